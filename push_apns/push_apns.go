@@ -0,0 +1,335 @@
+package push_apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler ApnsPush
+
+const (
+	DEFAULT_BUFFER = 32
+
+	PRODUCTION_HOST = "https://api.push.apple.com"
+	SANDBOX_HOST    = "https://api.sandbox.push.apple.com"
+
+	// Apple rejects tokens older than one hour and throttles tokens refreshed more often than every 20 minutes
+	TOKEN_LIFETIME = 50 * time.Minute
+
+	REQUEST_TIMEOUT = 10 * time.Second
+)
+
+type ApnsPush struct {
+	input chan *push.Receipt
+	stop  chan bool
+	done  chan bool
+	// Notifications being sent
+	sending sync.WaitGroup
+
+	// Key and config are replaced when the config is reloaded
+	lock   sync.RWMutex
+	key    *ecdsa.PrivateKey
+	config *configType
+	client *http.Client
+
+	// Cached authentication token
+	token       string
+	tokenIssued time.Time
+}
+
+type configType struct {
+	Disabled bool `json:"disabled"`
+	Buffer   int  `json:"buffer"`
+	// Path to the .p8 authentication key
+	KeyFile string `json:"key_file"`
+	// ID of the key
+	KeyId string `json:"key_id"`
+	// Apple developer team ID
+	TeamId string `json:"team_id"`
+	// Bundle ID of the app
+	Topic string `json:"topic"`
+	// Send to the development environment
+	Sandbox bool `json:"sandbox"`
+	// Seconds the notification is stored by APNs if the device is offline, 0 to deliver once
+	TimeToLive  int    `json:"time_to_live,omitempty"`
+	CollapseKey string `json:"collapse_key,omitempty"`
+	Sound       string `json:"sound,omitempty"`
+}
+
+// Initialize the handler
+func (*ApnsPush) Init(jsonconf string) error {
+
+	config, key, err := parseConfig(jsonconf)
+	if err != nil || config.Disabled {
+		return err
+	}
+
+	handler.key = key
+	handler.config = config
+	handler.client = &http.Client{Timeout: REQUEST_TIMEOUT}
+
+	if config.Buffer <= 0 {
+		config.Buffer = DEFAULT_BUFFER
+	}
+
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool, 1)
+	handler.done = make(chan bool)
+
+	// iOS devices get notifications from APNs only
+	push.ClaimPlatform("ios", "apns")
+
+	send := func(rcpt *push.Receipt) {
+		handler.sending.Add(1)
+		go func() {
+			sendNotification(rcpt)
+			handler.sending.Done()
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				send(rcpt)
+			case <-handler.stop:
+				// Send notifications already queued and wait for them to complete
+				for len(handler.input) > 0 {
+					send(<-handler.input)
+				}
+				handler.sending.Wait()
+				close(handler.done)
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// parseConfig parses the config and loads the authentication key.
+func parseConfig(jsonconf string) (*configType, *ecdsa.PrivateKey, error) {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return nil, nil, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if config.Disabled {
+		return &config, nil, nil
+	}
+
+	if config.KeyId == "" || config.TeamId == "" || config.Topic == "" {
+		return nil, nil, errors.New("key_id, team_id and topic are required")
+	}
+
+	raw, err := ioutil.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, nil, errors.New("failed to read key: " + err.Error())
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, nil, errors.New("key is not PEM-encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, errors.New("failed to parse key: " + err.Error())
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("key is not an ECDSA key")
+	}
+
+	return &config, key, nil
+}
+
+// Reload replaces the key and notification settings. Buffer size cannot be changed at runtime.
+func (*ApnsPush) Reload(jsonconf string) error {
+	config, key, err := parseConfig(jsonconf)
+	if err != nil {
+		return err
+	}
+
+	if config.Disabled {
+		return errors.New("cannot be disabled at runtime")
+	}
+
+	handler.lock.Lock()
+	handler.key = key
+	handler.config = config
+	handler.token = ""
+	handler.lock.Unlock()
+
+	return nil
+}
+
+// authToken returns the JWT signed with the key, creating a new one when the cached token expires.
+func authToken() (string, *configType, error) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	if handler.token != "" && time.Since(handler.tokenIssued) < TOKEN_LIFETIME {
+		return handler.token, handler.config, nil
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": handler.config.KeyId})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": handler.config.TeamId, "iat": now.Unix()})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, handler.key, hash[:])
+	if err != nil {
+		return "", nil, err
+	}
+	// The signature is r and s, each padded to 32 bytes
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	handler.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	handler.tokenIssued = now
+	return handler.token, handler.config, nil
+}
+
+func sendNotification(rcpt *push.Receipt) {
+	// List of UIDs for querying the database
+	uids := make([]t.Uid, len(rcpt.To))
+	skipDevices := make(map[string]bool)
+	for i, to := range rcpt.To {
+		uids[i] = to.User
+
+		// Some devices were online and received the message. Skip them.
+		for _, deviceId := range to.Devices {
+			skipDevices[deviceId] = true
+		}
+	}
+
+	token, config, err := authToken()
+	if err != nil {
+		return
+	}
+
+	body, err := json.Marshal(payload(rcpt, config))
+	if err != nil {
+		return
+	}
+
+	host := PRODUCTION_HOST
+	if config.Sandbox {
+		host = SANDBOX_HOST
+	}
+
+	// Devices are loaded one page of users at a time
+	store.Devices.ForEach(uids, "ios", func(devices []t.UserDevice) error {
+		for _, d := range devices {
+			if skipDevices[d.DeviceId] {
+				continue
+			}
+
+			if unregistered := sendToDevice(host, d.DeviceId, token, config, body); unregistered {
+				store.Devices.Delete(d.User, d.DeviceId)
+			}
+		}
+		return nil
+	})
+}
+
+// payload converts the receipt to the APNs payload. Fields of the receipt are sent as custom keys.
+func payload(rcpt *push.Receipt, config *configType) map[string]interface{} {
+	sound := config.Sound
+	if sound == "" {
+		sound = "default"
+	}
+
+	return map[string]interface{}{
+		"aps": map[string]interface{}{
+			// FIXME: the real plugin must understand the structure of the content to generate the text.
+			"alert": map[string]string{
+				"title": "New message",
+				"body":  "X sent a message"},
+			"sound":           sound,
+			"mutable-content": 1},
+		"topic": rcpt.Payload.Topic,
+		"xfrom": rcpt.Payload.From,
+		"ts":    rcpt.Payload.Timestamp,
+		"seq":   rcpt.Payload.SeqId}
+}
+
+// sendToDevice posts the notification to the device. Returns true if the device token is no longer valid.
+func sendToDevice(host, deviceId, token string, config *configType, body []byte) bool {
+	req, err := http.NewRequest(http.MethodPost, host+"/3/device/"+deviceId, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", config.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	// These are IM messages, they are high priority
+	req.Header.Set("apns-priority", "10")
+	if config.TimeToLive > 0 {
+		req.Header.Set("apns-expiration", strconv.FormatInt(time.Now().Unix()+int64(config.TimeToLive), 10))
+	} else {
+		req.Header.Set("apns-expiration", "0")
+	}
+	if config.CollapseKey != "" {
+		req.Header.Set("apns-collapse-id", config.CollapseKey)
+	}
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false
+	}
+	if resp.StatusCode == http.StatusGone {
+		return true
+	}
+
+	var result struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode == http.StatusBadRequest &&
+		(result.Reason == "BadDeviceToken" || result.Reason == "DeviceTokenNotForTopic")
+}
+
+// Check if the handler is initialized
+func (*ApnsPush) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push return a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (*ApnsPush) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop sends the queued notifications and stops the handler.
+func (*ApnsPush) Stop() {
+	handler.stop <- true
+	<-handler.done
+}
+
+func init() {
+	push.Register("apns", &handler)
+}
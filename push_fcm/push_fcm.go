@@ -3,6 +3,7 @@ package push_fcm
 import (
 	"encoding/json"
 	"errors"
+	"sync"
 	// "log"
 
 	"github.com/tinode/chat/server/push"
@@ -16,9 +17,16 @@ var handler FcmPush
 const DEFAULT_BUFFER = 32
 
 type FcmPush struct {
-	input  chan *push.Receipt
-	stop   chan bool
+	input chan *push.Receipt
+	stop  chan bool
+	done  chan bool
+	// Notifications being sent
+	sending sync.WaitGroup
+
+	// Client and config are replaced when the config is reloaded
+	lock   sync.RWMutex
 	client *fcm.Client
+	config *configType
 }
 
 type configType struct {
@@ -32,7 +40,7 @@ type configType struct {
 }
 
 // Initialize the handler
-func (FcmPush) Init(jsonconf string) error {
+func (*FcmPush) Init(jsonconf string) error {
 
 	var config configType
 	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
@@ -44,6 +52,7 @@ func (FcmPush) Init(jsonconf string) error {
 	}
 
 	handler.client = fcm.NewClient(config.ApiKey)
+	handler.config = &config
 
 	if config.Buffer <= 0 {
 		config.Buffer = DEFAULT_BUFFER
@@ -51,13 +60,28 @@ func (FcmPush) Init(jsonconf string) error {
 
 	handler.input = make(chan *push.Receipt, config.Buffer)
 	handler.stop = make(chan bool, 1)
+	handler.done = make(chan bool)
+
+	send := func(rcpt *push.Receipt) {
+		handler.sending.Add(1)
+		go func() {
+			sendNotification(rcpt)
+			handler.sending.Done()
+		}()
+	}
 
 	go func() {
 		for {
 			select {
 			case rcpt := <-handler.input:
-				go sendNotification(rcpt, &config)
+				send(rcpt)
 			case <-handler.stop:
+				// Send notifications already queued and wait for them to complete
+				for len(handler.input) > 0 {
+					send(<-handler.input)
+				}
+				handler.sending.Wait()
+				close(handler.done)
 				return
 			}
 		}
@@ -66,7 +90,30 @@ func (FcmPush) Init(jsonconf string) error {
 	return nil
 }
 
-func sendNotification(rcpt *push.Receipt, config *configType) {
+// Reload replaces the API key and notification settings. Buffer size cannot be changed at runtime.
+func (*FcmPush) Reload(jsonconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if config.Disabled {
+		return errors.New("cannot be disabled at runtime")
+	}
+
+	handler.lock.Lock()
+	handler.client = fcm.NewClient(config.ApiKey)
+	handler.config = &config
+	handler.lock.Unlock()
+
+	return nil
+}
+
+func sendNotification(rcpt *push.Receipt) {
+	handler.lock.RLock()
+	client, config := handler.client, handler.config
+	handler.lock.RUnlock()
+
 	// List of UIDs for querying the database
 	uids := make([]t.Uid, len(rcpt.To))
 	skipDevices := make(map[string]bool)
@@ -79,97 +126,93 @@ func sendNotification(rcpt *push.Receipt, config *configType) {
 		}
 	}
 
-	devices, count, err := store.Devices.GetAll(uids...)
-	if err != nil || count == 0 {
-		return
-	}
-
-	sendTo := make([]string, count)
-	i := 0
-	for _, devList := range devices {
-		for _, d := range devList {
-			if _, ok := skipDevices[d.DeviceId]; !ok {
-				sendTo[i] = d.DeviceId
-				i++
+	// Devices are loaded and notified one page of users at a time
+	store.Devices.ForEach(uids, "", func(devices []t.UserDevice) error {
+		// Inverse index to find the owners of failed tokens
+		devIds := make(map[string]t.Uid)
+		var sendTo []string
+		for _, d := range devices {
+			if !skipDevices[d.DeviceId] && !push.IsPlatformClaimed(d.Platform) {
+				sendTo = append(sendTo, d.DeviceId)
+				devIds[d.DeviceId] = d.User
 			}
 		}
-	}
-
-	msg := &fcm.HttpMessage{
-		To:               "",
-		RegistrationIds:  sendTo,
-		CollapseKey:      config.CollapseKey, // Optionally collapse several notification messages (i.e. "message sent")
-		Priority:         fcm.PriorityHigh,   // These are IM messages, they are high priority
-		ContentAvailable: true,               // to wake up the iOS app
-		TimeToLive:       &config.TimeToLive,
-		DryRun:           false,
-		// FIXME(gene): the real plugin must understand the structure of data to
-		// ensure it does not exceed 4KB. Messages on "me" are structured and must be converted to text first.
-		Data: rcpt.Payload,
-		Notification: &fcm.Notification{
-			Title:        "X sent a message",
-			Body:         "X sent a message",
-			Sound:        "default",
-			ClickAction:  "",
-			BodyLocKey:   "",
-			BodyLocArgs:  "",
-			TitleLocKey:  "",
-			TitleLocArgs: "",
-
-			// Android only
-			Icon:  config.Icon,
-			Tag:   "", // use some tag for coalesing notifications
-			Color: config.IconColor,
-
-			// iOS only
-			Badge: "",
-		},
-	}
+		if len(sendTo) == 0 {
+			return nil
+		}
 
-	resp, err := handler.client.SendHttp(msg)
-	if err != nil {
-		return
-	}
+		msg := &fcm.HttpMessage{
+			To:               "",
+			RegistrationIds:  sendTo,
+			CollapseKey:      config.CollapseKey, // Optionally collapse several notification messages (i.e. "message sent")
+			Priority:         fcm.PriorityHigh,   // These are IM messages, they are high priority
+			ContentAvailable: true,               // to wake up the iOS app
+			TimeToLive:       &config.TimeToLive,
+			DryRun:           false,
+			// FIXME(gene): the real plugin must understand the structure of data to
+			// ensure it does not exceed 4KB. Messages on "me" are structured and must be converted to text first.
+			Data: rcpt.Payload,
+			Notification: &fcm.Notification{
+				Title:        "X sent a message",
+				Body:         "X sent a message",
+				Sound:        "default",
+				ClickAction:  "",
+				BodyLocKey:   "",
+				BodyLocArgs:  "",
+				TitleLocKey:  "",
+				TitleLocArgs: "",
+
+				// Android only
+				Icon:  config.Icon,
+				Tag:   "", // use some tag for coalesing notifications
+				Color: config.IconColor,
+
+				// iOS only
+				Badge: "",
+			},
+		}
 
-	if resp.Fail > 0 {
-		// Generate an inverse index to speed up processing
-		devIds := make(map[string]t.Uid)
-		for uid, devList := range devices {
-			for _, d := range devList {
-				devIds[d.DeviceId] = uid
-			}
+		resp, err := client.SendHttp(msg)
+		if err != nil {
+			// Stop sending, the remaining pages would fail too
+			return err
 		}
 
-		i = 0
-		for _, fail := range resp.Results {
-			switch fail.Error {
-			case fcm.ErrorInvalidRegistration,
-				fcm.ErrorNotRegistered,
-				fcm.ErrorMismatchSenderId:
-				if uid, ok := devIds[sendTo[i]]; ok {
-					store.Devices.Delete(uid, sendTo[i])
-					// log.Printf("FCM push: %s; token removed: %s", fail.Error, sendTo[i])
+		if resp.Fail > 0 {
+			for i, fail := range resp.Results {
+				if i >= len(sendTo) {
+					break
+				}
+				switch fail.Error {
+				case fcm.ErrorInvalidRegistration,
+					fcm.ErrorNotRegistered,
+					fcm.ErrorMismatchSenderId:
+					if uid, ok := devIds[sendTo[i]]; ok {
+						store.Devices.Delete(uid, sendTo[i])
+						// log.Printf("FCM push: %s; token removed: %s", fail.Error, sendTo[i])
+					}
 				}
 			}
-			i++
 		}
-	}
-
+		return nil
+	})
 }
 
 // Initialize the handler
-func (FcmPush) IsReady() bool {
+func (*FcmPush) IsReady() bool {
 	return handler.input != nil
 }
 
 // Push return a channel that the server will use to send messages to.
 // If the adapter blocks, the message will be dropped.
-func (FcmPush) Push() chan<- *push.Receipt {
+func (*FcmPush) Push() chan<- *push.Receipt {
 	return handler.input
 }
 
-func (FcmPush) Stop() {
+// Stop sends the queued notifications and stops the handler.
+func (*FcmPush) Stop() {
 	handler.stop <- true
+	<-handler.done
 }
 
 func init() {
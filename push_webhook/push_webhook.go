@@ -0,0 +1,249 @@
+package push_webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+)
+
+var handler WebhookPush
+
+const (
+	DEFAULT_BUFFER = 32
+
+	// Default number of notifications sent at once
+	DEFAULT_WORKERS = 4
+
+	// Default timeout of the request in milliseconds
+	DEFAULT_TIMEOUT = 5000
+
+	// Delay before the first retry, doubled with every retry
+	RETRY_DELAY = time.Second
+)
+
+type WebhookPush struct {
+	input chan *push.Receipt
+	// Closed to stop the workers
+	stop chan bool
+	// Workers sending notifications
+	workers sync.WaitGroup
+
+	// Client and config are replaced when the config is reloaded
+	lock   sync.RWMutex
+	client *http.Client
+	config *configType
+}
+
+type configType struct {
+	Disabled bool `json:"disabled"`
+	Buffer   int  `json:"buffer"`
+	// Number of notifications sent at once
+	Workers int `json:"workers,omitempty"`
+	// Endpoint to POST notifications to
+	Url string `json:"url"`
+	// Secret used to sign requests
+	Secret string `json:"secret"`
+	// Request timeout in milliseconds
+	Timeout int `json:"timeout,omitempty"`
+	// Number of times a failed request is retried
+	Retries int `json:"retries,omitempty"`
+	// Send the content of the message, otherwise only the topic, sender, timestamp and seq ID are sent
+	IncludeContent bool `json:"include_content,omitempty"`
+	// Additional request headers, e.g. to authenticate with the receiving service
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Initialize the handler
+func (*WebhookPush) Init(jsonconf string) error {
+
+	config, err := parseConfig(jsonconf)
+	if err != nil || config.Disabled {
+		return err
+	}
+
+	handler.config = config
+	handler.client = &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond}
+
+	if config.Buffer <= 0 {
+		config.Buffer = DEFAULT_BUFFER
+	}
+	if config.Workers <= 0 {
+		config.Workers = DEFAULT_WORKERS
+	}
+
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool)
+
+	handler.workers.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go worker()
+	}
+
+	return nil
+}
+
+// worker sends notifications from the queue. When stopped, it sends notifications already queued
+// without retrying them.
+func worker() {
+	defer handler.workers.Done()
+
+	for {
+		select {
+		case rcpt := <-handler.input:
+			sendNotification(rcpt)
+		case <-handler.stop:
+			for {
+				select {
+				case rcpt := <-handler.input:
+					sendNotification(rcpt)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// parseConfig parses and validates the config.
+func parseConfig(jsonconf string) (*configType, error) {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return nil, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if config.Disabled {
+		return &config, nil
+	}
+
+	if u, err := url.Parse(config.Url); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("url must be a valid https URL")
+	}
+	if config.Secret == "" {
+		return nil, errors.New("secret is required")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DEFAULT_TIMEOUT
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+
+	return &config, nil
+}
+
+// Reload replaces the endpoint, secret and request settings. Buffer size and the number of workers
+// cannot be changed at runtime.
+func (*WebhookPush) Reload(jsonconf string) error {
+	config, err := parseConfig(jsonconf)
+	if err != nil {
+		return err
+	}
+
+	if config.Disabled {
+		return errors.New("cannot be disabled at runtime")
+	}
+
+	handler.lock.Lock()
+	handler.client = &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond}
+	handler.config = config
+	handler.lock.Unlock()
+
+	return nil
+}
+
+// sendNotification posts the receipt to the endpoint. Requests failed with network errors or
+// 5XX responses are retried with exponential backoff until the handler is stopped.
+func sendNotification(rcpt *push.Receipt) {
+	handler.lock.RLock()
+	client, config := handler.client, handler.config
+	handler.lock.RUnlock()
+
+	if !config.IncludeContent && rcpt.Payload.Content != nil {
+		copied := *rcpt
+		copied.Payload.Content = nil
+		rcpt = &copied
+	}
+
+	body, err := json.Marshal(rcpt)
+	if err != nil {
+		return
+	}
+
+	delay := RETRY_DELAY
+	for attempt := 0; attempt <= config.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-handler.stop:
+				return
+			}
+		}
+
+		if retry := post(client, config, body); !retry {
+			return
+		}
+	}
+}
+
+// post makes one request to the endpoint. Returns true if the request should be retried.
+// The time of the request in the X-Tinode-Timestamp header, unix seconds, and the body are signed
+// as "<timestamp>.<body>" with HMAC-SHA256 of the secret in the X-Tinode-Signature header, so
+// a captured request cannot be replayed later.
+func post(client *http.Client, config *configType, body []byte) bool {
+	req, err := http.NewRequest(http.MethodPost, config.Url, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	for name, val := range config.Headers {
+		req.Header.Set(name, val)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(config.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tinode-Timestamp", timestamp)
+	req.Header.Set("X-Tinode-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode >= 500
+}
+
+// Check if the handler is initialized
+func (*WebhookPush) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push return a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (*WebhookPush) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop sends the queued notifications and stops the handler.
+func (*WebhookPush) Stop() {
+	close(handler.stop)
+	handler.workers.Wait()
+}
+
+func init() {
+	push.Register("webhook", &handler)
+}
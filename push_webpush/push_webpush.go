@@ -0,0 +1,409 @@
+package push_webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler WebPush
+
+const (
+	DEFAULT_BUFFER = 32
+
+	// Push services reject VAPID tokens valid for more than 24 hours
+	TOKEN_LIFETIME = 12 * time.Hour
+	// A new token is created when the cached one expires in less than this
+	TOKEN_REFRESH = time.Hour
+
+	REQUEST_TIMEOUT = 10 * time.Second
+
+	// Size of the single record of the encrypted payload, RFC 8188
+	RECORD_SIZE = 4096
+)
+
+type WebPush struct {
+	input chan *push.Receipt
+	stop  chan bool
+	done  chan bool
+	// Notifications being sent
+	sending sync.WaitGroup
+
+	// Key and config are replaced when the config is reloaded
+	lock   sync.Mutex
+	key    *ecdsa.PrivateKey
+	config *configType
+	client *http.Client
+
+	// Cached VAPID tokens by the origin of the push service
+	tokens map[string]vapidToken
+}
+
+type vapidToken struct {
+	token   string
+	expires time.Time
+}
+
+type configType struct {
+	Disabled bool `json:"disabled"`
+	Buffer   int  `json:"buffer"`
+	// VAPID private key, base64url-encoded 32 bytes, e.g. as generated by `web-push generate-vapid-keys`
+	PrivateKey string `json:"private_key"`
+	// Contact of the application server, "mailto:" or "https:" URL
+	Subject string `json:"subject"`
+	// Seconds the notification is stored by the push service if the browser is offline
+	TimeToLive int `json:"time_to_live,omitempty"`
+}
+
+// Web Push subscription as returned by PushSubscription.toJSON() in the browser
+type subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// Initialize the handler
+func (*WebPush) Init(jsonconf string) error {
+
+	config, key, err := parseConfig(jsonconf)
+	if err != nil || config.Disabled {
+		return err
+	}
+
+	handler.key = key
+	handler.config = config
+	handler.client = &http.Client{Timeout: REQUEST_TIMEOUT}
+	handler.tokens = make(map[string]vapidToken)
+
+	if config.Buffer <= 0 {
+		config.Buffer = DEFAULT_BUFFER
+	}
+
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.stop = make(chan bool, 1)
+	handler.done = make(chan bool)
+
+	// Browsers get notifications from their push services only
+	push.ClaimPlatform("web", "webpush")
+
+	send := func(rcpt *push.Receipt) {
+		handler.sending.Add(1)
+		go func() {
+			sendNotification(rcpt)
+			handler.sending.Done()
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				send(rcpt)
+			case <-handler.stop:
+				// Send notifications already queued and wait for them to complete
+				for len(handler.input) > 0 {
+					send(<-handler.input)
+				}
+				handler.sending.Wait()
+				close(handler.done)
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// parseConfig parses the config and the VAPID key.
+func parseConfig(jsonconf string) (*configType, *ecdsa.PrivateKey, error) {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return nil, nil, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if config.Disabled {
+		return &config, nil, nil
+	}
+
+	if config.Subject == "" {
+		return nil, nil, errors.New("subject is required")
+	}
+
+	raw, err := decodeBase64(config.PrivateKey)
+	if err != nil || len(raw) != 32 {
+		return nil, nil, errors.New("private_key must be 32 bytes encoded as base64url")
+	}
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(raw)}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(raw)
+
+	return &config, key, nil
+}
+
+// Reload replaces the VAPID key and notification settings. Buffer size cannot be changed at runtime.
+func (*WebPush) Reload(jsonconf string) error {
+	config, key, err := parseConfig(jsonconf)
+	if err != nil {
+		return err
+	}
+
+	if config.Disabled {
+		return errors.New("cannot be disabled at runtime")
+	}
+
+	handler.lock.Lock()
+	handler.key = key
+	handler.config = config
+	handler.tokens = make(map[string]vapidToken)
+	handler.lock.Unlock()
+
+	return nil
+}
+
+// authHeader returns the VAPID Authorization header for the push service at the origin.
+func authHeader(origin string) (string, *configType, error) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	publicKey := base64.RawURLEncoding.EncodeToString(
+		elliptic.Marshal(elliptic.P256(), handler.key.X, handler.key.Y))
+
+	now := time.Now()
+	if cached, ok := handler.tokens[origin]; ok && cached.expires.Sub(now) > TOKEN_REFRESH {
+		return "vapid t=" + cached.token + ", k=" + publicKey, handler.config, nil
+	}
+
+	expires := now.Add(TOKEN_LIFETIME)
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": origin,
+		"exp": expires.Unix(),
+		"sub": handler.config.Subject})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, handler.key, hash[:])
+	if err != nil {
+		return "", nil, err
+	}
+	// The signature is r and s, each padded to 32 bytes
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	handler.tokens[origin] = vapidToken{token: token, expires: expires}
+	return "vapid t=" + token + ", k=" + publicKey, handler.config, nil
+}
+
+func sendNotification(rcpt *push.Receipt) {
+	// List of UIDs for querying the database
+	uids := make([]t.Uid, len(rcpt.To))
+	skipDevices := make(map[string]bool)
+	for i, to := range rcpt.To {
+		uids[i] = to.User
+
+		// Some devices were online and received the message. Skip them.
+		for _, deviceId := range to.Devices {
+			skipDevices[deviceId] = true
+		}
+	}
+
+	// The content is not sent: the payload of Web Push is limited to about 4KB.
+	body, err := json.Marshal(map[string]interface{}{
+		"topic": rcpt.Payload.Topic,
+		"xfrom": rcpt.Payload.From,
+		"ts":    rcpt.Payload.Timestamp,
+		"seq":   rcpt.Payload.SeqId})
+	if err != nil {
+		return
+	}
+
+	// Devices are loaded one page of users at a time
+	store.Devices.ForEach(uids, "web", func(devices []t.UserDevice) error {
+		for _, d := range devices {
+			if skipDevices[d.DeviceId] {
+				continue
+			}
+
+			var sub subscription
+			if err := json.Unmarshal([]byte(d.DeviceId), &sub); err != nil || sub.Endpoint == "" {
+				// Not a Web Push subscription, e.g. a FCM token registered by an older client
+				continue
+			}
+
+			if unsubscribed := sendToDevice(&sub, body); unsubscribed {
+				store.Devices.Delete(d.User, d.DeviceId)
+			}
+		}
+		return nil
+	})
+}
+
+// sendToDevice encrypts the payload for the subscription and posts it to the push service.
+// Returns true if the subscription is no longer valid.
+func sendToDevice(sub *subscription, payload []byte) bool {
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" {
+		return true
+	}
+
+	body, err := encrypt(sub, payload)
+	if err != nil {
+		// Malformed keys of the subscription
+		return true
+	}
+
+	auth, config, err := authHeader(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return false
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(config.TimeToLive))
+	// These are IM messages, they are high priority
+	req.Header.Set("Urgency", "high")
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	// 404 and 410 mean the subscription has expired or the user has unsubscribed
+	return resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone
+}
+
+// encrypt encrypts the payload for the subscription as described in RFC 8291.
+func encrypt(sub *subscription, payload []byte) ([]byte, error) {
+	uaPublic, err := decodeBase64(sub.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeBase64(sub.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil || len(authSecret) != 16 {
+		return nil, errors.New("invalid subscription keys")
+	}
+
+	// Ephemeral key of the application server
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	sx, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	sb := sx.Bytes()
+	copy(ecdhSecret[32-len(sb):], sb)
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// Combine the ECDH secret with the auth secret
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	// Content encryption key and nonce
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The payload is sent as a single record terminated by the 0x02 delimiter
+	plain := append(append(make([]byte, 0, len(payload)+1), payload...), 2)
+	if len(plain)+gcm.Overhead() > RECORD_SIZE {
+		return nil, errors.New("payload too large")
+	}
+
+	// Header: salt, record size, length of the key ID, key ID which is the public key of the server
+	header := make([]byte, 16+4+1)
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[16:], RECORD_SIZE)
+	header[20] = byte(len(asPublic))
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, plain, nil), nil
+}
+
+// hkdf derives a key of up to 32 bytes, RFC 5869.
+func hkdf(salt, secret, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// decodeBase64 decodes base64url with or without padding as sent by browsers.
+func decodeBase64(str string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+}
+
+// Check if the handler is initialized
+func (*WebPush) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push return a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (*WebPush) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Stop sends the queued notifications and stops the handler.
+func (*WebPush) Stop() {
+	handler.stop <- true
+	<-handler.done
+}
+
+func init() {
+	push.Register("webpush", &handler)
+}
@@ -0,0 +1,557 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Account management over plain HTTP for clients which don't keep a
+ *  websocket or long polling session, e.g. sign-up pages:
+ *    POST /v0/acc - register a new account with basic authentication and an
+ *      email address or a phone number;
+ *    POST /v0/acc/verify - confirm the credential with the code sent to it;
+ *    POST /v0/acc/resend - send a new confirmation code;
+ *    POST /v0/acc/cred - add a credential to the authenticated account;
+ *    POST /v0/acc/reset - send a password reset code to a confirmed credential;
+ *    POST /v0/acc/password - set a new password using the reset code.
+ *  Codes are delivered by validators, see package validate. Confirmed
+ *  credentials are added to user's tags if the tags are indexable.
+ *  Wrong codes are throttled by the login limiter per credential and per
+ *  IP address; the number of codes sent to one credential is capped too.
+ *  Unauthenticated requests don't tell if a credential is registered;
+ *  registrations are capped per IP address.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
+)
+
+const (
+	ACC_PATH = "/v0/acc"
+
+	// Lifetime of the code confirming a credential
+	ACC_CONFIRM_CODE_LIFETIME = 24 * time.Hour
+	// Lifetime of the password reset code
+	ACC_RESET_CODE_LIFETIME = time.Hour
+	// Number of failed attempts to enter the code before a new code must be requested
+	ACC_CODE_MAX_RETRIES = 3
+	// Minimum interval between codes sent to the same credential
+	ACC_CODE_RESEND_INTERVAL = time.Minute
+	// Maximum number of codes sent to the same credential in ACC_CODE_WINDOW
+	ACC_CODES_PER_WINDOW = 5
+	ACC_CODE_WINDOW      = 24 * time.Hour
+	// Maximum number of accounts registered from the same IP address in ACC_REGISTER_WINDOW
+	ACC_REGISTER_PER_WINDOW = 10
+	ACC_REGISTER_WINDOW     = time.Hour
+)
+
+// Body of account requests. Not all fields are used by every request.
+type accRequest struct {
+	// Login and password for basic authentication
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// Credential to register with
+	Email string `json:"email"`
+	Tel   string `json:"tel"`
+	// Credential to verify, resend the code to or reset the password with
+	Method string `json:"method"`
+	Value  string `json:"value"`
+	Code   string `json:"code"`
+	// Public description and tags of the new account
+	Public interface{} `json:"public"`
+	Tags   []string    `json:"tags"`
+}
+
+// Codes sent to one credential or accounts registered from one address in the current window
+type accCodesSent struct {
+	Count int   `json:"count"`
+	Since int64 `json:"since"`
+}
+
+// accInit registers account endpoints.
+func accInit() {
+	http.HandleFunc(ACC_PATH, serveAccount)
+	http.HandleFunc(ACC_PATH+"/", serveAccount)
+}
+
+// accCodeHash returns the form of the code stored in the database.
+func accCodeHash(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// accNewCode generates a random 6-digit code.
+func accNewCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// accPreCheck normalizes the credential. Returns nil validator if the method is unknown or the value is invalid.
+func accPreCheck(method, value string) (validate.Validator, string) {
+	v := validate.Get(method)
+	if v == nil {
+		return nil, ""
+	}
+	value, err := v.PreCheck(value)
+	if err != nil {
+		return nil, ""
+	}
+	return v, value
+}
+
+// accSendCode generates a new code for the credential, saves it and delivers it to the user.
+func accSendCode(v validate.Validator, cred *types.Credential, purpose string) error {
+	code, err := accNewCode()
+	if err != nil {
+		return err
+	}
+
+	lifetime := ACC_CONFIRM_CODE_LIFETIME
+	if purpose == "reset" {
+		lifetime = ACC_RESET_CODE_LIFETIME
+	}
+	cred.Code = accCodeHash(code)
+	cred.Purpose = purpose
+	cred.CodeExpires = types.TimeNow().Add(lifetime)
+	cred.Retries = 0
+	if err = store.Credentials.Upsert(cred); err != nil {
+		return err
+	}
+
+	return v.Send(cred.Value, code, purpose)
+}
+
+// accLimitKeys returns the keys of the login limiter counters of the credential and the address.
+func accLimitKeys(method, value, remoteAddr string) []string {
+	keys := loginLimitKeys("", nil, remoteAddr)
+	if value != "" {
+		keys = append(keys, "login:acc:"+method+":"+value)
+	}
+	return keys
+}
+
+// accCodeQuota counts the code about to be sent to the credential. Returns the time left until
+// the next code may be sent if too many were sent already, zero otherwise.
+func accCodeQuota(method, value string) time.Duration {
+	return accQuota("acc:codes:"+method+":"+value, ACC_CODES_PER_WINDOW, ACC_CODE_WINDOW)
+}
+
+// accRegisterQuota counts the account about to be registered from the address. Returns the time left
+// until the next account may be registered if too many were registered already, zero otherwise.
+func accRegisterQuota(remoteAddr string) time.Duration {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return accQuota("acc:register:"+host, ACC_REGISTER_PER_WINDOW, ACC_REGISTER_WINDOW)
+}
+
+// accQuota counts an event in the window of the key. Returns the time left until the window ends
+// if the limit is reached already, zero otherwise.
+func accQuota(key string, limit int, window time.Duration) time.Duration {
+	loginLimit.lock.Lock()
+	defer loginLimit.lock.Unlock()
+
+	now := time.Now()
+	var sent accCodesSent
+	if data, ok := loginLimit.cache.Get(key); ok {
+		json.Unmarshal(data, &sent)
+	}
+	end := time.Unix(sent.Since, 0).Add(window)
+	if end.Before(now) {
+		sent = accCodesSent{Since: now.Unix()}
+		end = now.Add(window)
+	}
+	if sent.Count >= limit {
+		return end.Sub(now)
+	}
+
+	sent.Count++
+	if data, err := json.Marshal(&sent); err == nil {
+		loginLimit.cache.Set(key, data, end.Sub(now))
+	}
+	return 0
+}
+
+// accResendTooSoon checks if a code was sent to the credential very recently.
+func accResendTooSoon(cred *types.Credential) bool {
+	return cred.Code != "" && cred.UpdatedAt.Add(ACC_CODE_RESEND_INTERVAL).After(types.TimeNow())
+}
+
+// accCheckCode checks the code entered by the user. Failed attempts are counted, the code is
+// cleared once used.
+func accCheckCode(cred *types.Credential, purpose, code string) (bool, error) {
+	if cred.Code == "" || cred.Purpose != purpose || cred.Retries >= ACC_CODE_MAX_RETRIES ||
+		cred.CodeExpires.Before(types.TimeNow()) {
+		return false, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(cred.Code), []byte(accCodeHash(code))) != 1 {
+		cred.Retries++
+		return false, store.Credentials.Upsert(cred)
+	}
+
+	cred.Code = ""
+	cred.Purpose = ""
+	cred.Retries = 0
+	return true, nil
+}
+
+// accAddCredTag adds the confirmed credential to user's tags if such tags are indexable.
+func accAddCredTag(cred *types.Credential) error {
+	uid := types.ParseUid(cred.User)
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return nil
+	}
+
+	var tags []string
+	if filterTags(&tags, []string{cred.Method + ":" + cred.Value}) == 0 {
+		return nil
+	}
+	for _, tag := range user.Tags {
+		if tag == tags[0] {
+			return nil
+		}
+	}
+	return store.Users.Update(uid, map[string]interface{}{"Tags": append(user.Tags, tags[0])})
+}
+
+// accCredAvailable checks if the credential can be claimed by the user: it does not exist,
+// belongs to the same user or is an expired unconfirmed credential of someone else.
+func accCredAvailable(cred *types.Credential, uid types.Uid) bool {
+	return cred == nil || cred.User == uid.String() ||
+		(!cred.Done && cred.CodeExpires.Before(types.TimeNow()))
+}
+
+// serveAccount dispatches account requests.
+func serveAccount(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	var body accRequest
+	req.Body = http.MaxBytesReader(wrt, req.Body, maxMessageSize())
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+
+	var reply *ServerComMessage
+	switch strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, ACC_PATH), "/") {
+	case "":
+		reply = accRegister(&body, req.RemoteAddr, now)
+	case "/verify":
+		reply = accVerify(&body, req.RemoteAddr, now)
+	case "/resend":
+		reply = accResend(&body, req.RemoteAddr, now)
+	case "/cred":
+		if uid, err := authHttpRequest(req); err != nil {
+			reply = ErrAuthFailed("", "", now)
+		} else {
+			reply = accAddCred(uid, &body, now)
+		}
+	case "/reset":
+		reply = accReset(&body, req.RemoteAddr, now)
+	case "/password":
+		reply = accPassword(&body, req.RemoteAddr, now)
+	default:
+		reply = ErrNotFound("", "", now)
+	}
+
+	wrt.WriteHeader(reply.Ctrl.Code)
+	enc.Encode(reply)
+}
+
+// accRegister creates a new account with basic authentication and an unconfirmed credential.
+// If the credential is registered already, no account is created but the response is the same.
+func accRegister(body *accRequest, remoteAddr string, now time.Time) *ServerComMessage {
+	method, value := "email", body.Email
+	if value == "" {
+		method, value = "tel", body.Tel
+	}
+	v, value := accPreCheck(method, value)
+	if v == nil || body.Login == "" || body.Password == "" {
+		return ErrMalformed("", "", now)
+	}
+
+	if retry := accRegisterQuota(remoteAddr); retry > 0 {
+		return ErrTooManyRequests("", "", now, retry)
+	}
+
+	// The response is the same whether the credential is available or not
+	reply := NoErrAccepted("", "", now)
+	reply.Ctrl.Params = map[string]interface{}{
+		"cred": map[string]interface{}{"meth": method, "val": value, "done": false},
+	}
+
+	authhdl := store.GetAuthHandler("basic")
+	secret := []byte(body.Login + ":" + body.Password)
+	if ok, authErr := authhdl.IsUnique(secret); !ok {
+		return decodeAuthError(authErr.Code, "", now)
+	}
+
+	if cred, err := store.Credentials.Get(method, value); err != nil {
+		return ErrUnknown("", "", now)
+	} else if !accCredAvailable(cred, types.ZeroUid) {
+		logSession.Infof("acc: registration with a taken credential %s:%s from %s", method, value, remoteAddr)
+		return reply
+	}
+
+	var user types.User
+	user.Access.Auth = getDefaultAccess(types.TopicCat_P2P, true)
+	user.Access.Anon = getDefaultAccess(types.TopicCat_P2P, false)
+	if !isNullValue(body.Public) {
+		user.Public = body.Public
+	}
+	if len(body.Tags) > 0 {
+		tags := make([]string, 0, len(body.Tags))
+		if filterTags(&tags, body.Tags) > 0 {
+			user.Tags = tags
+		}
+	}
+
+	if reject := pluginAccount(&user, "", now); reject != nil {
+		return reject
+	}
+
+	if _, err := store.Users.Create(&user, nil); err != nil {
+		return ErrUnknown("", "", now)
+	}
+
+	if _, authErr := authhdl.AddRecord(user.Uid(), secret, 0); authErr.IsError() {
+		logSession.Info(authErr.Err)
+		// Attempt to delete incomplete user record
+		store.Users.Delete(user.Uid(), false)
+		return decodeAuthError(authErr.Code, "", now)
+	}
+
+	cred := &types.Credential{User: user.Uid().String(), Method: method, Value: value}
+	if accCodeQuota(method, value) > 0 {
+		logSession.Warnf("acc: too many codes sent to %s:%s", method, value)
+	} else if err := accSendCode(v, cred, "confirm"); err != nil {
+		// The user can request the code again
+		logSession.Warnf("acc: failed to send confirmation code to %s: %v", cred.Id, err)
+	}
+	return reply
+}
+
+// accVerify confirms the credential with the code.
+func accVerify(body *accRequest, remoteAddr string, now time.Time) *ServerComMessage {
+	v, value := accPreCheck(body.Method, body.Value)
+	if v == nil || body.Code == "" {
+		return ErrMalformed("", "", now)
+	}
+
+	limitKeys := accLimitKeys(body.Method, value, remoteAddr)
+	if retry := loginLockedOut(limitKeys); retry > 0 {
+		return ErrTooManyRequests("", "", now, retry)
+	}
+
+	cred, err := store.Credentials.Get(body.Method, value)
+	if err != nil {
+		return ErrUnknown("", "", now)
+	}
+	if cred == nil {
+		return ErrNotFound("", "", now)
+	}
+	if cred.Done {
+		return NoErr("", "", now)
+	}
+
+	if ok, err := accCheckCode(cred, "confirm", body.Code); err != nil {
+		return ErrUnknown("", "", now)
+	} else if !ok {
+		loginFailed(limitKeys)
+		return ErrAuthFailed("", "", now)
+	}
+	loginSucceeded(limitKeys)
+
+	cred.Done = true
+	if err = store.Credentials.Upsert(cred); err != nil {
+		return ErrUnknown("", "", now)
+	}
+	if err = accAddCredTag(cred); err != nil {
+		logSession.Warnf("acc: failed to add tag for %s: %v", cred.Id, err)
+	}
+
+	return NoErr("", "", now)
+}
+
+// accResend sends a new confirmation code to an unconfirmed credential. Missing and confirmed credentials
+// get the same response.
+func accResend(body *accRequest, remoteAddr string, now time.Time) *ServerComMessage {
+	v, value := accPreCheck(body.Method, body.Value)
+	if v == nil {
+		return ErrMalformed("", "", now)
+	}
+	if retry := loginLockedOut(accLimitKeys(body.Method, value, remoteAddr)); retry > 0 {
+		return ErrTooManyRequests("", "", now, retry)
+	}
+
+	cred, err := store.Credentials.Get(body.Method, value)
+	if err != nil {
+		return ErrUnknown("", "", now)
+	}
+	if cred == nil || cred.Done {
+		return NoErrAccepted("", "", now)
+	}
+	if accResendTooSoon(cred) {
+		return ErrPolicy("", "", now)
+	}
+	if retry := accCodeQuota(body.Method, value); retry > 0 {
+		return ErrTooManyRequests("", "", now, retry)
+	}
+
+	if err = accSendCode(v, cred, "confirm"); err != nil {
+		logSession.Warnf("acc: failed to send confirmation code to %s: %v", cred.Id, err)
+		return ErrUnknown("", "", now)
+	}
+	return NoErrAccepted("", "", now)
+}
+
+// accAddCred adds an unconfirmed credential to the account of the authenticated user.
+func accAddCred(uid types.Uid, body *accRequest, now time.Time) *ServerComMessage {
+	v, value := accPreCheck(body.Method, body.Value)
+	if v == nil {
+		return ErrMalformed("", "", now)
+	}
+
+	cred, err := store.Credentials.Get(body.Method, value)
+	if err != nil {
+		return ErrUnknown("", "", now)
+	}
+	if !accCredAvailable(cred, uid) {
+		return ErrDuplicateCredential("", "", now)
+	}
+	if cred != nil && cred.User == uid.String() {
+		if cred.Done {
+			return NoErr("", "", now)
+		}
+		if accResendTooSoon(cred) {
+			return ErrPolicy("", "", now)
+		}
+	} else {
+		cred = &types.Credential{User: uid.String(), Method: body.Method, Value: value}
+	}
+	if retry := accCodeQuota(body.Method, value); retry > 0 {
+		return ErrTooManyRequests("", "", now, retry)
+	}
+
+	if err = accSendCode(v, cred, "confirm"); err != nil {
+		logSession.Warnf("acc: failed to send confirmation code to %s: %v", cred.Id, err)
+		return ErrUnknown("", "", now)
+	}
+	return NoErrAccepted("", "", now)
+}
+
+// accReset sends a password reset code to the confirmed credential. The response is the same
+// whether the credential exists or not so it cannot be used to find registered users.
+func accReset(body *accRequest, remoteAddr string, now time.Time) *ServerComMessage {
+	v, value := accPreCheck(body.Method, body.Value)
+	if v == nil {
+		return ErrMalformed("", "", now)
+	}
+	if retry := loginLockedOut(accLimitKeys(body.Method, value, remoteAddr)); retry > 0 {
+		return ErrTooManyRequests("", "", now, retry)
+	}
+
+	cred, err := store.Credentials.Get(body.Method, value)
+	if err != nil {
+		return ErrUnknown("", "", now)
+	}
+	if cred != nil && cred.Done && !accResendTooSoon(cred) && accCodeQuota(body.Method, value) == 0 {
+		if err = accSendCode(v, cred, "reset"); err != nil {
+			logSession.Warnf("acc: failed to send reset code to %s: %v", cred.Id, err)
+		}
+	}
+	return NoErrAccepted("", "", now)
+}
+
+// accPassword sets a new password of the basic login using the reset code.
+func accPassword(body *accRequest, remoteAddr string, now time.Time) *ServerComMessage {
+	v, value := accPreCheck(body.Method, body.Value)
+	if v == nil || body.Code == "" || body.Login == "" || body.Password == "" {
+		return ErrMalformed("", "", now)
+	}
+
+	limitKeys := accLimitKeys(body.Method, value, remoteAddr)
+	if retry := loginLockedOut(limitKeys); retry > 0 {
+		return ErrTooManyRequests("", "", now, retry)
+	}
+
+	cred, err := store.Credentials.Get(body.Method, value)
+	if err != nil {
+		return ErrUnknown("", "", now)
+	}
+	if cred == nil || !cred.Done {
+		loginFailed(limitKeys)
+		return ErrAuthFailed("", "", now)
+	}
+
+	if ok, err := accCheckCode(cred, "reset", body.Code); err != nil {
+		return ErrUnknown("", "", now)
+	} else if !ok {
+		loginFailed(limitKeys)
+		return ErrAuthFailed("", "", now)
+	}
+	loginSucceeded(limitKeys)
+
+	// The code is used up even if the login or the password is rejected
+	if err = store.Credentials.Upsert(cred); err != nil {
+		return ErrUnknown("", "", now)
+	}
+
+	uid, _, _, _, err := store.Users.GetAuthRecord("basic", strings.ToLower(body.Login))
+	if err != nil {
+		return ErrUnknown("", "", now)
+	}
+	if uid.String() != cred.User {
+		return ErrAuthFailed("", "", now)
+	}
+
+	secret := []byte(body.Login + ":" + body.Password)
+	if authErr := store.GetAuthHandler("basic").UpdateRecord(uid, secret, 0); authErr.IsError() {
+		return decodeAuthError(authErr.Code, "", now)
+	}
+	return NoErr("", "", now)
+}
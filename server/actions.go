@@ -0,0 +1,260 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Actionable messages. A message with head.action set carries a typed
+ *  action payload, such as a payment request or a ticket. Users respond to
+ *  it with {set action}; the server forwards the response to the external
+ *  endpoint configured for the action type and relays the endpoint's
+ *  decision back to the user. The server itself holds no action logic.
+ *
+ *  Requests to endpoints are signed with HMAC-SHA256 of the body and carry
+ *  an idempotency key which is the same for repeated identical responses.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default timeout of a request to the action endpoint
+	ACTION_DEFAULT_TIMEOUT = 5 * time.Second
+	// Maximum length of the response name
+	ACTION_MAX_RESPONSE_LENGTH = 64
+)
+
+type actionConfig struct {
+	// Action type, the value of head.action
+	Type string `json:"type"`
+	// URL of the endpoint which handles the responses
+	Url string `json:"url"`
+	// Secret used to sign requests to the endpoint
+	Secret string `json:"secret"`
+	// Request timeout in milliseconds
+	Timeout int `json:"timeout"`
+}
+
+type actionHandler struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// actionRequest is sent to the endpoint.
+type actionRequest struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"ts"`
+	// Topic and ID of the actionable message
+	Topic string `json:"topic"`
+	SeqId int    `json:"seq"`
+	// Author of the actionable message
+	From string `json:"from"`
+	// Content of the actionable message
+	Content interface{} `json:"content"`
+	// User who responded
+	User string `json:"user"`
+	// The response and optional data
+	Response string      `json:"resp"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// actionResponse is the endpoint's decision relayed to the user.
+type actionResponse struct {
+	Code   int         `json:"code"`
+	Text   string      `json:"text,omitempty"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+var actionHandlers map[string]*actionHandler
+
+// actionsInit parses config of action endpoints.
+func actionsInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config []actionConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logActions.Fatal("Failed to parse actions config:", err)
+	}
+
+	actionHandlers = make(map[string]*actionHandler, len(config))
+	for _, conf := range config {
+		if conf.Type == "" || conf.Url == "" {
+			logActions.Fatal("Action type and url are required")
+		}
+		if conf.Secret == "" {
+			logActions.Fatal("Missing secret of action '" + conf.Type + "'")
+		}
+		if _, dup := actionHandlers[conf.Type]; dup {
+			logActions.Fatal("Action '" + conf.Type + "' is configured twice")
+		}
+
+		timeout := time.Duration(conf.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = ACTION_DEFAULT_TIMEOUT
+		}
+		actionHandlers[conf.Type] = &actionHandler{
+			url:    conf.Url,
+			secret: []byte(conf.Secret),
+			client: &http.Client{Timeout: timeout}}
+		logActions.Infof("Forwarding '%s' actions to %s", conf.Type, conf.Url)
+	}
+}
+
+// actionGetHandler returns the handler of the action type or nil if the type is not configured.
+func actionGetHandler(action string) *actionHandler {
+	return actionHandlers[action]
+}
+
+// replySetAction forwards user's response to the actionable message in response to set.action.
+// The endpoint is called in the background; its decision is sent to the session when available.
+func (t *Topic) replySetAction(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+	action := set.Action
+	original := t.original(sess.uid)
+
+	pud := t.perUser[sess.uid]
+	if !(pud.modeGiven & pud.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDenied(set.Id, original, now))
+		return errors.New("attempt to respond to action without read access")
+	}
+
+	if action.SeqId <= pud.clearId || action.SeqId > t.lastId ||
+		action.Response == "" || len(action.Response) > ACTION_MAX_RESPONSE_LENGTH {
+		sess.queueOut(ErrMalformed(set.Id, original, now))
+		return errors.New("invalid action response")
+	}
+
+	messages, err := store.Messages.GetAll(t.name, sess.uid,
+		&types.BrowseOpt{Since: action.SeqId, Before: action.SeqId + 1, Limit: 1})
+	if err != nil {
+		sess.queueOut(ErrUnknown(set.Id, original, now))
+		return err
+	}
+	if len(messages) == 0 || messages[0].DeletedAt != nil || messages[0].Head["action"] == "" {
+		sess.queueOut(ErrNotFound(set.Id, original, now))
+		return errors.New("actionable message not found")
+	}
+	msg := &messages[0]
+
+	hnd := actionGetHandler(msg.Head["action"])
+	if hnd == nil {
+		sess.queueOut(ErrOperationNotAllowed(set.Id, original, now))
+		return errors.New("action '" + msg.Head["action"] + "' is not configured")
+	}
+
+	// The message may restrict the responses
+	if content, ok := msg.Content.(map[string]interface{}); ok {
+		if allowed, ok := content["responses"].([]interface{}); ok && !actionIsAllowed(allowed, action.Response) {
+			sess.queueOut(ErrMalformed(set.Id, original, now))
+			return errors.New("response is not allowed")
+		}
+	}
+
+	req := &actionRequest{
+		Type:      msg.Head["action"],
+		Timestamp: now,
+		Topic:     t.name,
+		SeqId:     msg.SeqId,
+		From:      types.ParseUid(msg.From).UserId(),
+		Content:   msg.Content,
+		User:      sess.uid.UserId(),
+		Response:  action.Response,
+		Data:      action.Data}
+
+	go func() {
+		resp, err := hnd.call(req)
+		if err != nil {
+			logActions.Warnf("topic[%s]: action '%s' failed: %v", req.Topic, req.Type, err)
+			sess.queueOut(ErrUnknown(set.Id, original, types.TimeNow()))
+			return
+		}
+
+		code := resp.Code
+		if code < 200 || code > 599 {
+			code = http.StatusOK
+		}
+		text := resp.Text
+		if text == "" {
+			text = http.StatusText(code)
+		}
+		sess.queueOut(&ServerComMessage{Ctrl: &MsgServerCtrl{
+			Id:        set.Id,
+			Code:      code,
+			Text:      text,
+			Topic:     original,
+			Params:    resp.Params,
+			Timestamp: types.TimeNow()}})
+	}()
+
+	return nil
+}
+
+func actionIsAllowed(allowed []interface{}, response string) bool {
+	for _, r := range allowed {
+		if r, ok := r.(string); ok && r == response {
+			return true
+		}
+	}
+	return false
+}
+
+// actionIdempotencyKey is the same for the same response of the same user to the same message.
+func actionIdempotencyKey(req *actionRequest) string {
+	hash := sha256.Sum256([]byte(req.Topic + ":" + strconv.Itoa(req.SeqId) + ":" + req.User + ":" + req.Response))
+	return hex.EncodeToString(hash[:])
+}
+
+// call posts the request to the endpoint. The body is signed with HMAC-SHA256, the signature is
+// sent in the X-Tinode-Signature header.
+func (ah *actionHandler) call(req *actionRequest) (*actionResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, ah.secret)
+	mac.Write(body)
+
+	hreq, err := http.NewRequest(http.MethodPost, ah.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("Idempotency-Key", actionIdempotencyKey(req))
+	hreq.Header.Set("X-Tinode-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := ah.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return nil, errors.New("unexpected response status " + resp.Status)
+	}
+
+	var result actionResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Code == 0 {
+		result.Code = resp.StatusCode
+	}
+	return &result, nil
+}
@@ -13,7 +13,6 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"encoding/base64"
-	"log"
 )
 
 // 32 random bytes to be used for signing auth tokens
@@ -53,11 +52,11 @@ func checkApiKey(apikey string) (isValid, isRoot bool) {
 
 	data, err := base64.URLEncoding.DecodeString(apikey)
 	if err != nil {
-		log.Println("failed to decode.base64 appid ", err)
+		logHttp.Warn("failed to decode.base64 appid", err)
 		return
 	}
 	if data[0] != 1 {
-		log.Println("unknown appid signature algorithm ", data[0])
+		logHttp.Warn("unknown appid signature algorithm", data[0])
 		return
 	}
 
@@ -65,7 +64,7 @@ func checkApiKey(apikey string) (isValid, isRoot bool) {
 	hasher.Write(data[:APIKEY_VERSION+APIKEY_APPID+APIKEY_SEQUENCE+APIKEY_WHO])
 	check := hasher.Sum(nil)
 	if !bytes.Equal(data[APIKEY_VERSION+APIKEY_APPID+APIKEY_SEQUENCE+APIKEY_WHO:], check) {
-		log.Println("invalid apikey signature")
+		logHttp.Warn("invalid apikey signature")
 		return
 	}
 
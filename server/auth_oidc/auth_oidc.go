@@ -0,0 +1,369 @@
+package auth_oidc
+
+// OpenID Connect authentication. The client signs in with an identity provider, such as Google,
+// Okta or Keycloak, and presents the ID token as the secret. The token's signature is checked
+// against the provider's published keys, then the subject of the token is mapped to a Tinode account.
+// The account is created on the first login if the issuer allows it.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Allowed difference between the clocks of the server and the provider
+	clock_leeway = time.Minute
+	// Default maximum age of the provider's keys
+	default_keys_max_age = 24 * time.Hour
+)
+
+// Accepted identity provider
+type issuer struct {
+	// Short name of the provider used in auth records, e.g. "google"
+	name string
+	// Accepted audiences: client IDs of the applications registered with the provider
+	audience []string
+	// Create an account when an unknown user signs in
+	createAccounts bool
+	keys           *keySet
+}
+
+type OidcAuth struct{}
+
+// Accepted issuers by the value of the "iss" claim
+var issuers map[string]*issuer
+
+// Claims of the ID token used by the server
+type idClaims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      interface{} `json:"aud"`
+	Expires       int64       `json:"exp"`
+	NotBefore     int64       `json:"nbf"`
+	Name          string      `json:"name"`
+	Email         string      `json:"email"`
+	EmailVerified bool        `json:"email_verified"`
+}
+
+func (OidcAuth) Init(jsonconf string) error {
+	if issuers != nil {
+		return errors.New("auth_oidc: already initialized")
+	}
+
+	type issuerConfig struct {
+		// Value of the "iss" claim, e.g. "https://accounts.google.com"
+		Issuer string `json:"issuer"`
+		// Short unique name of the issuer
+		Name string `json:"name"`
+		// Client IDs accepted in the "aud" claim
+		ClientIds []string `json:"client_ids"`
+		// JWKS URL; discovered from the issuer if blank
+		JwksUrl string `json:"jwks_url"`
+		// Maximum age of the keys in seconds
+		KeysMaxAge int `json:"keys_max_age"`
+		// Create accounts for unknown users
+		CreateAccounts bool `json:"create_accounts"`
+	}
+	var config struct {
+		Issuers []issuerConfig `json:"issuers"`
+	}
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("auth_oidc: failed to parse config: " + err.Error())
+	}
+	if len(config.Issuers) == 0 {
+		return errors.New("auth_oidc: no issuers configured")
+	}
+
+	names := make(map[string]bool)
+	issuers = make(map[string]*issuer, len(config.Issuers))
+	for _, conf := range config.Issuers {
+		if conf.Issuer == "" || conf.Name == "" || strings.Contains(conf.Name, ":") || len(conf.ClientIds) == 0 {
+			return errors.New("auth_oidc: issuer, name and client_ids are required, name must not contain ':'")
+		}
+		if issuers[conf.Issuer] != nil || names[conf.Name] {
+			return errors.New("auth_oidc: duplicate issuer " + conf.Issuer)
+		}
+		maxAge := time.Duration(conf.KeysMaxAge) * time.Second
+		if maxAge <= 0 {
+			maxAge = default_keys_max_age
+		}
+		names[conf.Name] = true
+		issuers[conf.Issuer] = &issuer{
+			name:           conf.Name,
+			audience:       conf.ClientIds,
+			createAccounts: conf.CreateAccounts,
+			keys:           &keySet{issuer: conf.Issuer, url: conf.JwksUrl, maxAge: maxAge}}
+	}
+
+	return nil
+}
+
+// verifyToken checks the signature and the claims of the ID token.
+func verifyToken(token []byte) (*issuer, *idClaims, auth.AuthErr) {
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return nil, nil, auth.NewErr(auth.ErrMalformed, errors.New("oidc auth: malformed token"))
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims idClaims
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil, auth.NewErr(auth.ErrMalformed, err)
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, nil, auth.NewErr(auth.ErrMalformed, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, auth.NewErr(auth.ErrMalformed, err)
+	}
+
+	iss := issuers[claims.Issuer]
+	if iss == nil {
+		return nil, nil, auth.NewErr(auth.ErrFailed, errors.New("oidc auth: unknown issuer '"+claims.Issuer+"'"))
+	}
+
+	key, err := iss.keys.key(header.Kid)
+	if err != nil {
+		return nil, nil, auth.NewErr(auth.ErrFailed, errors.New("oidc auth: "+err.Error()))
+	}
+	if err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, nil, auth.NewErr(auth.ErrFailed, errors.New("oidc auth: "+err.Error()))
+	}
+
+	now := time.Now()
+	if claims.Expires == 0 || time.Unix(claims.Expires, 0).Add(clock_leeway).Before(now) {
+		return nil, nil, auth.NewErr(auth.ErrExpired, errors.New("oidc auth: expired token"))
+	}
+	if claims.NotBefore != 0 && time.Unix(claims.NotBefore, 0).Add(-clock_leeway).After(now) {
+		return nil, nil, auth.NewErr(auth.ErrFailed, errors.New("oidc auth: token is not valid yet"))
+	}
+	if claims.Subject == "" {
+		return nil, nil, auth.NewErr(auth.ErrMalformed, errors.New("oidc auth: missing subject"))
+	}
+	if !iss.accepts(claims.Audience) {
+		return nil, nil, auth.NewErr(auth.ErrFailed, errors.New("oidc auth: token issued to another client"))
+	}
+
+	return iss, &claims, auth.NewErr(auth.NoErr, nil)
+}
+
+// accepts checks if the "aud" claim, a string or an array of strings, contains one of the client IDs.
+func (iss *issuer) accepts(aud interface{}) bool {
+	var audience []string
+	switch aud := aud.(type) {
+	case string:
+		audience = []string{aud}
+	case []interface{}:
+		for _, val := range aud {
+			if str, ok := val.(string); ok {
+				audience = append(audience, str)
+			}
+		}
+	}
+
+	for _, val := range audience {
+		for _, id := range iss.audience {
+			if val == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, result interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return errors.New("unsupported algorithm " + alg)
+	}
+
+	var hasher hash.Hash
+	var hashId crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hasher, hashId = sha256.New(), crypto.SHA256
+	case "384":
+		hasher, hashId = sha512.New384(), crypto.SHA384
+	case "512":
+		hasher, hashId = sha512.New(), crypto.SHA512
+	default:
+		return errors.New("unsupported algorithm " + alg)
+	}
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hashId, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(key, hashId, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" {
+			// The signature is r and s of the curve's size each
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				return errors.New("invalid signature")
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	}
+	return errors.New("algorithm " + alg + " does not match the key")
+}
+
+// unique returns the unique part of the auth record of the token's subject.
+func (iss *issuer) unique(claims *idClaims) string {
+	return iss.name + ":" + claims.Subject
+}
+
+// AddRecord links the identity from the ID token to an existing account.
+func (OidcAuth) AddRecord(uid types.Uid, secret []byte, lifetime time.Duration) (int, auth.AuthErr) {
+	iss, claims, authErr := verifyToken(secret)
+	if authErr.IsError() {
+		return auth.LevelNone, authErr
+	}
+
+	err, dup := store.Users.AddAuthRecord(uid, auth.LevelAuth, "oidc", iss.unique(claims), nil, time.Time{})
+	if dup {
+		return auth.LevelNone, auth.NewErr(auth.ErrDuplicate, err)
+	} else if err != nil {
+		return auth.LevelNone, auth.NewErr(auth.ErrInternal, err)
+	}
+	return auth.LevelAuth, auth.NewErr(auth.NoErr, nil)
+}
+
+// UpdateRecord links the identity to the authenticated account, as in {acc scheme="oidc"} from an existing user.
+func (a OidcAuth) UpdateRecord(uid types.Uid, secret []byte, lifetime time.Duration) auth.AuthErr {
+	iss, claims, authErr := verifyToken(secret)
+	if authErr.IsError() {
+		return authErr
+	}
+
+	storedUid, _, _, _, err := store.Users.GetAuthRecord("oidc", iss.unique(claims))
+	if err != nil {
+		return auth.NewErr(auth.ErrInternal, err)
+	}
+	if storedUid == uid {
+		return auth.NewErr(auth.InfoNotModified, nil)
+	} else if !storedUid.IsZero() {
+		return auth.NewErr(auth.ErrDuplicate, errors.New("oidc auth: identity is linked to another account"))
+	}
+
+	_, authErr = a.AddRecord(uid, secret, lifetime)
+	return authErr
+}
+
+// Authenticate maps the subject of the ID token to an account. Unknown users get a new account
+// if the issuer allows it.
+func (OidcAuth) Authenticate(secret []byte) (types.Uid, int, time.Time, auth.AuthErr) {
+	iss, claims, authErr := verifyToken(secret)
+	if authErr.IsError() {
+		return types.ZeroUid, auth.LevelNone, time.Time{}, authErr
+	}
+
+	unique := iss.unique(claims)
+	uid, authLvl, _, _, err := store.Users.GetAuthRecord("oidc", unique)
+	if err != nil {
+		return types.ZeroUid, auth.LevelNone, time.Time{}, auth.NewErr(auth.ErrInternal, err)
+	}
+	if !uid.IsZero() {
+		return uid, authLvl, time.Time{}, auth.NewErr(auth.NoErr, nil)
+	}
+
+	if !iss.createAccounts {
+		return types.ZeroUid, auth.LevelNone, time.Time{},
+			auth.NewErr(auth.ErrFailed, errors.New("oidc auth: no account for "+unique))
+	}
+	if uid, authErr = createAccount(unique, claims); authErr.IsError() {
+		return types.ZeroUid, auth.LevelNone, time.Time{}, authErr
+	}
+	return uid, auth.LevelAuth, time.Time{}, auth.NewErr(auth.NoErr, nil)
+}
+
+// createAccount creates an account for a new user of the identity provider.
+func createAccount(unique string, claims *idClaims) (types.Uid, auth.AuthErr) {
+	user := types.User{
+		Access: types.DefaultAccess{Auth: types.ModeCP2P, Anon: types.ModeNone}}
+	if claims.Name != "" {
+		user.Public = map[string]interface{}{"fn": claims.Name}
+	}
+	if claims.Email != "" && claims.EmailVerified {
+		user.Tags = []string{"email:" + strings.ToLower(claims.Email)}
+	}
+
+	if _, err := store.Users.Create(&user, nil); err != nil {
+		return types.ZeroUid, auth.NewErr(auth.ErrInternal, err)
+	}
+
+	err, dup := store.Users.AddAuthRecord(user.Uid(), auth.LevelAuth, "oidc", unique, nil, time.Time{})
+	if err != nil {
+		store.Users.Delete(user.Uid(), false)
+		if dup {
+			// Concurrent first login from another session, use the account created there
+			uid, _, _, _, err := store.Users.GetAuthRecord("oidc", unique)
+			if err == nil && !uid.IsZero() {
+				return uid, auth.NewErr(auth.NoErr, nil)
+			}
+		}
+		return types.ZeroUid, auth.NewErr(auth.ErrInternal, err)
+	}
+	return user.Uid(), auth.NewErr(auth.NoErr, nil)
+}
+
+// IsUnique checks that the identity is not linked to any account yet.
+func (OidcAuth) IsUnique(secret []byte) (bool, auth.AuthErr) {
+	iss, claims, authErr := verifyToken(secret)
+	if authErr.IsError() {
+		return false, authErr
+	}
+
+	uid, _, _, _, err := store.Users.GetAuthRecord("oidc", iss.unique(claims))
+	if err != nil {
+		return false, auth.NewErr(auth.ErrInternal, err)
+	}
+	if uid.IsZero() {
+		return true, auth.NewErr(auth.NoErr, nil)
+	}
+	return false, auth.NewErr(auth.ErrDuplicate, errors.New("oidc auth: duplicate credentials"))
+}
+
+func (OidcAuth) GenSecret(uid types.Uid, authLvl int, lifetime time.Duration) ([]byte, time.Time, auth.AuthErr) {
+	return nil, time.Time{}, auth.NewErr(auth.ErrUnsupported, errors.New("oidc auth: GenSecret is not supported"))
+}
+
+func init() {
+	var auth OidcAuth
+	store.RegisterAuthScheme("oidc", auth)
+}
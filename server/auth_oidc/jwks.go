@@ -0,0 +1,221 @@
+package auth_oidc
+
+// Signing keys of identity providers. Keys are fetched from the provider's JWKS endpoint, found
+// through OpenID discovery unless configured explicitly, and refreshed when a token is signed with
+// an unknown key.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Keys are not re-fetched more often than this
+	jwks_min_refresh = time.Minute
+	// Timeout of requests to the provider
+	jwks_http_timeout = 10 * time.Second
+)
+
+var jwksClient = &http.Client{Timeout: jwks_http_timeout}
+
+// Signing keys of one issuer
+type keySet struct {
+	sync.Mutex
+
+	issuer string
+	// URL of the JWKS document, empty until discovered
+	url string
+	// Maximum age of the keys
+	maxAge time.Duration
+
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// Closed when the keys being fetched are stored, nil if the keys are not being fetched
+	refreshing chan struct{}
+}
+
+// JSON Web Key, only the fields needed for signature verification
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the public key with the given ID, fetching the keys if needed. The keys are fetched
+// by one caller at a time without holding the lock; other callers keep using the keys they have.
+func (ks *keySet) key(kid string) (crypto.PublicKey, error) {
+	ks.Lock()
+	key, ok := ks.keys[kid]
+	stale := time.Since(ks.fetched) > ks.maxAge
+	if ok && !stale {
+		ks.Unlock()
+		return key, nil
+	}
+
+	// Unknown key: the provider may have rotated keys
+	if !stale && time.Since(ks.fetched) <= jwks_min_refresh {
+		ks.Unlock()
+		return nil, errors.New("unknown signing key '" + kid + "'")
+	}
+
+	var err error
+	if done := ks.refreshing; done != nil {
+		ks.Unlock()
+		if ok {
+			// Keep using the old key while the keys are being fetched
+			return key, nil
+		}
+		<-done
+		ks.Lock()
+	} else {
+		done = make(chan struct{})
+		ks.refreshing = done
+		url := ks.url
+		ks.Unlock()
+
+		var keys map[string]crypto.PublicKey
+		url, keys, err = fetchKeys(ks.issuer, url)
+
+		ks.Lock()
+		if err == nil {
+			ks.url = url
+			ks.keys = keys
+			ks.fetched = time.Now()
+		}
+		ks.refreshing = nil
+		close(done)
+	}
+	defer ks.Unlock()
+
+	if fresh, found := ks.keys[kid]; found {
+		return fresh, nil
+	}
+	if err != nil {
+		if ok {
+			// Keep using the old key if the provider is unreachable
+			return key, nil
+		}
+		return nil, err
+	}
+	return nil, errors.New("unknown signing key '" + kid + "'")
+}
+
+// fetchKeys loads the keys of the issuer from the JWKS url, discovering the url if it's empty.
+// Returns the url and the keys.
+func fetchKeys(issuer, url string) (string, map[string]crypto.PublicKey, error) {
+	if url == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JwksUri string `json:"jwks_uri"`
+		}
+		if err := getJson(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return "", nil, err
+		}
+		if discovery.Issuer != issuer || discovery.JwksUri == "" {
+			return "", nil, errors.New("invalid discovery document of '" + issuer + "'")
+		}
+		url = discovery.JwksUri
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJson(url, &jwks); err != nil {
+		return "", nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return url, keys, nil
+}
+
+// publicKey converts the JWK to an RSA or ECDSA public key.
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + jwk.Kty)
+}
+
+func decodeBigInt(val string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func getJson(url string, result interface{}) error {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("GET " + url + ": " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -1,4 +1,8 @@
-package main
+package auth_token
+
+// Tokens are issued after a successful login by any other scheme. A token carries the user ID, the
+// authentication level and the expiration time. It's signed with the key from the config, so it's
+// checked without a database lookup.
 
 import (
 	"bytes"
@@ -135,7 +139,8 @@ func (TokenAuth) GenSecret(uid types.Uid, authLvl int, lifetime time.Duration) (
 	} else if lifetime < 0 {
 		return nil, time.Time{}, auth.NewErr(auth.ErrExpired, errors.New("token auth: negative lifetime"))
 	}
-	expires := time.Now().Add(lifetime).UTC().Round(time.Millisecond)
+	// The token keeps the expiration time with the precision of one second
+	expires := time.Now().Add(lifetime).UTC().Truncate(time.Second)
 	binary.Write(buf, binary.LittleEndian, uint32(expires.Unix()))
 	binary.Write(buf, binary.LittleEndian, uint16(authLvl))
 	binary.Write(buf, binary.LittleEndian, uint16(serial_number))
@@ -0,0 +1,308 @@
+package auth_totp
+
+// Time-based one-time passwords (RFC 6238) as the second factor of password logins. The user
+// enrolls a secret in an authenticator app and confirms it with the first code. After that a login
+// with a password must be completed with a code from the app or with one of the backup codes.
+//
+// The secret, the hashes of unused backup codes and the last accepted time step are kept in the
+// auth record "totp:<user id>". The scheme cannot be used on its own: the session calls the
+// functions of this package between the steps of the login.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Length of the secret in bytes
+	key_length = 20
+	// Duration of one time step
+	time_step = 30
+	// Number of digits in a code
+	code_digits = 6
+	// 10^code_digits
+	code_modulo = 1000000
+	// Accepted time steps before and after the current one, to allow for clock drift
+	step_window = 1
+	// Default number of backup codes
+	default_backup_codes = 10
+	// Default name of the service shown in authenticator apps
+	default_issuer = "Tinode"
+)
+
+type TotpAuth struct{}
+
+var config = struct {
+	// Name of the service shown in authenticator apps
+	Issuer string `json:"issuer"`
+	// Number of backup codes generated at enrollment
+	BackupCodes int `json:"backup_codes"`
+	// Require the second factor from ROOT-level accounts
+	RequireRoot bool `json:"require_root"`
+}{Issuer: default_issuer, BackupCodes: default_backup_codes}
+
+// Serializes checks of the codes: used codes are consumed
+var lock sync.Mutex
+
+// Content of the auth record
+type record struct {
+	Key []byte `json:"key"`
+	// The user entered the first code
+	Confirmed bool `json:"confirmed"`
+	// SHA-256 hashes of unused backup codes
+	Backup []string `json:"backup"`
+	// The last time step accepted, codes can't be reused
+	LastStep int64 `json:"last_step"`
+}
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (TotpAuth) Init(jsonconf string) error {
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("auth_totp: failed to parse config: " + err.Error())
+	}
+	if config.Issuer == "" {
+		config.Issuer = default_issuer
+	}
+	if config.BackupCodes <= 0 {
+		config.BackupCodes = default_backup_codes
+	}
+	return nil
+}
+
+// Required checks if users with the given auth level must use the second factor.
+func Required(authLvl int) bool {
+	return config.RequireRoot && authLvl == auth.LevelRoot
+}
+
+func getRecord(uid types.Uid) (*record, error) {
+	storedUid, _, secret, _, err := store.Users.GetAuthRecord("totp", uid.UserId())
+	if err != nil || storedUid.IsZero() {
+		return nil, err
+	}
+	var rec record
+	if err = json.Unmarshal(secret, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func saveRecord(uid types.Uid, rec *record, isNew bool) error {
+	secret, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		err, _ = store.Users.AddAuthRecord(uid, auth.LevelAuth, "totp", uid.UserId(), secret, time.Time{})
+	} else {
+		_, err = store.Users.UpdateAuthRecord(uid, auth.LevelAuth, "totp", uid.UserId(), secret, time.Time{})
+	}
+	return err
+}
+
+// Enabled checks if the user has a confirmed second factor.
+func Enabled(uid types.Uid) (bool, error) {
+	rec, err := getRecord(uid)
+	if err != nil {
+		return false, err
+	}
+	return rec != nil && rec.Confirmed, nil
+}
+
+// Enroll generates a new secret and backup codes for the user. The secret is not used until it's
+// confirmed. Returns the otpauth:// URI for authenticator apps and the backup codes.
+func Enroll(uid types.Uid, account string) (string, []string, auth.AuthErr) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	rec, err := getRecord(uid)
+	if err != nil {
+		return "", nil, auth.NewErr(auth.ErrInternal, err)
+	}
+	if rec != nil && rec.Confirmed {
+		return "", nil, auth.NewErr(auth.ErrDuplicate, errors.New("totp auth: already enrolled"))
+	}
+	isNew := rec == nil
+
+	rec = &record{Key: make([]byte, key_length)}
+	if _, err = rand.Read(rec.Key); err != nil {
+		return "", nil, auth.NewErr(auth.ErrInternal, err)
+	}
+	codes := make([]string, config.BackupCodes)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err = rand.Read(buf); err != nil {
+			return "", nil, auth.NewErr(auth.ErrInternal, err)
+		}
+		codes[i] = strings.ToLower(b32.EncodeToString(buf))
+		rec.Backup = append(rec.Backup, hashBackup(codes[i]))
+	}
+
+	if err = saveRecord(uid, rec, isNew); err != nil {
+		return "", nil, auth.NewErr(auth.ErrInternal, err)
+	}
+
+	label := url.PathEscape(config.Issuer + ":" + account)
+	uri := "otpauth://totp/" + label + "?" + url.Values{
+		"secret": {b32.EncodeToString(rec.Key)},
+		"issuer": {config.Issuer},
+		"digits": {fmt.Sprint(code_digits)},
+		"period": {fmt.Sprint(time_step)}}.Encode()
+	return uri, codes, auth.NewErr(auth.NoErr, nil)
+}
+
+// Confirm enables the second factor once the user entered a valid code from the app.
+func Confirm(uid types.Uid, code string) auth.AuthErr {
+	lock.Lock()
+	defer lock.Unlock()
+
+	rec, err := getRecord(uid)
+	if err != nil {
+		return auth.NewErr(auth.ErrInternal, err)
+	}
+	if rec == nil {
+		return auth.NewErr(auth.ErrFailed, errors.New("totp auth: not enrolled"))
+	}
+	if rec.Confirmed {
+		return auth.NewErr(auth.InfoNotModified, nil)
+	}
+	step, ok := rec.checkCode(code, time.Now())
+	if !ok {
+		return auth.NewErr(auth.ErrFailed, errors.New("totp auth: invalid code"))
+	}
+
+	rec.Confirmed = true
+	rec.LastStep = step
+	if err = saveRecord(uid, rec, false); err != nil {
+		return auth.NewErr(auth.ErrInternal, err)
+	}
+	return auth.NewErr(auth.NoErr, nil)
+}
+
+// Verify checks the code from the app or a backup code. The code is consumed.
+func Verify(uid types.Uid, code string) auth.AuthErr {
+	lock.Lock()
+	defer lock.Unlock()
+
+	rec, err := getRecord(uid)
+	if err != nil {
+		return auth.NewErr(auth.ErrInternal, err)
+	}
+	if rec == nil || !rec.Confirmed {
+		return auth.NewErr(auth.ErrFailed, errors.New("totp auth: not enrolled"))
+	}
+
+	if step, ok := rec.checkCode(code, time.Now()); ok {
+		rec.LastStep = step
+	} else if !rec.useBackup(code) {
+		return auth.NewErr(auth.ErrFailed, errors.New("totp auth: invalid code"))
+	}
+
+	if err = saveRecord(uid, rec, false); err != nil {
+		return auth.NewErr(auth.ErrInternal, err)
+	}
+	return auth.NewErr(auth.NoErr, nil)
+}
+
+// Disable removes the second factor. The user must enter a valid code.
+func Disable(uid types.Uid, code string) auth.AuthErr {
+	if authErr := Verify(uid, code); authErr.IsError() {
+		return authErr
+	}
+	if _, err := store.Users.DelAuthRecord("totp", uid.UserId()); err != nil {
+		return auth.NewErr(auth.ErrInternal, err)
+	}
+	return auth.NewErr(auth.NoErr, nil)
+}
+
+// checkCode checks the code against the time steps around now. Returns the matching time step.
+func (rec *record) checkCode(code string, now time.Time) (int64, bool) {
+	if len(code) != code_digits {
+		return 0, false
+	}
+	current := now.Unix() / time_step
+	for step := current - step_window; step <= current+step_window; step++ {
+		if step <= rec.LastStep {
+			// Codes can't be reused
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(generateCode(rec.Key, step))) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// useBackup checks the backup code and removes it from the unused ones.
+func (rec *record) useBackup(code string) bool {
+	hash := hashBackup(code)
+	for i, stored := range rec.Backup {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			rec.Backup = append(rec.Backup[:i], rec.Backup[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// generateCode computes the code for the time step as defined in RFC 4226.
+func generateCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", code_digits, value%code_modulo)
+}
+
+func hashBackup(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func (TotpAuth) AddRecord(uid types.Uid, secret []byte, lifetime time.Duration) (int, auth.AuthErr) {
+	return auth.LevelNone, auth.NewErr(auth.ErrUnsupported, errors.New("totp auth: AddRecord is not supported"))
+}
+
+func (TotpAuth) UpdateRecord(uid types.Uid, secret []byte, lifetime time.Duration) auth.AuthErr {
+	return auth.NewErr(auth.ErrUnsupported, errors.New("totp auth: UpdateRecord is not supported"))
+}
+
+func (TotpAuth) Authenticate(secret []byte) (types.Uid, int, time.Time, auth.AuthErr) {
+	return types.ZeroUid, auth.LevelNone, time.Time{},
+		auth.NewErr(auth.ErrUnsupported, errors.New("totp auth: only used as the second step of login"))
+}
+
+func (TotpAuth) IsUnique(secret []byte) (bool, auth.AuthErr) {
+	return false, auth.NewErr(auth.ErrUnsupported, errors.New("totp auth: IsUnique is not supported"))
+}
+
+func (TotpAuth) GenSecret(uid types.Uid, authLvl int, lifetime time.Duration) ([]byte, time.Time, auth.AuthErr) {
+	return nil, time.Time{}, auth.NewErr(auth.ErrUnsupported, errors.New("totp auth: GenSecret is not supported"))
+}
+
+func init() {
+	var auth TotpAuth
+	store.RegisterAuthScheme("totp", auth)
+}
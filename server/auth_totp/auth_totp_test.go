@@ -0,0 +1,38 @@
+package auth_totp
+
+import (
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 4226, Appendix D
+func TestGenerateCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	expected := []string{"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489"}
+
+	for step, code := range expected {
+		if got := generateCode(key, int64(step)); got != code {
+			t.Errorf("step %d: expected %s, got %s", step, code, got)
+		}
+	}
+}
+
+func TestCheckCode(t *testing.T) {
+	rec := &record{Key: []byte("12345678901234567890")}
+	now := time.Unix(59, 0)
+
+	code := generateCode(rec.Key, 1)
+	step, ok := rec.checkCode(code, now)
+	if !ok || step != 1 {
+		t.Fatalf("valid code rejected")
+	}
+
+	rec.LastStep = step
+	if _, ok = rec.checkCode(code, now); ok {
+		t.Error("used code accepted")
+	}
+	if _, ok = rec.checkCode(generateCode(rec.Key, 5), now); ok {
+		t.Error("code outside of the window accepted")
+	}
+}
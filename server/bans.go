@@ -0,0 +1,92 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Ban list of group topics and channels. The owner, admins and moderators
+ *  remove a user from the topic and ban them with
+ *    {del what="sub" user="usr..." ban=true}
+ *  The user is added to the list of banned users stored with the topic and
+ *  any further {sub} of the user is rejected with 403. Users who are not
+ *  subscribed may be banned too. The ban is lifted when an admin invites the
+ *  user again with {set sub={user: "usr...", mode: "..."}} and any mode but
+ *  "N". Admins and moderators see the list in {meta desc}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of users banned from a topic
+	BANNED_MAX_COUNT = 4096
+)
+
+// bansLoad converts the stored list of banned users to a set.
+func bansLoad(banned []string) map[types.Uid]bool {
+	if len(banned) == 0 {
+		return nil
+	}
+	set := make(map[types.Uid]bool, len(banned))
+	for _, id := range banned {
+		if uid := types.ParseUid(id); !uid.IsZero() {
+			set[uid] = true
+		}
+	}
+	return set
+}
+
+// isBanned checks if the user is banned from the topic.
+func (t *Topic) isBanned(uid types.Uid) bool {
+	return t.banned[uid]
+}
+
+// bansSave stores the list of banned users with the given change.
+func (t *Topic) bansSave(uid types.Uid, ban bool) error {
+	if t.banned[uid] == ban {
+		return nil
+	}
+	if ban && len(t.banned) >= BANNED_MAX_COUNT {
+		return errors.New("too many banned users")
+	}
+
+	banned := make([]string, 0, len(t.banned)+1)
+	for id := range t.banned {
+		if id != uid {
+			banned = append(banned, id.String())
+		}
+	}
+	if ban {
+		banned = append(banned, uid.String())
+	}
+	if err := store.Topics.Update(t.name, map[string]interface{}{"Banned": banned}); err != nil {
+		return err
+	}
+
+	if ban {
+		if t.banned == nil {
+			t.banned = make(map[types.Uid]bool)
+		}
+		t.banned[uid] = true
+	} else {
+		delete(t.banned, uid)
+	}
+	return nil
+}
+
+// bannedList returns IDs of the banned users for {meta desc}.
+func (t *Topic) bannedList() []string {
+	if len(t.banned) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(t.banned))
+	for uid := range t.banned {
+		list = append(list, uid.UserId())
+	}
+	return list
+}
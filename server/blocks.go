@@ -0,0 +1,208 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Block lists of users. A user blocks another user with
+ *    {set topic="me" block={user: "usr...", blocked: true}}
+ *  and unblocks with blocked: false. The list is stored with the user and
+ *  is reported to the user in {meta desc} of 'me'. The blocked user is not
+ *  told. A blocked user:
+ *    - cannot start a p2p topic with the blocker or subscribe to it again;
+ *    - cannot publish to an existing p2p topic with the blocker, gets 403;
+ *    - does not find the blocker in 'fnd';
+ *    - gets no presence of the blocker: online status, user agent, last
+ *      seen time, and no typing notifications and receipts in the p2p topic.
+ *  Group topics and channels are not affected.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of users blocked by one user
+	BLOCKED_MAX_COUNT = 4096
+)
+
+// blocks checks if the user blocked the other user.
+func blocks(user *types.User, uid types.Uid) bool {
+	id := uid.String()
+	for _, blocked := range user.Blocked {
+		if blocked == id {
+			return true
+		}
+	}
+	return false
+}
+
+// p2pBlocksLoad returns the participants of a p2p topic blocked by the other participant.
+func p2pBlocksLoad(users []types.User) map[types.Uid]bool {
+	if len(users) != 2 {
+		return nil
+	}
+	var set map[types.Uid]bool
+	for i := range users {
+		other := users[(i+1)%2].Uid()
+		if blocks(&users[i], other) {
+			if set == nil {
+				set = make(map[types.Uid]bool, 1)
+			}
+			set[other] = true
+		}
+	}
+	return set
+}
+
+// blocksPeer checks if the user blocked the other participant of the p2p topic.
+func (t *Topic) blocksPeer(uid types.Uid) bool {
+	if t.cat != types.TopicCat_P2P {
+		return false
+	}
+	for other := range t.blocked {
+		if other != uid {
+			return true
+		}
+	}
+	return false
+}
+
+// blockersOf returns IDs of the users who blocked the given user among the users of the subscriptions.
+// userOf returns the user ID as a string or an empty string if the subscription is not to a user.
+func blockersOf(uid types.Uid, subs []types.Subscription, userOf func(*types.Subscription) string) (
+	map[string]bool, error) {
+
+	var uids []types.Uid
+	for i := range subs {
+		if other := types.ParseUserId(userOf(&subs[i])); !other.IsZero() {
+			uids = append(uids, other)
+		}
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	users, err := store.Users.GetAll(uids...)
+	if err != nil {
+		return nil, err
+	}
+	var blockers map[string]bool
+	for i := range users {
+		if blocks(&users[i], uid) {
+			if blockers == nil {
+				blockers = make(map[string]bool)
+			}
+			blockers[users[i].Uid().UserId()] = true
+		}
+	}
+	return blockers, nil
+}
+
+// blockedList returns IDs of the users blocked by the owner of 'me' for {meta desc}.
+func (t *Topic) blockedList() []string {
+	if t.cat != types.TopicCat_Me || len(t.blocked) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(t.blocked))
+	for uid := range t.blocked {
+		list = append(list, uid.UserId())
+	}
+	return list
+}
+
+// replySetBlock adds the user to the block list or removes it in response to set.block on 'me'.
+func (t *Topic) replySetBlock(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCat_Me {
+		sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
+		return errors.New("block list changed outside of 'me'")
+	}
+
+	target := types.ParseUserId(set.Block.User)
+	if target.IsZero() || target == sess.uid {
+		sess.queueOut(ErrMalformed(set.Id, set.Topic, now))
+		return errors.New("invalid user to block")
+	}
+	block := set.Block.Blocked
+	if t.blocked[target] == block {
+		sess.queueOut(InfoNoAction(set.Id, set.Topic, now))
+		return nil
+	}
+	if block && len(t.blocked) >= BLOCKED_MAX_COUNT {
+		sess.queueOut(ErrPolicy(set.Id, set.Topic, now))
+		return errors.New("too many blocked users")
+	}
+
+	blocked := make([]string, 0, len(t.blocked)+1)
+	for uid := range t.blocked {
+		if uid != target {
+			blocked = append(blocked, uid.String())
+		}
+	}
+	if block {
+		blocked = append(blocked, target.String())
+	}
+	if err := store.Users.Update(sess.uid, map[string]interface{}{"Blocked": blocked}); err != nil {
+		sess.queueOut(ErrUnknown(set.Id, set.Topic, now))
+		return err
+	}
+
+	what := "unblock"
+	if block {
+		if t.blocked == nil {
+			t.blocked = make(map[types.Uid]bool)
+		}
+		t.blocked[target] = true
+		what = "block"
+	} else {
+		delete(t.blocked, target)
+	}
+
+	// Tell the p2p topic, if it's loaded
+	p2p := sess.uid.P2PName(target)
+	globals.hub.route <- &ServerComMessage{
+		Info:   &MsgServerInfo{Topic: p2p, From: sess.uid.UserId(), What: what},
+		rcptto: p2p, timestamp: now}
+
+	// Hide the user from the blocked user or show again
+	if _, ok := t.perSubs[target.UserId()]; ok {
+		pres := &MsgServerPres{Topic: "me", What: "off", Src: t.name}
+		if !block && len(t.sessions) > 0 && t.presVisibleTo(target.UserId()) {
+			pres = &MsgServerPres{Topic: "me", What: "on", Src: t.name, UserAgent: t.userAgent, wantReply: true}
+		}
+		globals.hub.route <- &ServerComMessage{Pres: pres, rcptto: target.UserId()}
+	}
+
+	sess.queueOut(NoErr(set.Id, set.Topic, now))
+	return nil
+}
+
+// p2pBlockChange records the change of the block list of a participant of the p2p topic.
+func (t *Topic) p2pBlockChange(blocker types.Uid, block bool) {
+	if t.cat != types.TopicCat_P2P {
+		return
+	}
+	// The other participant may have no subscription, take it from the topic name
+	uid1, uid2, err := types.ParseP2P(t.name)
+	if err != nil {
+		return
+	}
+	uid := uid1
+	if uid == blocker {
+		uid = uid2
+	}
+	if block {
+		if t.blocked == nil {
+			t.blocked = make(map[types.Uid]bool, 1)
+		}
+		t.blocked[uid] = true
+	} else {
+		delete(t.blocked, uid)
+	}
+}
@@ -0,0 +1,362 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Delivery of messages to bots which don't keep a websocket connection.
+ *  Messages addressed to such bots are queued by the server. The bot either
+ *  fetches them with a long poll request to /v0/bot/updates, acknowledging
+ *  the previous batch with the offset, or receives them at its webhook.
+ *
+ *  In a cluster, the queue of a bot is kept at the node which owns the
+ *  bot's 'me' topic. Other nodes forward updates and polls to that node.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the long poll endpoint
+	BOT_UPDATES_PATH = "/v0/bot/updates"
+	// Default maximum number of updates queued for a bot; the oldest updates are dropped
+	BOT_DEFAULT_QUEUE_SIZE = 1000
+	// Maximum number of updates returned in one response
+	BOT_MAX_UPDATES = 100
+	// Maximum duration of a long poll
+	BOT_MAX_POLL_TIMEOUT = 50 * time.Second
+	// Default timeout of a webhook call
+	BOT_DEFAULT_WEBHOOK_TIMEOUT = 5 * time.Second
+	// Maximum delay between failed webhook calls
+	BOT_MAX_WEBHOOK_BACKOFF = time.Minute
+)
+
+type botConfig struct {
+	// ID of the bot user, e.g. "usrAbCd"
+	User string `json:"user"`
+	// URL to post updates to; if empty, the bot polls for updates
+	Webhook string `json:"webhook"`
+	// Secret used to sign webhook requests
+	Secret string `json:"secret"`
+	// Webhook request timeout in milliseconds
+	Timeout int `json:"timeout"`
+}
+
+type botsConfig struct {
+	// Maximum number of updates queued for a bot
+	QueueSize int         `json:"queue_size"`
+	Users     []botConfig `json:"users"`
+}
+
+// botUpdate is a message or a notification, such as an interaction with a card, queued for the bot.
+type botUpdate struct {
+	Id   int64          `json:"id"`
+	Data *MsgServerData `json:"data,omitempty"`
+	Info *MsgServerInfo `json:"info,omitempty"`
+}
+
+// botQueue holds updates of one bot.
+type botQueue struct {
+	sync.Mutex
+	updates []botUpdate
+	// ID of the next update
+	nextId int64
+	// Closed and replaced when a new update is added
+	signal chan bool
+
+	webhook string
+	secret  []byte
+	client  *http.Client
+}
+
+var bots struct {
+	queueSize int
+	queues    map[types.Uid]*botQueue
+}
+
+// botsInit parses config of bots with server-side delivery and starts webhook deliveries.
+func botsInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config botsConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logBots.Fatal("Failed to parse bots config:", err)
+	}
+
+	bots.queueSize = config.QueueSize
+	if bots.queueSize <= 0 {
+		bots.queueSize = BOT_DEFAULT_QUEUE_SIZE
+	}
+	bots.queues = make(map[types.Uid]*botQueue, len(config.Users))
+	for _, conf := range config.Users {
+		uid := types.ParseUserId(conf.User)
+		if uid.IsZero() {
+			logBots.Fatal("Invalid bot user '" + conf.User + "'")
+		}
+		if _, dup := bots.queues[uid]; dup {
+			logBots.Fatal("Bot '" + conf.User + "' is configured twice")
+		}
+
+		bq := &botQueue{nextId: 1, signal: make(chan bool)}
+		if conf.Webhook != "" {
+			if conf.Secret == "" {
+				logBots.Fatal("Missing webhook secret of bot '" + conf.User + "'")
+			}
+			timeout := time.Duration(conf.Timeout) * time.Millisecond
+			if timeout <= 0 {
+				timeout = BOT_DEFAULT_WEBHOOK_TIMEOUT
+			}
+			bq.webhook = conf.Webhook
+			bq.secret = []byte(conf.Secret)
+			bq.client = &http.Client{Timeout: timeout}
+		}
+		bots.queues[uid] = bq
+	}
+
+	for uid, bq := range bots.queues {
+		if bq.webhook != "" && !globals.cluster.isRemoteTopic(uid.UserId()) {
+			go bq.webhookLoop(uid)
+		}
+	}
+
+	http.HandleFunc(BOT_UPDATES_PATH, serveBotUpdates)
+	http.HandleFunc(BOT_CARDS_PATH, serveBotCards)
+	logBots.Infof("Queueing messages for %d bots", len(bots.queues))
+}
+
+// isBot checks if the user receives messages through the server-side queue.
+func isBot(uid types.Uid) bool {
+	_, ok := bots.queues[uid]
+	return ok
+}
+
+// botsEnqueue queues the message for every bot subscribed to the topic with read access.
+func (t *Topic) botsEnqueue(data *MsgServerData) {
+	if len(bots.queues) == 0 {
+		return
+	}
+
+	from := types.ParseUserId(data.From)
+	for uid, pud := range t.perUser {
+		if uid == from || !isBot(uid) || !canReceive(pud.modeGiven&pud.modeWant, uid, data) {
+			continue
+		}
+
+		// Bots see p2p topics by the name of the peer
+		copied := *data
+		copied.Topic = t.original(uid)
+		botEnqueue(uid, &copied, nil)
+	}
+}
+
+// botEnqueue adds the message or notification to the queue of the bot, forwarding it to another node if necessary.
+func botEnqueue(uid types.Uid, data *MsgServerData, info *MsgServerInfo) {
+	if globals.cluster.isRemoteTopic(uid.UserId()) {
+		if err := globals.cluster.botUpdate(uid, data, info); err != nil {
+			logBots.Warnf("bot[%s]: failed to forward update: %v", uid.UserId(), err)
+		}
+		return
+	}
+
+	bq := bots.queues[uid]
+	bq.Lock()
+	bq.updates = append(bq.updates, botUpdate{Id: bq.nextId, Data: data, Info: info})
+	bq.nextId++
+	if len(bq.updates) > bots.queueSize {
+		bq.updates = bq.updates[len(bq.updates)-bots.queueSize:]
+	}
+	close(bq.signal)
+	bq.signal = make(chan bool)
+	bq.Unlock()
+}
+
+// get acknowledges updates with IDs below the offset and returns up to limit of the following updates.
+// The returned channel is closed when a new update is added.
+func (bq *botQueue) get(offset int64, limit int) ([]botUpdate, chan bool) {
+	bq.Lock()
+	defer bq.Unlock()
+
+	i := 0
+	for i < len(bq.updates) && bq.updates[i].Id < offset {
+		i++
+	}
+	bq.updates = bq.updates[i:]
+
+	if limit > len(bq.updates) {
+		limit = len(bq.updates)
+	}
+	updates := make([]botUpdate, limit)
+	copy(updates, bq.updates[:limit])
+	return updates, bq.signal
+}
+
+// poll waits up to timeout for updates at or after the offset.
+func (bq *botQueue) poll(offset int64, limit int, timeout time.Duration) []botUpdate {
+	updates, signal := bq.get(offset, limit)
+	if len(updates) > 0 || timeout <= 0 {
+		return updates
+	}
+
+	select {
+	case <-signal:
+		updates, _ = bq.get(offset, limit)
+	case <-time.After(timeout):
+	}
+	return updates
+}
+
+// botPoll returns updates of the bot, fetching them from another node if necessary.
+func botPoll(uid types.Uid, offset int64, limit int, timeout time.Duration) ([]botUpdate, error) {
+	if globals.cluster.isRemoteTopic(uid.UserId()) {
+		return globals.cluster.botPoll(uid, offset, limit, timeout)
+	}
+	return bots.queues[uid].poll(offset, limit, timeout), nil
+}
+
+// webhookLoop posts updates to the bot's webhook. Updates are acknowledged when the webhook
+// responds with a 2XX status. Failed calls are retried with exponential backoff.
+func (bq *botQueue) webhookLoop(uid types.Uid) {
+	var offset int64
+	backoff := time.Second
+	for {
+		updates := bq.poll(offset, BOT_MAX_UPDATES, BOT_MAX_POLL_TIMEOUT)
+		if len(updates) == 0 {
+			continue
+		}
+
+		if err := bq.callWebhook(updates); err != nil {
+			logBots.Warnf("bot[%s]: webhook failed: %v", uid.UserId(), err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > BOT_MAX_WEBHOOK_BACKOFF {
+				backoff = BOT_MAX_WEBHOOK_BACKOFF
+			}
+			continue
+		}
+
+		backoff = time.Second
+		offset = updates[len(updates)-1].Id + 1
+	}
+}
+
+// callWebhook posts the updates signed with HMAC-SHA256 of the body in the X-Tinode-Signature header.
+func (bq *botQueue) callWebhook(updates []botUpdate) error {
+	body, err := json.Marshal(map[string]interface{}{"updates": updates})
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, bq.secret)
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, bq.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tinode-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := bq.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected response status " + resp.Status)
+	}
+	return nil
+}
+
+// serveBotUpdates handles long poll requests of bots:
+// GET /v0/bot/updates?offset=<id>&limit=<count>&timeout=<seconds>
+func serveBotUpdates(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	uid, err := authHttpRequest(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	}
+
+	bq := bots.queues[uid]
+	if bq == nil || bq.webhook != "" {
+		// Not a bot or the bot receives updates at the webhook
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	var offset int64
+	limit := BOT_MAX_UPDATES
+	var timeout time.Duration
+	if val := req.FormValue("offset"); val != "" {
+		if offset, err = strconv.ParseInt(val, 10, 64); err != nil {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+	}
+	if val := req.FormValue("limit"); val != "" {
+		if limit, err = strconv.Atoi(val); err != nil || limit <= 0 {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+		if limit > BOT_MAX_UPDATES {
+			limit = BOT_MAX_UPDATES
+		}
+	}
+	if val := req.FormValue("timeout"); val != "" {
+		secs, err := strconv.Atoi(val)
+		if err != nil || secs < 0 {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+		if timeout = time.Duration(secs) * time.Second; timeout > BOT_MAX_POLL_TIMEOUT {
+			timeout = BOT_MAX_POLL_TIMEOUT
+		}
+	}
+
+	updates, err := botPoll(uid, offset, limit, timeout)
+	if err != nil {
+		writeErr(ErrClusterNodeUnreachable("", "", now))
+		return
+	}
+	if updates == nil {
+		updates = []botUpdate{}
+	}
+	enc.Encode(map[string]interface{}{"updates": updates})
+}
@@ -0,0 +1,338 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Synthetic canary sessions. Every node periodically connects to itself
+ *  over websocket like a regular client, logs in, subscribes to a probe
+ *  topic and publishes a message into it. The probe is successful when the
+ *  node echoes the message back as {data}. The probe topic is hosted by one
+ *  node of the cluster, so canaries of the other nodes go through cluster
+ *  proxying. Latency and failures are reported in expvar; when the golden
+ *  path fails several times in a row, an alert is posted to a webhook.
+ *
+ *  The canary user and the probe topic must exist and the user must be
+ *  able to write to the topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default interval between probes
+	CANARY_DEFAULT_INTERVAL = time.Minute
+	// Default time allowed for every step of the probe
+	CANARY_DEFAULT_TIMEOUT = 10 * time.Second
+	// Default number of failed probes in a row which raise an alert
+	CANARY_DEFAULT_ALERT_AFTER = 3
+	// Time allowed for the alert webhook to respond
+	CANARY_ALERT_TIMEOUT = 5 * time.Second
+)
+
+type canaryConfig struct {
+	// Run canary sessions
+	Enabled bool `json:"enabled"`
+	// Interval between probes, seconds
+	Interval int `json:"interval"`
+	// Time allowed for each step of the probe, seconds
+	Timeout int `json:"timeout"`
+	// Websocket endpoint of this node, default ws://localhost<listen>/v0/channels
+	Url string `json:"url"`
+	// API key to connect with
+	ApiKey string `json:"api_key"`
+	// Credentials of the canary user for "basic" authentication
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// Topic to publish probes into
+	Topic string `json:"topic"`
+	// URL to POST alerts to
+	AlertWebhook string `json:"alert_webhook"`
+	// Number of failed probes in a row which raise an alert
+	AlertAfter int `json:"alert_after"`
+}
+
+var canary struct {
+	sync.Mutex
+
+	url        string
+	login      string
+	password   string
+	topic      string
+	timeout    time.Duration
+	webhook    string
+	alertAfter int
+	client     *http.Client
+
+	// Failed probes in a row
+	failures int
+	// The alert was sent and the recovery was not
+	alerted   bool
+	lastError string
+
+	// Exported as Canary in expvar
+	probes  *expvar.Int
+	failed  *expvar.Int
+	latency *expvar.Int
+}
+
+// canaryInit parses the config and starts the probes. Canary is off by default.
+func canaryInit(jsconfig json.RawMessage, listen string) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config canaryConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse canary config:", err)
+	}
+
+	if !config.Enabled {
+		return
+	}
+
+	if config.Login == "" || config.Topic == "" || config.ApiKey == "" {
+		logMain.Fatal("canary: login, topic and api_key are required")
+	}
+
+	endpoint := config.Url
+	if endpoint == "" {
+		host := listen
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		endpoint = "ws://" + host + "/v0/channels"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		logMain.Fatal("canary: invalid url", err)
+	}
+	query := u.Query()
+	query.Set("apikey", config.ApiKey)
+	u.RawQuery = query.Encode()
+	canary.url = u.String()
+
+	canary.login = config.Login
+	canary.password = config.Password
+	canary.topic = config.Topic
+	canary.timeout = time.Duration(config.Timeout) * time.Second
+	if canary.timeout <= 0 {
+		canary.timeout = CANARY_DEFAULT_TIMEOUT
+	}
+	canary.webhook = config.AlertWebhook
+	canary.alertAfter = config.AlertAfter
+	if canary.alertAfter <= 0 {
+		canary.alertAfter = CANARY_DEFAULT_ALERT_AFTER
+	}
+	canary.client = &http.Client{Timeout: CANARY_ALERT_TIMEOUT}
+
+	canary.probes = new(expvar.Int)
+	canary.failed = new(expvar.Int)
+	canary.latency = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("probes", canary.probes)
+	vars.Set("failed", canary.failed)
+	vars.Set("latency_ms", canary.latency)
+	vars.Set("failures_in_row", expvar.Func(func() interface{} {
+		canary.Lock()
+		defer canary.Unlock()
+		return canary.failures
+	}))
+	vars.Set("last_error", expvar.Func(func() interface{} {
+		canary.Lock()
+		defer canary.Unlock()
+		return canary.lastError
+	}))
+	expvar.Publish("Canary", vars)
+
+	interval := time.Duration(config.Interval) * time.Second
+	if interval <= 0 {
+		interval = CANARY_DEFAULT_INTERVAL
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if isStandby() {
+				// Clients are served by the primary region
+				continue
+			}
+			canaryRun()
+		}
+	}()
+
+	logMain.Infof("Canary probes of topic '%s' every %s", canary.topic, interval)
+}
+
+// canaryRun makes one probe and records the result.
+func canaryRun() {
+	step, latency, err := canaryProbe()
+	canary.probes.Add(1)
+
+	canary.Lock()
+	defer canary.Unlock()
+
+	if err == nil {
+		canary.latency.Set(int64(latency / time.Millisecond))
+		if canary.alerted {
+			logMain.Info("canary: golden path recovered")
+			go canaryAlert(map[string]interface{}{"recovered": true})
+		}
+		canary.failures = 0
+		canary.alerted = false
+		canary.lastError = ""
+		return
+	}
+
+	canary.failed.Add(1)
+	canary.failures++
+	canary.lastError = step + ": " + err.Error()
+	logMain.Warnf("canary: probe failed at %s: %v", step, err)
+
+	if canary.failures >= canary.alertAfter && !canary.alerted {
+		canary.alerted = true
+		go canaryAlert(map[string]interface{}{
+			"step":     step,
+			"error":    err.Error(),
+			"failures": canary.failures})
+	}
+}
+
+// canaryConn is a websocket client session of the canary.
+type canaryConn struct {
+	ws     *websocket.Conn
+	nextId int
+	// The published probe and whether it was received back; the {data} may come before the {ctrl}
+	probe  string
+	echoed bool
+}
+
+// request sends the client message and waits for the {ctrl} response to it.
+func (c *canaryConn) request(what string, body map[string]interface{}) (*MsgServerCtrl, error) {
+	c.nextId++
+	id := strconv.Itoa(c.nextId)
+	body["id"] = id
+	if err := c.ws.WriteJSON(map[string]interface{}{what: body}); err != nil {
+		return nil, err
+	}
+
+	var ctrl *MsgServerCtrl
+	err := c.await(func(msg *ServerComMessage) bool {
+		if msg.Ctrl != nil && msg.Ctrl.Id == id {
+			ctrl = msg.Ctrl
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ctrl.Code >= 300 {
+		return ctrl, errors.New(strconv.Itoa(ctrl.Code) + " " + ctrl.Text)
+	}
+	return ctrl, nil
+}
+
+// await reads messages until the one the function accepts, or until the time runs out.
+func (c *canaryConn) await(accept func(msg *ServerComMessage) bool) error {
+	c.ws.SetReadDeadline(time.Now().Add(canary.timeout))
+	for {
+		var msg ServerComMessage
+		if err := c.ws.ReadJSON(&msg); err != nil {
+			return err
+		}
+		if msg.Data != nil && c.probe != "" && msg.Data.Head["probe"] == c.probe {
+			c.echoed = true
+		}
+		if accept(&msg) {
+			return nil
+		}
+	}
+}
+
+// canaryProbe goes through the golden path: connect, log in, subscribe and publish a message.
+// Returns the time from publishing the message to receiving it back, or the failed step and the error.
+func canaryProbe() (string, time.Duration, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: canary.timeout}
+	ws, _, err := dialer.Dial(canary.url, nil)
+	if err != nil {
+		return "connect", 0, err
+	}
+	defer ws.Close()
+
+	c := &canaryConn{ws: ws}
+	if _, err := c.request("hi", map[string]interface{}{"ver": VERSION, "ua": "TinodeCanary/" + VERSION}); err != nil {
+		return "hi", 0, err
+	}
+	if _, err := c.request("login", map[string]interface{}{
+		"scheme": "basic",
+		"secret": []byte(canary.login + ":" + canary.password)}); err != nil {
+		return "login", 0, err
+	}
+	if _, err := c.request("sub", map[string]interface{}{"topic": canary.topic}); err != nil {
+		return "sub", 0, err
+	}
+
+	node := ""
+	if globals.cluster != nil {
+		node = globals.cluster.thisNodeName
+	}
+	start := time.Now()
+	c.probe = strconv.FormatInt(start.UnixNano(), 36)
+	if _, err := c.request("pub", map[string]interface{}{
+		"topic":   canary.topic,
+		"head":    map[string]string{"canary": node, "probe": c.probe},
+		"content": "canary probe " + c.probe}); err != nil {
+		return "pub", 0, err
+	}
+	if !c.echoed {
+		if err := c.await(func(*ServerComMessage) bool { return c.echoed }); err != nil {
+			return "data", 0, err
+		}
+	}
+	latency := time.Since(start)
+
+	c.request("leave", map[string]interface{}{"topic": canary.topic})
+	return "", latency, nil
+}
+
+// canaryAlert posts the alert to the webhook.
+func canaryAlert(alert map[string]interface{}) {
+	if canary.webhook == "" {
+		return
+	}
+
+	alert["topic"] = canary.topic
+	alert["ts"] = types.TimeNow()
+	if globals.cluster != nil {
+		alert["node"] = globals.cluster.thisNodeName
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+
+	resp, err := canary.client.Post(canary.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logMain.Warn("canary: failed to send alert", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logMain.Warn("canary: alert webhook responded", resp.Status)
+	}
+}
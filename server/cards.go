@@ -0,0 +1,296 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Interactive cards. A card is a {pub} message with head.card set and
+ *  content of the form
+ *    {"text": "Pick a size",
+ *     "elements": [{"type": "button", "id": "ok", "label": "OK"},
+ *                  {"type": "select", "id": "size", "options": ["S", "M"]}]}
+ *  Members interact with the card by {note what="card" seq=N card={elem, value}}.
+ *  The interaction is not broadcast: the server forwards it with the ID of
+ *  the interacting user to the author of the card only. Bots with a
+ *  server-side queue receive it as an update, other authors as
+ *  {info what="card"} on their 'me' topic.
+ *
+ *  The author updates the card in place with {note what="edit" seq=N content}
+ *  or, for bots without a connection, with POST /v0/bot/cards. The server
+ *  saves the new content and broadcasts it as {info what="edit"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the endpoint for editing cards by bots
+	BOT_CARDS_PATH = "/v0/bot/cards"
+	// Maximum number of elements in a card
+	CARD_MAX_ELEMENTS = 32
+	// Maximum number of options in a select element
+	CARD_MAX_OPTIONS = 64
+)
+
+// cardValidate checks that the content is a well-formed card.
+func cardValidate(content interface{}) bool {
+	elements, ok := cardElements(content)
+	if !ok || len(elements) == 0 || len(elements) > CARD_MAX_ELEMENTS {
+		return false
+	}
+
+	ids := make(map[string]bool, len(elements))
+	for _, el := range elements {
+		elem, ok := el.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		id, ok := elem["id"].(string)
+		if !ok || id == "" || ids[id] {
+			return false
+		}
+		ids[id] = true
+
+		switch elem["type"] {
+		case "button":
+		case "select":
+			options, ok := elem["options"].([]interface{})
+			if !ok || len(options) == 0 || len(options) > CARD_MAX_OPTIONS {
+				return false
+			}
+			for _, opt := range options {
+				if opt, ok := opt.(string); !ok || opt == "" {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// cardElements returns the list of card elements from message content.
+func cardElements(content interface{}) ([]interface{}, bool) {
+	if content, ok := content.(map[string]interface{}); ok {
+		elements, ok := content["elements"].([]interface{})
+		return elements, ok
+	}
+	return nil, false
+}
+
+// cardIsValidInput checks that the card has the element and the value is acceptable for it.
+func cardIsValidInput(content interface{}, event *MsgCardEvent) bool {
+	elements, _ := cardElements(content)
+	for _, el := range elements {
+		elem, _ := el.(map[string]interface{})
+		if id, _ := elem["id"].(string); id != event.Elem {
+			continue
+		}
+
+		if elem["type"] == "button" {
+			return event.Value == ""
+		}
+		options, _ := elem["options"].([]interface{})
+		for _, opt := range options {
+			if opt == event.Value {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// cardLoad returns the card with the given ID or nil if the message is not found or is not a card.
+func cardLoad(topic string, uid types.Uid, seq int) *types.Message {
+	messages, err := store.Messages.GetAll(topic, uid, &types.BrowseOpt{Since: seq, Before: seq + 1, Limit: 1})
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to load card: %v", topic, err)
+		return nil
+	}
+	if len(messages) == 0 || messages[0].DeletedAt != nil {
+		return nil
+	}
+	if _, ok := messages[0].Head["card"]; !ok {
+		return nil
+	}
+	return &messages[0]
+}
+
+// cardInteract forwards the user's interaction with the card to the author of the card.
+func (t *Topic) cardInteract(uid types.Uid, info *MsgServerInfo) {
+	pud := t.perUser[uid]
+	if !(pud.modeGiven & pud.modeWant).IsReader() || info.SeqId <= pud.clearId {
+		return
+	}
+
+	msg := cardLoad(t.name, uid, info.SeqId)
+	if msg == nil || !cardIsValidInput(msg.Content, info.Card) {
+		return
+	}
+
+	author := types.ParseUid(msg.From)
+	if author == uid {
+		return
+	}
+	if _, ok := t.perUser[author]; !ok {
+		// The author has left the topic
+		return
+	}
+
+	event := &MsgServerInfo{
+		Topic: "me",
+		From:  uid.UserId(),
+		What:  "card",
+		Card: &MsgCardEvent{
+			Topic: t.original(author),
+			SeqId: msg.SeqId,
+			Elem:  info.Card.Elem,
+			Value: info.Card.Value}}
+
+	if isBot(author) {
+		botEnqueue(author, nil, event)
+	} else {
+		globals.hub.route <- &ServerComMessage{Info: event, rcptto: author.UserId(), timestamp: types.TimeNow()}
+	}
+}
+
+// cardEdit saves the new content of the card sent by its author.
+// Returns true if the card was updated and the change should be broadcast.
+func (t *Topic) cardEdit(uid types.Uid, info *MsgServerInfo) bool {
+	pud := t.perUser[uid]
+	if !(pud.modeGiven & pud.modeWant).IsWriter() {
+		return false
+	}
+	return cardSave(t.name, uid, info)
+}
+
+// cardEditOffline saves the card edited while the topic is not loaded if the user may still write
+// into the topic.
+func cardEditOffline(topic string, uid types.Uid, info *MsgServerInfo) bool {
+	if !cardCanWrite(topic, uid) {
+		return false
+	}
+	return cardSave(topic, uid, info)
+}
+
+// cardCanWrite checks the stored subscription of the user for the W permission.
+func cardCanWrite(topic string, uid types.Uid) bool {
+	sub, err := store.Subs.Get(topic, uid)
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to load subscription: %v", topic, err)
+		return false
+	}
+	return sub != nil && !sub.IsDeleted() && (sub.ModeGiven & sub.ModeWant).IsWriter()
+}
+
+// cardSave replaces the content of the card if the user is its author.
+func cardSave(topic string, uid types.Uid, info *MsgServerInfo) bool {
+	if !cardValidate(info.Content) {
+		return false
+	}
+
+	msg := cardLoad(topic, uid, info.SeqId)
+	if msg == nil || msg.From != uid.String() {
+		return false
+	}
+
+	if err := store.Messages.Update(topic, info.SeqId, map[string]interface{}{"Content": info.Content}); err != nil {
+		logTopic.Errorf("topic[%s]: failed to update card: %v", topic, err)
+		return false
+	}
+	return true
+}
+
+// serveBotCards handles edits of cards by bots without a connection:
+// POST /v0/bot/cards {"topic": "grpXXX", "seq": 123, "content": {...}}
+func serveBotCards(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	uid, err := authHttpRequest(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	}
+	if !isBot(uid) {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	var edit struct {
+		Topic   string      `json:"topic"`
+		SeqId   int         `json:"seq"`
+		Content interface{} `json:"content"`
+	}
+	req.Body = http.MaxBytesReader(wrt, req.Body, maxMessageSize())
+	if err = json.NewDecoder(req.Body).Decode(&edit); err != nil || edit.SeqId <= 0 || !cardValidate(edit.Content) {
+		writeErr(ErrMalformed("", edit.Topic, now))
+		return
+	}
+
+	// Bots see p2p topics by the name of the peer
+	var routeTo string
+	if strings.HasPrefix(edit.Topic, "usr") {
+		if peer := types.ParseUserId(edit.Topic); !peer.IsZero() && peer != uid {
+			routeTo = uid.P2PName(peer)
+		}
+	} else if strings.HasPrefix(edit.Topic, "grp") {
+		routeTo = edit.Topic
+	}
+	if routeTo == "" {
+		writeErr(ErrMalformed("", edit.Topic, now))
+		return
+	}
+	// The topic checks the permission again when the edit is applied
+	if !cardCanWrite(routeTo, uid) {
+		writeErr(ErrPermissionDenied("", edit.Topic, now))
+		return
+	}
+
+	info := &MsgServerInfo{
+		Topic:   edit.Topic,
+		From:    uid.UserId(),
+		What:    "edit",
+		SeqId:   edit.SeqId,
+		Content: edit.Content}
+	if globals.cluster.isRemoteTopic(routeTo) {
+		if err = globals.cluster.botEdit(routeTo, info); err != nil {
+			writeErr(ErrClusterNodeUnreachable("", edit.Topic, now))
+			return
+		}
+	} else {
+		globals.hub.route <- &ServerComMessage{Info: info, rcptto: routeTo, timestamp: now}
+	}
+
+	wrt.WriteHeader(http.StatusAccepted)
+	enc.Encode(NoErrAccepted("", edit.Topic, now))
+}
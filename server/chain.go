@@ -0,0 +1,168 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Tamper-evident message history. With "history_chain" enabled every
+ *  message saved into a topic is linked to the previous message by hash:
+ *    head.prev - hash of the previous message of the topic;
+ *    head.hash - hash of this message, including head.prev.
+ *  The hash of the last message, the head of the chain, is reported in
+ *  {meta desc} as "chain". An auditor who recorded the head can later fetch
+ *  the history and recompute the hashes: a message altered, removed or
+ *  inserted by the server breaks the chain. Edits of messages are rejected
+ *  while the chain is enabled. Hard-deleted messages keep their hashes, so
+ *  deletions show up as messages without content, not as broken links.
+ *
+ *  The hash is SHA-256 in base64 of the JSON object
+ *    {"seq":..,"ts":..,"from":"usr..","thread":..,"head":{..},"content":..}
+ *  with the fields in this order, no whitespace, keys of "head" and of the
+ *  content sorted, no HTML escaping; "ts" is the time of the message in
+ *  milliseconds since the epoch, "head" excludes "hash".
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Keys of the message head with the hashes
+	CHAIN_HEAD_PREV = "prev"
+	CHAIN_HEAD_HASH = "hash"
+)
+
+type historyChainConfig struct {
+	// Link messages by hash
+	Enabled bool `json:"enabled"`
+}
+
+var historyChain struct {
+	enabled bool
+}
+
+// historyChainInit parses the config. The chain is disabled by default.
+func historyChainInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config historyChainConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse history_chain config:", err)
+	}
+	historyChain.enabled = config.Enabled
+	if historyChain.enabled {
+		logMain.Info("Message history is chained by hash")
+	}
+}
+
+// chainHash returns the hash of the stored message.
+func chainHash(msg *types.Message) (string, error) {
+	head := make(map[string]string, len(msg.Head))
+	for key, val := range msg.Head {
+		if key != CHAIN_HEAD_HASH {
+			head[key] = val
+		}
+	}
+
+	// Numbers are normalized to float64 as they are read back from the store
+	var content interface{}
+	if msg.Content != nil {
+		raw, err := json.Marshal(msg.Content)
+		if err != nil {
+			return "", err
+		}
+		if err = json.Unmarshal(raw, &content); err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(struct {
+		SeqId   int               `json:"seq"`
+		Ts      int64             `json:"ts"`
+		From    string            `json:"from"`
+		Thread  int               `json:"thread"`
+		Head    map[string]string `json:"head"`
+		Content interface{}       `json:"content"`
+	}{
+		SeqId:   msg.SeqId,
+		Ts:      msg.CreatedAt.UnixNano() / 1e6,
+		From:    types.ParseUid(msg.From).UserId(),
+		Thread:  msg.Thread,
+		Head:    head,
+		Content: content,
+	}); err != nil {
+		return "", err
+	}
+
+	// Encoder terminates the value with a newline
+	sum := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// chainLoad finds the head of the chain when the topic saves or reports it for the first time.
+func (t *Topic) chainLoad() error {
+	if t.chainLoaded || t.lastId == 0 {
+		t.chainLoaded = true
+		return nil
+	}
+
+	messages, err := store.Messages.GetAll(t.name, types.ZeroUid,
+		&types.BrowseOpt{Since: t.lastId, Before: t.lastId + 1, Limit: 1})
+	if err != nil {
+		return err
+	}
+	if len(messages) > 0 {
+		last := &messages[0]
+		t.chainHead = last.Head[CHAIN_HEAD_HASH]
+		if t.chainHead == "" && last.DeletedAt == nil {
+			// The message was saved before the chain was enabled
+			t.chainHead, _ = chainHash(last)
+		}
+	}
+	t.chainLoaded = true
+	return nil
+}
+
+// chainLink adds the hashes to the head of the message before it's saved. Returns the new head of the
+// chain which becomes current once the message is saved.
+func (t *Topic) chainLink(msg *types.Message) (string, error) {
+	// Without the head the message would start a new chain
+	if err := t.chainLoad(); err != nil {
+		return "", err
+	}
+
+	// The head may be shared with other messages
+	head := make(map[string]string, len(msg.Head)+2)
+	for key, val := range msg.Head {
+		head[key] = val
+	}
+	// The values sent by the client are replaced
+	delete(head, CHAIN_HEAD_HASH)
+	delete(head, CHAIN_HEAD_PREV)
+	if t.chainHead != "" {
+		head[CHAIN_HEAD_PREV] = t.chainHead
+	}
+	msg.Head = head
+
+	// The time is part of the hash, it must not be assigned by the store
+	msg.InitTimes()
+
+	hash, err := chainHash(msg)
+	if err != nil {
+		return "", err
+	}
+	head[CHAIN_HEAD_HASH] = hash
+	return hash, nil
+}
@@ -0,0 +1,125 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Checklists: shared to-do lists inside topics. A checklist is a {pub}
+ *  message with head.checklist set and content of the form
+ *    {"items": [{"text": "Buy milk", "done": false}, ...]}
+ *  Members toggle items with {note what="check" seq=N item=I done=true};
+ *  the server persists the state of the item and broadcasts the change as
+ *  {info what="check"}.
+ *
+ *  head.checklist controls who may toggle the items:
+ *    "all" - any member with the 'W' permission,
+ *    "author" - only the author of the checklist and the topic owner.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of items in a checklist
+	CHECKLIST_MAX_ITEMS = 128
+)
+
+// checklistValidate checks that the message is a well-formed checklist and initializes missing item states.
+func checklistValidate(data *MsgServerData) bool {
+	switch data.Head["checklist"] {
+	case "all", "author":
+	default:
+		return false
+	}
+
+	items, ok := checklistItems(data.Content)
+	if !ok || len(items) == 0 || len(items) > CHECKLIST_MAX_ITEMS {
+		return false
+	}
+
+	for _, it := range items {
+		item, ok := it.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if text, ok := item["text"].(string); !ok || text == "" {
+			return false
+		}
+		if done, ok := item["done"]; !ok {
+			item["done"] = false
+		} else if _, ok = done.(bool); !ok {
+			return false
+		}
+		// The server keeps track of who completed the item
+		delete(item, "by")
+	}
+	return true
+}
+
+// checklistItems returns the list of checklist items from message content.
+func checklistItems(content interface{}) ([]interface{}, bool) {
+	if content, ok := content.(map[string]interface{}); ok {
+		items, ok := content["items"].([]interface{})
+		return items, ok
+	}
+	return nil, false
+}
+
+// checklistToggle changes the state of the checklist item and saves the checklist.
+// Returns true if the state has changed and the change should be broadcast.
+func (t *Topic) checklistToggle(uid types.Uid, info *MsgServerInfo) bool {
+	pud := t.perUser[uid]
+	if !(pud.modeGiven & pud.modeWant).IsWriter() || info.SeqId <= pud.clearId {
+		return false
+	}
+
+	messages, err := store.Messages.GetAll(t.name, uid,
+		&types.BrowseOpt{Since: info.SeqId, Before: info.SeqId + 1, Limit: 1})
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to load checklist: %v", t.name, err)
+		return false
+	}
+	if len(messages) == 0 || messages[0].DeletedAt != nil {
+		return false
+	}
+	msg := &messages[0]
+
+	switch msg.Head["checklist"] {
+	case "all":
+	case "author":
+		if msg.From != uid.String() && uid != t.owner {
+			return false
+		}
+	default:
+		// Not a checklist
+		return false
+	}
+
+	items, ok := checklistItems(msg.Content)
+	if !ok || *info.Item >= len(items) {
+		return false
+	}
+	item, ok := items[*info.Item].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if done, _ := item["done"].(bool); done == *info.Done {
+		return false
+	}
+
+	item["done"] = *info.Done
+	if *info.Done {
+		item["by"] = uid.UserId()
+	} else {
+		delete(item, "by")
+	}
+
+	if err = store.Messages.Update(t.name, info.SeqId, map[string]interface{}{"Content": msg.Content}); err != nil {
+		logTopic.Errorf("topic[%s]: failed to update checklist: %v", t.name, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,485 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Diagnostic logs uploaded by client applications. An authenticated user
+ *  POSTs a multipart form to /v0/logs with the log in "file" and, if the
+ *  user has one, the support ticket ID in "ticket". The log must be text.
+ *  Before the log is stored by the media handler the server removes email
+ *  addresses, phone numbers, credentials and anything else matched by the
+ *  configured patterns. Uploads are limited in size and in number per user
+ *  per hour.
+ *
+ *  Support staff with root access find logs and link them to tickets
+ *  through /v0/admin/logs:
+ *    GET ?ticket=<id>&user=usr...&limit=N lists the logs, newest first;
+ *    GET ?id=<log id> returns the content of the log;
+ *    POST ?id=<log id>&ticket=<id> links the log to the ticket, an empty
+ *      ticket unlinks it.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// URL path for log uploads
+	CLIENT_LOG_PATH = "/v0/logs"
+	// Path of the admin endpoint
+	ADMIN_CLIENT_LOGS_PATH = "/v0/admin/logs"
+	// Default maximum size of an uploaded log
+	CLIENT_LOG_DEFAULT_MAX_SIZE = 1 << 20
+	// Default number of uploads per user per hour
+	CLIENT_LOG_DEFAULT_RATE = 10
+	// Maximum length of a ticket ID
+	CLIENT_LOG_MAX_TICKET_LENGTH = 64
+	// Default and maximum number of logs listed by the admin endpoint
+	CLIENT_LOG_DEFAULT_LIST = 50
+	CLIENT_LOG_MAX_LIST     = 500
+	// Rate counters are purged of expired windows when there are so many
+	CLIENT_LOG_PURGE_SIZE = 10000
+)
+
+type clientLogsConfig struct {
+	// Enable log uploads, requires a media handler
+	Enabled bool `json:"enabled"`
+	// Maximum size of an uploaded log in bytes
+	MaxSize int64 `json:"max_size"`
+	// Uploads allowed per user per hour
+	Rate int `json:"rate"`
+	// Regular expressions of additional content to remove from logs
+	Redact []string `json:"redact"`
+}
+
+// Content which is always removed from logs
+var clientLogDefaultRedact = []string{
+	// Email addresses
+	`[\w.+-]+@[\w-]+(\.[\w-]+)+`,
+	// Phone numbers in international format; local numbers cannot be told from timestamps
+	`\+\d[\d\s().-]{6,}\d`,
+	// Credentials in key=value or "key": "value" form
+	`(?i)(password|passwd|secret|token|authorization|cookie|api[_-]?key)["']?\s*[:=]\s*["']?[^\s"',;]+`,
+}
+
+// Uploads of one user in the current window
+type clientLogWindow struct {
+	count int
+	start time.Time
+}
+
+var clientLogs struct {
+	maxSize int64
+	rate    int
+	redact  []*regexp.Regexp
+
+	lock    sync.Mutex
+	windows map[types.Uid]*clientLogWindow
+
+	// Exported as ClientLogs in expvar
+	uploaded  *expvar.Int
+	throttled *expvar.Int
+	redacted  *expvar.Int
+}
+
+// clientLogsInit parses config and mounts the handlers. Log uploads are disabled by default.
+func clientLogsInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config clientLogsConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logHttp.Fatal("Failed to parse client_logs config:", err)
+	}
+	if !config.Enabled {
+		return
+	}
+	if globals.mediaHandler == nil {
+		logHttp.Fatal("client_logs: media handler is required")
+	}
+
+	clientLogs.maxSize = config.MaxSize
+	if clientLogs.maxSize <= 0 {
+		clientLogs.maxSize = CLIENT_LOG_DEFAULT_MAX_SIZE
+	}
+	clientLogs.rate = config.Rate
+	if clientLogs.rate <= 0 {
+		clientLogs.rate = CLIENT_LOG_DEFAULT_RATE
+	}
+	for _, expr := range append(clientLogDefaultRedact, config.Redact...) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			logHttp.Fatal("client_logs: invalid redact pattern", expr, err)
+		}
+		clientLogs.redact = append(clientLogs.redact, re)
+	}
+	clientLogs.windows = make(map[types.Uid]*clientLogWindow)
+
+	clientLogs.uploaded = new(expvar.Int)
+	clientLogs.throttled = new(expvar.Int)
+	clientLogs.redacted = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("uploaded", clientLogs.uploaded)
+	vars.Set("throttled", clientLogs.throttled)
+	vars.Set("redacted", clientLogs.redacted)
+	expvar.Publish("ClientLogs", vars)
+
+	http.HandleFunc(CLIENT_LOG_PATH, serveClientLogUpload)
+	http.HandleFunc(ADMIN_CLIENT_LOGS_PATH, serveClientLogsAdmin)
+	logHttp.Infof("Client log uploads enabled, max size %d, %d per hour", clientLogs.maxSize, clientLogs.rate)
+}
+
+// clientLogThrottle counts an upload of the user. Returns the time to wait if the user is over the rate.
+func clientLogThrottle(uid types.Uid, now time.Time) (time.Duration, bool) {
+	clientLogs.lock.Lock()
+	defer clientLogs.lock.Unlock()
+
+	w := clientLogs.windows[uid]
+	if w == nil || now.Sub(w.start) >= time.Hour {
+		if w == nil && len(clientLogs.windows) >= CLIENT_LOG_PURGE_SIZE {
+			for key, val := range clientLogs.windows {
+				if now.Sub(val.start) >= time.Hour {
+					delete(clientLogs.windows, key)
+				}
+			}
+		}
+		w = &clientLogWindow{start: now}
+		clientLogs.windows[uid] = w
+	}
+	if w.count >= clientLogs.rate {
+		clientLogs.throttled.Add(1)
+		return w.start.Add(time.Hour).Sub(now), true
+	}
+	w.count++
+	return 0, false
+}
+
+// clientLogRedact removes personal data and credentials from the log.
+func clientLogRedact(content []byte) []byte {
+	for _, re := range clientLogs.redact {
+		content = re.ReplaceAllFunc(content, func([]byte) []byte {
+			clientLogs.redacted.Add(1)
+			return []byte("[redacted]")
+		})
+	}
+	return content
+}
+
+// isValidTicket checks the support ticket ID.
+func isValidTicket(ticket string) bool {
+	if len(ticket) > CLIENT_LOG_MAX_TICKET_LENGTH {
+		return false
+	}
+	for _, r := range ticket {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// serveClientLogUpload handles multipart POST requests to /v0/logs. The form must contain "file" with
+// the log and may contain "ticket", the ID of the support ticket.
+func serveClientLogUpload(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	uid, err := authHttpRequest(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	}
+
+	if retry, throttled := clientLogThrottle(uid, now); throttled {
+		writeErr(ErrTooManyRequests("", "", now, retry))
+		return
+	}
+
+	// Some room for the other fields of the form
+	limit := clientLogs.maxSize + 4096
+	if req.ContentLength > limit {
+		writeErr(ErrTooLarge("", "", now))
+		return
+	}
+	req.Body = http.MaxBytesReader(wrt, req.Body, limit)
+
+	if err = req.ParseMultipartForm(limit); err != nil {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+
+	ticket := req.FormValue("ticket")
+	file, header, err := req.FormFile("file")
+	if err != nil || !isValidTicket(ticket) {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+	defer file.Close()
+
+	// Logs are text only: binary content cannot be redacted
+	mimeType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if mimeType == "" {
+		mimeType = "text/plain"
+	}
+	if !strings.HasPrefix(mimeType, "text/") && mimeType != "application/json" {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+	if header.Size > clientLogs.maxSize {
+		writeErr(ErrTooLarge("", "", now))
+		return
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(file, clientLogs.maxSize))
+	if err != nil {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+	content = clientLogRedact(content)
+
+	fdef := &types.FileDef{
+		User:     uid.String(),
+		MimeType: mimeType,
+		Size:     int64(len(content))}
+	fdef.Id = store.GetUidString()
+
+	if err = store.Files.StartUpload(fdef); err != nil {
+		logHttp.Error("logs: failed to create file record", err)
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+	fdef.Location, err = globals.mediaHandler.Upload(fdef, bytes.NewReader(content))
+	if err != nil {
+		logHttp.Error("logs: failed to store log", err)
+		store.Files.FinishUpload(fdef, false)
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+	if err = store.Files.FinishUpload(fdef, true); err != nil {
+		logHttp.Error("logs: failed to update file record", err)
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+
+	cl := &types.ClientLog{
+		User:      uid.String(),
+		File:      fdef.Id,
+		Ticket:    ticket,
+		UserAgent: req.Header.Get("User-Agent"),
+		Size:      fdef.Size}
+	if err = store.ClientLogs.Create(cl); err != nil {
+		logHttp.Error("logs: failed to save log record", err)
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+	clientLogs.uploaded.Add(1)
+
+	pkt := NoErr("", "", now)
+	pkt.Ctrl.Params = map[string]string{"id": cl.Id}
+	enc.Encode(pkt)
+}
+
+// Log record as reported by the admin endpoint
+type clientLogInfo struct {
+	Id        string    `json:"id"`
+	User      string    `json:"user"`
+	Ticket    string    `json:"ticket,omitempty"`
+	UserAgent string    `json:"ua,omitempty"`
+	Size      int64     `json:"size"`
+	Created   time.Time `json:"created"`
+}
+
+func clientLogInfoOf(cl *types.ClientLog) *clientLogInfo {
+	return &clientLogInfo{
+		Id:        cl.Id,
+		User:      types.ParseUid(cl.User).UserId(),
+		Ticket:    cl.Ticket,
+		UserAgent: cl.UserAgent,
+		Size:      cl.Size,
+		Created:   cl.CreatedAt}
+}
+
+// serveClientLogsAdmin lists, returns and links client logs:
+// GET /v0/admin/logs?ticket=<id>&user=usr...&limit=N
+// GET /v0/admin/logs?id=<log id>
+// POST /v0/admin/logs?id=<log id>&ticket=<id>
+func serveClientLogsAdmin(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if req.Method != http.MethodGet && redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	if _, authLvl, err := authHttpRequestLevel(req); err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	} else if authLvl != auth.LevelRoot {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	id := req.FormValue("id")
+	switch req.Method {
+	case http.MethodGet:
+		if id == "" {
+			clientLogsList(wrt, req, writeErr)
+			return
+		}
+		cl, err := store.ClientLogs.Get(id)
+		if err != nil {
+			writeErr(ErrUnknown("", "", now))
+			return
+		}
+		if cl == nil {
+			writeErr(ErrNotFound("", "", now))
+			return
+		}
+		clientLogDownload(wrt, cl, writeErr)
+
+	case http.MethodPost:
+		ticket := req.FormValue("ticket")
+		if id == "" || !isValidTicket(ticket) {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+		cl, err := store.ClientLogs.Get(id)
+		if err != nil {
+			writeErr(ErrUnknown("", "", now))
+			return
+		}
+		if cl == nil {
+			writeErr(ErrNotFound("", "", now))
+			return
+		}
+		cl.Ticket = ticket
+		if err = store.ClientLogs.Update(cl); err != nil {
+			writeErr(ErrUnknown("", "", now))
+			return
+		}
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc.Encode(clientLogInfoOf(cl))
+
+	default:
+		writeErr(ErrOperationNotAllowed("", "", now))
+	}
+}
+
+// clientLogsList writes the records of logs matching the query.
+func clientLogsList(wrt http.ResponseWriter, req *http.Request, writeErr func(*ServerComMessage)) {
+	now := types.TimeNow()
+
+	ticket := req.FormValue("ticket")
+	var user types.Uid
+	if str := req.FormValue("user"); str != "" {
+		if user = types.ParseUserId(str); user.IsZero() {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+	}
+	if ticket == "" && user.IsZero() {
+		// Listing all logs is not allowed
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+
+	limit := CLIENT_LOG_DEFAULT_LIST
+	if str := req.FormValue("limit"); str != "" {
+		if val, err := strconv.Atoi(str); err == nil && val > 0 {
+			limit = val
+		}
+	}
+	if limit > CLIENT_LOG_MAX_LIST {
+		limit = CLIENT_LOG_MAX_LIST
+	}
+
+	found, err := store.ClientLogs.Find(ticket, user, limit)
+	if err != nil {
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+
+	result := make([]*clientLogInfo, 0, len(found))
+	for i := range found {
+		result = append(result, clientLogInfoOf(&found[i]))
+	}
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(wrt).Encode(result)
+}
+
+// clientLogDownload writes the content of the log.
+func clientLogDownload(wrt http.ResponseWriter, cl *types.ClientLog, writeErr func(*ServerComMessage)) {
+	now := types.TimeNow()
+
+	fdef, err := store.Files.Get(cl.File)
+	if err != nil {
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+	if fdef == nil || fdef.Status != types.UploadCompleted {
+		writeErr(ErrNotFound("", "", now))
+		return
+	}
+
+	file, err := globals.mediaHandler.Download(fdef.Location)
+	if err != nil {
+		logHttp.Warn("logs: failed to read log", err)
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+	defer file.Close()
+
+	wrt.Header().Set("Content-Type", fdef.MimeType)
+	wrt.Header().Set("Content-Length", strconv.FormatInt(fdef.Size, 10))
+	io.Copy(wrt, file)
+}
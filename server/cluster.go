@@ -20,6 +20,9 @@ const CLUSTER_HASH_REPLICAS = 20
 type ClusterNodeConfig struct {
 	Name string `json:"name"`
 	Addr string `json:"addr"`
+	// Relative capacity of the node, 1 by default. A node with weight 2 hosts twice as many topics.
+	// Must be the same in the configs of all nodes.
+	Weight int `json:"weight"`
 }
 
 type ClusterConfig struct {
@@ -27,8 +30,15 @@ type ClusterConfig struct {
 	Nodes []ClusterNodeConfig `json:"nodes"`
 	// Name of this cluster node
 	ThisName string `json:"self"`
+	// Number of virtual nodes in the ring hash per unit of weight
+	VNodes int `json:"vnodes"`
+	// Placement of topics: "ring" for consistent hashing (default) or "rendezvous"
+	Hashing string `json:"hashing"`
 	// Failover configuration
 	Failover *ClusterFailoverConfig
+	// Nodes exchange messages over a pub/sub server instead of connecting to each other. Nodes are
+	// not listed then.
+	Backplane *ClusterBackplaneConfig `json:"backplane"`
 }
 
 // Client connection to another node
@@ -45,6 +55,8 @@ type ClusterNode struct {
 	address string
 	// Name of the node
 	name string
+	// Backplane the node is connected over, nil if it's connected directly
+	bp *clusterBackplane
 
 	// A number of times this node has failed in a row
 	failCount int
@@ -78,6 +90,11 @@ type ClusterSess struct {
 
 	// Session ID
 	Sid string
+
+	// Root admin impersonating the user, or 0
+	Impersonator types.Uid
+	// Time when the impersonated session expires
+	ImpersonationExpires time.Time
 }
 
 // Proxy to Master request message
@@ -97,6 +114,24 @@ type ClusterReq struct {
 	Sess *ClusterSess
 	// True if the original session has disconnected
 	SessGone bool
+	// Serialized trace context of the request
+	TraceCtx map[string]string
+	// ID of the request assigned by the node which received it from the client
+	ReqId string
+}
+
+// Update or long poll of a bot whose queue is kept by another node
+type ClusterBotReq struct {
+	Bot types.Uid
+	// Message or notification to queue
+	Data *MsgServerData
+	Info *MsgServerInfo
+	// Card edit: topic the card is in
+	Topic string
+	// Long poll parameters
+	Offset  int64
+	Limit   int
+	Timeout time.Duration
 }
 
 // Master to Proxy response message
@@ -104,6 +139,8 @@ type ClusterResp struct {
 	Msg []byte
 	// Session ID to forward message to, if any.
 	FromSID string
+	// Priority class of the message in the session's outbound queues
+	Class int
 }
 
 // Handle outbound node communication: read messages from the channel, forward to remote nodes.
@@ -125,7 +162,7 @@ func (n *ClusterNode) reconnect() {
 	var err error
 	for {
 		// Attempt to reconnect right away
-		if n.endpoint, err = rpc.Dial("tcp", n.address); err == nil {
+		if n.endpoint, err = n.dial(); err == nil {
 			if reconnTicker != nil {
 				reconnTicker.Stop()
 			}
@@ -133,7 +170,7 @@ func (n *ClusterNode) reconnect() {
 			n.connected = true
 			n.reconnecting = false
 			n.lock.Unlock()
-			log.Printf("cluster: connection to '%s' established", n.name)
+			logCluster.Infof("cluster: connection to '%s' established", n.name)
 			return
 		} else if count == 0 {
 			reconnTicker = time.NewTicker(DEFAULT_CLUSTER_RECONNECT)
@@ -146,7 +183,7 @@ func (n *ClusterNode) reconnect() {
 			// Wait for timer to try to reconnect again. Do nothing if the timer is inactive.
 		case <-n.done:
 			// Shutting down
-			log.Printf("cluster: node '%s' shutdown started", n.name)
+			logCluster.Infof("cluster: node '%s' shutdown started", n.name)
 			reconnTicker.Stop()
 			if n.endpoint != nil {
 				n.endpoint.Close()
@@ -155,19 +192,27 @@ func (n *ClusterNode) reconnect() {
 			n.connected = false
 			n.reconnecting = false
 			n.lock.Unlock()
-			log.Printf("cluster: node '%s' shut down completed", n.name)
+			logCluster.Infof("cluster: node '%s' shut down completed", n.name)
 			return
 		}
 	}
 }
 
+// dial connects to the node directly or over the backplane.
+func (n *ClusterNode) dial() (*rpc.Client, error) {
+	if n.bp != nil {
+		return n.bp.dial(n.name)
+	}
+	return rpc.Dial("tcp", n.address)
+}
+
 func (n *ClusterNode) call(proc string, msg interface{}, resp interface{}) error {
 	if !n.connected {
 		return errors.New("cluster: node '" + n.name + "' not connected")
 	}
 
 	if err := n.endpoint.Call(proc, msg, resp); err != nil {
-		log.Printf("cluster: call failed to '%s' [%s]", n.name, err)
+		logCluster.Warnf("cluster: call failed to '%s' [%s]", n.name, err)
 
 		n.lock.Lock()
 		if n.connected {
@@ -229,7 +274,7 @@ func (n *ClusterNode) callAsync(proc string, msg interface{}, resp interface{},
 
 // Proxy forwards message to master
 func (n *ClusterNode) forward(msg *ClusterReq) error {
-	log.Printf("cluster: forwarding request to node '%s'", n.name)
+	logCluster.Debugf("cluster: forwarding request to node '%s'", n.name)
 	msg.Node = globals.cluster.thisNodeName
 	rejected := false
 	err := n.call("Cluster.Master", msg, &rejected)
@@ -241,7 +286,7 @@ func (n *ClusterNode) forward(msg *ClusterReq) error {
 
 // Master responds to proxy
 func (n *ClusterNode) respond(msg *ClusterResp) error {
-	log.Printf("cluster: replying to node '%s'", n.name)
+	logCluster.Debugf("cluster: replying to node '%s'", n.name)
 	unused := false
 	return n.call("Cluster.Proxy", msg, &unused)
 }
@@ -256,9 +301,19 @@ type Cluster struct {
 	inbound *net.TCPListener
 	// Ring hash for mapping topic names to nodes
 	ring *rh.Ring
+	// Number of virtual nodes in the ring hash per unit of weight
+	vnodes int
+	// Weights of nodes in the ring hash, all nodes including this one
+	weights map[string]int
+	// Topics are placed by rendezvous hashing instead of the ring
+	rendezvous bool
+	// Nodes believed to be alive when the ring hash was last calculated, including cordoned nodes
+	live map[string]bool
 
 	// Failover parameters. Could be nil if failover is not enabled
 	fo *ClusterFailover
+	// Pub/sub backplane, nil if nodes are connected directly
+	bp *clusterBackplane
 }
 
 // Cluster.Master at topic's master node receives C2S messages from topic's proxy nodes.
@@ -266,7 +321,7 @@ type Cluster struct {
 // dispatch the message to it like it came from a normal ws/lp connection.
 // Called by a remote node.
 func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
-	log.Printf("cluster: Master request received from node '%s'", msg.Node)
+	logCluster.Debugf("cluster: Master request received from node '%s'", msg.Node)
 
 	// Find the local session associated with the given remote session.
 	sess := globals.sessionStore.Get(msg.Sess.Sid)
@@ -276,14 +331,15 @@ func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
 		if sess != nil {
 			sess.stop <- nil
 		}
-	} else if msg.Signature == c.ring.Signature() {
-		// This cluster member received a request for a topic it owns.
+	} else if msg.Signature == c.ring.Signature() || (msg.Msg != nil && msg.Msg.Pub != nil && handoffActive(msg.RcptTo)) {
+		// This cluster member received a request for a topic it owns or a {pub} to a topic it is
+		// handing off to another node. The proxy may not know yet that the topic has moved.
 
 		if sess == nil {
 			// If the session is not found, create it.
 			node := globals.cluster.nodes[msg.Node]
 			if node == nil {
-				log.Println("cluster: request from an unknown node", msg.Node)
+				logCluster.Warn("cluster: request from an unknown node", msg.Node)
 				return nil
 			}
 
@@ -299,8 +355,13 @@ func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
 		sess.remoteAddr = msg.Sess.RemoteAddr
 		sess.lang = msg.Sess.Lang
 		sess.deviceId = msg.Sess.DeviceId
+		sess.impersonator = msg.Sess.Impersonator
+		sess.impersonationExpires = msg.Sess.ImpersonationExpires
 
 		// Dispatch remote message to a local session.
+		msg.Msg.ctx = traceExtract(msg.TraceCtx)
+		msg.Msg.reqId = msg.ReqId
+		logCluster.Debugf("cluster: request req=%s from node '%s'", msg.ReqId, msg.Node)
 		sess.dispatch(msg.Msg)
 	} else {
 		// Reject the request: wrong signature, cluster is out of sync.
@@ -313,34 +374,90 @@ func (c *Cluster) Master(msg *ClusterReq, rejected *bool) error {
 // Proxy recieves messages from the master node addressed to a specific local session.
 // Called by Session.writeRPC
 func (Cluster) Proxy(msg *ClusterResp, unused *bool) error {
-	log.Println("cluster: response from Master for session", msg.FromSID)
+	logCluster.Debug("cluster: response from Master for session", msg.FromSID)
 
 	// This cluster member received a response from topic owner to be forwarded to a session
 	// Find appropriate session, send the message to it
 	if sess := globals.sessionStore.Get(msg.FromSID); sess != nil {
-		select {
-		case sess.send <- msg.Msg:
-		case <-time.After(time.Millisecond * 10):
-			log.Println("cluster.Proxy: timeout")
+		if !sess.enqueueWait(msg.Msg, msg.Class) {
+			logCluster.Warn("cluster.Proxy: timeout")
 		}
 	} else {
-		log.Println("cluster: master response for unknown session", msg.FromSID)
+		logCluster.Warn("cluster: master response for unknown session", msg.FromSID)
+	}
+
+	return nil
+}
+
+// BotUpdate queues a message for a bot owned by this node.
+func (Cluster) BotUpdate(msg *ClusterBotReq, unused *bool) error {
+	if !isBot(msg.Bot) {
+		return errors.New("cluster: update for unknown bot " + msg.Bot.UserId())
+	}
+	botEnqueue(msg.Bot, msg.Data, msg.Info)
+	return nil
+}
+
+// BotEdit routes an edit of a card made by a bot to the topic hosted by this node.
+func (Cluster) BotEdit(msg *ClusterBotReq, unused *bool) error {
+	globals.hub.route <- &ServerComMessage{Info: msg.Info, rcptto: msg.Topic, timestamp: types.TimeNow()}
+	return nil
+}
+
+// BotPoll serves a long poll of a bot owned by this node.
+func (Cluster) BotPoll(msg *ClusterBotReq, updates *[]botUpdate) error {
+	if !isBot(msg.Bot) {
+		return errors.New("cluster: poll for unknown bot " + msg.Bot.UserId())
 	}
+	*updates = bots.queues[msg.Bot].poll(msg.Offset, msg.Limit, msg.Timeout)
+	return nil
+}
 
+// botUpdate forwards a message to the node which keeps the bot's queue.
+func (c *Cluster) botUpdate(bot types.Uid, data *MsgServerData, info *MsgServerInfo) error {
+	n := c.nodeForTopic(bot.UserId())
+	if n == nil {
+		return errors.New("attempt to route to non-existent node")
+	}
+	unused := false
+	n.callAsync("Cluster.BotUpdate", &ClusterBotReq{Bot: bot, Data: data, Info: info}, &unused, nil)
 	return nil
 }
 
+// botEdit forwards an edit of a card to the node which hosts the topic.
+func (c *Cluster) botEdit(topic string, info *MsgServerInfo) error {
+	n := c.nodeForTopic(topic)
+	if n == nil {
+		return errors.New("attempt to route to non-existent node")
+	}
+	unused := false
+	n.callAsync("Cluster.BotEdit", &ClusterBotReq{Bot: types.ParseUserId(info.From), Topic: topic, Info: info}, &unused, nil)
+	return nil
+}
+
+// botPoll forwards a long poll to the node which keeps the bot's queue.
+func (c *Cluster) botPoll(bot types.Uid, offset int64, limit int, timeout time.Duration) ([]botUpdate, error) {
+	n := c.nodeForTopic(bot.UserId())
+	if n == nil {
+		return nil, errors.New("attempt to route to non-existent node")
+	}
+	var updates []botUpdate
+	err := n.call("Cluster.BotPoll",
+		&ClusterBotReq{Bot: bot, Offset: offset, Limit: limit, Timeout: timeout}, &updates)
+	return updates, err
+}
+
 // Given topic name, find appropriate cluster node to route message to
 func (c *Cluster) nodeForTopic(topic string) *ClusterNode {
 	key := c.ring.Get(topic)
 	if key == c.thisNodeName {
-		log.Println("cluster: request to route to self")
+		logCluster.Warn("cluster: request to route to self")
 		// Do not route to self
 		return nil
 	} else {
 		node := globals.cluster.nodes[key]
 		if node == nil {
-			log.Println("cluster: no node for topic", topic, key)
+			logCluster.Warn("cluster: no node for topic", topic, key)
 		}
 		return node
 	}
@@ -363,10 +480,12 @@ func (c *Cluster) routeToTopic(msg *ClientComMessage, topic string, sess *Sessio
 	}
 
 	// Save node name: it's need in order to inform relevant nodes when the session is disconnected
+	sess.rlock.Lock()
 	if sess.nodes == nil {
 		sess.nodes = make(map[string]bool)
 	}
 	sess.nodes[n.name] = true
+	sess.rlock.Unlock()
 
 	return n.forward(
 		&ClusterReq{
@@ -374,6 +493,8 @@ func (c *Cluster) routeToTopic(msg *ClientComMessage, topic string, sess *Sessio
 			Signature: c.ring.Signature(),
 			Msg:       msg,
 			RcptTo:    topic,
+			TraceCtx:  traceInject(msg.ctx),
+			ReqId:     msg.reqId,
 			Sess: &ClusterSess{
 				Uid:        sess.uid,
 				AuthLvl:    sess.authLvl,
@@ -382,7 +503,10 @@ func (c *Cluster) routeToTopic(msg *ClientComMessage, topic string, sess *Sessio
 				Ver:        sess.ver,
 				Lang:       sess.lang,
 				DeviceId:   sess.deviceId,
-				Sid:        sess.sid}})
+				Sid:        sess.sid,
+
+				Impersonator:         sess.impersonator,
+				ImpersonationExpires: sess.impersonationExpires}})
 }
 
 // Session terminated at origin. Inform remote Master nodes that the session is gone.
@@ -391,6 +515,9 @@ func (c *Cluster) sessionGone(sess *Session) error {
 		return nil
 	}
 
+	sess.rlock.Lock()
+	defer sess.rlock.Unlock()
+
 	// Save node name: it's need in order to inform relevant nodes when the session is disconnected
 	for name, _ := range sess.nodes {
 		n := c.nodes[name]
@@ -412,18 +539,18 @@ func (c *Cluster) sessionGone(sess *Session) error {
 
 func clusterInit(configString json.RawMessage, self *string) {
 	if globals.cluster != nil {
-		log.Fatal("Cluster already initialized")
+		logCluster.Fatal("Cluster already initialized")
 	}
 
 	// This is a standalone server, not initializing
 	if configString == nil || len(configString) == 0 {
-		log.Println("Running as a standalone server.")
+		logCluster.Info("Running as a standalone server.")
 		return
 	}
 
 	var config ClusterConfig
 	if err := json.Unmarshal(configString, &config); err != nil {
-		log.Fatal(err)
+		logCluster.Fatal(err)
 	}
 
 	gob.Register([]interface{}{})
@@ -435,10 +562,35 @@ func clusterInit(configString json.RawMessage, self *string) {
 	}
 	globals.cluster = &Cluster{
 		thisNodeName: thisName,
-		nodes:        make(map[string]*ClusterNode)}
+		nodes:        make(map[string]*ClusterNode),
+		vnodes:       CLUSTER_HASH_REPLICAS,
+		weights:      make(map[string]int, len(config.Nodes))}
+	if config.VNodes > 0 {
+		globals.cluster.vnodes = config.VNodes
+	}
+	switch config.Hashing {
+	case "", "ring":
+	case "rendezvous":
+		globals.cluster.rendezvous = true
+	default:
+		logCluster.Fatal("Unknown cluster hashing '" + config.Hashing + "'")
+	}
+	globals.cluster.startCordoned()
+
+	if config.Backplane != nil {
+		globals.cluster.backplaneInit(config.Backplane, config.Failover)
+		return
+	}
 
 	listenOn := ""
 	for _, host := range config.Nodes {
+		if host.Weight < 0 {
+			logCluster.Fatalf("Invalid weight %d of cluster node '%s'", host.Weight, host.Name)
+		} else if host.Weight == 0 {
+			host.Weight = 1
+		}
+		globals.cluster.weights[host.Name] = host.Weight
+
 		if host.Name == globals.cluster.thisNodeName {
 			listenOn = host.Addr
 			// Don't create a cluster member for this local instance
@@ -456,7 +608,7 @@ func clusterInit(configString json.RawMessage, self *string) {
 
 	if len(globals.cluster.nodes) == 0 {
 		// Cluster needs at least two nodes.
-		log.Fatal("Invalid cluster size: 1")
+		logCluster.Fatal("Invalid cluster size: 1")
 	}
 
 	if !globals.cluster.failoverInit(config.Failover) {
@@ -465,18 +617,22 @@ func clusterInit(configString json.RawMessage, self *string) {
 
 	addr, err := net.ResolveTCPAddr("tcp", listenOn)
 	if err != nil {
-		log.Fatal(err)
+		logCluster.Fatal(err)
 	}
 
 	globals.cluster.inbound, err = net.ListenTCP("tcp", addr)
 	if err != nil {
-		log.Fatal(err)
+		logCluster.Fatal(err)
 	}
 
 	rpc.Register(globals.cluster)
 	go rpc.Accept(globals.cluster.inbound)
 
-	log.Printf("Cluster of %d nodes initialized, node '%s' listening on [%s]", len(globals.cluster.nodes)+1,
+	globals.cluster.restartInit()
+	globals.cluster.handoffInit()
+	globals.cluster.failoverTestInit(config.Failover)
+
+	logCluster.Infof("Cluster of %d nodes initialized, node '%s' listening on [%s]", len(globals.cluster.nodes)+1,
 		globals.cluster.thisNodeName, listenOn)
 }
 
@@ -484,7 +640,7 @@ func clusterInit(configString json.RawMessage, self *string) {
 func (sess *Session) rpcWriteLoop() {
 	// There is no readLoop for RPC, delete the session here
 	defer func() {
-		log.Println("writeRPC - stop")
+		logCluster.Debug("writeRPC - stop")
 		sess.closeRPC()
 		globals.sessionStore.Delete(sess)
 		for _, sub := range sess.subs {
@@ -494,6 +650,13 @@ func (sess *Session) rpcWriteLoop() {
 	}()
 	var unused bool
 
+	// The error is returned if the remote node is down. Which means the remote
+	// session is also disconnected.
+	forward := func(msg []byte, class int) error {
+		return sess.rpcnode.call("Cluster.Proxy",
+			&ClusterResp{Msg: msg, FromSID: sess.sid, Class: class}, &unused)
+	}
+
 	for {
 		select {
 		case msg, ok := <-sess.send:
@@ -501,12 +664,18 @@ func (sess *Session) rpcWriteLoop() {
 				// channel closed
 				return
 			}
-			// The error is returned if the remote node is down. Which means the remote
-			// session is also disconnected.
-			if err := sess.rpcnode.call("Cluster.Proxy",
-				&ClusterResp{Msg: msg, FromSID: sess.sid}, &unused); err != nil {
-
-				log.Println("sess.writeRPC: " + err.Error())
+			if err := forward(msg, SEND_CLASS_DATA); err != nil {
+				logCluster.Warn("sess.writeRPC: " + err.Error())
+				return
+			}
+		case msg := <-sess.sendPres:
+			if err := sess.writeQueued(msg, SEND_CLASS_PRES, forward); err != nil {
+				logCluster.Warn("sess.writeRPC: " + err.Error())
+				return
+			}
+		case msg := <-sess.sendTyping:
+			if err := sess.writeQueued(msg, SEND_CLASS_TYPING, forward); err != nil {
+				logCluster.Warn("sess.writeRPC: " + err.Error())
 				return
 			}
 		case msg := <-sess.stop:
@@ -529,7 +698,7 @@ func (sess *Session) rpcWriteLoop() {
 // Proxied session is being closed at the Master node
 func (s *Session) closeRPC() {
 	if s.proto == RPC {
-		log.Println("cluster: session closed at master")
+		logCluster.Debug("cluster: session closed at master")
 	}
 }
 
@@ -539,39 +708,62 @@ func (c *Cluster) shutdown() {
 	}
 	globals.cluster = nil
 
-	c.inbound.Close()
+	if c.inbound != nil {
+		c.inbound.Close()
+	}
 
 	if c.fo != nil {
 		c.fo.done <- true
 	}
+	if c.bp != nil {
+		c.bp.done <- true
+	}
 
 	for _, n := range c.nodes {
 		n.done <- true
 	}
 
-	log.Println("Cluster shut down")
+	logCluster.Info("Cluster shut down")
+}
+
+// weight returns the weight of the node in the ring hash.
+func (c *Cluster) weight(name string) int {
+	if w := c.weights[name]; w > 0 {
+		return w
+	}
+	return 1
 }
 
 // Recalculate the ring hash using provided list of nodes or only nodes in a non-failed state.
 // Returns the list of nodes used for ring hash.
 func (c *Cluster) rehash(nodes []string) []string {
-	ring := rh.New(CLUSTER_HASH_REPLICAS, nil)
+	var ring *rh.Ring
+	if c.rendezvous {
+		ring = rh.NewRendezvous(c.vnodes, nil)
+	} else {
+		ring = rh.New(c.vnodes, nil)
+	}
 
 	var ringKeys []string
 
 	if nodes == nil {
 		for _, node := range c.nodes {
-			ringKeys = append(ringKeys, node.name)
+			nodes = append(nodes, node.name)
 		}
-		ringKeys = append(ringKeys, c.thisNodeName)
-	} else {
-		for _, name := range nodes {
+		nodes = append(nodes, c.thisNodeName)
+	}
+	live := make(map[string]bool, len(nodes))
+	for _, name := range nodes {
+		live[name] = true
+		// Nodes being restarted host no topics
+		if !isCordoned(name) {
 			ringKeys = append(ringKeys, name)
+			ring.AddWeighted(name, c.vnodes*c.weight(name))
 		}
 	}
-	ring.Add(ringKeys...)
 
 	c.ring = ring
+	c.live = live
 
 	return ringKeys
 }
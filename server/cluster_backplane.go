@@ -0,0 +1,471 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Cluster without peering. With "backplane" in cluster_config the nodes
+ *  don't connect to each other: they find each other and exchange cluster
+ *  messages over a Redis or NATS server. Nodes don't need to be listed in the
+ *  config, so N identical replicas can run behind a load balancer:
+ *    "cluster_config": {
+ *      "backplane": {"kind": "redis", "config": {"addr": "redis:6379"}}
+ *    }
+ *  Each node announces itself on the backplane every heartbeat. A node which
+ *  is not heard from for node_fail_after heartbeats is removed from the ring
+ *  hash, a newly heard node is added, and the topics move as usual. The name
+ *  of the node is the host name unless set by "self" or -cluster_self.
+ *
+ *  Cluster RPC runs unchanged over virtual connections: frames of a
+ *  connection are published to the channel of the receiving node.
+ *
+ *  Redis support is compiled with the "redis" build tag and uses Redis
+ *  Streams, NATS support with the "nats" tag.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default interval between announcements of a node
+	BACKPLANE_DEFAULT_HEARTBEAT = time.Second
+	// Default number of missed announcements before a node is considered gone
+	BACKPLANE_DEFAULT_FAIL_AFTER = 5
+	// Default prefix of backplane channels
+	BACKPLANE_DEFAULT_PREFIX = "tinode."
+	// Number of received frames buffered per virtual connection
+	BACKPLANE_CONN_QUEUE = 1024
+)
+
+// Kinds of frames
+const (
+	bpFrameHello = iota
+	bpFrameOpen
+	bpFrameData
+	bpFrameClose
+)
+
+type ClusterBackplaneConfig struct {
+	// Name of the pub/sub implementation: "redis" or "nats"
+	Kind string `json:"kind"`
+	// Configuration of the implementation
+	Config json.RawMessage `json:"config"`
+	// Prefix of channel names, BACKPLANE_DEFAULT_PREFIX by default
+	Prefix string `json:"prefix"`
+	// Time in milliseconds between announcements of a node
+	Heartbeat int `json:"heartbeat"`
+	// Number of missed announcements before the node is removed from the cluster
+	NodeFailAfter int `json:"node_fail_after"`
+	// Relative capacity of this node, 1 by default
+	Weight int `json:"weight"`
+}
+
+// Pub/sub server used as the backplane. Messages published to a channel by one node are
+// delivered to the subscribers in the order they were published.
+type backplaneBus interface {
+	// open connects to the server
+	open(config json.RawMessage) error
+	// publish sends data to the subscribers of the channel
+	publish(channel string, data []byte) error
+	// subscribe calls handler with the messages published to the channel from now on. Calls are
+	// made from one goroutine per channel.
+	subscribe(channel string, handler func(data []byte)) error
+	// close disconnects from the server
+	close()
+}
+
+var backplaneBuses = make(map[string]backplaneBus)
+
+// registerBackplane makes the pub/sub implementation available. Called from init().
+func registerBackplane(name string, bus backplaneBus) {
+	if _, dup := backplaneBuses[name]; dup {
+		panic("registerBackplane: called twice for " + name)
+	}
+	backplaneBuses[name] = bus
+}
+
+type clusterBackplane struct {
+	bus    backplaneBus
+	prefix string
+	self   string
+	weight int
+
+	heartBeat time.Duration
+	failAfter int
+
+	// Makes IDs of connections opened by this node unique across restarts
+	nonce string
+	seq   uint64
+
+	lock sync.Mutex
+	// Virtual connections by ID
+	conns map[string]*bpConn
+	// Nodes heard from: when they were heard from last time and their weights
+	seen    map[string]time.Time
+	weights map[string]int
+
+	done chan bool
+}
+
+// Virtual connection to another node
+type bpConn struct {
+	bp   *clusterBackplane
+	id   string
+	peer string
+
+	in  chan []byte
+	buf []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// encodeFrame serializes a frame: kind, length-prefixed sender and connection ID, data.
+func encodeFrame(kind byte, from, id string, data []byte) []byte {
+	frame := make([]byte, 0, 3+len(from)+len(id)+len(data))
+	frame = append(frame, kind, byte(len(from)))
+	frame = append(frame, from...)
+	frame = append(frame, byte(len(id)))
+	frame = append(frame, id...)
+	return append(frame, data...)
+}
+
+// decodeFrame parses a frame created by encodeFrame.
+func decodeFrame(frame []byte) (kind byte, from, id string, data []byte, err error) {
+	if len(frame) < 2 || len(frame) < 3+int(frame[1]) {
+		return 0, "", "", nil, errors.New("backplane: short frame")
+	}
+	kind = frame[0]
+	end := 2 + int(frame[1])
+	from = string(frame[2:end])
+	idEnd := end + 1 + int(frame[end])
+	if len(frame) < idEnd {
+		return 0, "", "", nil, errors.New("backplane: short frame")
+	}
+	return kind, from, string(frame[end+1 : idEnd]), frame[idEnd:], nil
+}
+
+func (c *Cluster) backplaneInit(config *ClusterBackplaneConfig, foConfig *ClusterFailoverConfig) {
+	bus := backplaneBuses[config.Kind]
+	if bus == nil {
+		logCluster.Fatal("Unknown cluster backplane '" + config.Kind + "'")
+	}
+	if err := bus.open(config.Config); err != nil {
+		logCluster.Fatal("Failed to connect to cluster backplane:", err)
+	}
+
+	if c.thisNodeName == "" {
+		var err error
+		if c.thisNodeName, err = os.Hostname(); err != nil || c.thisNodeName == "" {
+			logCluster.Fatal("Cluster node name is not set and host name is unknown:", err)
+		}
+	}
+	if len(c.thisNodeName) > 255 {
+		logCluster.Fatal("Cluster node name is too long")
+	}
+
+	bp := &clusterBackplane{
+		bus:       bus,
+		prefix:    config.Prefix,
+		self:      c.thisNodeName,
+		weight:    config.Weight,
+		heartBeat: time.Duration(config.Heartbeat) * time.Millisecond,
+		failAfter: config.NodeFailAfter,
+		nonce:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		conns:     make(map[string]*bpConn),
+		seen:      make(map[string]time.Time),
+		weights:   make(map[string]int),
+		done:      make(chan bool, 1)}
+	if bp.prefix == "" {
+		bp.prefix = BACKPLANE_DEFAULT_PREFIX
+	}
+	if bp.weight <= 0 {
+		bp.weight = 1
+	}
+	if bp.heartBeat <= 0 {
+		bp.heartBeat = BACKPLANE_DEFAULT_HEARTBEAT
+	}
+	if bp.failAfter <= 0 {
+		bp.failAfter = BACKPLANE_DEFAULT_FAIL_AFTER
+	}
+	c.bp = bp
+	c.weights[c.thisNodeName] = bp.weight
+
+	if foConfig != nil && foConfig.Enabled {
+		logCluster.Warn("cluster: failover config ignored, backplane nodes are tracked by heartbeats")
+	}
+
+	if err := bus.subscribe(bp.prefix+"node."+bp.self, bp.receive); err != nil {
+		logCluster.Fatal("Failed to subscribe to cluster backplane:", err)
+	}
+	if err := bus.subscribe(bp.prefix+"nodes", bp.hello); err != nil {
+		logCluster.Fatal("Failed to subscribe to cluster backplane:", err)
+	}
+
+	rpc.Register(c)
+
+	// Listen to other nodes for a while before taking any topics
+	bp.announce()
+	time.Sleep(2 * bp.heartBeat)
+	c.backplaneMembers(false)
+	go c.backplaneRun()
+
+	c.restartInit()
+	c.handoffInit()
+	c.failoverTestInit(foConfig)
+
+	logCluster.Infof("Cluster node '%s' joined backplane '%s' with %d other nodes", c.thisNodeName, config.Kind,
+		len(c.nodes))
+}
+
+// backplaneRun announces the node and tracks other nodes until the cluster is shut down.
+func (c *Cluster) backplaneRun() {
+	ticker := time.NewTicker(c.bp.heartBeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.bp.announce()
+			c.backplaneMembers(true)
+		case <-c.bp.done:
+			c.bp.bus.close()
+			return
+		}
+	}
+}
+
+// backplaneMembers adds nodes which were heard from and removes nodes which were not heard from
+// for too long, then rehashes if the set of nodes changed.
+func (c *Cluster) backplaneMembers(notify bool) {
+	bp := c.bp
+	expired := time.Now().Add(-bp.heartBeat * time.Duration(bp.failAfter))
+
+	bp.lock.Lock()
+	live := []string{c.thisNodeName}
+	var gone []string
+	for name, at := range bp.seen {
+		if at.Before(expired) {
+			delete(bp.seen, name)
+			gone = append(gone, name)
+		} else {
+			live = append(live, name)
+		}
+	}
+	var added []*ClusterNode
+	for _, name := range live {
+		if name != c.thisNodeName && c.nodes[name] == nil {
+			added = append(added, &ClusterNode{name: name, bp: bp, done: make(chan bool, 1)})
+		}
+	}
+	weights := map[string]int{c.thisNodeName: bp.weight}
+	for _, name := range live {
+		if name != c.thisNodeName {
+			weights[name] = bp.weights[name]
+		}
+	}
+	bp.lock.Unlock()
+
+	changed := len(added) > 0 || len(gone) > 0
+	if notify && !changed {
+		return
+	}
+
+	// Nodes which left are kept: they are reconnected when they come back. The maps are replaced,
+	// not changed, because they are read without locking.
+	nodes := make(map[string]*ClusterNode, len(c.nodes)+len(added))
+	for name, n := range c.nodes {
+		nodes[name] = n
+	}
+	for _, n := range added {
+		nodes[n.name] = n
+	}
+
+	for _, name := range gone {
+		logCluster.Warnf("cluster: node '%s' left the backplane", name)
+		bp.closePeer(name)
+	}
+	for _, n := range added {
+		logCluster.Infof("cluster: node '%s' joined the backplane", n.name)
+		go n.reconnect()
+	}
+
+	sort.Strings(live)
+	c.nodes = nodes
+	c.weights = weights
+	c.rehash(live)
+	if notify {
+		globals.hub.rehash <- true
+	}
+}
+
+// backplaneLive returns the names of the nodes currently on the backplane, including this one.
+func (c *Cluster) backplaneLive() []string {
+	live := make([]string, 0, len(c.live))
+	for name := range c.live {
+		live = append(live, name)
+	}
+	sort.Strings(live)
+	return live
+}
+
+// announce tells other nodes that this node is alive.
+func (bp *clusterBackplane) announce() {
+	if err := bp.bus.publish(bp.prefix+"nodes",
+		encodeFrame(bpFrameHello, bp.self, "", []byte(strconv.Itoa(bp.weight)))); err != nil {
+		logCluster.Warn("cluster: backplane announcement failed:", err)
+	}
+}
+
+// hello records an announcement of a node.
+func (bp *clusterBackplane) hello(frame []byte) {
+	kind, from, _, data, err := decodeFrame(frame)
+	if err != nil || kind != bpFrameHello || from == bp.self {
+		return
+	}
+	weight, _ := strconv.Atoi(string(data))
+	if weight <= 0 {
+		weight = 1
+	}
+	bp.lock.Lock()
+	bp.seen[from] = time.Now()
+	bp.weights[from] = weight
+	bp.lock.Unlock()
+}
+
+// receive handles a frame of a virtual connection addressed to this node.
+func (bp *clusterBackplane) receive(frame []byte) {
+	kind, from, id, data, err := decodeFrame(frame)
+	if err != nil {
+		logCluster.Warn("cluster: invalid backplane frame:", err)
+		return
+	}
+
+	switch kind {
+	case bpFrameOpen:
+		// Another node connected, serve cluster RPC to it
+		conn := bp.newConn(id, from)
+		go rpc.ServeConn(conn)
+	case bpFrameData:
+		bp.lock.Lock()
+		conn := bp.conns[id]
+		bp.lock.Unlock()
+		if conn == nil {
+			return
+		}
+		select {
+		case conn.in <- data:
+		case <-conn.done:
+		}
+	case bpFrameClose:
+		bp.lock.Lock()
+		conn := bp.conns[id]
+		bp.lock.Unlock()
+		if conn != nil {
+			conn.closeLocal()
+		}
+	}
+}
+
+func (bp *clusterBackplane) newConn(id, peer string) *bpConn {
+	conn := &bpConn{
+		bp:   bp,
+		id:   id,
+		peer: peer,
+		in:   make(chan []byte, BACKPLANE_CONN_QUEUE),
+		done: make(chan struct{})}
+	bp.lock.Lock()
+	bp.conns[id] = conn
+	bp.lock.Unlock()
+	return conn
+}
+
+// dial opens a virtual connection to another node for cluster RPC.
+func (bp *clusterBackplane) dial(peer string) (*rpc.Client, error) {
+	bp.lock.Lock()
+	_, alive := bp.seen[peer]
+	bp.lock.Unlock()
+	if !alive {
+		return nil, errors.New("cluster: node '" + peer + "' is not on the backplane")
+	}
+
+	id := bp.self + "#" + bp.nonce + "." + strconv.FormatUint(atomic.AddUint64(&bp.seq, 1), 36)
+	conn := bp.newConn(id, peer)
+	if err := bp.send(peer, bpFrameOpen, id, nil); err != nil {
+		conn.closeLocal()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// closePeer closes all connections to and from the node which left.
+func (bp *clusterBackplane) closePeer(peer string) {
+	var conns []*bpConn
+	bp.lock.Lock()
+	for _, conn := range bp.conns {
+		if conn.peer == peer {
+			conns = append(conns, conn)
+		}
+	}
+	bp.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.closeLocal()
+	}
+}
+
+func (bp *clusterBackplane) send(peer string, kind byte, id string, data []byte) error {
+	return bp.bus.publish(bp.prefix+"node."+peer, encodeFrame(kind, bp.self, id, data))
+}
+
+func (bc *bpConn) Read(p []byte) (int, error) {
+	for len(bc.buf) == 0 {
+		select {
+		case bc.buf = <-bc.in:
+		case <-bc.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, bc.buf)
+	bc.buf = bc.buf[n:]
+	return n, nil
+}
+
+func (bc *bpConn) Write(p []byte) (int, error) {
+	select {
+	case <-bc.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	if err := bc.bp.send(bc.peer, bpFrameData, bc.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the connection and tells the other node.
+func (bc *bpConn) Close() error {
+	bc.closeLocal()
+	return bc.bp.send(bc.peer, bpFrameClose, bc.id, nil)
+}
+
+// closeLocal closes the connection at this node only.
+func (bc *bpConn) closeLocal() {
+	bc.closeOnce.Do(func() {
+		close(bc.done)
+		bc.bp.lock.Lock()
+		delete(bc.bp.conns, bc.id)
+		bc.bp.lock.Unlock()
+	})
+}
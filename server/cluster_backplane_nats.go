@@ -0,0 +1,59 @@
+// +build nats
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Cluster backplane over NATS core subjects. Messages are not persisted: a node which is disconnected
+// from the server misses them and its cluster connections are restarted.
+
+type natsBackplane struct {
+	conn *nats.Conn
+}
+
+func init() {
+	registerBackplane("nats", &natsBackplane{})
+}
+
+func (nb *natsBackplane) open(jsconfig json.RawMessage) error {
+	var config struct {
+		// Comma-separated list of server URLs
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	}
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return err
+		}
+	}
+	if config.URL == "" {
+		config.URL = nats.DefaultURL
+	}
+
+	opts := []nats.Option{nats.Name("tinode"), nats.MaxReconnects(-1)}
+	if config.Token != "" {
+		opts = append(opts, nats.Token(config.Token))
+	}
+	var err error
+	nb.conn, err = nats.Connect(config.URL, opts...)
+	return err
+}
+
+func (nb *natsBackplane) publish(channel string, data []byte) error {
+	return nb.conn.Publish(channel, data)
+}
+
+func (nb *natsBackplane) subscribe(channel string, handler func(data []byte)) error {
+	_, err := nb.conn.Subscribe(channel, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+	return err
+}
+
+func (nb *natsBackplane) close() {
+	nb.conn.Drain()
+}
@@ -0,0 +1,149 @@
+// +build redis
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Cluster backplane over Redis Streams. Each channel is a stream trimmed to about max_len entries;
+// subscribers read new entries with blocking XREAD.
+
+const (
+	// Default number of entries kept in a stream
+	BACKPLANE_REDIS_MAX_LEN = 10000
+	// Time an XREAD call blocks waiting for new entries
+	BACKPLANE_REDIS_BLOCK = time.Second
+	// Delay before reading again after an error
+	BACKPLANE_REDIS_RETRY = time.Second
+)
+
+type redisBackplane struct {
+	pool   *redis.Pool
+	maxLen int
+	done   chan bool
+}
+
+func init() {
+	registerBackplane("redis", &redisBackplane{})
+}
+
+func (rb *redisBackplane) open(jsconfig json.RawMessage) error {
+	var config struct {
+		// Address of the redis server, host:port
+		Addr     string `json:"addr"`
+		Password string `json:"password"`
+		DB       int    `json:"db"`
+		// Approximate number of entries kept in each stream
+		MaxLen int `json:"max_len"`
+	}
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return err
+		}
+	}
+	if config.Addr == "" {
+		config.Addr = "localhost:6379"
+	}
+	rb.maxLen = config.MaxLen
+	if rb.maxLen <= 0 {
+		rb.maxLen = BACKPLANE_REDIS_MAX_LEN
+	}
+	rb.done = make(chan bool)
+	rb.pool = &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.Addr,
+				redis.DialPassword(config.Password),
+				redis.DialDatabase(config.DB))
+		},
+	}
+
+	conn := rb.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func (rb *redisBackplane) publish(channel string, data []byte) error {
+	conn := rb.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XADD", channel, "MAXLEN", "~", rb.maxLen, "*", "d", data)
+	return err
+}
+
+func (rb *redisBackplane) subscribe(channel string, handler func(data []byte)) error {
+	// Start after the last entry existing now
+	conn := rb.pool.Get()
+	last := "$"
+	if entries, err := redis.Values(conn.Do("XREVRANGE", channel, "+", "-", "COUNT", 1)); err != nil {
+		conn.Close()
+		return err
+	} else if len(entries) > 0 {
+		if entry, err := redis.Values(entries[0], nil); err == nil && len(entry) > 0 {
+			last, _ = redis.String(entry[0], nil)
+		}
+	}
+	conn.Close()
+
+	go func() {
+		var conn redis.Conn
+		for {
+			select {
+			case <-rb.done:
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			default:
+			}
+
+			if conn == nil {
+				// Blocking reads hold a connection
+				conn = rb.pool.Get()
+			}
+			reply, err := redis.Values(conn.Do("XREAD", "BLOCK", int(BACKPLANE_REDIS_BLOCK/time.Millisecond),
+				"STREAMS", channel, last))
+			if err == redis.ErrNil {
+				// No new entries
+				continue
+			} else if err != nil {
+				logCluster.Warn("cluster: backplane read failed:", err)
+				conn.Close()
+				conn = nil
+				time.Sleep(BACKPLANE_REDIS_RETRY)
+				continue
+			}
+
+			// [[stream, [[id, [field, value]], ...]]]
+			for _, stream := range reply {
+				parts, err := redis.Values(stream, nil)
+				if err != nil || len(parts) < 2 {
+					continue
+				}
+				entries, _ := redis.Values(parts[1], nil)
+				for _, e := range entries {
+					entry, err := redis.Values(e, nil)
+					if err != nil || len(entry) < 2 {
+						continue
+					}
+					last, _ = redis.String(entry[0], nil)
+					fields, _ := redis.ByteSlices(entry[1], nil)
+					if len(fields) == 2 {
+						handler(fields[1])
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (rb *redisBackplane) close() {
+	close(rb.done)
+	rb.pool.Close()
+}
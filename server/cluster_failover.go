@@ -0,0 +1,245 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Surviving the loss of a cluster node. When the leader declares a node
+ *  dead, all nodes recalculate the ring hash without it and the topics of
+ *  the dead node are loaded by their new masters at the next request.
+ *  Sessions which were attached to these topics through another node are
+ *  attached again by that node: it sends {sub} on behalf of the session to
+ *  the new master, which may be the node itself. The client receives the
+ *  usual {ctrl} and {meta} replies without an id. Topics which move from a
+ *  live node are handed off as before and the sessions get
+ *  {pres what="term"}.
+ *
+ *  With "test_mode" in the failover config, root admins fail a node on
+ *  purpose with
+ *    POST /v0/admin/cluster/failover?node=name&duration=60
+ *  The leader keeps the node out of the ring hash for the given number of
+ *  seconds as if it missed its heartbeats. The node keeps running and
+ *  serving its clients, its topics move to other nodes. The failure ends
+ *  early if another node becomes the leader. The leader cannot fail itself.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the admin endpoint
+	ADMIN_CLUSTER_FAILOVER_PATH = "/v0/admin/cluster/failover"
+	// Default and maximum duration of a failure in the test mode
+	CLUSTER_FAILOVER_TEST_DEFAULT = time.Minute
+	CLUSTER_FAILOVER_TEST_MAX     = time.Hour
+)
+
+// Topic of another node the session is attached to
+type remoteSub struct {
+	// Name of the topic as sent by the client
+	original string
+	// Node which hosted the topic when the session attached
+	node string
+}
+
+// Request to fail a node in the test mode
+type ClusterFailNodeReq struct {
+	Node     string
+	Duration time.Duration
+}
+
+type clusterFailNode struct {
+	req  *ClusterFailNodeReq
+	resp chan error
+}
+
+// remoteSubAdd records the topic of another node the session attached to.
+func (s *Session) remoteSubAdd(topic, original string) {
+	s.rlock.Lock()
+	defer s.rlock.Unlock()
+
+	if s.remoteSubs == nil {
+		s.remoteSubs = make(map[string]*remoteSub)
+	}
+	s.remoteSubs[topic] = &remoteSub{original: original, node: globals.cluster.ring.Get(topic)}
+}
+
+// remoteSubDel forgets the topic of another node the session left.
+func (s *Session) remoteSubDel(topic string) {
+	s.rlock.Lock()
+	defer s.rlock.Unlock()
+
+	delete(s.remoteSubs, topic)
+}
+
+// failedOver checks if this node is believed dead by the cluster and hosts no topics.
+func (c *Cluster) failedOver() bool {
+	if c == nil {
+		return false
+	}
+	return !c.live[c.thisNodeName]
+}
+
+// rehomeSessions attaches sessions of this node to the new masters of the topics of dead nodes.
+func (c *Cluster) rehomeSessions() {
+	if c == nil {
+		return
+	}
+	for _, s := range globals.sessionStore.all() {
+		if s.proto != RPC {
+			s.rehome(c)
+		}
+	}
+}
+
+// rehome attaches the session to the topics which moved from dead nodes. Topics which moved from live
+// nodes are forgotten: the old master detaches the session with {pres what="term"}.
+func (s *Session) rehome(c *Cluster) {
+	moved := make(map[string]string)
+	s.rlock.Lock()
+	for topic, sub := range s.remoteSubs {
+		if c.ring.Get(topic) != sub.node {
+			delete(s.remoteSubs, topic)
+			if !c.live[sub.node] {
+				moved[topic] = sub.original
+			}
+		}
+	}
+	s.rlock.Unlock()
+
+	for topic, original := range moved {
+		logCluster.Infof("cluster: sess[%s] attaching again to '%s'", s.sid, topic)
+		msg := &ClientComMessage{Sub: &MsgClientSub{Topic: original}, from: s.uid.UserId(),
+			timestamp: types.TimeNow()}
+		if c.isRemoteTopic(topic) {
+			if err := c.routeToTopic(msg, topic, s); err != nil {
+				logCluster.Warnf("cluster: sess[%s] failed to attach to '%s': %v", s.sid, topic, err)
+			} else {
+				s.remoteSubAdd(topic, original)
+			}
+		} else {
+			globals.hub.join <- &sessionJoin{topic: topic, pkt: msg.Sub, sess: s}
+		}
+	}
+}
+
+// failoverTestInit enables failing nodes by root admins if the test mode is configured.
+func (c *Cluster) failoverTestInit(config *ClusterFailoverConfig) {
+	if config == nil || !config.TestMode {
+		return
+	}
+	if c.fo == nil {
+		logCluster.Warn("cluster: failover test mode ignored, failover is disabled")
+		return
+	}
+	http.HandleFunc(ADMIN_CLUSTER_FAILOVER_PATH, serveClusterFailover)
+	logCluster.Warn("cluster: failover test mode enabled")
+}
+
+// FailNode fails a node in the test mode. Called by a remote node which is not the leader.
+func (c *Cluster) FailNode(req *ClusterFailNodeReq, unused *bool) error {
+	if c.fo == nil {
+		return errors.New("cluster: failover is disabled")
+	}
+	resp := make(chan error, 1)
+	c.fo.failNode <- &clusterFailNode{req: req, resp: resp}
+	return <-resp
+}
+
+// failoverTest fails the node at the leader. Other nodes forward the request to the leader.
+// Called by the failover runner.
+func (c *Cluster) failoverTest(fn *clusterFailNode) {
+	if c.fo.leader != c.thisNodeName {
+		leader := c.nodes[c.fo.leader]
+		if leader == nil {
+			fn.resp <- errors.New("cluster: no leader")
+			return
+		}
+		go func() {
+			unused := false
+			fn.resp <- leader.call("Cluster.FailNode", fn.req, &unused)
+		}()
+		return
+	}
+
+	if fn.req.Node == c.thisNodeName {
+		fn.resp <- errors.New("cluster: the leader cannot fail itself")
+		return
+	}
+	if c.nodes[fn.req.Node] == nil {
+		fn.resp <- errors.New("cluster: unknown node '" + fn.req.Node + "'")
+		return
+	}
+
+	c.fo.failed[fn.req.Node] = time.Now().Add(fn.req.Duration)
+	logCluster.Warnf("cluster: test mode: node '%s' failed for %s", fn.req.Node, fn.req.Duration)
+	c.failoverRehash()
+	fn.resp <- nil
+}
+
+// serveClusterFailover fails a node in the test mode:
+// POST /v0/admin/cluster/failover?node=name&duration=60
+func serveClusterFailover(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	admin, authLvl, err := authHttpRequestLevel(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	} else if authLvl != auth.LevelRoot {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	node := req.FormValue("node")
+	duration := CLUSTER_FAILOVER_TEST_DEFAULT
+	if s := req.FormValue("duration"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs <= 0 {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+		duration = time.Duration(secs) * time.Second
+	}
+	if node == "" || duration > CLUSTER_FAILOVER_TEST_MAX {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+
+	unused := false
+	if err = globals.cluster.FailNode(&ClusterFailNodeReq{Node: node, Duration: duration}, &unused); err != nil {
+		logCluster.Warn("cluster: node not failed:", err)
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+	logAudit.Infof("cluster: '%s' failed node '%s' for %s", admin.UserId(), node, duration)
+
+	wrt.WriteHeader(http.StatusAccepted)
+	enc.Encode(map[string]interface{}{"node": node, "until": now.Add(duration)})
+}
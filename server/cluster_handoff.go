@@ -0,0 +1,278 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Handoff of topics between cluster nodes when the ring hash changes.
+ *  A topic which moves to another node is stopped by the old master after
+ *  the messages already queued to it are saved. Messages published to the
+ *  topic while it is moving are buffered by the old master instead of being
+ *  rejected. Once the topic has stopped and the new master has the same ring
+ *  hash, the buffered messages are sent to the new master in the order they
+ *  were received. The senders are acknowledged with {ctrl code=202}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Time allowed for the topic to move to the new master
+	CLUSTER_HANDOFF_TIMEOUT = 10 * time.Second
+	// Maximum number of messages buffered per topic
+	CLUSTER_HANDOFF_MAX_MESSAGES = 256
+	// Interval between attempts to deliver buffered messages to the new master
+	CLUSTER_HANDOFF_RETRY_INTERVAL = 200 * time.Millisecond
+)
+
+// Message published to a moving topic
+type ClusterHandoffMsg struct {
+	// Sender of the message
+	Uid     types.Uid
+	Head    map[string]string
+	Thread  int
+	Content interface{}
+	// Time when the message was received by the old master
+	Timestamp time.Time
+}
+
+// Messages sent by the old master to the new master of the topic
+type ClusterHandoffReq struct {
+	// Name of the node sending this request
+	Node string
+	// Ring hash signature of the sending node, must match the signature of the new master
+	Signature string
+	// Expanded (routable) topic name
+	Topic string
+	Msgs  []ClusterHandoffMsg
+}
+
+// Message buffered by the old master with the session to acknowledge it to
+type handoffPending struct {
+	sess *Session
+	// ID of the {pub} and the topic name as sent by the client
+	id    string
+	topic string
+	msg   ClusterHandoffMsg
+}
+
+type topicHandoff struct {
+	started time.Time
+	pending []handoffPending
+}
+
+// Topics being handed off by this node
+var handoffs = struct {
+	sync.Mutex
+	topics map[string]*topicHandoff
+
+	// Exported as ClusterHandoff in expvar
+	buffered *expvar.Int
+	replayed *expvar.Int
+	failed   *expvar.Int
+}{topics: make(map[string]*topicHandoff)}
+
+// handoffInit registers the metrics of topic handoffs.
+func (c *Cluster) handoffInit() {
+	handoffs.buffered = new(expvar.Int)
+	handoffs.replayed = new(expvar.Int)
+	handoffs.failed = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("buffered", handoffs.buffered)
+	vars.Set("replayed", handoffs.replayed)
+	vars.Set("failed", handoffs.failed)
+	expvar.Publish("ClusterHandoff", vars)
+}
+
+// handoffBegin starts buffering messages to the topic which moves to another node.
+// Called by the hub before stopping the topic.
+func handoffBegin(topic string) {
+	handoffs.Lock()
+	defer handoffs.Unlock()
+
+	if _, ok := handoffs.topics[topic]; !ok {
+		handoffs.topics[topic] = &topicHandoff{started: time.Now()}
+	}
+}
+
+// handoffActive checks if the topic is being handed off by this node.
+func handoffActive(topic string) bool {
+	handoffs.Lock()
+	defer handoffs.Unlock()
+
+	return handoffs.topics[topic] != nil
+}
+
+// handoffBuffer keeps the {data} published by a client until the topic is handed off to the new master.
+// Returns false if the topic is not moving and the message must be processed as usual.
+func handoffBuffer(topic string, msg *ServerComMessage) bool {
+	// Edits, scheduled and server-generated messages are not buffered: they are rejected as before.
+	if msg.sessFrom == nil || msg.replace > 0 || !msg.deliverAt.IsZero() {
+		return false
+	}
+
+	handoffs.Lock()
+	defer handoffs.Unlock()
+
+	ho := handoffs.topics[topic]
+	if ho == nil {
+		return false
+	}
+	if len(ho.pending) >= CLUSTER_HANDOFF_MAX_MESSAGES {
+		handoffs.failed.Add(1)
+		msg.sessFrom.queueOut(ErrClusterNodeUnreachable(msg.id, msg.Data.Topic, msg.timestamp))
+		return true
+	}
+	ho.pending = append(ho.pending, handoffPending{
+		sess:  msg.sessFrom,
+		id:    msg.id,
+		topic: msg.Data.Topic,
+		msg: ClusterHandoffMsg{
+			Uid:       types.ParseUserId(msg.Data.From),
+			Head:      msg.Data.Head,
+			Thread:    msg.Data.Thread,
+			Content:   msg.Data.Content,
+			Timestamp: msg.timestamp}})
+	handoffs.buffered.Add(1)
+	return true
+}
+
+// handoffDrain buffers messages left in the queue of the stopped topic.
+func (t *Topic) handoffDrain() {
+	for {
+		select {
+		case msg := <-t.broadcast:
+			if msg.Data != nil && !handoffBuffer(t.name, msg) && msg.sessFrom != nil {
+				msg.sessFrom.queueOut(ErrLocked(msg.id, msg.Data.Topic, msg.timestamp))
+			}
+		default:
+			return
+		}
+	}
+}
+
+// handoffStopped is called when the topic has stopped at this node. The buffered messages can now
+// be sent to the new master.
+func handoffStopped(topic string) {
+	handoffs.Lock()
+	ho := handoffs.topics[topic]
+	handoffs.Unlock()
+
+	if ho != nil {
+		go globals.cluster.handoffReplay(topic, ho)
+	}
+}
+
+// handoffReplay sends buffered messages to the new master until none are left or the time runs out.
+func (c *Cluster) handoffReplay(topic string, ho *topicHandoff) {
+	for {
+		handoffs.Lock()
+		batch := ho.pending
+		ho.pending = nil
+		// The topic may have come back to this node before the handoff completed.
+		expired := time.Since(ho.started) > CLUSTER_HANDOFF_TIMEOUT || !c.isRemoteTopic(topic)
+		if len(batch) == 0 || expired {
+			delete(handoffs.topics, topic)
+		}
+		handoffs.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		if expired {
+			logCluster.Warnf("cluster: handoff of topic '%s' failed, %d messages rejected", topic, len(batch))
+			handoffs.failed.Add(int64(len(batch)))
+			for _, p := range batch {
+				p.sess.queueOut(ErrClusterNodeUnreachable(p.id, p.topic, types.TimeNow()))
+			}
+			return
+		}
+
+		if err := c.handoffSend(topic, batch); err != nil {
+			logCluster.Debugf("cluster: handoff of topic '%s' delayed: %v", topic, err)
+
+			// Keep the order: the failed batch goes before the messages received since.
+			handoffs.Lock()
+			ho.pending = append(batch, ho.pending...)
+			handoffs.Unlock()
+			time.Sleep(CLUSTER_HANDOFF_RETRY_INTERVAL)
+			continue
+		}
+
+		handoffs.replayed.Add(int64(len(batch)))
+		now := types.TimeNow()
+		for _, p := range batch {
+			if p.id != "" {
+				p.sess.queueOut(NoErrAccepted(p.id, p.topic, now))
+			}
+		}
+	}
+}
+
+// handoffSend sends messages to the new master of the topic.
+func (c *Cluster) handoffSend(topic string, batch []handoffPending) error {
+	n := c.nodeForTopic(topic)
+	if n == nil {
+		return errors.New("cluster: no node for topic")
+	}
+
+	req := &ClusterHandoffReq{
+		Node:      c.thisNodeName,
+		Signature: c.ring.Signature(),
+		Topic:     topic,
+		Msgs:      make([]ClusterHandoffMsg, len(batch))}
+	for i, p := range batch {
+		req.Msgs[i] = p.msg
+	}
+
+	rejected := false
+	if err := n.call("Cluster.Handoff", req, &rejected); err != nil {
+		return err
+	}
+	if rejected {
+		return errors.New("cluster: new master is not ready")
+	}
+	return nil
+}
+
+// Handoff at the new master receives messages buffered by the old master while the topic was moving.
+// Rejects them if the ring hash of this node does not match the sender's yet.
+func (c *Cluster) Handoff(req *ClusterHandoffReq, rejected *bool) error {
+	if req.Signature != c.ring.Signature() || c.isRemoteTopic(req.Topic) {
+		*rejected = true
+		return nil
+	}
+
+	now := types.TimeNow()
+	for _, msg := range req.Msgs {
+		// The sender was subscribed at the old master, but check the permission again:
+		// the message skips the session which normally checks it.
+		sub, err := store.Subs.Get(req.Topic, msg.Uid)
+		if err != nil || sub == nil || !(sub.ModeWant & sub.ModeGiven).IsWriter() {
+			logCluster.Warnf("cluster: handoff of topic '%s' dropped message from '%s'",
+				req.Topic, msg.Uid.UserId())
+			continue
+		}
+
+		globals.hub.route <- &ServerComMessage{
+			Data: &MsgServerData{
+				Topic:     req.Topic,
+				From:      msg.Uid.UserId(),
+				Timestamp: msg.Timestamp,
+				Head:      msg.Head,
+				Thread:    msg.Thread,
+				Content:   msg.Content},
+			rcptto:    req.Topic,
+			timestamp: now}
+	}
+	return nil
+}
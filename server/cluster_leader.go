@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"math/rand"
 	"net/rpc"
 	"time"
@@ -33,6 +32,10 @@ type ClusterFailover struct {
 	leaderPing chan *ClusterPing
 	// Channel for processing election votes
 	electionVote chan *ClusterVote
+	// Channel for requests to fail a node in the test mode
+	failNode chan *clusterFailNode
+	// Nodes failed in the test mode and when their failure ends
+	failed map[string]time.Time
 	// Channel for stopping the failover runner
 	done chan bool
 }
@@ -46,6 +49,8 @@ type ClusterFailoverConfig struct {
 	VoteAfter int `json:"vote_after"`
 	// Number of failures before a node is considered dead
 	NodeFailAfter int `json:"node_fail_after"`
+	// Root admins may fail nodes on purpose to test failover
+	TestMode bool `json:"test_mode"`
 }
 
 // Content of a leader node ping to a follower node
@@ -84,7 +89,7 @@ func (c *Cluster) failoverInit(config *ClusterFailoverConfig) bool {
 		return false
 	}
 	if len(c.nodes) < 2 {
-		log.Printf("cluster: failover disabled; need at least 3 nodes, got %d only", len(c.nodes)+1)
+		logCluster.Warnf("cluster: failover disabled; need at least 3 nodes, got %d only", len(c.nodes)+1)
 		return false
 	}
 
@@ -109,11 +114,13 @@ func (c *Cluster) failoverInit(config *ClusterFailoverConfig) bool {
 		nodeFailCountLimit: config.NodeFailAfter,
 		leaderPing:         make(chan *ClusterPing, config.VoteAfter),
 		electionVote:       make(chan *ClusterVote, len(c.nodes)),
+		failNode:           make(chan *clusterFailNode, 1),
+		failed:             make(map[string]time.Time),
 		done:               make(chan bool, 1)}
 
 	go c.run()
 
-	log.Println("cluster: failover mode enabled")
+	logCluster.Info("cluster: failover mode enabled")
 
 	return true
 }
@@ -167,21 +174,35 @@ func (c *Cluster) sendPings() {
 		}
 	}
 
-	if rehash {
-		var activeNodes []string
-		for _, node := range c.nodes {
-			if node.failCount < c.fo.nodeFailCountLimit {
-				activeNodes = append(activeNodes, node.name)
-			}
+	// Failures in the test mode which ended
+	now := time.Now()
+	for name, until := range c.fo.failed {
+		if now.After(until) {
+			delete(c.fo.failed, name)
+			rehash = true
 		}
-		activeNodes = append(activeNodes, c.thisNodeName)
+	}
 
-		c.fo.activeNodes = activeNodes
-		c.rehash(activeNodes)
+	if rehash {
+		c.failoverRehash()
+	}
+}
 
-		log.Println("cluster: initiating failover rehash for nodes", activeNodes)
-		globals.hub.rehash <- true
+// failoverRehash recalculates the ring hash without the dead nodes and the nodes failed in the test mode.
+func (c *Cluster) failoverRehash() {
+	var activeNodes []string
+	for _, node := range c.nodes {
+		if _, failed := c.fo.failed[node.name]; !failed && node.failCount < c.fo.nodeFailCountLimit {
+			activeNodes = append(activeNodes, node.name)
+		}
 	}
+	activeNodes = append(activeNodes, c.thisNodeName)
+
+	c.fo.activeNodes = activeNodes
+	c.rehash(activeNodes)
+
+	logCluster.Warn("cluster: initiating failover rehash for nodes", activeNodes)
+	globals.hub.rehash <- true
 }
 
 func (c *Cluster) electLeader() {
@@ -189,7 +210,7 @@ func (c *Cluster) electLeader() {
 	c.fo.term++
 	c.fo.leader = ""
 
-	log.Println("cluster: leading new election for term", c.fo.term)
+	logCluster.Info("cluster: leading new election for term", c.fo.term)
 
 	nodeCount := len(c.nodes)
 	// Number of votes needed to elect the leader
@@ -238,7 +259,7 @@ func (c *Cluster) electLeader() {
 	if voteCount >= expectVotes {
 		// Current node elected as the leader
 		c.fo.leader = c.thisNodeName
-		log.Println("Elected myself as a new leader")
+		logCluster.Info("Elected myself as a new leader")
 	}
 }
 
@@ -271,21 +292,21 @@ func (c *Cluster) run() {
 
 			if ping.Term < c.fo.term {
 				// This is a ping from a stale leader. Ignore.
-				log.Println("cluster: ping from a stale leader", ping.Term, c.fo.term, ping.Leader, c.fo.leader)
+				logCluster.Warn("cluster: ping from a stale leader", ping.Term, c.fo.term, ping.Leader, c.fo.leader)
 				continue
 			}
 
 			if ping.Term > c.fo.term {
 				c.fo.term = ping.Term
 				c.fo.leader = ping.Leader
-				log.Printf("cluster: leader '%s' elected", c.fo.leader)
+				logCluster.Infof("cluster: leader '%s' elected", c.fo.leader)
 			} else if ping.Leader != c.fo.leader {
 				if c.fo.leader != "" {
 					// Wrong leader. It's a bug, should never happen!
-					log.Printf("cluster: wrong leader '%s' while expecting '%s'; term %d",
+					logCluster.Warnf("cluster: wrong leader '%s' while expecting '%s'; term %d",
 						ping.Leader, c.fo.leader, ping.Term)
 				} else {
-					log.Printf("cluster: leader set to '%s'", ping.Leader)
+					logCluster.Infof("cluster: leader set to '%s'", ping.Leader)
 				}
 				c.fo.leader = ping.Leader
 			}
@@ -293,7 +314,7 @@ func (c *Cluster) run() {
 			missed = 0
 			if ping.Signature != c.ring.Signature() {
 				if rehashSkipped {
-					log.Println("cluster: rehashing at a request of",
+					logCluster.Info("cluster: rehashing at a request of",
 						ping.Leader, ping.Nodes, ping.Signature, c.ring.Signature())
 					c.rehash(ping.Nodes)
 					rehashSkipped = false
@@ -308,15 +329,17 @@ func (c *Cluster) run() {
 			if c.fo.term < vreq.req.Term {
 				// This is a new election. This node has not voted yet. Vote for the requestor and
 				// clear the current leader.
-				log.Printf("Voting YES for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
+				logCluster.Debugf("Voting YES for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
 				c.fo.term = vreq.req.Term
 				c.fo.leader = ""
 				vreq.resp <- ClusterVoteResponse{Result: true, Term: c.fo.term}
 			} else {
 				// This node has voted already or stale election, reject.
-				log.Printf("Voting NO for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
+				logCluster.Debugf("Voting NO for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
 				vreq.resp <- ClusterVoteResponse{Result: false, Term: c.fo.term}
 			}
+		case req := <-c.fo.failNode:
+			c.failoverTest(req)
 		case <-c.fo.done:
 			return
 		}
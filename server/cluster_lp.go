@@ -0,0 +1,154 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Long polling in a cluster behind a load balancer without sticky sessions.
+ *  IDs of long polling sessions start with the name of the node which owns
+ *  the session: "<node name>.<random>". A node which receives a poll of
+ *  another node's session forwards it over cluster RPC and relays the
+ *  response to the client.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Long poll forwarded to the node which owns the session
+type ClusterLongPollReq struct {
+	// Session ID
+	Sid string
+	// ID of the client request, used in error responses
+	Id string
+	// IP address of the client
+	RemoteAddr string
+	// Body of the request, if any
+	Payload []byte
+}
+
+// Response to the forwarded long poll
+type ClusterLongPollResp struct {
+	Status int
+	Body   []byte
+	// Content type of the body if the session uses a binary encoding
+	ContentType string
+}
+
+// Collects the response to the forwarded long poll
+type lpProxyWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *lpProxyWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *lpProxyWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *lpProxyWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// CloseNotify is never triggered: the node forwarding the poll does not report disconnects.
+func (w *lpProxyWriter) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+// lpSessionId generates an ID of a new long polling session. Standalone servers use plain IDs.
+func (c *Cluster) lpSessionId() string {
+	if c == nil {
+		return ""
+	}
+	return c.thisNodeName + "." + store.GetUidString()
+}
+
+// nodeForSession returns the node which owns the long polling session or nil if it's this node
+// or an unknown one.
+func (c *Cluster) nodeForSession(sid string) *ClusterNode {
+	if c == nil {
+		return nil
+	}
+	at := strings.LastIndex(sid, ".")
+	if at <= 0 {
+		return nil
+	}
+	return c.nodes[sid[:at]]
+}
+
+// proxyLongPoll forwards the long poll to the node which owns the session.
+func (c *Cluster) proxyLongPoll(n *ClusterNode, sid string, wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	id := req.FormValue("id")
+
+	maxSize := maxMessageSize()
+	if req.ContentLength > maxSize {
+		wrt.WriteHeader(http.StatusExpectationFailed)
+		enc.Encode(ErrMalformed(id, "", now))
+		return
+	}
+
+	var payload []byte
+	if req.ContentLength != 0 {
+		var err error
+		if payload, err = ioutil.ReadAll(http.MaxBytesReader(wrt, req.Body, maxSize)); err != nil {
+			logCluster.Warn("longPoll: " + err.Error())
+			wrt.WriteHeader(http.StatusBadRequest)
+			enc.Encode(ErrMalformed(id, "", now))
+			return
+		}
+	}
+
+	var resp ClusterLongPollResp
+	if err := n.call("Cluster.LongPoll", &ClusterLongPollReq{
+		Sid:        sid,
+		Id:         id,
+		RemoteAddr: req.RemoteAddr,
+		Payload:    payload}, &resp); err != nil {
+		wrt.WriteHeader(http.StatusBadGateway)
+		enc.Encode(ErrClusterNodeUnreachable(id, "", now))
+		return
+	}
+
+	if resp.ContentType != "" {
+		wrt.Header().Set("Content-Type", resp.ContentType)
+	}
+	if resp.Status != 0 {
+		wrt.WriteHeader(resp.Status)
+	}
+	wrt.Write(resp.Body)
+}
+
+// LongPoll serves the long poll forwarded by another node.
+func (c *Cluster) LongPoll(msg *ClusterLongPollReq, resp *ClusterLongPollResp) error {
+	req, err := http.NewRequest(http.MethodPost, "/v0/channels/lp?id="+url.QueryEscape(msg.Id),
+		bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+	req.RemoteAddr = msg.RemoteAddr
+
+	wrt := &lpProxyWriter{header: make(http.Header)}
+	serveLongPollSession(wrt, req, msg.Sid, nil, types.TimeNow())
+
+	resp.Status = wrt.status
+	resp.Body = wrt.body.Bytes()
+	resp.ContentType = wrt.header.Get("Content-Type")
+	return nil
+}
@@ -0,0 +1,466 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Rolling restart of the cluster. The coordinating node restarts the nodes
+ *  one at a time:
+ *    1. cordon: all nodes exclude the node from the ring hash, so its topics
+ *       move to other nodes; the node stops accepting new connections;
+ *    2. drain: wait until the node hosts no topics;
+ *    3. restart: the node shuts down gracefully, the process supervisor
+ *       (e.g. systemd) is expected to start it again;
+ *    4. rejoin: wait until the new process responds and has caught up with
+ *       the cluster;
+ *    5. uncordon: the node is added back to the ring hash.
+ *  The coordinating node is restarted last by another node.
+ *
+ *  Every node starts cordoned and asks the peers if they keep it cordoned.
+ *  If they do, the node is being restarted and stays cordoned until the
+ *  coordinator uncordons it; otherwise it uncordons itself.
+ *
+ *  The restart is started by POST /v0/admin/cluster/restart and can be
+ *  observed by GET of the same path or as RollingRestart in /debug/vars.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the admin endpoint
+	ADMIN_CLUSTER_RESTART_PATH = "/v0/admin/cluster/restart"
+	// Time to wait for the cordoned node to hand over its topics
+	CLUSTER_RESTART_DRAIN_TIMEOUT = 2 * time.Minute
+	// Time to wait for the restarted node to come back
+	CLUSTER_RESTART_REJOIN_TIMEOUT = 5 * time.Minute
+	// Interval between status checks of the node being restarted
+	CLUSTER_RESTART_POLL_INTERVAL = time.Second
+	// Time to wait for any peer to answer after start before uncordoning this node
+	CLUSTER_REJOIN_TIMEOUT = 30 * time.Second
+)
+
+// Request to add or remove a node from the set of cordoned nodes
+type ClusterCordonReq struct {
+	Node   string
+	Cordon bool
+}
+
+// Status of a node reported to the coordinator of a rolling restart
+type ClusterNodeStatus struct {
+	// Time when the process started
+	Started time.Time
+	// Number of topics hosted by the node
+	Topics int64
+	// The node has learned the cordoned nodes from its peers after start
+	Ready bool
+	// Nodes cordoned as seen by the node
+	Cordoned []string
+}
+
+// Request to restart the listed nodes in order
+type ClusterRestartReq struct {
+	Nodes []string
+}
+
+// Time when this process started
+var nodeStarted = time.Now()
+
+// Progress of the rolling restart coordinated by this node
+var rollingRestart struct {
+	sync.Mutex
+	running bool
+
+	// Exported as RollingRestart in expvar
+	vars *expvar.Map
+	// "idle", "cordon", "drain", "restart", "rejoin", "uncordon", "done", "handed-off" or "failed"
+	state *expvar.String
+	// Node being restarted
+	node *expvar.String
+	// Number of nodes restarted so far
+	restarted *expvar.Int
+	// Reason of the failure
+	err *expvar.String
+}
+
+// Nodes excluded from the ring hash
+var cordoned = struct {
+	sync.Mutex
+	nodes map[string]bool
+	// This node has caught up with the cordoned nodes of the cluster
+	ready bool
+}{nodes: make(map[string]bool)}
+
+// restartInit registers the admin endpoint and the metrics of rolling restarts.
+func (c *Cluster) restartInit() {
+	rollingRestart.state = new(expvar.String)
+	rollingRestart.state.Set("idle")
+	rollingRestart.node = new(expvar.String)
+	rollingRestart.restarted = new(expvar.Int)
+	rollingRestart.err = new(expvar.String)
+
+	rollingRestart.vars = new(expvar.Map).Init()
+	rollingRestart.vars.Set("state", rollingRestart.state)
+	rollingRestart.vars.Set("node", rollingRestart.node)
+	rollingRestart.vars.Set("restarted", rollingRestart.restarted)
+	rollingRestart.vars.Set("error", rollingRestart.err)
+	expvar.Publish("RollingRestart", rollingRestart.vars)
+
+	http.HandleFunc(ADMIN_CLUSTER_RESTART_PATH, serveClusterRestart)
+
+	go c.rejoin()
+}
+
+// startCordoned excludes this node from the ring hash and stops it from accepting connections
+// until rejoin finds out if the node is being restarted. Must be called before the first rehash.
+func (c *Cluster) startCordoned() {
+	cordoned.Lock()
+	cordoned.nodes[c.thisNodeName] = true
+	cordoned.Unlock()
+}
+
+// rejoin adopts the cordoned nodes from the first peer which answers. A peer which has not
+// caught up itself is only trusted about this node: after a restart of the whole cluster
+// every node has only itself cordoned.
+func (c *Cluster) rejoin() {
+	if len(c.nodes) == 0 {
+		// The first node of a backplane cluster
+		c.rejoined(make(map[string]bool))
+		return
+	}
+
+	deadline := time.Now().Add(CLUSTER_REJOIN_TIMEOUT)
+	for time.Now().Before(deadline) {
+		for _, n := range c.nodes {
+			var status ClusterNodeStatus
+			unused := false
+			if err := n.call("Cluster.NodeStatus", &unused, &status); err != nil {
+				continue
+			}
+
+			nodes := make(map[string]bool)
+			for _, name := range status.Cordoned {
+				if status.Ready || name == c.thisNodeName {
+					nodes[name] = true
+				}
+			}
+			c.rejoined(nodes)
+			if nodes[c.thisNodeName] {
+				logCluster.Infof("cluster: node '%s' is being restarted, staying cordoned", c.thisNodeName)
+			}
+			return
+		}
+		time.Sleep(CLUSTER_RESTART_POLL_INTERVAL)
+	}
+
+	logCluster.Warn("cluster: no peer answered after start, uncordoning this node")
+	c.rejoined(make(map[string]bool))
+}
+
+// rejoined replaces the cordoned nodes with the ones learned from the peers and rehashes topics.
+func (c *Cluster) rejoined(nodes map[string]bool) {
+	cordoned.Lock()
+	cordoned.nodes = nodes
+	cordoned.ready = true
+	cordoned.Unlock()
+
+	c.rehashLive()
+}
+
+// isCordoned checks if the node is excluded from the ring hash.
+func isCordoned(name string) bool {
+	cordoned.Lock()
+	defer cordoned.Unlock()
+	return cordoned.nodes[name]
+}
+
+// isCordoned checks if this node is being restarted and should not accept new connections.
+func (c *Cluster) isCordoned() bool {
+	if c == nil {
+		return false
+	}
+	return isCordoned(c.thisNodeName)
+}
+
+// Cordon adds or removes the node from the set of cordoned nodes and rehashes topics.
+// Called by the coordinator of the rolling restart.
+func (c *Cluster) Cordon(req *ClusterCordonReq, unused *bool) error {
+	c.setCordoned(req.Node, req.Cordon)
+	return nil
+}
+
+func (c *Cluster) setCordoned(name string, cordon bool) {
+	cordoned.Lock()
+	if cordon {
+		cordoned.nodes[name] = true
+	} else {
+		delete(cordoned.nodes, name)
+	}
+	cordoned.Unlock()
+
+	c.rehashLive()
+
+	logCluster.Infof("cluster: node '%s' cordoned: %t", name, cordon)
+}
+
+// rehashLive recalculates the ring hash of live nodes after a change of the cordoned nodes.
+func (c *Cluster) rehashLive() {
+	var active []string
+	if c.fo != nil {
+		active = c.fo.activeNodes
+	} else if c.bp != nil {
+		active = c.backplaneLive()
+	}
+	c.rehash(active)
+	globals.hub.rehash <- true
+}
+
+// NodeStatus reports the status of this node to the coordinator of the rolling restart.
+func (c *Cluster) NodeStatus(unused *bool, status *ClusterNodeStatus) error {
+	status.Started = nodeStarted
+	status.Topics = globals.hub.topicsLive.Value()
+
+	cordoned.Lock()
+	status.Ready = cordoned.ready
+	for name := range cordoned.nodes {
+		status.Cordoned = append(status.Cordoned, name)
+	}
+	cordoned.Unlock()
+	return nil
+}
+
+// Restart shuts down this node gracefully, as if it received SIGTERM.
+func (c *Cluster) Restart(unused *bool, unused2 *bool) error {
+	logCluster.Info("cluster: restart requested")
+	proc, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		return err
+	}
+	// Respond to the coordinator first
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		proc.Signal(syscall.SIGTERM)
+	}()
+	return nil
+}
+
+// RollingRestart restarts the listed nodes. Called by another node to restart it.
+func (c *Cluster) RollingRestart(req *ClusterRestartReq, unused *bool) error {
+	return c.startRollingRestart(req.Nodes)
+}
+
+// startRollingRestart starts restarting the nodes one by one in the background.
+// If nodes is empty, all nodes are restarted.
+func (c *Cluster) startRollingRestart(nodes []string) error {
+	rollingRestart.Lock()
+	defer rollingRestart.Unlock()
+
+	if rollingRestart.running {
+		return errors.New("rolling restart is already in progress")
+	}
+
+	if len(nodes) == 0 {
+		for name := range c.nodes {
+			nodes = append(nodes, name)
+		}
+		sort.Strings(nodes)
+		nodes = append(nodes, c.thisNodeName)
+	} else {
+		// This node must be the last one
+		var ordered []string
+		self := false
+		for _, name := range nodes {
+			if name == c.thisNodeName {
+				self = true
+			} else if c.nodes[name] == nil {
+				return errors.New("unknown node '" + name + "'")
+			} else {
+				ordered = append(ordered, name)
+			}
+		}
+		if self {
+			ordered = append(ordered, c.thisNodeName)
+		}
+		nodes = ordered
+	}
+
+	rollingRestart.running = true
+	rollingRestart.restarted.Set(0)
+	rollingRestart.err.Set("")
+	go c.rollingRestart(nodes)
+	return nil
+}
+
+func (c *Cluster) rollingRestart(nodes []string) {
+	state := "done"
+	defer func() {
+		rollingRestart.Lock()
+		rollingRestart.running = false
+		rollingRestart.Unlock()
+		rollingRestart.state.Set(state)
+		rollingRestart.node.Set("")
+	}()
+
+	for _, name := range nodes {
+		rollingRestart.node.Set(name)
+
+		if name == c.thisNodeName {
+			// Let another node restart this one
+			if err := c.handOffRestart(); err != nil {
+				c.restartFailed(err)
+				state = "failed"
+			} else {
+				state = "handed-off"
+			}
+			return
+		}
+
+		if err := c.restartNode(c.nodes[name]); err != nil {
+			c.restartFailed(err)
+			state = "failed"
+			return
+		}
+		rollingRestart.restarted.Add(1)
+	}
+}
+
+// restartNode takes the node through cordon, drain, restart, rejoin and uncordon steps.
+func (c *Cluster) restartNode(n *ClusterNode) error {
+	rollingRestart.state.Set("cordon")
+	if err := c.cordonAll(n.name, true); err != nil {
+		c.cordonAll(n.name, false)
+		return err
+	}
+
+	rollingRestart.state.Set("drain")
+	var status ClusterNodeStatus
+	unused := false
+	deadline := time.Now().Add(CLUSTER_RESTART_DRAIN_TIMEOUT)
+	for {
+		if err := n.call("Cluster.NodeStatus", &unused, &status); err != nil {
+			c.cordonAll(n.name, false)
+			return err
+		}
+		if status.Topics == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			// The remaining topics will be shut down gracefully
+			logCluster.Warnf("cluster: node '%s' still hosts %d topics, restarting anyway", n.name, status.Topics)
+			break
+		}
+		time.Sleep(CLUSTER_RESTART_POLL_INTERVAL)
+	}
+	started := status.Started
+
+	rollingRestart.state.Set("restart")
+	if err := n.call("Cluster.Restart", &unused, &unused); err != nil {
+		c.cordonAll(n.name, false)
+		return err
+	}
+
+	rollingRestart.state.Set("rejoin")
+	deadline = time.Now().Add(CLUSTER_RESTART_REJOIN_TIMEOUT)
+	for {
+		time.Sleep(CLUSTER_RESTART_POLL_INTERVAL)
+		// The new process uncordons itself unless it learns from the peers that it's being restarted
+		if err := n.call("Cluster.NodeStatus", &unused, &status); err == nil && status.Started.After(started) &&
+			status.Ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			// Leave the node cordoned: it's likely down
+			return errors.New("node '" + n.name + "' did not rejoin the cluster")
+		}
+	}
+
+	rollingRestart.state.Set("uncordon")
+	return c.cordonAll(n.name, false)
+}
+
+// cordonAll cordons or uncordons the node on all nodes of the cluster.
+func (c *Cluster) cordonAll(name string, cordon bool) error {
+	var failed error
+	for _, n := range c.nodes {
+		unused := false
+		if err := n.call("Cluster.Cordon", &ClusterCordonReq{Node: name, Cordon: cordon}, &unused); err != nil {
+			failed = err
+		}
+	}
+	c.setCordoned(name, cordon)
+	return failed
+}
+
+// handOffRestart asks another node to restart this one.
+func (c *Cluster) handOffRestart() error {
+	for _, n := range c.nodes {
+		unused := false
+		if err := n.call("Cluster.RollingRestart", &ClusterRestartReq{Nodes: []string{c.thisNodeName}}, &unused); err == nil {
+			logCluster.Infof("cluster: node '%s' will restart this node", n.name)
+			return nil
+		}
+	}
+	return errors.New("no node to hand off the restart to")
+}
+
+func (c *Cluster) restartFailed(err error) {
+	logCluster.Error("cluster: rolling restart failed:", err)
+	rollingRestart.err.Set(err.Error())
+}
+
+// serveClusterRestart starts a rolling restart or reports its progress:
+// POST /v0/admin/cluster/restart[?node=one&node=two]
+// GET /v0/admin/cluster/restart
+func serveClusterRestart(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	if _, authLvl, err := authHttpRequestLevel(req); err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	} else if authLvl != auth.LevelRoot {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		req.ParseForm()
+		if err := globals.cluster.startRollingRestart(req.Form["node"]); err != nil {
+			logCluster.Warn("cluster: rolling restart not started:", err)
+			writeErr(ErrOperationNotAllowed("", "", now))
+			return
+		}
+		wrt.WriteHeader(http.StatusAccepted)
+	default:
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	wrt.Write([]byte(rollingRestart.vars.String()))
+}
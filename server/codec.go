@@ -0,0 +1,89 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Serialization of wire messages. Messages sent to and received from the
+ *  clients are encoded by a codec selected with "json_codec" in the config:
+ *    - "std": encoding/json, always available;
+ *    - "jsoniter": github.com/json-iterator/go, build with -tags jsoniter;
+ *    - "sonic": github.com/bytedance/sonic, build with -tags sonic (amd64).
+ *  All codecs must produce the same JSON as encoding/json. Configuration,
+ *  HTTP handlers and plugins keep using encoding/json.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Codec serializes wire messages. Implementations must be safe for concurrent use.
+type Codec interface {
+	// Marshal returns the encoding of v. The result is owned by the caller.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal parses the encoded data and stores the result in v.
+	Unmarshal(data []byte, v interface{}) error
+	// NewEncoder returns an encoder writing to w. Packets are serialized by pooled encoders.
+	NewEncoder(w io.Writer) Encoder
+}
+
+// Encoder writes encoded values to its writer, each followed by a newline. It's used by one
+// goroutine at a time.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+var codecs map[string]Codec
+
+// Codec used for wire messages
+var wire Codec = stdCodec{}
+
+// registerCodec makes a codec available by the provided name.
+func registerCodec(name string, codec Codec) {
+	if codecs == nil {
+		codecs = make(map[string]Codec)
+	}
+
+	if codec == nil {
+		panic("registerCodec: codec is nil")
+	}
+	if _, dup := codecs[name]; dup {
+		panic("registerCodec: called twice for codec " + name)
+	}
+	codecs[name] = codec
+}
+
+// codecInit selects the codec of wire messages.
+func codecInit(name string) error {
+	if name == "" {
+		name = "std"
+	}
+	codec := codecs[name]
+	if codec == nil {
+		return errors.New("unknown json_codec '" + name + "', the server may have been built without it")
+	}
+	wire = codec
+	return nil
+}
+
+// stdCodec is encoding/json.
+type stdCodec struct{}
+
+func (stdCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (stdCodec) NewEncoder(w io.Writer) Encoder {
+	return json.NewEncoder(w)
+}
+
+func init() {
+	registerCodec("std", stdCodec{})
+}
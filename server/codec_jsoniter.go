@@ -0,0 +1,22 @@
+// +build jsoniter
+
+package main
+
+import (
+	"io"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+type jsoniterCodec struct {
+	jsoniter.API
+}
+
+func (c jsoniterCodec) NewEncoder(w io.Writer) Encoder {
+	return c.API.NewEncoder(w)
+}
+
+func init() {
+	// Same output as encoding/json: sorted map keys, escaped HTML
+	registerCodec("jsoniter", jsoniterCodec{jsoniter.ConfigCompatibleWithStandardLibrary})
+}
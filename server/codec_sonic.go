@@ -0,0 +1,22 @@
+// +build sonic
+
+package main
+
+import (
+	"io"
+
+	"github.com/bytedance/sonic"
+)
+
+type sonicCodec struct {
+	sonic.API
+}
+
+func (c sonicCodec) NewEncoder(w io.Writer) Encoder {
+	return c.API.NewEncoder(w)
+}
+
+func init() {
+	// Same output as encoding/json: sorted map keys, escaped HTML, validated strings
+	registerCodec("sonic", sonicCodec{sonic.ConfigStd})
+}
@@ -0,0 +1,395 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Compliance journaling: a copy of every message saved into the selected
+ *  topics, or into all topics, is delivered to a compliance endpoint in the
+ *  order the messages were saved. Edits are journaled as new copies with
+ *  the time of the edit. The endpoint is either HTTPS, which receives the
+ *  messages in batches as JSON, or SMTP, which receives one email per
+ *  message. Failed deliveries are retried until they succeed: a message is
+ *  never skipped, so the order is kept.
+ *
+ *  The messages waiting for delivery are kept in a bounded queue. A topic
+ *  takes room in the queue before it saves the message; when the queue is
+ *  full the topic waits for room, which slows down the publishers, and
+ *  rejects the message with 503 if no room is freed in time. The queue is
+ *  not persisted: messages queued when the server crashes are not
+ *  journaled. In a cluster every node journals the messages of the topics
+ *  it hosts.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of messages waiting for delivery
+	COMPLIANCE_DEFAULT_QUEUE_SIZE = 10000
+	// Default time a topic waits for room in the full queue
+	COMPLIANCE_DEFAULT_QUEUE_WAIT = 5 * time.Second
+	// Default timeout of HTTPS requests
+	COMPLIANCE_DEFAULT_TIMEOUT = 10 * time.Second
+	// Maximum number of messages in one HTTPS request
+	COMPLIANCE_MAX_BATCH = 100
+	// Maximum delay between retries of a failed delivery
+	COMPLIANCE_MAX_BACKOFF = time.Minute
+)
+
+type complianceSmtpConfig struct {
+	// SMTP server and port
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Credentials for PLAIN authentication, optional
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// Sender and recipient of the journal emails
+	Sender  string `json:"sender"`
+	Journal string `json:"journal"`
+}
+
+type complianceConfig struct {
+	// Enable journaling
+	Enabled bool `json:"enabled"`
+	// Names of journaled topics, all topics if empty
+	Topics []string `json:"topics"`
+	// Maximum number of messages waiting for delivery
+	QueueSize int `json:"queue_size"`
+	// Time a topic waits for room in the full queue, milliseconds
+	QueueWait int `json:"queue_wait"`
+	// HTTPS endpoint which receives batches of messages
+	Url string `json:"url"`
+	// Secret for signing the HTTPS requests, optional
+	Secret string `json:"secret"`
+	// Timeout of HTTPS requests, milliseconds
+	Timeout int `json:"timeout"`
+	// SMTP journaling, used instead of HTTPS
+	Smtp *complianceSmtpConfig `json:"smtp"`
+}
+
+// Journaled copy of a message
+type complianceRecord struct {
+	Topic     string            `json:"topic"`
+	SeqId     int               `json:"seq"`
+	From      string            `json:"from,omitempty"`
+	Timestamp time.Time         `json:"ts"`
+	EditedAt  *time.Time        `json:"edited,omitempty"`
+	Head      map[string]string `json:"head,omitempty"`
+	Content   interface{}       `json:"content"`
+}
+
+// Endpoint which receives the journal
+type complianceSink interface {
+	// send delivers the records in order. Returns the number of records delivered before a failure.
+	send(records []*complianceRecord) (int, error)
+}
+
+var compliance struct {
+	enabled bool
+	// Journaled topics, all if empty
+	topics map[string]bool
+	wait   time.Duration
+	sink   complianceSink
+
+	// Room in the queue: taken before a message is saved, freed when it's delivered
+	slots chan struct{}
+	// Messages waiting for delivery, oldest first
+	lock  sync.Mutex
+	queue []*complianceRecord
+	// Wakes up the delivery loop
+	signal chan struct{}
+	// Closed on shutdown; the delivery loop closes done when the queue is empty
+	stopping chan struct{}
+	done     chan struct{}
+
+	// Exported counters of journaled and rejected messages
+	journaled *expvar.Int
+	rejected  *expvar.Int
+}
+
+// complianceInit parses config and starts delivery of the journal. Journaling is disabled by default.
+func complianceInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config complianceConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logCompliance.Fatal("Failed to parse compliance_journal config:", err)
+	}
+	if !config.Enabled {
+		return
+	}
+
+	switch {
+	case config.Smtp != nil && config.Url != "":
+		logCompliance.Fatal("compliance_journal: 'url' and 'smtp' are mutually exclusive")
+	case config.Smtp != nil:
+		if config.Smtp.Host == "" || config.Smtp.Sender == "" || config.Smtp.Journal == "" {
+			logCompliance.Fatal("compliance_journal: 'smtp' requires 'host', 'sender' and 'journal'")
+		}
+		sink := &complianceSmtp{config: *config.Smtp}
+		if sink.config.Port <= 0 {
+			sink.config.Port = 25
+		}
+		if sink.config.Login != "" {
+			sink.auth = smtp.PlainAuth("", sink.config.Login, sink.config.Password, sink.config.Host)
+		}
+		compliance.sink = sink
+	case config.Url != "":
+		timeout := time.Duration(config.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = COMPLIANCE_DEFAULT_TIMEOUT
+		}
+		compliance.sink = &complianceHttp{
+			url:    config.Url,
+			secret: []byte(config.Secret),
+			client: &http.Client{Timeout: timeout}}
+	default:
+		logCompliance.Fatal("compliance_journal: missing 'url' or 'smtp'")
+	}
+
+	compliance.topics = make(map[string]bool, len(config.Topics))
+	for _, name := range config.Topics {
+		compliance.topics[name] = true
+	}
+	compliance.wait = time.Duration(config.QueueWait) * time.Millisecond
+	if compliance.wait <= 0 {
+		compliance.wait = COMPLIANCE_DEFAULT_QUEUE_WAIT
+	}
+	size := config.QueueSize
+	if size <= 0 {
+		size = COMPLIANCE_DEFAULT_QUEUE_SIZE
+	}
+	compliance.slots = make(chan struct{}, size)
+	compliance.signal = make(chan struct{}, 1)
+	compliance.stopping = make(chan struct{})
+	compliance.done = make(chan struct{})
+
+	compliance.journaled, compliance.rejected = new(expvar.Int), new(expvar.Int)
+	vars := new(expvar.Map).Init()
+	vars.Set("journaled", compliance.journaled)
+	vars.Set("rejected", compliance.rejected)
+	vars.Set("queued", expvar.Func(func() interface{} { return len(compliance.slots) }))
+	expvar.Publish("ComplianceJournal", vars)
+
+	compliance.enabled = true
+
+	go complianceRun()
+
+	if len(compliance.topics) > 0 {
+		logCompliance.Infof("Journaling messages of %d topics", len(compliance.topics))
+	} else {
+		logCompliance.Info("Journaling messages of all topics")
+	}
+}
+
+// complianceStop waits for the queued messages to be delivered.
+func complianceStop() {
+	if !compliance.enabled {
+		return
+	}
+
+	close(compliance.stopping)
+	select {
+	case <-compliance.done:
+	case <-time.After(globals.drainTimeout):
+		compliance.lock.Lock()
+		left := len(compliance.queue)
+		compliance.lock.Unlock()
+		logCompliance.Warnf("compliance: %d messages were not journaled", left)
+	}
+}
+
+// complianceWanted checks if the messages of the topic are journaled.
+func complianceWanted(topic string) bool {
+	return compliance.enabled && (len(compliance.topics) == 0 || compliance.topics[topic])
+}
+
+// complianceReserve takes room for one message in the queue, waiting while the queue is full. Returns false
+// if no room was freed in time: the message must be rejected.
+func complianceReserve() bool {
+	select {
+	case compliance.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(compliance.wait)
+	defer timer.Stop()
+	select {
+	case compliance.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		compliance.rejected.Add(1)
+		return false
+	}
+}
+
+// complianceRelease frees the room taken for a message which was not saved.
+func complianceRelease() {
+	<-compliance.slots
+}
+
+// complianceAppend queues the saved message for delivery into the room taken by complianceReserve.
+func complianceAppend(msg *types.Message) {
+	compliance.lock.Lock()
+	compliance.queue = append(compliance.queue, &complianceRecord{
+		Topic:     msg.Topic,
+		SeqId:     msg.SeqId,
+		From:      types.ParseUid(msg.From).UserId(),
+		Timestamp: msg.CreatedAt,
+		EditedAt:  msg.EditedAt,
+		Head:      msg.Head,
+		Content:   msg.Content})
+	compliance.lock.Unlock()
+
+	select {
+	case compliance.signal <- struct{}{}:
+	default:
+	}
+}
+
+// complianceRun delivers the queued messages in order.
+func complianceRun() {
+	backoff := time.Second
+	for {
+		compliance.lock.Lock()
+		batch := compliance.queue
+		if len(batch) > COMPLIANCE_MAX_BATCH {
+			batch = batch[:COMPLIANCE_MAX_BATCH]
+		}
+		compliance.lock.Unlock()
+
+		if len(batch) == 0 {
+			select {
+			case <-compliance.signal:
+				continue
+			case <-compliance.stopping:
+				// Messages could be queued before the signal was checked
+				compliance.lock.Lock()
+				empty := len(compliance.queue) == 0
+				compliance.lock.Unlock()
+				if empty {
+					close(compliance.done)
+					return
+				}
+				continue
+			}
+		}
+
+		sent, err := compliance.sink.send(batch)
+		if sent > 0 {
+			compliance.lock.Lock()
+			compliance.queue = compliance.queue[sent:]
+			if len(compliance.queue) == 0 {
+				compliance.queue = nil
+			}
+			compliance.lock.Unlock()
+			for i := 0; i < sent; i++ {
+				<-compliance.slots
+			}
+			compliance.journaled.Add(int64(sent))
+		}
+
+		if err != nil {
+			logCompliance.Warnf("compliance: failed to journal message %s#%d: %v",
+				batch[sent].Topic, batch[sent].SeqId, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > COMPLIANCE_MAX_BACKOFF {
+				backoff = COMPLIANCE_MAX_BACKOFF
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+// HTTPS endpoint: messages are posted as {"messages": [...]}. Requests are signed with HMAC-SHA256 of
+// the body in the X-Tinode-Signature header if the secret is set.
+type complianceHttp struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func (ch *complianceHttp) send(records []*complianceRecord) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{"messages": records})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ch.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(ch.secret) > 0 {
+		mac := hmac.New(sha256.New, ch.secret)
+		mac.Write(body)
+		req.Header.Set("X-Tinode-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ch.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, errors.New("unexpected response status " + resp.Status)
+	}
+	return len(records), nil
+}
+
+// SMTP journaling: each message is sent to the journal mailbox as an email with the message as JSON.
+type complianceSmtp struct {
+	config complianceSmtpConfig
+	auth   smtp.Auth
+}
+
+func (cs *complianceSmtp) send(records []*complianceRecord) (int, error) {
+	addr := cs.config.Host + ":" + strconv.Itoa(cs.config.Port)
+	for i, rec := range records {
+		body, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			return i, err
+		}
+
+		var email bytes.Buffer
+		fmt.Fprintf(&email, "From: %s\r\n", cs.config.Sender)
+		fmt.Fprintf(&email, "To: %s\r\n", cs.config.Journal)
+		fmt.Fprintf(&email, "Subject: Journal: %s #%d\r\n", rec.Topic, rec.SeqId)
+		fmt.Fprintf(&email, "Date: %s\r\n", rec.Timestamp.Format(time.RFC1123Z))
+		fmt.Fprintf(&email, "Message-ID: <%s.%d.%d@%s>\r\n",
+			rec.Topic, rec.SeqId, time.Now().UnixNano(), cs.config.Host)
+		fmt.Fprintf(&email, "X-Tinode-Topic: %s\r\n", rec.Topic)
+		fmt.Fprintf(&email, "X-Tinode-Seq: %d\r\n", rec.SeqId)
+		email.WriteString("MIME-Version: 1.0\r\n")
+		email.WriteString("Content-Type: application/json; charset=utf-8\r\n\r\n")
+		email.Write(body)
+		email.WriteString("\r\n")
+
+		if err = smtp.SendMail(addr, cs.auth, cs.config.Sender, []string{cs.config.Journal}, email.Bytes()); err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
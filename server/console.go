@@ -0,0 +1,612 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Administrative console API for operator tools. It's served on its own
+ *  listener, "admin_console.listen", which should not be reachable from the
+ *  internet, and authenticated by the keys of the operators in
+ *  "admin_console.keys" sent as "Authorization: Bearer <key>":
+ *    GET    /v0/console/sessions[?user=usr...]  - list sessions of all nodes
+ *    DELETE /v0/console/sessions?sid=...|user=usr... - terminate sessions
+ *    GET    /v0/console/users/usr...            - account state and quota
+ *    POST   /v0/console/users/usr...            - change the state of the
+ *           account, see userstate.go, or the upload quota:
+ *           {"state": "suspended", "reason": "...", "file_quota": N}
+ *    DELETE /v0/console/topics/<topic>          - delete any topic
+ *    GET    /v0/console/retention               - message retention policy
+ *    POST   /v0/console/retention               - change retention on all
+ *           nodes until restart, in seconds, 0 for the adapter default, -1
+ *           to keep forever: {"grp": N, "topics": {"grpXXX": N}}
+ *    POST   /v0/console/announce                - send a service announcement
+ *           to all sessions: {"content": ...}
+ *  The upload quota is the only limit the server keeps per user: the other
+ *  limits, e.g. message size or topic members, are server-wide settings.
+ *  Every request which changes anything is written to the audit log with
+ *  the name of the key. In a standby region the requests which change
+ *  anything fail with 503 and the URL of the primary region.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Prefix of the paths of the console API
+	ADMIN_CONSOLE_PATH = "/v0/console/"
+	// Maximum size of a request body
+	CONSOLE_MAX_BODY = 1 << 16
+)
+
+type adminConsoleConfig struct {
+	// Address to listen on, e.g. "127.0.0.1:6070"
+	Listen string `json:"listen"`
+	// Keys of the operators by name
+	Keys map[string]string `json:"keys"`
+}
+
+// Session as reported by the console
+type consoleSession struct {
+	Sid          string    `json:"sid"`
+	Node         string    `json:"node,omitempty"`
+	User         string    `json:"user,omitempty"`
+	AuthLevel    string    `json:"authlvl,omitempty"`
+	Proto        string    `json:"proto"`
+	RemoteAddr   string    `json:"remote,omitempty"`
+	UserAgent    string    `json:"ua,omitempty"`
+	LastAction   time.Time `json:"last"`
+	Impersonator string    `json:"impersonator,omitempty"`
+}
+
+// Account as reported by the console
+type consoleUser struct {
+	User string `json:"user"`
+	// State of the account, the reason and the time of the last change
+	State   string     `json:"state"`
+	Reason  string     `json:"reason,omitempty"`
+	StateAt *time.Time `json:"state_at,omitempty"`
+	// Quota set for the user, 0 for the server default, negative if unlimited
+	FileQuota int64 `json:"file_quota"`
+	// Size of the files uploaded by the user
+	FileUsage int64 `json:"file_usage"`
+}
+
+// Change of an account
+type consoleUserUpdate struct {
+	State     *string `json:"state"`
+	Reason    string  `json:"reason"`
+	FileQuota *int64  `json:"file_quota"`
+}
+
+// Message retention as reported and changed by the console, in seconds: 0 for the adapter default,
+// -1 to keep forever. Missing values are not changed.
+type consoleRetention struct {
+	Me     *int           `json:"me,omitempty"`
+	P2P    *int           `json:"p2p,omitempty"`
+	Grp    *int           `json:"grp,omitempty"`
+	Topics map[string]int `json:"topics,omitempty"`
+}
+
+// Request of the console to other nodes of the cluster
+type ClusterConsoleReq struct {
+	// Sessions of the user, or the session with the ID
+	User types.Uid
+	Sid  string
+	// Topic to delete
+	Topic string
+	// Announcement
+	Content interface{}
+	// Change of message retention
+	Retention *consoleRetention
+}
+
+var adminConsole struct {
+	keys map[string][]byte
+}
+
+// adminConsoleInit starts the console listener. The console is disabled if not configured.
+func adminConsoleInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config adminConsoleConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse admin_console config:", err)
+	}
+	if config.Listen == "" {
+		return
+	}
+	if len(config.Keys) == 0 {
+		logMain.Fatal("admin_console: missing 'keys'")
+	}
+
+	adminConsole.keys = make(map[string][]byte, len(config.Keys))
+	for name, key := range config.Keys {
+		if len(key) < 16 {
+			logMain.Fatalf("admin_console: key '%s' is shorter than 16 characters", name)
+		}
+		adminConsole.keys[name] = []byte(key)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ADMIN_CONSOLE_PATH, serveConsole)
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		logMain.Fatal("admin_console: failed to listen:", err)
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logMain.Warn("admin_console: listener stopped:", err)
+		}
+	}()
+
+	logMain.Infof("Admin console listening on %s", config.Listen)
+}
+
+// consoleOperator returns the name of the key the request is authenticated with, empty if none matches.
+func consoleOperator(req *http.Request) string {
+	parts := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return ""
+	}
+	given := []byte(strings.TrimSpace(parts[1]))
+	for name, key := range adminConsole.keys {
+		if subtle.ConstantTimeCompare(given, key) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+// serveConsole handles the requests of the console API.
+func serveConsole(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+	writeResult := func(result interface{}) {
+		if err := enc.Encode(result); err != nil {
+			logHttp.Warn("admin_console: failed to write response:", err)
+		}
+	}
+
+	operator := consoleOperator(req)
+	if operator == "" {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	}
+
+	if primary := regionRedirect(); primary != "" && req.Method != http.MethodGet {
+		// The console listener of the primary is not known here: report its region instead.
+		msg := ErrServiceUnavailable("", "", now)
+		msg.Ctrl.Params = map[string]interface{}{"url": primary}
+		writeErr(msg)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(wrt, req.Body, CONSOLE_MAX_BODY)
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, ADMIN_CONSOLE_PATH), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "sessions":
+		user := types.ZeroUid
+		if name := req.FormValue("user"); name != "" {
+			if user = types.ParseUserId(name); user.IsZero() {
+				writeErr(ErrMalformed("", "", now))
+				return
+			}
+		}
+		switch req.Method {
+		case http.MethodGet:
+			writeResult(map[string]interface{}{"sessions": consoleSessionsAll(user)})
+		case http.MethodDelete:
+			sid := req.FormValue("sid")
+			if sid == "" && user.IsZero() {
+				writeErr(ErrMalformed("", "", now))
+				return
+			}
+			count := consoleTerminateAll(&ClusterConsoleReq{User: user, Sid: sid})
+			logAudit.Infof("console: '%s' terminated %d sessions, user '%s', sid '%s'", operator, count,
+				user.UserId(), sid)
+			writeResult(map[string]interface{}{"terminated": count})
+		default:
+			writeErr(ErrOperationNotAllowed("", "", now))
+		}
+
+	case len(parts) == 2 && parts[0] == "users":
+		uid := types.ParseUserId(parts[1])
+		if uid.IsZero() {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+		var update *consoleUserUpdate
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			update = &consoleUserUpdate{}
+			if err := json.NewDecoder(req.Body).Decode(update); err != nil {
+				writeErr(ErrMalformed("", "", now))
+				return
+			}
+			if update.State != nil {
+				if _, ok := parseUserState(*update.State); !ok {
+					writeErr(ErrMalformed("", "", now))
+					return
+				}
+			}
+		default:
+			writeErr(ErrOperationNotAllowed("", "", now))
+			return
+		}
+		result, err := consoleUpdateUser(uid, update, operator)
+		if err == errUserStateTransition {
+			writeErr(ErrOperationNotAllowed("", "", now))
+			return
+		} else if err != nil {
+			writeErr(ErrUnknown("", "", now))
+			return
+		} else if result == nil {
+			writeErr(ErrUserNotFound("", "", now))
+			return
+		}
+		writeResult(result)
+
+	case len(parts) == 2 && parts[0] == "topics":
+		if req.Method != http.MethodDelete {
+			writeErr(ErrOperationNotAllowed("", "", now))
+			return
+		}
+		topic := parts[1]
+		if !strings.HasPrefix(topic, "grp") && !strings.HasPrefix(topic, "chn") && !strings.HasPrefix(topic, "p2p") {
+			writeErr(ErrMalformed("", topic, now))
+			return
+		}
+		if err := consoleDeleteTopic(topic); err != nil {
+			logHttp.Warnf("admin_console: failed to delete topic '%s': %v", topic, err)
+			writeErr(ErrUnknown("", topic, now))
+			return
+		}
+		logAudit.Infof("console: '%s' deleted topic '%s'", operator, topic)
+		writeResult(NoErr("", topic, now))
+
+	case len(parts) == 1 && parts[0] == "retention":
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !store.RetentionSupported() {
+				writeErr(ErrNotImplemented("", "", now))
+				return
+			}
+			var update consoleRetention
+			if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+				writeErr(ErrMalformed("", "", now))
+				return
+			}
+			for topic := range update.Topics {
+				// Messages of 'me' are stored under the user ID
+				if !strings.HasPrefix(topic, "usr") && !strings.HasPrefix(topic, "grp") &&
+					!strings.HasPrefix(topic, "chn") && !strings.HasPrefix(topic, "p2p") {
+					writeErr(ErrMalformed("", topic, now))
+					return
+				}
+			}
+			consoleRetentionAll(&update)
+			logAudit.Infof("console: '%s' changed message retention %s", operator, consoleRetentionString(&update))
+		default:
+			writeErr(ErrOperationNotAllowed("", "", now))
+			return
+		}
+		writeResult(consoleRetentionGet())
+
+	case len(parts) == 1 && parts[0] == "announce":
+		if req.Method != http.MethodPost {
+			writeErr(ErrOperationNotAllowed("", "", now))
+			return
+		}
+		var body struct {
+			Content interface{} `json:"content"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Content == nil {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+		count := consoleAnnounceAll(body.Content)
+		logAudit.Infof("console: '%s' sent an announcement to %d sessions", operator, count)
+		writeResult(map[string]interface{}{"sessions": count})
+
+	default:
+		writeErr(ErrNotFound("", "", now))
+	}
+}
+
+// consoleProtoName returns the name of the transport of the session.
+func consoleProtoName(proto int) string {
+	switch proto {
+	case WEBSOCK:
+		return "ws"
+	case LPOLL:
+		return "lp"
+	case SSE:
+		return "sse"
+	case MQTT:
+		return "mqtt"
+	}
+	return "none"
+}
+
+// consoleSessions lists the client sessions of this node, of the user if the user is not zero.
+func consoleSessions(user types.Uid) []consoleSession {
+	var node string
+	if globals.cluster != nil {
+		node = globals.cluster.thisNodeName
+	}
+
+	var list []consoleSession
+	for _, s := range globals.sessionStore.all() {
+		// Sessions proxied from other nodes are listed by their nodes
+		if s.proto == RPC || (!user.IsZero() && s.uid != user) {
+			continue
+		}
+		cs := consoleSession{
+			Sid:        s.sid,
+			Node:       node,
+			Proto:      consoleProtoName(s.proto),
+			RemoteAddr: s.remoteAddr,
+			UserAgent:  s.userAgent,
+			LastAction: s.lastActionAt()}
+		if !s.uid.IsZero() {
+			cs.User = s.uid.UserId()
+			cs.AuthLevel = auth.AuthLevelName(s.authLvl)
+		}
+		if !s.impersonator.IsZero() {
+			cs.Impersonator = s.impersonator.UserId()
+		}
+		list = append(list, cs)
+	}
+	return list
+}
+
+// consoleTerminate stops the client sessions of this node which match the request. Returns the number of
+// sessions stopped.
+func consoleTerminate(req *ClusterConsoleReq) int {
+	data := encodePacket(NoErrTerminated(types.TimeNow()))
+	count := 0
+	for _, s := range globals.sessionStore.all() {
+		if s.proto == RPC || s.stop == nil {
+			continue
+		}
+		if (req.Sid != "" && s.sid != req.Sid) || (!req.User.IsZero() && s.uid != req.User) {
+			continue
+		}
+		select {
+		case s.stop <- data:
+			count++
+		default:
+			// The session is already stopping
+		}
+	}
+	return count
+}
+
+// consoleAnnounce sends the announcement to the authenticated sessions of this node. Returns the number
+// of sessions.
+func consoleAnnounce(content interface{}) int {
+	now := types.TimeNow()
+	count := 0
+	for _, s := range globals.sessionStore.all() {
+		if s.proto == RPC || s.uid.IsZero() {
+			continue
+		}
+		s.queueOut(&ServerComMessage{Info: &MsgServerInfo{Topic: "me", What: "announce", Content: content},
+			rcptto: s.uid.UserId(), timestamp: now})
+		count++
+	}
+	return count
+}
+
+// consoleRetentionGet reports the retention policy of this node.
+func consoleRetentionGet() *consoleRetention {
+	seconds := func(period time.Duration) *int {
+		val := int(period / time.Second)
+		if period == store.RetainForever {
+			val = -1
+		}
+		return &val
+	}
+	result := &consoleRetention{
+		Me:     seconds(store.Retention.Category(types.TopicCat_Me)),
+		P2P:    seconds(store.Retention.Category(types.TopicCat_P2P)),
+		Grp:    seconds(store.Retention.Category(types.TopicCat_Grp)),
+		Topics: make(map[string]int)}
+	for topic, period := range store.Retention.Topics() {
+		result.Topics[topic] = *seconds(period)
+	}
+	return result
+}
+
+// consoleRetentionSet changes the retention policy of this node.
+func consoleRetentionSet(update *consoleRetention) {
+	period := func(val int) time.Duration {
+		if val < 0 {
+			return store.RetainForever
+		}
+		return time.Duration(val) * time.Second
+	}
+	if update.Me != nil {
+		store.Retention.SetCategory(types.TopicCat_Me, period(*update.Me))
+	}
+	if update.P2P != nil {
+		store.Retention.SetCategory(types.TopicCat_P2P, period(*update.P2P))
+	}
+	if update.Grp != nil {
+		// Channels are kept as long as group topics
+		store.Retention.SetCategory(types.TopicCat_Grp, period(*update.Grp))
+		store.Retention.SetCategory(types.TopicCat_Chn, period(*update.Grp))
+	}
+	for topic, val := range update.Topics {
+		store.Retention.SetTopic(topic, period(val))
+	}
+}
+
+// consoleRetentionString formats the change of retention for the audit log.
+func consoleRetentionString(update *consoleRetention) string {
+	data, _ := json.Marshal(update)
+	return string(data)
+}
+
+// ConsoleSessions lists the sessions of this node for the console of another node.
+func (Cluster) ConsoleSessions(req *ClusterConsoleReq, list *[]consoleSession) error {
+	*list = consoleSessions(req.User)
+	return nil
+}
+
+// ConsoleTerminate stops the sessions of this node on request of the console of another node.
+func (Cluster) ConsoleTerminate(req *ClusterConsoleReq, count *int) error {
+	*count = consoleTerminate(req)
+	return nil
+}
+
+// ConsoleAnnounce sends the announcement to the sessions of this node.
+func (Cluster) ConsoleAnnounce(req *ClusterConsoleReq, count *int) error {
+	*count = consoleAnnounce(req.Content)
+	return nil
+}
+
+// ConsoleRetention changes the retention policy of this node on request of the console of another node.
+func (Cluster) ConsoleRetention(req *ClusterConsoleReq, unused *bool) error {
+	consoleRetentionSet(req.Retention)
+	return nil
+}
+
+// ConsoleDeleteTopic deletes the topic hosted by this node on request of the console of another node.
+func (Cluster) ConsoleDeleteTopic(req *ClusterConsoleReq, unused *bool) error {
+	return consoleDeleteTopic(req.Topic)
+}
+
+// consoleSessionsAll lists the sessions of all nodes. Nodes which fail to respond are skipped.
+func consoleSessionsAll(user types.Uid) []consoleSession {
+	list := consoleSessions(user)
+	if globals.cluster != nil {
+		for _, n := range globals.cluster.nodes {
+			var remote []consoleSession
+			if err := n.call("Cluster.ConsoleSessions", &ClusterConsoleReq{User: user}, &remote); err == nil {
+				list = append(list, remote...)
+			}
+		}
+	}
+	return list
+}
+
+// consoleTerminateAll stops the matching sessions on all nodes. Returns the number of sessions stopped.
+func consoleTerminateAll(req *ClusterConsoleReq) int {
+	count := consoleTerminate(req)
+	if globals.cluster != nil {
+		for _, n := range globals.cluster.nodes {
+			var remote int
+			if err := n.call("Cluster.ConsoleTerminate", req, &remote); err == nil {
+				count += remote
+			}
+		}
+	}
+	return count
+}
+
+// consoleAnnounceAll sends the announcement to the sessions of all nodes. Returns the number of sessions.
+func consoleAnnounceAll(content interface{}) int {
+	count := consoleAnnounce(content)
+	if globals.cluster != nil {
+		for _, n := range globals.cluster.nodes {
+			var remote int
+			if err := n.call("Cluster.ConsoleAnnounce", &ClusterConsoleReq{Content: content}, &remote); err == nil {
+				count += remote
+			}
+		}
+	}
+	return count
+}
+
+// consoleRetentionAll changes the retention policy of all nodes. Nodes which fail to respond are skipped:
+// they keep the retention from the config.
+func consoleRetentionAll(update *consoleRetention) {
+	consoleRetentionSet(update)
+	if globals.cluster != nil {
+		for _, n := range globals.cluster.nodes {
+			unused := false
+			if err := n.call("Cluster.ConsoleRetention", &ClusterConsoleReq{Retention: update}, &unused); err != nil {
+				logHttp.Warnf("admin_console: failed to change retention at node '%s': %v", n.name, err)
+			}
+		}
+	}
+}
+
+// consoleDeleteTopic deletes the topic by the node which hosts it.
+func consoleDeleteTopic(topic string) error {
+	if globals.cluster.isRemoteTopic(topic) {
+		n := globals.cluster.nodeForTopic(topic)
+		if n == nil {
+			return errors.New("node of the topic is unreachable")
+		}
+		unused := false
+		return n.call("Cluster.ConsoleDeleteTopic", &ClusterConsoleReq{Topic: topic}, &unused)
+	}
+
+	done := make(chan error, 1)
+	globals.hub.unreg <- &topicUnreg{topic: topic, del: true, adminDone: done}
+	return <-done
+}
+
+// consoleUpdateUser applies the update to the account, if any, and reports the account. Returns nil if
+// the user does not exist.
+func consoleUpdateUser(uid types.Uid, update *consoleUserUpdate, operator string) (*consoleUser, error) {
+	user, err := store.Users.Get(uid)
+	if err != nil || user == nil {
+		return nil, err
+	}
+
+	if update != nil && update.State != nil {
+		state, _ := parseUserState(*update.State)
+		// Sessions of the user are terminated unless the account becomes active
+		if _, err = userStateChange(user, state, update.Reason, "console:"+operator); err != nil {
+			return nil, err
+		}
+	}
+	if update != nil && update.FileQuota != nil && *update.FileQuota != user.FileQuota {
+		if err = store.Users.Update(uid, map[string]interface{}{"FileQuota": *update.FileQuota}); err != nil {
+			return nil, err
+		}
+		logAudit.Infof("console: '%s' changed file quota of '%s' to %d", operator, uid.UserId(), *update.FileQuota)
+		user.FileQuota = *update.FileQuota
+	}
+
+	usage, err := store.Files.Usage(uid)
+	if err != nil {
+		return nil, err
+	}
+	result := &consoleUser{
+		User:      uid.UserId(),
+		State:     userStateName(user.State),
+		Reason:    user.StateReason,
+		FileQuota: user.FileQuota,
+		FileUsage: usage}
+	if !user.StateAt.IsZero() {
+		result.StateAt = &user.StateAt
+	}
+	return result, nil
+}
@@ -0,0 +1,230 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Contact list of a user kept by the server, independent of p2p topics.
+ *  Requests are made on 'me':
+ *    {set topic="me" contact={user: "usr...", what: "add"}} asks the other
+ *      user to be added; if the other user has already asked, it accepts;
+ *    {set topic="me" contact={user: "usr...", what: "accept"}} accepts the
+ *      request received from the other user;
+ *    {set topic="me" contact={user: "usr...", what: "remove"}} removes the
+ *      contact, declines or cancels the request;
+ *    {get topic="me" what="contacts"} returns the list in {meta contacts}.
+ *  The other user is told about a change by
+ *  {pres topic="me" what="contact" src="usr..."} and is expected to fetch
+ *  the list again. Accepted contacts exchange presence as if they had a p2p
+ *  topic. Requests from blocked users are not shown.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of contacts and requests of one user
+	CONTACTS_MAX_COUNT = 1024
+)
+
+var contactStatusNames = map[int]string{
+	types.ContactSent:     "sent",
+	types.ContactReceived: "received",
+	types.ContactAccepted: "accepted",
+}
+
+// replySetContact changes the contact list in response to set.contact on 'me'.
+func (t *Topic) replySetContact(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCat_Me {
+		sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
+		return errors.New("contact list changed outside of 'me'")
+	}
+
+	target := types.ParseUserId(set.Contact.User)
+	if target.IsZero() || target == sess.uid {
+		sess.queueOut(ErrMalformed(set.Id, set.Topic, now))
+		return errors.New("invalid contact")
+	}
+
+	contacts, err := store.Contacts.GetAll(sess.uid)
+	if err != nil {
+		sess.queueOut(ErrUnknown(set.Id, set.Topic, now))
+		return err
+	}
+	var status int
+	for i := range contacts {
+		if contacts[i].Contact == target.String() {
+			status = contacts[i].Status
+			break
+		}
+	}
+
+	// New status of the contact, 0 to remove it
+	next := status
+	switch set.Contact.What {
+	case "add":
+		if status == 0 {
+			if len(contacts) >= CONTACTS_MAX_COUNT {
+				sess.queueOut(ErrPolicy(set.Id, set.Topic, now))
+				return errors.New("too many contacts")
+			}
+			user, err := store.Users.Get(target)
+			if err != nil {
+				sess.queueOut(ErrUnknown(set.Id, set.Topic, now))
+				return err
+			}
+			if user == nil {
+				sess.queueOut(ErrUserNotFound(set.Id, set.Topic, now))
+				return errors.New("contact not found")
+			}
+			next = types.ContactSent
+		} else if status == types.ContactReceived {
+			next = types.ContactAccepted
+		}
+	case "accept":
+		if status == types.ContactReceived {
+			next = types.ContactAccepted
+		} else if status != types.ContactAccepted {
+			sess.queueOut(ErrNotFound(set.Id, set.Topic, now))
+			return errors.New("no contact request to accept")
+		}
+	case "remove":
+		next = 0
+	default:
+		sess.queueOut(ErrMalformed(set.Id, set.Topic, now))
+		return errors.New("invalid contact action")
+	}
+
+	if next == status {
+		sess.queueOut(InfoNoAction(set.Id, set.Topic, now))
+		return nil
+	}
+
+	if next == 0 {
+		err = store.Contacts.Delete(sess.uid, target)
+	} else {
+		err = store.Contacts.Set(sess.uid, target, next)
+	}
+	if err != nil {
+		sess.queueOut(ErrUnknown(set.Id, set.Topic, now))
+		return err
+	}
+
+	if next == types.ContactAccepted {
+		// Start exchanging presence
+		if t.contacts == nil {
+			t.contacts = make(map[types.Uid]bool)
+		}
+		t.contacts[target] = true
+		if _, ok := t.perSubs[target.UserId()]; !ok {
+			t.addToPerSubs(target.UserId(), false)
+		}
+		if t.presVisibleTo(target.UserId()) {
+			globals.hub.route <- &ServerComMessage{
+				Pres: &MsgServerPres{Topic: "me", What: "on", Src: t.name, UserAgent: t.userAgent,
+					wantReply: true},
+				rcptto: target.UserId()}
+		}
+	} else if status == types.ContactAccepted {
+		// Stop exchanging presence unless the users have a p2p topic
+		t.contactRemoved(target)
+		globals.hub.route <- &ServerComMessage{
+			Pres:   &MsgServerPres{Topic: "me", What: "off", Src: t.name},
+			rcptto: target.UserId()}
+		globals.hub.route <- &ServerComMessage{
+			Info:   &MsgServerInfo{Topic: "me", From: sess.uid.UserId(), What: "uncontact"},
+			rcptto: target.UserId(), timestamp: now}
+	}
+
+	// Tell the other user and the user's other sessions
+	globals.hub.route <- &ServerComMessage{
+		Pres:   &MsgServerPres{Topic: "me", What: "contact", Src: t.name},
+		rcptto: target.UserId()}
+	globals.hub.route <- &ServerComMessage{
+		Pres:   &MsgServerPres{Topic: "me", What: "contact", Src: target.UserId()},
+		rcptto: t.name}
+
+	sess.queueOut(NoErr(set.Id, set.Topic, now))
+	return nil
+}
+
+// contactRemoved stops exchanging presence with the removed contact unless the users have a p2p topic.
+func (t *Topic) contactRemoved(uid types.Uid) {
+	delete(t.contacts, uid)
+	owner := types.ParseUserId(t.name)
+	sub, err := store.Subs.Get(owner.P2PName(uid), owner)
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to check p2p subscription: %v", t.name, err)
+		return
+	}
+	if sub == nil || sub.IsDeleted() {
+		delete(t.perSubs, uid.UserId())
+	}
+}
+
+// replyGetContacts sends the contact list in response to get.contacts on 'me'.
+func (t *Topic) replyGetContacts(sess *Session, id string) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCat_Me {
+		sess.queueOut(ErrPermissionDenied(id, t.original(sess.uid), now))
+		return errors.New("contacts requested outside of 'me'")
+	}
+
+	contacts, err := store.Contacts.GetAll(sess.uid)
+	if err != nil {
+		sess.queueOut(ErrUnknown(id, "me", now))
+		return err
+	}
+
+	var uids []types.Uid
+	for i := range contacts {
+		uids = append(uids, types.ParseUid(contacts[i].Contact))
+	}
+	publics := make(map[string]interface{}, len(uids))
+	if len(uids) > 0 {
+		users, err := store.Users.GetAll(uids...)
+		if err != nil {
+			sess.queueOut(ErrUnknown(id, "me", now))
+			return err
+		}
+		for i := range users {
+			publics[users[i].Id] = users[i].Public
+		}
+	}
+
+	list := make([]MsgContact, 0, len(contacts))
+	for i := range contacts {
+		c := &contacts[i]
+		uid := types.ParseUid(c.Contact)
+		if c.Status == types.ContactReceived && t.blocked[uid] {
+			// Requests from blocked users are not shown
+			continue
+		}
+		mc := MsgContact{
+			User:    uid.UserId(),
+			Status:  contactStatusNames[c.Status],
+			Updated: c.UpdatedAt,
+			Public:  publics[c.Contact]}
+		if c.Status == types.ContactAccepted {
+			mc.Online = t.perSubs[mc.User].online
+		}
+		list = append(list, mc)
+	}
+
+	if len(list) == 0 {
+		sess.queueOut(NoErr(id, "me", now))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{Id: id, Topic: "me", Timestamp: &now,
+		Contacts: list}})
+	return nil
+}
@@ -9,6 +9,7 @@ package main
  *****************************************************************************/
 
 import (
+	"context"
 	"net/http"
 	"strings"
 	"time"
@@ -33,11 +34,26 @@ type MsgBrowseOpts struct {
 	BeforeTs *time.Time `json:"until,omitempty"`
 	// Limit the number of messages loaded
 	Limit uint `json:"limit,omitempty"`
+	// Load only messages which contain this text
+	Query string `json:"query,omitempty"`
+	// Load only replies in the thread started by the message with this seq id
+	Thread int `json:"thread,omitempty"`
+	// Load only messages which mention the requester
+	Mentions bool `json:"mentions,omitempty"`
 }
 
 type MsgGetOpts struct {
 	IfModifiedSince *time.Time `json:"ims,omitempty"`
 	Limit           int        `json:"limit,omitempty"`
+	// Return subscriptions after this user ID, for paged listings of large topics, or the next page of 'fnd'
+	// results after this cursor
+	After string `json:"after,omitempty"`
+}
+
+// MsgGetProfiles: C2S in get.profiles, request for Public of the topic's members
+type MsgGetProfiles struct {
+	// IDs of the users
+	Users []string `json:"users"`
 }
 
 type MsgGetQuery struct {
@@ -49,6 +65,47 @@ type MsgGetQuery struct {
 	Sub *MsgGetOpts `json:"sub,omitempty"`
 	// Parameters of "data" request
 	Data *MsgBrowseOpts `json:"data,omitempty"`
+	// Parameters of "inline" request
+	Inline *MsgInlineQuery `json:"inline,omitempty"`
+	// Parameters of "profiles" request
+	Profiles *MsgGetProfiles `json:"profiles,omitempty"`
+}
+
+// MsgCardEvent is a user's interaction with an element of an interactive card
+type MsgCardEvent struct {
+	// Topic and ID of the card as seen by the author, set by the server
+	Topic string `json:"topic,omitempty"`
+	SeqId int    `json:"seq,omitempty"`
+	// ID of the element, e.g. a button
+	Elem string `json:"elem"`
+	// Option chosen in a select element
+	Value string `json:"value,omitempty"`
+}
+
+// MsgInlineQuery is a query to an inline bot
+type MsgInlineQuery struct {
+	// ID of the query assigned by the server, set when the query is delivered to the bot
+	Id string `json:"id,omitempty"`
+	// Bot being queried, e.g. "usrAbCd"
+	Bot string `json:"bot,omitempty"`
+	// Topic where the query was made as seen by the bot, set by the server
+	Topic string `json:"topic,omitempty"`
+	// Text of the query
+	Query string `json:"query"`
+	// Opaque value returned by the bot in 'next' to fetch more results
+	Offset string `json:"offset,omitempty"`
+}
+
+// MsgInlineResults is the bot's answer to an inline query
+type MsgInlineResults struct {
+	// ID of the query being answered
+	Id    string `json:"id,omitempty"`
+	Bot   string `json:"bot,omitempty"`
+	Query string `json:"query,omitempty"`
+	// Results in bot-specific format
+	Results []interface{} `json:"results"`
+	// Offset of the next page of results, empty if there are no more results
+	Next string `json:"next,omitempty"`
 }
 
 // MsgSetSub: payload in set.sub request to update current subscription or invite another user, {sub.what} == "sub"
@@ -60,11 +117,115 @@ type MsgSetSub struct {
 	Mode string `json:"mode,omitempty"`
 }
 
+// MsgWebhook: webhook of a topic in set.desc and meta.desc
+type MsgWebhook struct {
+	// URL which receives the events, empty to remove the webhook
+	Url string `json:"url"`
+	// Secret for signing the requests, never reported back
+	Secret string `json:"secret,omitempty"`
+	// Events to send: "message", "member", "delete"; all if empty
+	Events []string `json:"events,omitempty"`
+}
+
 // MsgSetDesc: C2S in set.what == "desc" and sub.init message
 type MsgSetDesc struct {
 	DefaultAcs *MsgDefaultAcsMode `json:"defacs,omitempty"` // default access mode
 	Public     interface{}        `json:"public,omitempty"`
 	Private    interface{}        `json:"private,omitempty"` // Per-subscription private data
+	// Publish topic history on the web (group topics only, owner only)
+	WebView *bool `json:"web,omitempty"`
+	// Let search engines index the published history (group topics only, owner only)
+	WebIndex *bool `json:"webindex,omitempty"`
+	// Periodic digest: "daily", "weekly" or "" to disable (group topics only, owner only)
+	Digest *string `json:"digest,omitempty"`
+	// Delete messages this many seconds after they were sent, 0 to keep them (group topics: owner only,
+	// p2p topics: either participant)
+	Ttl *int `json:"ttl,omitempty"`
+	// Maximum number of members, 0 for the server default (group topics only, root only)
+	MaxMembers *int `json:"maxmem,omitempty"`
+	// Webhook which receives the events of the topic (group topics only, owner only)
+	Webhook *MsgWebhook `json:"webhook,omitempty"`
+}
+
+// MsgSetRemind: C2S in set.remind, request to remind the user about a message
+type MsgSetRemind struct {
+	// ID of the message to remind about
+	SeqId int `json:"seq"`
+	// When to deliver the reminder. Missing value cancels the reminder.
+	At *time.Time `json:"at,omitempty"`
+}
+
+// MsgSetAction: C2S in set.action, user's response to an actionable message
+type MsgSetAction struct {
+	// ID of the actionable message
+	SeqId int `json:"seq"`
+	// Response chosen by the user, e.g. "pay" or "decline"
+	Response string `json:"resp"`
+	// Optional response-specific data
+	Data interface{} `json:"data,omitempty"`
+}
+
+// MsgSetInvite: C2S in set.invite, request to issue an invite link or to revoke the issued ones
+type MsgSetInvite struct {
+	// Access mode given to users who join with the link, default access of the topic if missing
+	Mode string `json:"mode,omitempty"`
+	// Lifetime of the link in seconds, 0 for the maximum allowed
+	Expires int `json:"expires,omitempty"`
+	// Revoke all links issued earlier
+	Revoke bool `json:"revoke,omitempty"`
+}
+
+// MsgSetTransfer: C2S in set.transfer, a step of the ownership transfer
+type MsgSetTransfer struct {
+	// "offer", "cancel" by the owner; "accept", "decline" by the member the topic is offered to
+	What string `json:"what"`
+	// Member to offer the topic to, "offer" only
+	User string `json:"user,omitempty"`
+}
+
+// MsgSetBlock: C2S in set.block on 'me', a change of the user's block list
+type MsgSetBlock struct {
+	// User to block or unblock
+	User string `json:"user"`
+	// true to block the user, false to unblock
+	Blocked bool `json:"blocked"`
+}
+
+// MsgSetContact: C2S in set.contact on 'me', a change of the user's contact list
+type MsgSetContact struct {
+	// The other user
+	User string `json:"user"`
+	// "add", "accept" or "remove"
+	What string `json:"what"`
+}
+
+// MsgPrivacy: C2S in set.privacy and S2C in meta.desc on 'me', who sees the user's presence
+type MsgPrivacy struct {
+	// Appear offline to everyone
+	Invisible bool `json:"invisible,omitempty"`
+	// Hide the time when the user was last seen
+	HideLastSeen bool `json:"hideseen,omitempty"`
+	// Show presence to accepted contacts only
+	ContactsOnly bool `json:"contacts,omitempty"`
+}
+
+// MsgSetImpersonate: C2S in set.impersonate on 'me', user's consent to impersonation by support staff
+type MsgSetImpersonate struct {
+	// Number of seconds the consent is valid for, 0 to withdraw it
+	Allow int `json:"allow"`
+}
+
+// MsgNotifyPrefs: C2S in set.notify and S2C in meta.sub, user's preferences of push notifications for the topic
+type MsgNotifyPrefs struct {
+	// No notifications at all
+	Muted bool `json:"muted,omitempty"`
+	// Notifications only for messages which mention the user
+	MentionsOnly bool `json:"mentions,omitempty"`
+	// Quiet hours "HH:MM" in the time zone, e.g. "22:00" - "07:30"
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+	// IANA time zone name, e.g. "Europe/Berlin", UTC by default
+	TimeZone string `json:"tz,omitempty"`
 }
 
 type MsgSetQuery struct {
@@ -72,6 +233,24 @@ type MsgSetQuery struct {
 	Desc *MsgSetDesc `json:"desc,omitempty"`
 	// Subscription parameters
 	Sub *MsgSetSub `json:"sub,omitempty"`
+	// Message reminder
+	Remind *MsgSetRemind `json:"remind,omitempty"`
+	// Response to an actionable message
+	Action *MsgSetAction `json:"action,omitempty"`
+	// Preferences of push notifications, replace the current ones
+	Notify *MsgNotifyPrefs `json:"notify,omitempty"`
+	// Request for an invite link
+	Invite *MsgSetInvite `json:"invite,omitempty"`
+	// Step of the ownership transfer
+	Transfer *MsgSetTransfer `json:"transfer,omitempty"`
+	// Consent to impersonation, 'me' only
+	Impersonate *MsgSetImpersonate `json:"impersonate,omitempty"`
+	// Change of the block list, 'me' only
+	Block *MsgSetBlock `json:"block,omitempty"`
+	// Change of the contact list, 'me' only
+	Contact *MsgSetContact `json:"contact,omitempty"`
+	// Presence privacy settings, replace the current ones, 'me' only
+	Privacy *MsgPrivacy `json:"privacy,omitempty"`
 }
 
 // fndXXX.private is set to this object.
@@ -94,6 +273,8 @@ type MsgClientHi struct {
 	DeviceID string `json:"dev,omitempty"`
 	// Human language of the connected device
 	Lang string `json:"lang,omitempty"`
+	// Platform of the device: "ios", "android" or "web"
+	Platform string `json:"platf,omitempty"`
 }
 
 // User creation message {acc}
@@ -134,12 +315,30 @@ type MsgClientSub struct {
 
 	// mirrors {get}
 	Get *MsgGetQuery `json:"get,omitempty"`
+
+	// Invite link token for joining the topic
+	Invite string `json:"invite,omitempty"`
+
+	// Name of the template of a new group topic or channel
+	Template string `json:"template,omitempty"`
 }
 
 const (
 	constMsgMetaDesc = 1 << iota
 	constMsgMetaSub
 	constMsgMetaData
+	constMsgMetaRemind
+	constMsgMetaAction
+	constMsgMetaNotify
+	constMsgMetaInvite
+	constMsgMetaProfiles
+	constMsgMetaTransfer
+	constMsgMetaImpersonate
+	constMsgMetaSessions
+	constMsgMetaBlock
+	constMsgMetaContact
+	constMsgMetaContacts
+	constMsgMetaPrivacy
 	constMsgDelTopic
 	constMsgDelMsg
 	constMsgDelSub
@@ -156,6 +355,12 @@ func parseMsgClientMeta(params string) int {
 			bits |= constMsgMetaSub
 		case "data":
 			bits |= constMsgMetaData
+		case "profiles":
+			bits |= constMsgMetaProfiles
+		case "sessions":
+			bits |= constMsgMetaSessions
+		case "contacts":
+			bits |= constMsgMetaContacts
 		default:
 			// ignore
 		}
@@ -190,6 +395,8 @@ type MsgClientLeave struct {
 	Id    string `json:"id,omitempty"`
 	Topic string `json:"topic"`
 	Unsub bool   `json:unsub,omitempty`
+	// Leave all topics: "*", or all topics of one kind: "grp", "chn", "p2p"; sent to 'me'
+	All string `json:"all,omitempty"`
 }
 
 // MsgClientPub is client's request to publish data to topic subscribers {pub}
@@ -199,6 +406,14 @@ type MsgClientPub struct {
 	NoEcho  bool              `json:"noecho,omitempty"`
 	Head    map[string]string `json:"head,omitempty"`
 	Content interface{}       `json:"content"`
+	// SeqId of the sender's earlier message to replace with this one
+	Replace int `json:"replace,omitempty"`
+	// SeqId of the first message of the thread to reply in
+	Thread int `json:"thread,omitempty"`
+	// Deliver the message at this time instead of now
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	// IDs of mentioned users, replace head.mentions
+	Mentions []string `json:"mentions,omitempty"`
 }
 
 // Query topic state {get}
@@ -230,16 +445,34 @@ type MsgClientDel struct {
 	User string `json:"user,omitempty"`
 	// Request to hard-delete messages for all users, if such option is available.
 	Hard bool `json:"hard,omitempty"`
+	// Ban the user whose subscription is deleted from subscribing again
+	Ban bool `json:"ban,omitempty"`
 }
 
 // MsgClientNote is a client-generated notification for topic subscribers
 type MsgClientNote struct {
 	// There is no Id -- server will not akn {ping} packets, they are "fire and forget"
 	Topic string `json:"topic"`
-	// what is being reported: "recv" - message received, "read" - message read, "kp" - typing notification
+	// what is being reported: "recv" - message received, "read" - message read, "kp" - typing notification,
+	// "check" - checklist item toggled, "rsvp" - response to an event, "answer" - answer to an inline query,
+	// "card" - interaction with a card, "edit" - new content of a card, "react", "unreact" - reaction
+	// to a message added or taken back, "pin", "unpin" - message pinned or unpinned
 	What string `json:"what"`
 	// Server-issued message ID being reported
 	SeqId int `json:"seq,omitempty"`
+	// "check": index of the checklist item and its new state
+	Item *int  `json:"item,omitempty"`
+	Done *bool `json:"done,omitempty"`
+	// "rsvp": "yes", "no", "maybe" or empty to withdraw the response
+	Rsvp string `json:"rsvp,omitempty"`
+	// "answer": bot's answer to an inline query
+	Answer *MsgInlineResults `json:"answer,omitempty"`
+	// "card": element of the card the user interacted with
+	Card *MsgCardEvent `json:"card,omitempty"`
+	// "edit": new content of the card
+	Content interface{} `json:"content,omitempty"`
+	// "react", "unreact": the reaction, usually an emoji
+	React string `json:"react,omitempty"`
 }
 
 type ClientComMessage struct {
@@ -257,6 +490,10 @@ type ClientComMessage struct {
 	// from: userid as string
 	from      string
 	timestamp time.Time
+	// Trace context of the request
+	ctx context.Context
+	// Server-assigned ID of the request, see reqid.go
+	reqId string
 }
 
 /////////////////////////////////////////////////////////////
@@ -297,6 +534,34 @@ type MsgTopicDesc struct {
 	Public    interface{} `json:"public,omitempty"`
 	// Per-subscription private data
 	Private interface{} `json:"private,omitempty"`
+	// Topic history is published on the web
+	WebView bool `json:"web,omitempty"`
+	// Published history may be indexed by search engines
+	WebIndex bool `json:"webindex,omitempty"`
+	// Periodic digest
+	Digest string `json:"digest,omitempty"`
+	// Messages are deleted this many seconds after they were sent
+	Ttl int `json:"ttl,omitempty"`
+	// Maximum number of members, 0 if unlimited
+	MaxMembers int `json:"maxmem,omitempty"`
+	// Webhook of the topic without the secret, reported to the owner
+	Webhook *MsgWebhook `json:"webhook,omitempty"`
+	// IDs of pinned messages in the order they were pinned
+	Pinned []int `json:"pinned,omitempty"`
+	// IDs of users banned from the topic, reported to admins and moderators
+	Banned []string `json:"banned,omitempty"`
+	// IDs of users blocked by the user, 'me' only
+	Blocked []string `json:"blocked,omitempty"`
+	// Presence privacy settings, 'me' only
+	Privacy *MsgPrivacy `json:"privacy,omitempty"`
+	// Member the ownership is offered to, shown to the owner and to the member
+	Transfer string `json:"transfer,omitempty"`
+	// Tags given to the topic by its template
+	Tags []string `json:"tags,omitempty"`
+	// Reference to the entity of an external system, reported to admins
+	Ref string `json:"ref,omitempty"`
+	// Hash of the last message when the history is chained
+	Chain string `json:"chain,omitempty"`
 }
 
 // MsgTopicSub: topic subscription details, sent in Meta message
@@ -322,6 +587,8 @@ type MsgTopicSub struct {
 	Public interface{} `json:"public,omitempty"`
 	// User's own private data per topic
 	Private interface{} `json:"private,omitempty"`
+	// User's own preferences of push notifications
+	Notify *MsgNotifyPrefs `json:"notify,omitempty"`
 
 	// Response to non-'me' topic
 
@@ -349,8 +616,12 @@ type MsgServerCtrl struct {
 	Topic  string      `json:"topic,omitempty"`
 	Params interface{} `json:"params,omitempty"`
 
-	Code      int       `json:"code"`
-	Text      string    `json:"text,omitempty"`
+	Code int    `json:"code"`
+	Text string `json:"text,omitempty"`
+	// Machine-readable error code, see errcodes.go
+	Err string `json:"err,omitempty"`
+	// Server-assigned ID of the request, see reqid.go
+	ReqId     string    `json:"reqid,omitempty"`
 	Timestamp time.Time `json:"ts"`
 }
 
@@ -380,9 +651,14 @@ type MsgServerData struct {
 	From      string            `json:"from,omitempty"`
 	Timestamp time.Time         `json:"ts"`
 	DeletedAt *time.Time        `json:"deleted,omitempty"`
+	EditedAt  *time.Time        `json:"edited,omitempty"`
 	SeqId     int               `json:"seq"`
+	Thread    int               `json:"thread,omitempty"`
 	Head      map[string]string `json:"head,omitempty"`
 	Content   interface{}       `json:"content"`
+	// Counts of reactions to the message and the reactions of the receiving user
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Reacted   []string       `json:"reacted,omitempty"`
 }
 
 type MsgServerPres struct {
@@ -414,8 +690,42 @@ type MsgServerMeta struct {
 
 	Timestamp *time.Time `json:"ts,omitempty"`
 
-	Desc *MsgTopicDesc `json:"desc,omitempty"` // Topic description
-	Sub  []MsgTopicSub `json:"sub,omitempty"`  // Subscriptions as an array of objects
+	Desc   *MsgTopicDesc     `json:"desc,omitempty"`   // Topic description
+	Sub    []MsgTopicSub     `json:"sub,omitempty"`    // Subscriptions as an array of objects
+	Inline *MsgInlineResults `json:"inline,omitempty"` // Results of an inline bot query
+
+	Profiles []MsgProfile     `json:"profiles,omitempty"` // Public of the topic's members
+	Next     string           `json:"next,omitempty"`     // Cursor of the next page of subscriptions
+	Sessions []MsgSessionInfo `json:"sessions,omitempty"` // Sessions of the user attached to 'me'
+	Contacts []MsgContact     `json:"contacts,omitempty"` // Contact list of the user
+}
+
+// MsgProfile: Public of one user, sent in Meta message
+type MsgProfile struct {
+	User   string      `json:"user"`
+	Public interface{} `json:"public,omitempty"`
+}
+
+// MsgSessionInfo: one session of the user, sent in Meta message
+type MsgSessionInfo struct {
+	UserAgent  string `json:"ua,omitempty"`
+	RemoteAddr string `json:"ip,omitempty"`
+	// The session which requested the list
+	Current bool `json:"current,omitempty"`
+	// Support admin who opened the read-only session on behalf of the user
+	Impersonator string     `json:"impersonator,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+}
+
+// MsgContact: an entry of the contact list, sent in Meta message
+type MsgContact struct {
+	User string `json:"user"`
+	// "sent", "received" or "accepted"
+	Status  string    `json:"status"`
+	Updated time.Time `json:"updated"`
+	// Online status, accepted contacts only
+	Online bool        `json:"online,omitempty"`
+	Public interface{} `json:"public,omitempty"`
 }
 
 // MsgServerInfo is the server-side copy of MsgClientNote with From added
@@ -423,10 +733,35 @@ type MsgServerInfo struct {
 	Topic string `json:"topic"`
 	// ID of the user who originated the message
 	From string `json:"from"`
-	// what is being reported: "rcpt" - message received, "read" - message read, "kp" - typing notification
+	// what is being reported: "rcpt" - message received, "read" - message read, "kp" - typing notification,
+	// "check" - checklist item toggled, "rsvp" - response to an event, "query" - inline query to a bot,
+	// "card" - interaction with a card sent to its author, "edit" - card updated by its author,
+	// "react", "unreact" - reaction to a message added or taken back, "pin", "unpin" - message pinned
+	// or unpinned; "impersonate" - admin asks the user for consent to impersonation;
+	// "expire" - internal request to delete expired messages, never sent to clients;
+	// "provision" - internal notice that the topic was changed by provisioning, never sent to clients;
+	// "announce" - service announcement from the operator, sent to 'me'
 	What string `json:"what"`
 	// Server-issued message ID being reported
 	SeqId int `json:"seq,omitempty"`
+	// "check": index of the checklist item and its new state
+	Item *int  `json:"item,omitempty"`
+	Done *bool `json:"done,omitempty"`
+	// "rsvp": user's response to the event, empty if withdrawn
+	Rsvp string `json:"rsvp,omitempty"`
+	// "query": inline query addressed to the bot
+	Query *MsgInlineQuery `json:"query,omitempty"`
+	// "card": the card and the element the user interacted with
+	Card *MsgCardEvent `json:"card,omitempty"`
+	// "edit": new content of the card; "announce": content of the announcement
+	Content interface{} `json:"content,omitempty"`
+	// "react", "unreact": the reaction and the updated counts of all reactions to the message
+	React     string         `json:"react,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	// "pin", "unpin": IDs of the messages pinned in the topic after the change
+	Pinned []int `json:"pinned,omitempty"`
+	// "impersonate": reason given by the admin who asks to impersonate the user
+	Reason string `json:"reason,omitempty"`
 }
 
 type ServerComMessage struct {
@@ -442,10 +777,22 @@ type ServerComMessage struct {
 	sessFrom *Session
 	// MsgServerData has no Id field, copying it here for use in {ctrl} aknowledgements
 	id string
+	// SeqId of the message replaced by this {data}, 0 for new messages
+	replace int
+	// Time of scheduled delivery, zero for messages delivered now
+	deliverAt time.Time
+	// The sender of a {data} without sessFrom must be checked like the sender of a {pub}
+	checkFrom bool
 	// timestamp for consistency of timestamps in {ctrl} messages
 	timestamp time.Time
+	// Time when the {pub} was received by the session, for measuring latency
+	received time.Time
 	// Should the packet be sent to the original sessions? SessionIDs to skip.
 	skipSid string
+	// Trace context of the request which produced the message
+	ctx context.Context
+	// ID of the request which produced the message
+	reqId string
 }
 
 // Generators of error messages
@@ -498,7 +845,27 @@ func NoErrShutdown(ts time.Time) *ServerComMessage {
 	return msg
 }
 
+// NoErrTerminated tells the client that the session was terminated by the operator.
+func NoErrTerminated(ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusResetContent, // 205
+		Text:      "terminated",
+		Timestamp: ts}}
+	return msg
+}
+
 // 3xx
+// InfoSecondFactor tells the client to complete the login with a one-time code.
+func InfoSecondFactor(id string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusMultipleChoices, // 300
+		Text:      "second factor required",
+		Params:    map[string]interface{}{"scheme": "totp"},
+		Timestamp: ts}}
+	return msg
+}
+
 func InfoAlreadySubscribed(id, topic string, ts time.Time) *ServerComMessage {
 	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
 		Id:        id,
@@ -529,6 +896,16 @@ func InfoNoAction(id, topic string, ts time.Time) *ServerComMessage {
 	return msg
 }
 
+// InfoRedirect tells the client to reconnect to another server, e.g. after failover to another region.
+func InfoRedirect(url string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusTemporaryRedirect, // 307
+		Text:      "redirect",
+		Params:    map[string]interface{}{"url": url},
+		Timestamp: ts}}
+	return msg
+}
+
 func InfoNotModified(id, topic string, ts time.Time) *ServerComMessage {
 	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
 		Id:        id,
@@ -545,6 +922,7 @@ func ErrMalformed(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusBadRequest, // 400
 		Text:      "malformed",
+		Err:       ERR_MALFORMED,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -555,6 +933,7 @@ func ErrAuthRequired(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusUnauthorized, // 401
 		Text:      "authentication required",
+		Err:       ERR_AUTH_REQUIRED,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -565,6 +944,19 @@ func ErrAuthFailed(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusUnauthorized, // 401
 		Text:      "authentication failed",
+		Err:       ERR_AUTH_FAILED,
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+// ErrAuthExpired tells the client that the token or the credentials expired.
+func ErrAuthExpired(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusUnauthorized, // 401
+		Text:      "authentication expired",
+		Err:       ERR_AUTH_EXPIRED,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -575,6 +967,7 @@ func ErrAuthUnknownScheme(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusUnauthorized, // 401
 		Text:      "unknown authentication scheme",
+		Err:       ERR_AUTH_SCHEME,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -585,6 +978,7 @@ func ErrPermissionDenied(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusForbidden, // 403
 		Text:      "permission denied",
+		Err:       ERR_PERMISSION,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -595,6 +989,7 @@ func ErrTopicNotFound(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusNotFound,
 		Text:      "topic not found", // 404
+		Err:       ERR_TOPIC_NOT_FOUND,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -605,6 +1000,29 @@ func ErrUserNotFound(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusNotFound, // 404
 		Text:      "user not found or offline",
+		Err:       ERR_USER_NOT_FOUND,
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+func ErrNotFound(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusNotFound, // 404
+		Text:      "not found",
+		Err:       ERR_NOT_FOUND,
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+func ErrOperationNotAllowed(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusMethodNotAllowed, // 405
+		Text:      "operation or method not allowed",
+		Err:       ERR_NOT_ALLOWED,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -615,6 +1033,7 @@ func ErrAlreadyAuthenticated(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusConflict, // 409
 		Text:      "already authenticated",
+		Err:       ERR_AUTH_ALREADY,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -625,6 +1044,7 @@ func ErrDuplicateCredential(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusConflict, // 409
 		Text:      "duplicate credential",
+		Err:       ERR_AUTH_DUPLICATE,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -635,6 +1055,7 @@ func ErrAttachFirst(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusConflict, // 409
 		Text:      "must attach first",
+		Err:       ERR_ATTACH_FIRST,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -645,6 +1066,7 @@ func ErrAlreadyExists(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusConflict, // 409
 		Text:      "already exists",
+		Err:       ERR_ALREADY_EXISTS,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -655,6 +1077,7 @@ func ErrCommandOutOfSequence(id, unused string, ts time.Time) *ServerComMessage
 		Id:        id,
 		Code:      http.StatusConflict, // 409
 		Text:      "command out of sequence",
+		Err:       ERR_OUT_OF_SEQUENCE,
 		Timestamp: ts}}
 	return msg
 }
@@ -664,6 +1087,18 @@ func ErrGone(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusGone, // 410
 		Text:      "gone",
+		Err:       ERR_GONE,
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+func ErrTooLarge(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusRequestEntityTooLarge, // 413
+		Text:      "too large",
+		Err:       ERR_QUOTA_SIZE,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -674,7 +1109,25 @@ func ErrPolicy(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusUnprocessableEntity, // 422
 		Text:      "policy violation",
+		Err:       ERR_POLICY,
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+// ErrAccountState tells the user that the account is not active and why.
+func ErrAccountState(id, topic string, ts time.Time, state int, reason string) *ServerComMessage {
+	params := map[string]interface{}{"state": userStateName(state)}
+	if reason != "" {
+		params["reason"] = reason
+	}
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusForbidden, // 403
+		Text:      "account " + userStateName(state),
+		Err:       userStateErrCode(state),
 		Topic:     topic,
+		Params:    params,
 		Timestamp: ts}}
 	return msg
 }
@@ -684,16 +1137,44 @@ func ErrLocked(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusLocked, // 423
 		Text:      "locked",
+		Err:       ERR_TOPIC_FROZEN,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
 }
 
+// ErrTooManyRequests tells the client to retry after the given time.
+func ErrTooManyRequests(id, topic string, ts time.Time, retry time.Duration) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusTooManyRequests, // 429
+		Text:      "too many requests",
+		Err:       ERR_RATE_LIMITED,
+		Topic:     topic,
+		Params:    map[string]interface{}{"retry_after": int((retry + time.Second - 1) / time.Second)},
+		Timestamp: ts}}
+	return msg
+}
+
+// ErrTopicFull tells the client that the topic has as many members as allowed.
+func ErrTopicFull(id, topic string, ts time.Time, limit int) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusConflict, // 409
+		Text:      "topic is full",
+		Err:       ERR_QUOTA_MEMBERS,
+		Topic:     topic,
+		Params:    map[string]interface{}{"limit": limit},
+		Timestamp: ts}}
+	return msg
+}
+
 func ErrUnknown(id, topic string, ts time.Time) *ServerComMessage {
 	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
 		Id:        id,
 		Code:      http.StatusInternalServerError, // 500
 		Text:      "internal error",
+		Err:       ERR_INTERNAL,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -704,6 +1185,7 @@ func ErrNotImplemented(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusNotImplemented, // 501
 		Text:      "not implemented",
+		Err:       ERR_NOT_IMPLEMENTED,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -714,6 +1196,41 @@ func ErrClusterNodeUnreachable(id, topic string, ts time.Time) *ServerComMessage
 		Id:        id,
 		Code:      http.StatusBadGateway, // 502
 		Text:      "unreachable",
+		Err:       ERR_NODE_UNREACHABLE,
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+func ErrServiceUnavailable(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusServiceUnavailable, // 503
+		Text:      "service unavailable",
+		Err:       ERR_UNAVAILABLE,
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+// ErrStoreUnavailable tells the client that the database cannot be reached.
+func ErrStoreUnavailable(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusServiceUnavailable, // 503
+		Text:      "database unavailable",
+		Err:       ERR_STORE_UNAVAILABLE,
+		Topic:     topic,
+		Timestamp: ts}}
+	return msg
+}
+
+func ErrTimeout(id, topic string, ts time.Time) *ServerComMessage {
+	msg := &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusGatewayTimeout, // 504
+		Text:      "timeout",
+		Err:       ERR_TIMEOUT,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -724,6 +1241,7 @@ func ErrVersionNotSupported(id, topic string, ts time.Time) *ServerComMessage {
 		Id:        id,
 		Code:      http.StatusHTTPVersionNotSupported, // 505
 		Text:      "version not supported",
+		Err:       ERR_VERSION,
 		Topic:     topic,
 		Timestamp: ts}}
 	return msg
@@ -7,8 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
-	"log"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +18,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/store"
 	t "github.com/tinode/chat/server/store/types"
 )
@@ -46,6 +47,35 @@ type SubscriptionKey struct {
 	Id string
 }
 
+type FileDefKey struct {
+	Id string
+}
+
+type ReminderKey struct {
+	Id string
+}
+
+type ScheduledKey struct {
+	Id string
+}
+
+type CredentialKey struct {
+	Id string
+}
+
+type ClientLogKey struct {
+	Id string
+}
+
+type OperationKey struct {
+	Id string
+}
+
+type ContactKey struct {
+	User    string
+	Contact string
+}
+
 type MessageKey struct {
 	Topic string
 	SeqId int
@@ -58,38 +88,36 @@ var (
 	TOPICS_TABLE           string = "TinodeTopics"
 	SUBSCRIPTIONS_TABLE    string = "TinodeSubscriptions"
 	MESSAGES_TABLE         string = "TinodeMessages"
+	FILEUPLOADS_TABLE      string = "TinodeFileUploads"
+	REMINDERS_TABLE        string = "TinodeReminders"
+	SCHEDULED_TABLE        string = "TinodeScheduled"
+	CREDENTIALS_TABLE      string = "TinodeCredentials"
+	CLIENTLOGS_TABLE       string = "TinodeClientLogs"
+	CONTACTS_TABLE         string = "TinodeContacts"
+	JOURNAL_TABLE          string = "TinodeJournal"
 	MAX_RESULTS            int    = 100
 	MAX_DELETE_ITEMS       int    = 25
-	MAX_MESSAGES_RETRIEVED int    = 100 // max messages retrieved in single get messages operation
+	MAX_MESSAGES_RETRIEVED int    = 100  // max messages retrieved in single get messages operation
+	MAX_MESSAGES_SEARCHED  int    = 5000 // max messages examined in single search operation
 
 	EXPIRE_DURATION_MESSAGE_GROUP int = 604800   // 1 week
 	EXPIRE_DURATION_MESSAGE_ME    int = 2592000  // 1 month
 	EXPIRE_DURATION_MESSAGE_P2P   int = 31536000 // 1 year
 
 	SELF_TALK_SERVICE_USER_ID t.Uid = 5
-	DEBUG_MODE                bool
 )
 
 const (
 	MAX_BATCH_GET_ITEM   int = 100
 	MAX_FIND_SUBS_RESULT int = 100
-	MAX_DEVICES_PER_USER int = 100
 	MAX_USERS_TO_FETCH   int = 100
-)
-
-type ErrorLogger struct {
-	Tag string
-}
 
-func (e *ErrorLogger) LogError(err error) {
-	log.Printf("[%v] %v\n", e.Tag, err)
-}
+	// Initial and maximum delay before retrying unprocessed keys of device queries
+	DEVICE_RETRY_DELAY     = 50 * time.Millisecond
+	DEVICE_RETRY_MAX_DELAY = 2 * time.Second
+)
 
-func logDebugMessage(msg string) {
-	if DEBUG_MODE {
-		log.Println("[RDebug] " + msg)
-	}
-}
+var logger = logs.New("dynamodb")
 
 type Settings struct {
 	Region            string      `json:"region"`
@@ -98,7 +126,15 @@ type Settings struct {
 	SelfChatServiceId uint64      `json:"self_chat_service_id"`
 	TableConfig       TableConfig `json:"table_config"`
 	IndexConfig       IndexConfig `json:"index_config"`
-	DebugMode         bool        `json:"debug_mode"`
+	// Message retention in seconds by topic category, 0 means keep forever
+	MessageRetention MessageRetentionSettings `json:"message_retention"`
+}
+
+// Missing values keep the defaults EXPIRE_DURATION_MESSAGE_*
+type MessageRetentionSettings struct {
+	Me  *int `json:"me"`
+	P2P *int `json:"p2p"`
+	Grp *int `json:"grp"`
 }
 
 type ProvisionedThroughputSettings struct {
@@ -118,6 +154,13 @@ type TableConfig struct {
 	Topics        TableDetailSettings `json:"topics"`
 	Subscriptions TableDetailSettings `json:"subscriptions"`
 	Messages      TableDetailSettings `json:"messages"`
+	FileUploads   TableDetailSettings `json:"fileuploads"`
+	Reminders     TableDetailSettings `json:"reminders"`
+	Scheduled     TableDetailSettings `json:"scheduled"`
+	Credentials   TableDetailSettings `json:"credentials"`
+	ClientLogs    TableDetailSettings `json:"clientlogs"`
+	Contacts      TableDetailSettings `json:"contacts"`
+	Journal       TableDetailSettings `json:"journal"`
 }
 
 type IndexDetailSettings struct {
@@ -129,6 +172,9 @@ type IndexConfig struct {
 	Source        IndexDetailSettings
 	UserUpdatedAt IndexDetailSettings
 	Topic         IndexDetailSettings
+	FileUser      IndexDetailSettings `json:"fileuser"`
+	Kind          IndexDetailSettings `json:"kind"`
+	ExternalId    IndexDetailSettings `json:"externalid"`
 }
 
 // represent all settings from config file
@@ -172,8 +218,37 @@ func (a *DynamoDBAdapter) Open(jsonstring string) error {
 	TOPICS_TABLE = settings.TableConfig.Topics.Name
 	SUBSCRIPTIONS_TABLE = settings.TableConfig.Subscriptions.Name
 	MESSAGES_TABLE = settings.TableConfig.Messages.Name
+	if settings.TableConfig.FileUploads.Name != "" {
+		FILEUPLOADS_TABLE = settings.TableConfig.FileUploads.Name
+	}
+	if settings.TableConfig.Reminders.Name != "" {
+		REMINDERS_TABLE = settings.TableConfig.Reminders.Name
+	}
+	if settings.TableConfig.Scheduled.Name != "" {
+		SCHEDULED_TABLE = settings.TableConfig.Scheduled.Name
+	}
+	if settings.TableConfig.Credentials.Name != "" {
+		CREDENTIALS_TABLE = settings.TableConfig.Credentials.Name
+	}
+	if settings.TableConfig.ClientLogs.Name != "" {
+		CLIENTLOGS_TABLE = settings.TableConfig.ClientLogs.Name
+	}
+	if settings.TableConfig.Contacts.Name != "" {
+		CONTACTS_TABLE = settings.TableConfig.Contacts.Name
+	}
+	if settings.TableConfig.Journal.Name != "" {
+		JOURNAL_TABLE = settings.TableConfig.Journal.Name
+	}
 	SELF_TALK_SERVICE_USER_ID = t.Uid(settings.SelfChatServiceId)
-	DEBUG_MODE = settings.DebugMode
+	if settings.MessageRetention.Me != nil {
+		EXPIRE_DURATION_MESSAGE_ME = *settings.MessageRetention.Me
+	}
+	if settings.MessageRetention.P2P != nil {
+		EXPIRE_DURATION_MESSAGE_P2P = *settings.MessageRetention.P2P
+	}
+	if settings.MessageRetention.Grp != nil {
+		EXPIRE_DURATION_MESSAGE_GROUP = *settings.MessageRetention.Grp
+	}
 
 	// initialize dynamodb connection
 	sess, err := session.NewSessionWithOptions(session.Options{
@@ -200,6 +275,11 @@ func (a *DynamoDBAdapter) IsOpen() bool {
 	return a.svc != nil
 }
 
+// ExpiresMessages implements adapter.Expirer: messages are deleted by the TTL of the table.
+func (a *DynamoDBAdapter) ExpiresMessages() bool {
+	return true
+}
+
 func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 
 	var err error
@@ -211,7 +291,7 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 		})
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
-				log.Println(err)
+				logger.Error(err)
 				return err
 			}
 		}
@@ -222,7 +302,7 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 		})
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
-				log.Println(err)
+				logger.Error(err)
 				return err
 			}
 		}
@@ -233,7 +313,7 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 		})
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
-				log.Println(err)
+				logger.Error(err)
 				return err
 			}
 		}
@@ -244,7 +324,7 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 		})
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
-				log.Println(err)
+				logger.Error(err)
 				return err
 			}
 		}
@@ -255,7 +335,7 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 		})
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
-				log.Println(err)
+				logger.Error(err)
 				return err
 			}
 		}
@@ -266,7 +346,84 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 		})
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
-				log.Println(err)
+				logger.Error(err)
+				return err
+			}
+		}
+
+		// delete file uploads table
+		_, err = a.svc.DeleteTable(&dynamodb.DeleteTableInput{
+			TableName: aws.String(FILEUPLOADS_TABLE),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
+				logger.Error(err)
+				return err
+			}
+		}
+
+		// delete reminders table
+		_, err = a.svc.DeleteTable(&dynamodb.DeleteTableInput{
+			TableName: aws.String(REMINDERS_TABLE),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
+				logger.Error(err)
+				return err
+			}
+		}
+
+		// delete scheduled messages table
+		_, err = a.svc.DeleteTable(&dynamodb.DeleteTableInput{
+			TableName: aws.String(SCHEDULED_TABLE),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
+				logger.Error(err)
+				return err
+			}
+		}
+
+		// delete credentials table
+		_, err = a.svc.DeleteTable(&dynamodb.DeleteTableInput{
+			TableName: aws.String(CREDENTIALS_TABLE),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
+				logger.Error(err)
+				return err
+			}
+		}
+
+		// delete client logs table
+		_, err = a.svc.DeleteTable(&dynamodb.DeleteTableInput{
+			TableName: aws.String(CLIENTLOGS_TABLE),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
+				logger.Error(err)
+				return err
+			}
+		}
+
+		// delete contacts table
+		_, err = a.svc.DeleteTable(&dynamodb.DeleteTableInput{
+			TableName: aws.String(CONTACTS_TABLE),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
+				logger.Error(err)
+				return err
+			}
+		}
+
+		// delete journal table
+		_, err = a.svc.DeleteTable(&dynamodb.DeleteTableInput{
+			TableName: aws.String(JOURNAL_TABLE),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); (ok && aerr.Code() != dynamodb.ErrCodeResourceNotFoundException) || !ok {
+				logger.Error(err)
 				return err
 			}
 		}
@@ -290,12 +447,33 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 		a.svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{
 			TableName: aws.String(MESSAGES_TABLE),
 		})
+		a.svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{
+			TableName: aws.String(FILEUPLOADS_TABLE),
+		})
+		a.svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{
+			TableName: aws.String(REMINDERS_TABLE),
+		})
+		a.svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{
+			TableName: aws.String(SCHEDULED_TABLE),
+		})
+		a.svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{
+			TableName: aws.String(CREDENTIALS_TABLE),
+		})
+		a.svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{
+			TableName: aws.String(CLIENTLOGS_TABLE),
+		})
+		a.svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{
+			TableName: aws.String(CONTACTS_TABLE),
+		})
+		a.svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{
+			TableName: aws.String(JOURNAL_TABLE),
+		})
 	}
 
 	var input *dynamodb.CreateTableInput
 
-	// create table with no secondary indexes
-	log.Printf("Creating table with no secondary indexes: %v, %v, %v", USERS_TABLE, TOPICS_TABLE, MESSAGES_TABLE)
+	// create tables which are waited for together
+	logger.Infof("Creating tables: %v, %v, %v", USERS_TABLE, TOPICS_TABLE, MESSAGES_TABLE)
 
 	// create users table
 	input = &dynamodb.CreateTableInput{
@@ -315,12 +493,31 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 			ReadCapacityUnits:  aws.Int64(settings.TableConfig.Users.ProvisionedThroughput.ReadCapacity),
 			WriteCapacityUnits: aws.Int64(settings.TableConfig.Users.ProvisionedThroughput.WriteCapacity),
 		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				// Sparse index: only items with an external ID are indexed
+				IndexName: aws.String("ExternalId"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{
+						AttributeName: aws.String("ExternalId"),
+						KeyType:       aws.String("HASH"),
+					},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType: aws.String("ALL"),
+				},
+				ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+					ReadCapacityUnits:  aws.Int64(settings.IndexConfig.ExternalId.ProvisionedThroughput.ReadCapacity),
+					WriteCapacityUnits: aws.Int64(settings.IndexConfig.ExternalId.ProvisionedThroughput.WriteCapacity),
+				},
+			},
+		},
 		TableName: aws.String(USERS_TABLE),
 	}
 	_, err = a.svc.CreateTable(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
-			log.Println(err)
+			logger.Error(err)
 			return err
 		}
 	}
@@ -343,12 +540,31 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 			ReadCapacityUnits:  aws.Int64(settings.TableConfig.Topics.ProvisionedThroughput.ReadCapacity),
 			WriteCapacityUnits: aws.Int64(settings.TableConfig.Topics.ProvisionedThroughput.WriteCapacity),
 		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				// Sparse index: only items with an external ID are indexed
+				IndexName: aws.String("ExternalId"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{
+						AttributeName: aws.String("ExternalId"),
+						KeyType:       aws.String("HASH"),
+					},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType: aws.String("ALL"),
+				},
+				ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+					ReadCapacityUnits:  aws.Int64(settings.IndexConfig.ExternalId.ProvisionedThroughput.ReadCapacity),
+					WriteCapacityUnits: aws.Int64(settings.IndexConfig.ExternalId.ProvisionedThroughput.WriteCapacity),
+				},
+			},
+		},
 		TableName: aws.String(TOPICS_TABLE),
 	}
 	_, err = a.svc.CreateTable(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
-			log.Println(err)
+			logger.Error(err)
 			return err
 		}
 	}
@@ -384,7 +600,7 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 	_, err = a.svc.CreateTable(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
-			log.Println(err)
+			logger.Error(err)
 			return err
 		}
 	}
@@ -393,15 +609,15 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
 		TableName: aws.String(USERS_TABLE),
 	})
-	log.Printf("%v table created", USERS_TABLE)
+	logger.Infof("%v table created", USERS_TABLE)
 	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
 		TableName: aws.String(TOPICS_TABLE),
 	})
-	log.Printf("%v table created", TOPICS_TABLE)
+	logger.Infof("%v table created", TOPICS_TABLE)
 	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
 		TableName: aws.String(MESSAGES_TABLE),
 	})
-	log.Printf("%v table created", MESSAGES_TABLE)
+	logger.Infof("%v table created", MESSAGES_TABLE)
 
 	// only set TTL field if it is on online mode
 	if len(settings.Profile) > 0 {
@@ -414,14 +630,14 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 			},
 		})
 		if err != nil && !strings.Contains(err.Error(), "TimeToLive is already enabled") {
-			log.Println(err)
+			logger.Error(err)
 			return err
 		}
-		log.Printf("%v ttl field set to active", MESSAGES_TABLE)
+		logger.Infof("%v ttl field set to active", MESSAGES_TABLE)
 	}
 
 	// create table with secondary indexes
-	log.Printf("Creating tables with secondary indexes: %v, %v, %v", AUTH_TABLE, TAGUNIQUE_TABLE, SUBSCRIPTIONS_TABLE)
+	logger.Infof("Creating tables with secondary indexes: %v, %v, %v", AUTH_TABLE, TAGUNIQUE_TABLE, SUBSCRIPTIONS_TABLE)
 
 	// create auth table
 	input = &dynamodb.CreateTableInput{
@@ -468,14 +684,14 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 	_, err = a.svc.CreateTable(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
-			log.Println(err)
+			logger.Error(err)
 			return err
 		}
 	}
 	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
 		TableName: aws.String(AUTH_TABLE),
 	})
-	log.Printf("%v table created", AUTH_TABLE)
+	logger.Infof("%v table created", AUTH_TABLE)
 
 	// create tagunique table
 	input = &dynamodb.CreateTableInput{
@@ -488,6 +704,10 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 				AttributeName: aws.String("Source"),
 				AttributeType: aws.String("S"),
 			},
+			{
+				AttributeName: aws.String("Kind"),
+				AttributeType: aws.String("S"),
+			},
 		},
 		KeySchema: []*dynamodb.KeySchemaElement{
 			{
@@ -516,20 +736,41 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 					WriteCapacityUnits: aws.Int64(settings.IndexConfig.Source.ProvisionedThroughput.WriteCapacity),
 				},
 			},
+			{
+				// Tags of the same kind sorted by value for prefix lookups
+				IndexName: aws.String("Kind"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{
+						AttributeName: aws.String("Kind"),
+						KeyType:       aws.String("HASH"),
+					},
+					{
+						AttributeName: aws.String("Id"),
+						KeyType:       aws.String("RANGE"),
+					},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType: aws.String("ALL"),
+				},
+				ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+					ReadCapacityUnits:  aws.Int64(settings.IndexConfig.Kind.ProvisionedThroughput.ReadCapacity),
+					WriteCapacityUnits: aws.Int64(settings.IndexConfig.Kind.ProvisionedThroughput.WriteCapacity),
+				},
+			},
 		},
 		TableName: aws.String(TAGUNIQUE_TABLE),
 	}
 	_, err = a.svc.CreateTable(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
-			log.Println(err)
+			logger.Error(err)
 			return err
 		}
 	}
 	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
 		TableName: aws.String(TAGUNIQUE_TABLE),
 	})
-	log.Printf("%v table created", TAGUNIQUE_TABLE)
+	logger.Infof("%v table created", TAGUNIQUE_TABLE)
 
 	// create subscriptions table
 	input = &dynamodb.CreateTableInput{
@@ -604,73 +845,329 @@ func (a *DynamoDBAdapter) CreateDb(reset bool) error {
 	_, err = a.svc.CreateTable(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
-			log.Println(err)
+			logger.Error(err)
 			return err
 		}
 	}
 	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
 		TableName: aws.String(SUBSCRIPTIONS_TABLE),
 	})
-	log.Printf("%v table created", SUBSCRIPTIONS_TABLE)
+	logger.Infof("%v table created", SUBSCRIPTIONS_TABLE)
 
-	// install self-talk service account
-	user := &t.User{
-		Access: t.DefaultAccess{
-			Auth: t.ModeCP2P,
-			Anon: t.ModeNone,
+	// create file uploads table
+	input = &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("Id"),
+				AttributeType: aws.String("S"),
+			},
+			{
+				AttributeName: aws.String("User"),
+				AttributeType: aws.String("S"),
+			},
 		},
-		Public: map[string]string{
-			"fn": "SelfTalkService",
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("Id"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(settings.TableConfig.FileUploads.ProvisionedThroughput.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(settings.TableConfig.FileUploads.ProvisionedThroughput.WriteCapacity),
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("User"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{
+						AttributeName: aws.String("User"),
+						KeyType:       aws.String("HASH"),
+					},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType: aws.String("ALL"),
+				},
+				ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+					ReadCapacityUnits:  aws.Int64(settings.IndexConfig.FileUser.ProvisionedThroughput.ReadCapacity),
+					WriteCapacityUnits: aws.Int64(settings.IndexConfig.FileUser.ProvisionedThroughput.WriteCapacity),
+				},
+			},
 		},
+		TableName: aws.String(FILEUPLOADS_TABLE),
 	}
-	user.SetUid(SELF_TALK_SERVICE_USER_ID)
-	item, err := dynamodbattribute.MarshalMap(user)
+	_, err = a.svc.CreateTable(input)
 	if err != nil {
-		return err
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			logger.Error(err)
+			return err
+		}
 	}
-	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
-		Item:      item,
-		TableName: aws.String(USERS_TABLE),
+	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(FILEUPLOADS_TABLE),
 	})
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	log.Println("Successfully install self-talk service account")
-
-	return nil
-}
-
-func (a *DynamoDBAdapter) UserCreate(user *t.User) (error, bool) {
+	logger.Infof("%v table created", FILEUPLOADS_TABLE)
 
-	// insert tags
-	if user.Tags != nil {
-		type TagRecord struct {
-			Id     string
-			Source string
-		}
-		for _, tag := range user.Tags {
-			tagRecord, err := dynamodbattribute.MarshalMap(TagRecord{Id: tag, Source: user.Id})
-			if err != nil {
-				log.Println(err)
-				return err, false
-			}
-			_, err = a.svc.PutItem(&dynamodb.PutItemInput{
-				Item:                tagRecord,
-				TableName:           aws.String(TAGUNIQUE_TABLE),
-				ConditionExpression: aws.String("attribute_not_exists(Id)"), //to ensure tag uniqueness
-			})
-			if err != nil {
-				log.Println(err)
-				return err, false
-			}
+	// create reminders table
+	input = &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("Id"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("Id"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(settings.TableConfig.Reminders.ProvisionedThroughput.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(settings.TableConfig.Reminders.ProvisionedThroughput.WriteCapacity),
+		},
+		TableName: aws.String(REMINDERS_TABLE),
+	}
+	_, err = a.svc.CreateTable(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			logger.Error(err)
+			return err
 		}
 	}
+	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(REMINDERS_TABLE),
+	})
+	logger.Infof("%v table created", REMINDERS_TABLE)
 
-	// insert user record to db
+	// create scheduled messages table
+	input = &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("Id"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("Id"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(settings.TableConfig.Scheduled.ProvisionedThroughput.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(settings.TableConfig.Scheduled.ProvisionedThroughput.WriteCapacity),
+		},
+		TableName: aws.String(SCHEDULED_TABLE),
+	}
+	_, err = a.svc.CreateTable(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			logger.Error(err)
+			return err
+		}
+	}
+	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(SCHEDULED_TABLE),
+	})
+	logger.Infof("%v table created", SCHEDULED_TABLE)
+
+	// create credentials table
+	input = &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("Id"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("Id"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(settings.TableConfig.Credentials.ProvisionedThroughput.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(settings.TableConfig.Credentials.ProvisionedThroughput.WriteCapacity),
+		},
+		TableName: aws.String(CREDENTIALS_TABLE),
+	}
+	_, err = a.svc.CreateTable(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			logger.Error(err)
+			return err
+		}
+	}
+	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(CREDENTIALS_TABLE),
+	})
+	logger.Infof("%v table created", CREDENTIALS_TABLE)
+
+	// create client logs table
+	input = &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("Id"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("Id"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(settings.TableConfig.ClientLogs.ProvisionedThroughput.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(settings.TableConfig.ClientLogs.ProvisionedThroughput.WriteCapacity),
+		},
+		TableName: aws.String(CLIENTLOGS_TABLE),
+	}
+	_, err = a.svc.CreateTable(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			logger.Error(err)
+			return err
+		}
+	}
+	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(CLIENTLOGS_TABLE),
+	})
+	logger.Infof("%v table created", CLIENTLOGS_TABLE)
+
+	// create contacts table, records of a user are queried by the hash key
+	input = &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("User"),
+				AttributeType: aws.String("S"),
+			},
+			{
+				AttributeName: aws.String("Contact"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("User"),
+				KeyType:       aws.String("HASH"),
+			},
+			{
+				AttributeName: aws.String("Contact"),
+				KeyType:       aws.String("RANGE"),
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(settings.TableConfig.Contacts.ProvisionedThroughput.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(settings.TableConfig.Contacts.ProvisionedThroughput.WriteCapacity),
+		},
+		TableName: aws.String(CONTACTS_TABLE),
+	}
+	_, err = a.svc.CreateTable(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			logger.Error(err)
+			return err
+		}
+	}
+	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(CONTACTS_TABLE),
+	})
+	logger.Infof("%v table created", CONTACTS_TABLE)
+
+	// create journal table
+	input = &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("Id"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("Id"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(settings.TableConfig.Journal.ProvisionedThroughput.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(settings.TableConfig.Journal.ProvisionedThroughput.WriteCapacity),
+		},
+		TableName: aws.String(JOURNAL_TABLE),
+	}
+	_, err = a.svc.CreateTable(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			logger.Error(err)
+			return err
+		}
+	}
+	a.svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(JOURNAL_TABLE),
+	})
+	logger.Infof("%v table created", JOURNAL_TABLE)
+
+	// install self-talk service account
+	user := &t.User{
+		Access: t.DefaultAccess{
+			Auth: t.ModeCP2P,
+			Anon: t.ModeNone,
+		},
+		Public: map[string]string{
+			"fn": "SelfTalkService",
+		},
+	}
+	user.SetUid(SELF_TALK_SERVICE_USER_ID)
+	item, err := dynamodbattribute.MarshalMap(user)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(USERS_TABLE),
+	})
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	logger.Info("Successfully install self-talk service account")
+
+	return nil
+}
+
+func (a *DynamoDBAdapter) UserCreate(user *t.User) (error, bool) {
+
+	// insert tags
+	if user.Tags != nil {
+		type TagRecord struct {
+			Id     string
+			Source string
+			// Kind of the tag, i.e. "email", for prefix lookups
+			Kind string `json:",omitempty"`
+		}
+		for _, tag := range user.Tags {
+			tagRecord, err := dynamodbattribute.MarshalMap(TagRecord{Id: tag, Source: user.Id, Kind: t.TagKind(tag)})
+			if err != nil {
+				logger.Error(err)
+				return err, false
+			}
+			_, err = a.svc.PutItem(&dynamodb.PutItemInput{
+				Item:                tagRecord,
+				TableName:           aws.String(TAGUNIQUE_TABLE),
+				ConditionExpression: aws.String("attribute_not_exists(Id)"), //to ensure tag uniqueness
+			})
+			if err != nil {
+				logger.Error(err)
+				return err, false
+			}
+		}
+	}
+
+	// insert user record to db
 	item, err := dynamodbattribute.MarshalMap(*user)
 	if err != nil {
-		log.Println(err)
+		logger.Error(err)
 		return err, false
 	}
 	if *item["Devices"].NULL {
@@ -682,7 +1179,7 @@ func (a *DynamoDBAdapter) UserCreate(user *t.User) (error, bool) {
 		ConditionExpression: aws.String("attribute_not_exists(Id)"),
 	})
 	if err != nil {
-		log.Println(err)
+		logger.Error(err)
 		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException) {
 			return err, true
 		}
@@ -1013,7 +1510,7 @@ func (a *DynamoDBAdapter) UpdAuthRecord(unique string, authLvl int, secret []byt
 }
 
 func (a *DynamoDBAdapter) TopicCreate(topic *t.Topic) error {
-	logDebugMessage(fmt.Sprintf("TopicCreate(topic: %v)", topic))
+	logger.Debugf("TopicCreate(topic: %v)", topic)
 	item, err := dynamodbattribute.MarshalMap(topic)
 	if err != nil {
 		return err
@@ -1026,7 +1523,7 @@ func (a *DynamoDBAdapter) TopicCreate(topic *t.Topic) error {
 }
 
 func (a *DynamoDBAdapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
-	logDebugMessage(fmt.Sprintf("TopicCreateP2P(initiator: %v, invited: %v)", initiator, invited))
+	logger.Debugf("TopicCreateP2P(initiator: %v, invited: %v)", initiator, invited)
 	// Don't care if the initiator changes own subscription
 	initiator.Id = initiator.Topic + ":" + initiator.User
 	item, err := dynamodbattribute.MarshalMap(initiator)
@@ -1065,7 +1562,7 @@ func (a *DynamoDBAdapter) TopicCreateP2P(initiator, invited *t.Subscription) err
 }
 
 func (a *DynamoDBAdapter) TopicGet(topic string) (*t.Topic, error) {
-	logDebugMessage(fmt.Sprintf("TopicGet(topic: %v)", topic))
+	logger.Debugf("TopicGet(topic: %v)", topic)
 	kv, err := dynamodbattribute.MarshalMap(TopicKey{topic})
 	if err != nil {
 		return nil, err
@@ -1088,65 +1585,208 @@ func (a *DynamoDBAdapter) TopicGet(topic string) (*t.Topic, error) {
 	return &t, nil
 }
 
-func (a *DynamoDBAdapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription, error) {
-	logDebugMessage(fmt.Sprintf("TopicsForUser(uid: %v, keepDeleted: %v)", uid, keepDeleted))
-	// fetch all subscriptions owned by user
-	eav, _ := dynamodbattribute.MarshalMap(map[string]interface{}{
-		":User":     uid.String(),
-		":MeTopic":  "usr" + uid.String(),
-		":FndTopic": "fnd" + uid.String(),
-	})
-	input := &dynamodb.QueryInput{
+func (a *DynamoDBAdapter) TopicsWebIndex(limit int) ([]t.Topic, error) {
+	logger.Debugf("TopicsWebIndex(limit: %v)", limit)
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{":WebView": true, ":WebIndex": true})
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
 		ExpressionAttributeNames: map[string]*string{
-			"#User":  aws.String("User"),
-			"#Topic": aws.String("Topic"),
+			"#Public": aws.String("Public"),
 		},
 		ExpressionAttributeValues: eav,
-		KeyConditionExpression:    aws.String("#User = :User"),
-		FilterExpression:          aws.String("#Topic <> :MeTopic and #Topic <> :FndTopic"), // skip over `me` & `fnd` topics
-		IndexName:                 aws.String("UserUpdatedAt"),
-		TableName:                 aws.String(SUBSCRIPTIONS_TABLE),
+		FilterExpression:          aws.String("WebView = :WebView and WebIndex = :WebIndex and DeletedAt <> NOT_NULL"),
+		ProjectionExpression:      aws.String("Id, CreatedAt, UpdatedAt, SeqId, #Public"),
+		TableName:                 aws.String(TOPICS_TABLE),
 	}
-	if !keepDeleted {
-		input.FilterExpression = aws.String("DeletedAt <> NOT_NULL")
+
+	// the filter is applied after the scan, keep scanning until enough topics are found
+	var items []map[string]*dynamodb.AttributeValue
+	for len(items) < limit {
+		result, err := a.svc.Scan(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan topics due: %v", err)
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
 	}
-	result, err := a.svc.Query(input)
+	if len(items) > limit {
+		items = items[:limit]
+	}
+
+	var topics []t.Topic
+	if err = dynamodbattribute.UnmarshalListOfMaps(items, &topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+func (a *DynamoDBAdapter) TopicsDigest() ([]t.Topic, error) {
+	logger.Debug("TopicsDigest()")
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{":S": "S"})
 	if err != nil {
-		return nil, fmt.Errorf("unable to fetch subscriptions for topics due: %v", err)
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#Public": aws.String("Public"),
+		},
+		ExpressionAttributeValues: eav,
+		// empty strings are stored as NULL, so the digest is enabled if it's a string
+		FilterExpression:     aws.String("attribute_type(Digest, :S) and DeletedAt <> NOT_NULL"),
+		ProjectionExpression: aws.String("Id, SeqId, #Public, Digest, DigestAt, DigestSeq"),
+		TableName:            aws.String(TOPICS_TABLE),
 	}
+
 	var items []map[string]*dynamodb.AttributeValue
-	items = append(items, result.Items...)
-	for len(result.LastEvaluatedKey) > 0 {
-		input.ExclusiveStartKey = result.LastEvaluatedKey
-		result, err = a.svc.Query(input)
+	for {
+		result, err := a.svc.Scan(input)
 		if err != nil {
-			return nil, fmt.Errorf("unable to ftech more subscriptions for topics due: %v", err)
+			return nil, fmt.Errorf("unable to scan topics due: %v", err)
 		}
 		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
 	}
 
-	// parse subscriptions result
-	var subs []t.Subscription
-	if err = dynamodbattribute.UnmarshalListOfMaps(items, &subs); err != nil {
+	var topics []t.Topic
+	if err = dynamodbattribute.UnmarshalListOfMaps(items, &topics); err != nil {
 		return nil, err
 	}
+	return topics, nil
+}
 
-	// define container for joining subscriptions info
-	join := make(map[string]*t.Subscription)
-	var topicsToFind []map[string]*dynamodb.AttributeValue
-	var usersToFind []map[string]*dynamodb.AttributeValue
-	for i := 0; i < len(subs); i++ {
-		sub := &subs[i]
-		tcat := t.GetTopicCat(sub.Topic)
+func (a *DynamoDBAdapter) TopicsScripted() ([]t.Topic, error) {
+	logger.Debug("TopicsScripted()")
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{":L": "L"})
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		ExpressionAttributeValues: eav,
+		FilterExpression:          aws.String("attribute_type(Scripts, :L) and DeletedAt <> NOT_NULL"),
+		ProjectionExpression:      aws.String("Id, Scripts"),
+		TableName:                 aws.String(TOPICS_TABLE),
+	}
 
-		// only fetch info for p2p & grp topics
-		if tcat == t.TopicCat_Me || tcat == t.TopicCat_Fnd {
-			continue
-		} else if tcat == t.TopicCat_P2P {
-			uid1, uid2, _ := t.ParseP2P(sub.Topic)
-			var peerUid t.Uid
-			if uid1 == uid {
-				peerUid = uid2
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		result, err := a.svc.Scan(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan topics due: %v", err)
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	var topics []t.Topic
+	if err = dynamodbattribute.UnmarshalListOfMaps(items, &topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+func (a *DynamoDBAdapter) TopicsExpiring() ([]t.Topic, error) {
+	logger.Debug("TopicsExpiring()")
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{":Zero": 0})
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		ExpressionAttributeValues: eav,
+		FilterExpression:          aws.String("MessageTtl > :Zero and DeletedAt <> NOT_NULL"),
+		ProjectionExpression:      aws.String("Id, SeqId, ClearId, MessageTtl"),
+		TableName:                 aws.String(TOPICS_TABLE),
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		result, err := a.svc.Scan(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan topics due: %v", err)
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	var topics []t.Topic
+	if err = dynamodbattribute.UnmarshalListOfMaps(items, &topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+func (a *DynamoDBAdapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription, error) {
+	logger.Debugf("TopicsForUser(uid: %v, keepDeleted: %v)", uid, keepDeleted)
+	// fetch all subscriptions owned by user
+	eav, _ := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":User":     uid.String(),
+		":MeTopic":  "usr" + uid.String(),
+		":FndTopic": "fnd" + uid.String(),
+	})
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#User":  aws.String("User"),
+			"#Topic": aws.String("Topic"),
+		},
+		ExpressionAttributeValues: eav,
+		KeyConditionExpression:    aws.String("#User = :User"),
+		FilterExpression:          aws.String("#Topic <> :MeTopic and #Topic <> :FndTopic"), // skip over `me` & `fnd` topics
+		IndexName:                 aws.String("UserUpdatedAt"),
+		TableName:                 aws.String(SUBSCRIPTIONS_TABLE),
+	}
+	if !keepDeleted {
+		input.FilterExpression = aws.String("DeletedAt <> NOT_NULL")
+	}
+	result, err := a.svc.Query(input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch subscriptions for topics due: %v", err)
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	items = append(items, result.Items...)
+	for len(result.LastEvaluatedKey) > 0 {
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+		result, err = a.svc.Query(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to ftech more subscriptions for topics due: %v", err)
+		}
+		items = append(items, result.Items...)
+	}
+
+	// parse subscriptions result
+	var subs []t.Subscription
+	if err = dynamodbattribute.UnmarshalListOfMaps(items, &subs); err != nil {
+		return nil, err
+	}
+
+	// define container for joining subscriptions info
+	join := make(map[string]*t.Subscription)
+	var topicsToFind []map[string]*dynamodb.AttributeValue
+	var usersToFind []map[string]*dynamodb.AttributeValue
+	for i := 0; i < len(subs); i++ {
+		sub := &subs[i]
+		tcat := t.GetTopicCat(sub.Topic)
+
+		// only fetch info for p2p & grp topics
+		if tcat == t.TopicCat_Me || tcat == t.TopicCat_Fnd {
+			continue
+		} else if tcat == t.TopicCat_P2P {
+			uid1, uid2, _ := t.ParseP2P(sub.Topic)
+			var peerUid t.Uid
+			if uid1 == uid {
+				peerUid = uid2
 			} else {
 				peerUid = uid1
 			}
@@ -1200,7 +1840,7 @@ func (a *DynamoDBAdapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscr
 					sub.ObjHeader.MergeTimes(&top.ObjHeader)
 					sub.SetSeqId(top.SeqId)
 					sub.SetHardClearId(top.ClearId)
-					if t.GetTopicCat(sub.Topic) == t.TopicCat_Grp {
+					if t.GetTopicCat(sub.Topic) != t.TopicCat_P2P {
 						sub.SetPublic(top.Public)
 					}
 				}
@@ -1272,7 +1912,7 @@ func (a *DynamoDBAdapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscr
 }
 
 func (a *DynamoDBAdapter) UsersForTopic(topic string, keepDeleted bool) ([]t.Subscription, error) {
-	logDebugMessage(fmt.Sprintf("UsersForTopic(topic: %v, keepDeleted: %v)", topic, keepDeleted))
+	logger.Debugf("UsersForTopic(topic: %v, keepDeleted: %v)", topic, keepDeleted)
 	// get all subscriptions by topic
 	eav, _ := dynamodbattribute.MarshalMap(map[string]string{":Topic": topic})
 	input := &dynamodb.QueryInput{
@@ -1297,7 +1937,7 @@ func (a *DynamoDBAdapter) UsersForTopic(topic string, keepDeleted bool) ([]t.Sub
 		input.ExclusiveStartKey = result.LastEvaluatedKey
 		result, err = a.svc.Query(input)
 		if err != nil {
-			log.Println(fmt.Errorf("unable to fetch remaining subscriptions due: %v", err))
+			logger.Warn("unable to fetch remaining subscriptions due:", err)
 			break
 		}
 		items = append(items, result.Items...)
@@ -1366,7 +2006,7 @@ func (a *DynamoDBAdapter) UsersForTopic(topic string, keepDeleted bool) ([]t.Sub
 		for i := 0; i < nProcess; i++ {
 			err = <-errChan
 			if err != nil {
-				log.Println(err)
+				logger.Error(err)
 			}
 		}
 	}
@@ -1468,6 +2108,89 @@ func (a *DynamoDBAdapter) TopicUpdate(topic string, update map[string]interface{
 	return err
 }
 
+// setExternalId sets the ExternalId attribute of the item or removes it if the ID is empty: the attribute
+// is the key of a sparse index and cannot be set to null.
+func (a *DynamoDBAdapter) setExternalId(table string, kv map[string]*dynamodb.AttributeValue, extId string) error {
+	update := map[string]interface{}{":UpdatedAt": t.TimeNow()}
+	ue := "set UpdatedAt = :UpdatedAt"
+	if extId == "" {
+		ue += " remove ExternalId"
+	} else {
+		update[":ExternalId"] = extId
+		ue += ", ExternalId = :ExternalId"
+	}
+	eav, err := dynamodbattribute.MarshalMap(update)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       kv,
+		TableName:                 aws.String(table),
+		ExpressionAttributeValues: eav,
+		UpdateExpression:          aws.String(ue),
+	})
+	return err
+}
+
+// getByExternalId finds the item which is not deleted by its external ID, returns nil if not found.
+func (a *DynamoDBAdapter) getByExternalId(table, extId string) (map[string]*dynamodb.AttributeValue, error) {
+	eav, err := dynamodbattribute.MarshalMap(map[string]string{":ExternalId": extId})
+	if err != nil {
+		return nil, err
+	}
+	result, err := a.svc.Query(&dynamodb.QueryInput{
+		ExpressionAttributeValues: eav,
+		KeyConditionExpression:    aws.String("ExternalId = :ExternalId"),
+		FilterExpression:          aws.String("DeletedAt <> NOT_NULL"),
+		IndexName:                 aws.String("ExternalId"),
+		TableName:                 aws.String(table),
+	})
+	if err != nil || len(result.Items) == 0 {
+		return nil, err
+	}
+	return result.Items[0], nil
+}
+
+func (a *DynamoDBAdapter) UserSetExternalId(uid t.Uid, extId string) error {
+	kv, err := dynamodbattribute.MarshalMap(UserKey{Id: uid.String()})
+	if err != nil {
+		return err
+	}
+	return a.setExternalId(USERS_TABLE, kv, extId)
+}
+
+func (a *DynamoDBAdapter) UserGetByExternalId(extId string) (*t.User, error) {
+	item, err := a.getByExternalId(USERS_TABLE, extId)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	var user t.User
+	if err = dynamodbattribute.UnmarshalMap(item, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (a *DynamoDBAdapter) TopicSetExternalId(topic string, extId string) error {
+	kv, err := dynamodbattribute.MarshalMap(TopicKey{topic})
+	if err != nil {
+		return err
+	}
+	return a.setExternalId(TOPICS_TABLE, kv, extId)
+}
+
+func (a *DynamoDBAdapter) TopicGetByExternalId(extId string) (*t.Topic, error) {
+	item, err := a.getByExternalId(TOPICS_TABLE, extId)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	var topic t.Topic
+	if err = dynamodbattribute.UnmarshalMap(item, &topic); err != nil {
+		return nil, err
+	}
+	return &topic, nil
+}
+
 func (a *DynamoDBAdapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, error) {
 	var sub t.Subscription
 	kv, _ := dynamodbattribute.MarshalMap(SubscriptionKey{topic + ":" + user.String()})
@@ -1484,7 +2207,7 @@ func (a *DynamoDBAdapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscrip
 }
 
 func (a *DynamoDBAdapter) SubsForUser(forUser t.Uid, keepDeleted bool) ([]t.Subscription, error) {
-	logDebugMessage(fmt.Sprintf("SubsForUser(forUser: %v, keepDeleted: %v)", forUser, keepDeleted))
+	logger.Debugf("SubsForUser(forUser: %v, keepDeleted: %v)", forUser, keepDeleted)
 	if forUser.IsZero() {
 		return nil, errors.New("Invalid user ID in SubsForUser")
 	}
@@ -1518,7 +2241,7 @@ func (a *DynamoDBAdapter) SubsForUser(forUser t.Uid, keepDeleted bool) ([]t.Subs
 		input.ExclusiveStartKey = result.LastEvaluatedKey
 		result, err = a.svc.Query(input)
 		if err != nil {
-			log.Println(fmt.Errorf("unable to fetch more subscription due: %v", err))
+			logger.Warn("unable to fetch more subscription due:", err)
 			break
 		}
 		items = append(items, result.Items...)
@@ -1532,7 +2255,7 @@ func (a *DynamoDBAdapter) SubsForUser(forUser t.Uid, keepDeleted bool) ([]t.Subs
 }
 
 func (a *DynamoDBAdapter) SubsForTopic(topic string, keepDeleted bool) ([]t.Subscription, error) {
-	logDebugMessage(fmt.Sprintf("SubsForTopic(topic: %v, keepDeleted: %v)", topic, keepDeleted))
+	logger.Debugf("SubsForTopic(topic: %v, keepDeleted: %v)", topic, keepDeleted)
 	// must load User.Public for p2p topics
 	var p2p []t.User
 	var err error
@@ -1565,7 +2288,7 @@ func (a *DynamoDBAdapter) SubsForTopic(topic string, keepDeleted bool) ([]t.Subs
 		input.ExclusiveStartKey = result.LastEvaluatedKey
 		result, err = a.svc.Query(input)
 		if err != nil {
-			log.Println(fmt.Errorf("unable to fetch more subscriptions due: %v", err))
+			logger.Warn("unable to fetch more subscriptions due:", err)
 			break
 		}
 		items = append(items, result.Items...)
@@ -1612,6 +2335,34 @@ func (a *DynamoDBAdapter) SubsUpdate(topic string, user t.Uid, update map[string
 	return err
 }
 
+// SubsOwnerChange updates subscriptions of the old and the new owner in one transaction.
+func (a *DynamoDBAdapter) SubsOwnerChange(topic string, oldOwner, newOwner *t.Subscription) error {
+	now := t.TimeNow()
+	var items []*dynamodb.TransactWriteItem
+	for _, sub := range []*t.Subscription{newOwner, oldOwner} {
+		kv, err := dynamodbattribute.MarshalMap(SubscriptionKey{topic + ":" + sub.User})
+		if err != nil {
+			return err
+		}
+		eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+			":ModeWant":  int(sub.ModeWant),
+			":ModeGiven": int(sub.ModeGiven),
+			":UpdatedAt": now})
+		if err != nil {
+			return err
+		}
+		items = append(items, &dynamodb.TransactWriteItem{
+			Update: &dynamodb.Update{
+				Key:                       kv,
+				TableName:                 aws.String(SUBSCRIPTIONS_TABLE),
+				ExpressionAttributeValues: eav,
+				UpdateExpression:          aws.String("set ModeWant = :ModeWant, ModeGiven = :ModeGiven, UpdatedAt = :UpdatedAt"),
+			}})
+	}
+	_, err := a.svc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return err
+}
+
 func (a *DynamoDBAdapter) SubsDelete(topic string, user t.Uid) error {
 	// update UpdateAt & DeletedAt user's subscription
 	kv, err := dynamodbattribute.MarshalMap(&SubscriptionKey{topic + ":" + user.String()})
@@ -1677,29 +2428,27 @@ func (a *DynamoDBAdapter) SubsDelForTopic(topic string) error {
 		for range records {
 			err = <-errChan
 			if err != nil {
-				log.Println(err)
+				logger.Error(err)
 			}
 		}
 	}
 	return nil
 }
 
-func (a *DynamoDBAdapter) FindSubs(uid t.Uid, query []interface{}) ([]t.Subscription, error) {
-	logDebugMessage(fmt.Sprintf("FindSubs(uid: %v, query: %v)", uid, query))
+func (a *DynamoDBAdapter) FindSubs(uid t.Uid, tags, prefixes []string, limit int) ([]t.Subscription, error) {
+	logger.Debugf("FindSubs(uid: %v, tags: %v, prefixes: %v, limit: %v)", uid, tags, prefixes, limit)
 	uniqueIdx := make(map[string]bool) // to ensure uniqueness of tag & userid
 
 	// get user id from tagunique for each tag in query
 	var tkvs []map[string]*dynamodb.AttributeValue
-	for _, q := range query {
-		if tag, ok := q.(string); ok {
-			if !uniqueIdx[tag] {
-				kv, err := dynamodbattribute.MarshalMap(TagUniqueKey{tag})
-				if err != nil {
-					return nil, err
-				}
-				tkvs = append(tkvs, kv)
-				uniqueIdx[tag] = true
+	for _, tag := range tags {
+		if !uniqueIdx[tag] {
+			kv, err := dynamodbattribute.MarshalMap(TagUniqueKey{tag})
+			if err != nil {
+				return nil, err
 			}
+			tkvs = append(tkvs, kv)
+			uniqueIdx[tag] = true
 		}
 	}
 	// limit tags
@@ -1721,6 +2470,28 @@ func (a *DynamoDBAdapter) FindSubs(uid t.Uid, query []interface{}) ([]t.Subscrip
 		itemsTag = append(itemsTag, resTag.Responses[TAGUNIQUE_TABLE]...)
 		requestItemsTag = resTag.UnprocessedKeys
 	}
+
+	// prefixes are looked up in the Kind index of tagunique, i.e. "email:alice*" is
+	// Kind = "email" and Id begins with "email:alice"
+	for _, prefix := range prefixes {
+		queryInput := &dynamodb.QueryInput{
+			TableName:              aws.String(TAGUNIQUE_TABLE),
+			IndexName:              aws.String("Kind"),
+			KeyConditionExpression: aws.String("Kind = :kind AND begins_with(Id, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":kind":   {S: aws.String(t.TagKind(prefix))},
+				":prefix": {S: aws.String(prefix)},
+			},
+			// the caller is skipped, thus one extra
+			Limit: aws.Int64(int64(limit + 1)),
+		}
+		resTag, err := a.svc.Query(queryInput)
+		if err != nil {
+			return nil, err
+		}
+		itemsTag = append(itemsTag, resTag.Items...)
+	}
+
 	type Record struct {
 		Tag    string `json:"Id"`
 		UserId string `json:"Source"`
@@ -1732,34 +2503,50 @@ func (a *DynamoDBAdapter) FindSubs(uid t.Uid, query []interface{}) ([]t.Subscrip
 
 	// build unique users info to fetch
 	var usersToFind []map[string]*dynamodb.AttributeValue
-	userTagMap := make(map[string]string)
+	userTagMap := make(map[string][]string)
 	for _, record := range records {
 		// ensure uniqueness of user id in result
 		if !uniqueIdx[record.UserId] {
+			if len(usersToFind) > limit {
+				continue
+			}
 			kv, err := dynamodbattribute.MarshalMap(UserKey{record.UserId})
 			if err != nil {
 				continue
 			}
 			usersToFind = append(usersToFind, kv)
-			userTagMap[record.UserId] = record.Tag
 			uniqueIdx[record.UserId] = true
 		}
+		// the same tag may be found both exactly and by prefix
+		if !uniqueIdx[record.UserId+":"+record.Tag] {
+			userTagMap[record.UserId] = append(userTagMap[record.UserId], record.Tag)
+			uniqueIdx[record.UserId+":"+record.Tag] = true
+		}
+	}
+	if len(usersToFind) == 0 {
+		return nil, nil
 	}
 
-	// fetch users for completing subscriptions info
+	// fetch users for completing subscriptions info, MAX_BATCH_GET_ITEM at a time
 	var itemsUser []map[string]*dynamodb.AttributeValue
-	requestItemsUser := map[string]*dynamodb.KeysAndAttributes{USERS_TABLE: {Keys: usersToFind}}
-	for len(requestItemsUser) > 0 {
-		resUsers, err := a.svc.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: requestItemsUser})
-		if err != nil {
-			if len(itemsUser) > 0 {
-				break
-			} else {
-				return nil, err
+	for start := 0; start < len(usersToFind); start += MAX_BATCH_GET_ITEM {
+		end := start + MAX_BATCH_GET_ITEM
+		if end > len(usersToFind) {
+			end = len(usersToFind)
+		}
+		requestItemsUser := map[string]*dynamodb.KeysAndAttributes{USERS_TABLE: {Keys: usersToFind[start:end]}}
+		for len(requestItemsUser) > 0 {
+			resUsers, err := a.svc.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: requestItemsUser})
+			if err != nil {
+				if len(itemsUser) > 0 {
+					break
+				} else {
+					return nil, err
+				}
 			}
+			itemsUser = append(itemsUser, resUsers.Responses[USERS_TABLE]...)
+			requestItemsUser = resUsers.UnprocessedKeys
 		}
-		itemsUser = append(itemsUser, resUsers.Responses[USERS_TABLE]...)
-		requestItemsUser = resUsers.UnprocessedKeys
 	}
 	// parse result
 	var users []t.User
@@ -1777,19 +2564,21 @@ func (a *DynamoDBAdapter) FindSubs(uid t.Uid, query []interface{}) ([]t.Subscrip
 		sub.UpdatedAt = user.UpdatedAt
 		sub.User = user.Id
 		sub.SetPublic(user.Public)
-		sub.Private = []string{userTagMap[user.Id]}
+		sub.Private = userTagMap[user.Id]
 		subs = append(subs, sub)
+		if len(subs) == limit {
+			break
+		}
 	}
 	return subs, nil
 }
 
 func (a *DynamoDBAdapter) MessageSave(msg *t.Message) error {
 
-	eLog := ErrorLogger{"MessageSave"}
 	msg.SetUid(store.GetUid())
 	item, err := dynamodbattribute.MarshalMap(msg)
 	if err != nil {
-		eLog.LogError(err)
+		logger.Error("MessageSave:", err)
 		return err
 	}
 
@@ -1797,23 +2586,29 @@ func (a *DynamoDBAdapter) MessageSave(msg *t.Message) error {
 		item["DeletedFor"] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
 	}
 
-	// set expire duration
-	expireDurationInSeconds := EXPIRE_DURATION_MESSAGE_ME
+	// set expire duration: server policy takes precedence over adapter config
+	expireDuration := time.Duration(EXPIRE_DURATION_MESSAGE_ME) * time.Second
 	switch t.GetTopicCat(msg.Topic) {
 	case t.TopicCat_P2P:
-		expireDurationInSeconds = EXPIRE_DURATION_MESSAGE_P2P
-	case t.TopicCat_Grp:
-		expireDurationInSeconds = EXPIRE_DURATION_MESSAGE_GROUP
+		expireDuration = time.Duration(EXPIRE_DURATION_MESSAGE_P2P) * time.Second
+	case t.TopicCat_Grp, t.TopicCat_Chn:
+		expireDuration = time.Duration(EXPIRE_DURATION_MESSAGE_GROUP) * time.Second
+	}
+	if retention := msg.GetRetention(); retention != store.RetainDefault {
+		expireDuration = retention
+	}
+	// messages without ExpireTime are never expired by dynamodb
+	if expireDuration > 0 {
+		expireTimeUnix := time.Now().UTC().Add(expireDuration).Unix()
+		item["ExpireTime"] = &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", expireTimeUnix))}
 	}
-	expireTimeUnix := time.Now().UTC().Add(time.Duration(expireDurationInSeconds) * time.Second).Unix()
-	item["ExpireTime"] = &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", expireTimeUnix))}
 
 	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
 		Item:      item,
 		TableName: aws.String(MESSAGES_TABLE),
 	})
 	if err != nil {
-		eLog.LogError(err)
+		logger.Error("MessageSave:", err)
 	}
 	return err
 }
@@ -1821,7 +2616,7 @@ func (a *DynamoDBAdapter) MessageSave(msg *t.Message) error {
 // ini nanti pattern fetch message perlu dijelaskan ke k.dimas sm k.yacob
 // ini perlu di test dgn payload message yg banyak
 func (a *DynamoDBAdapter) MessageGetAll(topic string, forUser t.Uid, opts *t.BrowseOpt) ([]t.Message, error) {
-	logDebugMessage(fmt.Sprintf("MessageGetAll(topic: %v, forUser: %v, opts: %v)", topic, forUser, opts))
+	logger.Debugf("MessageGetAll(topic: %v, forUser: %v, opts: %v)", topic, forUser, opts)
 	since := 0
 	before := math.MaxInt32
 	numMessagesRetrieved := uint(MAX_MESSAGES_RETRIEVED)
@@ -1838,11 +2633,28 @@ func (a *DynamoDBAdapter) MessageGetAll(topic string, forUser t.Uid, opts *t.Bro
 		}
 	}
 
-	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+	values := map[string]interface{}{
 		":Topic":  topic,
 		":Since":  since,
 		":Before": before,
-	})
+	}
+	// Replies in the thread only
+	var filters []string
+	if opts != nil && opts.Thread > 0 {
+		values[":Thread"] = opts.Thread
+		filters = append(filters, "Thread = :Thread")
+	}
+	// Messages which mention the user. User IDs have the same length, so a substring of
+	// Head.mentions cannot match another user.
+	if opts != nil && !opts.Mentions.IsZero() {
+		values[":Mention"] = opts.Mentions.UserId()
+		filters = append(filters, "contains(Head.mentions, :Mention)")
+	}
+	var filter *string
+	if len(filters) > 0 {
+		filter = aws.String(strings.Join(filters, " and "))
+	}
+	eav, err := dynamodbattribute.MarshalMap(values)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse expression attribute values due: %v", err)
 	}
@@ -1850,6 +2662,7 @@ func (a *DynamoDBAdapter) MessageGetAll(topic string, forUser t.Uid, opts *t.Bro
 	result, err := a.svc.Query(&dynamodb.QueryInput{
 		ExpressionAttributeValues: eav,
 		KeyConditionExpression:    aws.String("Topic = :Topic and SeqId between :Since and :Before"),
+		FilterExpression:          filter,
 		TableName:                 aws.String(MESSAGES_TABLE),
 		Limit:                     aws.Int64(int64(numMessagesRetrieved)),
 		ScanIndexForward:          aws.Bool(false),
@@ -1865,13 +2678,14 @@ func (a *DynamoDBAdapter) MessageGetAll(topic string, forUser t.Uid, opts *t.Bro
 		result, err = a.svc.Query(&dynamodb.QueryInput{
 			ExpressionAttributeValues: eav,
 			KeyConditionExpression:    aws.String("Topic = :Topic and SeqId between :Since and :Before"),
+			FilterExpression:          filter,
 			TableName:                 aws.String(MESSAGES_TABLE),
 			Limit:                     aws.Int64(int64(itemLeft)),
 			ExclusiveStartKey:         result.LastEvaluatedKey,
 			ScanIndexForward:          aws.Bool(false),
 		})
 		if err != nil {
-			log.Println(fmt.Errorf("unable to fetch remaining items due to: %v, last evaluated key: %v", err, result.LastEvaluatedKey))
+			logger.Warnf("unable to fetch remaining items due to: %v, last evaluated key: %v", err, result.LastEvaluatedKey)
 			break
 		}
 		items = append(items, result.Items...)
@@ -1897,6 +2711,51 @@ func (a *DynamoDBAdapter) MessageGetAll(topic string, forUser t.Uid, opts *t.Bro
 	return msgs, nil
 }
 
+// MessageGetList loads the messages with the seq IDs from the list in batches
+func (a *DynamoDBAdapter) MessageGetList(topic string, forUser t.Uid, list []int) ([]t.Message, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	for start := 0; start < len(list); start += MAX_BATCH_GET_ITEM {
+		end := start + MAX_BATCH_GET_ITEM
+		if end > len(list) {
+			end = len(list)
+		}
+		var kv []map[string]*dynamodb.AttributeValue
+		for _, seq := range list[start:end] {
+			el, err := dynamodbattribute.MarshalMap(MessageKey{topic, seq})
+			if err != nil {
+				return nil, err
+			}
+			kv = append(kv, el)
+		}
+
+		requestItems := map[string]*dynamodb.KeysAndAttributes{MESSAGES_TABLE: {Keys: kv}}
+		for len(requestItems) > 0 {
+			result, err := a.svc.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: requestItems})
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, result.Responses[MESSAGES_TABLE]...)
+			requestItems = result.UnprocessedKeys
+		}
+	}
+
+	var msgs []t.Message
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &msgs); err != nil {
+		return nil, err
+	}
+
+	requester := forUser.String()
+	for i := 0; i < len(msgs); i++ {
+		for j := 0; j < len(msgs[i].DeletedFor); j++ {
+			if msgs[i].DeletedFor[j].User == requester {
+				msgs[i].DeletedAt = &msgs[i].DeletedFor[j].Timestamp
+				break
+			}
+		}
+	}
+	return msgs, nil
+}
+
 func (a *DynamoDBAdapter) MessageDeleteAll(topic string, before int) error {
 	/*
 	   It is possible for `before` value to be negative in which means user
@@ -1941,7 +2800,7 @@ func (a *DynamoDBAdapter) MessageDeleteAll(topic string, before int) error {
 			return err
 		}
 		return nil
-	case t.TopicCat_Grp:
+	case t.TopicCat_Grp, t.TopicCat_Chn:
 		kv, err := dynamodbattribute.MarshalMap(TopicKey{topic})
 		if err != nil {
 			return err
@@ -2052,94 +2911,868 @@ func (a *DynamoDBAdapter) MessageDeleteList(topic string, forUser t.Uid, hard bo
 	return errResult
 }
 
-func deviceHasher(deviceId string) string {
-	// Generate custom key as [64-bit hash of device id] to ensure predictable
-	// length of the key
-	hasher := fnv.New64()
-	hasher.Write([]byte(deviceId))
-	return strconv.FormatUint(uint64(hasher.Sum64()), 16)
-}
+// MessageSearch finds messages which contain the query string. DynamoDB has no full-text search so messages
+// are read newest first and matched in memory. At most MAX_MESSAGES_SEARCHED messages are examined.
+func (a *DynamoDBAdapter) MessageSearch(topic string, forUser t.Uid, query string, opts *t.BrowseOpt) ([]t.Message, error) {
+	since := 0
+	before := math.MaxInt32
+	limit := uint(MAX_MESSAGES_RETRIEVED)
 
-func (a *DynamoDBAdapter) DeviceUpsert(uid t.Uid, dev *t.DeviceDef) error {
-	// prepare hash
-	hash := deviceHasher(dev.DeviceId)
-	// prepare key
-	kv, err := dynamodbattribute.MarshalMap(UserKey{uid.String()})
-	if err != nil {
-		return err
+	if opts != nil {
+		if opts.Since > 0 {
+			since = opts.Since
+		}
+		if opts.Before > 0 {
+			before = opts.Before
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
 	}
-	// prepare ean, eav, ue
-	ean := map[string]*string{"#device": aws.String(hash)}
-	eav, err := dynamodbattribute.MarshalMap(map[string]*t.DeviceDef{":device": dev})
+
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":Topic":  topic,
+		":Since":  since,
+		":Before": before,
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ue := aws.String("SET Devices.#device = :device")
-	_, err = a.svc.UpdateItem(&dynamodb.UpdateItemInput{
-		ExpressionAttributeNames:  ean,
-		ExpressionAttributeValues: eav,
-		Key:              kv,
-		TableName:        aws.String(USERS_TABLE),
-		UpdateExpression: ue,
-	})
-	return err
+
+	query = strings.ToLower(query)
+	requester := forUser.String()
+	var msgs []t.Message
+	var lastKey map[string]*dynamodb.AttributeValue
+	examined := 0
+	for {
+		result, err := a.svc.Query(&dynamodb.QueryInput{
+			ExpressionAttributeValues: eav,
+			KeyConditionExpression:    aws.String("Topic = :Topic and SeqId between :Since and :Before"),
+			TableName:                 aws.String(MESSAGES_TABLE),
+			ExclusiveStartKey:         lastKey,
+			ScanIndexForward:          aws.Bool(false),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var page []t.Message
+		if err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+
+	Page:
+		for i := range page {
+			mm := &page[i]
+			if mm.DeletedAt != nil {
+				continue
+			}
+			for _, del := range mm.DeletedFor {
+				if del.User == requester {
+					continue Page
+				}
+			}
+
+			text, ok := mm.Content.(string)
+			if !ok {
+				raw, _ := json.Marshal(mm.Content)
+				text = string(raw)
+			}
+			if strings.Contains(strings.ToLower(text), query) {
+				msgs = append(msgs, *mm)
+				if uint(len(msgs)) >= limit {
+					return msgs, nil
+				}
+			}
+		}
+
+		examined += len(page)
+		lastKey = result.LastEvaluatedKey
+		if len(lastKey) == 0 || examined >= MAX_MESSAGES_SEARCHED {
+			break
+		}
+	}
+	return msgs, nil
 }
 
-// TODO: need better handling of batch get item
-func (a *DynamoDBAdapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
-	// limit uids
-	if len(uids) > MAX_DEVICES_PER_USER {
-		uids = uids[:MAX_DEVICES_PER_USER]
+func (a *DynamoDBAdapter) MessageUpdate(topic string, seqId int, update map[string]interface{}) error {
+	kv, err := dynamodbattribute.MarshalMap(MessageKey{topic, seqId})
+	if err != nil {
+		return err
+	}
+	ean, eav, ue, err := parseEanEavUeUpdateItem(update)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       kv,
+		TableName:                 aws.String(MESSAGES_TABLE),
+		ExpressionAttributeNames:  ean,
+		ExpressionAttributeValues: eav,
+		UpdateExpression:          ue,
+	})
+	return err
+}
+
+// MessageFirstAfter queries the messages of the topic in the order of SeqId until the first one
+// created after the given time.
+func (a *DynamoDBAdapter) MessageFirstAfter(topic string, since int, after time.Time) (int, error) {
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":Topic": topic,
+		":Since": since,
+		":After": after,
+	})
+	if err != nil {
+		return 0, err
+	}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: eav,
+		KeyConditionExpression:    aws.String("Topic = :Topic and SeqId >= :Since"),
+		FilterExpression:          aws.String("CreatedAt > :After"),
+		ProjectionExpression:      aws.String("SeqId"),
+		TableName:                 aws.String(MESSAGES_TABLE),
+		ScanIndexForward:          aws.Bool(true),
+	}
+
+	for {
+		result, err := a.svc.Query(input)
+		if err != nil {
+			return 0, fmt.Errorf("unable to query messages due: %v", err)
+		}
+		if len(result.Items) > 0 {
+			var msg t.Message
+			if err = dynamodbattribute.UnmarshalMap(result.Items[0], &msg); err != nil {
+				return 0, err
+			}
+			return msg.SeqId, nil
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return 0, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (a *DynamoDBAdapter) FileStartUpload(fd *t.FileDef) error {
+	item, err := dynamodbattribute.MarshalMap(fd)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(FILEUPLOADS_TABLE),
+		ConditionExpression: aws.String("attribute_not_exists(Id)"),
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) FileFinishUpload(fd *t.FileDef) error {
+	kv, err := dynamodbattribute.MarshalMap(FileDefKey{fd.Id})
+	if err != nil {
+		return err
+	}
+	ean, eav, ue, err := parseEanEavUeUpdateItem(map[string]interface{}{
+		"UpdatedAt": fd.UpdatedAt,
+		"Status":    fd.Status,
+		"Location":  fd.Location,
+		"Size":      fd.Size,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       kv,
+		TableName:                 aws.String(FILEUPLOADS_TABLE),
+		ExpressionAttributeNames:  ean,
+		ExpressionAttributeValues: eav,
+		UpdateExpression:          ue,
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) FileGet(fid string) (*t.FileDef, error) {
+	kv, err := dynamodbattribute.MarshalMap(FileDefKey{fid})
+	if err != nil {
+		return nil, err
+	}
+	result, err := a.svc.GetItem(&dynamodb.GetItemInput{
+		Key:       kv,
+		TableName: aws.String(FILEUPLOADS_TABLE),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+	var fd t.FileDef
+	if err = dynamodbattribute.UnmarshalMap(result.Item, &fd); err != nil {
+		return nil, err
+	}
+	return &fd, nil
+}
+
+func (a *DynamoDBAdapter) FileUsage(uid t.Uid) (int64, error) {
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":User":   uid.String(),
+		":Status": t.UploadCompleted,
+	})
+	if err != nil {
+		return 0, err
+	}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#User":   aws.String("User"),
+			"#Status": aws.String("Status"),
+			"#Size":   aws.String("Size"),
+		},
+		ExpressionAttributeValues: eav,
+		KeyConditionExpression:    aws.String("#User = :User"),
+		FilterExpression:          aws.String("#Status = :Status"),
+		ProjectionExpression:      aws.String("#Size"),
+		IndexName:                 aws.String("User"),
+		TableName:                 aws.String(FILEUPLOADS_TABLE),
+	}
+
+	var total int64
+	for {
+		result, err := a.svc.Query(input)
+		if err != nil {
+			return 0, fmt.Errorf("unable to fetch file uploads due: %v", err)
+		}
+		var records []struct{ Size int64 }
+		if err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &records); err != nil {
+			return 0, err
+		}
+		for _, rec := range records {
+			total += rec.Size
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return total, nil
+}
+
+func (a *DynamoDBAdapter) ReminderUpsert(r *t.Reminder) error {
+	item, err := dynamodbattribute.MarshalMap(r)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(REMINDERS_TABLE),
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) ReminderDelete(id string) error {
+	kv, err := dynamodbattribute.MarshalMap(ReminderKey{id})
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		Key:       kv,
+		TableName: aws.String(REMINDERS_TABLE),
+	})
+	return err
+}
+
+// RemindersDue scans the table: there is no partition key to query due reminders by.
+func (a *DynamoDBAdapter) RemindersDue(until time.Time, limit int, keep func(*t.Reminder) bool) ([]t.Reminder, error) {
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{":until": until})
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#At": aws.String("At"),
+		},
+		ExpressionAttributeValues: eav,
+		FilterExpression:          aws.String("#At <= :until"),
+		TableName:                 aws.String(REMINDERS_TABLE),
+	}
+
+	var reminders []t.Reminder
+	for len(reminders) < limit {
+		result, err := a.svc.Scan(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan reminders due: %v", err)
+		}
+		var page []t.Reminder
+		if err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		for i := range page {
+			if keep == nil || keep(&page[i]) {
+				reminders = append(reminders, page[i])
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	if len(reminders) > limit {
+		reminders = reminders[:limit]
+	}
+	return reminders, nil
+}
+
+func (a *DynamoDBAdapter) ScheduledSave(msg *t.ScheduledMessage) error {
+	item, err := dynamodbattribute.MarshalMap(msg)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(SCHEDULED_TABLE),
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) ScheduledDelete(id string) error {
+	kv, err := dynamodbattribute.MarshalMap(ScheduledKey{id})
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		Key:       kv,
+		TableName: aws.String(SCHEDULED_TABLE),
+	})
+	return err
+}
+
+// ScheduledDue scans the table the same way as RemindersDue. Scan results are not ordered, the
+// due messages are sorted by time here.
+func (a *DynamoDBAdapter) ScheduledDue(until time.Time, limit int,
+	keep func(*t.ScheduledMessage) bool) ([]t.ScheduledMessage, error) {
+	eav, err := dynamodbattribute.MarshalMap(map[string]interface{}{":until": until})
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#At": aws.String("At"),
+		},
+		ExpressionAttributeValues: eav,
+		FilterExpression:          aws.String("#At <= :until"),
+		TableName:                 aws.String(SCHEDULED_TABLE),
+	}
+
+	var msgs []t.ScheduledMessage
+	for len(msgs) < limit {
+		result, err := a.svc.Scan(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan scheduled messages due: %v", err)
+		}
+		var page []t.ScheduledMessage
+		if err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		for i := range page {
+			if keep == nil || keep(&page[i]) {
+				msgs = append(msgs, page[i])
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].At.Before(msgs[j].At) })
+	return msgs, nil
+}
+
+func (a *DynamoDBAdapter) CredUpsert(cred *t.Credential) error {
+	item, err := dynamodbattribute.MarshalMap(cred)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(CREDENTIALS_TABLE),
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) CredGet(id string) (*t.Credential, error) {
+	kv, err := dynamodbattribute.MarshalMap(CredentialKey{id})
+	if err != nil {
+		return nil, err
+	}
+	result, err := a.svc.GetItem(&dynamodb.GetItemInput{Key: kv, TableName: aws.String(CREDENTIALS_TABLE)})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+
+	var cred t.Credential
+	if err = dynamodbattribute.UnmarshalMap(result.Item, &cred); err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+func (a *DynamoDBAdapter) CredDelete(id string) error {
+	kv, err := dynamodbattribute.MarshalMap(CredentialKey{id})
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		Key:       kv,
+		TableName: aws.String(CREDENTIALS_TABLE),
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) ClientLogUpsert(cl *t.ClientLog) error {
+	item, err := dynamodbattribute.MarshalMap(cl)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(CLIENTLOGS_TABLE),
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) ClientLogGet(id string) (*t.ClientLog, error) {
+	kv, err := dynamodbattribute.MarshalMap(ClientLogKey{id})
+	if err != nil {
+		return nil, err
+	}
+	result, err := a.svc.GetItem(&dynamodb.GetItemInput{Key: kv, TableName: aws.String(CLIENTLOGS_TABLE)})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+
+	var cl t.ClientLog
+	if err = dynamodbattribute.UnmarshalMap(result.Item, &cl); err != nil {
+		return nil, err
+	}
+	return &cl, nil
+}
+
+// ClientLogFind scans the table: logs are looked up by support staff only, there is no need for indexes.
+func (a *DynamoDBAdapter) ClientLogFind(ticket string, user t.Uid, limit int) ([]t.ClientLog, error) {
+	input := &dynamodb.ScanInput{TableName: aws.String(CLIENTLOGS_TABLE)}
+
+	var filters []string
+	ean := make(map[string]*string)
+	values := make(map[string]interface{})
+	if ticket != "" {
+		filters = append(filters, "#Ticket = :ticket")
+		ean["#Ticket"] = aws.String("Ticket")
+		values[":ticket"] = ticket
+	}
+	if !user.IsZero() {
+		filters = append(filters, "#User = :user")
+		ean["#User"] = aws.String("User")
+		values[":user"] = user.String()
+	}
+	if len(filters) > 0 {
+		eav, err := dynamodbattribute.MarshalMap(values)
+		if err != nil {
+			return nil, err
+		}
+		input.ExpressionAttributeNames = ean
+		input.ExpressionAttributeValues = eav
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		result, err := a.svc.Scan(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan client logs: %v", err)
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	var logs []t.ClientLog
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &logs); err != nil {
+		return nil, err
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].CreatedAt.After(logs[j].CreatedAt) })
+	if len(logs) > limit {
+		logs = logs[:limit]
+	}
+	return logs, nil
+}
+
+func (a *DynamoDBAdapter) ContactUpsert(contacts ...*t.ContactRecord) error {
+	var requests []*dynamodb.WriteRequest
+	for _, c := range contacts {
+		item, err := dynamodbattribute.MarshalMap(c)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	}
+	_, err := a.svc.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{CONTACTS_TABLE: requests},
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) ContactGetAll(user t.Uid) ([]t.ContactRecord, error) {
+	eav, err := dynamodbattribute.MarshalMap(map[string]string{":User": user.String()})
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeNames:  map[string]*string{"#User": aws.String("User")},
+		ExpressionAttributeValues: eav,
+		KeyConditionExpression:    aws.String("#User = :User"),
+		TableName:                 aws.String(CONTACTS_TABLE),
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		result, err := a.svc.Query(input)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	var contacts []t.ContactRecord
+	if err = dynamodbattribute.UnmarshalListOfMaps(items, &contacts); err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+func (a *DynamoDBAdapter) ContactDelete(user, contact t.Uid) error {
+	var requests []*dynamodb.WriteRequest
+	for _, key := range []ContactKey{{user.String(), contact.String()}, {contact.String(), user.String()}} {
+		kv, err := dynamodbattribute.MarshalMap(key)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: kv}})
+	}
+	_, err := a.svc.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{CONTACTS_TABLE: requests},
+	})
+	return err
+}
+
+func (a *DynamoDBAdapter) OperationUpsert(op *t.Operation) error {
+	item, err := dynamodbattribute.MarshalMap(op)
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(JOURNAL_TABLE),
+	})
+	return err
+}
+
+// OperationGetAll scans the table. It's expected to be nearly empty.
+func (a *DynamoDBAdapter) OperationGetAll() ([]t.Operation, error) {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(JOURNAL_TABLE),
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		result, err := a.svc.Scan(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan journal: %v", err)
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	var ops []t.Operation
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &ops); err != nil {
+		return nil, err
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].CreatedAt.Before(ops[j].CreatedAt) })
+	return ops, nil
+}
+
+func (a *DynamoDBAdapter) OperationDelete(id string) error {
+	kv, err := dynamodbattribute.MarshalMap(OperationKey{id})
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		Key:       kv,
+		TableName: aws.String(JOURNAL_TABLE),
+	})
+	return err
+}
+
+// TagsDeleteForUser finds tags of the user in the Source index and deletes them one by one.
+func (a *DynamoDBAdapter) TagsDeleteForUser(uid t.Uid) error {
+	eav, err := dynamodbattribute.MarshalMap(map[string]string{":Source": uid.String()})
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: eav,
+		KeyConditionExpression:    aws.String("Source = :Source"),
+		IndexName:                 aws.String("Source"),
+		TableName:                 aws.String(TAGUNIQUE_TABLE),
+		ProjectionExpression:      aws.String("Id"),
+	}
+	for {
+		result, err := a.svc.Query(input)
+		if err != nil {
+			return err
+		}
+		for _, item := range result.Items {
+			_, err = a.svc.DeleteItem(&dynamodb.DeleteItemInput{
+				Key:       map[string]*dynamodb.AttributeValue{"Id": item["Id"]},
+				TableName: aws.String(TAGUNIQUE_TABLE),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// fsckScan scans the table page by page and calls fn for each item.
+func (a *DynamoDBAdapter) fsckScan(input *dynamodb.ScanInput, fn func(map[string]*dynamodb.AttributeValue) error) error {
+	for {
+		result, err := a.svc.Scan(input)
+		if err != nil {
+			return fmt.Errorf("unable to scan %s: %v", *input.TableName, err)
+		}
+		for _, item := range result.Items {
+			if err = fn(item); err != nil {
+				return err
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (a *DynamoDBAdapter) FsckUsers(fn func(*t.User) error) error {
+	return a.fsckScan(&dynamodb.ScanInput{
+		ProjectionExpression: aws.String("Id, DeletedAt, Tags"),
+		TableName:            aws.String(USERS_TABLE),
+	}, func(item map[string]*dynamodb.AttributeValue) error {
+		var user t.User
+		if err := dynamodbattribute.UnmarshalMap(item, &user); err != nil {
+			return err
+		}
+		return fn(&user)
+	})
+}
+
+func (a *DynamoDBAdapter) FsckTopics(fn func(*t.Topic) error) error {
+	return a.fsckScan(&dynamodb.ScanInput{
+		ProjectionExpression: aws.String("Id, SeqId, ClearId, DeletedAt"),
+		TableName:            aws.String(TOPICS_TABLE),
+	}, func(item map[string]*dynamodb.AttributeValue) error {
+		var topic t.Topic
+		if err := dynamodbattribute.UnmarshalMap(item, &topic); err != nil {
+			return err
+		}
+		return fn(&topic)
+	})
+}
+
+func (a *DynamoDBAdapter) FsckSubs(fn func(*t.Subscription) error) error {
+	return a.fsckScan(&dynamodb.ScanInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#User":  aws.String("User"),
+			"#Topic": aws.String("Topic"),
+		},
+		ProjectionExpression: aws.String("Id, CreatedAt, DeletedAt, #User, #Topic, ModeWant, ModeGiven"),
+		TableName:            aws.String(SUBSCRIPTIONS_TABLE),
+	}, func(item map[string]*dynamodb.AttributeValue) error {
+		var sub t.Subscription
+		if err := dynamodbattribute.UnmarshalMap(item, &sub); err != nil {
+			return err
+		}
+		return fn(&sub)
+	})
+}
+
+func (a *DynamoDBAdapter) FsckAuth(fn func(string, t.Uid) error) error {
+	type Record struct {
+		Unique string `json:"unique"`
+		UserId string `json:"userid"`
+	}
+	return a.fsckScan(&dynamodb.ScanInput{
+		ProjectionExpression: aws.String("unique, userid"),
+		TableName:            aws.String(AUTH_TABLE),
+	}, func(item map[string]*dynamodb.AttributeValue) error {
+		var record Record
+		if err := dynamodbattribute.UnmarshalMap(item, &record); err != nil {
+			return err
+		}
+		return fn(record.Unique, t.ParseUid(record.UserId))
+	})
+}
+
+func (a *DynamoDBAdapter) FsckTags(fn func(string, string) error) error {
+	type TagRecord struct {
+		Id     string
+		Source string
+	}
+	return a.fsckScan(&dynamodb.ScanInput{
+		TableName: aws.String(TAGUNIQUE_TABLE),
+	}, func(item map[string]*dynamodb.AttributeValue) error {
+		var tag TagRecord
+		if err := dynamodbattribute.UnmarshalMap(item, &tag); err != nil {
+			return err
+		}
+		return fn(tag.Id, tag.Source)
+	})
+}
+
+func (a *DynamoDBAdapter) TagDelete(tag string) error {
+	kv, err := dynamodbattribute.MarshalMap(TagUniqueKey{tag})
+	if err != nil {
+		return err
+	}
+	_, err = a.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		Key:       kv,
+		TableName: aws.String(TAGUNIQUE_TABLE),
+	})
+	return err
+}
+
+func deviceHasher(deviceId string) string {
+	// Generate custom key as [64-bit hash of device id] to ensure predictable
+	// length of the key
+	hasher := fnv.New64()
+	hasher.Write([]byte(deviceId))
+	return strconv.FormatUint(uint64(hasher.Sum64()), 16)
+}
+
+func (a *DynamoDBAdapter) DeviceUpsert(uid t.Uid, dev *t.DeviceDef) error {
+	// prepare hash
+	hash := deviceHasher(dev.DeviceId)
+	// prepare key
+	kv, err := dynamodbattribute.MarshalMap(UserKey{uid.String()})
+	if err != nil {
+		return err
+	}
+	// prepare ean, eav, ue
+	ean := map[string]*string{"#device": aws.String(hash)}
+	eav, err := dynamodbattribute.MarshalMap(map[string]*t.DeviceDef{":device": dev})
+	if err != nil {
+		return err
 	}
-	// get devices for each uid
+	ue := aws.String("SET Devices.#device = :device")
+	_, err = a.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  ean,
+		ExpressionAttributeValues: eav,
+		Key:              kv,
+		TableName:        aws.String(USERS_TABLE),
+		UpdateExpression: ue,
+	})
+	return err
+}
+
+// deviceRecord is the projection of the user item which holds the devices
+type deviceRecord struct {
+	Id      string
+	Devices map[string]*t.DeviceDef
+}
+
+// deviceBatchGet loads devices of up to MAX_BATCH_GET_ITEM users. Unprocessed keys are retried with
+// a growing delay so large audiences don't exhaust the read capacity of the users table.
+func (a *DynamoDBAdapter) deviceBatchGet(uids []t.Uid) ([]deviceRecord, error) {
 	var kvs []map[string]*dynamodb.AttributeValue
 	for _, uid := range uids {
 		el, err := dynamodbattribute.MarshalMap(UserKey{uid.String()})
 		if err != nil {
-			kvs = append(kvs, el)
+			return nil, err
 		}
+		kvs = append(kvs, el)
+	}
+	if len(kvs) == 0 {
+		return nil, nil
 	}
 
 	var items []map[string]*dynamodb.AttributeValue
 	requestItems := map[string]*dynamodb.KeysAndAttributes{USERS_TABLE: {Keys: kvs, ProjectionExpression: aws.String("Id, Devices")}}
+	delay := DEVICE_RETRY_DELAY
 	for len(requestItems) > 0 {
 		resUsers, err := a.svc.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: requestItems})
 		if err != nil {
-			if len(items) > 0 {
-				break
-			} else {
-				return nil, 0, err
-			}
+			return nil, err
 		}
 		items = append(items, resUsers.Responses[USERS_TABLE]...)
 		requestItems = resUsers.UnprocessedKeys
+		if len(requestItems) > 0 {
+			time.Sleep(delay)
+			if delay < DEVICE_RETRY_MAX_DELAY {
+				delay *= 2
+			}
+		}
 	}
-	type Record struct {
-		Id      string
-		Devices map[string]*t.DeviceDef
-	}
-	var records []Record
+
+	var records []deviceRecord
 	if err := dynamodbattribute.UnmarshalListOfMaps(items, &records); err != nil {
-		return nil, 0, err
+		return nil, err
 	}
+	return records, nil
+}
 
-	// convert devices map into list for each record, then put it on container map
+func (a *DynamoDBAdapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
 	result := make(map[t.Uid][]t.DeviceDef)
 	count := 0
-	var uid t.Uid
-	for _, record := range records {
-		if len(record.Devices) > 0 {
-			if err := uid.UnmarshalText([]byte(record.Id)); err != nil {
-				log.Print(err.Error())
+	for start := 0; start < len(uids); start += MAX_BATCH_GET_ITEM {
+		end := start + MAX_BATCH_GET_ITEM
+		if end > len(uids) {
+			end = len(uids)
+		}
+		records, err := a.deviceBatchGet(uids[start:end])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// convert devices map into list for each record, then put it on container map
+		for _, record := range records {
+			if len(record.Devices) == 0 {
+				continue
+			}
+			uid := t.ParseUid(record.Id)
+			if uid.IsZero() {
+				logger.Warn("DeviceGetAll: invalid user id", record.Id)
 				continue
 			}
-
-			result[uid] = make([]t.DeviceDef, len(record.Devices))
-			i := 0
 			for _, def := range record.Devices {
 				if def != nil {
-					result[uid][i] = *def
-					i++
+					result[uid] = append(result[uid], *def)
 					count++
 				}
 			}
@@ -2148,6 +3781,40 @@ func (a *DynamoDBAdapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef,
 	return result, count, nil
 }
 
+// DeviceGetPage loads devices of a page of users sorted by user ID and device ID.
+func (a *DynamoDBAdapter) DeviceGetPage(uids []t.Uid, platform string) ([]t.UserDevice, error) {
+	var result []t.UserDevice
+	for start := 0; start < len(uids); start += MAX_BATCH_GET_ITEM {
+		end := start + MAX_BATCH_GET_ITEM
+		if end > len(uids) {
+			end = len(uids)
+		}
+		records, err := a.deviceBatchGet(uids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			uid := t.ParseUid(record.Id)
+			if uid.IsZero() {
+				continue
+			}
+			for _, def := range record.Devices {
+				if def != nil && (platform == "" || def.Platform == platform) {
+					result = append(result, t.UserDevice{User: uid, DeviceDef: *def})
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].User != result[j].User {
+			return result[i].User < result[j].User
+		}
+		return result[i].DeviceId < result[j].DeviceId
+	})
+	return result, nil
+}
+
 func (a *DynamoDBAdapter) DeviceDelete(uid t.Uid, deviceId string) error {
 	// prepare hash
 	hash := deviceHasher(deviceId)
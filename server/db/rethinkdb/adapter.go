@@ -6,11 +6,13 @@ import (
 	"encoding/json"
 	"errors"
 	"hash/fnv"
-	"log"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/store"
 	t "github.com/tinode/chat/server/store/types"
 	rdb "gopkg.in/gorethink/gorethink.v2"
@@ -26,6 +28,8 @@ const (
 	defaultDatabase = "tinode"
 )
 
+var logger = logs.New("rethinkdb")
+
 type configType struct {
 	Database            string      `json:"database,omitempty"`
 	Addresses           interface{} `json:"addresses,omitempty"`
@@ -128,6 +132,10 @@ func (a *RethinkDbAdapter) CreateDb(reset bool) error {
 	if _, err := rdb.DB("tinode").Table("users").IndexCreate("Tags", rdb.IndexCreateOpts{Multi: true}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	// Users are found by their IDs in external systems
+	if _, err := rdb.DB("tinode").Table("users").IndexCreate("ExternalId").RunWrite(a.conn); err != nil {
+		return err
+	}
 	// User authentication records {unique, userid, secret}
 	if _, err := rdb.DB("tinode").TableCreate("auth", rdb.TableCreateOpts{PrimaryKey: "unique"}).RunWrite(a.conn); err != nil {
 		return err
@@ -152,6 +160,9 @@ func (a *RethinkDbAdapter) CreateDb(reset bool) error {
 	if _, err := rdb.DB("tinode").TableCreate("topics", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	if _, err := rdb.DB("tinode").Table("topics").IndexCreate("ExternalId").RunWrite(a.conn); err != nil {
+		return err
+	}
 
 	// Stored message
 	if _, err := rdb.DB("tinode").TableCreate("messages", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
@@ -169,6 +180,13 @@ func (a *RethinkDbAdapter) CreateDb(reset bool) error {
 		}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	// Replies in a thread
+	if _, err := rdb.DB("tinode").Table("messages").IndexCreateFunc("Topic_Thread_SeqId",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("Topic"), row.Field("Thread"), row.Field("SeqId")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
 
 	// Index of unique user contact information as strings, such as "email:jdoe@example.com" or "tel:18003287448":
 	// {Id: <tag>, Source: <uid>} to ensure uniqueness of tags.
@@ -176,6 +194,64 @@ func (a *RethinkDbAdapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Records of file uploads. The files themselves are stored by the media handler.
+	if _, err := rdb.DB("tinode").TableCreate("fileuploads", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index for computing user's quota usage
+	if _, err := rdb.DB("tinode").Table("fileuploads").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Message reminders
+	if _, err := rdb.DB("tinode").TableCreate("reminders", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index for finding due reminders
+	if _, err := rdb.DB("tinode").Table("reminders").IndexCreate("At").RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Messages pending delivery at a later time
+	if _, err := rdb.DB("tinode").TableCreate("scheduled", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index for finding due messages
+	if _, err := rdb.DB("tinode").Table("scheduled").IndexCreate("At").RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Email addresses and phone numbers of users and the state of their validation
+	if _, err := rdb.DB("tinode").TableCreate("credentials", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Diagnostic logs uploaded by clients
+	if _, err := rdb.DB("tinode").TableCreate("clientlogs", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Indexes for finding logs of a support ticket and of a user
+	if _, err := rdb.DB("tinode").Table("clientlogs").IndexCreate("Ticket").RunWrite(a.conn); err != nil {
+		return err
+	}
+	if _, err := rdb.DB("tinode").Table("clientlogs").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Contact lists, two records per pair of contacts
+	if _, err := rdb.DB("tinode").TableCreate("contacts", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index for loading the contact list of a user
+	if _, err := rdb.DB("tinode").Table("contacts").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Journal of multi-step operations
+	if _, err := rdb.DB("tinode").TableCreate("journal", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -246,7 +322,7 @@ func (a *RethinkDbAdapter) DelAllAuthRecords(uid t.Uid) (int, error) {
 
 // Update user's authentication secret
 func (a *RethinkDbAdapter) UpdAuthRecord(unique string, authLvl int, secret []byte, expires time.Time) (int, error) {
-	log.Println("Updating for unique", unique)
+	logger.Debug("Updating for unique", unique)
 
 	res, err := rdb.DB(a.dbName).Table("auth").Get(unique).Update(
 		map[string]interface{}{
@@ -364,6 +440,38 @@ func (a *RethinkDbAdapter) UserUpdate(uid t.Uid, update map[string]interface{})
 	return err
 }
 
+// externalIdValue returns the value of the ExternalId field for an update: an empty ID removes the field.
+func externalIdValue(extId string) interface{} {
+	if extId == "" {
+		return rdb.Literal()
+	}
+	return extId
+}
+
+// UserSetExternalId sets or clears the ID of the user in an external system
+func (a *RethinkDbAdapter) UserSetExternalId(uid t.Uid, extId string) error {
+	_, err := rdb.DB(a.dbName).Table("users").Get(uid.String()).
+		Update(map[string]interface{}{"ExternalId": externalIdValue(extId), "UpdatedAt": t.TimeNow()}).
+		RunWrite(a.conn)
+	return err
+}
+
+// UserGetByExternalId loads the user with the given external ID, returns (nil, nil) if not found.
+// Deleted users are not found.
+func (a *RethinkDbAdapter) UserGetByExternalId(extId string) (*t.User, error) {
+	rows, err := rdb.DB(a.dbName).Table("users").GetAllByIndex("ExternalId", extId).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).Limit(1).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []t.User
+	if err = rows.All(&users); err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
 // *****************************
 
 // TopicCreate creates a topic from template
@@ -418,6 +526,64 @@ func (a *RethinkDbAdapter) TopicGet(topic string) (*t.Topic, error) {
 	return tt, rows.Err()
 }
 
+// TopicsWebIndex loads topics published on the web which may be indexed. Only Id, UpdatedAt, SeqId and Public
+// are loaded.
+func (a *RethinkDbAdapter) TopicsWebIndex(limit int) ([]t.Topic, error) {
+	rows, err := rdb.DB(a.dbName).Table("topics").
+		Filter(map[string]interface{}{"WebView": true, "WebIndex": true}).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).
+		Pluck("Id", "CreatedAt", "UpdatedAt", "SeqId", "Public").Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []t.Topic
+	err = rows.All(&topics)
+	return topics, err
+}
+
+// TopicsDigest loads topics with periodic digests enabled. Only Id, SeqId, Public and digest fields are loaded.
+func (a *RethinkDbAdapter) TopicsDigest() ([]t.Topic, error) {
+	rows, err := rdb.DB(a.dbName).Table("topics").Filter(rdb.Row.Field("Digest").Default("").Ne("")).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).
+		Pluck("Id", "SeqId", "Public", "Digest", "DigestAt", "DigestSeq").Limit(MAX_RESULTS).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []t.Topic
+	err = rows.All(&topics)
+	return topics, err
+}
+
+// TopicsScripted loads topics with automation scripts. Only Id and Scripts are loaded.
+func (a *RethinkDbAdapter) TopicsScripted() ([]t.Topic, error) {
+	rows, err := rdb.DB(a.dbName).Table("topics").Filter(rdb.Row.HasFields("Scripts")).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).
+		Pluck("Id", "Scripts").Limit(MAX_RESULTS).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []t.Topic
+	err = rows.All(&topics)
+	return topics, err
+}
+
+// TopicsExpiring loads topics with a message TTL. Only Id, SeqId, ClearId and MessageTtl are loaded.
+func (a *RethinkDbAdapter) TopicsExpiring() ([]t.Topic, error) {
+	rows, err := rdb.DB(a.dbName).Table("topics").Filter(rdb.Row.Field("MessageTtl").Default(0).Gt(0)).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).
+		Pluck("Id", "SeqId", "ClearId", "MessageTtl").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []t.Topic
+	err = rows.All(&topics)
+	return topics, err
+}
+
 // TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' subscription.
 // Reads and denormalizes Public value.
 func (a *RethinkDbAdapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription, error) {
@@ -484,8 +650,8 @@ func (a *RethinkDbAdapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subsc
 			sub.ObjHeader.MergeTimes(&top.ObjHeader)
 			sub.SetSeqId(top.SeqId)
 			sub.SetHardClearId(top.ClearId)
-			if t.GetTopicCat(sub.Topic) == t.TopicCat_Grp {
-				// all done with a grp topic
+			if t.GetTopicCat(sub.Topic) != t.TopicCat_P2P {
+				// all done with a grp or chn topic
 				sub.SetPublic(top.Public)
 				subs = append(subs, sub)
 			} else {
@@ -624,6 +790,30 @@ func (a *RethinkDbAdapter) TopicUpdate(topic string, update map[string]interface
 	return err
 }
 
+// TopicSetExternalId sets or clears the ID of the topic in an external system
+func (a *RethinkDbAdapter) TopicSetExternalId(topic string, extId string) error {
+	_, err := rdb.DB(a.dbName).Table("topics").Get(topic).
+		Update(map[string]interface{}{"ExternalId": externalIdValue(extId), "UpdatedAt": t.TimeNow()}).
+		RunWrite(a.conn)
+	return err
+}
+
+// TopicGetByExternalId loads the topic with the given external ID, returns (nil, nil) if not found.
+// Deleted topics are not found.
+func (a *RethinkDbAdapter) TopicGetByExternalId(extId string) (*t.Topic, error) {
+	rows, err := rdb.DB(a.dbName).Table("topics").GetAllByIndex("ExternalId", extId).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).Limit(1).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []t.Topic
+	if err = rows.All(&topics); err != nil || len(topics) == 0 {
+		return nil, err
+	}
+	return &topics[0], nil
+}
+
 // Get a subscription of a user to a topic
 func (a *RethinkDbAdapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, error) {
 
@@ -736,6 +926,26 @@ func (a *RethinkDbAdapter) SubsUpdate(topic string, user t.Uid, update map[strin
 	return err
 }
 
+// SubsOwnerChange updates subscriptions of the old and the new owner in one query. RethinkDB has no
+// multi-document transactions, each document is updated atomically.
+func (a *RethinkDbAdapter) SubsOwnerChange(topic string, oldOwner, newOwner *t.Subscription) error {
+	now := t.TimeNow()
+	_, err := rdb.DB(a.dbName).Table("subscriptions").
+		GetAll(topic+":"+newOwner.User, topic+":"+oldOwner.User).
+		Update(func(row rdb.Term) interface{} {
+			return rdb.Branch(row.Field("User").Eq(newOwner.User),
+				map[string]interface{}{
+					"ModeWant":  int(newOwner.ModeWant),
+					"ModeGiven": int(newOwner.ModeGiven),
+					"UpdatedAt": now},
+				map[string]interface{}{
+					"ModeWant":  int(oldOwner.ModeWant),
+					"ModeGiven": int(oldOwner.ModeGiven),
+					"UpdatedAt": now})
+		}).RunWrite(a.conn)
+	return err
+}
+
 // SubsDelete marks subscription as deleted.
 func (a *RethinkDbAdapter) SubsDelete(topic string, user t.Uid) error {
 	now := t.TimeNow()
@@ -760,22 +970,41 @@ func (a *RethinkDbAdapter) SubsDelForTopic(topic string) error {
 	return err
 }
 
-// Returns a list of users who match given tags, such as "email:jdoe@example.com" or "tel:18003287448".
+// Returns a list of at most limit users who match given tags, such as "email:jdoe@example.com" or "tel:18003287448".
 // Just search the 'users.Tags' for the given tags using respective index.
-func (a *RethinkDbAdapter) FindSubs(uid t.Uid, query []interface{}) ([]t.Subscription, error) {
+func (a *RethinkDbAdapter) FindSubs(uid t.Uid, tags, prefixes []string, limit int) ([]t.Subscription, error) {
+	index := make(map[string]struct{})
+	var query []interface{}
+	for _, tag := range tags {
+		index[tag] = struct{}{}
+		query = append(query, tag)
+	}
+
+	// Exact tags are looked up in the index, prefixes are ranges of the index
+	users := rdb.DB(a.dbName).Table("users")
+	var terms []interface{}
+	if len(query) > 0 {
+		terms = append(terms, users.GetAllByIndex("Tags", query...))
+	}
+	for _, prefix := range prefixes {
+		terms = append(terms, users.Between(prefix, prefix+"\uffff", rdb.BetweenOpts{Index: "Tags"}))
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	q := terms[0].(rdb.Term)
+	if len(terms) > 1 {
+		q = q.Union(terms[1:]...)
+	}
+
 	// Query may contain redundant records, i.e. the same email twice.
 	// User could be matched on multiple tags, i.e on email and phone#. Thus the query may
 	// return duplicate users. Thus the need for distinct.
-	if rows, err := rdb.DB(a.dbName).Table("users").GetAllByIndex("Tags", query...).Limit(MAX_RESULTS).
-		Pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Tags").Distinct().Run(a.conn); err != nil {
+	// The caller is skipped, thus one extra.
+	if rows, err := q.Pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Tags").Distinct().
+		Limit(limit + 1).Run(a.conn); err != nil {
 		return nil, err
 	} else {
-		index := make(map[string]struct{})
-		for _, q := range query {
-			if tag, ok := q.(string); ok {
-				index[tag] = struct{}{}
-			}
-		}
 		var user t.User
 		var sub t.Subscription
 		var subs []t.Subscription
@@ -792,14 +1021,24 @@ func (a *RethinkDbAdapter) FindSubs(uid t.Uid, query []interface{}) ([]t.Subscri
 			sub.SetPublic(user.Public)
 			// TODO: maybe report default access to user
 			// sub.SetDefaultAccess(user.Access.Auth, user.Access.Anon)
-			tags := make([]string, 0, 1)
+			matched := make([]string, 0, 1)
 			for _, tag := range user.Tags {
 				if _, ok := index[tag]; ok {
-					tags = append(tags, tag)
+					matched = append(matched, tag)
+					continue
+				}
+				for _, prefix := range prefixes {
+					if strings.HasPrefix(tag, prefix) {
+						matched = append(matched, tag)
+						break
+					}
 				}
 			}
-			sub.Private = tags
+			sub.Private = matched
 			subs = append(subs, sub)
+			if len(subs) == limit {
+				break
+			}
 		}
 		if err = rows.Err(); err != nil {
 			return nil, err
@@ -853,11 +1092,33 @@ func (a *RethinkDbAdapter) MessageGetAll(topic string, forUser t.Uid, opts *t.Br
 		}
 	}
 
-	lower = []interface{}{topic, lower}
-	upper = []interface{}{topic, upper}
+	orderIndex := "Topic_SeqId"
+	var thread int
+	if opts != nil {
+		thread = opts.Thread
+	}
+	if thread > 0 && useIndex == "Topic_SeqId" {
+		// Replies in the thread only
+		useIndex = "Topic_Thread_SeqId"
+		orderIndex = useIndex
+		lower = []interface{}{topic, thread, lower}
+		upper = []interface{}{topic, thread, upper}
+	} else {
+		lower = []interface{}{topic, lower}
+		upper = []interface{}{topic, upper}
+	}
 
-	rows, err := rdb.DB(a.dbName).Table("messages").Between(lower, upper, rdb.BetweenOpts{Index: useIndex}).
-		OrderBy(rdb.OrderByOpts{Index: rdb.Desc("Topic_SeqId")}).Limit(limit).Run(a.conn)
+	q := rdb.DB(a.dbName).Table("messages").Between(lower, upper, rdb.BetweenOpts{Index: useIndex}).
+		OrderBy(rdb.OrderByOpts{Index: rdb.Desc(orderIndex)})
+	if thread > 0 && useIndex != "Topic_Thread_SeqId" {
+		q = q.Filter(map[string]interface{}{"Thread": thread})
+	}
+	if opts != nil && !opts.Mentions.IsZero() {
+		// Messages which list the user in the comma-separated Head.mentions
+		q = q.Filter(rdb.Row.Field("Head").Field("mentions").Default("").Split(",").
+			Contains(opts.Mentions.UserId()))
+	}
+	rows, err := q.Limit(limit).Run(a.conn)
 
 	if err != nil {
 		return nil, err
@@ -881,6 +1142,36 @@ func (a *RethinkDbAdapter) MessageGetAll(topic string, forUser t.Uid, opts *t.Br
 	return msgs, rows.Err()
 }
 
+// MessageGetList loads the messages with the seq IDs from the list in a single query
+func (a *RethinkDbAdapter) MessageGetList(topic string, forUser t.Uid, list []int) ([]t.Message, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	var indexVals []interface{}
+	for _, seq := range list {
+		indexVals = append(indexVals, []interface{}{topic, seq})
+	}
+	rows, err := rdb.DB(a.dbName).Table("messages").GetAllByIndex("Topic_SeqId", indexVals...).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	rows.All(&msgs)
+
+	requester := forUser.String()
+	for i := 0; i < len(msgs); i++ {
+		for j := 0; j < len(msgs[i].DeletedFor); j++ {
+			if msgs[i].DeletedFor[j].User == requester {
+				msgs[i].DeletedAt = &msgs[i].DeletedFor[j].Timestamp
+			}
+		}
+	}
+
+	return msgs, rows.Err()
+}
+
 // MessageDeleteAll hard-deletes messages in the given topic
 func (a *RethinkDbAdapter) MessageDeleteAll(topic string, clear int) error {
 	var maxval interface{} = clear
@@ -916,6 +1207,69 @@ func (a *RethinkDbAdapter) MessageDeleteList(topic string, forUser t.Uid, hard b
 	return err
 }
 
+// MessageSearch finds messages which contain the query string. The match is case-insensitive.
+// Non-string content is matched in its JSON representation.
+func (a *RethinkDbAdapter) MessageSearch(topic string, forUser t.Uid, query string, opts *t.BrowseOpt) ([]t.Message, error) {
+	var limit uint = 1024
+	var lower, upper interface{} = rdb.MinVal, rdb.MaxVal
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			upper = opts.Before
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	rows, err := rdb.DB(a.dbName).Table("messages").
+		Between([]interface{}{topic, lower}, []interface{}{topic, upper}, rdb.BetweenOpts{Index: "Topic_SeqId"}).
+		OrderBy(rdb.OrderByOpts{Index: rdb.Desc("Topic_SeqId")}).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).
+		Filter(rdb.Row.Field("DeletedFor").Default([]interface{}{}).Contains(func(del rdb.Term) rdb.Term {
+			return del.Field("User").Eq(forUser.String())
+		}).Not()).
+		Filter(rdb.Row.Field("Content").CoerceTo("string").Match("(?i)" + regexp.QuoteMeta(query))).
+		Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	rows.All(&msgs)
+	return msgs, rows.Err()
+}
+
+// MessageUpdate updates part of a message
+func (a *RethinkDbAdapter) MessageUpdate(topic string, seqId int, update map[string]interface{}) error {
+	_, err := rdb.DB(a.dbName).Table("messages").GetAllByIndex("Topic_SeqId", []interface{}{topic, seqId}).
+		Update(update).RunWrite(a.conn)
+	return err
+}
+
+// MessageFirstAfter returns SeqId of the first message starting with since which was created after the given time
+func (a *RethinkDbAdapter) MessageFirstAfter(topic string, since int, after time.Time) (int, error) {
+	rows, err := rdb.DB(a.dbName).Table("messages").
+		Between([]interface{}{topic, since}, []interface{}{topic, rdb.MaxVal}, rdb.BetweenOpts{Index: "Topic_SeqId"}).
+		OrderBy(rdb.OrderByOpts{Index: "Topic_SeqId"}).
+		Filter(rdb.Row.Field("CreatedAt").Gt(after)).Limit(1).Field("SeqId").Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if rows.IsNil() {
+		rows.Close()
+		return 0, nil
+	}
+
+	var seq int
+	err = rows.One(&seq)
+	return seq, err
+}
+
 /*
 func addOptions(q rdb.Term, value string, index string, opts *t.BrowseOpt) rdb.Term {
 	var limit uint = 1024 // TODO(gene): pass into adapter as a config param
@@ -960,6 +1314,364 @@ func deviceHasher(deviceId string) string {
 	return strconv.FormatUint(uint64(hasher.Sum64()), 16)
 }
 
+// FileStartUpload initializes a file upload
+func (a *RethinkDbAdapter) FileStartUpload(fd *t.FileDef) error {
+	_, err := rdb.DB(a.dbName).Table("fileuploads").Insert(fd).RunWrite(a.conn)
+	return err
+}
+
+// FileFinishUpload marks file upload as completed or failed
+func (a *RethinkDbAdapter) FileFinishUpload(fd *t.FileDef) error {
+	_, err := rdb.DB(a.dbName).Table("fileuploads").Get(fd.Id).
+		Update(map[string]interface{}{
+			"UpdatedAt": fd.UpdatedAt,
+			"Status":    fd.Status,
+			"Location":  fd.Location,
+			"Size":      fd.Size,
+		}).RunWrite(a.conn)
+	return err
+}
+
+// FileGet fetches a record of a specific file
+func (a *RethinkDbAdapter) FileGet(fid string) (*t.FileDef, error) {
+	rows, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.IsNil() {
+		rows.Close()
+		return nil, nil
+	}
+
+	var fd = new(t.FileDef)
+	if err = rows.One(fd); err != nil {
+		return nil, err
+	}
+
+	return fd, rows.Err()
+}
+
+// FileUsage returns total size of files uploaded by the user
+func (a *RethinkDbAdapter) FileUsage(uid t.Uid) (int64, error) {
+	rows, err := rdb.DB(a.dbName).Table("fileuploads").GetAllByIndex("User", uid.String()).
+		Filter(map[string]interface{}{"Status": t.UploadCompleted}).Sum("Size").Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	err = rows.One(&total)
+	return total, err
+}
+
+// ReminderUpsert creates a new reminder or replaces an existing one
+func (a *RethinkDbAdapter) ReminderUpsert(r *t.Reminder) error {
+	_, err := rdb.DB(a.dbName).Table("reminders").Insert(r, rdb.InsertOpts{Conflict: "replace"}).RunWrite(a.conn)
+	return err
+}
+
+// ReminderDelete deletes a reminder
+func (a *RethinkDbAdapter) ReminderDelete(id string) error {
+	_, err := rdb.DB(a.dbName).Table("reminders").Get(id).Delete().RunWrite(a.conn)
+	return err
+}
+
+// RemindersDue loads reminders which are due at or before the given time. The cursor is read until
+// limit reminders are accepted by keep.
+func (a *RethinkDbAdapter) RemindersDue(until time.Time, limit int, keep func(*t.Reminder) bool) ([]t.Reminder, error) {
+	rows, err := rdb.DB(a.dbName).Table("reminders").
+		Between(rdb.MinVal, until, rdb.BetweenOpts{Index: "At", RightBound: "closed"}).
+		OrderBy(rdb.OrderByOpts{Index: "At"}).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reminders []t.Reminder
+	var rem t.Reminder
+	for len(reminders) < limit && rows.Next(&rem) {
+		if keep == nil || keep(&rem) {
+			reminders = append(reminders, rem)
+		}
+		rem = t.Reminder{}
+	}
+	return reminders, rows.Err()
+}
+
+// ScheduledSave stores a message for delivery at a later time
+func (a *RethinkDbAdapter) ScheduledSave(msg *t.ScheduledMessage) error {
+	_, err := rdb.DB(a.dbName).Table("scheduled").Insert(msg).RunWrite(a.conn)
+	return err
+}
+
+// ScheduledDelete deletes a scheduled message
+func (a *RethinkDbAdapter) ScheduledDelete(id string) error {
+	_, err := rdb.DB(a.dbName).Table("scheduled").Get(id).Delete().RunWrite(a.conn)
+	return err
+}
+
+// ScheduledDue loads scheduled messages which are due at or before the given time. The cursor is read
+// until limit messages are accepted by keep.
+func (a *RethinkDbAdapter) ScheduledDue(until time.Time, limit int,
+	keep func(*t.ScheduledMessage) bool) ([]t.ScheduledMessage, error) {
+	rows, err := rdb.DB(a.dbName).Table("scheduled").
+		Between(rdb.MinVal, until, rdb.BetweenOpts{Index: "At", RightBound: "closed"}).
+		OrderBy(rdb.OrderByOpts{Index: "At"}).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []t.ScheduledMessage
+	var msg t.ScheduledMessage
+	for len(msgs) < limit && rows.Next(&msg) {
+		if keep == nil || keep(&msg) {
+			msgs = append(msgs, msg)
+		}
+		msg = t.ScheduledMessage{}
+	}
+	return msgs, rows.Err()
+}
+
+// CredUpsert creates a new credential or replaces an existing one
+func (a *RethinkDbAdapter) CredUpsert(cred *t.Credential) error {
+	_, err := rdb.DB(a.dbName).Table("credentials").Insert(cred, rdb.InsertOpts{Conflict: "replace"}).RunWrite(a.conn)
+	return err
+}
+
+// CredGet loads a credential by Id
+func (a *RethinkDbAdapter) CredGet(id string) (*t.Credential, error) {
+	rows, err := rdb.DB(a.dbName).Table("credentials").Get(id).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.IsNil() {
+		rows.Close()
+		return nil, nil
+	}
+
+	var cred = new(t.Credential)
+	if err = rows.One(cred); err != nil {
+		return nil, err
+	}
+
+	return cred, rows.Err()
+}
+
+// CredDelete deletes a credential
+func (a *RethinkDbAdapter) CredDelete(id string) error {
+	_, err := rdb.DB(a.dbName).Table("credentials").Get(id).Delete().RunWrite(a.conn)
+	return err
+}
+
+// ClientLogUpsert creates a new client log record or replaces an existing one
+func (a *RethinkDbAdapter) ClientLogUpsert(cl *t.ClientLog) error {
+	_, err := rdb.DB(a.dbName).Table("clientlogs").Insert(cl, rdb.InsertOpts{Conflict: "replace"}).RunWrite(a.conn)
+	return err
+}
+
+// ClientLogGet loads a client log record by Id
+func (a *RethinkDbAdapter) ClientLogGet(id string) (*t.ClientLog, error) {
+	rows, err := rdb.DB(a.dbName).Table("clientlogs").Get(id).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.IsNil() {
+		rows.Close()
+		return nil, nil
+	}
+
+	var cl = new(t.ClientLog)
+	if err = rows.One(cl); err != nil {
+		return nil, err
+	}
+
+	return cl, rows.Err()
+}
+
+// ClientLogFind loads records of logs by ticket and/or user, newest first
+func (a *RethinkDbAdapter) ClientLogFind(ticket string, user t.Uid, limit int) ([]t.ClientLog, error) {
+	q := rdb.DB(a.dbName).Table("clientlogs")
+	if ticket != "" {
+		q = q.GetAllByIndex("Ticket", ticket)
+		if !user.IsZero() {
+			q = q.Filter(map[string]interface{}{"User": user.String()})
+		}
+	} else if !user.IsZero() {
+		q = q.GetAllByIndex("User", user.String())
+	}
+
+	rows, err := q.OrderBy(rdb.Desc("CreatedAt")).Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []t.ClientLog
+	err = rows.All(&logs)
+	return logs, err
+}
+
+// ContactUpsert creates contact records or replaces existing ones
+func (a *RethinkDbAdapter) ContactUpsert(contacts ...*t.ContactRecord) error {
+	_, err := rdb.DB(a.dbName).Table("contacts").Insert(contacts, rdb.InsertOpts{Conflict: "replace"}).
+		RunWrite(a.conn)
+	return err
+}
+
+// ContactGetAll loads the contact list of the user
+func (a *RethinkDbAdapter) ContactGetAll(user t.Uid) ([]t.ContactRecord, error) {
+	rows, err := rdb.DB(a.dbName).Table("contacts").GetAllByIndex("User", user.String()).
+		Limit(MAX_RESULTS).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []t.ContactRecord
+	err = rows.All(&contacts)
+	return contacts, err
+}
+
+// ContactDelete deletes the contact records of both users
+func (a *RethinkDbAdapter) ContactDelete(user, contact t.Uid) error {
+	_, err := rdb.DB(a.dbName).Table("contacts").
+		GetAll(user.String()+":"+contact.String(), contact.String()+":"+user.String()).Delete().RunWrite(a.conn)
+	return err
+}
+
+// OperationUpsert saves a journal record of an operation
+func (a *RethinkDbAdapter) OperationUpsert(op *t.Operation) error {
+	_, err := rdb.DB(a.dbName).Table("journal").Insert(op, rdb.InsertOpts{Conflict: "replace"}).RunWrite(a.conn)
+	return err
+}
+
+// OperationGetAll loads all journal records, oldest first
+func (a *RethinkDbAdapter) OperationGetAll() ([]t.Operation, error) {
+	rows, err := rdb.DB(a.dbName).Table("journal").OrderBy("CreatedAt").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	var ops []t.Operation
+	err = rows.All(&ops)
+	return ops, err
+}
+
+// OperationDelete deletes a journal record
+func (a *RethinkDbAdapter) OperationDelete(id string) error {
+	_, err := rdb.DB(a.dbName).Table("journal").Get(id).Delete().RunWrite(a.conn)
+	return err
+}
+
+// TagsDeleteForUser deletes unique tags of the user. The table has no index by Source, it's scanned.
+func (a *RethinkDbAdapter) TagsDeleteForUser(uid t.Uid) error {
+	_, err := rdb.DB(a.dbName).Table("tagunique").Filter(map[string]interface{}{"Source": uid.String()}).
+		Delete().RunWrite(a.conn)
+	return err
+}
+
+// FsckUsers scans all user records
+func (a *RethinkDbAdapter) FsckUsers(fn func(*t.User) error) error {
+	rows, err := rdb.DB(a.dbName).Table("users").Pluck("Id", "DeletedAt", "Tags").Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var user t.User
+	for rows.Next(&user) {
+		if err = fn(&user); err != nil {
+			return err
+		}
+		user = t.User{}
+	}
+	return rows.Err()
+}
+
+// FsckTopics scans all topic records
+func (a *RethinkDbAdapter) FsckTopics(fn func(*t.Topic) error) error {
+	rows, err := rdb.DB(a.dbName).Table("topics").Pluck("Id", "SeqId", "ClearId", "DeletedAt").Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var topic t.Topic
+	for rows.Next(&topic) {
+		if err = fn(&topic); err != nil {
+			return err
+		}
+		topic = t.Topic{}
+	}
+	return rows.Err()
+}
+
+// FsckSubs scans all subscriptions
+func (a *RethinkDbAdapter) FsckSubs(fn func(*t.Subscription) error) error {
+	rows, err := rdb.DB(a.dbName).Table("subscriptions").
+		Pluck("Id", "CreatedAt", "DeletedAt", "User", "Topic", "ModeWant", "ModeGiven").Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var sub t.Subscription
+	for rows.Next(&sub) {
+		if err = fn(&sub); err != nil {
+			return err
+		}
+		sub = t.Subscription{}
+	}
+	return rows.Err()
+}
+
+// FsckAuth scans all authentication records
+func (a *RethinkDbAdapter) FsckAuth(fn func(string, t.Uid) error) error {
+	rows, err := rdb.DB(a.dbName).Table("auth").Pluck("unique", "userid").Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var record struct {
+		Unique string `gorethink:"unique"`
+		Userid string `gorethink:"userid"`
+	}
+	for rows.Next(&record) {
+		if err = fn(record.Unique, t.ParseUid(record.Userid)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// FsckTags scans all unique tags
+func (a *RethinkDbAdapter) FsckTags(fn func(string, string) error) error {
+	rows, err := rdb.DB(a.dbName).Table("tagunique").Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var tag struct {
+		Id     string
+		Source string
+	}
+	for rows.Next(&tag) {
+		if err = fn(tag.Id, tag.Source); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// TagDelete deletes a unique tag
+func (a *RethinkDbAdapter) TagDelete(tag string) error {
+	_, err := rdb.DB(a.dbName).Table("tagunique").Get(tag).Delete().RunWrite(a.conn)
+	return err
+}
+
 // Device management for push notifications
 func (a *RethinkDbAdapter) DeviceUpsert(user t.Uid, def *t.DeviceDef) error {
 	hash := deviceHasher(def.DeviceId)
@@ -995,7 +1707,7 @@ func (a *RethinkDbAdapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef,
 	for rows.Next(&row) {
 		if row.Devices != nil && len(row.Devices) > 0 {
 			if err := uid.UnmarshalText([]byte(row.Id)); err != nil {
-				log.Print(err.Error())
+				logger.Warn(err.Error())
 				continue
 			}
 
@@ -1014,6 +1726,58 @@ func (a *RethinkDbAdapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef,
 	return result, count, rows.Err()
 }
 
+// DeviceGetPage loads devices of a page of users sorted by user ID and device ID.
+func (a *RethinkDbAdapter) DeviceGetPage(uids []t.Uid, platform string) ([]t.UserDevice, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]interface{}, len(uids))
+	for i, id := range uids {
+		ids[i] = id.String()
+	}
+
+	rows, err := rdb.DB(a.dbName).Table("users").GetAll(ids...).Pluck("Id", "Devices").
+		Default(nil).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var row struct {
+		Id      string
+		Devices map[string]*t.DeviceDef
+	}
+
+	var result []t.UserDevice
+	for rows.Next(&row) {
+		if len(row.Devices) == 0 {
+			continue
+		}
+		uid := t.ParseUid(row.Id)
+		if uid.IsZero() {
+			logger.Warn("DeviceGetPage: invalid user id", row.Id)
+			continue
+		}
+		for _, def := range row.Devices {
+			if def != nil && (platform == "" || def.Platform == platform) {
+				result = append(result, t.UserDevice{User: uid, DeviceDef: *def})
+			}
+		}
+		row.Devices = nil
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].User != result[j].User {
+			return result[i].User < result[j].User
+		}
+		return result[i].DeviceId < result[j].DeviceId
+	})
+	return result, nil
+}
+
 func (a *RethinkDbAdapter) DeviceDelete(uid t.Uid, deviceId string) error {
 	_, err := rdb.DB(a.dbName).Table("users").Get(uid.String()).Replace(rdb.Row.Without(
 		map[string]string{"Devices": deviceHasher(deviceId)})).RunWrite(a.conn)
@@ -0,0 +1,277 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Periodic digests of group topics. The topic owner enables digests by
+ *  setting desc.digest to "daily" or "weekly". A background job posts a
+ *  summary of the period into the topic: number of messages, the most active
+ *  members and the most replied-to messages.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default interval between checks for due digests
+	DIGEST_DEFAULT_INTERVAL = 15 * time.Minute
+	// Default number of top members and threads listed in a digest
+	DIGEST_DEFAULT_TOP = 3
+	// Maximum length of the message snippet in a digest
+	DIGEST_SNIPPET_LENGTH = 60
+)
+
+type digestConfig struct {
+	// Enable periodic digests
+	Enabled bool `json:"enabled"`
+	// How often to check for due digests, seconds
+	CheckInterval int `json:"check_interval"`
+	// Number of top members and threads to list
+	Top int `json:"top"`
+}
+
+var digests struct {
+	top int
+	// Exported counter of posted digests
+	posted *expvar.Int
+}
+
+// Duration of the digest period by name.
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// isValidDigest checks if the digest period is known. An empty value disables digests.
+func isValidDigest(period string) bool {
+	if period == "" {
+		return true
+	}
+	_, ok := digestPeriods[period]
+	return ok
+}
+
+// digestInit parses config and starts the background job. Digests are off by default.
+func digestInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config digestConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logDigest.Fatal("Failed to parse digest config:", err)
+	}
+
+	if !config.Enabled {
+		return
+	}
+
+	interval := time.Duration(config.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = DIGEST_DEFAULT_INTERVAL
+	}
+	digests.top = config.Top
+	if digests.top <= 0 {
+		digests.top = DIGEST_DEFAULT_TOP
+	}
+	digests.posted = new(expvar.Int)
+	expvar.Publish("DigestsPosted", digests.posted)
+
+	go digestRun(interval)
+	logDigest.Infof("Posting topic digests, checking every %s", interval)
+}
+
+func digestRun(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if isStandby() {
+			// Digests are posted by the primary region
+			continue
+		}
+
+		topics, err := store.Topics.GetDigest()
+		if err != nil {
+			logDigest.Warn("digest: failed to load topics", err)
+			continue
+		}
+
+		now := types.TimeNow()
+		for i := range topics {
+			topic := &topics[i]
+			period, ok := digestPeriods[topic.Digest]
+			if !ok || now.Sub(topic.DigestAt) < period {
+				continue
+			}
+			// Only the cluster node which owns the topic posts the digest
+			if globals.cluster.isRemoteTopic(topic.Id) {
+				continue
+			}
+			if err := digestPost(topic, now); err != nil {
+				logDigest.Warnf("digest: topic '%s' %v", topic.Id, err)
+			}
+		}
+	}
+}
+
+// Per-period activity of the topic.
+type digestStats struct {
+	messages int
+	posters  map[string]int
+	replies  map[int]int
+	snippets map[int]string
+	lastSeq  int
+}
+
+// digestPost collects statistics of the topic since the last digest and posts the summary into the topic.
+// Only the most recent messages are counted, up to the adapter limit.
+func digestPost(topic *types.Topic, now time.Time) error {
+	msgs, err := store.Messages.GetAll(topic.Id, types.ZeroUid, &types.BrowseOpt{Since: topic.DigestSeq + 1})
+	if err != nil {
+		return err
+	}
+
+	stats := digestCollect(msgs)
+	if stats.lastSeq < topic.DigestSeq {
+		stats.lastSeq = topic.DigestSeq
+	}
+
+	if stats.messages > 0 {
+		globals.hub.route <- &ServerComMessage{
+			Data: &MsgServerData{
+				Topic:     topic.Id,
+				Timestamp: now,
+				Head:      map[string]string{"digest": topic.Digest},
+				Content:   digestFormat(topic, stats)},
+			rcptto:    topic.Id,
+			timestamp: now}
+		digests.posted.Add(1)
+	}
+
+	// The digest message itself will be skipped by the next digest
+	return store.Topics.Update(topic.Id, map[string]interface{}{
+		"DigestAt":  now,
+		"DigestSeq": stats.lastSeq})
+}
+
+// digestCollect calculates statistics of messages. Replies reference the original message by
+// its seq ID in head.reply. Earlier digests and deleted messages are skipped.
+func digestCollect(msgs []types.Message) *digestStats {
+	stats := &digestStats{
+		posters:  make(map[string]int),
+		replies:  make(map[int]int),
+		snippets: make(map[int]string)}
+
+	for i := range msgs {
+		mm := &msgs[i]
+		if mm.SeqId > stats.lastSeq {
+			stats.lastSeq = mm.SeqId
+		}
+		if mm.DeletedAt != nil || mm.Head["digest"] != "" {
+			continue
+		}
+
+		stats.messages++
+		if mm.From != "" {
+			stats.posters[mm.From]++
+		}
+		if reply, err := strconv.Atoi(mm.Head["reply"]); err == nil && reply > 0 {
+			stats.replies[reply]++
+		}
+		stats.snippets[mm.SeqId] = webViewSnippet(webFeedSanitize(webViewText(mm.Content)), DIGEST_SNIPPET_LENGTH)
+	}
+	return stats
+}
+
+// digestFormat generates plain text of the digest.
+func digestFormat(topic *types.Topic, stats *digestStats) string {
+	var buf bytes.Buffer
+
+	title := "Daily"
+	if topic.Digest == "weekly" {
+		title = "Weekly"
+	}
+	fmt.Fprintf(&buf, "%s digest: %d messages from %d members", title, stats.messages, len(stats.posters))
+
+	posters := digestTop(stats.posters, digests.top)
+	if len(posters) > 0 {
+		buf.WriteString("\nMost active:")
+		names := digestNames(posters)
+		for i, from := range posters {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, " %s (%d)", names[from], stats.posters[from])
+		}
+	}
+
+	threads := make(map[string]int, len(stats.replies))
+	for seq, count := range stats.replies {
+		threads[strconv.Itoa(seq)] = count
+	}
+	if top := digestTop(threads, digests.top); len(top) > 0 {
+		buf.WriteString("\nTop threads:")
+		for _, key := range top {
+			seq, _ := strconv.Atoi(key)
+			fmt.Fprintf(&buf, "\n #%d, %d replies", seq, threads[key])
+			if snippet := stats.snippets[seq]; snippet != "" {
+				buf.WriteString(": " + snippet)
+			}
+		}
+	}
+
+	return buf.String()
+}
+
+// digestTop returns up to n keys with the highest counts.
+func digestTop(counts map[string]int, n int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] == counts[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return counts[keys[i]] > counts[keys[j]]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// digestNames maps user IDs to public names, falling back to usrXXX.
+func digestNames(uids []string) map[string]string {
+	names := make(map[string]string, len(uids))
+	query := make([]types.Uid, 0, len(uids))
+	for _, id := range uids {
+		uid := types.ParseUid(id)
+		names[id] = uid.UserId()
+		query = append(query, uid)
+	}
+
+	if users, err := store.Users.GetAll(query...); err == nil {
+		for i := range users {
+			if public, ok := users[i].Public.(map[string]interface{}); ok {
+				if fn, ok := public["fn"].(string); ok && fn != "" {
+					names[users[i].Id] = fn
+				}
+			}
+		}
+	}
+	return names
+}
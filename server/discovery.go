@@ -0,0 +1,65 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Paged results of 'fnd'. Users matching the query in fnd.private are
+ *  ranked by the number of matched tags, then ordered by user ID, and
+ *  returned by {get what="sub"} in pages of sub.limit users. If there are
+ *  more, {meta next} holds an opaque cursor and the client requests the
+ *  next page with sub={after: cursor}. Each page runs the query again:
+ *  results may shift if users change their tags in the meantime. At most
+ *  FND_MAX_RESULTS users are found by one query.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of users in one page
+	FND_DEFAULT_PAGE_SIZE = 100
+	// Maximum number of users in one page
+	FND_MAX_PAGE_SIZE = 1000
+	// Maximum number of users found by one query
+	FND_MAX_RESULTS = 1000
+)
+
+// fndPage runs the query and returns one page of results. Returns the cursor of the next page
+// or an empty string if it's the last page.
+func fndPage(uid types.Uid, query []interface{}, opts *MsgGetOpts) ([]types.Subscription, string, error) {
+	var offset int
+	limit := FND_DEFAULT_PAGE_SIZE
+	if opts != nil {
+		if opts.After != "" {
+			// Invalid cursor starts from the beginning
+			if n, err := strconv.Atoi(opts.After); err == nil && n > 0 {
+				offset = n
+			}
+		}
+		if opts.Limit > 0 {
+			limit = opts.Limit
+			if limit > FND_MAX_PAGE_SIZE {
+				limit = FND_MAX_PAGE_SIZE
+			}
+		}
+	}
+
+	subs, err := store.Users.FindSubs(uid, query, FND_MAX_RESULTS)
+	if err != nil || offset >= len(subs) {
+		return nil, "", err
+	}
+
+	subs = subs[offset:]
+	var next string
+	if len(subs) > limit {
+		subs = subs[:limit]
+		next = strconv.Itoa(offset + limit)
+	}
+	return subs, next, nil
+}
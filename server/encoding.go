@@ -0,0 +1,301 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Binary encodings of the wire protocol negotiated by clients. Messages are
+ *  serialized as JSON by the wire codec (see codec.go) and fanned out as
+ *  JSON; the transport converts them to the encoding of the session:
+ *    websocket    - subprotocol "tinode.msgpack" or "tinode.cbor", or the
+ *                   query parameter enc=msgpack|cbor; every message is sent
+ *                   in one binary frame;
+ *    long polling - enc=msgpack|cbor in the request which creates the
+ *                   session; bodies of requests and responses are in the
+ *                   encoding, one message per body.
+ *  The messages have the same structure as in JSON. Binary strings of the
+ *  encoding are accepted where JSON has base64 strings, e.g. {login} secret.
+ *  A packet fanned out to many sessions is converted once per encoding: the
+ *  most recently converted packets are remembered with their frames.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of websocket subprotocols which select the encoding
+	ENCODING_SUBPROTOCOL_PREFIX = "tinode."
+	// Maximum nesting of arrays and maps in a decoded message
+	ENCODING_MAX_DEPTH = 64
+	// Number of the most recently converted packets remembered per encoding
+	ENCODING_FRAME_CACHE_SIZE = 64
+)
+
+var errEncodingMalformed = errors.New("encoding: malformed data")
+
+// Binary encoding of messages. Implementations convert generic values: nil, bool, json.Number, string,
+// []interface{} and map[string]interface{}.
+type frameEncoding interface {
+	// contentType of HTTP bodies in the encoding
+	contentType() string
+	// encode serializes the value decoded from JSON
+	encode(v interface{}) ([]byte, error)
+	// decode parses the data into a value which can be serialized as JSON
+	decode(data []byte) (interface{}, error)
+}
+
+var frameEncodings = make(map[string]frameEncoding)
+
+// Packets recently converted to the encoding with their frames
+type frameCache struct {
+	sync.Mutex
+	entries [ENCODING_FRAME_CACHE_SIZE]struct {
+		packet []byte
+		frame  []byte
+	}
+	next int
+}
+
+var frameCaches = make(map[frameEncoding]*frameCache)
+
+// registerFrameEncoding makes the encoding available by name. Called from init().
+func registerFrameEncoding(name string, fenc frameEncoding) {
+	if _, dup := frameEncodings[name]; dup {
+		panic("registerFrameEncoding: called twice for " + name)
+	}
+	frameEncodings[name] = fenc
+	frameCaches[fenc] = &frameCache{}
+}
+
+// get returns the frame of the packet if the same packet was converted recently. Packets are shared
+// by the sessions, so they are compared by address. The entry keeps the packet alive, its address
+// cannot be reused by another packet.
+func (fc *frameCache) get(packet []byte) []byte {
+	fc.Lock()
+	defer fc.Unlock()
+
+	for i := range fc.entries {
+		entry := &fc.entries[i]
+		if len(entry.packet) == len(packet) && len(packet) > 0 && &entry.packet[0] == &packet[0] {
+			return entry.frame
+		}
+	}
+	return nil
+}
+
+// put remembers the frame of the packet replacing the oldest entry.
+func (fc *frameCache) put(packet, frame []byte) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.entries[fc.next].packet = packet
+	fc.entries[fc.next].frame = frame
+	fc.next = (fc.next + 1) % len(fc.entries)
+}
+
+// websocketSubprotocols lists the subprotocols selecting the encodings, JSON first.
+func websocketSubprotocols() []string {
+	names := make([]string, 0, len(frameEncodings))
+	for name := range frameEncodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	protocols := []string{ENCODING_SUBPROTOCOL_PREFIX + "json"}
+	for _, name := range names {
+		protocols = append(protocols, ENCODING_SUBPROTOCOL_PREFIX+name)
+	}
+	return protocols
+}
+
+// frameEncodingByName returns the encoding with the given name, nil for JSON. Returns false if the
+// encoding is unknown.
+func frameEncodingByName(name string) (frameEncoding, bool) {
+	name = strings.TrimPrefix(name, ENCODING_SUBPROTOCOL_PREFIX)
+	if name == "" || name == "json" {
+		return nil, true
+	}
+	fenc, ok := frameEncodings[name]
+	return fenc, ok
+}
+
+// frameEncodingName returns the name of the encoding, empty for JSON.
+func frameEncodingName(fenc frameEncoding) string {
+	for name, known := range frameEncodings {
+		if known == fenc {
+			return name
+		}
+	}
+	return ""
+}
+
+// frameFromJSON converts the message serialized as JSON to the encoding.
+func frameFromJSON(fenc frameEncoding, data []byte) ([]byte, error) {
+	if fenc == nil || len(data) == 0 {
+		return data, nil
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep integers exact
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return fenc.encode(v)
+}
+
+// frameToJSON converts the message in the encoding to JSON.
+func frameToJSON(fenc frameEncoding, data []byte) ([]byte, error) {
+	if fenc == nil {
+		return data, nil
+	}
+
+	v, err := fenc.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// Writer of messages in the encoding of the client, JSON if the encoding is nil.
+type frameWriter struct {
+	wrt  io.Writer
+	fenc frameEncoding
+}
+
+// Encode writes the message, same as json.Encoder.Encode for JSON.
+func (fw frameWriter) Encode(msg interface{}) error {
+	if fw.fenc == nil {
+		return json.NewEncoder(fw.wrt).Encode(msg)
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if data, err = frameFromJSON(fw.fenc, data); err != nil {
+		return err
+	}
+	_, err = fw.wrt.Write(data)
+	return err
+}
+
+// setContentType sets the Content-Type of the response in the encoding.
+func (fw frameWriter) setContentType(wrt http.ResponseWriter) {
+	if fw.fenc != nil {
+		wrt.Header().Set("Content-Type", fw.fenc.contentType())
+	}
+}
+
+// encodeFrame converts the packet taken from the send queues to the encoding of the session. The
+// frame is shared with other sessions which got the same packet and must not be modified.
+func (s *Session) encodeFrame(packet []byte) ([]byte, error) {
+	if s.enc == nil || len(packet) == 0 {
+		return packet, nil
+	}
+
+	cache := frameCaches[s.enc]
+	if frame := cache.get(packet); frame != nil {
+		return frame, nil
+	}
+	frame, err := frameFromJSON(s.enc, packet)
+	if err != nil {
+		return nil, err
+	}
+	cache.put(packet, frame)
+	return frame, nil
+}
+
+// frameNumber returns the value of a JSON number as int64, uint64 or float64.
+func frameNumber(num json.Number) (interface{}, error) {
+	str := string(num)
+	if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return i, nil
+	}
+	if u, err := strconv.ParseUint(str, 10, 64); err == nil {
+		return u, nil
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+// frameSortedKeys returns the keys of the map in the order of encoding/json.
+func frameSortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// frameTime converts seconds and nanoseconds since the epoch to the timestamp used in JSON.
+func frameTime(sec int64, nsec int64) time.Time {
+	return time.Unix(sec, nsec).UTC()
+}
+
+// Reader of encoded data. The length of the data is checked before every read.
+type frameReader struct {
+	buf   []byte
+	depth int
+}
+
+func (fr *frameReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(fr.buf)) {
+		return nil, errEncodingMalformed
+	}
+	v := fr.buf[:n]
+	fr.buf = fr.buf[n:]
+	return v, nil
+}
+
+func (fr *frameReader) uint(size int) (uint64, error) {
+	b, err := fr.next(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return v, nil
+}
+
+// enter starts reading a container of n elements, each at least one byte long.
+func (fr *frameReader) enter(n uint64) error {
+	if n > uint64(len(fr.buf)) {
+		return errEncodingMalformed
+	}
+	fr.depth++
+	if fr.depth > ENCODING_MAX_DEPTH {
+		return errors.New("encoding: nesting too deep")
+	}
+	return nil
+}
+
+func (fr *frameReader) leave() {
+	fr.depth--
+}
+
+// Writer of encoded data
+type frameBuffer struct {
+	bytes.Buffer
+}
+
+// writeUint writes the value as a big-endian integer of the given size.
+func (fb *frameBuffer) writeUint(v uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		fb.WriteByte(byte(v >> (8 * uint(i))))
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+// CBOR encoding, RFC 8949. Indefinite-length items are accepted. Tags are ignored except epoch-based
+// date/time (tag 1) which is converted to the format of JSON.
+
+// Major types of CBOR
+const (
+	CBOR_UINT   = 0
+	CBOR_NEGINT = 1
+	CBOR_BYTES  = 2
+	CBOR_TEXT   = 3
+	CBOR_ARRAY  = 4
+	CBOR_MAP    = 5
+	CBOR_TAG    = 6
+	CBOR_SIMPLE = 7
+)
+
+// Additional information of indefinite length
+const CBOR_INDEFINITE = 31
+
+type cborEncoding struct{}
+
+func init() {
+	registerFrameEncoding("cbor", cborEncoding{})
+}
+
+func (cborEncoding) contentType() string {
+	return "application/cbor"
+}
+
+func (cborEncoding) encode(v interface{}) ([]byte, error) {
+	var fb frameBuffer
+	if err := cborWrite(&fb, v); err != nil {
+		return nil, err
+	}
+	return fb.Bytes(), nil
+}
+
+func cborWrite(fb *frameBuffer, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		fb.WriteByte(0xf6)
+	case bool:
+		if val {
+			fb.WriteByte(0xf5)
+		} else {
+			fb.WriteByte(0xf4)
+		}
+	case json.Number:
+		num, err := frameNumber(val)
+		if err != nil {
+			return err
+		}
+		return cborWrite(fb, num)
+	case int64:
+		if val >= 0 {
+			cborWriteHead(fb, CBOR_UINT, uint64(val))
+		} else {
+			cborWriteHead(fb, CBOR_NEGINT, uint64(-1-val))
+		}
+	case uint64:
+		cborWriteHead(fb, CBOR_UINT, val)
+	case float64:
+		fb.WriteByte(0xfb)
+		fb.writeUint(math.Float64bits(val), 8)
+	case string:
+		cborWriteHead(fb, CBOR_TEXT, uint64(len(val)))
+		fb.WriteString(val)
+	case []interface{}:
+		cborWriteHead(fb, CBOR_ARRAY, uint64(len(val)))
+		for _, elem := range val {
+			if err := cborWrite(fb, elem); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		cborWriteHead(fb, CBOR_MAP, uint64(len(val)))
+		for _, key := range frameSortedKeys(val) {
+			cborWriteHead(fb, CBOR_TEXT, uint64(len(key)))
+			fb.WriteString(key)
+			if err := cborWrite(fb, val[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("cbor: unsupported value")
+	}
+	return nil
+}
+
+// cborWriteHead writes the major type with the argument in the shortest form.
+func cborWriteHead(fb *frameBuffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		fb.WriteByte(major<<5 | byte(arg))
+	case arg <= math.MaxUint8:
+		fb.WriteByte(major<<5 | 24)
+		fb.writeUint(arg, 1)
+	case arg <= math.MaxUint16:
+		fb.WriteByte(major<<5 | 25)
+		fb.writeUint(arg, 2)
+	case arg <= math.MaxUint32:
+		fb.WriteByte(major<<5 | 26)
+		fb.writeUint(arg, 4)
+	default:
+		fb.WriteByte(major<<5 | 27)
+		fb.writeUint(arg, 8)
+	}
+}
+
+func (cborEncoding) decode(data []byte) (interface{}, error) {
+	fr := &frameReader{buf: data}
+	v, err := cborRead(fr)
+	if err != nil {
+		return nil, err
+	}
+	if len(fr.buf) > 0 {
+		return nil, errEncodingMalformed
+	}
+	return v, nil
+}
+
+// cborReadHead reads the major type and the argument. The argument of indefinite-length items is not read.
+func cborReadHead(fr *frameReader) (byte, byte, uint64, error) {
+	b, err := fr.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		arg, err = fr.uint(1 << (info - 24))
+	case info == CBOR_INDEFINITE:
+		if major < CBOR_BYTES || major == CBOR_TAG {
+			err = errEncodingMalformed
+		}
+	default:
+		err = errEncodingMalformed
+	}
+	return major, info, arg, err
+}
+
+func cborRead(fr *frameReader) (interface{}, error) {
+	major, info, arg, err := cborReadHead(fr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case CBOR_UINT:
+		return arg, nil
+	case CBOR_NEGINT:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), nil
+	case CBOR_BYTES, CBOR_TEXT:
+		str, err := cborReadString(fr, major, info, arg)
+		if err != nil {
+			return nil, err
+		}
+		if major == CBOR_TEXT {
+			return string(str), nil
+		}
+		return str, nil
+	case CBOR_ARRAY:
+		return cborReadArray(fr, info, arg)
+	case CBOR_MAP:
+		return cborReadMap(fr, info, arg)
+	case CBOR_TAG:
+		val, err := cborRead(fr)
+		if err != nil || arg != 1 {
+			return val, err
+		}
+		// Epoch-based date/time
+		switch t := val.(type) {
+		case uint64:
+			return frameTime(int64(t), 0), nil
+		case int64:
+			return frameTime(t, 0), nil
+		case float64:
+			sec, frac := math.Modf(t)
+			return frameTime(int64(sec), int64(frac*1e9)), nil
+		}
+		return nil, errEncodingMalformed
+	}
+
+	// Simple values and floats
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		// null and undefined
+		return nil, nil
+	case 25:
+		return cborHalfFloat(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	}
+	return nil, errEncodingMalformed
+}
+
+// cborReadString reads a byte or text string. Indefinite-length strings are concatenated from chunks.
+func cborReadString(fr *frameReader, major, info byte, size uint64) ([]byte, error) {
+	if info != CBOR_INDEFINITE {
+		str, err := fr.next(size)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), str...), nil
+	}
+
+	var str []byte
+	for !cborBreak(fr) {
+		chunkMajor, chunkInfo, chunkSize, err := cborReadHead(fr)
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkInfo == CBOR_INDEFINITE {
+			return nil, errEncodingMalformed
+		}
+		chunk, err := fr.next(chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		str = append(str, chunk...)
+	}
+	return str, nil
+}
+
+// cborBreak checks if the next item of an indefinite-length string, array or map is the break code and skips it.
+func cborBreak(fr *frameReader) bool {
+	if len(fr.buf) > 0 && fr.buf[0] == 0xff {
+		fr.buf = fr.buf[1:]
+		return true
+	}
+	return false
+}
+
+func cborReadArray(fr *frameReader, info byte, size uint64) (interface{}, error) {
+	indefinite := info == CBOR_INDEFINITE
+	if indefinite {
+		size = 0
+	}
+	if err := fr.enter(size); err != nil {
+		return nil, err
+	}
+	defer fr.leave()
+
+	arr := make([]interface{}, 0, size)
+	for i := uint64(0); indefinite || i < size; i++ {
+		if indefinite && cborBreak(fr) {
+			break
+		}
+		elem, err := cborRead(fr)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, elem)
+	}
+	return arr, nil
+}
+
+func cborReadMap(fr *frameReader, info byte, size uint64) (interface{}, error) {
+	indefinite := info == CBOR_INDEFINITE
+	if indefinite {
+		size = 0
+	}
+	if err := fr.enter(size); err != nil {
+		return nil, err
+	}
+	defer fr.leave()
+
+	m := make(map[string]interface{}, size)
+	for i := uint64(0); indefinite || i < size; i++ {
+		if indefinite && cborBreak(fr) {
+			break
+		}
+		key, err := cborRead(fr)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, errors.New("cbor: map keys must be strings")
+		}
+		if m[name], err = cborRead(fr); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// cborHalfFloat converts IEEE 754 half-precision float to float64.
+func cborHalfFloat(half uint16) float64 {
+	exp := int(half>>10) & 0x1f
+	mant := float64(half & 0x3ff)
+	var val float64
+	switch exp {
+	case 0:
+		val = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			val = math.Inf(1)
+		} else {
+			val = math.NaN()
+		}
+	default:
+		val = math.Ldexp(mant+1024, exp-25)
+	}
+	if half&0x8000 != 0 {
+		val = -val
+	}
+	return val
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+// MessagePack encoding, https://github.com/msgpack/msgpack/blob/master/spec.md
+// Timestamps (extension type -1) are accepted and converted to the format of JSON.
+
+type msgpackEncoding struct{}
+
+func init() {
+	registerFrameEncoding("msgpack", msgpackEncoding{})
+}
+
+func (msgpackEncoding) contentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackEncoding) encode(v interface{}) ([]byte, error) {
+	var fb frameBuffer
+	if err := msgpackWrite(&fb, v); err != nil {
+		return nil, err
+	}
+	return fb.Bytes(), nil
+}
+
+func msgpackWrite(fb *frameBuffer, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		fb.WriteByte(0xc0)
+	case bool:
+		if val {
+			fb.WriteByte(0xc3)
+		} else {
+			fb.WriteByte(0xc2)
+		}
+	case json.Number:
+		num, err := frameNumber(val)
+		if err != nil {
+			return err
+		}
+		return msgpackWrite(fb, num)
+	case int64:
+		if val >= 0 {
+			msgpackWriteUint(fb, uint64(val))
+		} else if val >= -32 {
+			fb.WriteByte(byte(val))
+		} else if val >= math.MinInt8 {
+			fb.WriteByte(0xd0)
+			fb.writeUint(uint64(val), 1)
+		} else if val >= math.MinInt16 {
+			fb.WriteByte(0xd1)
+			fb.writeUint(uint64(val), 2)
+		} else if val >= math.MinInt32 {
+			fb.WriteByte(0xd2)
+			fb.writeUint(uint64(val), 4)
+		} else {
+			fb.WriteByte(0xd3)
+			fb.writeUint(uint64(val), 8)
+		}
+	case uint64:
+		msgpackWriteUint(fb, val)
+	case float64:
+		fb.WriteByte(0xcb)
+		fb.writeUint(math.Float64bits(val), 8)
+	case string:
+		msgpackWriteHead(fb, len(val), 0xa0, 32, 0xd9)
+		fb.WriteString(val)
+	case []interface{}:
+		msgpackWriteHead(fb, len(val), 0x90, 16, 0xdc)
+		for _, elem := range val {
+			if err := msgpackWrite(fb, elem); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		msgpackWriteHead(fb, len(val), 0x80, 16, 0xde)
+		for _, key := range frameSortedKeys(val) {
+			msgpackWriteHead(fb, len(key), 0xa0, 32, 0xd9)
+			fb.WriteString(key)
+			if err := msgpackWrite(fb, val[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("msgpack: unsupported value")
+	}
+	return nil
+}
+
+func msgpackWriteUint(fb *frameBuffer, val uint64) {
+	switch {
+	case val < 0x80:
+		fb.WriteByte(byte(val))
+	case val <= math.MaxUint8:
+		fb.WriteByte(0xcc)
+		fb.writeUint(val, 1)
+	case val <= math.MaxUint16:
+		fb.WriteByte(0xcd)
+		fb.writeUint(val, 2)
+	case val <= math.MaxUint32:
+		fb.WriteByte(0xce)
+		fb.writeUint(val, 4)
+	default:
+		fb.WriteByte(0xcf)
+		fb.writeUint(val, 8)
+	}
+}
+
+// msgpackWriteHead writes the type and the length of a string, an array or a map: the fixed form if the
+// length is below fixLimit, otherwise the 8 (strings only), 16 or 32 bit form starting at the given code.
+func msgpackWriteHead(fb *frameBuffer, size int, fixCode byte, fixLimit int, code byte) {
+	switch {
+	case size < fixLimit:
+		fb.WriteByte(fixCode | byte(size))
+	case code == 0xd9 && size <= math.MaxUint8:
+		fb.WriteByte(code)
+		fb.writeUint(uint64(size), 1)
+	case size <= math.MaxUint16:
+		if code == 0xd9 {
+			code++
+		}
+		fb.WriteByte(code)
+		fb.writeUint(uint64(size), 2)
+	default:
+		if code == 0xd9 {
+			code++
+		}
+		fb.WriteByte(code + 1)
+		fb.writeUint(uint64(size), 4)
+	}
+}
+
+func (msgpackEncoding) decode(data []byte) (interface{}, error) {
+	fr := &frameReader{buf: data}
+	v, err := msgpackRead(fr)
+	if err != nil {
+		return nil, err
+	}
+	if len(fr.buf) > 0 {
+		return nil, errEncodingMalformed
+	}
+	return v, nil
+}
+
+func msgpackRead(fr *frameReader) (interface{}, error) {
+	b, err := fr.next(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		return msgpackReadStr(fr, uint64(code&0x1f))
+	case code&0xf0 == 0x90:
+		return msgpackReadArray(fr, uint64(code&0x0f))
+	case code&0xf0 == 0x80:
+		return msgpackReadMap(fr, uint64(code&0x0f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return fr.uint(1 << (code - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		u, err := fr.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, nil
+	case 0xca:
+		u, err := fr.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := fr.uint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb:
+		size, err := fr.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackReadStr(fr, size)
+	case 0xc4, 0xc5, 0xc6:
+		size, err := fr.uint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := fr.next(size)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), bin...), nil
+	case 0xdc, 0xdd:
+		size, err := fr.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackReadArray(fr, size)
+	case 0xde, 0xdf:
+		size, err := fr.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackReadMap(fr, size)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return msgpackReadExt(fr, 1<<(code-0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		size, err := fr.uint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackReadExt(fr, size)
+	}
+	return nil, errEncodingMalformed
+}
+
+func msgpackReadStr(fr *frameReader, size uint64) (interface{}, error) {
+	str, err := fr.next(size)
+	if err != nil {
+		return nil, err
+	}
+	return string(str), nil
+}
+
+func msgpackReadArray(fr *frameReader, size uint64) (interface{}, error) {
+	if err := fr.enter(size); err != nil {
+		return nil, err
+	}
+	defer fr.leave()
+
+	arr := make([]interface{}, size)
+	for i := range arr {
+		elem, err := msgpackRead(fr)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = elem
+	}
+	return arr, nil
+}
+
+func msgpackReadMap(fr *frameReader, size uint64) (interface{}, error) {
+	if err := fr.enter(size); err != nil {
+		return nil, err
+	}
+	defer fr.leave()
+
+	m := make(map[string]interface{}, size)
+	for i := uint64(0); i < size; i++ {
+		key, err := msgpackRead(fr)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map keys must be strings")
+		}
+		if m[name], err = msgpackRead(fr); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// msgpackReadExt reads an extension value. Only timestamps are supported.
+func msgpackReadExt(fr *frameReader, size uint64) (interface{}, error) {
+	typ, err := fr.next(1)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ[0]) != -1 {
+		return nil, errors.New("msgpack: unsupported extension type")
+	}
+
+	var ts time.Time
+	switch size {
+	case 4:
+		sec, err := fr.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		ts = frameTime(int64(sec), 0)
+	case 8:
+		val, err := fr.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		ts = frameTime(int64(val&0x3ffffffff), int64(val>>34))
+	case 12:
+		nsec, err := fr.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		sec, err := fr.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		ts = frameTime(int64(sec), int64(nsec))
+	default:
+		return nil, errEncodingMalformed
+	}
+	return ts, nil
+}
@@ -0,0 +1,187 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Disappearing messages. Participants of a topic set desc.ttl to have
+ *  messages deleted that many seconds after they were sent. A background
+ *  job finds expired messages in the topics with a TTL and hard-deletes
+ *  them the same way as {del what="msg" hard=true before=...}: subscribers
+ *  receive {pres what="del"}. The job works through the adapter, so it does
+ *  not depend on the expiration features of the database.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default interval between checks for expired messages
+	EPHEMERAL_DEFAULT_INTERVAL = time.Minute
+	// Default shortest TTL, seconds
+	EPHEMERAL_DEFAULT_MIN_TTL = 60
+)
+
+type ephemeralConfig struct {
+	// Allow topics to set message TTL
+	Enabled bool `json:"enabled"`
+	// How often to check for expired messages, seconds
+	CheckInterval int `json:"check_interval"`
+	// Shortest TTL a topic may set, seconds
+	MinTtl int `json:"min_ttl"`
+}
+
+var ephemeral struct {
+	enabled bool
+	minTtl  int
+	// Exported counter of deleted messages
+	expired *expvar.Int
+}
+
+// ephemeralInit parses config and starts the background job. Message TTL is off by default.
+func ephemeralInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config ephemeralConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse message_ttl config:", err)
+	}
+
+	if !config.Enabled {
+		return
+	}
+
+	interval := time.Duration(config.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = EPHEMERAL_DEFAULT_INTERVAL
+	}
+	ephemeral.minTtl = config.MinTtl
+	if ephemeral.minTtl <= 0 {
+		ephemeral.minTtl = EPHEMERAL_DEFAULT_MIN_TTL
+	}
+	ephemeral.expired = new(expvar.Int)
+	expvar.Publish("ExpiredMessages", ephemeral.expired)
+
+	ephemeral.enabled = true
+
+	go ephemeralRun(interval)
+	logMain.Infof("Deleting expired messages, checking every %s", interval)
+}
+
+// isValidTtl checks the message TTL requested by the client. Zero disables the TTL.
+func isValidTtl(ttl int) bool {
+	return ttl == 0 || (ephemeral.enabled && ttl >= ephemeral.minTtl)
+}
+
+func ephemeralRun(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if isStandby() {
+			// Messages are deleted by the primary region
+			continue
+		}
+
+		topics, err := store.Topics.GetExpiring()
+		if err != nil {
+			logMain.Warn("ephemeral: failed to load topics", err)
+			continue
+		}
+
+		now := types.TimeNow()
+		for i := range topics {
+			topic := &topics[i]
+			since := topic.ClearId + 1
+			if since > topic.SeqId {
+				continue
+			}
+			// Only the cluster node which owns the topic deletes the messages
+			if globals.cluster.isRemoteTopic(topic.Id) {
+				continue
+			}
+
+			// Messages are stored in the order they are sent: everything before the first
+			// message which has not expired yet is deleted.
+			cutoff := now.Add(-time.Duration(topic.MessageTtl) * time.Second)
+			first, err := store.Messages.FirstAfter(topic.Id, since, cutoff)
+			if err != nil {
+				logMain.Warnf("ephemeral: topic '%s' %v", topic.Id, err)
+				continue
+			}
+			seq := topic.SeqId
+			if first > 0 {
+				seq = first - 1
+			}
+			if seq < since {
+				continue
+			}
+
+			// The topic deletes the messages if it's loaded, otherwise the hub calls messagesExpireOffline.
+			globals.hub.route <- &ServerComMessage{
+				Info:   &MsgServerInfo{Topic: topic.Id, What: "expire", SeqId: seq},
+				rcptto: topic.Id}
+		}
+	}
+}
+
+// expireMessages hard-deletes messages up to and including seq and notifies the subscribers.
+func (t *Topic) expireMessages(seq int) {
+	if seq <= t.clearId {
+		return
+	}
+
+	if err := store.Messages.Delete(t.name, types.ZeroUid, true, seq); err != nil {
+		logTopic.Errorf("topic[%s]: failed to delete expired messages: %v", t.name, err)
+		return
+	}
+	ephemeral.expired.Add(int64(seq - t.clearId))
+	t.clearId = seq
+	t.unpinDeleted(seq, nil)
+
+	params := &PresParams{seqId: seq}
+	t.presSubsOnline("del", "", params, types.ModeRead, "")
+	t.presSubsOffline("del", params, types.ModeRead, "", true)
+}
+
+// messagesExpireOffline is the same as expireMessages for a topic which is not loaded.
+func messagesExpireOffline(topic string, seq int) {
+	stopic, err := store.Topics.Get(topic)
+	if err != nil || stopic == nil || seq <= stopic.ClearId {
+		return
+	}
+
+	if err := store.Messages.Delete(topic, types.ZeroUid, true, seq); err != nil {
+		logMain.Warnf("ephemeral: topic '%s' failed to delete expired messages %v", topic, err)
+		return
+	}
+	ephemeral.expired.Add(int64(seq - stopic.ClearId))
+
+	var pinned []int
+	for _, pin := range stopic.Pinned {
+		if pin > seq {
+			pinned = append(pinned, pin)
+		}
+	}
+	if len(pinned) != len(stopic.Pinned) {
+		if err := store.Topics.Update(topic, map[string]interface{}{"Pinned": pinned}); err != nil {
+			logMain.Warnf("ephemeral: topic '%s' failed to update pinned messages %v", topic, err)
+		}
+	}
+
+	subs, err := store.Topics.GetSubs(topic)
+	if err != nil {
+		logMain.Warnf("ephemeral: topic '%s' failed to load subscriptions %v", topic, err)
+		return
+	}
+	presSubsOfflineOffline(topic, types.GetTopicCat(topic), subs, "del", &PresParams{seqId: seq}, "")
+}
@@ -0,0 +1,86 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Catalog of machine-readable error codes. Every {ctrl} with an error
+ *  carries one of the codes in "err" next to the HTTP-like numeric code and
+ *  the human-readable text. The text may change between releases, the codes
+ *  don't: clients should branch on "err". A code is a category optionally
+ *  followed by a dot and a subcode, e.g. "auth.expired": clients which don't
+ *  know the subcode can still act on the category. Details such as the time
+ *  to wait before retrying are reported in params.
+ *
+ *****************************************************************************/
+
+package main
+
+const (
+	// Request cannot be parsed or has invalid fields
+	ERR_MALFORMED = "malformed"
+	// Request sent before {hi} or otherwise out of order
+	ERR_OUT_OF_SEQUENCE = "malformed.sequence"
+	// Protocol version of the client is not supported
+	ERR_VERSION = "malformed.version"
+
+	// The session must log in first
+	ERR_AUTH_REQUIRED = "auth.required"
+	// Invalid credentials
+	ERR_AUTH_FAILED = "auth.failed"
+	// Token or credentials expired
+	ERR_AUTH_EXPIRED = "auth.expired"
+	// Unknown authentication scheme
+	ERR_AUTH_SCHEME = "auth.scheme"
+	// The session is already authenticated
+	ERR_AUTH_ALREADY = "auth.already"
+	// Credential is already used by another account
+	ERR_AUTH_DUPLICATE = "auth.duplicate"
+
+	// The user has no permission to perform the operation
+	ERR_PERMISSION = "permission"
+	// The operation is not allowed by the server policy or by content rules
+	ERR_POLICY = "permission.policy"
+	// The account is suspended, deleted or banned by the operator, params.state and params.reason
+	ERR_ACCOUNT_SUSPENDED = "permission.suspended"
+	ERR_ACCOUNT_DELETED   = "permission.deleted"
+	ERR_ACCOUNT_BANNED    = "permission.banned"
+
+	// Object not found
+	ERR_NOT_FOUND = "not_found"
+	// Topic not found
+	ERR_TOPIC_NOT_FOUND = "not_found.topic"
+	// User not found
+	ERR_USER_NOT_FOUND = "not_found.user"
+	// Object was deleted
+	ERR_GONE = "not_found.gone"
+
+	// Operation is not allowed on the object
+	ERR_NOT_ALLOWED = "conflict.not_allowed"
+	// The session must attach to the topic first
+	ERR_ATTACH_FIRST = "conflict.attach_first"
+	// Object already exists
+	ERR_ALREADY_EXISTS = "conflict.exists"
+
+	// Topic does not accept requests for now: it's being deleted or moved to another cluster node
+	ERR_TOPIC_FROZEN = "topic.frozen"
+
+	// Request or upload is larger than allowed
+	ERR_QUOTA_SIZE = "quota.size"
+	// Topic has as many members as allowed, params.limit
+	ERR_QUOTA_MEMBERS = "quota.members"
+
+	// Too many requests, retry after params.retry_after seconds
+	ERR_RATE_LIMITED = "rate_limited"
+
+	// Internal error of the server
+	ERR_INTERNAL = "internal"
+	// Feature is not implemented
+	ERR_NOT_IMPLEMENTED = "internal.not_implemented"
+	// Server cannot serve the request now, retry later
+	ERR_UNAVAILABLE = "unavailable"
+	// Database cannot be reached
+	ERR_STORE_UNAVAILABLE = "unavailable.store"
+	// Another cluster node cannot be reached
+	ERR_NODE_UNREACHABLE = "unavailable.node"
+	// Operation timed out
+	ERR_TIMEOUT = "unavailable.timeout"
+)
@@ -0,0 +1,349 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Events: a {pub} message with head.event="rsvp" and content of the form
+ *    {"title": "Team lunch", "start": "2017-11-02T12:00:00Z",
+ *     "end": "2017-11-02T13:00:00Z", "location": "Cafe", "description": "..."}
+ *  Members respond with {note what="rsvp" seq=N rsvp="yes"}. The server
+ *  keeps the responses and their counts in the stored message, broadcasts
+ *  them as {info what="rsvp"}, and reminds users who are going shortly
+ *  before the event starts. Events are exported in iCalendar format at
+ *  /v0/event/<topic>/<seq>.ics
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// URL path of the iCalendar export
+	EVENT_ICS_PATH = "/v0/event/"
+	// Users who are going to the event are reminded this long before the start
+	EVENT_REMINDER_LEAD = 15 * time.Minute
+	// Maximum length of the event title
+	EVENT_MAX_TITLE_LENGTH = 256
+)
+
+// Valid RSVP responses
+var eventResponses = []string{"yes", "no", "maybe"}
+
+// isValidRsvp checks if the response is known. An empty response withdraws the previous one.
+func isValidRsvp(rsvp string) bool {
+	if rsvp == "" {
+		return true
+	}
+	for _, r := range eventResponses {
+		if r == rsvp {
+			return true
+		}
+	}
+	return false
+}
+
+// eventValidate checks that the message is a well-formed event and resets the server-managed fields.
+func eventValidate(data *MsgServerData) bool {
+	if data.Head["event"] != "rsvp" {
+		return false
+	}
+
+	content, ok := data.Content.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if title, ok := content["title"].(string); !ok || title == "" || len(title) > EVENT_MAX_TITLE_LENGTH {
+		return false
+	}
+	start, end, ok := eventTimes(content)
+	if !ok || (!end.IsZero() && end.Before(start)) {
+		return false
+	}
+	for _, key := range []string{"location", "description"} {
+		if val, ok := content[key]; ok {
+			if _, ok = val.(string); !ok {
+				return false
+			}
+		}
+	}
+
+	content["rsvp"] = map[string]interface{}{}
+	content["counts"] = eventCounts(nil)
+	return true
+}
+
+// eventTimes parses start and optional end time of the event.
+func eventTimes(content map[string]interface{}) (start, end time.Time, ok bool) {
+	val, _ := content["start"].(string)
+	start, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return
+	}
+	if val, present := content["end"]; present {
+		str, _ := val.(string)
+		if end, err = time.Parse(time.RFC3339, str); err != nil {
+			return
+		}
+	}
+	return start.UTC(), end.UTC(), true
+}
+
+// eventCounts aggregates responses by type.
+func eventCounts(rsvp map[string]interface{}) map[string]interface{} {
+	counts := make(map[string]interface{}, len(eventResponses))
+	for _, r := range eventResponses {
+		counts[r] = 0
+	}
+	for _, r := range rsvp {
+		if r, ok := r.(string); ok {
+			if n, ok := counts[r].(int); ok {
+				counts[r] = n + 1
+			}
+		}
+	}
+	return counts
+}
+
+// eventRsvp records user's response to the event and schedules or cancels the reminder.
+// Returns true if the response has changed and should be broadcast.
+func (t *Topic) eventRsvp(uid types.Uid, info *MsgServerInfo) bool {
+	pud := t.perUser[uid]
+	if !(pud.modeGiven & pud.modeWant).IsReader() || info.SeqId <= pud.clearId {
+		return false
+	}
+
+	messages, err := store.Messages.GetAll(t.name, uid,
+		&types.BrowseOpt{Since: info.SeqId, Before: info.SeqId + 1, Limit: 1})
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to load event: %v", t.name, err)
+		return false
+	}
+	if len(messages) == 0 || messages[0].DeletedAt != nil || messages[0].Head["event"] != "rsvp" {
+		return false
+	}
+	msg := &messages[0]
+
+	content, ok := msg.Content.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	start, end, ok := eventTimes(content)
+	if !ok {
+		return false
+	}
+	// Responses to past events are not accepted
+	now := types.TimeNow()
+	if end.IsZero() {
+		end = start
+	}
+	if end.Before(now) {
+		return false
+	}
+
+	rsvp, _ := content["rsvp"].(map[string]interface{})
+	if rsvp == nil {
+		rsvp = make(map[string]interface{})
+	}
+	if prev, _ := rsvp[uid.UserId()].(string); prev == info.Rsvp {
+		return false
+	}
+	if info.Rsvp == "" {
+		delete(rsvp, uid.UserId())
+	} else {
+		rsvp[uid.UserId()] = info.Rsvp
+	}
+	content["rsvp"] = rsvp
+	content["counts"] = eventCounts(rsvp)
+
+	if err = store.Messages.Update(t.name, info.SeqId, map[string]interface{}{"Content": content}); err != nil {
+		logTopic.Errorf("topic[%s]: failed to update event: %v", t.name, err)
+		return false
+	}
+
+	// Remind users who are going or might go
+	remindAt := start.Add(-EVENT_REMINDER_LEAD)
+	id := reminderId(uid, t.name, info.SeqId)
+	if (info.Rsvp == "yes" || info.Rsvp == "maybe") && remindAt.After(now) {
+		title, _ := content["title"].(string)
+		err = store.Reminders.Upsert(&types.Reminder{
+			ObjHeader: types.ObjHeader{Id: id},
+			User:      uid.String(),
+			Topic:     t.original(uid),
+			SeqId:     info.SeqId,
+			Snippet:   webViewSnippet(title, REMINDER_SNIPPET_LENGTH),
+			At:        remindAt})
+	} else {
+		err = store.Reminders.Delete(id)
+	}
+	if err != nil {
+		logTopic.Errorf("topic[%s]: failed to update event reminder: %v", t.name, err)
+	}
+
+	return true
+}
+
+// serveEventIcs handles GET requests like /v0/event/grpXXXXX/123.ics. Events in topics published
+// on the web are available to everyone, other events only to the topic subscribers.
+func serveEventIcs(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		json.NewEncoder(wrt).Encode(msg)
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, EVENT_ICS_PATH)
+	parts := strings.Split(strings.TrimSuffix(path, ".ics"), "/")
+	if len(parts) != 2 || !strings.HasSuffix(path, ".ics") {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+	topic := parts[0]
+	seq, err := strconv.Atoi(parts[1])
+	if err != nil || seq <= 0 {
+		writeErr(ErrMalformed("", topic, now))
+		return
+	}
+
+	name, uid, ok := eventAccessAllowed(req, topic)
+	if !ok {
+		writeErr(ErrPermissionDenied("", topic, now))
+		return
+	}
+
+	messages, err := store.Messages.GetAll(name, uid, &types.BrowseOpt{Since: seq, Before: seq + 1, Limit: 1})
+	if err != nil {
+		writeErr(ErrUnknown("", topic, now))
+		return
+	}
+	if len(messages) == 0 || messages[0].DeletedAt != nil || messages[0].Head["event"] != "rsvp" {
+		writeErr(ErrNotFound("", topic, now))
+		return
+	}
+
+	body, ok := eventIcs(&messages[0], req.Host)
+	if !ok {
+		writeErr(ErrNotFound("", topic, now))
+		return
+	}
+
+	wrt.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	wrt.Header().Set("Content-Disposition", "attachment; filename=\""+topic+"-"+parts[1]+".ics\"")
+	http.ServeContent(wrt, req, "", messages[0].UpdatedAt, bytes.NewReader(body))
+}
+
+// eventAccessAllowed checks if the requester may read events of the topic. Returns the name of the topic
+// to query and the ID of the authenticated user, if any.
+func eventAccessAllowed(req *http.Request, topic string) (string, types.Uid, bool) {
+	if webView.mount != "" && strings.HasPrefix(topic, "grp") {
+		if stopic, err := store.Topics.Get(topic); err == nil && stopic != nil && stopic.WebView {
+			return topic, types.ZeroUid, true
+		}
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		return "", types.ZeroUid, false
+	}
+	uid, err := authHttpRequest(req)
+	if err != nil {
+		return "", types.ZeroUid, false
+	}
+
+	// P2P topics are referenced by the name of the peer
+	name := topic
+	if strings.HasPrefix(name, "usr") {
+		name = uid.P2PName(types.ParseUserId(name))
+	}
+	if !strings.HasPrefix(name, "grp") && !strings.HasPrefix(name, "chn") && !strings.HasPrefix(name, "p2p") {
+		return "", types.ZeroUid, false
+	}
+
+	sub, err := store.Subs.Get(name, uid)
+	if err != nil || sub == nil || sub.IsDeleted() || !(sub.ModeGiven & sub.ModeWant).IsReader() {
+		return "", types.ZeroUid, false
+	}
+	return name, uid, true
+}
+
+// eventIcs renders the event as an iCalendar (RFC 5545) object.
+func eventIcs(msg *types.Message, host string) ([]byte, bool) {
+	content, ok := msg.Content.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	start, end, ok := eventTimes(content)
+	if !ok {
+		return nil, false
+	}
+
+	const layout = "20060102T150405Z"
+	var buf bytes.Buffer
+	line := func(name, value string) {
+		icsFold(&buf, name+":"+value)
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//Tinode//Tinode Chat Server "+VERSION+"//EN")
+	line("BEGIN", "VEVENT")
+	line("UID", msg.Topic+"-"+strconv.Itoa(msg.SeqId)+"@"+host)
+	line("DTSTAMP", msg.CreatedAt.UTC().Format(layout))
+	line("LAST-MODIFIED", msg.UpdatedAt.UTC().Format(layout))
+	line("DTSTART", start.Format(layout))
+	if !end.IsZero() {
+		line("DTEND", end.Format(layout))
+	}
+	title, _ := content["title"].(string)
+	line("SUMMARY", icsEscape(title))
+	if location, _ := content["location"].(string); location != "" {
+		line("LOCATION", icsEscape(location))
+	}
+	if description, _ := content["description"].(string); description != "" {
+		line("DESCRIPTION", icsEscape(description))
+	}
+	line("END", "VEVENT")
+	line("END", "VCALENDAR")
+
+	return buf.Bytes(), true
+}
+
+var icsEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n", "\r", "")
+
+// icsEscape escapes special characters in iCalendar text values.
+func icsEscape(text string) string {
+	return icsEscaper.Replace(text)
+}
+
+// icsFold writes the content line folded at 75 octets as required by RFC 5545.
+// Multi-byte UTF-8 characters are not split between lines.
+func icsFold(buf *bytes.Buffer, line string) {
+	const maxLen = 75
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > maxLen {
+			buf.WriteString("\r\n ")
+			// The leading space counts towards the length of the continuation line
+			width = 1
+		}
+		buf.WriteRune(r)
+		width += size
+	}
+	buf.WriteString("\r\n")
+}
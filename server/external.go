@@ -0,0 +1,148 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  IDs of users and topics in external systems. Integrations keep their own
+ *  keys of Tinode objects here instead of in tags. An ID is unique among
+ *  users and among topics, it's indexed by the store.
+ *
+ *  Only requests with a trusted (root) API key may set and look up the IDs:
+ *    POST /v0/admin/external?user=usr...&id=crm-42
+ *    POST /v0/admin/external?topic=grp...&id=course-7
+ *  set the ID, an empty id clears it. An ID given to another object is
+ *  rejected with 409.
+ *    GET /v0/admin/external?user=crm-42
+ *    GET /v0/admin/external?topic=course-7
+ *  return the object with the given external ID or 404.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the endpoint
+	ADMIN_EXTERNAL_PATH = "/v0/admin/external"
+	// Maximum length of an external ID
+	EXTERNAL_ID_MAX_LENGTH = 128
+)
+
+// serveExternalId sets and looks up external IDs of users and topics.
+func serveExternalId(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if req.Method != http.MethodGet && redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if isValid, isRoot := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	} else if !isRoot {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	user, topic := req.FormValue("user"), req.FormValue("topic")
+	if (user == "") == (topic == "") {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		var resp map[string]string
+		if user != "" {
+			usr, err := store.Users.GetByExternalId(user)
+			if err != nil {
+				writeErr(ErrUnknown("", "", now))
+				return
+			} else if usr != nil {
+				resp = map[string]string{"user": types.ParseUid(usr.Id).UserId(), "id": user}
+			}
+		} else {
+			stopic, err := store.Topics.GetByExternalId(topic)
+			if err != nil {
+				writeErr(ErrUnknown("", "", now))
+				return
+			} else if stopic != nil {
+				resp = map[string]string{"topic": stopic.Id, "id": topic}
+			}
+		}
+		if resp == nil {
+			writeErr(ErrNotFound("", "", now))
+			return
+		}
+		enc.Encode(resp)
+
+	case http.MethodPost:
+		extId := req.FormValue("id")
+		if len(extId) > EXTERNAL_ID_MAX_LENGTH {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+
+		var err error
+		if user != "" {
+			uid := types.ParseUserId(user)
+			if uid.IsZero() {
+				writeErr(ErrMalformed("", "", now))
+				return
+			}
+			var usr *types.User
+			if usr, err = store.Users.Get(uid); err == nil && usr == nil {
+				writeErr(ErrUserNotFound("", "", now))
+				return
+			} else if err == nil {
+				err = store.Users.SetExternalId(uid, extId)
+			}
+		} else {
+			cat := types.GetTopicCat(topic)
+			if cat != types.TopicCat_Grp && cat != types.TopicCat_Chn {
+				writeErr(ErrMalformed("", "", now))
+				return
+			}
+			var stopic *types.Topic
+			if stopic, err = store.Topics.Get(topic); err == nil && stopic == nil {
+				writeErr(ErrTopicNotFound("", "", now))
+				return
+			} else if err == nil {
+				err = store.Topics.SetExternalId(topic, extId)
+			}
+		}
+		if err == store.ErrExternalIdTaken {
+			writeErr(ErrAlreadyExists("", "", now))
+			return
+		} else if err != nil {
+			logHttp.Warn("external: failed to set ID:", err)
+			writeErr(ErrUnknown("", "", now))
+			return
+		}
+		logAudit.Infof("external: ID of '%s%s' set to '%s'", user, topic, extId)
+
+		resp := map[string]string{"id": extId}
+		if user != "" {
+			resp["user"] = user
+		} else {
+			resp["topic"] = topic
+		}
+		enc.Encode(resp)
+
+	default:
+		writeErr(ErrOperationNotAllowed("", "", now))
+	}
+}
@@ -0,0 +1,186 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Delivery of topic messages to the attached sessions. A message is
+ *  serialized once per topic, or once per recipient user in p2p topics where
+ *  the name of the topic depends on the recipient. The same packet is queued
+ *  to websocket, long polling and cluster sessions alike.
+ *
+ *  Encoders with their scratch buffers and the indexes of push recipients are
+ *  reused through sync.Pool. The packets themselves are not: they are shared
+ *  by the sessions and written out asynchronously.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Scratch buffer with an encoder of the wire codec writing to it
+type packetEncoder struct {
+	buf bytes.Buffer
+	enc Encoder
+}
+
+// The codec is selected at startup, before the first packet is encoded.
+var packetEncoders = sync.Pool{
+	New: func() interface{} {
+		pe := &packetEncoder{}
+		pe.enc = wire.NewEncoder(&pe.buf)
+		return pe
+	},
+}
+
+// Maps of users to their positions in push receipts
+var pushIndexes = sync.Pool{
+	New: func() interface{} {
+		return make(map[types.Uid]int)
+	},
+}
+
+// encodePacket serializes the message with the configured codec. The result is the same as of
+// wire.Marshal.
+func encodePacket(msg *ServerComMessage) []byte {
+	pe := packetEncoders.Get().(*packetEncoder)
+	defer packetEncoders.Put(pe)
+
+	pe.buf.Reset()
+	if err := pe.enc.Encode(msg); err != nil {
+		logMain.Warn("failed to serialize message:", err)
+		return nil
+	}
+	// Drop the trailing newline added by the encoder
+	data := bytes.TrimSuffix(pe.buf.Bytes(), []byte{'\n'})
+	packet := make([]byte, len(data))
+	copy(packet, data)
+	return packet
+}
+
+// newPushIndex returns an empty map of users to their positions in a push receipt.
+func newPushIndex() map[types.Uid]int {
+	return pushIndexes.Get().(map[types.Uid]int)
+}
+
+// releaseIndex returns the index of recipients to the pool once the sessions received the message.
+func (pr *pushReceipt) releaseIndex() {
+	if pr.uidMap == nil {
+		return
+	}
+	for uid := range pr.uidMap {
+		delete(pr.uidMap, uid)
+	}
+	pushIndexes.Put(pr.uidMap)
+	pr.uidMap = nil
+}
+
+// fanOut queues the message to the sessions attached to the topic which may receive it and records
+// the devices which got it for push notifications.
+func (t *Topic) fanOut(msg *ServerComMessage, pushRcpt *pushReceipt) {
+	var packet []byte
+	if t.cat != types.TopicCat_P2P {
+		packet = encodePacket(msg)
+		memMessageQueued(len(packet))
+	}
+
+	// Packets already serialized for the users of a p2p topic
+	var p2p [2]struct {
+		uid    types.Uid
+		packet []byte
+	}
+
+	for sess := range t.sessions {
+		if sess.sid == msg.skipSid {
+			continue
+		}
+
+		if msg.Pres != nil {
+			// Skip notifying - already notified on topic.
+			if msg.Pres.skipTopic != "" && sess.subs[msg.Pres.skipTopic] != nil {
+				continue
+			}
+			if msg.Pres.What == "msg" && msg.Pres.skipTopic != "" && sess.hibernate != nil {
+				// New message in a topic the session was detached from while idle
+				sess.wakeTopic(msg.Pres.skipTopic)
+			}
+
+			// Check presence filters
+			pud, _ := t.perUser[sess.uid]
+			if !(pud.modeGiven & pud.modeWant).IsPresencer() ||
+				(msg.Pres.filter != 0 && int(pud.modeGiven&pud.modeWant)&msg.Pres.filter == 0) {
+				continue
+			}
+		} else {
+			// Check if the user has Read permission or the message is a command addressed to the user
+			pud, _ := t.perUser[sess.uid]
+			mode := pud.modeGiven & pud.modeWant
+			if msg.Data != nil {
+				if !canReceive(mode, sess.uid, msg.Data) {
+					continue
+				}
+			} else if !mode.IsReader() {
+				continue
+			}
+		}
+
+		if t.cat == types.TopicCat_P2P {
+			packet = nil
+			free := -1
+			for i := range p2p {
+				if p2p[i].packet == nil {
+					if free < 0 {
+						free = i
+					}
+				} else if p2p[i].uid == sess.uid {
+					packet = p2p[i].packet
+					break
+				}
+			}
+
+			if packet == nil {
+				// For p2p topics topic name is dependent on receiver
+				if msg.Data != nil {
+					msg.Data.Topic = t.original(sess.uid)
+				} else if msg.Pres != nil {
+					msg.Pres.Topic = t.original(sess.uid)
+				} else if msg.Info != nil {
+					msg.Info.Topic = t.original(sess.uid)
+				}
+				packet = encodePacket(msg)
+				memMessageQueued(len(packet))
+				if free >= 0 {
+					p2p[free].uid = sess.uid
+					p2p[free].packet = packet
+				}
+			}
+		}
+
+		if sess.enqueue(packet, sendClass(msg)) {
+			if msg.Data != nil {
+				sess.lpDataQueued(t.name, msg.Data.SeqId)
+			}
+			// Update device map with the device ID which should recive the notification
+			if pushRcpt != nil {
+				if i, ok := pushRcpt.uidMap[sess.uid]; ok {
+					pushRcpt.rcpt.To[i].Delieved++
+					if sess.deviceId != "" {
+						pushRcpt.rcpt.To[i].Devices = append(pushRcpt.rcpt.To[i].Devices, sess.deviceId)
+					}
+				}
+			}
+		} else if sess.sendStuck() {
+			logTopic.Warnf("topic[%s]: connection stuck, detaching", t.name)
+			// The topic reads this channel itself: don't block. The request is repeated with the next message.
+			select {
+			case t.unreg <- &sessionLeave{sess: sess, unsub: false}:
+			default:
+			}
+		}
+		// Otherwise the message was dropped to keep the reserve for {ctrl}: the session is busy, not stuck.
+	}
+}
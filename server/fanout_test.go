@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// makeFanOutTopic creates a topic with the given number of users, each attached with sessPerUser sessions.
+func makeFanOutTopic(cat types.TopicCat, users, sessPerUser int) *Topic {
+	t := &Topic{
+		name:       "grpBenchmark",
+		x_original: "grpBenchmark",
+		cat:        cat,
+		perUser:    make(map[types.Uid]perUserData, users),
+		sessions:   make(map[*Session]bool, users*sessPerUser),
+		unreg:      make(chan *sessionLeave, 32)}
+
+	uids := make([]types.Uid, users)
+	for i := range uids {
+		uids[i] = types.Uid(i + 1)
+	}
+
+	for i, uid := range uids {
+		pud := perUserData{modeWant: types.ModeCPublic, modeGiven: types.ModeCPublic}
+		if cat == types.TopicCat_P2P {
+			pud.topicName = uids[(i+1)%len(uids)].UserId()
+		}
+		t.perUser[uid] = pud
+
+		for j := 0; j < sessPerUser; j++ {
+			sess := &Session{
+				sid:      strconv.Itoa(i) + "-" + strconv.Itoa(j),
+				uid:      uid,
+				deviceId: "device-" + strconv.Itoa(j),
+				send:     make(chan []byte, 1)}
+			t.sessions[sess] = true
+		}
+	}
+	return t
+}
+
+func drainFanOut(t *Topic) {
+	for sess := range t.sessions {
+		select {
+		case <-sess.send:
+		default:
+		}
+	}
+}
+
+func benchmarkFanOut(b *testing.B, cat types.TopicCat, users, sessPerUser int, withPush bool) {
+	t := makeFanOutTopic(cat, users, sessPerUser)
+	msg := &ServerComMessage{Data: &MsgServerData{
+		Topic:     t.x_original,
+		From:      types.Uid(1).UserId(),
+		Timestamp: time.Now().UTC().Round(time.Millisecond),
+		SeqId:     1,
+		Content:   "The quick brown fox jumps over the lazy dog"}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var pushRcpt *pushReceipt
+		if withPush {
+			pushRcpt = t.makePushReceipt(msg.Data)
+		}
+
+		t.fanOut(msg, pushRcpt)
+
+		b.StopTimer()
+		if pushRcpt != nil {
+			pushRcpt.releaseIndex()
+		}
+		drainFanOut(t)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkFanOutGroup10k(b *testing.B) {
+	benchmarkFanOut(b, types.TopicCat_Grp, 10000, 1, false)
+}
+
+func BenchmarkFanOutGroup10kPush(b *testing.B) {
+	benchmarkFanOut(b, types.TopicCat_Grp, 10000, 1, true)
+}
+
+func BenchmarkFanOutP2P(b *testing.B) {
+	benchmarkFanOut(b, types.TopicCat_P2P, 2, 8, false)
+}
+
+// BenchmarkFanOutP2PPerSession serializes the message for every session as fan-out did before
+// packets were shared, for comparison with BenchmarkFanOutP2P.
+func BenchmarkFanOutP2PPerSession(b *testing.B) {
+	t := makeFanOutTopic(types.TopicCat_P2P, 2, 8)
+	msg := &ServerComMessage{Data: &MsgServerData{
+		Topic:     t.x_original,
+		From:      types.Uid(1).UserId(),
+		Timestamp: time.Now().UTC().Round(time.Millisecond),
+		SeqId:     1,
+		Content:   "The quick brown fox jumps over the lazy dog"}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for sess := range t.sessions {
+			msg.Data.Topic = t.original(sess.uid)
+			packet, _ := json.Marshal(msg)
+			sess.send <- packet
+		}
+
+		b.StopTimer()
+		drainFanOut(t)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkEncodePacket(b *testing.B) {
+	msg := &ServerComMessage{Data: &MsgServerData{
+		Topic:     "grpBenchmark",
+		From:      types.Uid(1).UserId(),
+		Timestamp: time.Now().UTC().Round(time.Millisecond),
+		SeqId:     1,
+		Content:   "The quick brown fox jumps over the lazy dog"}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encodePacket(msg)
+	}
+}
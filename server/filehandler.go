@@ -0,0 +1,365 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Handler of large file uploads and downloads. The files are kept by the
+ *  media handler (local file system or S3), the store keeps the metadata.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// URL path for file uploads
+	FILE_UPLOAD_PATH = "/v0/file/u/"
+	// URL path for file downloads
+	FILE_SERVE_PATH = "/v0/file/s/"
+	// Default maximum size of an uploaded file
+	FILE_DEFAULT_MAX_SIZE = 8 << 20
+)
+
+// Types of files served inline. SVG and HTML are not in the list: they may contain scripts.
+var fileInlineTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+	"audio/mpeg": true,
+	"audio/ogg":  true,
+	"audio/wav":  true,
+	"audio/webm": true,
+	"audio/aac":  true,
+	"audio/mp4":  true,
+	"video/mp4":  true,
+	"video/ogg":  true,
+	"video/webm": true,
+}
+
+type mediaConfig struct {
+	// Name of the handler to use for file uploads, e.g. "fs" or "s3"
+	UseHandler string `json:"use_handler"`
+	// Maximum size of an uploaded file in bytes
+	MaxFileUploadSize int64 `json:"max_size"`
+	// Maximum total size of files uploaded by one user in bytes, 0 means unlimited
+	UserQuota int64 `json:"user_quota"`
+	// Individual handler configs
+	Handlers map[string]json.RawMessage `json:"handlers"`
+}
+
+// mediaInit parses config, initializes the media handler and mounts the upload and download
+// handlers. File uploads are disabled if no handler is configured.
+func mediaInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config mediaConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logHttp.Fatal("Failed to parse media config:", err)
+	}
+
+	if config.UseHandler == "" {
+		return
+	}
+
+	globals.mediaHandler = media.GetHandler(config.UseHandler)
+	if globals.mediaHandler == nil {
+		logHttp.Fatal("Unknown media handler '" + config.UseHandler + "'")
+	}
+	if err := globals.mediaHandler.Init(string(config.Handlers[config.UseHandler])); err != nil {
+		logHttp.Fatal("Failed to initialize media handler:", err)
+	}
+
+	globals.maxFileUploadSize = config.MaxFileUploadSize
+	if globals.maxFileUploadSize <= 0 {
+		globals.maxFileUploadSize = FILE_DEFAULT_MAX_SIZE
+	}
+	globals.fileUserQuota = config.UserQuota
+
+	http.HandleFunc(FILE_UPLOAD_PATH, serveFileUpload)
+	http.HandleFunc(FILE_SERVE_PATH, serveFileDownload)
+	logHttp.Infof("Using media handler '%s', max upload size %d", config.UseHandler, globals.maxFileUploadSize)
+}
+
+// serveFileUpload handles multipart POST requests to /v0/file/u/. The form must contain
+// "topic", the name of the topic where the file is going to be shared, and "file".
+func serveFileUpload(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	// The body must be limited before the form is parsed: the API key and the credentials may be
+	// sent as form values.
+	if req.ContentLength > globals.maxFileUploadSize {
+		writeErr(ErrTooLarge("", "", now))
+		return
+	}
+	req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxFileUploadSize)
+
+	// Memory buffer of the same size as the max message size. Larger files are spilled to disk.
+	if err := req.ParseMultipartForm(maxMessageSize()); err != nil {
+		logHttp.Warn("upload: failed to parse form", err)
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	uid, err := authHttpRequest(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	}
+
+	topic := req.FormValue("topic")
+	file, header, err := req.FormFile("file")
+	if err != nil || topic == "" {
+		writeErr(ErrMalformed("", topic, now))
+		return
+	}
+	defer file.Close()
+
+	// The client may use the "usrXXX" name of the p2p topic.
+	name := topic
+	if strings.HasPrefix(name, "usr") {
+		name = uid.P2PName(types.ParseUserId(name))
+	}
+	if !strings.HasPrefix(name, "grp") && !strings.HasPrefix(name, "chn") && !strings.HasPrefix(name, "p2p") {
+		writeErr(ErrPermissionDenied("", topic, now))
+		return
+	}
+
+	sub, err := store.Subs.Get(name, uid)
+	if err != nil {
+		writeErr(ErrUnknown("", topic, now))
+		return
+	}
+	if sub == nil || sub.IsDeleted() || !(sub.ModeGiven & sub.ModeWant).IsWriter() {
+		writeErr(ErrPermissionDenied("", topic, now))
+		return
+	}
+
+	// The operator may override the default quota of the user
+	quota := globals.fileUserQuota
+	if user, err := store.Users.Get(uid); err != nil {
+		writeErr(ErrUnknown("", topic, now))
+		return
+	} else if user != nil && user.FileQuota != 0 {
+		quota = user.FileQuota
+	}
+	if quota > 0 {
+		usage, err := store.Files.Usage(uid)
+		if err != nil {
+			writeErr(ErrUnknown("", topic, now))
+			return
+		}
+		if usage+header.Size > quota {
+			writeErr(ErrTooLarge("", topic, now))
+			return
+		}
+	}
+
+	mimeType := header.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	fdef := &types.FileDef{
+		User:     uid.String(),
+		Topic:    name,
+		MimeType: mimeType,
+		Size:     header.Size}
+	fdef.Id = store.GetUidString()
+
+	if err = store.Files.StartUpload(fdef); err != nil {
+		logHttp.Error("upload: failed to create file record", err)
+		writeErr(ErrUnknown("", topic, now))
+		return
+	}
+
+	fdef.Location, err = globals.mediaHandler.Upload(fdef, file)
+	if err != nil {
+		logHttp.Error("upload: failed to store file", err)
+		store.Files.FinishUpload(fdef, false)
+		writeErr(ErrUnknown("", topic, now))
+		return
+	}
+
+	if err = store.Files.FinishUpload(fdef, true); err != nil {
+		logHttp.Error("upload: failed to update file record", err)
+		writeErr(ErrUnknown("", topic, now))
+		return
+	}
+
+	pkt := NoErr("", topic, now)
+	pkt.Ctrl.Params = map[string]string{
+		"url": FILE_SERVE_PATH + fdef.Id,
+	}
+	enc.Encode(pkt)
+}
+
+// serveFileDownload handles GET requests like /v0/file/s/XXXXXX. Files shared in topics
+// published on the web are available to everyone, other files only to the topic subscribers.
+func serveFileDownload(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	enc := json.NewEncoder(wrt)
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	fid := strings.TrimPrefix(req.URL.Path, FILE_SERVE_PATH)
+	if fid == "" || strings.Contains(fid, "/") {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+
+	fdef, err := store.Files.Get(fid)
+	if err != nil {
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+	if fdef == nil || fdef.Status != types.UploadCompleted {
+		writeErr(ErrNotFound("", "", now))
+		return
+	}
+
+	if !fileAccessAllowed(req, fdef) {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	file, err := globals.mediaHandler.Download(fdef.Location)
+	if err != nil {
+		logHttp.Warn("download: failed to read file", err)
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+	defer file.Close()
+
+	// Only media which browsers can't execute is shown inline, everything else is downloaded
+	wrt.Header().Set("X-Content-Type-Options", "nosniff")
+	if mimeType, _, err := mime.ParseMediaType(fdef.MimeType); err == nil && fileInlineTypes[mimeType] {
+		wrt.Header().Set("Content-Type", mimeType)
+		wrt.Header().Set("Content-Disposition", "inline")
+	} else {
+		wrt.Header().Set("Content-Type", "application/octet-stream")
+		wrt.Header().Set("Content-Disposition", "attachment")
+	}
+	wrt.Header().Set("Content-Length", strconv.FormatInt(fdef.Size, 10))
+	wrt.Header().Set("Last-Modified", fdef.UpdatedAt.Format(http.TimeFormat))
+	if req.Method == http.MethodHead {
+		return
+	}
+	io.Copy(wrt, file)
+}
+
+// fileAccessAllowed checks if the file can be downloaded by the requester.
+func fileAccessAllowed(req *http.Request, fdef *types.FileDef) bool {
+	if webView.mount != "" && strings.HasPrefix(fdef.Topic, "grp") {
+		if topic, err := store.Topics.Get(fdef.Topic); err == nil && topic != nil && topic.WebView {
+			return true
+		}
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		return false
+	}
+	uid, err := authHttpRequest(req)
+	if err != nil {
+		return false
+	}
+	if uid.String() == fdef.User {
+		return true
+	}
+
+	sub, err := store.Subs.Get(fdef.Topic, uid)
+	return err == nil && sub != nil && !sub.IsDeleted() && (sub.ModeGiven & sub.ModeWant).IsReader()
+}
+
+// authHttpRequest authenticates the request by a token passed either in the "Authorization: Token ..."
+// header or in the "secret" form value.
+func authHttpRequest(req *http.Request) (types.Uid, error) {
+	uid, _, err := authHttpRequestLevel(req)
+	return uid, err
+}
+
+// authHttpRequestLevel is authHttpRequest which also returns the authentication level of the user.
+func authHttpRequestLevel(req *http.Request) (types.Uid, int, error) {
+	var secret string
+	if parts := strings.SplitN(req.Header.Get("Authorization"), " ", 2); len(parts) == 2 && parts[0] == "Token" {
+		secret = strings.TrimSpace(parts[1])
+	} else {
+		secret = req.FormValue("secret")
+	}
+	if secret == "" {
+		return types.ZeroUid, 0, errors.New("missing credentials")
+	}
+
+	token, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		if token, err = base64.URLEncoding.DecodeString(secret); err != nil {
+			return types.ZeroUid, 0, errors.New("malformed credentials")
+		}
+	}
+
+	hdl := store.GetAuthHandler("token")
+	if hdl == nil {
+		return types.ZeroUid, 0, errors.New("token authentication is not available")
+	}
+	uid, authLvl, _, authErr := hdl.Authenticate(token)
+	if authErr.IsError() {
+		return types.ZeroUid, 0, authErr.Err
+	}
+	if authLvl < auth.LevelAuth {
+		return types.ZeroUid, 0, errors.New("insufficient authentication level")
+	}
+	// Tokens issued before the account was disabled are not accepted
+	if user, err := store.Users.Get(uid); err != nil {
+		return types.ZeroUid, 0, err
+	} else if !userStateLoaded(user) {
+		return types.ZeroUid, 0, errors.New("account " + userStateName(user.State))
+	}
+	return uid, authLvl, nil
+}
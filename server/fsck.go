@@ -0,0 +1,116 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Consistency check of the store by root admins over HTTP:
+ *    GET /v0/admin/fsck - report the problems found;
+ *    POST /v0/admin/fsck - report and repair them.
+ *  The same check is run offline by tinode-db -fsck. See store.Fsck for the
+ *  list of problems and repairs. Repairs of topics which are loaded take
+ *  effect when the topics are loaded again.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the admin endpoint
+	ADMIN_FSCK_PATH = "/v0/admin/fsck"
+	// Maximum number of problems listed in the response; all are counted and logged
+	FSCK_MAX_REPORTED = 1000
+)
+
+// Problem as reported by the admin endpoint
+type fsckIssueInfo struct {
+	Kind     string `json:"kind"`
+	Object   string `json:"object"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// Result of the check
+type fsckResult struct {
+	Found    int              `json:"found"`
+	Repaired int              `json:"repaired"`
+	Issues   []*fsckIssueInfo `json:"issues,omitempty"`
+}
+
+// Only one check runs at a time
+var fsckRunning sync.Mutex
+
+// serveFsck checks the store and optionally repairs it:
+// GET /v0/admin/fsck
+// POST /v0/admin/fsck
+func serveFsck(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if req.Method != http.MethodGet && redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	uid, authLvl, err := authHttpRequestLevel(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	} else if authLvl != auth.LevelRoot {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	var repair bool
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		repair = true
+	default:
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	fsckRunning.Lock()
+	defer fsckRunning.Unlock()
+
+	logAudit.Infof("fsck: started by '%s', repair: %t", uid.UserId(), repair)
+
+	var result fsckResult
+	err = store.Fsck(repair, func(issue *types.FsckIssue) {
+		logMain.Warnf("fsck: %s '%s': %s, repaired: %t", issue.Kind, issue.Object, issue.Detail, issue.Repaired)
+		result.Found++
+		if issue.Repaired {
+			result.Repaired++
+		}
+		if len(result.Issues) < FSCK_MAX_REPORTED {
+			result.Issues = append(result.Issues, &fsckIssueInfo{Kind: issue.Kind, Object: issue.Object,
+				Detail: issue.Detail, Repaired: issue.Repaired})
+		}
+	})
+	if err != nil {
+		logMain.Error("fsck: failed:", err)
+		writeErr(ErrUnknown("", "", now))
+		return
+	}
+
+	enc.Encode(&result)
+}
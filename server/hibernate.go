@@ -0,0 +1,261 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Hibernation of idle websocket sessions. A session which has not sent
+ *  anything for the configured time stays connected and attached to 'me',
+ *  but is quietly detached from its group and p2p topics: no {ctrl} is sent
+ *  to the client and no presence change is announced. The session keeps
+ *  only the name of each topic and the ID of its last message. Topics with
+ *  no attached sessions left are unloaded as usual, releasing their queues.
+ *
+ *  The session is woken lazily:
+ *    - any packet from the client attaches the session to all hibernated
+ *      topics before the packet is processed;
+ *    - a new message in a hibernated topic, announced on 'me', attaches the
+ *      session to that topic; messages published while the session was
+ *      detached are sent to it as {data}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum time to wait for the topics to take a session woken by the client
+	HIBERNATION_WAKE_TIMEOUT = 2 * time.Second
+	// Maximum number of missed messages sent to a woken session
+	HIBERNATION_MAX_MISSED = 32
+)
+
+type hibernationConfig struct {
+	// Websocket sessions idle for this many seconds are hibernated, 0 disables hibernation
+	Idle int `json:"idle"`
+}
+
+// Topic the session was detached from while hibernated
+type hibernatedTopic struct {
+	// Name of the topic as seen by the user
+	original string
+	// ID of the last message of the topic when the session was detached
+	seq int
+}
+
+var hibernation struct {
+	idle time.Duration
+
+	// Exported as Hibernation in expvar
+	detached *expvar.Int
+	resumed  *expvar.Int
+	missed   *expvar.Int
+}
+
+// hibernationInit parses config and starts hibernating idle sessions. Hibernation is off by default.
+func hibernationInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config hibernationConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse hibernation config:", err)
+	}
+	if config.Idle <= 0 {
+		return
+	}
+
+	hibernation.idle = time.Duration(config.Idle) * time.Second
+	hibernation.detached = new(expvar.Int)
+	hibernation.resumed = new(expvar.Int)
+	hibernation.missed = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("detached", hibernation.detached)
+	vars.Set("resumed", hibernation.resumed)
+	vars.Set("missed", hibernation.missed)
+	expvar.Publish("Hibernation", vars)
+
+	period := hibernation.idle / 2
+	if period > time.Minute {
+		period = time.Minute
+	}
+	go hibernationSweep(period)
+
+	logMain.Infof("Sessions idle for %s are hibernated", hibernation.idle)
+}
+
+func hibernationSweep(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		globals.sessionStore.Hibernate(hibernation.idle)
+	}
+}
+
+// hibernatable checks if the session may be detached from the topic while idle.
+func hibernatable(topic string) bool {
+	return strings.HasPrefix(topic, "grp") || strings.HasPrefix(topic, "chn") || strings.HasPrefix(topic, "p2p")
+}
+
+// hibernateTopics detaches the idle session from its topics. Must be called by the goroutine
+// which writes to the session.
+func (s *Session) hibernateTopics() {
+	if time.Since(s.lastActionAt()) < hibernation.idle {
+		// The client sent something after the session was found idle
+		return
+	}
+
+	var leaves []*sessionLeave
+	var done []chan<- *sessionLeave
+
+	s.hlock.Lock()
+	for name, sub := range s.subs {
+		if !hibernatable(name) {
+			continue
+		}
+		if s.hibernated == nil {
+			s.hibernated = make(map[string]*hibernatedTopic)
+		}
+		entry := &hibernatedTopic{}
+		s.hibernated[name] = entry
+		delete(s.subs, name)
+		leaves = append(leaves, &sessionLeave{sess: s, topic: name, hibernate: entry})
+		done = append(done, sub.done)
+	}
+	s.hlock.Unlock()
+
+	// The topics lock the session when processing the request
+	for i, leave := range leaves {
+		done[i] <- leave
+	}
+}
+
+// wake attaches the session to all hibernated topics and waits for the topics to take it.
+func (s *Session) wake() {
+	s.hlock.Lock()
+	entries := s.hibernated
+	s.hibernated = nil
+	resume := make(map[string]hibernatedTopic, len(entries))
+	for name, entry := range entries {
+		resume[name] = *entry
+	}
+	s.hlock.Unlock()
+
+	if len(resume) == 0 {
+		return
+	}
+
+	done := make(chan bool, len(resume))
+	for name, entry := range resume {
+		s.resume(name, entry, done)
+	}
+
+	timeout := time.After(HIBERNATION_WAKE_TIMEOUT)
+	for range resume {
+		select {
+		case <-done:
+		case <-timeout:
+			logSession.Warnf("sess[%s]: timeout waking up from hibernation", s.sid)
+			return
+		}
+	}
+}
+
+// wakeTopic attaches the session to one hibernated topic without waiting.
+func (s *Session) wakeTopic(name string) {
+	s.hlock.Lock()
+	entry, ok := s.hibernated[name]
+	if ok {
+		delete(s.hibernated, name)
+	}
+	s.hlock.Unlock()
+
+	if ok {
+		go s.resume(name, *entry, nil)
+	}
+}
+
+// resume asks the hub to attach the session to the topic again.
+func (s *Session) resume(name string, entry hibernatedTopic, done chan bool) {
+	if entry.original == "" {
+		// The topic has not detached the session yet, it's still loaded
+		entry.original = name
+	}
+	hibernation.resumed.Add(1)
+	globals.hub.join <- &sessionJoin{topic: name, pkt: &MsgClientSub{Topic: entry.original}, sess: s,
+		resume: &entry, resumed: done}
+}
+
+// hibernateSession detaches the idle session without notifying anyone and records where it
+// should resume from.
+func (t *Topic) hibernateSession(sess *Session, entry *hibernatedTopic) {
+	sess.hlock.Lock()
+	defer sess.hlock.Unlock()
+
+	if sess.hibernated[t.name] != entry || !t.sessions[sess] {
+		// The session woke up before it was detached
+		return
+	}
+
+	delete(t.sessions, sess)
+	pud := t.perUser[sess.uid]
+	pud.online--
+	t.perUser[sess.uid] = pud
+
+	entry.original = t.original(sess.uid)
+	entry.seq = t.lastId
+	hibernation.detached.Add(1)
+}
+
+// resumeSession attaches the woken session without a reply to the client and sends it the messages
+// published while it was detached.
+func (t *Topic) resumeSession(sreg *sessionJoin) error {
+	sess := sreg.sess
+	pud, ok := t.perUser[sess.uid]
+	if !ok || !(pud.modeGiven & pud.modeWant).IsJoiner() {
+		return errors.New("hibernated session is no longer subscribed")
+	}
+
+	if t.sessions[sess] {
+		// The session was not detached yet
+		return nil
+	}
+
+	pud.online++
+	t.perUser[sess.uid] = pud
+
+	since := sreg.resume.seq
+	if since <= 0 || since >= t.lastId || !(pud.modeGiven & pud.modeWant).IsReader() {
+		return nil
+	}
+	if since < pud.clearId {
+		since = pud.clearId
+	}
+
+	messages, err := store.Messages.GetAll(t.name, sess.uid,
+		&types.BrowseOpt{Since: since + 1, Limit: HIBERNATION_MAX_MISSED})
+	if err != nil {
+		// The session is attached anyway, the client will fetch the messages itself
+		logTopic.Warnf("topic[%s]: failed to load messages missed in hibernation: %v", t.name, err)
+		return nil
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		sess.queueOut(storedMessage(t.original(sess.uid), sess.uid, &messages[i]))
+	}
+	if hibernation.missed != nil {
+		// Restored long polling sessions resume without hibernation
+		hibernation.missed.Add(int64(len(messages)))
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Limits of message history queries. Requests {get what="data"} are
+ *  adjusted before they reach the database:
+ *    max_messages - the number of messages returned by one request; requests
+ *                   without a limit or with a greater one get this many;
+ *    max_age      - messages older than this are not returned at all;
+ *    rate, burst  - history requests of a user across all topics, per minute;
+ *                   requests over the rate are rejected with 429 and
+ *                   params.retry_after in seconds.
+ *  All limits are off by default.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// The first message newer than max_age is looked up again after this time
+	HISTORY_FLOOR_TTL = time.Minute
+	// Rate counters of users are purged of idle ones when there are so many
+	HISTORY_PURGE_SIZE = 100000
+)
+
+type historyLimitConfig struct {
+	// Maximum number of messages returned by one request, 0 - unlimited
+	MaxMessages int `json:"max_messages"`
+	// Messages older than this many seconds are not returned, 0 - unlimited
+	MaxAge int `json:"max_age"`
+	// History requests allowed per user per minute, 0 - unlimited
+	Rate int `json:"rate"`
+	// Requests allowed in a burst, default is the rate
+	Burst int `json:"burst"`
+}
+
+// Request budget of one user
+type historyBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var historyLimit struct {
+	maxMessages int
+	maxAge      time.Duration
+	rate        float64
+	burst       float64
+
+	lock    sync.Mutex
+	buckets map[types.Uid]*historyBucket
+
+	// Exported as HistoryLimits in expvar
+	clamped   *expvar.Int
+	aged      *expvar.Int
+	throttled *expvar.Int
+}
+
+// The first message which is not older than max_age, per topic. Accessed by the topic goroutine only.
+type historyFloor struct {
+	seq int
+	at  time.Time
+}
+
+// historyLimitInit parses config and publishes the metrics.
+func historyLimitInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config historyLimitConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse history_limits config:", err)
+	}
+
+	historyLimit.maxMessages = config.MaxMessages
+	historyLimit.maxAge = time.Duration(config.MaxAge) * time.Second
+	historyLimit.rate = float64(config.Rate) / 60
+	historyLimit.burst = float64(config.Burst)
+	if historyLimit.burst <= 0 {
+		historyLimit.burst = float64(config.Rate)
+	}
+	historyLimit.buckets = make(map[types.Uid]*historyBucket)
+
+	historyLimit.clamped = new(expvar.Int)
+	historyLimit.aged = new(expvar.Int)
+	historyLimit.throttled = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("clamped", historyLimit.clamped)
+	vars.Set("aged", historyLimit.aged)
+	vars.Set("throttled", historyLimit.throttled)
+	expvar.Publish("HistoryLimits", vars)
+
+	logMain.Infof("History limits: %d messages, %s, %d requests per minute", config.MaxMessages,
+		historyLimit.maxAge, config.Rate)
+}
+
+// historyThrottle takes one request from the user's budget. Returns the time to wait if the budget is spent.
+func historyThrottle(uid types.Uid, now time.Time) (time.Duration, bool) {
+	if historyLimit.rate <= 0 {
+		return 0, false
+	}
+
+	historyLimit.lock.Lock()
+	defer historyLimit.lock.Unlock()
+
+	b := historyLimit.buckets[uid]
+	if b == nil {
+		if len(historyLimit.buckets) >= HISTORY_PURGE_SIZE {
+			historyPurge(now)
+		}
+		b = &historyBucket{tokens: historyLimit.burst, last: now}
+		historyLimit.buckets[uid] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * historyLimit.rate
+	if b.tokens > historyLimit.burst {
+		b.tokens = historyLimit.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		historyLimit.throttled.Add(1)
+		return time.Duration((1 - b.tokens) / historyLimit.rate * float64(time.Second)), true
+	}
+	b.tokens--
+	return 0, false
+}
+
+// historyPurge forgets users whose budget is full again. Must be called with the lock held.
+func historyPurge(now time.Time) {
+	for uid, b := range historyLimit.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*historyLimit.rate >= historyLimit.burst {
+			delete(historyLimit.buckets, uid)
+		}
+	}
+}
+
+// historyAdjust applies the depth limits to the query.
+func (t *Topic) historyAdjust(opts *types.BrowseOpt, now time.Time) *types.BrowseOpt {
+	if historyLimit.maxMessages <= 0 && historyLimit.maxAge <= 0 {
+		return opts
+	}
+	if opts == nil {
+		opts = &types.BrowseOpt{}
+	}
+
+	if limit := uint(historyLimit.maxMessages); limit > 0 && (opts.Limit == 0 || opts.Limit > limit) {
+		if opts.Limit > limit {
+			historyLimit.clamped.Add(1)
+		}
+		opts.Limit = limit
+	}
+
+	if historyLimit.maxAge > 0 {
+		cutoff := now.Add(-historyLimit.maxAge)
+		if opts.ByTime {
+			if opts.After == nil || opts.After.Before(cutoff) {
+				opts.After = &cutoff
+				historyLimit.aged.Add(1)
+			}
+		} else if floor := t.historyFloorSeq(now, cutoff); opts.Since < floor {
+			opts.Since = floor
+			historyLimit.aged.Add(1)
+		}
+	}
+	return opts
+}
+
+// historyFloorSeq returns the ID of the oldest message which may be returned.
+func (t *Topic) historyFloorSeq(now, cutoff time.Time) int {
+	if now.Sub(t.historyFloor.at) < HISTORY_FLOOR_TTL {
+		return t.historyFloor.seq
+	}
+
+	first, err := store.Messages.FirstAfter(t.name, t.clearId+1, cutoff)
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to find the oldest message within history limits: %v", t.name, err)
+		// Keep the previous value
+		return t.historyFloor.seq
+	}
+	if first == 0 {
+		// All messages are older than max_age
+		first = t.lastId + 1
+	}
+	t.historyFloor = historyFloor{seq: first, at: now}
+	return first
+}
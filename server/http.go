@@ -9,15 +9,16 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -47,6 +48,38 @@ type TlsAutocertConfig struct {
 	Email string `json:"email"`
 }
 
+// Certificate loaded from cert_file and key_file, replaced when the config is reloaded.
+// Not set if TLS is disabled or autocert is used.
+var tlsCert atomic.Value
+
+func loadTlsCert(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	tlsCert.Store(&cert)
+	return nil
+}
+
+// tlsReload loads the static certificate again, e.g. after it was renewed. Switching between
+// plain HTTP, autocert and static certificates requires a restart.
+func tlsReload(tls_config string) error {
+	if tlsCert.Load() == nil {
+		return nil
+	}
+
+	var tlsConfig TlsConfig
+	if tls_config != "" {
+		if err := json.Unmarshal([]byte(tls_config), &tlsConfig); err != nil {
+			return errors.New("failed to parse tls_config: " + err.Error())
+		}
+	}
+	if tlsConfig.Autocert != nil || tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+		return errors.New("changing TLS mode requires a restart")
+	}
+	return loadTlsCert(tlsConfig.CertFile, tlsConfig.KeyFile)
+}
+
 func listenAndServe(addr string, tlsEnabled bool, tls_config string, stop <-chan bool) error {
 	var tlsConfig TlsConfig
 
@@ -84,12 +117,20 @@ func listenAndServe(addr string, tlsEnabled bool, tls_config string, stop <-chan
 
 			server.TLSConfig.GetCertificate = certManager.GetCertificate
 			if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
-				log.Printf("HTTP server: using autocert, static cert and key files are ignored")
+				logHttp.Infof("HTTP server: using autocert, static cert and key files are ignored")
 				tlsConfig.CertFile = ""
 				tlsConfig.KeyFile = ""
 			}
 		} else if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
 			return errors.New("HTTP server: missing certificate or key file names")
+		} else {
+			if err := loadTlsCert(tlsConfig.CertFile, tlsConfig.KeyFile); err != nil {
+				return errors.New("HTTP server: failed to load certificate: " + err.Error())
+			}
+			// Serve the current certificate so it can be replaced without a restart
+			server.TLSConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return tlsCert.Load().(*tls.Certificate), nil
+			}
 		}
 	}
 
@@ -97,22 +138,23 @@ func listenAndServe(addr string, tlsEnabled bool, tls_config string, stop <-chan
 		var err error
 		if tlsEnabled || tlsConfig.Enabled {
 			if tlsConfig.RedirectHttp != "" {
-				log.Printf("Redirecting connections from HTTP at [%s] to HTTPS at [%s]",
+				logHttp.Infof("Redirecting connections from HTTP at [%s] to HTTPS at [%s]",
 					tlsConfig.RedirectHttp, server.Addr)
 				go http.ListenAndServe(tlsConfig.RedirectHttp, tlsRedirect(addr))
 			}
 
-			log.Printf("Listening for client HTTPS connections on [%s]", server.Addr)
-			err = server.ListenAndServeTLS(tlsConfig.CertFile, tlsConfig.KeyFile)
+			logHttp.Infof("Listening for client HTTPS connections on [%s]", server.Addr)
+			// Certificates are provided by TLSConfig.GetCertificate
+			err = server.ListenAndServeTLS("", "")
 		} else {
-			log.Printf("Listening for client HTTP connections on [%s]", server.Addr)
+			logHttp.Infof("Listening for client HTTP connections on [%s]", server.Addr)
 			err = server.ListenAndServe()
 		}
 		if err != nil {
 			if shuttingDown {
-				log.Printf("HTTP server: stopped")
+				logHttp.Infof("HTTP server: stopped")
 			} else {
-				log.Println("HTTP server: failed", err)
+				logHttp.Warn("HTTP server: failed", err)
 			}
 		}
 		httpdone <- true
@@ -123,28 +165,55 @@ loop:
 	for {
 		select {
 		case <-stop:
-			// Flip the flag that we are terminating and close the Accept-ing socket, so no new connections are possible
+			// Sessions, requests in progress and topics must finish by this time
+			deadline := time.Now().Add(globals.drainTimeout)
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			defer cancel()
+
+			// Flip the flag that we are terminating and close the Accept-ing socket, so no new connections are possible.
+			// Shutdown waits for requests in progress, such as long polls, to complete.
 			shuttingDown = true
-			if err := server.Shutdown(nil); err != nil {
-				// failure/timeout shutting down the server gracefully
-				return err
-			}
+			httpstopped := make(chan error, 1)
+			go func() {
+				httpstopped <- server.Shutdown(ctx)
+			}()
 
 			// Wait for http server to stop Accept()-ing connections
 			<-httpdone
+			// Stop accepting MQTT clients
+			mqttStop()
 
-			// Terminate all sessions
-			globals.sessionStore.Shutdown()
+			// Tell sessions the server is going away and wait for them to disconnect
+			globals.sessionStore.Shutdown(deadline)
+
+			if err := <-httpstopped; err != nil {
+				logHttp.Warn("HTTP server: requests in progress did not complete", err)
+			}
 
 			// Shutdown local cluster node, if it's a part of a cluster.
 			globals.cluster.shutdown()
 
-			// Shutdown the hub. The hub will shutdown topics
+			// Shutdown the hub. The hub will shutdown topics after they save pending messages
 			hubdone := make(chan bool)
 			globals.hub.shutdown <- hubdone
 
 			// wait for the hub to finish
-			<-hubdone
+			select {
+			case <-hubdone:
+			case <-time.After(deadline.Sub(time.Now())):
+				logHttp.Warn("HTTP server: topics did not shut down in time")
+			}
+
+			// Save read/recv markers of topics which are still running
+			markersStop()
+			// Save last seen time of users who went offline recently
+			lastSeenStop()
+			// Deliver the messages waiting to be journaled
+			complianceStop()
+			// Disconnect from the store of long polling sessions
+			lpStateStop()
+			// Send the last metrics
+			metricsStop()
 
 			break loop
 
@@ -162,10 +231,17 @@ func signalHandler() <-chan bool {
 	signal.Notify(signchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		// Wait for a signal. Don't care which signal it is
-		sig := <-signchan
-		log.Printf("Signal received: '%s', shutting down", sig)
-		stop <- true
+		for sig := range signchan {
+			if sig == syscall.SIGHUP {
+				logHttp.Infof("Signal received: '%s', reloading config", sig)
+				reloadConfig()
+				continue
+			}
+
+			logHttp.Infof("Signal received: '%s', shutting down", sig)
+			stop <- true
+			return
+		}
 	}()
 
 	return stop
@@ -9,13 +9,16 @@
 package main
 
 import (
+	"errors"
 	"expvar"
-	"log"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Request to hub to subscribe session to topic
@@ -30,6 +33,10 @@ type sessionJoin struct {
 	created bool
 	// If the topic was just loaded
 	loaded bool
+	// Hibernated session resumes the subscription quietly
+	resume *hibernatedTopic
+	// Signal when the resumed session is processed, could be nil
+	resumed chan bool
 }
 
 // Request to hub to remove the topic
@@ -42,6 +49,10 @@ type topicUnreg struct {
 	msg *MsgClientDel
 	// Unregister then delete the topic
 	del bool
+	// Deleted by the operator regardless of the owner; receives the result
+	adminDone chan error
+	// The loaded topic already deleted from the store by the operator, to be stopped
+	adminDeleted *Topic
 }
 
 type metaReq struct {
@@ -131,6 +142,9 @@ func (h *Hub) run() {
 			t := h.topicGet(sreg.topic) // is the topic already loaded?
 			if t == nil {
 				// Topic does not exist or not loaded
+				if memRefuseTopic(sreg) || shedRefuseTopic(sreg) {
+					continue
+				}
 				go topicInit(sreg, h)
 			} else {
 				// Topic found.
@@ -146,38 +160,35 @@ func (h *Hub) run() {
 			if dst := h.topicGet(msg.rcptto); dst != nil {
 				// Everything is OK, sending packet to known topic
 				if dst.broadcast != nil {
+					_, span := traceStart(msg.ctx, "hub.route", attribute.String("topic", msg.rcptto))
 					select {
 					case dst.broadcast <- msg:
+						span.End()
 					default:
-						log.Printf("hub: topic's broadcast queue is full '%s'", dst.name)
+						logHub.Warnf("hub: topic's broadcast queue is full '%s'", dst.name)
+						traceEnd(span, errors.New("topic's broadcast queue is full"))
 					}
 				}
 			} else {
 				if msg.Data != nil {
-					// Normally the message is persisted at the topic. If the topic is offline,
-					// persist message here. The only case of sending to offline topics is invites/info to 'me'
-					// The 'me' must receive them, so ignore access settings
-
-					if err := store.Messages.Save(&types.Message{
-						ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
-						Topic:     msg.rcptto,
-						// SeqId is assigned by the store.Mesages.Save
-						From:    types.ParseUserId(msg.Data.From).String(),
-						Content: msg.Data.Content}); err != nil {
-
-						msg.sessFrom.queueOut(ErrUnknown(msg.id, msg.Data.Topic, timestamp))
-						return
-					}
-
-					// TODO(gene): validate topic name, discarding invalid topics
-					log.Printf("Hub. Topic[%s] is unknown or offline", msg.rcptto)
-
-					msg.sessFrom.queueOut(NoErrAccepted(msg.id, msg.rcptto, timestamp))
+					// Normally the message is persisted at the topic. The topic is offline: persist the
+					// message without blocking the hub.
+					go h.routeOffline(msg, timestamp)
+				} else if msg.Info != nil && msg.Info.What == "edit" {
+					// Card edited by a bot while the topic is offline: nobody to notify, just save it
+					go cardEditOffline(msg.rcptto, types.ParseUserId(msg.Info.From), msg.Info)
+				} else if msg.Info != nil && msg.Info.What == "expire" {
+					// Messages expired in a topic which is not loaded: delete them and notify offline subscribers
+					go messagesExpireOffline(msg.rcptto, msg.Info.SeqId)
+				} else if msg.Info != nil && msg.Info.What == "unsub" {
+					// The user left a topic which is not loaded by a bulk request: tell the user's sessions
+					go presSingleUserOfflineOffline(types.ParseUserId(msg.Info.From), msg.Info.Topic, "gone",
+						types.ModeNone, nilPresParams, "")
 				}
 			}
 
 		case meta := <-h.meta:
-			log.Println("hub.meta: got message")
+			logHub.Debug("hub.meta: got message")
 			// Request for topic info from a user who is not subscribed to the topic
 			if dst := h.topicGet(meta.topic); dst != nil {
 				// If topic is already in memory, pass request to topic
@@ -193,26 +204,46 @@ func (h *Hub) run() {
 			if unreg.del {
 				reason = StopDeleted
 			}
-			h.topicUnreg(unreg.sess, unreg.topic, unreg.msg, reason)
+			if unreg.adminDeleted != nil {
+				h.topicDeletedAdmin(unreg.adminDeleted, unreg.adminDone)
+			} else if unreg.adminDone != nil {
+				h.topicDeleteAdmin(unreg.topic, unreg.adminDone)
+			} else {
+				h.topicUnreg(unreg.sess, unreg.topic, unreg.msg, reason)
+			}
 
 		case <-h.rehash:
 			for _, topic := range h.topics {
 				if globals.cluster.isRemoteTopic(topic.name) {
+					// Messages to the topic are buffered until it's stopped here
+					handoffBegin(topic.name)
 					h.topicUnreg(nil, topic.name, nil, StopRehashing)
 				}
 			}
+			// Sessions attached to topics of dead nodes are attached to the new masters
+			go globals.cluster.rehomeSessions()
 
 		case hubdone := <-h.shutdown:
 			topicsdone := make(chan bool)
 			for _, topic := range h.topics {
-				topic.exit <- &shutDown{done: topicsdone}
+				topic.exit <- &shutDown{done: topicsdone, reason: StopShutdown}
+				topicStopping(topic, StopShutdown)
 			}
 
-			for i := 0; i < len(h.topics); i++ {
-				<-topicsdone
+			for i := 0; i < len(h.topics); {
+				select {
+				case <-topicsdone:
+					i++
+				case msg := <-h.route:
+					// Topics deliver their pending messages before stopping and must not block on the hub.
+					// Notifications are not delivered at shutdown anyway.
+					if msg.Data != nil {
+						logHub.Warnf("hub: message to '%s' dropped at shutdown", msg.rcptto)
+					}
+				}
 			}
 
-			log.Printf("Hub shutdown: terminated %d topics", len(h.topics))
+			logHub.Infof("Hub shutdown: terminated %d topics", len(h.topics))
 
 			// let the main goroutine know we are done with the cleanup
 			hubdone <- true
@@ -225,9 +256,107 @@ func (h *Hub) run() {
 }
 
 // topicInit reads an existing topic from database or creates a new topic
+// Locks of topics which are being loaded or receive messages while offline. A topic is not loaded while
+// a message is being saved into it, so the SeqId of the message is not reused by the topic.
+var topicLocks = struct {
+	sync.Mutex
+	locks map[string]*topicLock
+}{locks: make(map[string]*topicLock)}
+
+type topicLock struct {
+	sync.Mutex
+	// Number of goroutines holding or waiting for the lock
+	refs int
+}
+
+// lockTopic locks the topic by name. Returns the function which unlocks it.
+func lockTopic(name string) func() {
+	topicLocks.Lock()
+	tl := topicLocks.locks[name]
+	if tl == nil {
+		tl = &topicLock{}
+		topicLocks.locks[name] = tl
+	}
+	tl.refs++
+	topicLocks.Unlock()
+
+	tl.Lock()
+	return func() {
+		tl.Unlock()
+		topicLocks.Lock()
+		if tl.refs--; tl.refs == 0 {
+			delete(topicLocks.locks, name)
+		}
+		topicLocks.Unlock()
+	}
+}
+
+// routeOffline persists the message sent to a topic which is not loaded. The cases of sending to
+// offline topics are invites/info to 'me' and server-generated messages, such as digests, to group
+// topics. The 'me' must receive them, so ignore access settings.
+func (h *Hub) routeOffline(msg *ServerComMessage, timestamp time.Time) {
+	unlock := lockTopic(msg.rcptto)
+	defer unlock()
+
+	if h.topicGet(msg.rcptto) != nil {
+		// The topic was loaded meanwhile, it will persist the message
+		h.route <- msg
+		return
+	}
+
+	// SeqId of 'me' is assigned by the store.Mesages.Save
+	var seqId int
+	if strings.HasPrefix(msg.rcptto, "grp") || strings.HasPrefix(msg.rcptto, "chn") ||
+		strings.HasPrefix(msg.rcptto, "p2p") {
+		stopic, err := store.Topics.Get(msg.rcptto)
+		if err != nil || stopic == nil {
+			logHub.Warnf("hub: failed to load offline topic '%s' %v", msg.rcptto, err)
+			return
+		}
+		seqId = stopic.SeqId + 1
+	}
+
+	stored := &types.Message{
+		ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
+		SeqId:     seqId,
+		Topic:     msg.rcptto,
+		From:      types.ParseUserId(msg.Data.From).String(),
+		Thread:    msg.Data.Thread,
+		Head:      msg.Data.Head,
+		Content:   msg.Data.Content}
+	_, span := traceStart(msg.ctx, "store.Messages.Save", attribute.String("topic", msg.rcptto))
+	err := store.Messages.Save(stored)
+	traceEnd(span, err)
+	if err != nil {
+		msg.sessFrom.queueOut(ErrUnknown(msg.id, msg.Data.Topic, timestamp))
+		return
+	}
+
+	if strings.HasPrefix(msg.rcptto, "usr") {
+		// The user is offline, deliver the message as a push notification
+		push.Push(&push.Receipt{
+			To: []push.PushTo{{User: types.ParseUserId(msg.rcptto)}},
+			Payload: push.Payload{
+				Topic:     msg.Data.Topic,
+				From:      msg.Data.From,
+				Timestamp: msg.Data.Timestamp,
+				SeqId:     stored.SeqId,
+				Content:   msg.Data.Content}})
+	}
+
+	// TODO(gene): validate topic name, discarding invalid topics
+	logHub.Warnf("Hub. Topic[%s] is unknown or offline", msg.rcptto)
+
+	msg.sessFrom.queueOut(NoErrAccepted(msg.id, msg.rcptto, timestamp))
+}
+
 func topicInit(sreg *sessionJoin, h *Hub) {
 	var t *Topic
 
+	// Messages are not saved into the topic while it's being loaded
+	unlock := lockTopic(sreg.topic)
+	defer unlock()
+
 	timestamp := time.Now().UTC().Round(time.Millisecond)
 
 	t = &Topic{name: sreg.topic,
@@ -245,7 +374,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 	parseMode := func(modeString string, defaultMode types.AccessMode) types.AccessMode {
 		mode := defaultMode
 		if err := mode.UnmarshalText([]byte(modeString)); err != nil {
-			log.Println("hub: invalid access mode for topic[" + t.x_original + "]: '" + modeString + "'")
+			logHub.Warn("hub: invalid access mode for topic[" + t.x_original + "]: '" + modeString + "'")
 		}
 
 		return mode
@@ -260,13 +389,13 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 
 		user, err := store.Users.Get(sreg.sess.uid)
 		if err != nil {
-			log.Println("hub: cannot load user object for 'me'='" + t.name + "' (" + err.Error() + ")")
+			logHub.Warn("hub: cannot load user object for 'me'='" + t.name + "' (" + err.Error() + ")")
 			// Log out the session
 			sreg.sess.uid = types.ZeroUid
 			sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		} else if user == nil {
-			log.Println("hub: user's account unexpectedly not found (deleted?)")
+			logHub.Error("hub: user's account unexpectedly not found (deleted?)")
 			// Log out the session
 			sreg.sess.uid = types.ZeroUid
 			sreg.sess.queueOut(ErrUserNotFound(sreg.pkt.Id, t.x_original, timestamp))
@@ -276,9 +405,11 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		// User's default access for p2p topics
 		t.accessAuth = user.Access.Auth
 		t.accessAnon = user.Access.Anon
+		t.blocked = bansLoad(user.Blocked)
+		t.privacy = user.Privacy
 
 		if err = t.loadSubscribers(); err != nil {
-			log.Println("hub: cannot load subscribers for '" + t.name + "' (" + err.Error() + ")")
+			logHub.Warn("hub: cannot load subscribers for '" + t.name + "' (" + err.Error() + ")")
 			sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		}
@@ -309,17 +440,17 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 
 		user, err := store.Users.Get(sreg.sess.uid)
 		if err != nil {
-			log.Println("hub: cannot load user object for 'fnd'='" + t.name + "' (" + err.Error() + ")")
+			logHub.Warn("hub: cannot load user object for 'fnd'='" + t.name + "' (" + err.Error() + ")")
 			sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		} else if user == nil {
-			log.Println("hub: user's account unexpectedly not found (deleted?)")
+			logHub.Error("hub: user's account unexpectedly not found (deleted?)")
 			sreg.sess.queueOut(ErrUserNotFound(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		}
 
 		if err = t.loadSubscribers(); err != nil {
-			log.Println("hub: cannot load subscribers for '" + t.name + "' (" + err.Error() + ")")
+			logHub.Warn("hub: cannot load subscribers for '" + t.name + "' (" + err.Error() + ")")
 			sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		}
@@ -348,7 +479,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		// Check if the topic already exists
 		stopic, err := store.Topics.Get(t.name)
 		if err != nil {
-			log.Println("hub: error while loading topic '" + t.name + "' (" + err.Error() + ")")
+			logHub.Warn("hub: error while loading topic '" + t.name + "' (" + err.Error() + ")")
 			sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		}
@@ -358,14 +489,14 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		if stopic != nil {
 			// Subs already have Public swapped
 			if subs, err = store.Topics.GetSubs(t.name); err != nil {
-				log.Println("hub: cannot load subscritions for '" + t.name + "' (" + err.Error() + ")")
+				logHub.Warn("hub: cannot load subscritions for '" + t.name + "' (" + err.Error() + ")")
 				sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 				return
 			}
 
 			// Case 3, fail
 			if subs == nil || len(subs) == 0 {
-				log.Println("hub: missing both subscriptions for '" + t.name + "' (SHOULD NEVER HAPPEN!)")
+				logHub.Error("hub: missing both subscriptions for '" + t.name + "' (SHOULD NEVER HAPPEN!)")
 				sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 				return
 			}
@@ -375,6 +506,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 
 			t.lastId = stopic.SeqId
 			t.clearId = stopic.ClearId
+			t.ttl = stopic.MessageTtl
 		}
 
 		// t.owner is blank for p2p topics
@@ -390,7 +522,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		if stopic != nil && len(subs) == 2 {
 			// Case 4.
 
-			log.Println("hub: existing p2p topic")
+			logHub.Debug("hub: existing p2p topic")
 
 			for i := 0; i < 2; i++ {
 				uid := types.ParseUid(subs[i].User)
@@ -400,11 +532,20 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 					topicName: types.ParseUid(subs[(i+1)%2].User).UserId(),
 
 					private:   subs[i].Private,
+					notify:    subs[i].Notify,
 					modeWant:  subs[i].ModeWant,
 					modeGiven: subs[i].ModeGiven,
 					clearId:   subs[i].ClearId}
 			}
 
+			users, err := store.Users.GetAll(types.ParseUid(subs[0].User), types.ParseUid(subs[1].User))
+			if err != nil {
+				logHub.Warn("hub: failed to load users for '" + t.name + "' (" + err.Error() + ")")
+				sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
+				return
+			}
+			t.blocked = p2pBlocksLoad(users)
+
 		} else {
 			// Cases 1 (new topic), 2 (one of the two subscriptions is missing: either it's a new request
 			// or the subscription was deleted)
@@ -417,17 +558,17 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 			userId2 := types.ParseUserId(t.x_original)
 			// User index: u1 - requester, u2 - the other user
 
-			log.Println("hub: creating new p2p topic", userId1.String(), userId2.String())
+			logHub.Debug("hub: creating new p2p topic", userId1.String(), userId2.String())
 
 			var u1, u2 int
 			users, err := store.Users.GetAll(userId1, userId2)
 			if err != nil {
-				log.Println("hub: failed to load users for '" + t.name + "' (" + err.Error() + ")")
+				logHub.Warn("hub: failed to load users for '" + t.name + "' (" + err.Error() + ")")
 				sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 				return
 			} else if users == nil || len(users) != 2 {
 				// Invited user does not exist
-				log.Println("hub: missing user for '" + t.name + "'")
+				logHub.Warn("hub: missing user for '" + t.name + "'")
 				sreg.sess.queueOut(ErrUserNotFound(sreg.pkt.Id, t.x_original, timestamp))
 				return
 			} else {
@@ -439,6 +580,13 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 				}
 			}
 
+			if blocks(&users[u2], userId1) {
+				// The requester is blocked by the other user
+				sreg.sess.queueOut(ErrPermissionDenied(sreg.pkt.Id, t.x_original, timestamp))
+				return
+			}
+			t.blocked = p2pBlocksLoad(users)
+
 			// Figure out which subscriptions are missing: User1's, User2's or both.
 			var sub1, sub2 *types.Subscription
 			// Set to true if only requester's subscription has to be created.
@@ -452,7 +600,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 					sub2 = &subs[0]
 					user1only = true
 				}
-				log.Println("hub: one subscription already exists", subs[0].User, user1only)
+				logHub.Debug("hub: one subscription already exists", subs[0].User, user1only)
 			}
 
 			// Other user's subscription is missing
@@ -476,7 +624,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 				// Swap Public to match swapped Public in subs returned from store.Topics.GetSubs
 				sub2.SetPublic(users[u1].Public)
 
-				log.Println("hub: created second subscripton")
+				logHub.Debug("hub: created second subscripton")
 			}
 
 			// Requester's subscription is missing:
@@ -501,7 +649,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 
 						if uid != sreg.sess.uid {
 							// Report the error and ignore the value
-							log.Println("hub: setting mode for another user is not supported '" + t.name + "'")
+							logHub.Warn("hub: setting mode for another user is not supported '" + t.name + "'")
 						} else {
 							// user1 is setting non-default modeWant
 							userData.modeWant = parseMode(sreg.pkt.Set.Sub.Mode, userData.modeWant) &
@@ -530,7 +678,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 				// Swap Public to match swapped Public in subs returned from store.Topics.GetSubs
 				sub1.SetPublic(users[u2].Public)
 
-				log.Println("hub: created first subscription")
+				logHub.Debug("hub: created first subscription")
 			}
 
 			if !user1only {
@@ -544,7 +692,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 			// Create everything
 			if stopic == nil {
 				if err = store.Topics.CreateP2P(sub1, sub2); err != nil {
-					log.Println("hub: databse error in creating subscriptions '" + t.name + "' (" + err.Error() + ")")
+					logHub.Error("hub: databse error in creating subscriptions '" + t.name + "' (" + err.Error() + ")")
 					sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 					return
 				}
@@ -565,7 +713,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 					subToMake = sub2
 				}
 				if err = store.Subs.Create(subToMake); err != nil {
-					log.Println("hub: databse error in re-subscribing user '" + t.name + "' (" + err.Error() + ")")
+					logHub.Error("hub: databse error in re-subscribing user '" + t.name + "' (" + err.Error() + ")")
 					sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 					return
 				}
@@ -588,7 +736,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 				modeGiven: sub2.ModeGiven,
 				clearId:   sub2.ClearId}
 
-			log.Println("hub: marking request as 'topic created'")
+			logHub.Debug("hub: marking request as 'topic created'")
 			sreg.created = true
 		}
         
@@ -613,7 +761,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
                     "ModeWant": int(userData.modeWant),
                 }
                 if err = store.Subs.Update(t.name, uid, update); err != nil {
-                    log.Println("hub: databse error in updating user subscription '" + t.name + "' (" + err.Error() + ")")
+                    logHub.Error("hub: databse error in updating user subscription '" + t.name + "' (" + err.Error() + ")")
                     sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
                     return
                 }
@@ -627,9 +775,10 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		t.x_original = ""
 
 		// Processing request to create a new generic (group) topic:
-	} else if strings.HasPrefix(t.x_original, "new") {
+	} else if strings.HasPrefix(t.x_original, "new") || strings.HasPrefix(t.x_original, "nch") {
 
-		t.cat = types.TopicCat_Grp
+		// Group topic or a channel
+		t.cat = types.GetTopicCat(t.name)
 
 		// Generic topics have parameters stored in the topic object
 		t.owner = sreg.sess.uid
@@ -642,6 +791,16 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 			modeGiven: types.ModeCFull,
 			modeWant:  types.ModeCFull}
 
+		// Parameters of the request override the template
+		tmpl, ok := topicTemplateGet(sreg.pkt.Template)
+		if !ok {
+			sreg.sess.queueOut(ErrNotFound(sreg.pkt.Id, t.x_original, timestamp))
+			return
+		}
+		if tmpl != nil {
+			tmpl.applyDefaults(t)
+		}
+
 		if sreg.pkt.Set != nil {
 			// User sent initialization parameters
 			if sreg.pkt.Set.Desc != nil {
@@ -651,6 +810,18 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 				if !isNullValue(sreg.pkt.Set.Desc.Private) {
 					userData.private = sreg.pkt.Set.Desc.Private
 				}
+				if sreg.pkt.Set.Desc.WebView != nil {
+					t.webView = *sreg.pkt.Set.Desc.WebView
+				}
+				if sreg.pkt.Set.Desc.WebIndex != nil {
+					t.webIndex = *sreg.pkt.Set.Desc.WebIndex
+				}
+				if sreg.pkt.Set.Desc.Digest != nil && isValidDigest(*sreg.pkt.Set.Desc.Digest) {
+					t.digest = *sreg.pkt.Set.Desc.Digest
+				}
+				if sreg.pkt.Set.Desc.Ttl != nil && isValidTtl(*sreg.pkt.Set.Desc.Ttl) {
+					t.ttl = *sreg.pkt.Set.Desc.Ttl
+				}
 
 				// set default access
 				if sreg.pkt.Set.Desc.DefaultAcs != nil {
@@ -666,9 +837,9 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 						} else {
 							t.accessAnon = anon
 						}
-						log.Println("hub: invalid access mode for topic '" + t.name + "': '" + err.Error() + "'")
+						logHub.Warn("hub: invalid access mode for topic '" + t.name + "': '" + err.Error() + "'")
 					} else if auth.IsOwner() || anon.IsOwner() {
-						log.Println("hub: OWNER default access in topic '" + t.name)
+						logHub.Warn("hub: OWNER default access in topic '" + t.name)
 						t.accessAuth, t.accessAnon = auth & ^types.ModeOwner, anon & ^types.ModeOwner
 					} else {
 						t.accessAuth, t.accessAnon = auth, anon
@@ -692,39 +863,54 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		// t.lastId & t.clearId are not set for new topics
 
 		stopic := &types.Topic{
-			ObjHeader: types.ObjHeader{Id: sreg.topic, CreatedAt: timestamp},
-			Access:    types.DefaultAccess{Auth: t.accessAuth, Anon: t.accessAnon},
-			Public:    t.public}
+			ObjHeader:  types.ObjHeader{Id: sreg.topic, CreatedAt: timestamp},
+			Access:     types.DefaultAccess{Auth: t.accessAuth, Anon: t.accessAnon},
+			WebView:    t.webView,
+			WebIndex:   t.webIndex,
+			Digest:     t.digest,
+			DigestAt:   timestamp,
+			MessageTtl: t.ttl,
+			Tags:       t.tags,
+			Public:     t.public}
+		if reject := pluginTopic(stopic, t.owner, sreg.pkt.Id, t.x_original, timestamp); reject != nil {
+			sreg.sess.queueOut(reject)
+			return
+		}
+		t.public = stopic.Public
+
 		// store.Topics.Create will add a subscription record for the topic creator
 		stopic.GiveAccess(t.owner, userData.modeWant, userData.modeGiven)
 		err := store.Topics.Create(stopic, t.owner, t.perUser[t.owner].private)
 		if err != nil {
-			log.Println("hub: cannot save new topic '" + t.name + "' (" + err.Error() + ")")
+			logHub.Error("hub: cannot save new topic '" + t.name + "' (" + err.Error() + ")")
 			// Error sent on "newWHATEVER" topic
 			sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		}
+		if tmpl != nil {
+			tmpl.install(t)
+		}
 
 		t.x_original = t.name // keeping 'new' as original has no value to the client
 		sreg.created = true
 
-	} else if strings.HasPrefix(t.x_original, "grp") {
-		t.cat = types.TopicCat_Grp
+	} else if strings.HasPrefix(t.x_original, "grp") || strings.HasPrefix(t.x_original, "chn") {
+		t.cat = types.GetTopicCat(t.name)
 
 		// TODO(gene): check and validate topic name
 		stopic, err := store.Topics.Get(t.name)
 		if err != nil {
-			log.Println("hub: error while loading topic '" + t.name + "' (" + err.Error() + ")")
+			logHub.Warn("hub: error while loading topic '" + t.name + "' (" + err.Error() + ")")
 			sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		} else if stopic == nil {
-			log.Println("hub: topic '" + t.name + "' does not exist")
+			logHub.Warn("hub: topic '" + t.name + "' does not exist")
 			sreg.sess.queueOut(ErrTopicNotFound(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		}
 
 		if err = t.loadSubscribers(); err != nil {
-			log.Println("hub: cannot load subscribers for '" + t.name + "' (" + err.Error() + ")")
+			logHub.Warn("hub: cannot load subscribers for '" + t.name + "' (" + err.Error() + ")")
 			sreg.sess.queueOut(ErrUnknown(sreg.pkt.Id, t.x_original, timestamp))
 			return
 		}
@@ -735,6 +921,19 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		t.accessAnon = stopic.Access.Anon
 
 		t.public = stopic.Public
+		t.webView = stopic.WebView
+		t.webIndex = stopic.WebIndex
+		t.digest = stopic.Digest
+		t.webhook = stopic.Webhook
+		t.pinned = stopic.Pinned
+		t.tags = stopic.Tags
+		t.externalRef = stopic.ExternalRef
+		t.banned = bansLoad(stopic.Banned)
+		t.inviteGen = stopic.InviteGen
+		t.transferTo = types.ParseUid(stopic.TransferTo)
+		t.ttl = stopic.MessageTtl
+		t.maxMembers = stopic.MaxMembers
+		scriptsLoad(t.name, stopic.Scripts)
 
 		t.created = stopic.CreatedAt
 		t.updated = stopic.UpdatedAt
@@ -748,7 +947,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		return
 	}
 
-	log.Println("hub: topic created or loaded: " + t.name)
+	logHub.Debug("hub: topic created or loaded: " + t.name)
 
 	h.topicPut(t.name, t)
 	h.topicsLive.Add(1)
@@ -779,11 +978,12 @@ func (t *Topic) loadSubscribers() error {
 			readId:    sub.ReadSeqId,
 			recvId:    sub.RecvSeqId,
 			private:   sub.Private,
+			notify:    sub.Notify,
 			modeWant:  sub.ModeWant,
 			modeGiven: sub.ModeGiven}
 
 		if (sub.ModeGiven & sub.ModeWant).IsOwner() {
-			log.Printf("hub.loadSubscriptions: %s set owner to %s", t.name, uid.String())
+			logHub.Debugf("hub.loadSubscriptions: %s set owner to %s", t.name, uid.String())
 			t.owner = uid
 		}
 	}
@@ -832,10 +1032,11 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *MsgClientDel, reason
 
 				if err := store.Topics.Delete(topic); err != nil {
 					t.resume()
-					log.Println("topicUnreg failed to delete online topic:", err)
+					logHub.Error("topicUnreg failed to delete online topic:", err)
 					sess.queueOut(ErrUnknown(msg.Id, msg.Topic, now))
 					return
 				}
+				webhookTopicDeleted(t.webhook, topic)
 
 				t.meta <- &metaReq{
 					topic: topic,
@@ -849,6 +1050,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *MsgClientDel, reason
 
 				h.topicDel(topic)
 				t.exit <- &shutDown{reason: StopDeleted}
+				topicStopping(t, StopDeleted)
 				h.topicsLive.Add(-1)
 			} else {
 				// Case 1.1.2: requester is NOT the owner
@@ -864,7 +1066,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *MsgClientDel, reason
 
 			// Get all subscribers: we have to notify them all.
 			if subs, err := store.Topics.GetSubs(topic); err != nil {
-				log.Println("topicUnreg failed to load subscribers:", err)
+				logHub.Error("topicUnreg failed to load subscribers:", err)
 				sess.queueOut(ErrUnknown(msg.Id, msg.Topic, now))
 				return
 			} else {
@@ -888,22 +1090,24 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *MsgClientDel, reason
 					if tcat == types.TopicCat_P2P && subs != nil && len(subs) < 2 {
 						// This is a P2P topic and fewer than 2 subscriptions, delete the entire topic
 						if err := store.Topics.Delete(topic); err != nil {
-							log.Println("topicUnreg failed to delete offline topic:", err)
+							logHub.Error("topicUnreg failed to delete offline topic:", err)
 							sess.queueOut(ErrUnknown(msg.Id, msg.Topic, now))
 							return
 						}
+						webhookTopicDeleted(nil, topic)
 					} else {
 						// Not P2P or more than 1 subscription left.
 						// Delete user's own subscription only
 						if err := store.Subs.Delete(topic, sess.uid); err != nil {
-							log.Println("topicUnreg failed (3):", err)
+							logHub.Error("topicUnreg failed (3):", err)
 							sess.queueOut(ErrUnknown(msg.Id, msg.Topic, now))
 							return
 						}
+						webhookMemberChanged(webhookOf(topic), topic, sess.uid, "leave", types.ModeNone, types.ModeNone)
 					}
 
 					// Notify user's other sessions that the subscription is gone
-					log.Println("Notifying single user - sub deleted")
+					logHub.Debug("Notifying single user - sub deleted")
 					presSingleUserOfflineOffline(sess.uid, msg.Topic, "acs",
 						sub.ModeGiven&sub.ModeWant,
 						&PresParams{
@@ -912,14 +1116,17 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *MsgClientDel, reason
 						}, sess.sid)
 				} else {
 					// Case 1.2.1.1: owner, delete the topic from db
+					webhook := webhookOf(topic)
 					if err := store.Topics.Delete(topic); err != nil {
-						log.Println("topicUnreg failed (4):", err)
+						logHub.Error("topicUnreg failed (4):", err)
 						sess.queueOut(ErrUnknown(msg.Id, msg.Topic, now))
 						return
 					}
 
+					webhookTopicDeleted(webhook, topic)
+
 					// Notify subscribers that the topic is gone
-					log.Println("Notifying all subscribers - topic deleted")
+					logHub.Debug("Notifying all subscribers - topic deleted")
 					presSubsOfflineOffline(msg.Topic, tcat, subs, "gone", &PresParams{}, sess.sid)
 				}
 
@@ -936,6 +1143,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *MsgClientDel, reason
 			t.suspend()
 			h.topicDel(topic)
 			t.exit <- &shutDown{reason: reason}
+			topicStopping(t, reason)
 			h.topicsLive.Add(-1)
 		}
 
@@ -946,13 +1154,73 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *MsgClientDel, reason
 	}
 }
 
+// topicDeleteAdmin deletes the topic on request of the operator whoever owns it. Subscribers are notified
+// as if the owner deleted the topic. The result is sent to done.
+func (h *Hub) topicDeleteAdmin(topic string, done chan error) {
+	// Store calls are done off the hub.
+	if t := h.topicGet(topic); t != nil {
+		// The topic takes no requests while it's deleted
+		t.suspend()
+		webhook := t.webhook
+		go func() {
+			if err := store.Topics.Delete(topic); err != nil {
+				t.resume()
+				done <- err
+				return
+			}
+			webhookTopicDeleted(webhook, topic)
+			// The topic is stopped by the hub
+			h.unreg <- &topicUnreg{topic: topic, del: true, adminDone: done, adminDeleted: t}
+		}()
+		return
+	}
+
+	// The topic is not loaded: notify the subscribers from the database.
+	go func() {
+		subs, err := store.Topics.GetSubs(topic)
+		if err != nil {
+			done <- err
+			return
+		}
+		webhook := webhookOf(topic)
+		if err = store.Topics.Delete(topic); err != nil {
+			done <- err
+			return
+		}
+		webhookTopicDeleted(webhook, topic)
+		presSubsOfflineOffline(topic, topicCat(topic), subs, "gone", &PresParams{}, "")
+		done <- nil
+	}()
+}
+
+// topicDeletedAdmin stops the topic deleted from the store by topicDeleteAdmin.
+func (h *Hub) topicDeletedAdmin(t *Topic, done chan<- error) {
+	if h.topicGet(t.name) != t {
+		// The topic stopped on its own meanwhile
+		done <- nil
+		return
+	}
+
+	// Without the session the topic detaches all sessions
+	t.meta <- &metaReq{
+		topic: t.name,
+		pkt:   &ClientComMessage{Del: &MsgClientDel{Topic: t.name, What: "topic"}},
+		what:  constMsgDelTopic}
+
+	h.topicDel(t.name)
+	t.exit <- &shutDown{reason: StopDeleted}
+	topicStopping(t, StopDeleted)
+	h.topicsLive.Add(-1)
+	done <- nil
+}
+
 // replyTopicDescBasic loads minimal topic Desc when the requester is not subscribed to the topic
 func replyTopicDescBasic(sess *Session, topic string, get *MsgClientGet) {
-	log.Printf("hub.replyTopicDescBasic: topic %s", topic)
+	logHub.Debugf("hub.replyTopicDescBasic: topic %s", topic)
 	now := time.Now().UTC().Round(time.Millisecond)
 	desc := &MsgTopicDesc{}
 
-	if strings.HasPrefix(topic, "grp") {
+	if strings.HasPrefix(topic, "grp") || strings.HasPrefix(topic, "chn") {
 		stopic, err := store.Topics.Get(topic)
 		if err != nil {
 			sess.queueOut(ErrUnknown(get.Id, get.Topic, now))
@@ -988,7 +1256,7 @@ func replyTopicDescBasic(sess *Session, topic string, get *MsgClientGet) {
 
 		suser, err := store.Users.Get(uid)
 		if err != nil {
-			log.Printf("hub.replyTopicInfoBasic: sending  error 3")
+			logHub.Debugf("hub.replyTopicInfoBasic: sending  error 3")
 			sess.queueOut(ErrUnknown(get.Id, get.Topic, now))
 			return
 		} else if suser == nil {
@@ -1001,7 +1269,7 @@ func replyTopicDescBasic(sess *Session, topic string, get *MsgClientGet) {
 		}
 	}
 
-	log.Printf("hub.replyTopicDescBasic: sending desc -- OK")
+	logHub.Debugf("hub.replyTopicDescBasic: sending desc -- OK")
 	sess.queueOut(&ServerComMessage{
 		Meta: &MsgServerMeta{Id: get.Id, Topic: get.Topic, Timestamp: &now, Desc: desc}})
 }
@@ -1014,13 +1282,13 @@ func parseTopicAccess(acs *MsgDefaultAcsMode, defAuth, defAnon types.AccessMode)
 
 	if acs.Auth != "" {
 		if err = auth.UnmarshalText([]byte(acs.Auth)); err != nil {
-			log.Println("hub: invalid default auth access mode '" + acs.Auth + "'")
+			logHub.Warn("hub: invalid default auth access mode '" + acs.Auth + "'")
 		}
 	}
 
 	if acs.Anon != "" {
 		if err = anon.UnmarshalText([]byte(acs.Anon)); err != nil {
-			log.Println("hub: invalid default anon access mode '" + acs.Anon + "'")
+			logHub.Warn("hub: invalid default anon access mode '" + acs.Anon + "'")
 		}
 	}
 
@@ -0,0 +1,521 @@
+package main
+
+// Concurrency tests of the hub and topics. They don't need a database: the topic is loaded into the
+// hub directly and users are existing subscribers, so joining, leaving and typing notifications are
+// handled in memory. The save stage of the publishing pipeline is replaced with one which only assigns
+// SeqIds. Run with go test -race.
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const testTopicName = "grpConcurrency"
+
+// newTestHub creates a hub like newHub does, but does not publish the metrics:
+// expvar allows that only once per process.
+func newTestHub() *Hub {
+	h := &Hub{
+		topics:     make(map[string]*Topic),
+		route:      make(chan *ServerComMessage, 4096),
+		join:       make(chan *sessionJoin),
+		unreg:      make(chan *topicUnreg),
+		rehash:     make(chan bool),
+		meta:       make(chan *metaReq, 128),
+		shutdown:   make(chan chan<- bool),
+		topicsLive: new(expvar.Int)}
+	globals.hub = h
+	testPipelineOnce.Do(func() {
+		// The metrics are published once per process
+		noteThrottleInit(nil)
+
+		save := &pubStage{name: "save", inTopic: true, handler: pubSaveMemory}
+		for _, stage := range []*pubStage{pubStages["validate"], save, pubStages["fanout"]} {
+			stage.calls, stage.rejected, stage.micros = new(expvar.Int), new(expvar.Int), new(expvar.Int)
+			pubPipeline.topic = append(pubPipeline.topic, stage)
+		}
+	})
+	return h
+}
+
+var testPipelineOnce sync.Once
+
+// pubSaveMemory replaces pubSave: the message is not stored, only given the next SeqId.
+func pubSaveMemory(pc *pubContext) (*ServerComMessage, bool) {
+	t, msg := pc.t, pc.msg
+	t.lastId++
+	msg.Data.SeqId = t.lastId
+	if msg.id != "" {
+		msg.sessFrom.queueOut(NoErrAccepted(msg.id, t.original(pc.from), msg.timestamp))
+	}
+	return nil, true
+}
+
+// startTestTopic loads a group topic with the given number of subscribers into the hub and starts the hub.
+func startTestTopic(h *Hub, users int) *Topic {
+	t := &Topic{
+		name:       testTopicName,
+		x_original: testTopicName,
+		cat:        types.TopicCat_Grp,
+		sessions:   make(map[*Session]bool),
+		broadcast:  make(chan *ServerComMessage, 256),
+		reg:        make(chan *sessionJoin, 32),
+		unreg:      make(chan *sessionLeave, 32),
+		meta:       make(chan *metaReq, 32),
+		perUser:    make(map[types.Uid]perUserData, users),
+		exit:       make(chan *shutDown, 1)}
+	for i := 1; i <= users; i++ {
+		t.perUser[types.Uid(i)] = perUserData{modeWant: types.ModeCPublic, modeGiven: types.ModeCPublic}
+	}
+
+	h.topicPut(t.name, t)
+	h.topicsLive.Add(1)
+	go t.run(h)
+	go h.run()
+	return t
+}
+
+func newTestSession(uid types.Uid, sid string) *Session {
+	return &Session{
+		sid:     sid,
+		uid:     uid,
+		authLvl: auth.LevelAuth,
+		subs:    make(map[string]*Subscription),
+		send:    make(chan []byte, 256),
+		stop:    make(chan []byte, 1),
+		detach:  make(chan string, 64)}
+}
+
+// waitCtrl reads packets sent to the session until the {ctrl} with the given id arrives.
+func waitCtrl(sess *Session, id string, timeout time.Duration) (int, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case data := <-sess.send:
+			var pkt struct {
+				Ctrl *struct {
+					Id   string `json:"id"`
+					Code int    `json:"code"`
+				} `json:"ctrl"`
+			}
+			if json.Unmarshal(data, &pkt) == nil && pkt.Ctrl != nil && pkt.Ctrl.Id == id {
+				return pkt.Ctrl.Code, true
+			}
+		case <-deadline:
+			return 0, false
+		}
+	}
+}
+
+// drainSession discards packets sent to the session until stop is closed.
+func drainSession(sess *Session, stop chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-sess.send:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func joinTopic(h *Hub, sess *Session, id string) (int, bool) {
+	h.join <- &sessionJoin{topic: testTopicName, pkt: &MsgClientSub{Id: id, Topic: testTopicName}, sess: sess}
+	return waitCtrl(sess, id, 5*time.Second)
+}
+
+func leaveTopic(t *Topic, sess *Session, id string) (int, bool) {
+	select {
+	case t.unreg <- &sessionLeave{sess: sess, topic: testTopicName, reqId: id}:
+	case <-time.After(time.Second):
+		return 0, false
+	}
+	return waitCtrl(sess, id, 5*time.Second)
+}
+
+// sendTyping sends a typing notification to the topic. Returns false if the topic does not accept it.
+func sendTyping(t *Topic, sess *Session) bool {
+	msg := &ServerComMessage{
+		Info:      &MsgServerInfo{Topic: testTopicName, From: sess.uid.UserId(), What: "kp"},
+		rcptto:    testTopicName,
+		skipSid:   sess.sid,
+		timestamp: types.TimeNow()}
+	select {
+	case t.broadcast <- msg:
+		return true
+	case <-time.After(10 * time.Millisecond):
+		return false
+	}
+}
+
+// sendData publishes a {data} message to the topic. Returns false if the topic does not accept it.
+func sendData(t *Topic, sess *Session, id string) bool {
+	now := types.TimeNow()
+	msg := &ServerComMessage{
+		Data:      &MsgServerData{Topic: testTopicName, From: sess.uid.UserId(), Timestamp: now, Content: id},
+		rcptto:    testTopicName,
+		sessFrom:  sess,
+		id:        id,
+		timestamp: now,
+		received:  time.Now()}
+	select {
+	case t.broadcast <- msg:
+		return true
+	case <-time.After(10 * time.Millisecond):
+		return false
+	}
+}
+
+// stopTestHub shuts down the hub and its topics.
+func stopTestHub(tb testing.TB, h *Hub) {
+	done := make(chan bool)
+	select {
+	case h.shutdown <- done:
+	case <-time.After(5 * time.Second):
+		tb.Fatal("hub did not accept shutdown")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		tb.Fatal("hub did not shut down")
+	}
+}
+
+// topicRunning checks if the topic goroutine has not exited yet.
+func topicRunning(t *Topic) bool {
+	topicWatch.Lock()
+	defer topicWatch.Unlock()
+	_, ok := topicWatch.live[t]
+	return ok
+}
+
+// Many sessions of the same users join, send typing notifications and leave the same topic at once.
+// The topic must end up with no sessions attached and every user offline.
+func TestTopicConcurrentJoinPublishLeave(t *testing.T) {
+	const users = 16
+	const sessPerUser = 4
+	const rounds = 20
+
+	h := newTestHub()
+	topic := startTestTopic(h, users+1)
+
+	// Keeps the topic from being unloaded by the idle timer while the others leave
+	anchor := newTestSession(types.Uid(users+1), "anchor")
+	if code, ok := joinTopic(h, anchor, "anchor"); !ok || code >= 300 {
+		t.Fatalf("anchor failed to join: %d %v", code, ok)
+	}
+	anchorStop := make(chan bool)
+	var anchorWg sync.WaitGroup
+	anchorWg.Add(1)
+	go drainSession(anchor, anchorStop, &anchorWg)
+
+	var wg sync.WaitGroup
+	errs := make(chan string, users*sessPerUser)
+	for u := 1; u <= users; u++ {
+		for j := 0; j < sessPerUser; j++ {
+			wg.Add(1)
+			go func(sess *Session) {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					id := strconv.Itoa(i)
+					if code, ok := joinTopic(h, sess, "sub"+id); !ok || code >= 300 {
+						errs <- sess.sid + ": join failed " + strconv.Itoa(code)
+						return
+					}
+					for k := 0; k < 3; k++ {
+						sendTyping(topic, sess)
+					}
+					if code, ok := leaveTopic(topic, sess, "leave"+id); !ok || code >= 300 {
+						errs <- sess.sid + ": leave failed " + strconv.Itoa(code)
+						return
+					}
+				}
+			}(newTestSession(types.Uid(u), strconv.Itoa(u)+"-"+strconv.Itoa(j)))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	close(anchorStop)
+	anchorWg.Wait()
+	stopTestHub(t, h)
+
+	// The topic goroutine has exited, its state may be inspected now
+	if len(topic.sessions) != 1 {
+		t.Errorf("sessions attached: expected 1, got %d", len(topic.sessions))
+	}
+	for uid, pud := range topic.perUser {
+		expected := 0
+		if uid == anchor.uid {
+			expected = 1
+		}
+		if pud.online != expected {
+			t.Errorf("user %s online: expected %d, got %d", uid.UserId(), expected, pud.online)
+		}
+	}
+}
+
+// The topic is unloaded while its sessions keep publishing and leaving. Nothing may block forever
+// and the topic goroutine must exit.
+func TestTopicUnloadWhilePublishing(t *testing.T) {
+	const users = 8
+
+	h := newTestHub()
+	topic := startTestTopic(h, users)
+
+	sessions := make([]*Session, users)
+	for i := range sessions {
+		sessions[i] = newTestSession(types.Uid(i+1), strconv.Itoa(i))
+		if code, ok := joinTopic(h, sessions[i], "sub"); !ok || code >= 300 {
+			t.Fatalf("session %d failed to join: %d %v", i, code, ok)
+		}
+	}
+
+	stop := make(chan bool)
+	var drainWg, wg sync.WaitGroup
+	for _, sess := range sessions {
+		drainWg.Add(1)
+		go drainSession(sess, stop, &drainWg)
+
+		wg.Add(1)
+		go func(sess *Session) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if !sendTyping(topic, sess) || !sendData(topic, sess, strconv.Itoa(i)) {
+					break
+				}
+			}
+			select {
+			case topic.unreg <- &sessionLeave{sess: sess, topic: testTopicName}:
+			case <-time.After(100 * time.Millisecond):
+			}
+		}(sess)
+	}
+
+	h.unreg <- &topicUnreg{topic: testTopicName}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for topicRunning(topic) {
+		if time.Now().After(deadline) {
+			t.Fatal("topic did not stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wg.Wait()
+	close(stop)
+	drainWg.Wait()
+	stopTestHub(t, h)
+}
+
+// runIdleSession serves the session of a client which stopped reading, its write loop is blocked on the
+// network. Once the session is stopped for being idle, it leaves its topics like the websocket loops do.
+func runIdleSession(sess *Session, wg *sync.WaitGroup) {
+	defer wg.Done()
+	<-sess.stop
+	globals.sessionStore.Delete(sess)
+	for _, sub := range sess.subs {
+		sub.done <- &sessionLeave{sess: sess}
+	}
+}
+
+// testProxyNode is the cluster node the proxied sessions are connected to.
+type testProxyNode struct {
+	responses int64
+}
+
+// Proxy receives packets forwarded to the proxied sessions.
+func (n *testProxyNode) Proxy(msg *ClusterResp, unused *bool) error {
+	atomic.AddInt64(&n.responses, 1)
+	return nil
+}
+
+// startProxyNode starts an RPC server in place of the proxy node and connects to it.
+func startProxyNode(tb testing.TB) (*ClusterNode, net.Listener) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Cluster", &testProxyNode{}); err != nil {
+		tb.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go server.Accept(ln)
+
+	endpoint, err := rpc.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		tb.Fatal(err)
+	}
+	return &ClusterNode{name: "proxy", endpoint: endpoint, connected: true}, ln
+}
+
+// Sessions publish {data} to the topic while others stop reading and are stopped for being idle and
+// the sessions proxied from another cluster node are disconnected by that node. Every accepted message
+// must get a SeqId, the topic must end up with no sessions attached and every user offline.
+func TestTopicPublishWhileSessionsGo(t *testing.T) {
+	const users = 8
+	const messages = 100
+
+	globals.sessionStore = NewSessionStore(time.Minute)
+	globals.cluster = nil
+	h := newTestHub()
+	topic := startTestTopic(h, 3*users+1)
+
+	node, ln := startProxyNode(t)
+	defer ln.Close()
+
+	// Keeps the topic from being unloaded by the idle timer while the others leave
+	anchor := newTestSession(types.Uid(3*users+1), "anchor")
+	if code, ok := joinTopic(h, anchor, "anchor"); !ok || code >= 300 {
+		t.Fatalf("anchor failed to join: %d %v", code, ok)
+	}
+	anchorStop := make(chan bool)
+	var anchorWg sync.WaitGroup
+	anchorWg.Add(1)
+	go drainSession(anchor, anchorStop, &anchorWg)
+
+	join := func(sess *Session, uid int) {
+		sess.uid = types.Uid(uid)
+		sess.authLvl = auth.LevelAuth
+		if code, ok := joinTopic(h, sess, "sub"); !ok || code >= 300 {
+			t.Fatalf("session %s failed to join: %d %v", sess.sid, code, ok)
+		}
+	}
+
+	var sent int64
+	var publishers, loops sync.WaitGroup
+	publish := func(sess *Session) {
+		defer publishers.Done()
+		for i := 0; i < messages; i++ {
+			if !sendData(topic, sess, strconv.Itoa(i)) {
+				return
+			}
+			atomic.AddInt64(&sent, 1)
+		}
+	}
+
+	// Replies to the publishers are read until the end, also after their sessions are gone
+	stop := make(chan bool)
+	var drains sync.WaitGroup
+	var direct, proxied []*Session
+	for i := 1; i <= users; i++ {
+		// Attached to this node
+		sess := newTestSession(0, "ws-"+strconv.Itoa(i))
+		join(sess, i)
+		direct = append(direct, sess)
+
+		// Not reading: detached by the topic, then stopped by the session store for being idle
+		idle := globals.sessionStore.Create(httptest.NewRecorder(), "lp-"+strconv.Itoa(i))
+		join(idle, users+i)
+		for len(idle.send) < cap(idle.send) {
+			// Replies the client never read
+			idle.send <- []byte("{}")
+		}
+		loops.Add(1)
+		go runIdleSession(idle, &loops)
+
+		// Proxied from another node
+		remote := globals.sessionStore.Create(node, "rpc-"+strconv.Itoa(i))
+		join(remote, 2*users+i)
+		proxied = append(proxied, remote)
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			remote.rpcWriteLoop()
+		}()
+
+		for _, s := range []*Session{sess, remote} {
+			drains.Add(1)
+			go drainSession(s, stop, &drains)
+		}
+
+		publishers.Add(2)
+		go publish(sess)
+		go publish(remote)
+	}
+
+	// Time enough to fill the queues of the idle sessions
+	time.Sleep(20 * time.Millisecond)
+	if stopped := globals.sessionStore.StopIdle(time.Millisecond, NoErrShutdown(time.Now())); stopped != users {
+		t.Errorf("idle sessions stopped: expected %d, got %d", users, stopped)
+	}
+	var rejected bool
+	for _, sess := range proxied {
+		(&Cluster{}).Master(&ClusterReq{Node: node.name, Sess: &ClusterSess{Sid: sess.sid}, SessGone: true}, &rejected)
+	}
+
+	publishers.Wait()
+	for _, sess := range direct {
+		topic.unreg <- &sessionLeave{sess: sess, topic: testTopicName}
+	}
+	loops.Wait()
+
+	// The anchor leaves last: once it's answered, the topic has processed all other leaves
+	close(anchorStop)
+	anchorWg.Wait()
+	if code, ok := leaveTopic(topic, anchor, "leave"); !ok || code >= 300 {
+		t.Errorf("anchor failed to leave: %d %v", code, ok)
+	}
+	stopTestHub(t, h)
+	close(stop)
+	drains.Wait()
+
+	// The topic goroutine has exited, its state may be inspected now
+	if topic.lastId != int(sent) {
+		t.Errorf("messages published: expected %d, got %d", sent, topic.lastId)
+	}
+	if len(topic.sessions) != 0 {
+		t.Errorf("sessions attached: expected 0, got %d", len(topic.sessions))
+	}
+	for uid, pud := range topic.perUser {
+		if pud.online != 0 {
+			t.Errorf("user %s online: expected 0, got %d", uid.UserId(), pud.online)
+		}
+	}
+}
+
+func BenchmarkTopicJoinLeave(b *testing.B) {
+	h := newTestHub()
+	topic := startTestTopic(h, 2)
+
+	anchor := newTestSession(types.Uid(2), "anchor")
+	if _, ok := joinTopic(h, anchor, "anchor"); !ok {
+		b.Fatal("anchor failed to join")
+	}
+	anchorStop := make(chan bool)
+	var anchorWg sync.WaitGroup
+	anchorWg.Add(1)
+	go drainSession(anchor, anchorStop, &anchorWg)
+
+	sess := newTestSession(types.Uid(1), "bench")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := joinTopic(h, sess, "sub"); !ok {
+			b.Fatal("join timed out")
+		}
+		if _, ok := leaveTopic(topic, sess, "leave"); !ok {
+			b.Fatal("leave timed out")
+		}
+	}
+	b.StopTimer()
+
+	close(anchorStop)
+	anchorWg.Wait()
+	stopTestHub(b, h)
+}
@@ -0,0 +1,424 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Read-only impersonation of users by support staff. A root admin requests
+ *  a token with
+ *    POST /v0/admin/impersonate?user=usr...&reason=...
+ *  and logs in with it on a new connection:
+ *    {login scheme="impersonate" secret="<token>"}
+ *  The session acts as the user but cannot change anything: {pub}, {set},
+ *  {del}, {acc}, {note}, creating topics and new or changed subscriptions
+ *  are rejected. It must attach to 'me' before any other topic, so the user
+ *  sees it in {get topic="me" what="sessions"} with the impersonator's ID.
+ *
+ *  If consent is required the user allows impersonation for a time with
+ *    {set topic="me" impersonate={allow: 3600}}
+ *  and withdraws it with allow: 0. A token request without the consent is
+ *  answered with 202 and the user gets {info topic="me" what="impersonate"}
+ *  with the admin's ID and reason.
+ *
+ *  Tokens, logins, denied requests and ends of the sessions are written to
+ *  the "audit" log.
+ *
+ *  Token is base64url(JSON payload) "." base64url(HMAC-SHA256 of payload).
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the admin endpoint
+	ADMIN_IMPERSONATE_PATH = "/v0/admin/impersonate"
+	// Minimum length of the signing key, bytes
+	IMPERSONATION_MIN_KEY_LENGTH = 32
+	// Default lifetime of a token and of the session
+	IMPERSONATION_DEFAULT_TTL = time.Hour
+	// Maximum length of the reason
+	IMPERSONATION_MAX_REASON = 256
+)
+
+type impersonationConfig struct {
+	// Key to sign tokens with, base64-encoded; empty disables impersonation
+	Key string `json:"key"`
+	// Lifetime of a token and of the session in seconds
+	Ttl int `json:"ttl"`
+	// The user must allow impersonation first
+	Consent bool `json:"consent"`
+}
+
+// Signed content of the token
+type impersonationPayload struct {
+	// User being impersonated
+	User string `json:"usr"`
+	// Admin who requested the token
+	Admin string `json:"adm"`
+	// Reason given by the admin
+	Reason string `json:"rsn,omitempty"`
+	// Expiration time, Unix seconds
+	Expires int64 `json:"exp"`
+}
+
+var impersonation struct {
+	key     []byte
+	ttl     time.Duration
+	consent bool
+}
+
+// impersonationInit parses config and mounts the admin endpoint. Impersonation is disabled unless
+// the key is given.
+func impersonationInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config impersonationConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse impersonation config:", err)
+	}
+	if config.Key == "" {
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config.Key)
+	if err != nil {
+		logMain.Fatal("impersonation: failed to decode key", err)
+	}
+	if len(key) < IMPERSONATION_MIN_KEY_LENGTH {
+		logMain.Fatal("impersonation: key is too short")
+	}
+	impersonation.key = key
+	impersonation.ttl = time.Duration(config.Ttl) * time.Second
+	if impersonation.ttl <= 0 {
+		impersonation.ttl = IMPERSONATION_DEFAULT_TTL
+	}
+	impersonation.consent = config.Consent
+
+	http.HandleFunc(ADMIN_IMPERSONATE_PATH, serveImpersonate)
+
+	logMain.Infof("Impersonation enabled, consent required: %v", impersonation.consent)
+}
+
+// impersonationSign returns the signed token for the payload.
+func impersonationSign(payload *impersonationPayload) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, impersonation.key)
+	mac.Write(data)
+	return base64.RawURLEncoding.EncodeToString(data) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// impersonationParse verifies the token signature and expiration and returns its payload.
+func impersonationParse(token string) (*impersonationPayload, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed impersonation token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, impersonation.key)
+	mac.Write(data)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("invalid impersonation signature")
+	}
+
+	var payload impersonationPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > payload.Expires {
+		return nil, errors.New("impersonation token expired")
+	}
+	return &payload, nil
+}
+
+// serveImpersonate issues impersonation tokens to root admins.
+func serveImpersonate(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	writeCtrl := func(msg *ServerComMessage) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeCtrl(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeCtrl(ErrAuthRequired("", "", now))
+		return
+	}
+
+	admin, authLvl, err := authHttpRequestLevel(req)
+	if err != nil {
+		writeCtrl(ErrAuthFailed("", "", now))
+		return
+	} else if authLvl != auth.LevelRoot {
+		writeCtrl(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	uid := types.ParseUserId(req.FormValue("user"))
+	reason := strings.TrimSpace(req.FormValue("reason"))
+	if uid.IsZero() || uid == admin || reason == "" || len(reason) > IMPERSONATION_MAX_REASON {
+		writeCtrl(ErrMalformed("", "", now))
+		return
+	}
+
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		writeCtrl(ErrUnknown("", "", now))
+		return
+	}
+	if user == nil {
+		writeCtrl(ErrUserNotFound("", "", now))
+		return
+	}
+
+	expires := now.Add(impersonation.ttl)
+	if impersonation.consent {
+		if !user.ImpersonationConsent.After(now) {
+			// Ask the user
+			globals.hub.route <- &ServerComMessage{
+				Info:   &MsgServerInfo{Topic: "me", From: admin.UserId(), What: "impersonate", Reason: reason},
+				rcptto: uid.UserId(), timestamp: now}
+			logAudit.Infof("impersonation: %s asked %s for consent, reason %q, from %s", admin.UserId(),
+				uid.UserId(), reason, req.RemoteAddr)
+			writeCtrl(NoErrAccepted("", "", now))
+			return
+		}
+		if user.ImpersonationConsent.Before(expires) {
+			expires = user.ImpersonationConsent
+		}
+	}
+
+	token, err := impersonationSign(&impersonationPayload{
+		User:    uid.UserId(),
+		Admin:   admin.UserId(),
+		Reason:  reason,
+		Expires: expires.Unix()})
+	if err != nil {
+		writeCtrl(ErrUnknown("", "", now))
+		return
+	}
+	logAudit.Warnf("impersonation: token for %s issued to %s until %s, reason %q, from %s", uid.UserId(),
+		admin.UserId(), expires.Format(time.RFC3339), reason, req.RemoteAddr)
+
+	reply := NoErr("", "", now)
+	reply.Ctrl.Params = map[string]interface{}{"token": token, "expires": expires}
+	writeCtrl(reply)
+}
+
+// loginImpersonate authenticates the session as the user named in the token from
+// {login scheme="impersonate"}.
+func (s *Session) loginImpersonate(msg *ClientComMessage) {
+	if impersonation.key == nil {
+		s.queueOut(ErrAuthUnknownScheme(msg.Login.Id, "", msg.timestamp))
+		return
+	}
+
+	limitKeys := loginLimitKeys(msg.Login.Scheme, msg.Login.Secret, s.remoteAddr)
+	if retry := loginLockedOut(limitKeys); retry > 0 {
+		s.queueOut(ErrTooManyRequests(msg.Login.Id, "", msg.timestamp, retry))
+		return
+	}
+
+	payload, err := impersonationParse(string(msg.Login.Secret))
+	if err != nil {
+		logSession.Info(err)
+		loginFailed(limitKeys)
+		s.queueOut(ErrAuthFailed(msg.Login.Id, "", msg.timestamp))
+		return
+	}
+	uid := types.ParseUserId(payload.User)
+	admin := types.ParseUserId(payload.Admin)
+
+	if impersonation.consent {
+		user, err := store.Users.Get(uid)
+		if err != nil {
+			s.queueOut(ErrUnknown(msg.Login.Id, "", msg.timestamp))
+			return
+		}
+		if user == nil || !user.ImpersonationConsent.After(msg.timestamp) {
+			logAudit.Infof("impersonation: login of %s as %s rejected, no consent", payload.Admin, payload.User)
+			s.queueOut(ErrAuthFailed(msg.Login.Id, "", msg.timestamp))
+			return
+		}
+	}
+
+	loginSucceeded(limitKeys)
+	s.uid = uid
+	s.authLvl = auth.LevelAuth
+	s.impersonator = admin
+	s.impersonationExpires = time.Unix(payload.Expires, 0).UTC()
+
+	logAudit.Warnf("impersonation: sess[%s] of %s opened by %s until %s, reason %q, from %s", s.sid,
+		payload.User, payload.Admin, s.impersonationExpires.Format(time.RFC3339), payload.Reason, s.remoteAddr)
+
+	s.queueOut(&ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        msg.Login.Id,
+		Code:      http.StatusOK,
+		Text:      http.StatusText(http.StatusOK),
+		Timestamp: msg.timestamp,
+		Params: map[string]interface{}{"user": payload.User, "impersonator": payload.Admin,
+			"expires": s.impersonationExpires}}})
+}
+
+// impersonationAllowed checks if the impersonated session may send the message. Answers the client
+// and returns false if it may not.
+func (s *Session) impersonationAllowed(msg *ClientComMessage) bool {
+	if !s.impersonationExpires.IsZero() && msg.timestamp.After(s.impersonationExpires) {
+		if s.proto != RPC {
+			logAudit.Infof("impersonation: sess[%s] of %s by %s expired", s.sid, s.uid.UserId(),
+				s.impersonator.UserId())
+			select {
+			case s.stop <- encodePacket(ErrAuthFailed("", "", msg.timestamp)):
+			default:
+			}
+		}
+		return false
+	}
+
+	var id, topic string
+	switch {
+	case msg.Hi != nil, msg.Login != nil, msg.Get != nil:
+		return true
+	case msg.Leave != nil:
+		if !msg.Leave.Unsub {
+			return true
+		}
+		id, topic = msg.Leave.Id, msg.Leave.Topic
+	case msg.Sub != nil:
+		id, topic = msg.Sub.Id, msg.Sub.Topic
+		// Attachment to a remote 'me' is not tracked by the session
+		me := s.uid.UserId()
+		if msg.Sub.Set == nil && !strings.HasPrefix(topic, "new") && !strings.HasPrefix(topic, "nch") &&
+			(topic == "me" || s.subs[me] != nil || globals.cluster.isRemoteTopic(me)) {
+			// Subscriptions are checked by the topic
+			return true
+		}
+	case msg.Pub != nil:
+		id, topic = msg.Pub.Id, msg.Pub.Topic
+	case msg.Set != nil:
+		id, topic = msg.Set.Id, msg.Set.Topic
+	case msg.Del != nil:
+		id, topic = msg.Del.Id, msg.Del.Topic
+	case msg.Acc != nil:
+		id = msg.Acc.Id
+	case msg.Note != nil:
+		// Notes are not answered, drop quietly
+		return false
+	}
+
+	logAudit.Infof("impersonation: sess[%s] of %s by %s denied request to '%s'", s.sid, s.uid.UserId(),
+		s.impersonator.UserId(), topic)
+	s.queueOut(ErrPermissionDenied(id, topic, msg.timestamp))
+	return false
+}
+
+// replySetImpersonate records the user's consent to impersonation in response to set.impersonate on 'me'.
+func (t *Topic) replySetImpersonate(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCat_Me || !sess.impersonator.IsZero() {
+		sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
+		return errors.New("impersonation consent outside of 'me'")
+	}
+	if impersonation.key == nil || !impersonation.consent {
+		sess.queueOut(ErrOperationNotAllowed(set.Id, set.Topic, now))
+		return errors.New("impersonation consent is not used")
+	}
+	if set.Impersonate.Allow < 0 {
+		sess.queueOut(ErrMalformed(set.Id, set.Topic, now))
+		return errors.New("invalid impersonation consent")
+	}
+
+	// Consent cannot outlive a token issued now
+	allow := time.Duration(set.Impersonate.Allow) * time.Second
+	if allow > impersonation.ttl {
+		allow = impersonation.ttl
+	}
+	var until time.Time
+	if allow > 0 {
+		until = now.Add(allow)
+	}
+	if err := store.Users.Update(sess.uid, map[string]interface{}{"ImpersonationConsent": until}); err != nil {
+		sess.queueOut(ErrUnknown(set.Id, set.Topic, now))
+		return err
+	}
+	if allow > 0 {
+		logAudit.Infof("impersonation: %s allowed impersonation until %s", sess.uid.UserId(),
+			until.Format(time.RFC3339))
+	} else {
+		logAudit.Infof("impersonation: %s withdrew consent to impersonation", sess.uid.UserId())
+	}
+
+	reply := NoErr(set.Id, set.Topic, now)
+	if allow > 0 {
+		reply.Ctrl.Params = map[string]interface{}{"expires": until}
+	}
+	sess.queueOut(reply)
+	return nil
+}
+
+// replyGetSessions lists the sessions attached to 'me' in response to {get what="sessions"}.
+func (t *Topic) replyGetSessions(sess *Session, id string) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCat_Me {
+		sess.queueOut(ErrPermissionDenied(id, t.original(sess.uid), now))
+		return errors.New("sessions requested outside of 'me'")
+	}
+
+	sessions := make([]MsgSessionInfo, 0, len(t.sessions))
+	for s := range t.sessions {
+		info := MsgSessionInfo{
+			UserAgent:  s.userAgent,
+			RemoteAddr: s.remoteAddr,
+			Current:    s == sess}
+		if !s.impersonator.IsZero() {
+			info.Impersonator = s.impersonator.UserId()
+			if !s.impersonationExpires.IsZero() {
+				expires := s.impersonationExpires
+				info.Expires = &expires
+			}
+		}
+		sessions = append(sessions, info)
+	}
+
+	sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{Id: id, Topic: "me", Timestamp: &now,
+		Sessions: sessions}})
+	return nil
+}
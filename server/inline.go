@@ -0,0 +1,191 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Inline bot queries. A client attached to any topic queries a bot with
+ *  {get what="inline" inline={bot, query, offset}}. The query is answered
+ *  either by a plugin configured for the bot or by the bot's own session:
+ *  the bot receives the query as {info what="query"} on its 'me' topic and
+ *  answers with {note what="answer"}. Results are sent only to the querying
+ *  session as {meta inline}. Nothing is stored in the topic: the client
+ *  publishes the result the user picks as an ordinary message.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Time to wait for the bot to answer the query
+	INLINE_QUERY_TIMEOUT = 5 * time.Second
+	// Maximum length of the query in characters
+	INLINE_MAX_QUERY_LENGTH = 256
+	// Maximum number of results in one answer
+	INLINE_MAX_RESULTS = 50
+)
+
+// inlinePending is a query forwarded to the bot's session and waiting for an answer.
+type inlinePending struct {
+	sess  *Session
+	bot   types.Uid
+	id    string
+	topic string
+	query string
+	timer *time.Timer
+}
+
+// Queries waiting for an answer from bot sessions, keyed by query ID
+var inlineQueries = struct {
+	sync.Mutex
+	pending map[string]*inlinePending
+}{pending: make(map[string]*inlinePending)}
+
+// inlineQuery handles {get what="inline"}. The expanded topic is the topic the query was made from.
+func (s *Session) inlineQuery(msg *ClientComMessage, expanded string) {
+	now := msg.timestamp
+	query := msg.Get.Inline
+
+	var bot types.Uid
+	if query != nil {
+		bot = types.ParseUserId(query.Bot)
+	}
+	if bot.IsZero() || bot == s.uid || query.Query == "" ||
+		utf8.RuneCountInString(query.Query) > INLINE_MAX_QUERY_LENGTH {
+		s.queueOut(ErrMalformed(msg.Get.Id, msg.Get.Topic, now))
+		return
+	}
+
+	if _, ok := s.subs[expanded]; !ok && !globals.cluster.isRemoteTopic(expanded) {
+		s.queueOut(ErrAttachFirst(msg.Get.Id, msg.Get.Topic, now))
+		return
+	}
+
+	if p := pluginInlineGet(bot); p != nil {
+		go s.inlineQueryPlugin(p, msg, expanded)
+		return
+	}
+
+	if user, err := store.Users.Get(bot); err != nil {
+		s.queueOut(ErrUnknown(msg.Get.Id, msg.Get.Topic, now))
+		return
+	} else if user == nil {
+		s.queueOut(ErrUserNotFound(msg.Get.Id, msg.Get.Topic, now))
+		return
+	}
+
+	// Forward the query to the bot's sessions and wait for the answer.
+	pending := &inlinePending{
+		sess:  s,
+		bot:   bot,
+		id:    msg.Get.Id,
+		topic: msg.Get.Topic,
+		query: query.Query}
+	qid := store.GetUidString()
+
+	inlineQueries.Lock()
+	inlineQueries.pending[qid] = pending
+	pending.timer = time.AfterFunc(INLINE_QUERY_TIMEOUT, func() {
+		if inlineTake(qid) != nil {
+			s.queueOut(ErrTimeout(pending.id, pending.topic, types.TimeNow()))
+		}
+	})
+	inlineQueries.Unlock()
+
+	globals.hub.route <- &ServerComMessage{Info: &MsgServerInfo{
+		Topic: "me",
+		From:  s.uid.UserId(),
+		What:  "query",
+		Query: &MsgInlineQuery{
+			Id:     qid,
+			Topic:  expanded,
+			Query:  query.Query,
+			Offset: query.Offset},
+	}, rcptto: bot.UserId(), timestamp: now}
+}
+
+// inlineQueryPlugin asks the plugin configured for the bot to answer the query.
+func (s *Session) inlineQueryPlugin(p *plugin, msg *ClientComMessage, expanded string) {
+	query := msg.Get.Inline
+	resp, err := p.transport.call(&pluginRequest{
+		Event:     pluginEventInline,
+		Timestamp: msg.timestamp,
+		User:      s.uid.UserId(),
+		Topic:     expanded,
+		Query:     query.Query,
+		Offset:    query.Offset})
+	if err != nil {
+		logSession.Warnf("plugin[%s]: %s", p.name, err.Error())
+		s.queueOut(ErrUnknown(msg.Get.Id, msg.Get.Topic, types.TimeNow()))
+		return
+	}
+	if resp.Action == pluginActionReject {
+		s.queueOut(pluginReject(resp.Code, resp.Text, msg.Get.Id, msg.Get.Topic, types.TimeNow()))
+		return
+	}
+
+	s.inlineReply(msg.Get.Id, msg.Get.Topic, &MsgInlineResults{
+		Bot:     query.Bot,
+		Query:   query.Query,
+		Results: resp.Results,
+		Next:    resp.Next})
+}
+
+// inlineAnswer handles {note what="answer"} sent by the bot in response to the forwarded query.
+func (s *Session) inlineAnswer(answer *MsgInlineResults) error {
+	if answer == nil || answer.Id == "" {
+		return errors.New("malformed inline answer")
+	}
+
+	inlineQueries.Lock()
+	pending := inlineQueries.pending[answer.Id]
+	if pending == nil || pending.bot != s.uid {
+		// Unknown, expired or answered by someone else
+		inlineQueries.Unlock()
+		return errors.New("unknown inline query")
+	}
+	delete(inlineQueries.pending, answer.Id)
+	inlineQueries.Unlock()
+
+	pending.timer.Stop()
+	pending.sess.inlineReply(pending.id, pending.topic, &MsgInlineResults{
+		Bot:     s.uid.UserId(),
+		Query:   pending.query,
+		Results: answer.Results,
+		Next:    answer.Next})
+	return nil
+}
+
+// inlineTake removes the pending query from the registry and returns it, nil if the query is not found.
+func inlineTake(qid string) *inlinePending {
+	inlineQueries.Lock()
+	defer inlineQueries.Unlock()
+
+	pending := inlineQueries.pending[qid]
+	delete(inlineQueries.pending, qid)
+	return pending
+}
+
+// inlineReply sends results of the query to the querying session only.
+func (s *Session) inlineReply(id, topic string, results *MsgInlineResults) {
+	if len(results.Results) > INLINE_MAX_RESULTS {
+		results.Results = results.Results[:INLINE_MAX_RESULTS]
+	}
+	if results.Results == nil {
+		results.Results = []interface{}{}
+	}
+	now := types.TimeNow()
+	s.queueOut(&ServerComMessage{Meta: &MsgServerMeta{
+		Id:        id,
+		Topic:     topic,
+		Timestamp: &now,
+		Inline:    results}})
+}
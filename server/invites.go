@@ -0,0 +1,226 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Join-by-link invitations to group topics and channels. An admin of the
+ *  topic requests a link with
+ *    {set topic="grp..." invite={mode: "JRW", expires: 86400}}
+ *  and gets back a signed token in {ctrl params.invite}. Anyone who
+ *  presents the token in {sub topic="grp..." invite="..."} is subscribed
+ *  with the mode of the token, even if the default access of the topic
+ *  would not let them in. The token is not bound to a user and can be used
+ *  until it expires or is revoked. All outstanding tokens of the topic are
+ *  revoked with {set invite={revoke: true}}. Banned users cannot join with
+ *  a token.
+ *
+ *  Token is base64url(JSON payload) "." base64url(HMAC-SHA256 of payload).
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Minimum length of the signing key, bytes
+	INVITE_MIN_KEY_LENGTH = 32
+)
+
+type invitesConfig struct {
+	// Key to sign tokens with, base64-encoded; empty disables invite links
+	Key string `json:"key"`
+	// Maximum lifetime of a token in seconds, 0 - tokens may be issued without expiration
+	MaxTtl int `json:"max_ttl"`
+}
+
+// Signed content of the token
+type invitePayload struct {
+	Topic string `json:"topic"`
+	Mode  string `json:"mode"`
+	// Expiration time, Unix seconds, 0 if the token does not expire
+	Expires int64 `json:"exp,omitempty"`
+	// Generation of the topic's invites; tokens of older generations are revoked
+	Gen int `json:"gen"`
+}
+
+var invites struct {
+	key    []byte
+	maxTtl time.Duration
+}
+
+// invitesInit parses config. Invite links are disabled unless the key is given.
+func invitesInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config invitesConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse invites config:", err)
+	}
+	if config.Key == "" {
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config.Key)
+	if err != nil {
+		logMain.Fatal("invites: failed to decode key", err)
+	}
+	if len(key) < INVITE_MIN_KEY_LENGTH {
+		logMain.Fatal("invites: key is too short")
+	}
+	invites.key = key
+	invites.maxTtl = time.Duration(config.MaxTtl) * time.Second
+
+	logMain.Info("Invite links enabled")
+}
+
+// inviteSign returns the signed token for the payload.
+func inviteSign(payload *invitePayload) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, invites.key)
+	mac.Write(data)
+	return base64.RawURLEncoding.EncodeToString(data) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// inviteParse verifies the token signature and returns its payload.
+func inviteParse(token string) (*invitePayload, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed invite token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, invites.key)
+	mac.Write(data)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("invalid invite signature")
+	}
+
+	var payload invitePayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// inviteMode checks the token presented in {sub} and returns the access mode it grants.
+func (t *Topic) inviteMode(token string, now time.Time) (types.AccessMode, error) {
+	if invites.key == nil {
+		return types.ModeNone, errors.New("invite links are disabled")
+	}
+	payload, err := inviteParse(token)
+	if err != nil {
+		return types.ModeNone, err
+	}
+	if payload.Topic != t.name || payload.Gen != t.inviteGen {
+		return types.ModeNone, errors.New("invite token is revoked or issued for another topic")
+	}
+	if payload.Expires != 0 && now.Unix() > payload.Expires {
+		return types.ModeNone, errors.New("invite token expired")
+	}
+
+	var mode types.AccessMode
+	if err := mode.UnmarshalText([]byte(payload.Mode)); err != nil {
+		return types.ModeNone, err
+	}
+	return mode, nil
+}
+
+// replySetInvite issues a new invite token or revokes the outstanding ones in response to set.invite.
+func (t *Topic) replySetInvite(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+	req := set.Invite
+	original := t.original(sess.uid)
+
+	if invites.key == nil {
+		sess.queueOut(ErrOperationNotAllowed(set.Id, original, now))
+		return errors.New("invite links are disabled")
+	}
+	if t.cat != types.TopicCat_Grp && t.cat != types.TopicCat_Chn {
+		sess.queueOut(ErrPermissionDenied(set.Id, original, now))
+		return errors.New("invite links to a non-group topic")
+	}
+	pud := t.perUser[sess.uid]
+	if !(pud.modeGiven & pud.modeWant).IsAdmin() {
+		sess.queueOut(ErrPermissionDenied(set.Id, original, now))
+		return errors.New("invite links requested by non-admin")
+	}
+
+	if req.Revoke {
+		gen := t.inviteGen + 1
+		if err := store.Topics.Update(t.name, map[string]interface{}{"InviteGen": gen}); err != nil {
+			sess.queueOut(ErrUnknown(set.Id, original, now))
+			return err
+		}
+		t.inviteGen = gen
+		if req.Mode == "" {
+			sess.queueOut(NoErr(set.Id, original, now))
+			return nil
+		}
+	}
+
+	mode := types.ModeUnset
+	if req.Mode != "" {
+		if err := mode.UnmarshalText([]byte(req.Mode)); err != nil {
+			sess.queueOut(ErrMalformed(set.Id, original, now))
+			return err
+		}
+	}
+	if mode == types.ModeUnset {
+		mode = t.accessAuth
+	}
+	// Ownership and moderation cannot be given by a link
+	mode &= ^(types.ModeOwner | types.ModeModerate)
+	if !mode.IsJoiner() {
+		sess.queueOut(ErrMalformed(set.Id, original, now))
+		return errors.New("invite link does not let users join")
+	}
+
+	ttl := time.Duration(req.Expires) * time.Second
+	if ttl < 0 || (invites.maxTtl > 0 && (ttl == 0 || ttl > invites.maxTtl)) {
+		ttl = invites.maxTtl
+	}
+	payload := &invitePayload{Topic: t.name, Mode: mode.String(), Gen: t.inviteGen}
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+		payload.Expires = expires.Unix()
+	}
+
+	token, err := inviteSign(payload)
+	if err != nil {
+		sess.queueOut(ErrUnknown(set.Id, original, now))
+		return err
+	}
+
+	params := map[string]interface{}{"invite": token, "mode": payload.Mode}
+	if !expires.IsZero() {
+		params["expires"] = expires
+	}
+	resp := NoErr(set.Id, original, now)
+	resp.Ctrl.Params = params
+	sess.queueOut(resp)
+	return nil
+}
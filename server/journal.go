@@ -0,0 +1,45 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Recovery of multi-step operations of the store interrupted by a crash:
+ *  deletion of topics, creation and hard deletion of users, deletion of
+ *  several subscriptions of a user. Each operation is recorded in a journal
+ *  before it starts and the record is deleted when it's done. Records found
+ *  at startup are recovered before the server accepts connections: deletions
+ *  are resumed, creation of users is rolled back. In a cluster each node
+ *  recovers its own operations.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// journalRecover completes operations interrupted at the previous run of this node.
+func journalRecover() {
+	var node string
+	if globals.cluster != nil {
+		node = globals.cluster.thisNodeName
+	}
+
+	var recovered, failed int
+	err := store.RecoverOperations(node, func(op *types.Operation, err error) {
+		if err != nil {
+			failed++
+			logMain.Warnf("journal: failed to recover %s '%s' of %s: %v", op.Kind, op.Object, op.CreatedAt, err)
+			return
+		}
+		recovered++
+		logMain.Infof("journal: recovered %s '%s' of %s", op.Kind, op.Object, op.CreatedAt)
+	})
+	if err != nil {
+		logMain.Fatal("Failed to load the journal of operations:", err)
+	}
+	if recovered+failed > 0 {
+		logMain.Infof("journal: %d interrupted operation(s) recovered, %d failed", recovered, failed)
+	}
+}
@@ -0,0 +1,182 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Write-behind of users' last seen time and user agent. The 'me' topic
+ *  records them every time a session of the user leaves. With many users
+ *  connecting and disconnecting, each of them generates a stream of
+ *  single-item writes. The updates are now collected in memory, only the
+ *  latest one per user is kept, and written on a timer or when too many are
+ *  pending. All pending updates are written on shutdown.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default interval between writes of pending updates
+	LASTSEEN_FLUSH_INTERVAL = 5 * time.Second
+	// Default number of pending updates which triggers a write
+	LASTSEEN_MAX_PENDING = 1024
+)
+
+type lastSeenConfig struct {
+	// Write every update immediately
+	Disabled bool `json:"disabled"`
+	// Interval between writes in milliseconds
+	FlushInterval int `json:"flush_interval"`
+	// Write when so many users have pending updates
+	MaxPending int `json:"max_pending"`
+}
+
+type lastSeenVal struct {
+	userAgent string
+	when      time.Time
+}
+
+var lastSeen struct {
+	sync.Mutex
+	pending map[types.Uid]lastSeenVal
+
+	disabled   bool
+	maxPending int
+	// Signal to write the updates now
+	flush chan bool
+	// Stops the writer
+	stop chan chan bool
+
+	// Exported as LastSeen in expvar
+	updates *expvar.Int
+	writes  *expvar.Int
+	failed  *expvar.Int
+}
+
+// lastSeenInit starts the writer of pending updates.
+func lastSeenInit(jsconfig json.RawMessage) {
+	var config lastSeenConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse last_seen config:", err)
+		}
+	}
+
+	lastSeen.updates = new(expvar.Int)
+	lastSeen.writes = new(expvar.Int)
+	lastSeen.failed = new(expvar.Int)
+	vars := new(expvar.Map).Init()
+	vars.Set("updates", lastSeen.updates)
+	vars.Set("writes", lastSeen.writes)
+	vars.Set("failed", lastSeen.failed)
+	vars.Set("pending", expvar.Func(func() interface{} {
+		lastSeen.Lock()
+		defer lastSeen.Unlock()
+		return len(lastSeen.pending)
+	}))
+	expvar.Publish("LastSeen", vars)
+
+	lastSeen.disabled = config.Disabled
+	if lastSeen.disabled {
+		return
+	}
+
+	interval := time.Duration(config.FlushInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = LASTSEEN_FLUSH_INTERVAL
+	}
+	lastSeen.maxPending = config.MaxPending
+	if lastSeen.maxPending <= 0 {
+		lastSeen.maxPending = LASTSEEN_MAX_PENDING
+	}
+	lastSeen.pending = make(map[types.Uid]lastSeenVal)
+	lastSeen.flush = make(chan bool, 1)
+	lastSeen.stop = make(chan chan bool)
+
+	memRegisterCache("last_seen", func() int64 {
+		lastSeen.Lock()
+		defer lastSeen.Unlock()
+		// Key, value with a short user agent and the overhead of the map
+		return int64(len(lastSeen.pending)) * 160
+	})
+
+	go lastSeenWriter(interval)
+}
+
+func lastSeenWriter(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			lastSeenFlush()
+		case <-lastSeen.flush:
+			lastSeenFlush()
+		case done := <-lastSeen.stop:
+			lastSeenFlush()
+			done <- true
+			return
+		}
+	}
+}
+
+// lastSeenUpdate saves the time when the user was last online and the user agent.
+func lastSeenUpdate(uid types.Uid, userAgent string, when time.Time) error {
+	lastSeen.updates.Add(1)
+
+	if lastSeen.disabled {
+		lastSeen.writes.Add(1)
+		return store.Users.UpdateLastSeen(uid, userAgent, when)
+	}
+
+	lastSeen.Lock()
+	if prev, ok := lastSeen.pending[uid]; !ok || !when.Before(prev.when) {
+		lastSeen.pending[uid] = lastSeenVal{userAgent: userAgent, when: when}
+	}
+	full := len(lastSeen.pending) >= lastSeen.maxPending
+	lastSeen.Unlock()
+
+	if full {
+		select {
+		case lastSeen.flush <- true:
+		default:
+			// Write already requested
+		}
+	}
+	return nil
+}
+
+// lastSeenFlush writes all pending updates.
+func lastSeenFlush() {
+	lastSeen.Lock()
+	batch := lastSeen.pending
+	lastSeen.pending = make(map[types.Uid]lastSeenVal, len(batch))
+	lastSeen.Unlock()
+
+	for uid, val := range batch {
+		lastSeen.writes.Add(1)
+		if err := store.Users.UpdateLastSeen(uid, val.userAgent, val.when); err != nil {
+			lastSeen.failed.Add(1)
+			logTopic.Warnf("failed to update last seen of %s: %v", uid.UserId(), err)
+		}
+	}
+}
+
+// lastSeenStop writes all pending updates and stops the writer.
+func lastSeenStop() {
+	if lastSeen.disabled || lastSeen.stop == nil {
+		return
+	}
+	done := make(chan bool)
+	lastSeen.stop <- done
+	<-done
+}
@@ -0,0 +1,178 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Latency budget of published messages. Every {pub} is stamped with the
+ *  time it was received by the session. As the message passes through the
+ *  publishing pipeline, the time elapsed since then is recorded when the
+ *  message is persisted, when it's fanned out to sessions and when it's
+ *  handed to push notifications. Each step has a histogram with percentiles
+ *  exported in expvar. A message which takes longer than the budget from
+ *  receiving to push is logged with the breakdown by steps.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Steps of the message delivery, each step is measured from receiving the message
+const (
+	LATENCY_PERSIST = iota
+	LATENCY_FANOUT
+	LATENCY_PUSH
+	latencyStepCount
+)
+
+var latencyStepNames = [latencyStepCount]string{"persist", "fanout", "push"}
+
+// Upper bounds of the histogram buckets in milliseconds. The last bucket is unbounded.
+var latencyBuckets = [...]int64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+const (
+	// Default time from receiving a message to push
+	LATENCY_DEFAULT_BUDGET = 500 * time.Millisecond
+	// Budget violations are logged at most this often
+	LATENCY_LOG_INTERVAL = time.Second
+)
+
+type latencyConfig struct {
+	// Don't record latency
+	Disabled bool `json:"disabled"`
+	// Time allowed from receiving a message to handing it to push notifications, milliseconds
+	Budget int `json:"budget"`
+}
+
+// Histogram of latency of one step
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]int64
+}
+
+var latency struct {
+	enabled bool
+	budget  time.Duration
+
+	steps [latencyStepCount]latencyHistogram
+
+	// Time of the last logged violation as UnixNano and violations not logged since
+	lastLogged int64
+	suppressed int64
+
+	// Exported as Latency in expvar
+	overBudget *expvar.Int
+}
+
+// latencyInit parses config and publishes the metrics. Latency is recorded unless disabled.
+func latencyInit(jsconfig json.RawMessage) {
+	var config latencyConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse latency_budget config:", err)
+		}
+	}
+
+	if config.Disabled {
+		return
+	}
+
+	latency.budget = time.Duration(config.Budget) * time.Millisecond
+	if latency.budget <= 0 {
+		latency.budget = LATENCY_DEFAULT_BUDGET
+	}
+	latency.overBudget = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	for i := range latency.steps {
+		vars.Set(latencyStepNames[i], expvar.Func(latency.steps[i].export))
+	}
+	vars.Set("budget_ms", expvar.Func(func() interface{} { return int64(latency.budget / time.Millisecond) }))
+	vars.Set("over_budget", latency.overBudget)
+	expvar.Publish("Latency", vars)
+
+	latency.enabled = true
+}
+
+// observe adds the value to the histogram.
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := int64(d / time.Millisecond)
+	i := 0
+	for i < len(latencyBuckets) && ms > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+}
+
+// latencyPercentile returns the upper bound of the bucket which contains the given percentile,
+// -1 if the percentile falls into the unbounded bucket.
+func latencyPercentile(counts []int64, total int64, p int64) int64 {
+	rank := (total*p + 99) / 100
+	var sum int64
+	for i, count := range counts {
+		sum += count
+		if sum >= rank {
+			if i < len(latencyBuckets) {
+				return latencyBuckets[i]
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+// export returns the histogram and the percentiles for expvar.
+func (h *latencyHistogram) export() interface{} {
+	counts := make([]int64, len(h.counts))
+	var total int64
+	buckets := make(map[string]int64, len(counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+		total += counts[i]
+		if i < len(latencyBuckets) {
+			buckets["le_"+strconv.FormatInt(latencyBuckets[i], 10)] = counts[i]
+		} else {
+			buckets["inf"] = counts[i]
+		}
+	}
+
+	result := map[string]interface{}{"count": total, "buckets_ms": buckets}
+	if total > 0 {
+		result["p50_ms"] = latencyPercentile(counts, total, 50)
+		result["p90_ms"] = latencyPercentile(counts, total, 90)
+		result["p99_ms"] = latencyPercentile(counts, total, 99)
+	}
+	return result
+}
+
+// latencyMark records the time the message took to reach the step. Returns the time.
+func latencyMark(msg *ServerComMessage, step int) time.Duration {
+	if !latency.enabled || msg.received.IsZero() {
+		return 0
+	}
+	elapsed := time.Since(msg.received)
+	latency.steps[step].observe(elapsed)
+	return elapsed
+}
+
+// latencyCheck logs the message if it took longer than the budget to deliver.
+func latencyCheck(t *Topic, msg *ServerComMessage, marks *[latencyStepCount]time.Duration) {
+	if !latency.enabled || marks[LATENCY_PUSH] <= latency.budget {
+		return
+	}
+	latency.overBudget.Add(1)
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&latency.lastLogged)
+	if now-last < int64(LATENCY_LOG_INTERVAL) || !atomic.CompareAndSwapInt64(&latency.lastLogged, last, now) {
+		atomic.AddInt64(&latency.suppressed, 1)
+		return
+	}
+	logTopic.Warnf("topic[%s]: message %d over latency budget %s: persist %s, fanout %s, push %s to %d sessions (%d more not logged)",
+		t.name, msg.Data.SeqId, latency.budget, marks[LATENCY_PERSIST], marks[LATENCY_FANOUT], marks[LATENCY_PUSH],
+		len(t.sessions), atomic.SwapInt64(&latency.suppressed, 0))
+}
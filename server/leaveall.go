@@ -0,0 +1,299 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Leaving all topics at once. A user unsubscribes from all topics or from
+ *  all topics of one kind with
+ *    {leave topic="me" unsub=true all="grp"}
+ *  where all is "*" or one of "grp", "chn", "p2p". The server replies with
+ *  {ctrl} 202 and the ID of the job in params.job, and deletes the
+ *  subscriptions in the background. The user's sessions receive
+ *    {pres topic="me" what="gone" src="grp..."} for each topic left;
+ *    {pres topic="me" what="leave" src="<job>" seq=N} every
+ *      LEAVEALL_PROGRESS_EVERY topics, N is the number of topics left so far;
+ *    {pres topic="me" what="left" src="<job>" seq=N} when the job is done.
+ *  Topics owned by the user are skipped. One job per user runs at a time.
+ *
+ *  Root admins run the same job for any user with
+ *    POST /v0/admin/leave?user=usr...&all=grp
+ *  and check it with GET /v0/admin/leave?job=...
+ *
+ *  Deletions are journaled by the store: if the server crashes, the rest of
+ *  the current batch is deleted at startup, without notifications.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the admin endpoint
+	ADMIN_LEAVE_PATH = "/v0/admin/leave"
+	// Number of topics between progress notifications
+	LEAVEALL_PROGRESS_EVERY = 50
+	// Time a finished job is kept for GET requests
+	LEAVEALL_KEEP_FINISHED = time.Hour
+)
+
+// Job of leaving topics of one user
+type leaveJob struct {
+	Id   string `json:"id"`
+	User string `json:"user"`
+	All  string `json:"all"`
+	// Number of topics left so far
+	Left int `json:"left"`
+	// Number of topics skipped because the user owns them
+	Skipped  int    `json:"skipped"`
+	Finished bool   `json:"finished"`
+	Error    string `json:"error,omitempty"`
+
+	uid types.Uid
+}
+
+// Jobs which are running or recently finished
+var leaveJobs struct {
+	sync.Mutex
+	byId   map[string]*leaveJob
+	byUser map[types.Uid]*leaveJob
+}
+
+// leaveAllMatch checks if the subscription to the topic is to be deleted by the filter.
+func leaveAllMatch(all, topic string) bool {
+	switch types.GetTopicCat(topic) {
+	case types.TopicCat_Me, types.TopicCat_Fnd:
+		return false
+	case types.TopicCat_Grp:
+		return all == "*" || all == "grp"
+	case types.TopicCat_Chn:
+		return all == "*" || all == "chn"
+	case types.TopicCat_P2P:
+		return all == "*" || all == "p2p"
+	}
+	return false
+}
+
+// leaveAllStart starts a job of leaving the topics of the user matching the filter.
+func leaveAllStart(uid types.Uid, all string) (*leaveJob, error) {
+	if all != "*" && all != "grp" && all != "chn" && all != "p2p" {
+		return nil, errors.New("invalid topic filter")
+	}
+
+	leaveJobs.Lock()
+	defer leaveJobs.Unlock()
+
+	if leaveJobs.byId == nil {
+		leaveJobs.byId = make(map[string]*leaveJob)
+		leaveJobs.byUser = make(map[types.Uid]*leaveJob)
+	}
+	if _, ok := leaveJobs.byUser[uid]; ok {
+		return nil, nil
+	}
+
+	job := &leaveJob{Id: store.GetUidString(), User: uid.UserId(), All: all, uid: uid}
+	leaveJobs.byId[job.Id] = job
+	leaveJobs.byUser[uid] = job
+
+	go job.run()
+
+	return job, nil
+}
+
+// leaveAllGet returns a copy of the job's state.
+func leaveAllGet(id string) *leaveJob {
+	leaveJobs.Lock()
+	defer leaveJobs.Unlock()
+
+	if job, ok := leaveJobs.byId[id]; ok {
+		state := *job
+		return &state
+	}
+	return nil
+}
+
+// run deletes the subscriptions in rounds: the store returns a limited number of subscriptions at once.
+func (job *leaveJob) run() {
+	seen := make(map[string]bool)
+	var err error
+	for {
+		var subs []types.Subscription
+		if subs, err = store.Users.GetSubs(job.uid); err != nil {
+			break
+		}
+
+		var topics []string
+		var skipped int
+		original := make(map[string]string)
+		for i := range subs {
+			sub := &subs[i]
+			if seen[sub.Topic] || !leaveAllMatch(job.All, sub.Topic) {
+				continue
+			}
+			seen[sub.Topic] = true
+			if (sub.ModeGiven & sub.ModeWant).IsOwner() {
+				skipped++
+				continue
+			}
+			original[sub.Topic] = sub.Topic
+			if uid1, uid2, err := types.ParseP2P(sub.Topic); err == nil {
+				// Name of a p2p topic as seen by the user
+				if uid1 == job.uid {
+					original[sub.Topic] = uid2.UserId()
+				} else {
+					original[sub.Topic] = uid1.UserId()
+				}
+			}
+			topics = append(topics, sub.Topic)
+		}
+
+		leaveJobs.Lock()
+		job.Skipped += skipped
+		leaveJobs.Unlock()
+
+		if len(topics) == 0 {
+			break
+		}
+
+		err = store.Subs.DeleteAll(job.uid, topics, func(topic string) {
+			// Loaded topics evict the user, otherwise the user is told here
+			globals.hub.route <- &ServerComMessage{
+				Info:   &MsgServerInfo{Topic: original[topic], From: job.User, What: "unsub"},
+				rcptto: topic, timestamp: types.TimeNow()}
+
+			leaveJobs.Lock()
+			job.Left++
+			left := job.Left
+			leaveJobs.Unlock()
+
+			if left%LEAVEALL_PROGRESS_EVERY == 0 {
+				job.notify("leave", left)
+			}
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	leaveJobs.Lock()
+	job.Finished = true
+	if err != nil {
+		job.Error = err.Error()
+	}
+	left := job.Left
+	delete(leaveJobs.byUser, job.uid)
+	leaveJobs.Unlock()
+
+	if err != nil {
+		logMain.Warnf("leave: job %s of '%s' failed after %d topics: %v", job.Id, job.User, left, err)
+	} else {
+		logMain.Infof("leave: job %s of '%s' left %d topics", job.Id, job.User, left)
+	}
+	job.notify("left", left)
+
+	time.AfterFunc(LEAVEALL_KEEP_FINISHED, func() {
+		leaveJobs.Lock()
+		delete(leaveJobs.byId, job.Id)
+		leaveJobs.Unlock()
+	})
+}
+
+// notify tells the user's sessions about the progress of the job.
+func (job *leaveJob) notify(what string, left int) {
+	globals.hub.route <- &ServerComMessage{
+		Pres:   &MsgServerPres{Topic: "me", What: what, Src: job.Id, SeqId: left},
+		rcptto: job.User}
+}
+
+// replyLeaveAll handles {leave topic="me" all=...}.
+func (s *Session) replyLeaveAll(msg *ClientComMessage) {
+	if msg.Leave.Topic != "me" || !msg.Leave.Unsub {
+		s.queueOut(ErrMalformed(msg.Leave.Id, msg.Leave.Topic, msg.timestamp))
+		return
+	}
+	job, err := leaveAllStart(s.uid, msg.Leave.All)
+	if err != nil {
+		s.queueOut(ErrMalformed(msg.Leave.Id, msg.Leave.Topic, msg.timestamp))
+		return
+	}
+	if job == nil {
+		s.queueOut(ErrAlreadyExists(msg.Leave.Id, msg.Leave.Topic, msg.timestamp))
+		return
+	}
+
+	reply := NoErrAccepted(msg.Leave.Id, msg.Leave.Topic, msg.timestamp)
+	reply.Ctrl.Params = map[string]interface{}{"job": job.Id}
+	s.queueOut(reply)
+}
+
+// serveLeaveAll starts a job for a user or reports the state of a job:
+// POST /v0/admin/leave?user=usr...&all=grp
+// GET /v0/admin/leave?job=...
+func serveLeaveAll(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if req.Method != http.MethodGet && redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	admin, authLvl, err := authHttpRequestLevel(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	} else if authLvl != auth.LevelRoot {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	var job *leaveJob
+	switch req.Method {
+	case http.MethodGet:
+		if job = leaveAllGet(req.FormValue("job")); job == nil {
+			writeErr(ErrNotFound("", "", now))
+			return
+		}
+	case http.MethodPost:
+		uid := types.ParseUserId(req.FormValue("user"))
+		if uid.IsZero() {
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+		if job, err = leaveAllStart(uid, req.FormValue("all")); err != nil {
+			writeErr(ErrMalformed("", "", now))
+			return
+		} else if job == nil {
+			writeErr(ErrAlreadyExists("", "", now))
+			return
+		}
+		logAudit.Infof("leave: '%s' started job %s for '%s', topics: %s", admin.UserId(), job.Id,
+			job.User, job.All)
+		job = leaveAllGet(job.Id)
+		wrt.WriteHeader(http.StatusAccepted)
+	default:
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	enc.Encode(job)
+}
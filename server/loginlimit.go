@@ -0,0 +1,259 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Throttling of failed logins. Failed {login} attempts are counted per
+ *  account (basic scheme only) and per IP address. When the count reaches
+ *  the limit, further logins are rejected with 429 and params.retry_after
+ *  in seconds. Each next lockout of the same account or address is twice
+ *  as long, up to max_lockout. A successful login resets the account's
+ *  counter; the address counter expires only after a period without
+ *  failures, so spraying one password over many accounts is slowed down too.
+ *
+ *  The counters are kept in the shared cache if store_config has one,
+ *  otherwise in memory of each node.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	LOGIN_ACCOUNT_FAILURES = 5
+	LOGIN_IP_FAILURES      = 20
+	LOGIN_LOCKOUT          = time.Minute
+	LOGIN_MAX_LOCKOUT      = time.Hour
+	LOGIN_WINDOW           = 24 * time.Hour
+
+	// Local counters are purged of expired ones when there are so many
+	LOGIN_LOCAL_PURGE_SIZE = 100000
+)
+
+type loginLimitConfig struct {
+	Disabled bool `json:"disabled"`
+	// Failed logins allowed per account before it's locked
+	AccountFailures int `json:"account_failures"`
+	// Failed logins allowed per IP address before it's locked
+	IpFailures int `json:"ip_failures"`
+	// First lockout in seconds, each next one is twice as long
+	Lockout int `json:"lockout"`
+	// Longest lockout in seconds
+	MaxLockout int `json:"max_lockout"`
+	// Counters and lockouts are forgotten after so many seconds without failures
+	Window int `json:"window"`
+}
+
+// Failures of one account or address
+type loginFailures struct {
+	Count    int   `json:"count"`
+	Lockouts int   `json:"lockouts"`
+	Until    int64 `json:"until"`
+}
+
+var loginLimit struct {
+	disabled        bool
+	accountFailures int
+	ipFailures      int
+	lockout         time.Duration
+	maxLockout      time.Duration
+	window          time.Duration
+
+	// Counters, shared or local
+	cache store.Cache
+	// Keeps read-modify-write of the counters consistent on this node
+	lock sync.Mutex
+}
+
+// loginLimitInit configures throttling. Must be called after the store is opened.
+func loginLimitInit(jsconfig json.RawMessage) {
+	var config loginLimitConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse login_limit config:", err)
+		}
+	}
+
+	loginLimit.disabled = config.Disabled
+	loginLimit.accountFailures = config.AccountFailures
+	if loginLimit.accountFailures <= 0 {
+		loginLimit.accountFailures = LOGIN_ACCOUNT_FAILURES
+	}
+	loginLimit.ipFailures = config.IpFailures
+	if loginLimit.ipFailures <= 0 {
+		loginLimit.ipFailures = LOGIN_IP_FAILURES
+	}
+	loginLimit.lockout = time.Duration(config.Lockout) * time.Second
+	if loginLimit.lockout <= 0 {
+		loginLimit.lockout = LOGIN_LOCKOUT
+	}
+	loginLimit.maxLockout = time.Duration(config.MaxLockout) * time.Second
+	if loginLimit.maxLockout < loginLimit.lockout {
+		loginLimit.maxLockout = LOGIN_MAX_LOCKOUT
+	}
+	loginLimit.window = time.Duration(config.Window) * time.Second
+	if loginLimit.window < loginLimit.maxLockout {
+		loginLimit.window = LOGIN_WINDOW
+	}
+
+	if loginLimit.cache = store.GetCache(); loginLimit.cache == nil {
+		local := &localCounters{entries: make(map[string]localCounter)}
+		loginLimit.cache = local
+		memRegisterCache("login_counters", func() int64 {
+			local.Lock()
+			defer local.Unlock()
+			return int64(len(local.entries)) * 128
+		})
+	}
+}
+
+// loginLimitKeys returns the keys of the counters of the login attempt.
+func loginLimitKeys(scheme string, secret []byte, remoteAddr string) []string {
+	var keys []string
+	if remoteAddr != "" {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		keys = append(keys, "login:ip:"+host)
+	}
+	if scheme == "basic" {
+		if splitAt := strings.Index(string(secret), ":"); splitAt > 0 {
+			keys = append(keys, "login:acc:basic:"+strings.ToLower(string(secret[:splitAt])))
+		}
+	}
+	return keys
+}
+
+func loginCounter(key string) *loginFailures {
+	var failures loginFailures
+	if data, ok := loginLimit.cache.Get(key); ok {
+		json.Unmarshal(data, &failures)
+	}
+	return &failures
+}
+
+// loginLockedOut returns the time left until the login may be attempted again, zero if it may be attempted now.
+func loginLockedOut(keys []string) time.Duration {
+	if loginLimit.disabled {
+		return 0
+	}
+
+	now := time.Now()
+	var retry time.Duration
+	for _, key := range keys {
+		if left := time.Unix(loginCounter(key).Until, 0).Sub(now); left > retry {
+			retry = left
+		}
+	}
+	return retry
+}
+
+// loginFailed counts the failed attempt and locks out the account or address if there are too many.
+func loginFailed(keys []string) {
+	if loginLimit.disabled {
+		return
+	}
+
+	loginLimit.lock.Lock()
+	defer loginLimit.lock.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		limit := loginLimit.ipFailures
+		if strings.HasPrefix(key, "login:acc:") {
+			limit = loginLimit.accountFailures
+		}
+
+		failures := loginCounter(key)
+		failures.Count++
+		if failures.Count >= limit {
+			lockout := loginLimit.lockout << uint(failures.Lockouts)
+			if lockout > loginLimit.maxLockout || lockout <= 0 {
+				lockout = loginLimit.maxLockout
+			}
+			failures.Count = 0
+			failures.Lockouts++
+			failures.Until = now.Add(lockout).Unix()
+			logSession.Warnf("login: too many failed attempts for %s, locked out for %v", key, lockout)
+		}
+
+		if data, err := json.Marshal(failures); err == nil {
+			loginLimit.cache.Set(key, data, loginLimit.window)
+		}
+	}
+}
+
+// loginSucceeded resets the counter of the account. Counters of addresses expire on their own.
+func loginSucceeded(keys []string) {
+	if loginLimit.disabled {
+		return
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "login:acc:") {
+			loginLimit.cache.Delete(key)
+		}
+	}
+}
+
+// Counters of this node when the shared cache is not configured
+type localCounters struct {
+	sync.Mutex
+	entries map[string]localCounter
+}
+
+type localCounter struct {
+	data    []byte
+	expires time.Time
+}
+
+func (c *localCounters) Init(jsonconf string) error {
+	return nil
+}
+
+func (c *localCounters) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || entry.expires.Before(time.Now()) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (c *localCounters) Set(key string, val []byte, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= LOGIN_LOCAL_PURGE_SIZE {
+		for k, entry := range c.entries {
+			if entry.expires.Before(now) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = localCounter{data: val, expires: now.Add(ttl)}
+}
+
+func (c *localCounters) Delete(keys ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+}
+
+func (c *localCounters) Close() error {
+	return nil
+}
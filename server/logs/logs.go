@@ -0,0 +1,297 @@
+// Package logs implements leveled, module-scoped logging with text or JSON output to
+// one or more sinks.
+package logs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log record.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts the name of a level to Level.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == strings.ToLower(name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.New("logs: unknown level '" + name + "'")
+}
+
+type sinkConfig struct {
+	// "stderr", "file" or "syslog"
+	Type string `json:"type"`
+	// Records below this level are not written to this sink; default is to write everything
+	Level string `json:"level"`
+
+	// "file": path to the log file
+	Path string `json:"path"`
+	// "file": rotate the file when it grows larger than this many megabytes, 0 for no rotation
+	MaxSize int `json:"max_size"`
+	// "file": number of rotated files to keep
+	MaxBackups int `json:"max_backups"`
+
+	// "syslog": network and address of the syslog server, empty to use the local syslog
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	// "syslog": tag of the records
+	Tag string `json:"tag"`
+}
+
+type configType struct {
+	// Default level: "debug", "info", "warn" or "error"
+	Level string `json:"level"`
+	// Overrides of the level for individual modules, e.g. {"dynamodb": "warn"}
+	Modules map[string]string `json:"modules"`
+	// "text" (default) or "json"
+	Format string       `json:"format"`
+	Sinks  []sinkConfig `json:"sinks"`
+}
+
+// sink receives formatted records.
+type sink interface {
+	write(level Level, rec []byte) error
+	close() error
+}
+
+type sinkEntry struct {
+	minLevel Level
+	sink     sink
+}
+
+// state is the current configuration. It is replaced as a whole when the logger is reconfigured.
+type state struct {
+	level   Level
+	modules map[string]Level
+	json    bool
+	sinks   []sinkEntry
+}
+
+var current atomic.Value
+
+// Serializes writes to sinks
+var writeLock sync.Mutex
+
+func init() {
+	current.Store(&state{
+		level: LevelInfo,
+		sinks: []sinkEntry{{minLevel: LevelDebug, sink: &stderrSink{}}}})
+}
+
+// Init configures logging. The configuration may be empty, then records of level info and above
+// are written to stderr as text. Init may be called more than once to change the configuration.
+func Init(jsconfig string) error {
+	var config configType
+	if jsconfig != "" {
+		if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
+			return errors.New("logs: failed to parse config: " + err.Error())
+		}
+	}
+
+	st := &state{level: LevelInfo, modules: make(map[string]Level)}
+	var err error
+	if config.Level != "" {
+		if st.level, err = ParseLevel(config.Level); err != nil {
+			return err
+		}
+	}
+	for module, name := range config.Modules {
+		if st.modules[module], err = ParseLevel(name); err != nil {
+			return err
+		}
+	}
+	switch config.Format {
+	case "", "text":
+	case "json":
+		st.json = true
+	default:
+		return errors.New("logs: unknown format '" + config.Format + "'")
+	}
+
+	if len(config.Sinks) == 0 {
+		config.Sinks = []sinkConfig{{Type: "stderr"}}
+	}
+	for i := range config.Sinks {
+		conf := &config.Sinks[i]
+		entry := sinkEntry{minLevel: LevelDebug}
+		if conf.Level != "" {
+			if entry.minLevel, err = ParseLevel(conf.Level); err != nil {
+				return err
+			}
+		}
+		if entry.sink, err = newSink(conf); err != nil {
+			for _, opened := range st.sinks {
+				opened.sink.close()
+			}
+			return err
+		}
+		st.sinks = append(st.sinks, entry)
+	}
+
+	writeLock.Lock()
+	old := current.Load().(*state)
+	current.Store(st)
+	for _, entry := range old.sinks {
+		entry.sink.close()
+	}
+	writeLock.Unlock()
+
+	// Records written with the standard logger, e.g. by third-party packages, go to the sinks too.
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{New("std")})
+
+	return nil
+}
+
+func newSink(conf *sinkConfig) (sink, error) {
+	switch conf.Type {
+	case "stderr":
+		return &stderrSink{}, nil
+	case "file":
+		return newFileSink(conf.Path, conf.MaxSize, conf.MaxBackups)
+	case "syslog":
+		return newSyslogSink(conf.Network, conf.Addr, conf.Tag)
+	}
+	return nil, errors.New("logs: unknown sink '" + conf.Type + "'")
+}
+
+// Logger writes records on behalf of a module.
+type Logger struct {
+	module string
+}
+
+// New creates a logger for the module. Loggers are cheap and are normally created once per module.
+func New(module string) *Logger {
+	return &Logger{module: module}
+}
+
+// Enabled checks if records of the given level are written for the module.
+func (l *Logger) Enabled(level Level) bool {
+	st := current.Load().(*state)
+	if min, ok := st.modules[l.module]; ok {
+		return level >= min
+	}
+	return level >= st.level
+}
+
+func (l *Logger) Debug(v ...interface{}) {
+	l.output(LevelDebug, "", v)
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(LevelDebug, format, v)
+}
+
+func (l *Logger) Info(v ...interface{}) {
+	l.output(LevelInfo, "", v)
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output(LevelInfo, format, v)
+}
+
+func (l *Logger) Warn(v ...interface{}) {
+	l.output(LevelWarn, "", v)
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(LevelWarn, format, v)
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.output(LevelError, "", v)
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.output(LevelError, format, v)
+}
+
+// Fatal writes an error record and terminates the process.
+func (l *Logger) Fatal(v ...interface{}) {
+	l.output(LevelError, "", v)
+	os.Exit(1)
+}
+
+// Fatalf writes an error record and terminates the process.
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.output(LevelError, format, v)
+	os.Exit(1)
+}
+
+// record is the JSON representation of a log record.
+type record struct {
+	Timestamp string `json:"ts"`
+	Level     string `json:"level"`
+	Module    string `json:"module"`
+	Msg       string `json:"msg"`
+}
+
+func (l *Logger) output(level Level, format string, v []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var msg string
+	if format == "" {
+		msg = fmt.Sprintln(v...)
+	} else {
+		msg = fmt.Sprintf(format, v...)
+	}
+	msg = strings.TrimRight(msg, "\n")
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	st := current.Load().(*state)
+	ts := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	var rec []byte
+	if st.json {
+		rec, _ = json.Marshal(&record{Timestamp: ts, Level: level.String(), Module: l.module, Msg: msg})
+	} else {
+		rec = []byte(ts + " " + strings.ToUpper(level.String()) + " [" + l.module + "] " + msg)
+	}
+	rec = append(rec, '\n')
+
+	for _, entry := range st.sinks {
+		if level >= entry.minLevel {
+			if err := entry.sink.write(level, rec); err != nil {
+				os.Stderr.Write([]byte("logs: failed to write record: " + err.Error() + "\n"))
+			}
+		}
+	}
+}
+
+// stdWriter passes output of the standard logger to the sinks at info level.
+type stdWriter struct {
+	logger *Logger
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	w.logger.output(LevelInfo, "", []interface{}{string(p)})
+	return len(p), nil
+}
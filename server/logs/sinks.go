@@ -0,0 +1,88 @@
+package logs
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+// stderrSink writes records to the standard error.
+type stderrSink struct{}
+
+func (stderrSink) write(level Level, rec []byte) error {
+	_, err := os.Stderr.Write(rec)
+	return err
+}
+
+func (stderrSink) close() error {
+	return nil
+}
+
+// fileSink appends records to a file. When the file grows larger than maxSize, it's renamed to
+// <path>.1, the previous <path>.1 to <path>.2 and so on, up to maxBackups files.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newFileSink(path string, maxSize, maxBackups int) (*fileSink, error) {
+	if path == "" {
+		return nil, errors.New("logs: missing path of the log file")
+	}
+	fs := &fileSink{path: path, maxSize: int64(maxSize) << 20, maxBackups: maxBackups}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileSink) open() error {
+	file, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fs.file = file
+	fs.size = info.Size()
+	return nil
+}
+
+func (fs *fileSink) write(level Level, rec []byte) error {
+	if fs.maxSize > 0 && fs.size+int64(len(rec)) > fs.maxSize && fs.size > 0 {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.file.Write(rec)
+	fs.size += int64(n)
+	return err
+}
+
+func (fs *fileSink) rotate() error {
+	if err := fs.file.Close(); err != nil {
+		return err
+	}
+	if fs.maxBackups > 0 {
+		os.Remove(fs.path + "." + strconv.Itoa(fs.maxBackups))
+		for i := fs.maxBackups - 1; i > 0; i-- {
+			os.Rename(fs.path+"."+strconv.Itoa(i), fs.path+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(fs.path, fs.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(fs.path); err != nil {
+		return err
+	}
+	return fs.open()
+}
+
+func (fs *fileSink) close() error {
+	return fs.file.Close()
+}
@@ -0,0 +1,42 @@
+// +build !windows,!nacl,!plan9
+
+package logs
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+// syslogSink sends records to syslog with the matching priority.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(network, addr, tag string) (sink, error) {
+	if tag == "" {
+		tag = "tinode"
+	}
+	writer, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (ss *syslogSink) write(level Level, rec []byte) error {
+	// Syslog adds its own timestamp and newline
+	msg := strings.TrimSuffix(string(rec), "\n")
+	switch level {
+	case LevelDebug:
+		return ss.writer.Debug(msg)
+	case LevelInfo:
+		return ss.writer.Info(msg)
+	case LevelWarn:
+		return ss.writer.Warning(msg)
+	}
+	return ss.writer.Err(msg)
+}
+
+func (ss *syslogSink) close() error {
+	return ss.writer.Close()
+}
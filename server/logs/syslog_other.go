@@ -0,0 +1,9 @@
+// +build windows nacl plan9
+
+package logs
+
+import "errors"
+
+func newSyslogSink(network, addr, tag string) (sink, error) {
+	return nil, errors.New("logs: syslog is not supported on this platform")
+}
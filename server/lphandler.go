@@ -9,34 +9,60 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"time"
 )
 
+// lpWrite writes a message taken from the queues in the encoding of the session.
+func (sess *Session) lpWrite(wrt http.ResponseWriter, msg []byte) error {
+	frame, err := sess.encodeFrame(msg)
+	if err != nil {
+		return err
+	}
+	_, err = wrt.Write(frame)
+	return err
+}
+
 func (sess *Session) writeOnce(wrt http.ResponseWriter) {
 
 	notifier, _ := wrt.(http.CloseNotifier)
 	closed := notifier.CloseNotify()
 
+	// Messages are sent before notifications
+	if msg, _, ok := sess.nextUrgent(SEND_CLASS_TYPING); ok {
+		if err := sess.lpWrite(wrt, msg); err != nil {
+			logSession.Warn("sess.writeOnce: " + err.Error())
+		}
+		return
+	}
+
 	select {
 	case msg, ok := <-sess.send:
 		if !ok {
-			log.Println("writeOnce: reading from a closed channel")
-		} else if _, err := wrt.Write(msg); err != nil {
-			log.Println("sess.writeOnce: " + err.Error())
+			logSession.Warn("writeOnce: reading from a closed channel")
+		} else if err := sess.lpWrite(wrt, msg); err != nil {
+			logSession.Warn("sess.writeOnce: " + err.Error())
+		}
+
+	case msg := <-sess.sendPres:
+		if err := sess.lpWrite(wrt, msg); err != nil {
+			logSession.Warn("sess.writeOnce: " + err.Error())
+		}
+
+	case msg := <-sess.sendTyping:
+		if err := sess.lpWrite(wrt, msg); err != nil {
+			logSession.Warn("sess.writeOnce: " + err.Error())
 		}
 
 	case <-closed:
-		log.Println("conn.writeOnce: connection closed by peer")
+		logSession.Warn("conn.writeOnce: connection closed by peer")
 
 	case msg := <-sess.stop:
 		// Make session unavailable
 		globals.sessionStore.Delete(sess)
-		wrt.Write(msg)
+		sess.lpWrite(wrt, msg)
 
 	case topic := <-sess.detach:
 		delete(sess.subs, topic)
@@ -44,17 +70,18 @@ func (sess *Session) writeOnce(wrt http.ResponseWriter) {
 	case <-time.After(pingPeriod):
 		// just write an empty packet on timeout
 		if _, err := wrt.Write([]byte{}); err != nil {
-			log.Println("sess.writeOnce: timout/" + err.Error())
+			logSession.Warn("sess.writeOnce: timout/" + err.Error())
 		}
 	}
 }
 
 func (sess *Session) readOnce(wrt http.ResponseWriter, req *http.Request) (error, int) {
-	if req.ContentLength > globals.maxMessageSize {
+	maxSize := maxMessageSize()
+	if req.ContentLength > maxSize {
 		return errors.New("request too large"), http.StatusExpectationFailed
 	}
 
-	req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxMessageSize)
+	req.Body = http.MaxBytesReader(wrt, req.Body, maxSize)
 	if raw, err := ioutil.ReadAll(req.Body); err == nil {
 		sess.dispatchRaw(raw)
 		return nil, 0
@@ -66,6 +93,8 @@ func (sess *Session) readOnce(wrt http.ResponseWriter, req *http.Request) (error
 // serveLongPoll handles long poll connections when WebSocket is not available
 // Connection could be without sid or with sid:
 //  - if sid is empty, create session, expect a login in the same request, respond and close
+//  - if sid is not empty and the session belongs to another cluster node, proxy the request there
+//  - if sid is not empty and the session is kept in the shared store, restore it if needed (see lpstate.go)
 //  - if sid is not empty and there is an initialized session, payload is optional
 //   - if no payload, perform long poll
 //   - if payload exists, process it and close
@@ -80,7 +109,16 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 		wrt.Header().Set("Strict-Transport-Security", "max-age"+globals.tlsStrictMaxAge)
 	}
 
-	enc := json.NewEncoder(wrt)
+	// Binary encoding requested by the client, JSON by default
+	fenc, ok := frameEncodingByName(req.FormValue("enc"))
+	enc := frameWriter{wrt: wrt, fenc: fenc}
+	enc.setContentType(wrt)
+
+	if !ok {
+		wrt.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrMalformed(req.FormValue("id"), "", now))
+		return
+	}
 
 	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
 		wrt.WriteHeader(http.StatusForbidden)
@@ -111,11 +149,22 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 
 	// Get session id
 	sid := req.FormValue("sid")
-	var sess *Session
 	if sid == "" {
+		if redirectToPrimary(wrt, req) {
+			return
+		}
+
+		if globals.cluster.isCordoned() {
+			// The node is being restarted, the client should connect to another node
+			wrt.WriteHeader(http.StatusServiceUnavailable)
+			enc.Encode(ErrServiceUnavailable(req.FormValue("id"), "", now))
+			return
+		}
+
 		// New session
-		sess = globals.sessionStore.Create(wrt, "")
-		log.Println("longPoll: new session created, sid=", sess.sid)
+		sess := globals.sessionStore.Create(wrt, globals.cluster.lpSessionId())
+		sess.enc = fenc
+		logSession.Debug("longPoll: new session created, sid=", sess.sid)
 		wrt.WriteHeader(http.StatusCreated)
 		pkt := NoErrCreated(req.FormValue("id"), "", now)
 		pkt.Ctrl.Params = map[string]string{
@@ -125,21 +174,42 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 
 		return
 
-	} else {
-		// Existing session
-		sess = globals.sessionStore.Get(sid)
-		if sess == nil {
-			log.Println("longPoll: invalid or expired session id", sid)
-
-			wrt.WriteHeader(http.StatusForbidden)
-			enc.Encode(
-				&ServerComMessage{Ctrl: &MsgServerCtrl{
-					Timestamp: now,
-					Code:      http.StatusForbidden,
-					Text:      "invalid or expired session id"}})
+	} else if node := lpSessionNode(sid); node != nil {
+		// Session of another node
+		globals.cluster.proxyLongPoll(node, sid, wrt, req)
+		return
+	}
 
-			return
-		}
+	serveLongPollSession(wrt, req, sid, fenc, now)
+}
+
+// serveLongPollSession reads the payload or waits for messages of an existing session.
+func serveLongPollSession(wrt http.ResponseWriter, req *http.Request, sid string, fenc frameEncoding,
+	now time.Time) {
+
+	sess := globals.sessionStore.Get(sid)
+	if sess == nil {
+		// The session of another node could be continued here
+		sess = lpStateRestore(sid, wrt)
+	}
+	if sess != nil {
+		// The encoding is chosen when the session is created
+		fenc = sess.enc
+	}
+	enc := frameWriter{wrt: wrt, fenc: fenc}
+	enc.setContentType(wrt)
+
+	if sess == nil {
+		logSession.Warn("longPoll: invalid or expired session id", sid)
+
+		wrt.WriteHeader(http.StatusForbidden)
+		enc.Encode(
+			&ServerComMessage{Ctrl: &MsgServerCtrl{
+				Timestamp: now,
+				Code:      http.StatusForbidden,
+				Text:      "invalid or expired session id"}})
+
+		return
 	}
 
 	sess.remoteAddr = req.RemoteAddr
@@ -147,7 +217,7 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 	if req.ContentLength != 0 {
 		// Read payload and send it for processing.
 		if err, code := sess.readOnce(wrt, req); err != nil {
-			log.Println("longPoll: " + err.Error())
+			logSession.Warn("longPoll: " + err.Error())
 			// Failed to read request, report an error, if possible
 			if code != 0 {
 				wrt.WriteHeader(code)
@@ -160,4 +230,5 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 	}
 
 	sess.writeOnce(wrt)
+	sess.lpStateSave()
 }
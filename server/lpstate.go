@@ -0,0 +1,363 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Long polling without sticky sessions. With "lp_state" in the config the
+ *  state needed to continue a long polling session is kept in a shared
+ *  store: the user, the client and the topics the session is attached to
+ *  with the ID of the last message delivered in each. A node which receives
+ *  a poll of a session it does not own:
+ *    - forwards the poll to the node which owns the session if that node is
+ *      alive;
+ *    - otherwise restores the session from the state and serves the poll.
+ *      The restored session is attached to its topics quietly and is sent
+ *      the messages published since the last one delivered.
+ *  The state is saved after a poll which left nothing queued for the client
+ *  and expires with the session.
+ *    "lp_state": {"kind": "redis", "config": {"addr": "redis:6379"}}
+ *
+ *  Redis support is compiled with the "redis" build tag.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default prefix of keys in the shared store
+	LP_STATE_DEFAULT_PREFIX = "tinode.lp."
+	// Maximum time to wait for the topics to take a restored session
+	LP_STATE_RESTORE_TIMEOUT = 2 * time.Second
+)
+
+type lpStateConfig struct {
+	// Name of the shared store: "redis"
+	Kind string `json:"kind"`
+	// Configuration of the store
+	Config json.RawMessage `json:"config"`
+	// Prefix of keys, LP_STATE_DEFAULT_PREFIX by default
+	Prefix string `json:"prefix"`
+}
+
+// Key-value store shared by the nodes
+type lpStateStore interface {
+	// open connects to the store
+	open(config json.RawMessage) error
+	// get returns the value of the key or nil if the key does not exist
+	get(key string) ([]byte, error)
+	// set stores the value which expires after ttl
+	set(key string, value []byte, ttl time.Duration) error
+	// del deletes the key
+	del(key string) error
+	// close disconnects from the store
+	close()
+}
+
+var lpStateStores = make(map[string]lpStateStore)
+
+// registerLpStateStore makes the shared store available. Called from init().
+func registerLpStateStore(name string, ss lpStateStore) {
+	if _, dup := lpStateStores[name]; dup {
+		panic("registerLpStateStore: called twice for " + name)
+	}
+	lpStateStores[name] = ss
+}
+
+// State of a long polling session
+type lpSessionState struct {
+	// Node which owns the session
+	Node string
+
+	Uid       types.Uid
+	AuthLvl   int
+	Ver       int
+	UserAgent string
+	DeviceId  string
+	Lang      string
+	Platform  string
+	// Binary encoding of the session, empty for JSON
+	Enc string
+
+	// Topics the session is attached to and the ID of the last message delivered in each
+	Topics map[string]int
+}
+
+var lpState struct {
+	store    lpStateStore
+	prefix   string
+	lifetime time.Duration
+}
+
+// lpStateInit connects to the shared store if configured. Sessions are kept in memory by default.
+func lpStateInit(jsconfig json.RawMessage, lifetime time.Duration) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config lpStateConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse lp_state config:", err)
+	}
+	if config.Kind == "" {
+		return
+	}
+
+	ss := lpStateStores[config.Kind]
+	if ss == nil {
+		logMain.Fatal("lp_state: unknown kind '" + config.Kind + "', the server may be compiled without it")
+	}
+	if err := ss.open(config.Config); err != nil {
+		logMain.Fatal("lp_state: failed to connect:", err)
+	}
+
+	lpState.store = ss
+	lpState.prefix = config.Prefix
+	if lpState.prefix == "" {
+		lpState.prefix = LP_STATE_DEFAULT_PREFIX
+	}
+	lpState.lifetime = lifetime
+
+	logMain.Infof("Long polling sessions are shared over %s", config.Kind)
+}
+
+// lpStateStop disconnects from the shared store.
+func lpStateStop() {
+	if lpState.store != nil {
+		lpState.store.close()
+	}
+}
+
+// lpThisNode returns the name of this node, empty for a standalone server.
+func lpThisNode() string {
+	if globals.cluster == nil {
+		return ""
+	}
+	return globals.cluster.thisNodeName
+}
+
+// lpStateLoad reads the state of the session, nil if it's not found.
+func lpStateLoad(sid string) (*lpSessionState, error) {
+	data, err := lpState.store.get(lpState.prefix + sid)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var state lpSessionState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// lpStateWrite saves the state of the session.
+func lpStateWrite(sid string, state *lpSessionState) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = lpState.store.set(lpState.prefix+sid, data, lpState.lifetime)
+	}
+	if err != nil {
+		logSession.Warnf("sess[%s]: failed to save long polling state: %v", sid, err)
+	}
+}
+
+// lpSessionNode returns the node which owns the long polling session or nil if the poll is served
+// by this node.
+func lpSessionNode(sid string) *ClusterNode {
+	c := globals.cluster
+	if lpState.store == nil {
+		return c.nodeForSession(sid)
+	}
+
+	state, err := lpStateLoad(sid)
+	if err != nil {
+		logSession.Warnf("sess[%s]: failed to load long polling state: %v", sid, err)
+		return c.nodeForSession(sid)
+	}
+	if state == nil {
+		// Not saved yet
+		return c.nodeForSession(sid)
+	}
+	if c == nil || state.Node == c.thisNodeName {
+		return nil
+	}
+	if n := c.nodes[state.Node]; n != nil && c.live[state.Node] {
+		return n
+	}
+	// The owner is gone, the session is restored by this node
+	return nil
+}
+
+// lpDataQueued records the ID of the message queued for the session.
+func (s *Session) lpDataQueued(topic string, seq int) {
+	if lpState.store == nil || s.proto != LPOLL {
+		return
+	}
+
+	s.lpLock.Lock()
+	if s.lpSeq == nil {
+		s.lpSeq = make(map[string]int)
+	}
+	if seq > s.lpSeq[topic] {
+		s.lpSeq[topic] = seq
+	}
+	s.lpLock.Unlock()
+}
+
+// lpStateSave saves the state of the long polling session after a poll. The state is not saved
+// while packets are still queued for the client.
+func (s *Session) lpStateSave() {
+	if lpState.store == nil || s.uid.IsZero() || !s.impersonator.IsZero() || len(s.send) > 0 ||
+		!globals.sessionStore.has(s) {
+		return
+	}
+
+	state := &lpSessionState{
+		Node:      lpThisNode(),
+		Uid:       s.uid,
+		AuthLvl:   s.authLvl,
+		Ver:       s.ver,
+		UserAgent: s.userAgent,
+		DeviceId:  s.deviceId,
+		Lang:      s.lang,
+		Platform:  s.platform,
+		Enc:       frameEncodingName(s.enc),
+		Topics:    make(map[string]int)}
+
+	s.rw.RLock()
+	for name := range s.subs {
+		state.Topics[name] = 0
+	}
+	s.rw.RUnlock()
+
+	s.rlock.Lock()
+	for name := range s.remoteSubs {
+		state.Topics[name] = 0
+	}
+	s.rlock.Unlock()
+
+	s.lpLock.Lock()
+	for name := range state.Topics {
+		state.Topics[name] = s.lpSeq[name]
+	}
+	s.lpLock.Unlock()
+
+	lpStateWrite(s.sid, state)
+}
+
+// lpStateDrop deletes the state of the session which was closed by this node.
+func lpStateDrop(sid string) {
+	if lpState.store == nil {
+		return
+	}
+
+	go func() {
+		state, err := lpStateLoad(sid)
+		if err != nil || state == nil || state.Node != lpThisNode() {
+			// Another node took over the session
+			return
+		}
+		if err = lpState.store.del(lpState.prefix + sid); err != nil {
+			logSession.Warnf("sess[%s]: failed to delete long polling state: %v", sid, err)
+		}
+	}()
+}
+
+// lpOriginal returns the name of the topic as seen by the user of the session.
+func (s *Session) lpOriginal(name string) string {
+	switch {
+	case name == s.uid.UserId():
+		return "me"
+	case name == s.uid.FndName():
+		return "fnd"
+	case strings.HasPrefix(name, "p2p"):
+		if uid1, uid2, err := types.ParseP2P(name); err == nil {
+			if uid1 == s.uid {
+				return uid2.UserId()
+			}
+			return uid1.UserId()
+		}
+	}
+	return name
+}
+
+// lpStateRestore creates the session from the shared state and attaches it to its topics.
+// Returns nil if the state is not found.
+func lpStateRestore(sid string, wrt http.ResponseWriter) *Session {
+	if lpState.store == nil {
+		return nil
+	}
+
+	state, err := lpStateLoad(sid)
+	if err != nil {
+		logSession.Warnf("sess[%s]: failed to load long polling state: %v", sid, err)
+		return nil
+	} else if state == nil {
+		return nil
+	}
+
+	if user, err := store.Users.Get(state.Uid); err != nil || user == nil {
+		// The account is gone or unavailable
+		return nil
+	}
+
+	// Claim the session before attaching it to topics
+	state.Node = lpThisNode()
+	lpStateWrite(sid, state)
+
+	sess := globals.sessionStore.Create(wrt, sid)
+	sess.uid = state.Uid
+	sess.authLvl = state.AuthLvl
+	sess.ver = state.Ver
+	sess.userAgent = state.UserAgent
+	sess.deviceId = state.DeviceId
+	sess.lang = state.Lang
+	sess.platform = state.Platform
+	sess.enc, _ = frameEncodingByName(state.Enc)
+	sess.lpSeq = make(map[string]int, len(state.Topics))
+
+	logSession.Infof("sess[%s]: long polling session of %s restored", sid, state.Uid.UserId())
+
+	now := types.TimeNow()
+	done := make(chan bool, len(state.Topics))
+	waiting := 0
+	for name, seq := range state.Topics {
+		original := sess.lpOriginal(name)
+		sess.lpSeq[name] = seq
+		if globals.cluster.isRemoteTopic(name) {
+			msg := &ClientComMessage{Sub: &MsgClientSub{Topic: original}, from: sess.uid.UserId(), timestamp: now}
+			if err := globals.cluster.routeToTopic(msg, name, sess); err != nil {
+				logSession.Warnf("sess[%s]: failed to attach to '%s': %v", sid, name, err)
+			} else {
+				sess.remoteSubAdd(name, original)
+			}
+			continue
+		}
+
+		join := &sessionJoin{topic: name, pkt: &MsgClientSub{Topic: original}, sess: sess, resumed: done}
+		if hibernatable(name) {
+			// Attach quietly and send the messages missed since the last delivered one
+			join.resume = &hibernatedTopic{original: original, seq: seq}
+		}
+		globals.hub.join <- join
+		waiting++
+	}
+
+	timeout := time.After(LP_STATE_RESTORE_TIMEOUT)
+	for ; waiting > 0; waiting-- {
+		select {
+		case <-done:
+		case <-timeout:
+			logSession.Warnf("sess[%s]: timeout restoring topics", sid)
+			return sess
+		}
+	}
+	return sess
+}
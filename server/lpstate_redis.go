@@ -0,0 +1,79 @@
+// +build redis
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Shared state of long polling sessions in Redis. Each session is a key which expires with the session.
+
+type redisLpStateStore struct {
+	pool *redis.Pool
+}
+
+func init() {
+	registerLpStateStore("redis", &redisLpStateStore{})
+}
+
+func (rs *redisLpStateStore) open(jsconfig json.RawMessage) error {
+	var config struct {
+		// Address of the redis server, host:port
+		Addr     string `json:"addr"`
+		Password string `json:"password"`
+		DB       int    `json:"db"`
+	}
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return err
+		}
+	}
+	if config.Addr == "" {
+		config.Addr = "localhost:6379"
+	}
+	rs.pool = &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.Addr,
+				redis.DialPassword(config.Password),
+				redis.DialDatabase(config.DB))
+		},
+	}
+
+	conn := rs.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func (rs *redisLpStateStore) get(key string) ([]byte, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (rs *redisLpStateStore) set(key string, value []byte, ttl time.Duration) error {
+	conn := rs.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", key, value, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (rs *redisLpStateStore) del(key string) error {
+	conn := rs.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+func (rs *redisLpStateStore) close() {
+	rs.pool.Close()
+}
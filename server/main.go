@@ -13,22 +13,36 @@ import (
 	_ "expvar"
 	"flag"
 	"io/ioutil"
-	"log"
 	"net/http"
-    _ "net/http/pprof"
+	_ "net/http/pprof"
 	"os"
 	"runtime"
 	"strings"
 	"time"
 
+	_ "github.com/tinode/chat/push_apns"
 	_ "github.com/tinode/chat/push_fcm"
+	_ "github.com/tinode/chat/push_webhook"
+	_ "github.com/tinode/chat/push_webpush"
 	_ "github.com/tinode/chat/server/auth_basic"
-    _ "github.com/tinode/chat/server/db/dynamodb"
-    _ "github.com/tinode/chat/server/db/rethinkdb"
+	_ "github.com/tinode/chat/server/auth_oidc"
+	_ "github.com/tinode/chat/server/auth_token"
+	_ "github.com/tinode/chat/server/db/dynamodb"
+	_ "github.com/tinode/chat/server/db/rethinkdb"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	_ "github.com/tinode/chat/server/media/fs"
+	_ "github.com/tinode/chat/server/media/s3"
 	"github.com/tinode/chat/server/push"
 	_ "github.com/tinode/chat/server/push_stdout"
+	"github.com/tinode/chat/server/search"
+	_ "github.com/tinode/chat/server/search/db"
+	_ "github.com/tinode/chat/server/search/elastic"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
+	_ "github.com/tinode/chat/server/validate_email"
+	_ "github.com/tinode/chat/server/validate_tel"
 )
 
 const (
@@ -45,6 +59,9 @@ const (
 	// Default maximum message size
 	MAX_MESSAGE_SIZE = 1 << 19 // 512K
 
+	// Default time allowed for sessions and topics to finish on shutdown
+	DEFAULT_DRAIN_TIMEOUT = 10 * time.Second
+
 	// TODO: Move to config
 	DEFAULT_GROUP_AUTH_ACCESS = types.ModeCPublic
 	DEFAULT_P2P_AUTH_ACCESS   = types.ModeCP2P
@@ -56,18 +73,52 @@ const (
 var buildstamp = ""
 
 var globals struct {
-	hub           *Hub
-	sessionStore  *SessionStore
-	cluster       *Cluster
-	apiKeySalt    []byte
-	indexableTags []string
+	hub          *Hub
+	sessionStore *SessionStore
+	cluster      *Cluster
+	apiKeySalt   []byte
 	// Add Strict-Transport-Security to headers, the value signifies age.
 	// Empty string "" turns it off
 	tlsStrictMaxAge string
-	// Maximum message size allowed from peer.
-	maxMessageSize int64
+	// Path to the config file, re-read on SIGHUP.
+	configFile string
+
+	// Media handler for file uploads, nil if uploads are disabled.
+	mediaHandler media.Handler
+	// Maximum size of an uploaded file.
+	maxFileUploadSize int64
+	// Maximum total size of files uploaded by a single user, 0 for unlimited.
+	fileUserQuota int64
+
+	// Message search handler, nil if search is disabled.
+	searchHandler search.Handler
+
+	// Time allowed for sessions and topics to finish on shutdown.
+	drainTimeout time.Duration
 }
 
+// Loggers of the server modules
+var (
+	logMain       = logs.New("main")
+	logHub        = logs.New("hub")
+	logTopic      = logs.New("topic")
+	logSession    = logs.New("session")
+	logPres       = logs.New("pres")
+	logCluster    = logs.New("cluster")
+	logHttp       = logs.New("http")
+	logPlugins    = logs.New("plugins")
+	logActions    = logs.New("actions")
+	logSearch     = logs.New("search")
+	logDigest     = logs.New("digest")
+	logReminder   = logs.New("reminder")
+	logBots       = logs.New("bots")
+	logScripts    = logs.New("scripts")
+	logScheduled  = logs.New("scheduled")
+	logAudit      = logs.New("audit")
+	logCompliance = logs.New("compliance")
+	logWebhooks   = logs.New("webhooks")
+)
+
 // Contentx of the configuration file
 type configType struct {
 	// Default port to listen on. Either numeric or canonical name, e.g. :80 or :https
@@ -88,10 +139,106 @@ type configType struct {
 	PushConfig    json.RawMessage            `json:"push"`
 	TlsConfig     json.RawMessage            `json:"tls"`
 	AuthConfig    map[string]json.RawMessage `json:"auth_config"`
+	// Read-only web view of published topics
+	WebViewConfig json.RawMessage `json:"web_view"`
+	// File uploads and media handlers
+	MediaConfig json.RawMessage `json:"media"`
+	// Diagnostic logs uploaded by clients
+	ClientLogsConfig json.RawMessage `json:"client_logs"`
+	// Read-only impersonation of users by support staff
+	ImpersonationConfig json.RawMessage `json:"impersonation"`
+	// Periodic digests of group topics
+	DigestConfig json.RawMessage `json:"digest"`
+	// External services called on account, topic and message events
+	PluginsConfig json.RawMessage `json:"plugins"`
+	// Full-text search of messages
+	SearchConfig json.RawMessage `json:"search"`
+	// External endpoints which handle responses to actionable messages
+	ActionsConfig json.RawMessage `json:"actions"`
+	// OpenTelemetry tracing
+	TracingConfig json.RawMessage `json:"tracing"`
+	// Registry of custom message types
+	MsgTypesConfig json.RawMessage `json:"message_types"`
+	// Log levels, format and sinks
+	LogConfig json.RawMessage `json:"logging"`
+	// Bots which receive messages by long polling or at a webhook
+	BotsConfig json.RawMessage `json:"bots"`
+	// Time in seconds allowed for sessions to disconnect and topics to save pending messages on shutdown
+	DrainTimeout int `json:"drain_timeout"`
+	// Role of the server in active-passive deployment across regions
+	RegionConfig json.RawMessage `json:"region"`
+	// Delivery of confirmation codes to email addresses and phone numbers
+	ValidatorsConfig json.RawMessage `json:"validators"`
+	// Detection of topics which fail to shut down
+	TopicWatchdogConfig json.RawMessage `json:"topic_watchdog"`
+	// Memory watermarks for admission control
+	MemoryConfig json.RawMessage `json:"memory"`
+	// Thresholds of CPU and queues for load shedding
+	LoadSheddingConfig json.RawMessage `json:"load_shedding"`
+	// Write-behind of read/recv markers
+	MarkersConfig json.RawMessage `json:"markers"`
+	// Throttling of typing notifications and receipts in group topics
+	NoteThrottleConfig json.RawMessage `json:"note_throttle"`
+	// Write-behind of users' last seen time
+	LastSeenConfig json.RawMessage `json:"last_seen"`
+	// Throttling of failed logins
+	LoginLimitConfig json.RawMessage `json:"login_limit"`
+	// Editing of published messages
+	MessageEditConfig json.RawMessage `json:"message_edit"`
+	// Order of the stages of the publishing pipeline
+	PubPipelineConfig json.RawMessage `json:"publish_pipeline"`
+	// Latency budget of delivering published messages
+	LatencyConfig json.RawMessage `json:"latency_budget"`
+	// Limits of message history queries
+	HistoryLimitConfig json.RawMessage `json:"history_limits"`
+	// Join-by-link invitations to group topics
+	InvitesConfig json.RawMessage `json:"invites"`
+	// Paged membership listings of large topics
+	MembersConfig json.RawMessage `json:"member_pages"`
+	// Maximum number of members of group topics
+	MemberLimitsConfig json.RawMessage `json:"member_limits"`
+	// Templates of group topics and channels
+	TopicTemplatesConfig json.RawMessage `json:"topic_templates"`
+	// Outbound queues of sessions
+	SendQueueConfig json.RawMessage `json:"send_queues"`
+	// Detaching idle sessions from their topics
+	HibernationConfig json.RawMessage `json:"hibernation"`
+	// Configs for WebAssembly message filters
+	WasmFiltersConfig json.RawMessage `json:"wasm_filters"`
+	// Automation scripts attached to topics
+	ScriptsConfig json.RawMessage `json:"scripts"`
+	// Delivery of messages at a later time
+	ScheduledConfig json.RawMessage `json:"scheduled_delivery"`
+	// Disappearing messages
+	EphemeralConfig json.RawMessage `json:"message_ttl"`
+	// Synthetic client sessions probing this node
+	CanaryConfig json.RawMessage `json:"canary"`
+	// Encoder of wire messages: "std" (default), "jsoniter" or "sonic"
+	JsonCodec string `json:"json_codec"`
+	// Long polling sessions shared by cluster nodes
+	LpStateConfig json.RawMessage `json:"lp_state"`
+	// Pushing metrics to StatsD or CloudWatch
+	MetricsConfig json.RawMessage `json:"metrics"`
+	// MQTT bridge for embedded devices
+	MqttConfig json.RawMessage `json:"mqtt"`
+	// Compression of websocket messages
+	WsCompressionConfig json.RawMessage `json:"ws_compression"`
+	// Tamper-evident message history
+	HistoryChainConfig json.RawMessage `json:"history_chain"`
+	// Copies of messages delivered to a compliance endpoint
+	ComplianceConfig json.RawMessage `json:"compliance_journal"`
+	// Anonymous usage statistics, opt-in
+	UsageStatsConfig json.RawMessage `json:"usage_stats"`
+	// Outgoing webhooks on topic events
+	WebhooksConfig json.RawMessage `json:"webhooks"`
+	// Administrative console API
+	AdminConsoleConfig json.RawMessage `json:"admin_console"`
+	// Service accounts which may publish over HTTP
+	RestPublishConfig json.RawMessage `json:"rest_publish"`
 }
 
 func main() {
-	log.Printf("Server v%s:%s pid=%d started with processes: %d", VERSION, buildstamp, os.Getpid(),
+	logMain.Infof("Server v%s:%s pid=%d started with processes: %d", VERSION, buildstamp, os.Getpid(),
 		runtime.GOMAXPROCS(runtime.NumCPU()))
 
 	var configfile = flag.String("config", "./tinode.conf", "Path to config file.")
@@ -102,27 +249,42 @@ func main() {
 	var clusterSelf = flag.String("cluster_self", "", "Override the name of the current cluster node")
 	flag.Parse()
 
-	log.Printf("Using config from: '%s'", *configfile)
+	logMain.Infof("Using config from: '%s'", *configfile)
+	globals.configFile = *configfile
 
 	var config configType
 	if raw, err := ioutil.ReadFile(*configfile); err != nil {
-		log.Fatal(err)
+		logMain.Fatal(err)
 	} else if err = json.Unmarshal(raw, &config); err != nil {
-		log.Fatal(err)
+		logMain.Fatal(err)
+	}
+
+	if err := logs.Init(string(config.LogConfig)); err != nil {
+		logMain.Fatal("Failed to initialize logging:", err)
 	}
 
 	if *listenOn != "" {
 		config.Listen = *listenOn
 	}
 
+	if err := codecInit(config.JsonCodec); err != nil {
+		logMain.Fatal("Failed to initialize JSON codec:", err)
+	}
+
+	stopTracing := tracingInit(config.TracingConfig)
+	defer func() {
+		stopTracing()
+		logMain.Info("Stopped tracing")
+	}()
+
 	var err = store.Open(string(config.StoreConfig))
 	if err != nil {
-		log.Fatal("Failed to connect to DB: ", err)
+		logMain.Fatal("Failed to connect to DB:", err)
 	}
 	defer func() {
 		store.Close()
-		log.Println("Closed database connection(s)")
-		log.Println("All done, good bye")
+		logMain.Info("Closed database connection(s)")
+		logMain.Info("All done, good bye")
 	}()
 
 	for name, jsconf := range config.AuthConfig {
@@ -135,27 +297,107 @@ func main() {
 
 	err = push.Init(string(config.PushConfig))
 	if err != nil {
-		log.Fatal("Failed to initialize push notifications: ", err)
+		logMain.Fatal("Failed to initialize push notifications:", err)
 	}
 	defer func() {
 		push.Stop()
-		log.Println("Stopped push notifications")
+		logMain.Info("Stopped push notifications")
 	}()
 
+	if len(config.ValidatorsConfig) > 0 {
+		if err = validate.Init(string(config.ValidatorsConfig)); err != nil {
+			logMain.Fatal("Failed to initialize validators:", err)
+		}
+	}
+
+	// Priority classes of outbound packets
+	sendQueueInit(config.SendQueueConfig)
+	// Hibernation of idle sessions
+	hibernationInit(config.HibernationConfig)
 	// Keep inactive LP sessions for 15 seconds
 	globals.sessionStore = NewSessionStore(IDLETIMEOUT + 15*time.Second)
+	// Shared state of long polling sessions
+	lpStateInit(config.LpStateConfig, IDLETIMEOUT+15*time.Second)
 	// The hub (the main message router)
 	globals.hub = newHub()
+	// Metrics of topic goroutines and detection of stuck topics
+	topicWatchInit(config.TopicWatchdogConfig)
+	// Memory accounting and admission control
+	memoryInit(config.MemoryConfig)
+	// Load shedding when the node is overloaded
+	sheddingInit(config.LoadSheddingConfig)
+	// Write-behind of read/recv markers
+	markersInit(config.MarkersConfig)
+	// Throttling of typing notifications and receipts
+	noteThrottleInit(config.NoteThrottleConfig)
+	// Write-behind of users' last seen time
+	lastSeenInit(config.LastSeenConfig)
+	// Throttling of failed logins
+	loginLimitInit(config.LoginLimitConfig)
+	// Editing of published messages
+	msgEditInit(config.MessageEditConfig)
+	// Linking of messages by hash
+	historyChainInit(config.HistoryChainConfig)
+	// Journaling of messages for compliance
+	complianceInit(config.ComplianceConfig)
+	// Stages of the publishing pipeline
+	pubPipelineInit(config.PubPipelineConfig)
+	// Latency of the message delivery
+	latencyInit(config.LatencyConfig)
+	// Limits of message history queries
+	historyLimitInit(config.HistoryLimitConfig)
+	// Invite links
+	invitesInit(config.InvitesConfig)
+	// Paged membership listings
+	membersInit(config.MembersConfig)
+	// Group size limits
+	memberLimitsInit(config.MemberLimitsConfig)
+	// Templates of new topics
+	topicTemplatesInit(config.TopicTemplatesConfig)
+
+	// WebAssembly message filters
+	wasmFiltersInit(config.WasmFiltersConfig)
+	// Automation scripts of topics
+	scriptsInit(config.ScriptsConfig)
+	// Scheduled delivery of messages
+	scheduledInit(config.ScheduledConfig)
+	// Deletion of expired messages
+	ephemeralInit(config.EphemeralConfig)
 	// Cluster initialization
 	clusterInit(config.ClusterConfig, clusterSelf)
+	// Operations of the store interrupted by a crash
+	journalRecover()
+	// Primary or standby region
+	regionInit(config.RegionConfig)
+	// Periodic topic digests
+	digestInit(config.DigestConfig)
+	// Delivery of message reminders
+	reminderInit()
+	// Plugins
+	pluginsInit(config.PluginsConfig)
+	// Message search
+	searchInit(config.SearchConfig)
+	// Actionable messages
+	actionsInit(config.ActionsConfig)
+	// Custom message types
+	msgTypesInit(config.MsgTypesConfig)
+	// Server-side queues of bots without persistent connections
+	botsInit(config.BotsConfig)
+	// Callbacks on topic events
+	webhooksInit(config.WebhooksConfig)
+	// Synthetic sessions probing the node
+	canaryInit(config.CanaryConfig, config.Listen)
+	// Metrics pushed to a monitoring system
+	metricsInit(config.MetricsConfig)
+	// Anonymous usage statistics
+	usageStatsInit(config.UsageStatsConfig)
 	// API key validation secret
 	globals.apiKeySalt = config.APIKeySalt
-	// Indexable tags for user discovery
-	globals.indexableTags = config.IndexableTags
-	// Maximum message size
-	globals.maxMessageSize = int64(config.MaxMessageSize)
-	if globals.maxMessageSize <= 0 {
-		globals.maxMessageSize = MAX_MESSAGE_SIZE
+	// Indexable tags for user discovery and maximum message size
+	setLiveSettings(&config)
+	globals.drainTimeout = time.Duration(config.DrainTimeout) * time.Second
+	if globals.drainTimeout <= 0 {
+		globals.drainTimeout = DEFAULT_DRAIN_TIMEOUT
 	}
 
 	// Serve static content from the directory in -static_data flag if that's
@@ -166,7 +408,7 @@ func main() {
 	if staticContent == "" {
 		path, err := os.Getwd()
 		if err != nil {
-			log.Fatal(err)
+			logMain.Fatal(err)
 		}
 		staticContent = path + "/static/"
 	}
@@ -182,18 +424,47 @@ func main() {
 		}
 	}
 	http.Handle(static_mount, http.StripPrefix(static_mount, hstsHandler(http.FileServer(http.Dir(staticContent)))))
-	log.Printf("Serving static content from '%s' at '%s'", staticContent, static_mount)
+	logMain.Infof("Serving static content from '%s' at '%s'", staticContent, static_mount)
 
 	// Streaming channels
 	// Handle websocket clients. WS must come up first, so reconnecting clients won't fall back to LP
+	upgrader.Subprotocols = websocketSubprotocols()
+	wsCompressionInit(config.WsCompressionConfig)
 	http.HandleFunc("/v0/channels", serveWebSocket)
 	// Handle long polling clients
 	http.HandleFunc("/v0/channels/lp", serveLongPoll)
+	// Handle Server-Sent Events clients
+	http.HandleFunc("/v0/channels/sse", serveSSE)
+	// Accept MQTT clients, if enabled
+	mqttInit(config.MqttConfig)
+	// Serve read-only web view of published topics, if enabled
+	webViewInit(config.WebViewConfig)
+	// Handle file uploads and downloads, if enabled
+	mediaInit(config.MediaConfig)
+	// Uploads of diagnostic logs by clients, if enabled
+	clientLogsInit(config.ClientLogsConfig)
+	// Impersonation of users by root admins, if enabled
+	impersonationInit(config.ImpersonationConfig)
+	// Account registration and credential validation over HTTP
+	accInit()
+	// Export of events in iCalendar format
+	http.HandleFunc(EVENT_ICS_PATH, serveEventIcs)
+	// Consistency check of the store by root admins
+	http.HandleFunc(ADMIN_FSCK_PATH, serveFsck)
+	http.HandleFunc(ADMIN_LEAVE_PATH, serveLeaveAll)
+	// Provisioning of group topics by external systems
+	http.HandleFunc(ADMIN_PROVISION_PATH, serveProvision)
+	// IDs of users and topics in external systems
+	http.HandleFunc(ADMIN_EXTERNAL_PATH, serveExternalId)
+	// Publishing by backend services over HTTP
+	restPubInit(config.RestPublishConfig)
+	// Operator console on its own listener, if configured
+	adminConsoleInit(config.AdminConsoleConfig)
 	// Serve json-formatted 404 for all other URLs
 	http.HandleFunc("/", serve404)
 
 	if err := listenAndServe(config.Listen, *tlsEnabled, string(config.TlsConfig), signalHandler()); err != nil {
-		log.Fatal(err)
+		logMain.Fatal(err)
 	}
 }
 
@@ -0,0 +1,228 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Write-behind of read and received markers. Every {note what="read"} or
+ *  {note what="recv"} used to update the subscription in the database.
+ *  Clients send them for every message, so markers are now collected in
+ *  memory: only the latest values per topic and user are written, on a
+ *  timer or when too many are pending. The markers of a topic are written
+ *  when the topic stops, and all of them on shutdown.
+ *
+ *  Topics keep the current values in perUser, so only reads of
+ *  subscriptions from the database may be behind by up to flush_interval.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default interval between writes of pending markers
+	MARKERS_FLUSH_INTERVAL = 2 * time.Second
+	// Default number of pending markers which triggers a write
+	MARKERS_MAX_PENDING = 1024
+)
+
+type markersConfig struct {
+	// Write every marker immediately
+	Disabled bool `json:"disabled"`
+	// Interval between writes in milliseconds
+	FlushInterval int `json:"flush_interval"`
+	// Write when so many subscriptions have pending markers
+	MaxPending int `json:"max_pending"`
+}
+
+type markerKey struct {
+	topic string
+	uid   types.Uid
+}
+
+type markerVal struct {
+	recv int
+	read int
+}
+
+var markers struct {
+	sync.Mutex
+	pending map[markerKey]markerVal
+	// Keeps the order of writes of the same markers
+	writeLock sync.Mutex
+
+	disabled   bool
+	maxPending int
+	// Signal to write the markers now
+	flush chan bool
+	// Stops the writer
+	stop chan chan bool
+
+	// Exported as Markers in expvar
+	updates *expvar.Int
+	writes  *expvar.Int
+	failed  *expvar.Int
+}
+
+// markersInit starts the writer of pending markers.
+func markersInit(jsconfig json.RawMessage) {
+	var config markersConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse markers config:", err)
+		}
+	}
+
+	markers.updates = new(expvar.Int)
+	markers.writes = new(expvar.Int)
+	markers.failed = new(expvar.Int)
+	vars := new(expvar.Map).Init()
+	vars.Set("updates", markers.updates)
+	vars.Set("writes", markers.writes)
+	vars.Set("failed", markers.failed)
+	vars.Set("pending", expvar.Func(func() interface{} {
+		markers.Lock()
+		defer markers.Unlock()
+		return len(markers.pending)
+	}))
+	expvar.Publish("Markers", vars)
+
+	markers.disabled = config.Disabled
+	if markers.disabled {
+		return
+	}
+
+	interval := time.Duration(config.FlushInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = MARKERS_FLUSH_INTERVAL
+	}
+	markers.maxPending = config.MaxPending
+	if markers.maxPending <= 0 {
+		markers.maxPending = MARKERS_MAX_PENDING
+	}
+	markers.pending = make(map[markerKey]markerVal)
+	markers.flush = make(chan bool, 1)
+	markers.stop = make(chan chan bool)
+
+	memRegisterCache("markers", func() int64 {
+		markers.Lock()
+		defer markers.Unlock()
+		// Key, value and the overhead of the map
+		return int64(len(markers.pending)) * 96
+	})
+
+	go markersWriter(interval)
+}
+
+func markersWriter(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			markersFlush(nil)
+		case <-markers.flush:
+			markersFlush(nil)
+		case done := <-markers.stop:
+			markersFlush(nil)
+			done <- true
+			return
+		}
+	}
+}
+
+// markersUpdate saves user's read and received markers of the topic. Called by the topic goroutine.
+func markersUpdate(topic string, uid types.Uid, recv, read int) error {
+	markers.updates.Add(1)
+
+	if markers.disabled {
+		return markersWrite(topic, uid, markerVal{recv: recv, read: read})
+	}
+
+	markers.Lock()
+	markers.pending[markerKey{topic, uid}] = markerVal{recv: recv, read: read}
+	full := len(markers.pending) >= markers.maxPending
+	markers.Unlock()
+
+	if full {
+		select {
+		case markers.flush <- true:
+		default:
+			// Write already requested
+		}
+	}
+	return nil
+}
+
+// markersPending returns markers not written yet.
+func markersPending(topic string, uid types.Uid) (recv, read int, ok bool) {
+	if markers.disabled {
+		return
+	}
+	markers.Lock()
+	val, ok := markers.pending[markerKey{topic, uid}]
+	markers.Unlock()
+	return val.recv, val.read, ok
+}
+
+// markersFlushTopic writes pending markers of one topic, e.g. when the topic stops.
+func markersFlushTopic(topic string) {
+	if markers.disabled {
+		return
+	}
+	markersFlush(func(key markerKey) bool { return key.topic == topic })
+}
+
+// markersFlush writes pending markers which match the filter, all if the filter is nil.
+func markersFlush(filter func(markerKey) bool) {
+	markers.writeLock.Lock()
+	defer markers.writeLock.Unlock()
+
+	markers.Lock()
+	batch := markers.pending
+	if filter == nil {
+		markers.pending = make(map[markerKey]markerVal, len(batch))
+	} else {
+		batch = make(map[markerKey]markerVal)
+		for key, val := range markers.pending {
+			if filter(key) {
+				batch[key] = val
+				delete(markers.pending, key)
+			}
+		}
+	}
+	markers.Unlock()
+
+	for key, val := range batch {
+		if err := markersWrite(key.topic, key.uid, val); err != nil {
+			markers.failed.Add(1)
+			logTopic.Errorf("topic[%s]: failed to update SeqRead/Recv counter: %v", key.topic, err)
+		}
+	}
+}
+
+func markersWrite(topic string, uid types.Uid, val markerVal) error {
+	markers.writes.Add(1)
+	return store.Subs.Update(topic, uid,
+		map[string]interface{}{
+			"RecvSeqId": val.recv,
+			"ReadSeqId": val.read})
+}
+
+// markersStop writes all pending markers and stops the writer.
+func markersStop() {
+	if markers.disabled || markers.stop == nil {
+		return
+	}
+	done := make(chan bool)
+	markers.stop <- done
+	<-done
+}
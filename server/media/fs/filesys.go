@@ -0,0 +1,77 @@
+// Package fs implements media interface by storing media objects in a single
+// directory in the file system.
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	handlerName = "fs"
+
+	// Default directory to store uploaded files in
+	defaultUploadDir = "uploads"
+)
+
+type configType struct {
+	FileUploadDirectory string `json:"upload_dir"`
+}
+
+type fshandler struct {
+	fileUploadLocation string
+}
+
+// Init initializes the media handler.
+func (fh *fshandler) Init(jsconf string) error {
+	var config configType
+	if jsconf != "" {
+		if err := json.Unmarshal([]byte(jsconf), &config); err != nil {
+			return errors.New("failed to parse config: " + err.Error())
+		}
+	}
+
+	fh.fileUploadLocation = config.FileUploadDirectory
+	if fh.fileUploadLocation == "" {
+		fh.fileUploadLocation = defaultUploadDir
+	}
+	return os.MkdirAll(fh.fileUploadLocation, 0777)
+}
+
+// Upload saves the file to disk under the name of the file ID.
+func (fh *fshandler) Upload(fdef *types.FileDef, file io.Reader) (string, error) {
+	location := filepath.Join(fh.fileUploadLocation, fdef.Id)
+
+	outfile, err := os.Create(location)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = io.Copy(outfile, file); err != nil {
+		outfile.Close()
+		os.Remove(location)
+		return "", err
+	}
+
+	if err = outfile.Close(); err != nil {
+		os.Remove(location)
+		return "", err
+	}
+
+	return location, nil
+}
+
+// Download opens the file for reading.
+func (fh *fshandler) Download(location string) (io.ReadCloser, error) {
+	return os.Open(location)
+}
+
+func init() {
+	media.Register(handlerName, &fshandler{})
+}
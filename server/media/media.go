@@ -0,0 +1,44 @@
+package media
+
+// Interfaces for storing media files uploaded by clients
+
+import (
+	"io"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Handler is an interface which must be implemented by media handlers (uploaders-downloaders).
+type Handler interface {
+	// Init initializes the media handler.
+	Init(jsconf string) error
+
+	// Upload processes request for file upload. Returns internal location of the file
+	// which is later passed to Download.
+	Upload(fdef *types.FileDef, file io.Reader) (string, error)
+
+	// Download returns content of the file stored at the given location.
+	Download(location string) (io.ReadCloser, error)
+}
+
+var handlers map[string]Handler
+
+// Register a media handler
+func Register(name string, hnd Handler) {
+	if handlers == nil {
+		handlers = make(map[string]Handler)
+	}
+
+	if hnd == nil {
+		panic("Register: media handler is nil")
+	}
+	if _, dup := handlers[name]; dup {
+		panic("Register: called twice for handler " + name)
+	}
+	handlers[name] = hnd
+}
+
+// GetHandler returns a registered handler by name or nil if the handler is not found.
+func GetHandler(name string) Handler {
+	return handlers[name]
+}
@@ -0,0 +1,92 @@
+// Package s3 implements media interface by storing media objects in Amazon S3 bucket.
+package s3
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	handlerName = "s3"
+)
+
+type configType struct {
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Region          string `json:"region"`
+	BucketName      string `json:"bucket"`
+}
+
+type awshandler struct {
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+	conf     configType
+}
+
+// Init initializes the media handler.
+func (ah *awshandler) Init(jsconf string) error {
+	if err := json.Unmarshal([]byte(jsconf), &ah.conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if ah.conf.Region == "" {
+		return errors.New("missing region")
+	}
+	if ah.conf.BucketName == "" {
+		return errors.New("missing bucket")
+	}
+
+	awsconf := &aws.Config{Region: aws.String(ah.conf.Region)}
+	if ah.conf.AccessKeyId != "" {
+		// Otherwise use the default credential chain: environment, shared config or instance role.
+		awsconf.Credentials = credentials.NewStaticCredentials(ah.conf.AccessKeyId, ah.conf.SecretAccessKey, "")
+	}
+	sess, err := session.NewSession(awsconf)
+	if err != nil {
+		return err
+	}
+
+	ah.svc = s3.New(sess)
+	ah.uploader = s3manager.NewUploader(sess)
+	return nil
+}
+
+// Upload stores the file in the bucket under the name of the file ID.
+func (ah *awshandler) Upload(fdef *types.FileDef, file io.Reader) (string, error) {
+	_, err := ah.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(ah.conf.BucketName),
+		Key:         aws.String(fdef.Id),
+		Body:        file,
+		ContentType: aws.String(fdef.MimeType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return fdef.Id, nil
+}
+
+// Download fetches the object from the bucket.
+func (ah *awshandler) Download(location string) (io.ReadCloser, error) {
+	result, err := ah.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(ah.conf.BucketName),
+		Key:    aws.String(location),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+func init() {
+	media.Register(handlerName, &awshandler{})
+}
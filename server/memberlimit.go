@@ -0,0 +1,89 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Limits of the number of subscribers of group topics. Large groups slow
+ *  down presence fan-out for everyone on the node. New subscriptions to a
+ *  group topic which already has as many members as allowed are rejected
+ *  with {ctrl code=409 text="topic is full" params={limit}}; this applies to
+ *  joining by {sub}, by an invite link and to invitations by admins.
+ *  Existing members are never removed when the limit is lowered. Banned
+ *  users are not counted. Channels are not limited.
+ *
+ *  The limit of a topic is the global default unless root sets an override
+ *  with {set desc={maxmem: N}}, 0 removes the override. Neither can exceed
+ *  the server-wide cap.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+type memberLimitsConfig struct {
+	// Maximum number of members of a group topic without an override, 0 - unlimited
+	Default int `json:"default"`
+	// Maximum number of members of any group topic, 0 - no cap
+	Cap int `json:"cap"`
+}
+
+var memberLimits struct {
+	def int
+	cap int
+}
+
+// memberLimitsInit parses config. Topics are not limited by default.
+func memberLimitsInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config memberLimitsConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse member_limits config:", err)
+	}
+	if config.Default < 0 || config.Cap < 0 {
+		logMain.Fatal("member_limits: negative limit")
+	}
+
+	memberLimits.def = config.Default
+	memberLimits.cap = config.Cap
+
+	logMain.Infof("Group topics are limited to %d members by default, %d at most", memberLimits.def,
+		memberLimits.cap)
+}
+
+// memberLimit returns the maximum number of members of the topic, 0 if unlimited.
+func (t *Topic) memberLimit() int {
+	if t.cat != types.TopicCat_Grp {
+		return 0
+	}
+	limit := memberLimits.def
+	if t.maxMembers > 0 {
+		limit = t.maxMembers
+	}
+	if memberLimits.cap > 0 && (limit == 0 || limit > memberLimits.cap) {
+		limit = memberLimits.cap
+	}
+	return limit
+}
+
+// isFull checks if the topic cannot take one more member. Returns the limit.
+func (t *Topic) isFull() (int, bool) {
+	limit := t.memberLimit()
+	if limit == 0 {
+		return 0, false
+	}
+
+	count := 0
+	for uid := range t.perUser {
+		if !t.isBanned(uid) {
+			count++
+		}
+	}
+	return limit, count >= limit
+}
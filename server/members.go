@@ -0,0 +1,295 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Membership listings of large group topics and channels. Subscribers of
+ *  topics with more members than the threshold are returned by
+ *  {get what="sub"} in pages ordered by user ID, without Public. The client
+ *  requests the next page with sub={after: "usr..."} using the cursor from
+ *  {meta next}, and fetches profiles of the members it actually displays
+ *  with {get what="profiles" profiles={users: [...]}}. Profiles are served
+ *  from an in-process cache of users' Public.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of members in one page
+	MEMBERS_DEFAULT_PAGE_SIZE = 100
+	// Maximum number of members in one page
+	MEMBERS_MAX_PAGE_SIZE = 1000
+	// Maximum number of profiles in one request
+	PROFILES_MAX_BATCH = 100
+	// Default number of cached profiles
+	PROFILES_DEFAULT_CACHE_SIZE = 10000
+	// Default time a cached profile is served before it's reloaded
+	PROFILES_DEFAULT_TTL = 5 * time.Minute
+)
+
+type membersConfig struct {
+	// Topics with more subscribers than this are listed in pages, 0 disables paging
+	Threshold int `json:"threshold"`
+	// Number of members in one page
+	PageSize int `json:"page_size"`
+	// Number of users' profiles cached in memory
+	CacheSize int `json:"cache_size"`
+	// Time in seconds a cached profile is served before it's reloaded from the database
+	CacheTtl int `json:"cache_ttl"`
+}
+
+// Cached Public of one user
+type profileEntry struct {
+	uid    types.Uid
+	public interface{}
+	loaded time.Time
+}
+
+var members struct {
+	threshold int
+	pageSize  int
+
+	// LRU cache of profiles
+	lock      sync.Mutex
+	ll        *list.List
+	profiles  map[types.Uid]*list.Element
+	cacheSize int
+	ttl       time.Duration
+
+	// Exported as MemberPages in expvar
+	pages  *expvar.Int
+	hits   *expvar.Int
+	misses *expvar.Int
+}
+
+// membersInit parses config and publishes the metrics. Paging is off by default.
+func membersInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config membersConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse member_pages config:", err)
+	}
+	if config.Threshold <= 0 {
+		return
+	}
+
+	members.threshold = config.Threshold
+	members.pageSize = config.PageSize
+	if members.pageSize <= 0 {
+		members.pageSize = MEMBERS_DEFAULT_PAGE_SIZE
+	} else if members.pageSize > MEMBERS_MAX_PAGE_SIZE {
+		members.pageSize = MEMBERS_MAX_PAGE_SIZE
+	}
+	members.cacheSize = config.CacheSize
+	if members.cacheSize <= 0 {
+		members.cacheSize = PROFILES_DEFAULT_CACHE_SIZE
+	}
+	members.ttl = time.Duration(config.CacheTtl) * time.Second
+	if members.ttl <= 0 {
+		members.ttl = PROFILES_DEFAULT_TTL
+	}
+	members.ll = list.New()
+	members.profiles = make(map[types.Uid]*list.Element)
+
+	members.pages = new(expvar.Int)
+	members.hits = new(expvar.Int)
+	members.misses = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("pages", members.pages)
+	vars.Set("profile_hits", members.hits)
+	vars.Set("profile_misses", members.misses)
+	expvar.Publish("MemberPages", vars)
+
+	logMain.Infof("Members of topics with over %d subscribers are listed in pages of %d", members.threshold,
+		members.pageSize)
+}
+
+// membersPaged checks if subscribers of the topic are listed in pages.
+func (t *Topic) membersPaged() bool {
+	return members.threshold > 0 && (t.cat == types.TopicCat_Grp || t.cat == types.TopicCat_Chn) &&
+		len(t.perUser) > members.threshold
+}
+
+// membersPage loads one page of subscriptions without Public. Returns the cursor of the next page
+// or an empty string if it's the last page.
+func (t *Topic) membersPage(opts *MsgGetOpts) ([]types.Subscription, string, error) {
+	subs, err := store.Topics.GetSubsAny(t.name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var after string
+	limit := members.pageSize
+	if opts != nil {
+		after = opts.After
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	if after != "" {
+		// Cursor is a user ID as seen by clients
+		if uid := types.ParseUserId(after); !uid.IsZero() {
+			after = uid.String()
+		}
+	}
+
+	sort.Slice(subs, func(i, j int) bool { return subs[i].User < subs[j].User })
+	start := sort.Search(len(subs), func(i int) bool { return subs[i].User > after })
+	subs = subs[start:]
+
+	var next string
+	if len(subs) > limit {
+		subs = subs[:limit]
+		next = types.ParseUid(subs[limit-1].User).UserId()
+	}
+	members.pages.Add(1)
+	return subs, next, nil
+}
+
+// profilesGet returns Public of the users, from cache where possible.
+func profilesGet(uids []types.Uid) ([]MsgProfile, error) {
+	now := time.Now()
+	result := make([]MsgProfile, 0, len(uids))
+	var missing []types.Uid
+
+	members.lock.Lock()
+	for _, uid := range uids {
+		if elem, ok := members.profiles[uid]; ok {
+			entry := elem.Value.(*profileEntry)
+			if now.Sub(entry.loaded) < members.ttl {
+				members.ll.MoveToFront(elem)
+				result = append(result, MsgProfile{User: uid.UserId(), Public: entry.public})
+				continue
+			}
+		}
+		missing = append(missing, uid)
+	}
+	members.lock.Unlock()
+
+	members.hits.Add(int64(len(result)))
+	if len(missing) == 0 {
+		return result, nil
+	}
+	members.misses.Add(int64(len(missing)))
+
+	users, err := store.Users.GetAll(missing...)
+	if err != nil {
+		return nil, err
+	}
+
+	members.lock.Lock()
+	defer members.lock.Unlock()
+
+	for i := range users {
+		uid := types.ParseUid(users[i].Id)
+		result = append(result, MsgProfile{User: uid.UserId(), Public: users[i].Public})
+
+		entry := &profileEntry{uid: uid, public: users[i].Public, loaded: now}
+		if elem, ok := members.profiles[uid]; ok {
+			elem.Value = entry
+			members.ll.MoveToFront(elem)
+		} else {
+			members.profiles[uid] = members.ll.PushFront(entry)
+		}
+	}
+	for members.ll.Len() > members.cacheSize {
+		back := members.ll.Back()
+		members.ll.Remove(back)
+		delete(members.profiles, back.Value.(*profileEntry).uid)
+	}
+	return result, nil
+}
+
+// profileInvalidate drops the cached profile of the user after the user changed Public.
+func profileInvalidate(uid types.Uid) {
+	if members.profiles == nil {
+		return
+	}
+
+	members.lock.Lock()
+	defer members.lock.Unlock()
+
+	if elem, ok := members.profiles[uid]; ok {
+		members.ll.Remove(elem)
+		delete(members.profiles, uid)
+	}
+}
+
+// replyGetProfiles returns Public of the topic's members in response to {get what="profiles"}.
+func (t *Topic) replyGetProfiles(sess *Session, id string, req *MsgGetProfiles) error {
+	now := types.TimeNow()
+	original := t.original(sess.uid)
+
+	if t.cat != types.TopicCat_Grp && t.cat != types.TopicCat_Chn {
+		sess.queueOut(ErrPermissionDenied(id, original, now))
+		return errors.New("profiles requested for a non-group topic")
+	}
+	if req == nil || len(req.Users) == 0 || len(req.Users) > PROFILES_MAX_BATCH {
+		sess.queueOut(ErrMalformed(id, original, now))
+		return errors.New("invalid profiles request")
+	}
+
+	pud := t.perUser[sess.uid]
+	mode := pud.modeGiven & pud.modeWant
+	if !mode.IsJoiner() {
+		sess.queueOut(ErrPermissionDenied(id, original, now))
+		return errors.New("profiles requested by non-member")
+	}
+	// Readers of a channel don't see other readers, only the topic's staff
+	staffOnly := t.cat == types.TopicCat_Chn && !mode.IsSharer() && !mode.IsModerator()
+
+	uids := make([]types.Uid, 0, len(req.Users))
+	for _, user := range req.Users {
+		uid := types.ParseUserId(user)
+		if uid.IsZero() {
+			sess.queueOut(ErrMalformed(id, original, now))
+			return errors.New("invalid user id in profiles request")
+		}
+		// Profiles of members only
+		if member, ok := t.perUser[uid]; ok && (!staffOnly || uid == sess.uid ||
+			member.modeGiven.IsAdmin() || member.modeGiven.IsWriter()) {
+			uids = append(uids, uid)
+		}
+	}
+
+	var profiles []MsgProfile
+	if len(uids) > 0 {
+		var err error
+		if members.profiles != nil {
+			profiles, err = profilesGet(uids)
+		} else {
+			var users []types.User
+			if users, err = store.Users.GetAll(uids...); err == nil {
+				for i := range users {
+					profiles = append(profiles, MsgProfile{User: types.ParseUid(users[i].Id).UserId(),
+						Public: users[i].Public})
+				}
+			}
+		}
+		if err != nil {
+			sess.queueOut(ErrUnknown(id, original, now))
+			return err
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{Id: id, Topic: original, Timestamp: &now,
+		Profiles: profiles}})
+	return nil
+}
@@ -0,0 +1,207 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Approximate accounting of memory held by loaded topics, outbound queues
+ *  of sessions and caches. When the total goes above the high watermark,
+ *  the server refuses to load more topics with a retryable 503 error and
+ *  disconnects sessions idle for longer than idle_session. The limits are
+ *  lifted when the total drops below the low watermark.
+ *
+ *  The numbers are estimates, not measurements: they are meant to keep the
+ *  server from being killed for running out of memory during traffic spikes.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Estimated memory of a loaded topic without subscribers
+	MEM_TOPIC_SIZE = 8 * 1024
+	// Estimated memory of one subscriber of a loaded topic
+	MEM_SUBSCRIBER_SIZE = 512
+	// Estimated memory of one contact of a loaded 'me' topic
+	MEM_CONTACT_SIZE = 256
+	// Initial estimate of an outbound message
+	MEM_MESSAGE_SIZE = 512
+
+	// Interval between checks of the watermarks
+	MEM_CHECK_INTERVAL = time.Second
+	// Sessions idle for this long are disconnected when the memory is short
+	MEM_DEFAULT_IDLE_SESSION = 5 * time.Minute
+)
+
+type memoryConfig struct {
+	// Limit in megabytes above which topics are not loaded and idle sessions are disconnected.
+	// 0 disables admission control.
+	HighWatermark int64 `json:"high_watermark"`
+	// The limits are lifted below this value in megabytes, default 90% of high_watermark
+	LowWatermark int64 `json:"low_watermark"`
+	// Sessions idle for this many seconds may be disconnected
+	IdleSession int `json:"idle_session"`
+}
+
+var memory struct {
+	high int64
+	low  int64
+	idle time.Duration
+
+	// 1 if above the high watermark and not yet below the low one
+	over int32
+	// Moving average of the size of outbound messages
+	msgSize int64
+
+	cacheLock sync.Mutex
+	caches    map[string]func() int64
+
+	// Exported as Memory in expvar
+	topics  *expvar.Int
+	queues  *expvar.Int
+	cached  *expvar.Int
+	total   *expvar.Int
+	refused *expvar.Int
+	shed    *expvar.Int
+}
+
+// memoryInit publishes the metrics and starts the watermark checks.
+func memoryInit(jsconfig json.RawMessage) {
+	var config memoryConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse memory config:", err)
+		}
+	}
+
+	memory.high = config.HighWatermark << 20
+	memory.low = config.LowWatermark << 20
+	if memory.low <= 0 || memory.low > memory.high {
+		memory.low = memory.high / 10 * 9
+	}
+	memory.idle = time.Duration(config.IdleSession) * time.Second
+	if memory.idle <= 0 {
+		memory.idle = MEM_DEFAULT_IDLE_SESSION
+	}
+	atomic.StoreInt64(&memory.msgSize, MEM_MESSAGE_SIZE)
+
+	memory.topics = new(expvar.Int)
+	memory.queues = new(expvar.Int)
+	memory.cached = new(expvar.Int)
+	memory.total = new(expvar.Int)
+	memory.refused = new(expvar.Int)
+	memory.shed = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("topics", memory.topics)
+	vars.Set("queues", memory.queues)
+	vars.Set("caches", memory.cached)
+	vars.Set("total", memory.total)
+	vars.Set("topics_refused", memory.refused)
+	vars.Set("sessions_shed", memory.shed)
+	vars.Set("over_watermark", expvar.Func(func() interface{} { return memOverWatermark() }))
+	expvar.Publish("Memory", vars)
+
+	memRegisterCache("time_zones", notifyZonesSize)
+	memRegisterCache("store", store.CacheMemSize)
+	memRegisterCache("recent_messages", store.RecentMemSize)
+
+	go func() {
+		for range time.Tick(MEM_CHECK_INTERVAL) {
+			memCheck()
+		}
+	}()
+
+	if memory.high > 0 {
+		logMain.Infof("Memory admission control: high watermark %dMB, low watermark %dMB",
+			memory.high>>20, memory.low>>20)
+	}
+}
+
+// memRegisterCache adds a cache to the accounting. The function returns the estimated size of the cache in bytes.
+func memRegisterCache(name string, size func() int64) {
+	memory.cacheLock.Lock()
+	if memory.caches == nil {
+		memory.caches = make(map[string]func() int64)
+	}
+	memory.caches[name] = size
+	memory.cacheLock.Unlock()
+}
+
+// memTopicSize estimates the memory held by the topic. Called by the topic goroutine when it starts
+// and when its subscribers change.
+func memTopicSize(t *Topic) int64 {
+	return int64(MEM_TOPIC_SIZE + len(t.perUser)*MEM_SUBSCRIBER_SIZE + len(t.perSubs)*MEM_CONTACT_SIZE)
+}
+
+// memMessageQueued updates the average size of outbound messages.
+func memMessageQueued(size int) {
+	// Exponential moving average with a weight of 1/64, races only make the estimate less precise
+	avg := atomic.LoadInt64(&memory.msgSize)
+	atomic.StoreInt64(&memory.msgSize, avg+(int64(size)-avg)/64)
+}
+
+// memOverWatermark checks if the server should refuse work.
+func memOverWatermark() bool {
+	return atomic.LoadInt32(&memory.over) == 1
+}
+
+// memCheck recalculates the memory estimate and sheds load when the memory is short.
+func memCheck() {
+	topics := topicWatchMemory()
+	queues := int64(globals.sessionStore.queuedMessages()) * atomic.LoadInt64(&memory.msgSize)
+
+	var cached int64
+	memory.cacheLock.Lock()
+	for _, size := range memory.caches {
+		cached += size()
+	}
+	memory.cacheLock.Unlock()
+
+	total := topics + queues + cached
+	memory.topics.Set(topics)
+	memory.queues.Set(queues)
+	memory.cached.Set(cached)
+	memory.total.Set(total)
+
+	if memory.high <= 0 {
+		return
+	}
+
+	if total > memory.high {
+		if atomic.CompareAndSwapInt32(&memory.over, 0, 1) {
+			logMain.Warnf("Memory estimate %dMB is above the high watermark, refusing new topics", total>>20)
+		}
+	} else if total < memory.low {
+		if atomic.CompareAndSwapInt32(&memory.over, 1, 0) {
+			logMain.Infof("Memory estimate %dMB is below the low watermark, accepting new topics", total>>20)
+		}
+	}
+
+	if memOverWatermark() {
+		now := time.Now().UTC().Round(time.Millisecond)
+		if count := globals.sessionStore.StopIdle(memory.idle, ErrServiceUnavailable("", "", now)); count > 0 {
+			memory.shed.Add(int64(count))
+			logMain.Warnf("Memory is short, disconnected %d idle sessions", count)
+		}
+	}
+}
+
+// memRefuseTopic checks if the topic may be loaded. If not, the session is told to retry later.
+func memRefuseTopic(sreg *sessionJoin) bool {
+	if !memOverWatermark() {
+		return false
+	}
+	memory.refused.Add(1)
+	sreg.sess.queueOut(ErrServiceUnavailable(sreg.pkt.Id, sreg.pkt.Topic, types.TimeNow()))
+	return true
+}
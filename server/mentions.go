@@ -0,0 +1,116 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Mentions of users in published messages. A message mentions users listed
+ *  in {pub mentions=[...]}, in head.mentions as a comma-separated list, or,
+ *  if neither is given, in the Drafty content as entities of type "MN"
+ *  with a user ID as the value. The topic keeps only mentions of its
+ *  subscribers and stores them in head.mentions.
+ *
+ *  Mentioned users receive push notifications even if they muted the topic
+ *  and can fetch the messages which mention them with
+ *  {get what="data" data={mentions=true}}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum number of users mentioned in one message
+const MENTIONS_MAX = 64
+
+// mentionsOf returns the IDs of users listed in head.mentions.
+func mentionsOf(head map[string]string) []string {
+	var ids []string
+	for _, id := range strings.Split(head["mentions"], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// mentionsDrafty returns the user IDs mentioned in Drafty content as {"tp": "MN", "data": {"val": "usr..."}}.
+func mentionsDrafty(content interface{}) []string {
+	drafty, ok := content.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	ents, _ := drafty["ent"].([]interface{})
+
+	var ids []string
+	for _, ent := range ents {
+		ent, _ := ent.(map[string]interface{})
+		if tp, _ := ent["tp"].(string); tp != "MN" {
+			continue
+		}
+		data, _ := ent["data"].(map[string]interface{})
+		if val, _ := data["val"].(string); val != "" {
+			ids = append(ids, val)
+		}
+	}
+	return ids
+}
+
+// mentionsNormalize replaces head.mentions of the message with the list of mentioned subscribers
+// of the topic. The sender is never mentioned.
+func (t *Topic) mentionsNormalize(data *MsgServerData, from types.Uid) {
+	ids := mentionsOf(data.Head)
+	if len(ids) == 0 {
+		ids = mentionsDrafty(data.Content)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	seen := make(map[types.Uid]bool, len(ids))
+	var valid []string
+	for _, id := range ids {
+		uid := types.ParseUserId(id)
+		if uid.IsZero() || uid == from || seen[uid] {
+			continue
+		}
+		if _, ok := t.perUser[uid]; !ok {
+			continue
+		}
+		seen[uid] = true
+		valid = append(valid, uid.UserId())
+		if len(valid) == MENTIONS_MAX {
+			break
+		}
+	}
+
+	// The head may be shared with the sender's {pub}
+	head := make(map[string]string, len(data.Head)+1)
+	for key, val := range data.Head {
+		head[key] = val
+	}
+	if len(valid) > 0 {
+		head["mentions"] = strings.Join(valid, ",")
+	} else {
+		delete(head, "mentions")
+	}
+	if len(head) == 0 {
+		head = nil
+	}
+	data.Head = head
+}
+
+// mentionedUsers returns the set of users mentioned in the message.
+func mentionedUsers(data *MsgServerData) map[types.Uid]bool {
+	ids := mentionsOf(data.Head)
+	if len(ids) == 0 {
+		return nil
+	}
+	users := make(map[types.Uid]bool, len(ids))
+	for _, id := range ids {
+		users[types.ParseUserId(id)] = true
+	}
+	return users
+}
@@ -0,0 +1,209 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Pushing server metrics to a monitoring system. Metrics are published in
+ *  expvar and served at /debug/vars; with "metrics" in the config the node
+ *  also sends them to a backend at regular intervals:
+ *    "metrics": {"kind": "statsd", "interval": 10,
+ *      "config": {"addr": "localhost:8125", "prefix": "tinode."}}
+ *  Every numeric value of the published variables is sent as a gauge named
+ *  after its path, e.g. "SendQueues.dropped_data". Arrays are skipped.
+ *  Backends:
+ *    statsd     - StatsD or DogStatsD over UDP;
+ *    cloudwatch - CloudWatch embedded metric format, written to the
+ *                 CloudWatch agent or to stdout for Lambda and ECS log
+ *                 drivers.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Default interval between reports
+	METRICS_DEFAULT_INTERVAL = 10 * time.Second
+)
+
+type metricsConfig struct {
+	// Name of the backend: "statsd" or "cloudwatch"
+	Kind string `json:"kind"`
+	// Interval between reports, seconds
+	Interval int `json:"interval"`
+	// Names of the variables to report, all except "cmdline" and "memstats" if empty
+	Include []string `json:"include"`
+	// Configuration of the backend
+	Config json.RawMessage `json:"config"`
+}
+
+// Value of a metric
+type metricPoint struct {
+	Name  string
+	Value float64
+}
+
+// Monitoring system receiving the metrics
+type metricsSink interface {
+	// open configures the sink
+	open(config json.RawMessage) error
+	// emit sends the values of the metrics collected at the given time
+	emit(ts time.Time, points []metricPoint) error
+	// close flushes and releases the sink
+	close()
+}
+
+var metricsSinks = make(map[string]metricsSink)
+
+// registerMetricsSink makes the backend available. Called from init().
+func registerMetricsSink(name string, sink metricsSink) {
+	if _, dup := metricsSinks[name]; dup {
+		panic("registerMetricsSink: called twice for " + name)
+	}
+	metricsSinks[name] = sink
+}
+
+var metrics struct {
+	sink    metricsSink
+	include map[string]bool
+	stop    chan bool
+	done    chan bool
+}
+
+// metricsInit starts pushing metrics to the configured backend. Metrics are not pushed by default.
+func metricsInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config metricsConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse metrics config:", err)
+	}
+	if config.Kind == "" {
+		return
+	}
+
+	sink := metricsSinks[config.Kind]
+	if sink == nil {
+		logMain.Fatal("metrics: unknown kind '" + config.Kind + "'")
+	}
+	if err := sink.open(config.Config); err != nil {
+		logMain.Fatal("metrics: failed to initialize", config.Kind, err)
+	}
+
+	interval := time.Duration(config.Interval) * time.Second
+	if interval <= 0 {
+		interval = METRICS_DEFAULT_INTERVAL
+	}
+	if len(config.Include) > 0 {
+		metrics.include = make(map[string]bool, len(config.Include))
+		for _, name := range config.Include {
+			metrics.include[name] = true
+		}
+	}
+	metrics.sink = sink
+	metrics.stop = make(chan bool)
+	metrics.done = make(chan bool)
+	go metricsLoop(interval)
+
+	logMain.Infof("Metrics are sent to %s every %s", config.Kind, interval)
+}
+
+// metricsStop sends the last report and stops the backend.
+func metricsStop() {
+	if metrics.sink == nil {
+		return
+	}
+	metrics.stop <- true
+	<-metrics.done
+}
+
+func metricsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			metricsReport()
+		case <-metrics.stop:
+			metricsReport()
+			metrics.sink.close()
+			metrics.done <- true
+			return
+		}
+	}
+}
+
+// metricsReport collects the current values and sends them to the backend.
+func metricsReport() {
+	points := metricsCollect()
+	if len(points) == 0 {
+		return
+	}
+	if err := metrics.sink.emit(time.Now().UTC(), points); err != nil {
+		logMain.Warn("metrics: failed to send:", err)
+	}
+}
+
+// metricsCollect flattens numeric values of the published variables.
+func metricsCollect() []metricPoint {
+	var points []metricPoint
+	expvar.Do(func(kv expvar.KeyValue) {
+		if metrics.include != nil {
+			if !metrics.include[kv.Key] {
+				return
+			}
+		} else if kv.Key == "cmdline" || kv.Key == "memstats" {
+			return
+		}
+
+		var val interface{}
+		if err := json.Unmarshal([]byte(kv.Value.String()), &val); err != nil {
+			return
+		}
+		points = metricsFlatten(points, kv.Key, val)
+	})
+	return points
+}
+
+func metricsFlatten(points []metricPoint, name string, val interface{}) []metricPoint {
+	switch v := val.(type) {
+	case float64:
+		points = append(points, metricPoint{Name: name, Value: v})
+	case bool:
+		if v {
+			points = append(points, metricPoint{Name: name, Value: 1})
+		} else {
+			points = append(points, metricPoint{Name: name, Value: 0})
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			points = metricsFlatten(points, name+"."+key, v[key])
+		}
+	}
+	return points
+}
+
+// metricsName replaces characters which monitoring systems don't accept in metric names.
+func metricsName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+			r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metrics written as CloudWatch embedded metric format (EMF) documents, one per line. The CloudWatch
+// agent or the log driver extracts the metrics from the documents.
+
+const (
+	// Maximum number of metrics in one EMF document
+	METRICS_EMF_MAX_METRICS = 100
+	// Default namespace of the metrics
+	METRICS_EMF_DEFAULT_NAMESPACE = "Tinode"
+)
+
+type cloudwatchSink struct {
+	out       io.WriteCloser
+	namespace string
+	// Dimensions added to every document
+	dimensions map[string]string
+	dimNames   []string
+}
+
+func init() {
+	registerMetricsSink("cloudwatch", &cloudwatchSink{})
+}
+
+func (cs *cloudwatchSink) open(jsconfig json.RawMessage) error {
+	var config struct {
+		// CloudWatch agent endpoint, "udp://host:port" or "tcp://host:port"; stdout if empty
+		Addr      string `json:"addr"`
+		Namespace string `json:"namespace"`
+		// Dimensions of the metrics; the name of the cluster node is added as "Node"
+		Dimensions map[string]string `json:"dimensions"`
+	}
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return err
+		}
+	}
+
+	if config.Addr == "" {
+		cs.out = os.Stdout
+	} else {
+		parts := strings.SplitN(config.Addr, "://", 2)
+		if len(parts) != 2 {
+			parts = []string{"udp", config.Addr}
+		}
+		conn, err := net.Dial(parts[0], parts[1])
+		if err != nil {
+			return err
+		}
+		cs.out = conn
+	}
+
+	cs.namespace = config.Namespace
+	if cs.namespace == "" {
+		cs.namespace = METRICS_EMF_DEFAULT_NAMESPACE
+	}
+	cs.dimensions = config.Dimensions
+	if cs.dimensions == nil {
+		cs.dimensions = make(map[string]string)
+	}
+	if globals.cluster != nil {
+		if _, ok := cs.dimensions["Node"]; !ok {
+			cs.dimensions["Node"] = globals.cluster.thisNodeName
+		}
+	}
+	for name := range cs.dimensions {
+		cs.dimNames = append(cs.dimNames, name)
+	}
+	sort.Strings(cs.dimNames)
+	return nil
+}
+
+func (cs *cloudwatchSink) emit(ts time.Time, points []metricPoint) error {
+	type metricDef struct {
+		Name string
+	}
+	type directive struct {
+		Namespace  string
+		Dimensions [][]string
+		Metrics    []metricDef
+	}
+
+	for start := 0; start < len(points); start += METRICS_EMF_MAX_METRICS {
+		end := start + METRICS_EMF_MAX_METRICS
+		if end > len(points) {
+			end = len(points)
+		}
+
+		doc := make(map[string]interface{}, end-start+len(cs.dimensions)+1)
+		dir := directive{Namespace: cs.namespace, Dimensions: [][]string{cs.dimNames}}
+		for _, pt := range points[start:end] {
+			name := metricsName(pt.Name)
+			dir.Metrics = append(dir.Metrics, metricDef{Name: name})
+			doc[name] = pt.Value
+		}
+		for name, val := range cs.dimensions {
+			doc[name] = val
+		}
+		doc["_aws"] = map[string]interface{}{
+			"Timestamp":         ts.UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []directive{dir}}
+
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if _, err = cs.out.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cs *cloudwatchSink) close() {
+	if cs.out != os.Stdout {
+		cs.out.Close()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics sent to StatsD as gauges over UDP. Several metrics are packed into one datagram.
+
+const (
+	// Maximum size of a datagram which is not fragmented on common networks
+	METRICS_STATSD_MAX_PACKET = 1432
+)
+
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	// DogStatsD tags appended to every metric, e.g. "|#env:prod,node:one"
+	tags string
+}
+
+func init() {
+	registerMetricsSink("statsd", &statsdSink{})
+}
+
+func (ss *statsdSink) open(jsconfig json.RawMessage) error {
+	var config struct {
+		// Address of the StatsD server, host:port
+		Addr string `json:"addr"`
+		// Prefix of metric names
+		Prefix string `json:"prefix"`
+		// DogStatsD tags
+		Tags []string `json:"tags"`
+	}
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return err
+		}
+	}
+	if config.Addr == "" {
+		config.Addr = "localhost:8125"
+	}
+
+	var err error
+	if ss.conn, err = net.Dial("udp", config.Addr); err != nil {
+		return err
+	}
+	ss.prefix = config.Prefix
+	if len(config.Tags) > 0 {
+		ss.tags = "|#" + strings.Join(config.Tags, ",")
+	}
+	return nil
+}
+
+func (ss *statsdSink) emit(ts time.Time, points []metricPoint) error {
+	var packet bytes.Buffer
+	var line []byte
+	for _, pt := range points {
+		line = append(line[:0], ss.prefix...)
+		line = append(line, metricsName(pt.Name)...)
+		line = append(line, ':')
+		line = strconv.AppendFloat(line, pt.Value, 'f', -1, 64)
+		line = append(line, "|g"...)
+		line = append(line, ss.tags...)
+
+		if packet.Len() > 0 && packet.Len()+1+len(line) > METRICS_STATSD_MAX_PACKET {
+			if _, err := ss.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.Write(line)
+	}
+	if packet.Len() > 0 {
+		_, err := ss.conn.Write(packet.Bytes())
+		return err
+	}
+	return nil
+}
+
+func (ss *statsdSink) close() {
+	ss.conn.Close()
+}
@@ -0,0 +1,742 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  MQTT bridge for embedded devices which don't speak the JSON protocol.
+ *  With "mqtt" in the config the node accepts MQTT 3.1.1 clients:
+ *    "mqtt": {"listen": ":1883"}
+ *  The client connects with the API key as the user name and a token of
+ *  the user as the password. Each client is a session of the user. MQTT
+ *  topics are Tinode topics: a PUBLISH to "grpAbCd" is posted to the topic
+ *  as {pub} with the payload as content, a JSON value if the payload is
+ *  valid JSON, a string otherwise. After a SUBSCRIBE to "grpAbCd" the
+ *  {data} messages of the topic are delivered as PUBLISH with the content
+ *  as payload. The session joins the topic on the first PUBLISH or
+ *  SUBSCRIBE. Messages are delivered to the client with QoS 0; a PUBLISH
+ *  with QoS 1 is acknowledged when the topic accepts the message.
+ *  Wildcards, QoS 2, retained messages and wills are not supported.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of MQTT control packets
+const (
+	MQTT_CONNECT     = 1
+	MQTT_CONNACK     = 2
+	MQTT_PUBLISH     = 3
+	MQTT_PUBACK      = 4
+	MQTT_SUBSCRIBE   = 8
+	MQTT_SUBACK      = 9
+	MQTT_UNSUBSCRIBE = 10
+	MQTT_UNSUBACK    = 11
+	MQTT_PINGREQ     = 12
+	MQTT_PINGRESP    = 13
+	MQTT_DISCONNECT  = 14
+)
+
+// Return codes of CONNACK
+const (
+	MQTT_ACCEPTED        = 0
+	MQTT_BAD_PROTOCOL    = 1
+	MQTT_UNAVAILABLE     = 3
+	MQTT_BAD_CREDENTIALS = 4
+	MQTT_NOT_AUTHORIZED  = 5
+)
+
+const (
+	// Return code of SUBACK for a rejected subscription
+	MQTT_SUB_FAILURE = 0x80
+	// Time allowed to send CONNECT after opening the connection
+	MQTT_CONNECT_TIMEOUT = 10 * time.Second
+)
+
+var errMqttMalformed = errors.New("mqtt: malformed packet")
+
+type mqttConfig struct {
+	// Address to listen on, e.g. ":1883"; MQTT clients are not accepted if empty
+	Listen string `json:"listen"`
+	// Certificate and private key for TLS; plain TCP if empty
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+var mqttListener net.Listener
+
+// mqttInit starts accepting MQTT clients. The bridge is disabled by default.
+func mqttInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config mqttConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse mqtt config:", err)
+	}
+	if config.Listen == "" {
+		return
+	}
+
+	var err error
+	if config.CertFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			logMain.Fatal("mqtt: failed to load certificate:", err)
+		}
+		mqttListener, err = tls.Listen("tcp", config.Listen, &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		mqttListener, err = net.Listen("tcp", config.Listen)
+	}
+	if err != nil {
+		logMain.Fatal("mqtt: failed to listen:", err)
+	}
+
+	go mqttServe(mqttListener)
+
+	logMain.Infof("Listening for MQTT clients on [%s]", config.Listen)
+}
+
+// mqttStop stops accepting MQTT clients. Connected clients are disconnected with other sessions.
+func mqttStop() {
+	if mqttListener != nil {
+		mqttListener.Close()
+	}
+}
+
+func mqttServe(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logSession.Warn("mqtt: accept failed", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go mqttServeConn(conn)
+	}
+}
+
+// One MQTT control packet
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// mqttRead reads the next packet no longer than the limit.
+func mqttRead(rd *bufio.Reader, limit int64) (*mqttPacket, error) {
+	head, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// Remaining length: up to 4 bytes, 7 bits each, least significant first
+	var size int64
+	for i, mult := 0, int64(1); ; i, mult = i+1, mult*128 {
+		b, err := rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size += int64(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return nil, errMqttMalformed
+		}
+	}
+	if size > limit {
+		return nil, errors.New("mqtt: packet too large")
+	}
+
+	pkt := &mqttPacket{kind: head >> 4, flags: head & 0x0f, body: make([]byte, size)}
+	if _, err = io.ReadFull(rd, pkt.body); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// Decoder of the fields of a packet. The first error is kept in err, the following reads return zero values.
+type mqttFields struct {
+	buf []byte
+	err error
+}
+
+func (f *mqttFields) readByte() byte {
+	if f.err != nil {
+		return 0
+	}
+	if len(f.buf) < 1 {
+		f.err = errMqttMalformed
+		return 0
+	}
+	v := f.buf[0]
+	f.buf = f.buf[1:]
+	return v
+}
+
+func (f *mqttFields) readUint16() uint16 {
+	if f.err != nil {
+		return 0
+	}
+	if len(f.buf) < 2 {
+		f.err = errMqttMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(f.buf)
+	f.buf = f.buf[2:]
+	return v
+}
+
+// readBytes reads binary data or a string prefixed with its length.
+func (f *mqttFields) readBytes() []byte {
+	size := int(f.readUint16())
+	if f.err != nil {
+		return nil
+	}
+	if len(f.buf) < size {
+		f.err = errMqttMalformed
+		return nil
+	}
+	v := f.buf[:size]
+	f.buf = f.buf[size:]
+	return v
+}
+
+func (f *mqttFields) readString() string {
+	return string(f.readBytes())
+}
+
+// mqttEncode builds a packet from the first byte of the header and the fields.
+func mqttEncode(head byte, fields ...[]byte) []byte {
+	size := 0
+	for _, field := range fields {
+		size += len(field)
+	}
+
+	pkt := make([]byte, 0, size+5)
+	pkt = append(pkt, head)
+	for {
+		b := byte(size % 128)
+		size /= 128
+		if size > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if size == 0 {
+			break
+		}
+	}
+	for _, field := range fields {
+		pkt = append(pkt, field...)
+	}
+	return pkt
+}
+
+func mqttUint16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func mqttString(s string) []byte {
+	return append(mqttUint16(uint16(len(s))), s...)
+}
+
+// Connection of an MQTT client
+type mqttConn struct {
+	conn net.Conn
+	// Lock for writing packets from the read and write loops
+	wlock sync.Mutex
+
+	// Lock for lastId, pending and delivered
+	lock sync.Mutex
+	// Last ID of a request sent to the session
+	lastId int
+	// Handlers of {ctrl} responses to the requests, indexed by request ID
+	pending map[string]func(*MsgServerCtrl)
+	// Topics the client subscribed to
+	delivered map[string]bool
+
+	// Topics the session is attached to or joining, indexed by topic name
+	topics map[string]*mqttTopic
+	// Lock for topics, held while the messages to the topics are dispatched to keep them in order
+	tlock sync.Mutex
+}
+
+// Topic used by an MQTT client
+type mqttTopic struct {
+	// The session is attached to the topic
+	attached bool
+	// Messages published while the session is joining the topic
+	queued []*MsgClientPub
+	// Callbacks waiting for the session to join the topic
+	waiting []func(ok bool)
+}
+
+func (mc *mqttConn) write(pkt []byte) error {
+	mc.wlock.Lock()
+	defer mc.wlock.Unlock()
+
+	mc.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err := mc.conn.Write(pkt)
+	return err
+}
+
+func (mc *mqttConn) connack(code byte) error {
+	return mc.write(mqttEncode(MQTT_CONNACK<<4, []byte{0, code}))
+}
+
+// nextId returns the ID of the next request to the session and registers the handler of its response.
+func (mc *mqttConn) nextId(handler func(*MsgServerCtrl)) string {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	mc.lastId++
+	id := strconv.Itoa(mc.lastId)
+	if handler != nil {
+		mc.pending[id] = handler
+	}
+	return id
+}
+
+func mqttServeConn(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(MQTT_CONNECT_TIMEOUT))
+	pkt, err := mqttRead(rd, maxMessageSize())
+	if err != nil || pkt.kind != MQTT_CONNECT {
+		conn.Close()
+		return
+	}
+
+	mc := &mqttConn{
+		conn:      conn,
+		pending:   make(map[string]func(*MsgServerCtrl)),
+		delivered: make(map[string]bool),
+		topics:    make(map[string]*mqttTopic),
+	}
+	sess, keepAlive := mc.connect(pkt)
+	if sess == nil {
+		conn.Close()
+		return
+	}
+
+	go sess.mqttWriteLoop()
+	sess.mqttReadLoop(rd, keepAlive)
+}
+
+// connect authenticates the client and creates its session. Returns nil if the connection is refused.
+func (mc *mqttConn) connect(pkt *mqttPacket) (*Session, time.Duration) {
+	f := mqttFields{buf: pkt.body}
+	protocol := f.readString()
+	level := f.readByte()
+	flags := f.readByte()
+	keepAlive := time.Duration(f.readUint16()) * time.Second
+	clientId := f.readString()
+	if flags&0x04 != 0 {
+		// Wills are not supported, skip the topic and the message
+		f.readBytes()
+		f.readBytes()
+	}
+	var apikey, token string
+	if flags&0x80 != 0 {
+		apikey = f.readString()
+	}
+	if flags&0x40 != 0 {
+		token = f.readString()
+	}
+	if f.err != nil {
+		return nil, 0
+	}
+
+	if (protocol != "MQTT" || level != 4) && (protocol != "MQIsdp" || level != 3) {
+		mc.connack(MQTT_BAD_PROTOCOL)
+		return nil, 0
+	}
+
+	if isValid, _ := checkApiKey(apikey); !isValid {
+		logSession.Warn("mqtt: Missing, invalid or expired API key")
+		mc.connack(MQTT_NOT_AUTHORIZED)
+		return nil, 0
+	}
+
+	if globals.cluster.isCordoned() || isStandby() {
+		// The node is being restarted or the region is a standby, the client should connect elsewhere
+		mc.connack(MQTT_UNAVAILABLE)
+		return nil, 0
+	}
+
+	// The token is sent as is or in base64 as in {login}
+	secret, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		secret = []byte(token)
+	}
+
+	sess := globals.sessionStore.Create(mc, "")
+	sess.remoteAddr = mc.conn.RemoteAddr().String()
+	// Responses without IDs are not sent to the client
+	sess.dispatch(&ClientComMessage{Hi: &MsgClientHi{Version: VERSION, UserAgent: "MQTT; " + clientId}})
+	sess.dispatch(&ClientComMessage{Login: &MsgClientLogin{Scheme: "token", Secret: secret}})
+	if sess.uid.IsZero() {
+		globals.sessionStore.Delete(sess)
+		mc.connack(MQTT_BAD_CREDENTIALS)
+		return nil, 0
+	}
+
+	if err := mc.connack(MQTT_ACCEPTED); err != nil {
+		globals.sessionStore.Delete(sess)
+		return nil, 0
+	}
+	logSession.Debugf("mqtt: new session, sid=%s client=%s", sess.sid, clientId)
+
+	return sess, keepAlive
+}
+
+func (sess *Session) mqttReadLoop(rd *bufio.Reader, keepAlive time.Duration) {
+	mc := sess.mqtt
+
+	defer func() {
+		logSession.Debug("mqtt - stop")
+		mc.conn.Close()
+		// Break the write loop
+		select {
+		case sess.stop <- nil:
+		default:
+		}
+		globals.sessionStore.Delete(sess)
+		globals.cluster.sessionGone(sess)
+		for _, sub := range sess.subs {
+			// sub.done is the same as topic.unreg
+			sub.done <- &sessionLeave{sess: sess, unsub: false}
+		}
+	}()
+
+	// The client is disconnected after one and a half keep alive periods of silence
+	timeout := keepAlive * 3 / 2
+	if timeout == 0 {
+		timeout = pongWait
+	}
+
+	for {
+		mc.conn.SetReadDeadline(time.Now().Add(timeout))
+		pkt, err := mqttRead(rd, maxMessageSize())
+		if err != nil {
+			logSession.Warn("sess.mqttReadLoop: " + err.Error())
+			return
+		}
+
+		switch pkt.kind {
+		case MQTT_PUBLISH:
+			err = mc.publish(sess, pkt)
+		case MQTT_SUBSCRIBE:
+			err = mc.subscribe(sess, pkt)
+		case MQTT_UNSUBSCRIBE:
+			err = mc.unsubscribe(pkt)
+		case MQTT_PINGREQ:
+			err = mc.write(mqttEncode(MQTT_PINGRESP << 4))
+		case MQTT_DISCONNECT:
+			return
+		default:
+			err = errors.New("mqtt: unexpected packet " + strconv.Itoa(int(pkt.kind)))
+		}
+		if err != nil {
+			logSession.Warn("sess.mqttReadLoop: " + err.Error())
+			return
+		}
+	}
+}
+
+func (sess *Session) mqttWriteLoop() {
+	mc := sess.mqtt
+
+	// Break the read loop
+	defer mc.conn.Close()
+
+	write := func(msg []byte, class int) error {
+		return mc.deliver(msg)
+	}
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				return
+			}
+			if err := mc.deliver(msg); err != nil {
+				logSession.Warn("sess.mqttWriteLoop: " + err.Error())
+				return
+			}
+		case msg := <-sess.sendPres:
+			if err := sess.writeQueued(msg, SEND_CLASS_PRES, write); err != nil {
+				logSession.Warn("sess.mqttWriteLoop: " + err.Error())
+				return
+			}
+		case msg := <-sess.sendTyping:
+			if err := sess.writeQueued(msg, SEND_CLASS_TYPING, write); err != nil {
+				logSession.Warn("sess.mqttWriteLoop: " + err.Error())
+				return
+			}
+		case <-sess.stop:
+			// MQTT has no shutdown notice: write the messages already queued and disconnect
+			for {
+				queued, _, ok := sess.nextUrgent(SEND_CLASS_TYPING)
+				if !ok {
+					break
+				}
+				if err := mc.deliver(queued); err != nil {
+					return
+				}
+			}
+			return
+
+		case topic := <-sess.detach:
+			delete(sess.subs, topic)
+			// The write loop must not wait for the read loop
+			go mc.detached(sess.lpOriginal(topic))
+		}
+	}
+}
+
+// deliver handles a packet queued to the session: responses are passed to their handlers, {data} messages
+// of the subscribed topics are sent to the client. Other messages are dropped.
+func (mc *mqttConn) deliver(packet []byte) error {
+	var msg ServerComMessage
+	if err := wire.Unmarshal(packet, &msg); err != nil {
+		logSession.Warn("mqtt: failed to parse message", err)
+		return nil
+	}
+
+	switch {
+	case msg.Ctrl != nil && msg.Ctrl.Id != "":
+		mc.lock.Lock()
+		handler := mc.pending[msg.Ctrl.Id]
+		delete(mc.pending, msg.Ctrl.Id)
+		mc.lock.Unlock()
+		if handler != nil {
+			handler(msg.Ctrl)
+		}
+
+	case msg.Data != nil:
+		mc.lock.Lock()
+		subscribed := mc.delivered[msg.Data.Topic]
+		mc.lock.Unlock()
+		if !subscribed {
+			return nil
+		}
+
+		var payload []byte
+		if str, ok := msg.Data.Content.(string); ok {
+			payload = []byte(str)
+		} else {
+			payload, _ = json.Marshal(msg.Data.Content)
+		}
+		return mc.write(mqttEncode(MQTT_PUBLISH<<4, mqttString(msg.Data.Topic), payload))
+	}
+	return nil
+}
+
+// publish posts the payload of PUBLISH to the topic.
+func (mc *mqttConn) publish(sess *Session, pkt *mqttPacket) error {
+	qos := (pkt.flags >> 1) & 0x03
+	if qos > 1 {
+		return errors.New("mqtt: QoS 2 is not supported")
+	}
+
+	f := mqttFields{buf: pkt.body}
+	topic := f.readString()
+	var packetId uint16
+	if qos > 0 {
+		packetId = f.readUint16()
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return errMqttMalformed
+	}
+
+	var content interface{}
+	if err := json.Unmarshal(f.buf, &content); err != nil {
+		content = string(f.buf)
+	}
+
+	var handler func(*MsgServerCtrl)
+	if qos > 0 {
+		handler = func(ctrl *MsgServerCtrl) {
+			if ctrl.Code >= http.StatusMultipleChoices {
+				// MQTT 3.1.1 cannot report the error, the connection is closed instead
+				logSession.Warnf("mqtt: publish to '%s' rejected: %d %s", topic, ctrl.Code, ctrl.Text)
+				mc.conn.Close()
+				return
+			}
+			mc.write(mqttEncode(MQTT_PUBACK<<4, mqttUint16(packetId)))
+		}
+	}
+	pub := &MsgClientPub{Id: mc.nextId(handler), Topic: topic, Content: content}
+
+	mc.tlock.Lock()
+	defer mc.tlock.Unlock()
+
+	if t := mc.join(sess, topic); t.attached {
+		sess.dispatch(&ClientComMessage{Pub: pub})
+	} else {
+		t.queued = append(t.queued, pub)
+	}
+	return nil
+}
+
+// subscribe starts delivering messages of the topics to the client. Wildcards are rejected.
+func (mc *mqttConn) subscribe(sess *Session, pkt *mqttPacket) error {
+	if pkt.flags != 0x02 {
+		return errMqttMalformed
+	}
+
+	f := mqttFields{buf: pkt.body}
+	packetId := f.readUint16()
+	var names []string
+	for len(f.buf) > 0 && f.err == nil {
+		names = append(names, f.readString())
+		// Requested QoS, messages are delivered with QoS 0
+		f.readByte()
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if len(names) == 0 {
+		return errMqttMalformed
+	}
+
+	// The results are reported together when all topics are joined
+	codes := make([]byte, len(names))
+	left := len(names)
+	done := func(i int, ok bool) {
+		mc.lock.Lock()
+		if ok {
+			mc.delivered[names[i]] = true
+		} else {
+			codes[i] = MQTT_SUB_FAILURE
+		}
+		left--
+		last := left == 0
+		mc.lock.Unlock()
+
+		if last {
+			mc.write(mqttEncode(MQTT_SUBACK<<4, mqttUint16(packetId), codes))
+		}
+	}
+
+	mc.tlock.Lock()
+	defer mc.tlock.Unlock()
+
+	for i, name := range names {
+		i := i
+		if name == "" || strings.ContainsAny(name, "+#") {
+			done(i, false)
+			continue
+		}
+		if t := mc.join(sess, name); t.attached {
+			done(i, true)
+		} else {
+			t.waiting = append(t.waiting, func(ok bool) { done(i, ok) })
+		}
+	}
+	return nil
+}
+
+// unsubscribe stops delivering messages of the topics. The session stays attached so the client can publish.
+func (mc *mqttConn) unsubscribe(pkt *mqttPacket) error {
+	if pkt.flags != 0x02 {
+		return errMqttMalformed
+	}
+
+	f := mqttFields{buf: pkt.body}
+	packetId := f.readUint16()
+	var names []string
+	for len(f.buf) > 0 && f.err == nil {
+		names = append(names, f.readString())
+	}
+	if f.err != nil {
+		return f.err
+	}
+
+	mc.lock.Lock()
+	for _, name := range names {
+		delete(mc.delivered, name)
+	}
+	mc.lock.Unlock()
+
+	return mc.write(mqttEncode(MQTT_UNSUBACK<<4, mqttUint16(packetId)))
+}
+
+// join returns the topic, sending {sub} if the session is not attached to it. Called with tlock held.
+func (mc *mqttConn) join(sess *Session, name string) *mqttTopic {
+	if t := mc.topics[name]; t != nil {
+		return t
+	}
+
+	t := &mqttTopic{}
+	mc.topics[name] = t
+	id := mc.nextId(func(ctrl *MsgServerCtrl) {
+		// Called from the write loop which must not wait for the read loop
+		go mc.joined(sess, name, ctrl.Code < http.StatusMultipleChoices || ctrl.Code == http.StatusNotModified)
+	})
+	sess.dispatch(&ClientComMessage{Sub: &MsgClientSub{Id: id, Topic: name}})
+	return t
+}
+
+// joined handles the response to {sub}: publishes the queued messages and completes SUBSCRIBE.
+func (mc *mqttConn) joined(sess *Session, name string, ok bool) {
+	mc.tlock.Lock()
+	defer mc.tlock.Unlock()
+
+	t := mc.topics[name]
+	if t == nil {
+		return
+	}
+
+	if ok {
+		t.attached = true
+		for _, pub := range t.queued {
+			sess.dispatch(&ClientComMessage{Pub: pub})
+		}
+	} else {
+		delete(mc.topics, name)
+		if len(t.queued) > 0 {
+			// MQTT 3.1.1 cannot report that the messages are rejected, the connection is closed instead
+			logSession.Warnf("mqtt: failed to join '%s', messages rejected", name)
+			mc.conn.Close()
+		}
+	}
+	t.queued = nil
+
+	for _, callback := range t.waiting {
+		callback(ok)
+	}
+	t.waiting = nil
+}
+
+// detached forgets the topic which detached the session. It's joined again on the next PUBLISH or SUBSCRIBE.
+func (mc *mqttConn) detached(name string) {
+	mc.tlock.Lock()
+	delete(mc.topics, name)
+	mc.tlock.Unlock()
+}
@@ -0,0 +1,142 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Editing of published messages. The sender publishes the new version as
+ *  {pub replace=123}. The stored message keeps its SeqId, the earlier
+ *  version is appended to its edit history and the replacement is sent to
+ *  the attached sessions as {data seq=123 edited=...}. Edits are allowed
+ *  within a configurable window after the message was published.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default time after publishing when the message can be edited
+	MSGEDIT_WINDOW = 15 * time.Minute
+	// Default number of earlier versions kept per message
+	MSGEDIT_MAX_EDITS = 10
+)
+
+type msgEditConfig struct {
+	// Reject all edits
+	Disabled bool `json:"disabled"`
+	// Time after publishing when the message can be edited, in seconds
+	Window int `json:"window"`
+	// Number of times the message can be edited
+	MaxEdits int `json:"max_edits"`
+}
+
+var msgEdit = struct {
+	disabled bool
+	window   time.Duration
+	maxEdits int
+}{window: MSGEDIT_WINDOW, maxEdits: MSGEDIT_MAX_EDITS}
+
+func msgEditInit(jsconfig json.RawMessage) {
+	var config msgEditConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse message_edit config:", err)
+		}
+	}
+
+	msgEdit.disabled = config.Disabled
+	if config.Window > 0 {
+		msgEdit.window = time.Duration(config.Window) * time.Second
+	}
+	if config.MaxEdits > 0 {
+		msgEdit.maxEdits = config.MaxEdits
+	}
+}
+
+// replaceMessage saves the new version of the message in msg.replace. Returns true if the message was
+// replaced and should be sent to the attached sessions. Called by the topic goroutine.
+func (t *Topic) replaceMessage(msg *ServerComMessage, from types.Uid) bool {
+	reject := func(errmsg *ServerComMessage) bool {
+		if msg.sessFrom != nil {
+			msg.sessFrom.queueOut(errmsg)
+		}
+		return false
+	}
+	original := t.original(from)
+
+	if msgEdit.disabled || historyChain.enabled {
+		// Edits would break the chain of hashes
+		return reject(ErrOperationNotAllowed(msg.id, original, msg.timestamp))
+	}
+	if msg.replace > t.lastId {
+		return reject(ErrNotFound(msg.id, original, msg.timestamp))
+	}
+
+	messages, err := store.Messages.GetAll(t.name, from,
+		&types.BrowseOpt{Since: msg.replace, Before: msg.replace + 1, Limit: 1})
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to load message for editing: %v", t.name, err)
+		return reject(ErrUnknown(msg.id, original, msg.timestamp))
+	}
+	if len(messages) == 0 || messages[0].DeletedAt != nil {
+		return reject(ErrNotFound(msg.id, original, msg.timestamp))
+	}
+
+	stored := &messages[0]
+	if stored.From != from.String() {
+		return reject(ErrPermissionDenied(msg.id, original, msg.timestamp))
+	}
+	if msg.timestamp.Sub(stored.CreatedAt) > msgEdit.window || len(stored.Edits) >= msgEdit.maxEdits {
+		return reject(ErrPolicy(msg.id, original, msg.timestamp))
+	}
+
+	previous := stored.CreatedAt
+	if stored.EditedAt != nil {
+		previous = *stored.EditedAt
+	}
+	edited := msg.timestamp
+	stored.Edits = append(stored.Edits,
+		types.MessageEdit{Timestamp: previous, Head: stored.Head, Content: stored.Content})
+	stored.EditedAt = &edited
+	stored.Head = msg.Data.Head
+	stored.Content = msg.Data.Content
+
+	journal := complianceWanted(t.name)
+	if journal && !complianceReserve() {
+		logTopic.Warnf("topic[%s]: edit rejected, compliance journal is full", t.name)
+		return reject(ErrServiceUnavailable(msg.id, original, msg.timestamp))
+	}
+	if err = store.Messages.Update(t.name, stored.SeqId, map[string]interface{}{
+		"Head":     stored.Head,
+		"Content":  stored.Content,
+		"EditedAt": stored.EditedAt,
+		"Edits":    stored.Edits}); err != nil {
+		if journal {
+			complianceRelease()
+		}
+		logTopic.Errorf("topic[%s]: failed to save edited message: %v", t.name, err)
+		return reject(ErrUnknown(msg.id, original, msg.timestamp))
+	}
+	if journal {
+		complianceAppend(stored)
+	}
+	searchIndex(stored)
+
+	if msg.id != "" {
+		reply := NoErrAccepted(msg.id, original, msg.timestamp)
+		reply.Ctrl.Params = map[string]int{"seq": stored.SeqId}
+		msg.sessFrom.queueOut(reply)
+	}
+
+	msg.Data.SeqId = stored.SeqId
+	msg.Data.Thread = stored.Thread
+	msg.Data.Timestamp = stored.CreatedAt
+	msg.Data.EditedAt = &edited
+	return true
+}
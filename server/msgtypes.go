@@ -0,0 +1,265 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Registry of custom message types. The operator registers MIME types of
+ *  message content in the config together with a size limit, a validation
+ *  schema and a fallback text. A message declares its type in head.mime.
+ *  The server validates messages of the registered types, adds the fallback
+ *  text for clients which don't understand the type, and advertises the
+ *  registered types in the {hi} response.
+ *
+ *  Schemas are a subset of JSON Schema: type, properties, required,
+ *  additionalProperties, items, enum, minLength, maxLength, minimum,
+ *  maximum, minItems, maxItems.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+type msgTypeConfig struct {
+	// MIME type of the content, the value of head.mime
+	Mime string `json:"mime"`
+	// Maximum size of JSON-serialized content in bytes, 0 for no limit other than max_message_size
+	MaxSize int `json:"max_size"`
+	// Schema of the content
+	Schema *jsonSchema `json:"schema"`
+	// Text shown by clients which don't support the type
+	Fallback string `json:"fallback"`
+}
+
+type msgTypesConfig struct {
+	// Reject messages with head.mime which is neither registered nor built-in
+	Strict bool            `json:"strict"`
+	Types  []msgTypeConfig `json:"types"`
+}
+
+// Types which are always accepted
+var msgTypesBuiltin = []string{"text/plain", "text/x-drafty"}
+
+var msgTypes struct {
+	strict bool
+	types  map[string]*msgTypeConfig
+	// Sorted list of registered and built-in types reported to clients
+	names []string
+}
+
+// msgTypesInit parses the registry of message types.
+func msgTypesInit(jsconfig json.RawMessage) {
+	msgTypes.names = append([]string{}, msgTypesBuiltin...)
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config msgTypesConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse message types config:", err)
+	}
+
+	msgTypes.strict = config.Strict
+	msgTypes.types = make(map[string]*msgTypeConfig, len(config.Types))
+	for i := range config.Types {
+		mt := &config.Types[i]
+		if mt.Mime == "" {
+			logMain.Fatal("Message type must have a MIME type")
+		}
+		if _, dup := msgTypes.types[mt.Mime]; dup {
+			logMain.Fatal("Message type '" + mt.Mime + "' is registered twice")
+		}
+		if mt.Schema != nil {
+			if err := mt.Schema.check(); err != nil {
+				logMain.Fatal("Invalid schema of message type '"+mt.Mime+"':", err)
+			}
+		}
+		msgTypes.types[mt.Mime] = mt
+		msgTypes.names = append(msgTypes.names, mt.Mime)
+	}
+	sort.Strings(msgTypes.names)
+
+	logMain.Infof("Registered %d custom message types", len(msgTypes.types))
+}
+
+// msgTypeValidate checks the message content against the registered type and adds the fallback text.
+func msgTypeValidate(data *MsgServerData) error {
+	mime := data.Head["mime"]
+	mt := msgTypes.types[mime]
+	if mt == nil {
+		if msgTypes.strict {
+			for _, name := range msgTypesBuiltin {
+				if name == mime {
+					return nil
+				}
+			}
+			return errors.New("unknown message type '" + mime + "'")
+		}
+		return nil
+	}
+
+	if mt.MaxSize > 0 {
+		raw, err := json.Marshal(data.Content)
+		if err != nil {
+			return err
+		}
+		if len(raw) > mt.MaxSize {
+			return errors.New("content is too large")
+		}
+	}
+
+	if mt.Schema != nil {
+		if err := mt.Schema.validate(data.Content, "content"); err != nil {
+			return err
+		}
+	}
+
+	if mt.Fallback != "" && data.Head["fallback"] == "" {
+		data.Head["fallback"] = mt.Fallback
+	}
+	return nil
+}
+
+// jsonSchema is a subset of JSON Schema sufficient for validation of message content.
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+}
+
+// check verifies that the schema uses only the supported types.
+func (s *jsonSchema) check() error {
+	switch s.Type {
+	case "", "object", "array", "string", "number", "integer", "boolean", "null":
+	default:
+		return errors.New("unsupported type '" + s.Type + "'")
+	}
+	for _, prop := range s.Properties {
+		if prop == nil {
+			return errors.New("empty property schema")
+		}
+		if err := prop.check(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check()
+	}
+	return nil
+}
+
+// validate checks the value decoded from JSON against the schema. The path is used in error messages.
+func (s *jsonSchema) validate(value interface{}, path string) error {
+	if len(s.Enum) > 0 {
+		found := false
+		switch value.(type) {
+		case string, float64, bool, nil:
+			// Only scalar values can be enumerated
+			for _, e := range s.Enum {
+				if e == value {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return errors.New(path + ": value is not allowed")
+		}
+	}
+
+	switch s.Type {
+	case "":
+		// Any type
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.New(path + ": object expected")
+		}
+		for _, key := range s.Required {
+			if _, ok := obj[key]; !ok {
+				return errors.New(path + ": missing '" + key + "'")
+			}
+		}
+		for key, val := range obj {
+			prop := s.Properties[key]
+			if prop == nil {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return errors.New(path + ": unexpected '" + key + "'")
+				}
+				continue
+			}
+			if err := prop.validate(val, path+"."+key); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return errors.New(path + ": array expected")
+		}
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			return errors.New(path + ": too few items")
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			return errors.New(path + ": too many items")
+		}
+		if s.Items != nil {
+			for i, val := range arr {
+				if err := s.Items.validate(val, path+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return errors.New(path + ": string expected")
+		}
+		length := utf8.RuneCountInString(str)
+		if s.MinLength != nil && length < *s.MinLength {
+			return errors.New(path + ": string is too short")
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return errors.New(path + ": string is too long")
+		}
+	case "number", "integer":
+		num, ok := value.(float64)
+		if !ok {
+			return errors.New(path + ": number expected")
+		}
+		if s.Type == "integer" && num != float64(int64(num)) {
+			return errors.New(path + ": integer expected")
+		}
+		if s.Minimum != nil && num < *s.Minimum {
+			return errors.New(path + ": value is too small")
+		}
+		if s.Maximum != nil && num > *s.Maximum {
+			return errors.New(path + ": value is too large")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return errors.New(path + ": boolean expected")
+		}
+	case "null":
+		if value != nil {
+			return errors.New(path + ": null expected")
+		}
+	default:
+		return errors.New(path + ": unsupported schema type '" + s.Type + "'")
+	}
+	return nil
+}
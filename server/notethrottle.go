@@ -0,0 +1,170 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Throttling of typing notifications and read/received receipts in group
+ *  topics. Every {note} is broadcast to all sessions attached to the topic,
+ *  so in a large group with many active members the number of tiny frames
+ *  grows with the square of the number of members. Group topics now
+ *  broadcast at most one {info what="kp"} per user per typing_interval and
+ *  drop the rest. Read and received receipts are still applied and saved
+ *  immediately, but are broadcast once per receipt_interval: only the
+ *  latest receipt of each user is sent.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default interval between typing notifications of a user
+	NOTE_TYPING_INTERVAL = 2 * time.Second
+	// Default interval between broadcasts of receipts
+	NOTE_RECEIPT_INTERVAL = time.Second
+)
+
+type noteThrottleConfig struct {
+	// Broadcast every note immediately
+	Disabled bool `json:"disabled"`
+	// Minimum interval between typing notifications of a user in milliseconds
+	TypingInterval int `json:"typing_interval"`
+	// Interval between broadcasts of read/recv receipts in milliseconds
+	ReceiptInterval int `json:"receipt_interval"`
+}
+
+var noteThrottle struct {
+	disabled        bool
+	typingInterval  time.Duration
+	receiptInterval time.Duration
+
+	// Exported as NoteThrottle in expvar
+	typingDropped     *expvar.Int
+	receiptsMerged    *expvar.Int
+	receiptsBroadcast *expvar.Int
+}
+
+// Key of a pending receipt: the user and "read" or "recv"
+type receiptKey struct {
+	uid  types.Uid
+	what string
+}
+
+// topicNotes is the state of note throttling of one topic. Accessed by the topic goroutine only.
+type topicNotes struct {
+	// Time when the last typing notification of the user was broadcast
+	typing map[types.Uid]time.Time
+	// The latest receipts not broadcast yet
+	receipts map[receiptKey]*ServerComMessage
+	// Fires when pending receipts should be broadcast
+	flush *time.Timer
+}
+
+// noteThrottleInit parses config and publishes the metrics.
+func noteThrottleInit(jsconfig json.RawMessage) {
+	var config noteThrottleConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse note_throttle config:", err)
+		}
+	}
+
+	noteThrottle.disabled = config.Disabled
+	noteThrottle.typingInterval = time.Duration(config.TypingInterval) * time.Millisecond
+	if noteThrottle.typingInterval <= 0 {
+		noteThrottle.typingInterval = NOTE_TYPING_INTERVAL
+	}
+	noteThrottle.receiptInterval = time.Duration(config.ReceiptInterval) * time.Millisecond
+	if noteThrottle.receiptInterval <= 0 {
+		noteThrottle.receiptInterval = NOTE_RECEIPT_INTERVAL
+	}
+
+	noteThrottle.typingDropped = new(expvar.Int)
+	noteThrottle.receiptsMerged = new(expvar.Int)
+	noteThrottle.receiptsBroadcast = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("typing_dropped", noteThrottle.typingDropped)
+	vars.Set("receipts_merged", noteThrottle.receiptsMerged)
+	vars.Set("receipts_broadcast", noteThrottle.receiptsBroadcast)
+	expvar.Publish("NoteThrottle", vars)
+}
+
+// newTopicNotes creates the throttling state for the topic. Returns nil if notes of the topic
+// are not throttled.
+func newTopicNotes(cat types.TopicCat) *topicNotes {
+	if noteThrottle.disabled || cat != types.TopicCat_Grp {
+		return nil
+	}
+	flush := time.NewTimer(time.Hour)
+	flush.Stop()
+	return &topicNotes{
+		typing:   make(map[types.Uid]time.Time),
+		receipts: make(map[receiptKey]*ServerComMessage),
+		flush:    flush}
+}
+
+// typingAllowed checks if the typing notification of the user should be broadcast now.
+func (tn *topicNotes) typingAllowed(uid types.Uid, now time.Time) bool {
+	if tn == nil {
+		return true
+	}
+	if last, ok := tn.typing[uid]; ok && now.Sub(last) < noteThrottle.typingInterval {
+		noteThrottle.typingDropped.Add(1)
+		return false
+	}
+	tn.typing[uid] = now
+	return true
+}
+
+// deferReceipt keeps the read/recv receipt to be broadcast later. Returns false if receipts
+// are not throttled and the message should be broadcast now.
+func (tn *topicNotes) deferReceipt(uid types.Uid, msg *ServerComMessage) bool {
+	if tn == nil {
+		return false
+	}
+	key := receiptKey{uid: uid, what: msg.Info.What}
+	if _, ok := tn.receipts[key]; ok {
+		// Replaced by the newer receipt
+		noteThrottle.receiptsMerged.Add(1)
+	}
+	if len(tn.receipts) == 0 {
+		tn.flush.Reset(noteThrottle.receiptInterval)
+	}
+	tn.receipts[key] = msg
+	return true
+}
+
+// flushC returns the channel which signals that receipts should be broadcast.
+func (tn *topicNotes) flushC() <-chan time.Time {
+	if tn == nil {
+		return nil
+	}
+	return tn.flush.C
+}
+
+// stop releases the timer of the throttling state.
+func (tn *topicNotes) stop() {
+	if tn != nil {
+		tn.flush.Stop()
+	}
+}
+
+// notesFlush broadcasts pending read/recv receipts.
+func (t *Topic) notesFlush() {
+	for key, msg := range t.notes.receipts {
+		delete(t.notes.receipts, key)
+		// The user may have lost the permission to read since the receipt was received.
+		if pud, ok := t.perUser[key.uid]; !ok || !(pud.modeGiven & pud.modeWant).IsReader() {
+			continue
+		}
+		noteThrottle.receiptsBroadcast.Add(1)
+		t.fanOut(msg, nil)
+	}
+}
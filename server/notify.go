@@ -0,0 +1,187 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Preferences of push notifications per subscription. The user sets them
+ *  with {set notify={muted, mentions, quiet_start, quiet_end, tz}}. The
+ *  preferences are checked before the message is handed to push handlers:
+ *    - muted: no notifications except for messages which mention the user;
+ *    - mentions: notifications only for messages which mention the user in
+ *      head.mentions, a comma-separated list of user IDs;
+ *    - quiet hours: no notifications between quiet_start and quiet_end in
+ *      the user's time zone.
+ *  Messages are delivered to connected sessions regardless of preferences.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Time zones already loaded
+var notifyZones struct {
+	sync.Mutex
+	cache map[string]*time.Location
+}
+
+// notifyLocation returns the time zone by IANA name.
+func notifyLocation(name string) (*time.Location, error) {
+	notifyZones.Lock()
+	defer notifyZones.Unlock()
+
+	if loc, ok := notifyZones.cache[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	if notifyZones.cache == nil {
+		notifyZones.cache = make(map[string]*time.Location)
+	}
+	notifyZones.cache[name] = loc
+	return loc, nil
+}
+
+// notifyZonesSize estimates the memory held by the loaded time zones.
+func notifyZonesSize() int64 {
+	notifyZones.Lock()
+	defer notifyZones.Unlock()
+	// A time zone with its transitions takes a few kilobytes
+	return int64(len(notifyZones.cache)) * 4096
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, errors.New("invalid time of day")
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 23 {
+		return 0, errors.New("invalid hours")
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, errors.New("invalid minutes")
+	}
+	return hours*60 + minutes, nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// notifyPrefsFromMsg validates the preferences sent by the client. Returns nil if all notifications are allowed.
+func notifyPrefsFromMsg(msg *MsgNotifyPrefs) (*types.NotifyPrefs, error) {
+	prefs := &types.NotifyPrefs{
+		Muted:        msg.Muted,
+		MentionsOnly: msg.MentionsOnly,
+		TimeZone:     msg.TimeZone}
+
+	if msg.QuietStart != "" || msg.QuietEnd != "" {
+		var err error
+		if prefs.QuietStart, err = parseClock(msg.QuietStart); err != nil {
+			return nil, err
+		}
+		if prefs.QuietEnd, err = parseClock(msg.QuietEnd); err != nil {
+			return nil, err
+		}
+	}
+	if prefs.TimeZone != "" {
+		if _, err := notifyLocation(prefs.TimeZone); err != nil {
+			return nil, err
+		}
+	}
+
+	if !prefs.Muted && !prefs.MentionsOnly && prefs.QuietStart == prefs.QuietEnd {
+		return nil, nil
+	}
+	return prefs, nil
+}
+
+// notifyPrefsToMsg converts the stored preferences to the form sent to the client.
+func notifyPrefsToMsg(prefs *types.NotifyPrefs) *MsgNotifyPrefs {
+	if prefs == nil {
+		return nil
+	}
+	msg := &MsgNotifyPrefs{
+		Muted:        prefs.Muted,
+		MentionsOnly: prefs.MentionsOnly,
+		TimeZone:     prefs.TimeZone}
+	if prefs.QuietStart != prefs.QuietEnd {
+		msg.QuietStart = formatClock(prefs.QuietStart)
+		msg.QuietEnd = formatClock(prefs.QuietEnd)
+	}
+	return msg
+}
+
+// isQuietHours checks if the time falls within the user's quiet hours.
+func isQuietHours(prefs *types.NotifyPrefs, now time.Time) bool {
+	if prefs.QuietStart == prefs.QuietEnd {
+		return false
+	}
+
+	if prefs.TimeZone != "" {
+		if loc, err := notifyLocation(prefs.TimeZone); err == nil {
+			now = now.In(loc)
+		}
+	}
+	minutes := now.Hour()*60 + now.Minute()
+
+	if prefs.QuietStart < prefs.QuietEnd {
+		return minutes >= prefs.QuietStart && minutes < prefs.QuietEnd
+	}
+	// Quiet hours span midnight, e.g. 22:00 - 07:00
+	return minutes >= prefs.QuietStart || minutes < prefs.QuietEnd
+}
+
+// notifyAllowed checks if the user wants a push notification about the message. Mentions
+// are sent to muted topics too.
+func notifyAllowed(prefs *types.NotifyPrefs, mentioned bool, data *MsgServerData) bool {
+	if prefs == nil {
+		return true
+	}
+	if (prefs.Muted || prefs.MentionsOnly) && !mentioned {
+		return false
+	}
+	return !isQuietHours(prefs, data.Timestamp)
+}
+
+// replySetNotify replaces user's preferences of push notifications in response to set.notify.
+func (t *Topic) replySetNotify(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+
+	pud, ok := t.perUser[sess.uid]
+	if !ok || t.cat == types.TopicCat_Me || t.cat == types.TopicCat_Fnd {
+		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
+		return errors.New("notification preferences of an invalid subscription")
+	}
+
+	prefs, err := notifyPrefsFromMsg(set.Notify)
+	if err != nil {
+		sess.queueOut(ErrMalformed(set.Id, t.original(sess.uid), now))
+		return err
+	}
+
+	if err = store.Subs.Update(t.name, sess.uid, map[string]interface{}{"Notify": prefs}); err != nil {
+		sess.queueOut(ErrUnknown(set.Id, t.original(sess.uid), now))
+		return err
+	}
+
+	pud.notify = prefs
+	t.perUser[sess.uid] = pud
+
+	sess.queueOut(NoErr(set.Id, t.original(sess.uid), now))
+	return nil
+}
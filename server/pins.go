@@ -0,0 +1,111 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Pinned messages. The owner and admins of a topic pin a message with
+ *    {note what="pin" seq=N}
+ *  and unpin it with {note what="unpin" seq=N}. The list of pinned messages
+ *  is stored with the topic and reported in {meta desc}. The change is
+ *  broadcast to attached sessions as {info} with the updated list and to
+ *  offline subscribers as {pres what="upd"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of pinned messages in a topic
+	PINNED_MAX_COUNT = 10
+)
+
+// messagePin pins or unpins the message. Returns true if the list of pinned messages has changed
+// and should be broadcast. The updated list is returned in info.Pinned, empty if no messages are pinned.
+func (t *Topic) messagePin(uid types.Uid, info *MsgServerInfo, skipSid string) bool {
+	if t.cat != types.TopicCat_Grp && t.cat != types.TopicCat_Chn && t.cat != types.TopicCat_P2P {
+		return false
+	}
+	pud := t.perUser[uid]
+	if mode := pud.modeGiven & pud.modeWant; !mode.IsAdmin() && !mode.IsOwner() {
+		return false
+	}
+
+	pos := -1
+	for i, seq := range t.pinned {
+		if seq == info.SeqId {
+			pos = i
+			break
+		}
+	}
+
+	var pinned []int
+	if info.What == "pin" {
+		if pos >= 0 || len(t.pinned) >= PINNED_MAX_COUNT || info.SeqId > t.lastId || info.SeqId <= t.clearId {
+			return false
+		}
+
+		messages, err := store.Messages.GetAll(t.name, uid,
+			&types.BrowseOpt{Since: info.SeqId, Before: info.SeqId + 1, Limit: 1})
+		if err != nil {
+			logTopic.Warnf("topic[%s]: failed to load message for pinning: %v", t.name, err)
+			return false
+		}
+		if len(messages) == 0 || messages[0].DeletedAt != nil {
+			return false
+		}
+		pinned = append(append(pinned, t.pinned...), info.SeqId)
+	} else {
+		if pos < 0 {
+			return false
+		}
+		pinned = append(append(pinned, t.pinned[:pos]...), t.pinned[pos+1:]...)
+	}
+
+	if err := store.Topics.Update(t.name, map[string]interface{}{"Pinned": pinned}); err != nil {
+		logTopic.Errorf("topic[%s]: failed to update pinned messages: %v", t.name, err)
+		return false
+	}
+	t.pinned = pinned
+
+	// Subscribers which are not attached will see the list in {meta desc}
+	t.presSubsOffline("upd", nilPresParams, types.ModeRead, skipSid, false)
+
+	info.Pinned = pinned
+	return true
+}
+
+// unpinDeleted removes hard-deleted messages from the pinned list. Deleted are either all messages
+// up to and including the given seq or the listed ones.
+func (t *Topic) unpinDeleted(before int, list []int) {
+	if len(t.pinned) == 0 {
+		return
+	}
+
+	var pinned []int
+	for _, seq := range t.pinned {
+		deleted := seq <= before
+		for _, del := range list {
+			if seq == del {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			pinned = append(pinned, seq)
+		}
+	}
+	if len(pinned) == len(t.pinned) {
+		return
+	}
+
+	// Subscribers are notified of the deletion by the caller
+	if err := store.Topics.Update(t.name, map[string]interface{}{"Pinned": pinned}); err != nil {
+		logTopic.Errorf("topic[%s]: failed to update pinned messages: %v", t.name, err)
+		return
+	}
+	t.pinned = pinned
+}
@@ -0,0 +1,359 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Publishing pipeline: {pub} messages pass through an ordered chain of
+ *  stages. Each stage may rewrite the message, reject it with an error to
+ *  the sender, or drop it. Stages which need no topic state run in the
+ *  goroutine of the publishing session, before the message is routed to
+ *  the topic; the others run in the topic goroutine.
+ *
+ *  Built-in stages:
+ *    plugins  - session: plugins may reject or rewrite the message;
+ *    validate - topic: write permission, format of checklists, cards,
+ *               events, actions and typed messages;
+ *    save     - topic: the message is stored, edits replace stored messages,
+ *               messages with deliver_at are queued for later delivery;
+ *    fanout   - topic: delivery to sessions, bots and push notifications.
+ *
+ *  New features register their stages with registerPubStage and are placed
+ *  into the chain by "publish_pipeline": {"stages": [...]} in the config.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Default order of the stages
+var pubDefaultStages = []string{"plugins", "validate", "save", "fanout"}
+
+// Stages which must be present in every pipeline, in this order
+var pubRequiredStages = []string{"validate", "save", "fanout"}
+
+type pubPipelineConfig struct {
+	// Names of the stages in the order of execution
+	Stages []string `json:"stages"`
+}
+
+// State of a {data} message passing through the pipeline.
+type pubContext struct {
+	msg *ServerComMessage
+	// The following fields are set in the topic goroutine only
+	t *Topic
+	// Sender of the message
+	from types.Uid
+	// True if the message replaces an earlier one
+	edit bool
+	// Time from receiving the message to each step of delivery
+	latency [latencyStepCount]time.Duration
+}
+
+// pubStageFunc processes the message. Returns an error to send to the sender, if any, and false if the
+// message must not go further.
+type pubStageFunc func(pc *pubContext) (*ServerComMessage, bool)
+
+type pubStage struct {
+	name string
+	// Runs in the topic goroutine
+	inTopic bool
+	handler pubStageFunc
+
+	// Metrics
+	calls    *expvar.Int
+	rejected *expvar.Int
+	micros   *expvar.Int
+}
+
+var pubStages = map[string]*pubStage{}
+
+// The configured chain
+var pubPipeline struct {
+	session []*pubStage
+	topic   []*pubStage
+}
+
+// registerPubStage makes the stage available for the pipeline. Call from init().
+func registerPubStage(name string, inTopic bool, handler pubStageFunc) {
+	if _, dup := pubStages[name]; dup {
+		panic("publish pipeline: stage registered twice " + name)
+	}
+	pubStages[name] = &pubStage{name: name, inTopic: inTopic, handler: handler}
+}
+
+func pubPipelineInit(jsconfig json.RawMessage) {
+	var config pubPipelineConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse publish_pipeline config:", err)
+		}
+	}
+	names := config.Stages
+	if len(names) == 0 {
+		names = pubDefaultStages
+	}
+
+	vars := new(expvar.Map).Init()
+	required := 0
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		stage := pubStages[name]
+		if stage == nil {
+			logMain.Fatalf("publish_pipeline: unknown stage '%s'", name)
+		}
+		if seen[name] {
+			logMain.Fatalf("publish_pipeline: stage '%s' is listed twice", name)
+		}
+		seen[name] = true
+
+		if stage.inTopic {
+			pubPipeline.topic = append(pubPipeline.topic, stage)
+		} else if len(pubPipeline.topic) > 0 {
+			logMain.Fatalf("publish_pipeline: stage '%s' must come before '%s'", name, pubPipeline.topic[0].name)
+		} else {
+			pubPipeline.session = append(pubPipeline.session, stage)
+		}
+
+		if required < len(pubRequiredStages) && name == pubRequiredStages[required] {
+			required++
+		}
+
+		stage.calls, stage.rejected, stage.micros = new(expvar.Int), new(expvar.Int), new(expvar.Int)
+		stageVars := new(expvar.Map).Init()
+		stageVars.Set("calls", stage.calls)
+		stageVars.Set("rejected", stage.rejected)
+		stageVars.Set("micros", stage.micros)
+		vars.Set(name, stageVars)
+	}
+	if required < len(pubRequiredStages) {
+		logMain.Fatalf("publish_pipeline: stages %v are required in this order", pubRequiredStages)
+	}
+
+	expvar.Publish("PublishStages", vars)
+	logMain.Infof("Publish pipeline: %v", names)
+}
+
+// runStages passes the message through the stages. Returns false if the message was rejected or dropped.
+func (pc *pubContext) runStages(stages []*pubStage) bool {
+	for _, stage := range stages {
+		start := time.Now()
+		reply, ok := stage.handler(pc)
+		stage.calls.Add(1)
+		stage.micros.Add(int64(time.Since(start) / time.Microsecond))
+		if !ok {
+			stage.rejected.Add(1)
+			if reply != nil && pc.msg.sessFrom != nil {
+				pc.msg.sessFrom.queueOut(reply)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// pubSessionStages runs the stages of the pipeline which precede routing to the topic.
+// Returns false if the message must not be routed.
+func pubSessionStages(msg *ServerComMessage) bool {
+	return (&pubContext{msg: msg}).runStages(pubPipeline.session)
+}
+
+// publish passes the {data} message through the stages of the pipeline run by the topic.
+func (t *Topic) publish(msg *ServerComMessage) {
+	if t.isSuspended() {
+		if handoffBuffer(t.name, msg) {
+			// The topic is moving to another cluster node
+			return
+		}
+		if msg.sessFrom != nil {
+			msg.sessFrom.queueOut(ErrLocked(msg.id, t.original(msg.sessFrom.uid), msg.timestamp))
+		}
+		return
+	}
+
+	pc := &pubContext{msg: msg, t: t, from: types.ParseUserId(msg.Data.From), edit: msg.replace > 0}
+	pc.runStages(pubPipeline.topic)
+}
+
+func init() {
+	registerPubStage("plugins", false, pubPlugins)
+	registerPubStage("validate", true, pubValidate)
+	registerPubStage("save", true, pubSave)
+	registerPubStage("fanout", true, pubFanOut)
+}
+
+// pubPlugins lets the plugins reject or rewrite the message.
+func pubPlugins(pc *pubContext) (*ServerComMessage, bool) {
+	if reject := pluginMessage(pc.msg); reject != nil {
+		return reject, false
+	}
+	return nil, true
+}
+
+// pubValidate checks sender's permission and the format of the message.
+func pubValidate(pc *pubContext) (*ServerComMessage, bool) {
+	t, msg := pc.t, pc.msg
+	original := t.original(pc.from)
+
+	// msg.sessFrom is not nil when the message originated at the client, checkFrom is set for messages
+	// published over HTTP. Internally generated messages are not checked for permissions.
+	if msg.sessFrom != nil || msg.checkFrom {
+		if state, reason := userStateOf(pc.from); state != types.UserStateActive {
+			return ErrAccountState(msg.id, original, msg.timestamp, state, reason), false
+		}
+		userData := t.perUser[pc.from]
+		if !(userData.modeWant & userData.modeGiven).IsWriter() {
+			return ErrPermissionDenied(msg.id, original, msg.timestamp), false
+		}
+		if t.blocked[pc.from] && t.cat == types.TopicCat_P2P {
+			// The other participant blocked the sender
+			return ErrPermissionDenied(msg.id, original, msg.timestamp), false
+		}
+	}
+
+	if msg.Data.Thread > t.lastId {
+		// Replies are allowed only to existing messages
+		return ErrMalformed(msg.id, original, msg.timestamp), false
+	}
+
+	t.mentionsNormalize(msg.Data, pc.from)
+
+	head := msg.Data.Head
+	if _, ok := head["checklist"]; ok && !checklistValidate(msg.Data) {
+		return ErrMalformed(msg.id, original, msg.timestamp), false
+	}
+	if cmd, ok := head["cmd"]; ok && types.ParseUserId(cmd).IsZero() {
+		return ErrMalformed(msg.id, original, msg.timestamp), false
+	}
+	if _, ok := head["card"]; ok && !cardValidate(msg.Data.Content) {
+		return ErrMalformed(msg.id, original, msg.timestamp), false
+	}
+	if _, ok := head["event"]; ok && !eventValidate(msg.Data) {
+		return ErrMalformed(msg.id, original, msg.timestamp), false
+	}
+	if action, ok := head["action"]; ok && actionGetHandler(action) == nil {
+		return ErrMalformed(msg.id, original, msg.timestamp), false
+	}
+	if _, ok := head["mime"]; ok {
+		if err := msgTypeValidate(msg.Data); err != nil {
+			logTopic.Warnf("topic[%s]: invalid message, req=%s: %v", t.name, msg.reqId, err)
+			return ErrMalformed(msg.id, original, msg.timestamp), false
+		}
+	}
+	return nil, true
+}
+
+// pubSave stores the message and assigns it the next SeqId. Edits replace the stored message.
+func pubSave(pc *pubContext) (*ServerComMessage, bool) {
+	t, msg := pc.t, pc.msg
+
+	if pc.edit {
+		// replaceMessage responds to the sender
+		return nil, t.replaceMessage(msg, pc.from)
+	}
+	if !msg.deliverAt.IsZero() {
+		// The message is stored until due and published later, scheduleMessage responds to the sender
+		t.scheduleMessage(msg, pc.from)
+		return nil, false
+	}
+
+	stored := &types.Message{
+		ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
+		SeqId:     t.lastId + 1,
+		Topic:     t.name,
+		From:      pc.from.String(),
+		Thread:    msg.Data.Thread,
+		Head:      msg.Data.Head,
+		Content:   msg.Data.Content}
+	var chainHead string
+	if historyChain.enabled {
+		var err error
+		if chainHead, err = t.chainLink(stored); err != nil {
+			logTopic.Errorf("topic[%s]: failed to chain message, req=%s: %v", t.name, msg.reqId, err)
+			return ErrUnknown(msg.id, t.original(pc.from), msg.timestamp), false
+		}
+		// Subscribers receive the hashes with the message
+		msg.Data.Head = stored.Head
+	}
+	journal := complianceWanted(t.name)
+	if journal && !complianceReserve() {
+		logTopic.Warnf("topic[%s]: message rejected, compliance journal is full, req=%s", t.name, msg.reqId)
+		return ErrServiceUnavailable(msg.id, t.original(pc.from), msg.timestamp), false
+	}
+	_, span := traceStart(msg.ctx, "store.Messages.Save", attribute.String("topic", t.name))
+	err := store.Messages.Save(stored)
+	traceEnd(span, err)
+	if err != nil {
+		if journal {
+			complianceRelease()
+		}
+		logTopic.Errorf("topic[%s]: failed to save message, req=%s: %v", t.name, msg.reqId, err)
+		return ErrUnknown(msg.id, t.original(pc.from), msg.timestamp), false
+	}
+	if journal {
+		complianceAppend(stored)
+	}
+
+	t.lastId++
+	if historyChain.enabled {
+		t.chainHead = chainHead
+	}
+	msg.Data.SeqId = t.lastId
+	pc.latency[LATENCY_PERSIST] = latencyMark(msg, LATENCY_PERSIST)
+	searchIndex(stored)
+	webhookMessageSaved(t.webhook, stored)
+
+	if msg.id != "" {
+		reply := NoErrAccepted(msg.id, t.original(msg.sessFrom.uid), msg.timestamp)
+		reply.Ctrl.Params = map[string]int{"seq": t.lastId}
+		msg.sessFrom.queueOut(reply)
+	}
+	return nil, true
+}
+
+// pubFanOut delivers the message to attached sessions, bots and offline users. Edits are delivered to
+// attached sessions only.
+func pubFanOut(pc *pubContext) (*ServerComMessage, bool) {
+	t, msg := pc.t, pc.msg
+
+	var pushRcpt *pushReceipt
+	if !pc.edit {
+		pushRcpt = t.makePushReceipt(msg.Data)
+		t.botsEnqueue(msg.Data)
+
+		// Message sent: notify offline 'R' subscrbers on 'me'. Channels may have too many readers
+		// to notify each of them: readers learn of new messages from the topic's seq on 'me'.
+		if t.cat != types.TopicCat_Chn {
+			t.presSubsOffline("msg", &PresParams{seqId: msg.Data.SeqId}, types.ModeRead, "", true)
+		}
+	}
+
+	_, span := traceStart(msg.ctx, "topic.broadcast",
+		attribute.String("topic", t.name), attribute.Int("sessions", len(t.sessions)))
+	t.fanOut(msg, pushRcpt)
+	if !pc.edit {
+		pc.latency[LATENCY_FANOUT] = latencyMark(msg, LATENCY_FANOUT)
+	}
+
+	if pushRcpt != nil {
+		_, pspan := traceStart(msg.ctx, "push", attribute.Int("recipients", len(pushRcpt.rcpt.To)))
+		push.Push(pushRcpt.rcpt)
+		pspan.End()
+		pushRcpt.releaseIndex()
+	}
+	span.End()
+
+	if !pc.edit {
+		pc.latency[LATENCY_PUSH] = latencyMark(msg, LATENCY_PUSH)
+		latencyCheck(t, msg, &pc.latency)
+	}
+	return nil, true
+}
@@ -0,0 +1,364 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Plugins: external services which are called on account creation, topic
+ *  creation and message publishing. A plugin can accept, reject or modify
+ *  the event, or just observe it. Plugins are called in the order they are
+ *  listed in the config; each plugin sees changes made by the previous ones.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default timeout of a plugin call
+	PLUGIN_DEFAULT_TIMEOUT = 500 * time.Millisecond
+)
+
+// Events plugins can subscribe to
+const (
+	pluginEventAccount = "account"
+	pluginEventTopic   = "topic"
+	pluginEventMessage = "message"
+	pluginEventInline  = "inline"
+)
+
+// Plugin decisions
+const (
+	pluginActionAccept = "accept"
+	pluginActionReject = "reject"
+	pluginActionModify = "modify"
+)
+
+type pluginFilters struct {
+	// Call the plugin when a new account is created
+	Account bool `json:"account"`
+	// Call the plugin when a new group topic is created
+	Topic bool `json:"topic"`
+	// Call the plugin when a message is published
+	Message bool `json:"message"`
+	// The plugin answers inline queries to the bot
+	Inline bool `json:"inline"`
+}
+
+type pluginConfig struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`
+	// Timeout of a call in milliseconds
+	Timeout int           `json:"timeout"`
+	Filters pluginFilters `json:"filters"`
+	// The plugin only observes events: it's called asynchronously and the response is ignored
+	Observe bool `json:"observe"`
+	// Reject the event with this code if the plugin cannot be reached, 0 to accept
+	FailureCode int    `json:"failure_code"`
+	FailureText string `json:"failure_text"`
+	// Address of the service, e.g. http://localhost:8080/hooks
+	ServiceAddr string `json:"service_addr"`
+	// User ID of the bot the plugin answers inline queries for, e.g. "usrAbCd"
+	Bot string `json:"bot"`
+}
+
+// pluginRequest is sent to the plugin.
+type pluginRequest struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"ts"`
+	// User who caused the event
+	User string `json:"user,omitempty"`
+	// Topic affected by the event
+	Topic string `json:"topic,omitempty"`
+
+	// Message headers and content (message event)
+	Head    map[string]string `json:"head,omitempty"`
+	Content interface{}       `json:"content,omitempty"`
+	// Public data and tags of the new account or topic (account and topic events)
+	Public interface{} `json:"public,omitempty"`
+	Tags   []string    `json:"tags,omitempty"`
+
+	// Inline query and offset of the requested page (inline event)
+	Query  string `json:"query,omitempty"`
+	Offset string `json:"offset,omitempty"`
+}
+
+// pluginResponse is the plugin's decision.
+type pluginResponse struct {
+	// "accept" (default), "reject" or "modify"
+	Action string `json:"action"`
+	// Error code and text to report to the client when the event is rejected
+	Code int    `json:"code,omitempty"`
+	Text string `json:"text,omitempty"`
+
+	// Replacement values for "modify". Missing values are left unchanged.
+	Head    map[string]string `json:"head,omitempty"`
+	Content interface{}       `json:"content,omitempty"`
+	Public  interface{}       `json:"public,omitempty"`
+	Tags    []string          `json:"tags,omitempty"`
+
+	// Results of the inline query and offset of the next page
+	Results []interface{} `json:"results,omitempty"`
+	Next    string        `json:"next,omitempty"`
+}
+
+// pluginTransport delivers requests to the plugin service.
+type pluginTransport interface {
+	call(req *pluginRequest) (*pluginResponse, error)
+}
+
+type plugin struct {
+	name        string
+	filters     pluginFilters
+	observe     bool
+	failureCode int
+	failureText string
+	bot         types.Uid
+	transport   pluginTransport
+}
+
+var plugins []*plugin
+
+// pluginsInit parses config and connects to the plugin services.
+func pluginsInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config []pluginConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logPlugins.Fatal("Failed to parse plugins config:", err)
+	}
+
+	for i := range config {
+		conf := &config[i]
+		if !conf.Enabled {
+			continue
+		}
+
+		timeout := time.Duration(conf.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = PLUGIN_DEFAULT_TIMEOUT
+		}
+
+		var bot types.Uid
+		if conf.Filters.Inline {
+			if bot = types.ParseUserId(conf.Bot); bot.IsZero() {
+				logPlugins.Fatal("Plugin '" + conf.Name + "' answers inline queries but has no valid bot")
+			}
+		}
+
+		transport, err := pluginNewTransport(conf.ServiceAddr, timeout)
+		if err != nil {
+			logPlugins.Fatal("Failed to initialize plugin '"+conf.Name+"':", err)
+		}
+
+		plugins = append(plugins, &plugin{
+			name:        conf.Name,
+			filters:     conf.Filters,
+			observe:     conf.Observe,
+			failureCode: conf.FailureCode,
+			failureText: conf.FailureText,
+			bot:         bot,
+			transport:   transport})
+		logPlugins.Infof("Using plugin '%s' at %s", conf.Name, conf.ServiceAddr)
+	}
+}
+
+// pluginNewTransport creates a transport for the service address. Only HTTP(S) services are supported.
+func pluginNewTransport(addr string, timeout time.Duration) (pluginTransport, error) {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return &pluginHttpTransport{
+			addr:   strings.TrimSuffix(addr, "/"),
+			client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, errors.New("unsupported service address '" + addr + "'")
+}
+
+// pluginHttpTransport posts JSON-serialized requests to <addr>/<event>.
+type pluginHttpTransport struct {
+	addr   string
+	client *http.Client
+}
+
+func (ht *pluginHttpTransport) call(req *pluginRequest) (*pluginResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ht.client.Post(ht.addr+"/"+req.Event, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected response status " + resp.Status)
+	}
+
+	var result pluginResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (p *plugin) wants(event string) bool {
+	switch event {
+	case pluginEventAccount:
+		return p.filters.Account
+	case pluginEventTopic:
+		return p.filters.Topic
+	case pluginEventMessage:
+		return p.filters.Message
+	}
+	return false
+}
+
+// pluginInlineGet returns the plugin which answers inline queries to the bot or nil.
+func pluginInlineGet(bot types.Uid) *plugin {
+	for _, p := range plugins {
+		if p.filters.Inline && p.bot == bot {
+			return p
+		}
+	}
+	return nil
+}
+
+// pluginsCall passes the event to all interested plugins in order. Returns the error to report
+// to the client if the event was rejected, otherwise the (possibly modified) request.
+func pluginsCall(req *pluginRequest, id, topic string) (*pluginRequest, *ServerComMessage) {
+	for _, p := range plugins {
+		if !p.wants(req.Event) {
+			continue
+		}
+
+		if p.observe {
+			// Make a copy: the request may be modified by the subsequent plugins.
+			observed := *req
+			go func(p *plugin) {
+				if _, err := p.transport.call(&observed); err != nil {
+					logPlugins.Warnf("plugin[%s]: %s", p.name, err.Error())
+				}
+			}(p)
+			continue
+		}
+
+		resp, err := p.transport.call(req)
+		if err != nil {
+			logPlugins.Warnf("plugin[%s]: %s", p.name, err.Error())
+			if p.failureCode != 0 {
+				return nil, pluginReject(p.failureCode, p.failureText, id, topic, req.Timestamp)
+			}
+			continue
+		}
+
+		switch resp.Action {
+		case pluginActionReject:
+			return nil, pluginReject(resp.Code, resp.Text, id, topic, req.Timestamp)
+		case pluginActionModify:
+			if resp.Head != nil {
+				req.Head = resp.Head
+			}
+			if resp.Content != nil {
+				req.Content = resp.Content
+			}
+			if resp.Public != nil {
+				req.Public = resp.Public
+			}
+			if resp.Tags != nil {
+				req.Tags = resp.Tags
+			}
+		}
+	}
+	return req, nil
+}
+
+func pluginReject(code int, text, id, topic string, ts time.Time) *ServerComMessage {
+	if code < 400 || code > 599 {
+		return ErrPolicy(id, topic, ts)
+	}
+	if text == "" {
+		text = http.StatusText(code)
+	}
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      code,
+		Text:      text,
+		Topic:     topic,
+		Timestamp: ts}}
+}
+
+// pluginMessage is called before a {pub} message is saved and broadcast.
+func pluginMessage(msg *ServerComMessage) *ServerComMessage {
+	if len(plugins) == 0 {
+		return nil
+	}
+
+	_, span := traceStart(msg.ctx, "plugins.message")
+	defer span.End()
+
+	req, reject := pluginsCall(&pluginRequest{
+		Event:     pluginEventMessage,
+		Timestamp: msg.timestamp,
+		User:      msg.Data.From,
+		Topic:     msg.rcptto,
+		Head:      msg.Data.Head,
+		Content:   msg.Data.Content}, msg.id, msg.Data.Topic)
+	if reject != nil {
+		return reject
+	}
+
+	msg.Data.Head = req.Head
+	msg.Data.Content = req.Content
+	return nil
+}
+
+// pluginAccount is called before a new account is saved.
+func pluginAccount(user *types.User, id string, ts time.Time) *ServerComMessage {
+	if len(plugins) == 0 {
+		return nil
+	}
+
+	req, reject := pluginsCall(&pluginRequest{
+		Event:     pluginEventAccount,
+		Timestamp: ts,
+		Public:    user.Public,
+		Tags:      user.Tags}, id, "")
+	if reject != nil {
+		return reject
+	}
+
+	user.Public = req.Public
+	user.Tags = req.Tags
+	return nil
+}
+
+// pluginTopic is called before a new group topic is saved.
+func pluginTopic(topic *types.Topic, owner types.Uid, id, original string, ts time.Time) *ServerComMessage {
+	if len(plugins) == 0 {
+		return nil
+	}
+
+	req, reject := pluginsCall(&pluginRequest{
+		Event:     pluginEventTopic,
+		Timestamp: ts,
+		User:      owner.UserId(),
+		Topic:     topic.Id,
+		Public:    topic.Public}, id, original)
+	if reject != nil {
+		return reject
+	}
+
+	topic.Public = req.Public
+	return nil
+}
@@ -1,9 +1,6 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
-
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -58,6 +55,14 @@ func (t *Topic) loadContacts(uid types.Uid) error {
 		//log.Printf("Pres loadContacts: topic[%s]: processing sub '%s'", t.name, sub.Topic)
 		t.addToPerSubs(sub.Topic, false)
 	}
+
+	// Accepted contacts exchange presence too
+	if err = t.loadAcceptedContacts(uid); err != nil {
+		return err
+	}
+	for contact := range t.contacts {
+		t.addToPerSubs(contact.UserId(), false)
+	}
 	//log.Printf("Pres loadContacts: topic[%s]: total cached %d", t.name, len(t.perSubs))
 	return nil
 }
@@ -106,7 +111,7 @@ func (t *Topic) presProcReq(fromUserId string, what string, wantReply bool) {
 		}
 	}
 
-	if (online || unknown) && doReply {
+	if (online || unknown) && doReply && t.presVisibleTo(fromUserId) {
 		globals.hub.route <- &ServerComMessage{
 			// Topic is 'me' even for group topics; group topics will use 'me' as a signal to drop the message
 			// without forwarding to sessions
@@ -125,6 +130,14 @@ func (t *Topic) presProcReq(fromUserId string, what string, wantReply bool) {
 func (t *Topic) presUsersOfInterest(what string, ua string) {
 	// Push update to subscriptions
 	for topic, _ := range t.perSubs {
+		if t.blocked[types.ParseUserId(topic)] {
+			// Blocked users don't see the user's presence
+			continue
+		}
+		if what != "upd" && !t.presVisibleTo(topic) {
+			// Hidden by the user's privacy settings
+			continue
+		}
 		globals.hub.route <- &ServerComMessage{
 			Pres: &MsgServerPres{
 				Topic: "me", What: what, Src: t.name, UserAgent: ua, wantReply: (what == "on")},
@@ -169,15 +182,18 @@ func (t *Topic) presSubsOnline(what, src string, params *PresParams, filter type
 }
 
 // Send presence notification to attached sessions directly, without routing though topic.
-func (t *Topic) presSubsOnlineDirect(what string) {
+func (t *Topic) presSubsOnlineDirect(what string, skipProxied bool) {
 	msg := &ServerComMessage{Pres: &MsgServerPres{Topic: t.x_original, What: what}}
 
 	var packet []byte
 	if t.cat != types.TopicCat_P2P {
-		packet, _ = json.Marshal(msg)
+		packet = encodePacket(msg)
 	}
 
 	for sess := range t.sessions {
+		if skipProxied && sess.proto == RPC {
+			continue
+		}
 		// Check presence filters
 		pud, _ := t.perUser[sess.uid]
 		if !(pud.modeGiven & pud.modeWant).IsPresencer() {
@@ -187,13 +203,10 @@ func (t *Topic) presSubsOnlineDirect(what string) {
 		if t.cat == types.TopicCat_P2P {
 			// For p2p topics topic name is dependent on receiver
 			msg.Pres.Topic = t.original(sess.uid)
-			packet, _ = json.Marshal(msg)
+			packet = encodePacket(msg)
 		}
 
-		select {
-		case sess.send <- packet:
-		default:
-		}
+		sess.enqueue(packet, SEND_CLASS_PRES)
 	}
 }
 
@@ -364,7 +377,7 @@ func (t *Topic) presPubMessageCount(uid types.Uid, list []int, clear, recv, read
 		// Attached topics will receive an {info}
 		t.presSingleUserOffline(uid, what, &PresParams{seqId: seq, seqList: list}, skip, true)
 	} else {
-		log.Printf("Case U, V1: topic[%s] invalid request - missing payload", t.name)
+		logPres.Warnf("Case U, V1: topic[%s] invalid request - missing payload", t.name)
 	}
 }
 
@@ -0,0 +1,177 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Presence privacy of users. A user changes the settings with
+ *    {set topic="me" privacy={invisible: true, hideseen: true, contacts: true}}
+ *  which replaces the current settings; all false restores the defaults.
+ *  The settings are stored with the user and are reported to the user in
+ *  {meta desc} of 'me'.
+ *    - invisible: the user appears offline to everyone;
+ *    - hideseen: the time when the user was last seen is not shown;
+ *    - contacts: only accepted contacts see the user online.
+ *  The settings are enforced by the user's 'me' topic when it sends presence
+ *  to other users and when other users request their subscriptions on 'me'.
+ *  Changes of 'public' are still reported. Presence in group topics, i.e.
+ *  being attached to the topic, is not affected.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// presVisibleTo checks if the user or the topic may see the presence of the topic's owner.
+func (t *Topic) presVisibleTo(topic string) bool {
+	uid := types.ParseUserId(topic)
+	if t.blocked[uid] {
+		return false
+	}
+	if t.cat != types.TopicCat_Me || uid.IsZero() {
+		// Group topics get the user's status to reply with their own
+		return true
+	}
+	if t.privacy.Invisible {
+		return false
+	}
+	return !t.privacy.ContactsOnly || t.contacts[uid]
+}
+
+// privacyDesc returns the privacy settings of the owner of 'me' for {meta desc}.
+func (t *Topic) privacyDesc() *MsgPrivacy {
+	if t.cat != types.TopicCat_Me || t.privacy == (types.PresencePrivacy{}) {
+		return nil
+	}
+	return &MsgPrivacy{
+		Invisible:    t.privacy.Invisible,
+		HideLastSeen: t.privacy.HideLastSeen,
+		ContactsOnly: t.privacy.ContactsOnly}
+}
+
+// loadAcceptedContacts loads the set of accepted contacts of the owner of 'me'.
+func (t *Topic) loadAcceptedContacts(uid types.Uid) error {
+	contacts, err := store.Contacts.GetAll(uid)
+	if err != nil {
+		return err
+	}
+	t.contacts = make(map[types.Uid]bool)
+	for i := range contacts {
+		if contacts[i].Status == types.ContactAccepted {
+			t.contacts[types.ParseUid(contacts[i].Contact)] = true
+		}
+	}
+	return nil
+}
+
+// contactsChanged reloads accepted contacts after the other user changed the contact list and tells
+// newly accepted contacts that the user is online if they may see it.
+func (t *Topic) contactsChanged() {
+	if t.cat != types.TopicCat_Me {
+		return
+	}
+	before := t.contacts
+	if err := t.loadAcceptedContacts(types.ParseUserId(t.name)); err != nil {
+		logTopic.Warnf("topic[%s]: failed to reload contacts: %v", t.name, err)
+		t.contacts = before
+		return
+	}
+	if len(t.sessions) == 0 {
+		return
+	}
+	for uid := range t.contacts {
+		if !before[uid] && t.presVisibleTo(uid.UserId()) {
+			globals.hub.route <- &ServerComMessage{
+				Pres:   &MsgServerPres{Topic: "me", What: "on", Src: t.name, UserAgent: t.userAgent},
+				rcptto: uid.UserId()}
+		}
+	}
+}
+
+// presenceHiddenBy finds users among the users of the subscriptions who hide their presence from
+// the given user: the users who blocked the given user or hide it by privacy settings. Returned are
+// IDs of the users who appear offline and IDs of the users whose last seen time is not shown.
+// contacts are accepted contacts of the given user.
+func presenceHiddenBy(uid types.Uid, contacts map[types.Uid]bool, subs []types.Subscription) (
+	offline, unseen map[string]bool, err error) {
+
+	var uids []types.Uid
+	for i := range subs {
+		if other := types.ParseUserId(subs[i].GetWith()); !other.IsZero() {
+			uids = append(uids, other)
+		}
+	}
+	if len(uids) == 0 {
+		return nil, nil, nil
+	}
+
+	users, err := store.Users.GetAll(uids...)
+	if err != nil {
+		return nil, nil, err
+	}
+	offline = make(map[string]bool)
+	unseen = make(map[string]bool)
+	for i := range users {
+		user := &users[i]
+		id := user.Uid().UserId()
+		if blocks(user, uid) || user.Privacy.Invisible || (user.Privacy.ContactsOnly && !contacts[user.Uid()]) {
+			offline[id] = true
+			unseen[id] = true
+		} else if user.Privacy.HideLastSeen {
+			unseen[id] = true
+		}
+	}
+	return offline, unseen, nil
+}
+
+// replySetPrivacy changes the presence privacy settings in response to set.privacy on 'me'.
+func (t *Topic) replySetPrivacy(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCat_Me {
+		sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
+		return errors.New("privacy changed outside of 'me'")
+	}
+
+	privacy := types.PresencePrivacy{
+		Invisible:    set.Privacy.Invisible,
+		HideLastSeen: set.Privacy.HideLastSeen,
+		ContactsOnly: set.Privacy.ContactsOnly}
+	if privacy == t.privacy {
+		sess.queueOut(InfoNoAction(set.Id, set.Topic, now))
+		return nil
+	}
+
+	if err := store.Users.Update(sess.uid, map[string]interface{}{"Privacy": privacy}); err != nil {
+		sess.queueOut(ErrUnknown(set.Id, set.Topic, now))
+		return err
+	}
+
+	// Users who saw the user before the change
+	visible := make(map[string]bool, len(t.perSubs))
+	for topic := range t.perSubs {
+		visible[topic] = t.presVisibleTo(topic)
+	}
+	t.privacy = privacy
+
+	// Hide the user from those who may no longer see the user's presence, show to the others again
+	if len(t.sessions) > 0 {
+		for topic := range t.perSubs {
+			if show := t.presVisibleTo(topic); show != visible[topic] {
+				pres := &MsgServerPres{Topic: "me", What: "off", Src: t.name}
+				if show {
+					pres = &MsgServerPres{Topic: "me", What: "on", Src: t.name, UserAgent: t.userAgent,
+						wantReply: true}
+				}
+				globals.hub.route <- &ServerComMessage{Pres: pres, rcptto: topic}
+			}
+		}
+	}
+
+	sess.queueOut(NoErr(set.Id, set.Topic, now))
+	return nil
+}
@@ -0,0 +1,287 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Provisioning of group topics by external systems. Root admins create
+ *  topics and add members in bulk with
+ *    POST /v0/admin/topics
+ *    {"topics": [{"key": "crm:account:42", "ref": "account/42",
+ *      "owner": "usr...", "defacs": {"auth": "JRWPS", "anon": "N"},
+ *      "public": {...}, "members": [{"user": "usr...", "mode": "JRWPS"}]}]}
+ *  The key identifies the topic to the external system: the name of the
+ *  topic is derived from the key, so repeating the request with the same key
+ *  does not create another topic. The topic is created if it does not exist,
+ *  members who are not subscribed yet are added, existing subscriptions are
+ *  not changed. The ref is stored with the topic and reported in {meta desc}
+ *  to administrators of the topic. It's updated if it changes.
+ *
+ *  The reply lists the results in the order of the request:
+ *    {"topics": [{"key": "...", "topic": "grp...", "created": true,
+ *      "added": 2}]}
+ *  A failed item has "error" set, the other items are still processed.
+ *  Added members are told about the subscription as if they were invited.
+ *  Banned users are not added.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the admin endpoint
+	ADMIN_PROVISION_PATH = "/v0/admin/topics"
+	// Maximum number of topics in one request
+	PROVISION_MAX_TOPICS = 100
+	// Maximum number of members of one topic in one request
+	PROVISION_MAX_MEMBERS = 256
+	// Maximum length of the key and of the external reference
+	PROVISION_MAX_KEY_LENGTH = 128
+	// Access given to members by default
+	PROVISION_DEFAULT_MODE = "JRWPS"
+)
+
+type provisionMember struct {
+	User string `json:"user"`
+	// Access mode, PROVISION_DEFAULT_MODE if empty
+	Mode string `json:"mode"`
+}
+
+type provisionTopic struct {
+	// Idempotency key of the topic
+	Key string `json:"key"`
+	// Reference to the entity of the external system
+	Ref string `json:"ref"`
+	// Owner of the new topic, ignored if the topic exists
+	Owner string `json:"owner"`
+	// Default access and public of the new topic, ignored if the topic exists
+	DefaultAcs *MsgDefaultAcsMode `json:"defacs"`
+	Public     interface{}        `json:"public"`
+	Members    []provisionMember  `json:"members"`
+}
+
+type provisionRequest struct {
+	Topics []provisionTopic `json:"topics"`
+}
+
+type provisionResult struct {
+	Key     string `json:"key"`
+	Topic   string `json:"topic,omitempty"`
+	Created bool   `json:"created,omitempty"`
+	// Number of members added
+	Added int    `json:"added,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// provisionTopicName derives the name of the group topic from the idempotency key.
+func provisionTopicName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	var uid types.Uid
+	if err := uid.UnmarshalBinary(sum[:8]); err != nil {
+		return ""
+	}
+	return "grp" + uid.String()
+}
+
+// provision creates the topic if needed and adds missing members.
+func provision(item *provisionTopic) (*provisionResult, error) {
+	res := &provisionResult{Key: item.Key}
+	if item.Key == "" || len(item.Key) > PROVISION_MAX_KEY_LENGTH || len(item.Ref) > PROVISION_MAX_KEY_LENGTH ||
+		len(item.Members) > PROVISION_MAX_MEMBERS {
+		return res, errors.New("invalid key, ref or too many members")
+	}
+
+	members := make(map[types.Uid]types.AccessMode, len(item.Members))
+	for _, m := range item.Members {
+		uid := types.ParseUserId(m.User)
+		if uid.IsZero() {
+			return res, errors.New("invalid member '" + m.User + "'")
+		}
+		if m.Mode == "" {
+			m.Mode = PROVISION_DEFAULT_MODE
+		}
+		var mode types.AccessMode
+		if err := mode.UnmarshalText([]byte(m.Mode)); err != nil || mode.IsOwner() || !mode.IsJoiner() {
+			return res, errors.New("invalid access of member '" + m.User + "'")
+		}
+		members[uid] = mode
+	}
+
+	res.Topic = provisionTopicName(item.Key)
+	stopic, err := store.Topics.Get(res.Topic)
+	if err != nil {
+		return res, err
+	}
+
+	var owner types.Uid
+	if stopic == nil {
+		if owner = types.ParseUserId(item.Owner); owner.IsZero() {
+			return res, errors.New("owner is required to create the topic")
+		}
+		auth, anon, err := parseTopicAccess(item.DefaultAcs, getDefaultAccess(types.TopicCat_Grp, true),
+			getDefaultAccess(types.TopicCat_Grp, false))
+		if err != nil || auth.IsOwner() || anon.IsOwner() {
+			return res, errors.New("invalid default access")
+		}
+		stopic = &types.Topic{
+			ObjHeader:   types.ObjHeader{Id: res.Topic},
+			Access:      types.DefaultAccess{Auth: auth, Anon: anon},
+			ExternalRef: item.Ref,
+			Public:      item.Public}
+		stopic.GiveAccess(owner, types.ModeCFull, types.ModeCFull)
+		if err = store.Topics.Create(stopic, owner, nil); err != nil {
+			return res, err
+		}
+		res.Created = true
+	} else if stopic.ExternalRef != item.Ref {
+		if err = store.Topics.Update(res.Topic, map[string]interface{}{"ExternalRef": item.Ref}); err != nil {
+			return res, err
+		}
+	}
+
+	subs, err := store.Topics.GetSubs(res.Topic)
+	if err != nil {
+		return res, err
+	}
+	for i := range subs {
+		uid := types.ParseUid(subs[i].User)
+		delete(members, uid)
+		if (subs[i].ModeGiven & subs[i].ModeWant).IsOwner() {
+			owner = uid
+		}
+	}
+	for _, banned := range stopic.Banned {
+		delete(members, types.ParseUid(banned))
+	}
+
+	var added []*types.Subscription
+	for uid, mode := range members {
+		added = append(added, &types.Subscription{
+			User:      uid.String(),
+			Topic:     res.Topic,
+			ModeWant:  mode,
+			ModeGiven: mode})
+	}
+	if len(added) > 0 {
+		if err = store.Subs.Create(added...); err != nil {
+			return res, err
+		}
+		res.Added = len(added)
+	}
+
+	if res.Created || len(added) > 0 || stopic.ExternalRef != item.Ref {
+		// Loaded topic picks up the changes, otherwise they are loaded with the topic
+		globals.hub.route <- &ServerComMessage{
+			Info:   &MsgServerInfo{Topic: res.Topic, What: "provision"},
+			rcptto: res.Topic, timestamp: types.TimeNow()}
+	}
+	for _, sub := range added {
+		webhookMemberChanged(stopic.Webhook, res.Topic, types.ParseUid(sub.User), "join", sub.ModeWant, sub.ModeGiven)
+		presSingleUserOfflineOffline(types.ParseUid(sub.User), res.Topic, "acs", sub.ModeGiven, &PresParams{
+			dWant:  types.ModeNone.Delta(sub.ModeWant),
+			dGiven: types.ModeNone.Delta(sub.ModeGiven),
+			actor:  owner.UserId()}, "")
+	}
+
+	return res, nil
+}
+
+// provisionReload loads the external reference and new subscriptions after the topic was provisioned.
+func (t *Topic) provisionReload() {
+	stopic, err := store.Topics.Get(t.name)
+	if err != nil || stopic == nil {
+		logTopic.Warnf("topic[%s]: failed to reload provisioned topic: %v", t.name, err)
+		return
+	}
+	t.externalRef = stopic.ExternalRef
+
+	subs, err := store.Topics.GetSubs(t.name)
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to reload subscriptions: %v", t.name, err)
+		return
+	}
+	for i := range subs {
+		sub := &subs[i]
+		uid := types.ParseUid(sub.User)
+		if _, ok := t.perUser[uid]; ok {
+			continue
+		}
+		t.perUser[uid] = perUserData{
+			created:   sub.CreatedAt,
+			updated:   sub.UpdatedAt,
+			clearId:   sub.ClearId,
+			readId:    sub.ReadSeqId,
+			recvId:    sub.RecvSeqId,
+			private:   sub.Private,
+			notify:    sub.Notify,
+			modeWant:  sub.ModeWant,
+			modeGiven: sub.ModeGiven}
+	}
+}
+
+// serveProvision creates topics and memberships in bulk:
+// POST /v0/admin/topics
+func serveProvision(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	admin, authLvl, err := authHttpRequestLevel(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	} else if authLvl != auth.LevelRoot {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	var body provisionRequest
+	if err = json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Topics) == 0 ||
+		len(body.Topics) > PROVISION_MAX_TOPICS {
+		writeErr(ErrMalformed("", "", now))
+		return
+	}
+
+	results := make([]*provisionResult, 0, len(body.Topics))
+	for i := range body.Topics {
+		res, err := provision(&body.Topics[i])
+		if err != nil {
+			logMain.Warnf("provision: '%s' failed: %v", res.Key, err)
+			res.Error = err.Error()
+		} else if res.Created || res.Added > 0 {
+			logAudit.Infof("provision: '%s' provisioned '%s' for '%s', created: %t, added %d", admin.UserId(),
+				res.Topic, res.Key, res.Created, res.Added)
+		}
+		results = append(results, res)
+	}
+
+	enc.Encode(map[string]interface{}{"topics": results})
+}
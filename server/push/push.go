@@ -17,6 +17,8 @@ type PushTo struct {
 	Delieved int `json:"delivered"`
 	// List of user's devices that the packet was delivered to (if known). Len(Devices) >= Delivered
 	Devices []string `json:"devices,omitempty"`
+	// The user is mentioned in the message. Handlers may deliver such notifications with a higher priority.
+	Mentioned bool `json:"mentioned,omitempty"`
 }
 
 type Receipt struct {
@@ -48,10 +50,16 @@ type PushHandler interface {
 	// The message will be dropped if the channel blocks.
 	Push() chan<- *Receipt
 
-	// Stop operations
+	// Stop operations. The handler should send the messages already queued before returning.
 	Stop()
 }
 
+// Reloader is implemented by handlers which can change configuration at runtime, e.g. rotate credentials.
+type Reloader interface {
+	// Reload applies the new configuration to the initialized handler
+	Reload(jsonconf string) error
+}
+
 type configType struct {
 	Name   string          `json:"name"`
 	Config json.RawMessage `json:"config"`
@@ -59,6 +67,9 @@ type configType struct {
 
 var handlers map[string]PushHandler
 
+// Device platforms, e.g. "ios", served directly by a dedicated handler
+var claimedPlatforms map[string]string
+
 // Register a push handler
 func Register(name string, hnd PushHandler) {
 	if handlers == nil {
@@ -93,6 +104,48 @@ func Init(jsconfig string) error {
 	return nil
 }
 
+// ClaimPlatform is called by an enabled handler which delivers notifications to devices of the
+// platform directly, e.g. APNs for "ios". General-purpose handlers skip devices of claimed platforms.
+func ClaimPlatform(platform, name string) {
+	if claimedPlatforms == nil {
+		claimedPlatforms = make(map[string]string)
+	}
+	if other, dup := claimedPlatforms[platform]; dup && other != name {
+		panic("ClaimPlatform: platform " + platform + " is claimed by " + other)
+	}
+	claimedPlatforms[platform] = name
+}
+
+// IsPlatformClaimed checks if devices of the platform are served by a dedicated handler.
+func IsPlatformClaimed(platform string) bool {
+	_, ok := claimedPlatforms[platform]
+	return ok
+}
+
+// Reload passes the new configuration to the initialized handlers which support reloading.
+// Handlers which were not initialized at startup cannot be enabled at runtime.
+func Reload(jsconfig string) error {
+	var config []configType
+
+	if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	for _, cc := range config {
+		hnd := handlers[cc.Name]
+		if hnd == nil || !hnd.IsReady() {
+			continue
+		}
+		if r, ok := hnd.(Reloader); ok {
+			if err := r.Reload(string(cc.Config)); err != nil {
+				return errors.New(cc.Name + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
 // Push a single message
 func Push(msg *Receipt) {
 	if handlers == nil {
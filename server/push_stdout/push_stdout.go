@@ -17,6 +17,7 @@ type StdoutPush struct {
 	initialized bool
 	input       chan *push.Receipt
 	stop        chan bool
+	done        chan bool
 }
 
 type configType struct {
@@ -49,6 +50,7 @@ func (StdoutPush) Init(jsonconf string) error {
 
 	handler.input = make(chan *push.Receipt, config.Buffer)
 	handler.stop = make(chan bool, 1)
+	handler.done = make(chan bool)
 
 	go func() {
 		for {
@@ -56,6 +58,11 @@ func (StdoutPush) Init(jsonconf string) error {
 			case msg := <-handler.input:
 				fmt.Fprintln(os.Stdout, msg)
 			case <-handler.stop:
+				// Flush receipts already queued
+				for len(handler.input) > 0 {
+					fmt.Fprintln(os.Stdout, <-handler.input)
+				}
+				close(handler.done)
 				return
 			}
 		}
@@ -75,8 +82,13 @@ func (StdoutPush) Push() chan<- *push.Receipt {
 	return handler.input
 }
 
+// Stop writes the queued receipts and stops the handler.
 func (StdoutPush) Stop() {
+	if handler.input == nil {
+		return
+	}
 	handler.stop <- true
+	<-handler.done
 }
 
 func init() {
@@ -0,0 +1,133 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Reactions to messages. Subscribers react with
+ *    {note what="react" seq=N react="👍"}
+ *  and take the reaction back with {note what="unreact" seq=N react="👍"}.
+ *  The reactions are stored with the message, by reaction and user. The
+ *  change is broadcast as {info} with the updated counts of all reactions
+ *  to the message; {data} served by {get what="data"} carries the counts
+ *  and the reactions of the requesting user.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum length of a reaction in bytes: a few emoji joined into one
+	REACTION_MAX_LENGTH = 32
+	// Maximum number of different reactions to one message
+	REACTION_MAX_DISTINCT = 32
+	// Maximum number of reactions of one user to one message
+	REACTION_MAX_PER_USER = 8
+)
+
+// isValidReaction checks that the reaction is a short string without spaces or control characters.
+func isValidReaction(react string) bool {
+	if react == "" || len(react) > REACTION_MAX_LENGTH || !utf8.ValidString(react) {
+		return false
+	}
+	return strings.IndexFunc(react, func(r rune) bool { return r <= ' ' || r == 0x7f }) < 0
+}
+
+// reactionCounts counts users by reaction.
+func reactionCounts(reactions map[string][]string) map[string]int {
+	if len(reactions) == 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(reactions))
+	for react, users := range reactions {
+		counts[react] = len(users)
+	}
+	return counts
+}
+
+// reactionsOf returns the reactions of the user.
+func reactionsOf(reactions map[string][]string, uid types.Uid) []string {
+	var mine []string
+	user := uid.UserId()
+	for react, users := range reactions {
+		for _, u := range users {
+			if u == user {
+				mine = append(mine, react)
+				break
+			}
+		}
+	}
+	return mine
+}
+
+// messageReact adds or removes user's reaction to the message. Returns true if the reactions have changed
+// and should be broadcast. The updated counts are returned in info.Reactions.
+func (t *Topic) messageReact(uid types.Uid, info *MsgServerInfo) bool {
+	pud := t.perUser[uid]
+	if !(pud.modeGiven & pud.modeWant).IsReader() || info.SeqId <= pud.clearId {
+		return false
+	}
+
+	messages, err := store.Messages.GetAll(t.name, uid,
+		&types.BrowseOpt{Since: info.SeqId, Before: info.SeqId + 1, Limit: 1})
+	if err != nil {
+		logTopic.Warnf("topic[%s]: failed to load message for reaction: %v", t.name, err)
+		return false
+	}
+	if len(messages) == 0 || messages[0].DeletedAt != nil {
+		return false
+	}
+	msg := &messages[0]
+
+	reactions := msg.Reactions
+	if reactions == nil {
+		reactions = make(map[string][]string)
+	}
+	user := uid.UserId()
+	users := reactions[info.React]
+	pos := -1
+	for i, u := range users {
+		if u == user {
+			pos = i
+			break
+		}
+	}
+
+	if info.What == "react" {
+		if pos >= 0 {
+			// Already reacted
+			return false
+		}
+		if len(users) == 0 && len(reactions) >= REACTION_MAX_DISTINCT {
+			return false
+		}
+		if len(reactionsOf(reactions, uid)) >= REACTION_MAX_PER_USER {
+			return false
+		}
+		reactions[info.React] = append(users, user)
+	} else {
+		if pos < 0 {
+			return false
+		}
+		users = append(users[:pos], users[pos+1:]...)
+		if len(users) == 0 {
+			delete(reactions, info.React)
+		} else {
+			reactions[info.React] = users
+		}
+	}
+
+	if err = store.Messages.Update(t.name, info.SeqId, map[string]interface{}{"Reactions": reactions}); err != nil {
+		logTopic.Errorf("topic[%s]: failed to update reactions: %v", t.name, err)
+		return false
+	}
+
+	info.Reactions = reactionCounts(reactions)
+	return true
+}
@@ -0,0 +1,530 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Active-passive deployment across regions. The primary region serves
+ *  clients. The standby region runs the same configuration against its own
+ *  copy of the database, serves no clients and runs no background jobs.
+ *
+ *  The standby keeps its database up to date by repeating the writes of the
+ *  primary. Every node of the primary records its writes in memory, see
+ *  store/changes.go, and serves them at /v0/admin/region/changes to the
+ *  holders of "stream_key". Every node of the primary is tailed by one node
+ *  of the standby, chosen by the ring hash of its URL. A restarted primary
+ *  node or a standby which fell too far behind loses changes: they are
+ *  counted in RegionStream.lost and the standby database must be copied
+ *  again.
+ *
+ *  Failover is performed through the admin endpoint /v0/admin/region:
+ *    POST ?action=promote on the standby asks the primary to step down and
+ *      makes the standby the primary. The old primary may be unreachable;
+ *    POST ?action=demote&primary=<url> turns the region into a standby:
+ *      connected clients receive {ctrl code=307 params={url}} and are
+ *      disconnected, new connections are redirected to the primary.
+ *  In a cluster the role is changed on all nodes of the region. A promoted
+ *  standby repeats the remaining changes of the old primary before it
+ *  accepts writes; a demoted primary starts tailing the new one from the
+ *  current position of its stream.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the admin endpoint
+	ADMIN_REGION_PATH = "/v0/admin/region"
+	// Path of the stream of changes
+	ADMIN_REGION_CHANGES_PATH = "/v0/admin/region/changes"
+	// Timeout of the request to the old primary on promotion
+	REGION_DEMOTE_TIMEOUT = 10 * time.Second
+	// Timeout of the request for the changes
+	REGION_STREAM_TIMEOUT = 10 * time.Second
+	// Default interval between the requests for the changes, milliseconds
+	REGION_DEFAULT_POLL_INTERVAL = 500
+	// Largest number of changes sent in one response
+	REGION_CHANGES_BATCH = 1024
+)
+
+type regionConfig struct {
+	// Name of the region, e.g. "us-east"
+	Name string `json:"name"`
+	// Base URL of the region as seen by clients, e.g. "https://us-east.example.com"
+	Url string `json:"url"`
+	// This region starts as a standby
+	Standby bool `json:"standby"`
+	// Base URL of the primary region, required for the standby
+	PrimaryUrl string `json:"primary_url"`
+	// Base URLs of the nodes of the other region, e.g. "http://10.1.0.5:6060". The standby repeats
+	// the changes made by these nodes.
+	PeerNodes []string `json:"peer_nodes"`
+	// Shared secret which authorizes the requests for the changes
+	StreamKey string `json:"stream_key"`
+	// How often the standby asks for the changes, milliseconds
+	PollInterval int `json:"poll_interval"`
+}
+
+// Response to the request for the changes
+type RegionChanges struct {
+	// Stream the changes belong to
+	Epoch string
+	// Position of the reader after the changes
+	Seq     int64
+	Changes []store.Change
+	// Some changes after the requested position are no longer available
+	Lost bool
+}
+
+// Position of the standby node in the stream of a primary node
+type regionStreamPos struct {
+	Epoch string
+	Seq   int64
+}
+
+// Request to change the role of the region on all nodes of the cluster
+type ClusterRegionReq struct {
+	Standby    bool
+	PrimaryUrl string
+}
+
+var region struct {
+	sync.RWMutex
+
+	name string
+	url  string
+
+	standby    bool
+	primaryUrl string
+
+	streamKey string
+	peers     []string
+}
+
+var regionStream struct {
+	// Guards pos
+	sync.Mutex
+	// Only one pass over the streams at a time
+	pass sync.Mutex
+
+	// Positions in the streams of the peer nodes tailed by this node. A missing position means
+	// the stream is read starting with its current end.
+	pos map[string]regionStreamPos
+
+	client *http.Client
+
+	applied *expvar.Int
+	failed  *expvar.Int
+	lost    *expvar.Int
+}
+
+// regionInit parses the region config. Without the config the server is the primary.
+func regionInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config regionConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse region config:", err)
+	}
+
+	if !isValidRegionUrl(config.Url) {
+		logMain.Fatal("Region url must be an absolute http(s) URL")
+	}
+	if config.Standby && !isValidRegionUrl(config.PrimaryUrl) {
+		logMain.Fatal("Standby region requires primary_url")
+	}
+
+	region.name = config.Name
+	region.url = strings.TrimSuffix(config.Url, "/")
+	region.standby = config.Standby
+	region.primaryUrl = strings.TrimSuffix(config.PrimaryUrl, "/")
+	region.streamKey = config.StreamKey
+
+	for _, peer := range config.PeerNodes {
+		if !isValidRegionUrl(peer) {
+			logMain.Fatal("Region peer_nodes must be absolute http(s) URLs")
+		}
+		region.peers = append(region.peers, strings.TrimSuffix(peer, "/"))
+	}
+	if len(region.peers) > 0 && region.streamKey == "" {
+		logMain.Fatal("Region peer_nodes require stream_key")
+	}
+
+	http.HandleFunc(ADMIN_REGION_PATH, serveRegion)
+	if region.streamKey != "" {
+		if !store.ChangesEnabled() {
+			logMain.Warn("Region stream_key is set but the store does not record changes: enable store_config.change_stream")
+		}
+		http.HandleFunc(ADMIN_REGION_CHANGES_PATH, serveRegionChanges)
+	}
+
+	if len(region.peers) > 0 {
+		regionStream.pos = make(map[string]regionStreamPos)
+		regionStream.client = &http.Client{Timeout: REGION_STREAM_TIMEOUT}
+		regionStream.applied, regionStream.failed, regionStream.lost = new(expvar.Int), new(expvar.Int), new(expvar.Int)
+		vars := new(expvar.Map).Init()
+		vars.Set("applied", regionStream.applied)
+		vars.Set("failed", regionStream.failed)
+		vars.Set("lost", regionStream.lost)
+		expvar.Publish("RegionStream", vars)
+
+		interval := config.PollInterval
+		if interval <= 0 {
+			interval = REGION_DEFAULT_POLL_INTERVAL
+		}
+		go regionTail(time.Duration(interval) * time.Millisecond)
+	}
+
+	if region.standby {
+		logMain.Infof("Region '%s' is a standby of %s", region.name, region.primaryUrl)
+	} else {
+		logMain.Infof("Region '%s' is the primary", region.name)
+	}
+}
+
+func isValidRegionUrl(str string) bool {
+	u, err := url.Parse(str)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// isStandby checks if the region does not serve clients.
+func isStandby() bool {
+	region.RLock()
+	defer region.RUnlock()
+	return region.standby
+}
+
+// regionRedirect returns the URL of the primary region if this region is a standby.
+func regionRedirect() string {
+	region.RLock()
+	defer region.RUnlock()
+	if region.standby {
+		return region.primaryUrl
+	}
+	return ""
+}
+
+// redirectToPrimary redirects the request to the primary region. Returns false if this region is the primary.
+func redirectToPrimary(wrt http.ResponseWriter, req *http.Request) bool {
+	primary := regionRedirect()
+	if primary == "" {
+		return false
+	}
+	http.Redirect(wrt, req, primary+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// setRegionRole changes the role of this node. Demoted nodes disconnect the clients redirecting
+// them to the new primary.
+func setRegionRole(standby bool, primaryUrl string) {
+	if !standby && isStandby() {
+		// Catch up with the old primary before accepting writes. It's likely down if the pass fails.
+		regionTailPass()
+	}
+
+	region.Lock()
+	region.standby = standby
+	region.primaryUrl = primaryUrl
+	region.Unlock()
+
+	if standby {
+		regionStreamReset()
+		logMain.Infof("Region '%s' is now a standby of %s", region.name, primaryUrl)
+		globals.sessionStore.Redirect(primaryUrl)
+	} else {
+		logMain.Infof("Region '%s' is now the primary", region.name)
+	}
+}
+
+// RegionRole changes the role of this node. Called by the node which received the admin request.
+func (c *Cluster) RegionRole(req *ClusterRegionReq, unused *bool) error {
+	setRegionRole(req.Standby, req.PrimaryUrl)
+	return nil
+}
+
+// regionRole changes the role of the region on this and all other nodes of the cluster.
+func (c *Cluster) regionRole(standby bool, primaryUrl string) error {
+	var failed error
+	if c != nil {
+		for _, n := range c.nodes {
+			unused := false
+			if err := n.call("Cluster.RegionRole",
+				&ClusterRegionReq{Standby: standby, PrimaryUrl: primaryUrl}, &unused); err != nil {
+				logCluster.Warnf("cluster: failed to change region role of node '%s': %v", n.name, err)
+				failed = err
+			}
+		}
+	}
+	setRegionRole(standby, primaryUrl)
+	return failed
+}
+
+// demotePrimary asks the current primary region to become a standby of this region.
+// The credentials of the original request are reused: both regions share the database.
+func demotePrimary(req *http.Request) error {
+	region.RLock()
+	primaryUrl, selfUrl := region.primaryUrl, region.url
+	region.RUnlock()
+
+	if primaryUrl == "" {
+		return errors.New("primary is unknown")
+	}
+
+	fwd, err := http.NewRequest(http.MethodPost, primaryUrl+ADMIN_REGION_PATH+"?action=demote&primary="+
+		url.QueryEscape(selfUrl), nil)
+	if err != nil {
+		return err
+	}
+	fwd.Header.Set("X-Tinode-APIKey", getApiKey(req))
+	fwd.Header.Set("Authorization", req.Header.Get("Authorization"))
+
+	resp, err := (&http.Client{Timeout: REGION_DEMOTE_TIMEOUT}).Do(fwd)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected response status " + resp.Status)
+	}
+	return nil
+}
+
+// serveRegion reports or changes the role of the region:
+// GET /v0/admin/region
+// POST /v0/admin/region?action=promote
+// POST /v0/admin/region?action=demote&primary=<url>
+func serveRegion(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	if _, authLvl, err := authHttpRequestLevel(req); err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	} else if authLvl != auth.LevelRoot {
+		writeErr(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch req.FormValue("action") {
+		case "promote":
+			if !isStandby() {
+				// Already the primary: report the role
+				break
+			}
+			if err = demotePrimary(req); err != nil {
+				// The primary is likely down, promote anyway
+				logMain.Warn("Region promotion: the primary was not demoted:", err)
+			}
+			err = globals.cluster.regionRole(false, "")
+		case "demote":
+			primaryUrl := req.FormValue("primary")
+			if !isValidRegionUrl(primaryUrl) {
+				writeErr(ErrMalformed("", "", now))
+				return
+			}
+			err = globals.cluster.regionRole(true, strings.TrimSuffix(primaryUrl, "/"))
+		default:
+			writeErr(ErrMalformed("", "", now))
+			return
+		}
+	default:
+		writeErr(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	if err != nil {
+		// The role of this node was changed, some other nodes may not know it
+		writeErr(ErrClusterNodeUnreachable("", "", now))
+		return
+	}
+
+	region.RLock()
+	role := "primary"
+	if region.standby {
+		role = "standby"
+	}
+	report := map[string]interface{}{
+		"name":        region.name,
+		"role":        role,
+		"url":         region.url,
+		"primary_url": region.primaryUrl}
+	region.RUnlock()
+
+	if len(region.peers) > 0 {
+		streams := make(map[string]regionStreamPos)
+		regionStream.Lock()
+		for peer, pos := range regionStream.pos {
+			streams[peer] = pos
+		}
+		regionStream.Unlock()
+		report["streams"] = streams
+	}
+	enc.Encode(report)
+}
+
+// serveRegionChanges sends the changes recorded by this node to a node of the standby region:
+// GET /v0/admin/region/changes?epoch=<epoch>&since=<seq>
+// A request without the epoch returns no changes and the current end of the stream.
+func serveRegionChanges(wrt http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(wrt, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(region.streamKey)) != 1 {
+		http.Error(wrt, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !store.ChangesEnabled() {
+		http.Error(wrt, "changes are not recorded", http.StatusServiceUnavailable)
+		return
+	}
+
+	var resp RegionChanges
+	if epoch := req.FormValue("epoch"); epoch == "" {
+		resp.Epoch, resp.Seq = store.ChangesHead()
+	} else {
+		since, err := strconv.ParseInt(req.FormValue("since"), 10, 64)
+		if err != nil || since < 0 {
+			http.Error(wrt, "malformed position", http.StatusBadRequest)
+			return
+		}
+		resp.Changes, resp.Epoch, resp.Seq, resp.Lost = store.ChangesSince(epoch, since, REGION_CHANGES_BATCH)
+	}
+
+	wrt.Header().Set("Content-Type", "application/octet-stream")
+	if err := gob.NewEncoder(wrt).Encode(&resp); err != nil {
+		logMain.Warn("Region stream: failed to write changes:", err)
+	}
+}
+
+// regionTail repeats the changes of the primary nodes while the region is a standby.
+func regionTail(interval time.Duration) {
+	for range time.Tick(interval) {
+		if isStandby() {
+			regionTailPass()
+		}
+	}
+}
+
+// regionTailPass repeats all available changes of the primary nodes tailed by this node.
+func regionTailPass() {
+	regionStream.pass.Lock()
+	defer regionStream.pass.Unlock()
+
+	for _, peer := range region.peers {
+		if globals.cluster.isRemoteTopic(peer) {
+			// Tailed by another node of the cluster
+			continue
+		}
+		for {
+			count, err := regionTailPeer(peer)
+			if err != nil {
+				logMain.Warnf("Region stream: failed to read changes of %s: %v", peer, err)
+				break
+			}
+			if count < REGION_CHANGES_BATCH {
+				break
+			}
+		}
+	}
+}
+
+// regionTailPeer requests one batch of changes from the peer node and applies them.
+// Returns the number of received changes.
+func regionTailPeer(peer string) (int, error) {
+	regionStream.Lock()
+	pos := regionStream.pos[peer]
+	regionStream.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, peer+ADMIN_REGION_CHANGES_PATH+"?epoch="+url.QueryEscape(pos.Epoch)+
+		"&since="+strconv.FormatInt(pos.Seq, 10), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+region.streamKey)
+
+	resp, err := regionStream.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New("unexpected response status " + resp.Status)
+	}
+
+	var batch RegionChanges
+	if err = gob.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return 0, err
+	}
+
+	if batch.Lost {
+		regionStream.lost.Add(1)
+		logMain.Warnf("Region stream: changes of %s were lost, the database of the standby is out of date", peer)
+	}
+	for i := range batch.Changes {
+		if err := store.ApplyChange(&batch.Changes[i]); err != nil {
+			regionStream.failed.Add(1)
+			logMain.Warnf("Region stream: failed to apply change %d of %s (%s): %v", batch.Changes[i].Seq, peer,
+				batch.Changes[i].Op, err)
+		} else {
+			regionStream.applied.Add(1)
+		}
+	}
+
+	regionStream.Lock()
+	regionStream.pos[peer] = regionStreamPos{Epoch: batch.Epoch, Seq: batch.Seq}
+	regionStream.Unlock()
+
+	return len(batch.Changes), nil
+}
+
+// regionStreamReset makes the node tail the primary nodes starting with the current end of their streams.
+func regionStreamReset() {
+	if len(region.peers) == 0 {
+		return
+	}
+
+	regionStream.pass.Lock()
+	regionStream.Lock()
+	for peer := range regionStream.pos {
+		delete(regionStream.pos, peer)
+	}
+	regionStream.Unlock()
+	regionStream.pass.Unlock()
+}
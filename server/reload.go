@@ -0,0 +1,84 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Reloading of the configuration on SIGHUP. Only settings which can change
+ *  at runtime are applied: indexable tags, maximum message size, TLS
+ *  certificate, push credentials and logging. Other changes require a
+ *  restart.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+)
+
+// liveSettings are the settings which are replaced when the configuration is reloaded.
+type liveSettings struct {
+	// Tags allowed in index (user discovery)
+	indexableTags []string
+	// Maximum message size allowed from peer.
+	maxMessageSize int64
+}
+
+// Current *liveSettings
+var live atomic.Value
+
+// setLiveSettings makes the settings from the config current.
+func setLiveSettings(config *configType) {
+	settings := &liveSettings{
+		indexableTags:  config.IndexableTags,
+		maxMessageSize: int64(config.MaxMessageSize)}
+	if settings.maxMessageSize <= 0 {
+		settings.maxMessageSize = MAX_MESSAGE_SIZE
+	}
+	live.Store(settings)
+}
+
+// indexableTags returns the tags allowed in index.
+func indexableTags() []string {
+	return live.Load().(*liveSettings).indexableTags
+}
+
+// maxMessageSize returns the maximum message size allowed from peer.
+func maxMessageSize() int64 {
+	return live.Load().(*liveSettings).maxMessageSize
+}
+
+// reloadConfig re-reads the config file and applies the settings which can change at runtime.
+// The current settings are kept if the file cannot be read or parsed.
+func reloadConfig() {
+	var config configType
+	if raw, err := ioutil.ReadFile(globals.configFile); err != nil {
+		logMain.Error("Config reload: failed to read config:", err)
+		return
+	} else if err = json.Unmarshal(raw, &config); err != nil {
+		logMain.Error("Config reload: failed to parse config:", err)
+		return
+	}
+
+	if err := logs.Init(string(config.LogConfig)); err != nil {
+		logMain.Error("Config reload: logging:", err)
+	}
+
+	setLiveSettings(&config)
+
+	if err := tlsReload(string(config.TlsConfig)); err != nil {
+		logMain.Error("Config reload: TLS:", err)
+	}
+
+	if len(config.PushConfig) > 0 {
+		if err := push.Reload(string(config.PushConfig)); err != nil {
+			logMain.Error("Config reload: push:", err)
+		}
+	}
+
+	logMain.Infof("Reloaded config from '%s'", globals.configFile)
+}
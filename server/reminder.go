@@ -0,0 +1,92 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Message reminders. A user requests a reminder about a message with
+ *  {set remind}. When the reminder is due, the server delivers a {data}
+ *  message with the reference to the original message and a snippet of it
+ *  to the user's 'me' topic. Reminders are persisted in the store.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// How often to check for due reminders
+	REMINDER_CHECK_INTERVAL = 30 * time.Second
+	// Maximum number of reminders delivered at once
+	REMINDER_BATCH_SIZE = 256
+	// Maximum length of the message snippet in a reminder
+	REMINDER_SNIPPET_LENGTH = 120
+)
+
+// reminderId generates ID of the reminder. There is at most one reminder per user per message.
+func reminderId(uid types.Uid, topic string, seq int) string {
+	return uid.String() + ":" + topic + ":" + strconv.Itoa(seq)
+}
+
+// reminderInit starts the background job which delivers due reminders.
+func reminderInit() {
+	go func() {
+		ticker := time.NewTicker(REMINDER_CHECK_INTERVAL)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			reminderDeliver()
+		}
+	}()
+}
+
+func reminderDeliver() {
+	if isStandby() {
+		// Reminders are delivered by the primary region
+		return
+	}
+
+	now := types.TimeNow()
+
+	// The reminder is delivered by the cluster node which owns user's 'me' topic. Reminders of other
+	// nodes are skipped by the query: they must not fill the batch.
+	reminders, err := store.Reminders.GetDue(now, REMINDER_BATCH_SIZE, func(rem *types.Reminder) bool {
+		uid := types.ParseUid(rem.User)
+		return uid.IsZero() || !globals.cluster.isRemoteTopic(uid.UserId())
+	})
+	if err != nil {
+		logReminder.Warn("reminder: failed to load due reminders", err)
+		return
+	}
+
+	for i := range reminders {
+		rem := &reminders[i]
+		uid := types.ParseUid(rem.User)
+		if uid.IsZero() {
+			store.Reminders.Delete(rem.Id)
+			continue
+		}
+
+		globals.hub.route <- &ServerComMessage{
+			Data: &MsgServerData{
+				Topic:     "me",
+				Timestamp: now,
+				Head:      map[string]string{"reminder": rem.Topic},
+				Content: map[string]interface{}{
+					"topic":   rem.Topic,
+					"seq":     rem.SeqId,
+					"snippet": rem.Snippet,
+				}},
+			rcptto:    uid.UserId(),
+			timestamp: now}
+
+		if err := store.Reminders.Delete(rem.Id); err != nil {
+			logReminder.Error("reminder: failed to delete delivered reminder", err)
+		}
+	}
+}
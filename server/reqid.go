@@ -0,0 +1,104 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Request IDs. Every message received from a client is given an ID
+ *  generated by the server. The ID is returned in "reqid" of the {ctrl}
+ *  response, written to the logs and traces of the request and sent with
+ *  the request to the cluster node which hosts the topic. A failed action
+ *  reported by a user can be found by the ID in the logs of all nodes.
+ *  Only requests with a client-assigned "id" get the request ID in the
+ *  response: responses are matched to requests by the "id".
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	// Number of recent requests of a session which are matched to the responses
+	REQID_RECENT = 32
+)
+
+// Recent requests of a session waiting for {ctrl} responses
+type recentReqs struct {
+	lock sync.Mutex
+	// Client-assigned and server-assigned IDs of the requests, a ring buffer
+	ids  [REQID_RECENT][2]string
+	next int
+}
+
+// clientId returns the client-assigned ID of the message.
+func (msg *ClientComMessage) clientId() string {
+	switch {
+	case msg.Pub != nil:
+		return msg.Pub.Id
+	case msg.Sub != nil:
+		return msg.Sub.Id
+	case msg.Leave != nil:
+		return msg.Leave.Id
+	case msg.Hi != nil:
+		return msg.Hi.Id
+	case msg.Login != nil:
+		return msg.Login.Id
+	case msg.Get != nil:
+		return msg.Get.Id
+	case msg.Set != nil:
+		return msg.Set.Id
+	case msg.Del != nil:
+		return msg.Del.Id
+	case msg.Acc != nil:
+		return msg.Acc.Id
+	}
+	return ""
+}
+
+// reqStart assigns the request ID to the message unless it was assigned by the node which received the
+// message from the client. The ID is remembered to be returned in the response.
+func (s *Session) reqStart(msg *ClientComMessage) {
+	if msg.reqId == "" {
+		msg.reqId = store.GetUidString()
+	}
+
+	id := msg.clientId()
+	if id == "" {
+		return
+	}
+
+	s.reqs.lock.Lock()
+	s.reqs.ids[s.reqs.next] = [2]string{id, msg.reqId}
+	s.reqs.next = (s.reqs.next + 1) % REQID_RECENT
+	s.reqs.lock.Unlock()
+}
+
+// reqIdOf returns the request ID of the most recent request with the given client-assigned ID and forgets it.
+func (s *Session) reqIdOf(id string) string {
+	if id == "" {
+		return ""
+	}
+
+	s.reqs.lock.Lock()
+	defer s.reqs.lock.Unlock()
+
+	for i := 1; i <= REQID_RECENT; i++ {
+		entry := &s.reqs.ids[(s.reqs.next-i+REQID_RECENT)%REQID_RECENT]
+		if entry[0] == id {
+			reqId := entry[1]
+			*entry = [2]string{}
+			return reqId
+		}
+	}
+	return ""
+}
+
+// reqStamp adds the request ID to the {ctrl} response.
+func (s *Session) reqStamp(msg *ServerComMessage) {
+	if msg.Ctrl != nil && msg.Ctrl.ReqId == "" {
+		msg.Ctrl.ReqId = s.reqIdOf(msg.Ctrl.Id)
+	}
+}
@@ -0,0 +1,251 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Publishing messages over HTTP by backend services which don't keep a
+ *  session open:
+ *    POST /v0/topics/<topic>/messages
+ *    {"head": {...}, "content": ..., "thread": 12, "from": "usr..."}
+ *  The request carries the API key and the token of a user in the
+ *  Authorization header, same as file uploads. Only root and the service
+ *  accounts listed in "rest_publish" may publish. A service account posts
+ *  as itself into topics where it has the W permission; <topic> is either
+ *  a grp, chn or p2p topic name or the ID of the other user of a p2p topic.
+ *  Root may post as any user with the W permission given in "from", or as
+ *  the server if "from" is empty. The sender is checked like a session:
+ *  the account must be active and must not be blocked by the other user of
+ *  a p2p topic. The message is accepted with 202 and published
+ *  asynchronously like a scheduled message; it's not reported back with a
+ *  seq ID. A standby region redirects the request to the primary.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Prefix of the path of the endpoint, followed by <topic>/messages
+const REST_TOPICS_PATH = "/v0/topics/"
+
+type restPubConfig struct {
+	// IDs of the service accounts which may publish, e.g. "usrAbCdEfGh"
+	Services []string `json:"services"`
+}
+
+// Service accounts allowed to publish, in addition to root
+var restPubServices map[types.Uid]bool
+
+type restPubRequest struct {
+	// Sender of the message, root only
+	From    string            `json:"from"`
+	Head    map[string]string `json:"head"`
+	Thread  int               `json:"thread"`
+	Content interface{}       `json:"content"`
+}
+
+// Request to publish a message posted over HTTP, forwarded to the node which hosts the topic
+type ClusterRestPubReq struct {
+	Topic string
+	Data  *MsgServerData
+}
+
+// restPubInit parses the list of service accounts and mounts the endpoint. Root may publish without
+// the config.
+func restPubInit(jsconfig json.RawMessage) {
+	if len(jsconfig) > 0 {
+		var config restPubConfig
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logHttp.Fatal("Failed to parse rest_publish config:", err)
+		}
+		restPubServices = make(map[types.Uid]bool, len(config.Services))
+		for _, id := range config.Services {
+			uid := types.ParseUserId(id)
+			if uid.IsZero() {
+				logHttp.Fatalf("rest_publish: invalid service account '%s'", id)
+			}
+			restPubServices[uid] = true
+		}
+	}
+
+	http.HandleFunc(REST_TOPICS_PATH, servePublish)
+}
+
+// RestPublish publishes a message posted over HTTP to another node into a topic hosted by this node.
+func (Cluster) RestPublish(req *ClusterRestPubReq, unused *bool) error {
+	restRoute(req.Topic, req.Data)
+	return nil
+}
+
+// restRoute sends the message to the topic which saves and delivers it.
+func restRoute(topic string, data *MsgServerData) {
+	// The topic checks the sender like the sender of a {pub}. Messages of the server are not checked.
+	globals.hub.route <- &ServerComMessage{Data: data, rcptto: topic, timestamp: data.Timestamp,
+		checkFrom: data.From != ""}
+}
+
+// restTopicName converts the topic name from the request path to the name the topic is routed by.
+// Returns an empty string if the topic does not accept messages over HTTP.
+func restTopicName(name string, from types.Uid) string {
+	switch {
+	case strings.HasPrefix(name, "grp"), strings.HasPrefix(name, "chn"), strings.HasPrefix(name, "p2p"):
+		return name
+	case strings.HasPrefix(name, "usr"):
+		other := types.ParseUserId(name)
+		if other.IsZero() || from.IsZero() || other == from {
+			return ""
+		}
+		return from.P2PName(other)
+	}
+	return ""
+}
+
+// restSenderAllowed checks if the sender may post into the topic: the sender's account must be active
+// and must not be blocked by the other user of the p2p topic. The topic repeats the checks when the
+// message is published.
+func restSenderAllowed(topic string, from types.Uid) (bool, error) {
+	user, err := store.Users.Get(from)
+	if err != nil {
+		return false, err
+	}
+	if user == nil || !userStateLoaded(user) {
+		return false, nil
+	}
+
+	if !strings.HasPrefix(topic, "p2p") {
+		return true, nil
+	}
+	uid1, uid2, err := types.ParseP2P(topic)
+	if err != nil {
+		return false, nil
+	}
+	other := uid1
+	if other == from {
+		other = uid2
+	}
+	peer, err := store.Users.Get(other)
+	if err != nil {
+		return false, err
+	}
+	return peer != nil && !blocks(peer, from), nil
+}
+
+// servePublish publishes a message into the topic:
+// POST /v0/topics/<topic>/messages
+func servePublish(wrt http.ResponseWriter, req *http.Request) {
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeCtrl := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeCtrl(ErrAuthRequired("", "", now))
+		return
+	}
+
+	caller, authLvl, err := authHttpRequestLevel(req)
+	if err != nil {
+		writeCtrl(ErrAuthFailed("", "", now))
+		return
+	}
+	if authLvl != auth.LevelRoot && !restPubServices[caller] {
+		writeCtrl(ErrPermissionDenied("", "", now))
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, REST_TOPICS_PATH), "/")
+	if len(parts) != 2 || parts[1] != "messages" {
+		writeCtrl(ErrNotFound("", "", now))
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeCtrl(ErrOperationNotAllowed("", parts[0], now))
+		return
+	}
+
+	req.Body = http.MaxBytesReader(wrt, req.Body, maxMessageSize())
+	var body restPubRequest
+	if err = json.NewDecoder(req.Body).Decode(&body); err != nil || body.Content == nil || body.Thread < 0 {
+		writeCtrl(ErrMalformed("", parts[0], now))
+		return
+	}
+
+	from := caller
+	if authLvl == auth.LevelRoot {
+		// Root posts as the server unless the sender is given
+		from = types.ZeroUid
+		if body.From != "" {
+			if from = types.ParseUserId(body.From); from.IsZero() {
+				writeCtrl(ErrMalformed("", parts[0], now))
+				return
+			}
+		}
+	} else if body.From != "" && types.ParseUserId(body.From) != caller {
+		writeCtrl(ErrPermissionDenied("", parts[0], now))
+		return
+	}
+
+	topic := restTopicName(parts[0], from)
+	if topic == "" {
+		writeCtrl(ErrPermissionDenied("", parts[0], now))
+		return
+	}
+
+	if !from.IsZero() {
+		sub, err := store.Subs.Get(topic, from)
+		if err != nil {
+			writeCtrl(ErrUnknown("", parts[0], now))
+			return
+		}
+		if sub == nil || sub.IsDeleted() || !(sub.ModeWant & sub.ModeGiven).IsWriter() {
+			writeCtrl(ErrPermissionDenied("", parts[0], now))
+			return
+		}
+		if ok, err := restSenderAllowed(topic, from); err != nil {
+			writeCtrl(ErrUnknown("", parts[0], now))
+			return
+		} else if !ok {
+			writeCtrl(ErrPermissionDenied("", parts[0], now))
+			return
+		}
+	}
+
+	data := &MsgServerData{
+		Topic:     topic,
+		From:      from.UserId(),
+		Timestamp: now,
+		Head:      body.Head,
+		Thread:    body.Thread,
+		Content:   body.Content}
+
+	if globals.cluster.isRemoteTopic(topic) {
+		n := globals.cluster.nodeForTopic(topic)
+		unused := false
+		if n == nil || n.call("Cluster.RestPublish", &ClusterRestPubReq{Topic: topic, Data: data}, &unused) != nil {
+			writeCtrl(ErrClusterNodeUnreachable("", parts[0], now))
+			return
+		}
+	} else {
+		restRoute(topic, data)
+	}
+
+	if authLvl == auth.LevelRoot && !from.IsZero() {
+		logAudit.Infof("publish: '%s' posted to '%s' as '%s'", caller.UserId(), topic, from.UserId())
+	}
+	writeCtrl(NoErrAccepted("", parts[0], now))
+}
@@ -1,11 +1,14 @@
 // Implementation of a consistent ring hash:
 // https://en.wikipedia.org/wiki/Consistent_hashing
+// and of rendezvous (highest random weight) hashing:
+// https://en.wikipedia.org/wiki/Rendezvous_hashing
 package ringhash
 
 import (
 	"encoding/ascii85"
 	"hash/fnv"
 	"log"
+	"math"
 	"sort"
 	"strconv"
 )
@@ -32,9 +35,19 @@ func (k sortable) Less(i, j int) bool {
 	}
 }
 
+// Key and its weight for rendezvous hashing
+type weighted struct {
+	key    string
+	weight int
+}
+
 type Ring struct {
 	keys []elem // Sorted list of keys.
 
+	// Rendezvous hashing: keys and their weights sorted by key
+	rendezvous bool
+	nodes      []weighted
+
 	signature string
 	replicas  int
 	hashfunc  Hash
@@ -55,25 +68,75 @@ func New(replicas int, fn Hash) *Ring {
 	return ring
 }
 
+// NewRendezvous creates a hash which places items with rendezvous hashing instead of a ring:
+// each item goes to the key with the highest score computed from the item and the key. Removing
+// a key moves only the items of that key, and they are spread evenly over the remaining keys.
+// The number of replicas is used as the weight of a key.
+func NewRendezvous(replicas int, fn Hash) *Ring {
+	ring := New(replicas, fn)
+	ring.rendezvous = true
+	return ring
+}
+
 // Returns the number of keys in the ring.
 func (ring *Ring) Len() int {
+	if ring.rendezvous {
+		return len(ring.nodes)
+	}
 	return len(ring.keys)
 }
 
 // Adds keys to the ring.
 func (ring *Ring) Add(keys ...string) {
 	for _, key := range keys {
-		for i := 0; i < ring.replicas; i++ {
-			ring.keys = append(ring.keys, elem{
-				hash: ring.hashfunc([]byte(strconv.Itoa(i) + key)),
-				key:  key})
-		}
+		ring.addReplicas(key, ring.replicas)
+	}
+	ring.update()
+}
+
+// AddWeighted adds a key with the given number of replicas (virtual nodes) instead of the default.
+// A key with twice as many replicas receives about twice as many items. Replicas are numbered
+// the same way regardless of their count, so changing the count of one key moves only the items
+// of the added or removed replicas.
+func (ring *Ring) AddWeighted(key string, replicas int) {
+	ring.addReplicas(key, replicas)
+	ring.update()
+}
+
+func (ring *Ring) addReplicas(key string, replicas int) {
+	if ring.rendezvous {
+		ring.nodes = append(ring.nodes, weighted{key: key, weight: replicas})
+		return
+	}
+	for i := 0; i < replicas; i++ {
+		ring.keys = append(ring.keys, elem{
+			hash: ring.hashfunc([]byte(strconv.Itoa(i) + key)),
+			key:  key})
 	}
+}
+
+// update sorts the keys and recalculates the signature.
+func (ring *Ring) update() {
 	sort.Sort(sortable(ring.keys))
+	sort.Slice(ring.nodes, func(i, j int) bool { return ring.nodes[i].key < ring.nodes[j].key })
 
 	// Calculate signature
 	hash := fnv.New128a()
 	b := make([]byte, 4)
+	if ring.rendezvous {
+		hash.Write([]byte("rendezvous"))
+		// Weights are hashed instead of the replicas
+		for _, node := range ring.nodes {
+			b[0] = byte(node.weight)
+			b[1] = byte(node.weight >> 8)
+			b[2] = byte(node.weight >> 16)
+			b[3] = byte(node.weight >> 24)
+			hash.Write(b)
+			hash.Write([]byte(node.key))
+		}
+		// The hash function changes the placement too
+		hash.Write([]byte(strconv.FormatUint(uint64(ring.hashfunc([]byte("signature"))), 10)))
+	}
 	for _, key := range ring.keys {
 		b[0] = byte(key.hash)
 		b[1] = byte(key.hash >> 8)
@@ -99,6 +162,10 @@ func (ring *Ring) Get(key string) string {
 
 	hash := ring.hashfunc([]byte(key))
 
+	if ring.rendezvous {
+		return ring.highestScore(hash)
+	}
+
 	// Binary search for appropriate replica.
 	idx := sort.Search(len(ring.keys), func(i int) bool {
 		el := ring.keys[i]
@@ -113,6 +180,29 @@ func (ring *Ring) Get(key string) string {
 	return ring.keys[idx].key
 }
 
+// highestScore returns the key with the highest weighted score for the item with the given hash.
+func (ring *Ring) highestScore(hash uint32) string {
+	var best string
+	var bestScore float64
+	for _, node := range ring.nodes {
+		// Mix hashes of the item and of the key into a number in (0, 1)
+		x := uint64(ring.hashfunc([]byte(node.key)))<<32 | uint64(hash)
+		x ^= x >> 30
+		x *= 0xbf58476d1ce4e5b9
+		x ^= x >> 27
+		x *= 0x94d049bb133111eb
+		x ^= x >> 31
+		r := (float64(x>>11) + 0.5) / (1 << 53)
+
+		// Weighted score: a key with twice the weight wins twice as often
+		score := float64(node.weight) / -math.Log(r)
+		if best == "" || score > bestScore {
+			best, bestScore = node.key, score
+		}
+	}
+	return best
+}
+
 // Get a ring hash signature. Two identical ring hashes
 // will have the same signature. Two hashes with different
 // number of keys or replicas or hash functions will have different
@@ -172,3 +172,83 @@ func benchmarkGet(b *testing.B, keycount int) {
 		ring.Get(ids[i&(keycount-1)])
 	}
 }
+
+func TestWeighted(t *testing.T) {
+	ring := New(20, nil)
+	ring.Add("owl", "crow")
+	ring.AddWeighted("eagle", 80)
+
+	const count = 10000
+	assigned := make(map[string]string, count)
+	hits := make(map[string]int)
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("grp%d", i)
+		assigned[key] = ring.Get(key)
+		hits[assigned[key]]++
+	}
+
+	// 'eagle' has two thirds of the replicas and should get about as many keys
+	if share := float64(hits["eagle"]) / count; share < 0.5 || share > 0.8 {
+		t.Errorf("'eagle' should get about 2/3 of keys, got %.2f", share)
+	}
+
+	// Adding replicas to 'owl' may only move keys to 'owl'
+	ring = New(20, nil)
+	ring.AddWeighted("owl", 40)
+	ring.Add("crow")
+	ring.AddWeighted("eagle", 80)
+	for key, prev := range assigned {
+		if node := ring.Get(key); node != prev && node != "owl" {
+			t.Errorf("'%s' moved from '%s' to '%s'", key, prev, node)
+		}
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	ring := NewRendezvous(20, nil)
+	ring.Add("owl", "crow")
+	ring.AddWeighted("eagle", 80)
+
+	const count = 10000
+	assigned := make(map[string]string, count)
+	hits := make(map[string]int)
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("grp%d", i)
+		assigned[key] = ring.Get(key)
+		hits[assigned[key]]++
+	}
+
+	// 'eagle' has two thirds of the weight and should get about as many keys
+	if share := float64(hits["eagle"]) / count; share < 0.6 || share > 0.73 {
+		t.Errorf("'eagle' should get about 2/3 of keys, got %.2f", share)
+	}
+
+	// Removing 'eagle' moves only the keys of 'eagle', about evenly
+	ring = NewRendezvous(20, nil)
+	ring.Add("crow", "owl")
+	moved := make(map[string]int)
+	for key, prev := range assigned {
+		node := ring.Get(key)
+		if prev != "eagle" && node != prev {
+			t.Errorf("'%s' moved from '%s' to '%s'", key, prev, node)
+		} else if prev == "eagle" {
+			moved[node]++
+		}
+	}
+	if share := float64(moved["owl"]) / float64(hits["eagle"]); share < 0.4 || share > 0.6 {
+		t.Errorf("'owl' should get about half of the keys of 'eagle', got %.2f", share)
+	}
+
+	ring1 := NewRendezvous(20, nil)
+	ring2 := New(20, nil)
+	ring1.Add("owl", "crow")
+	ring2.Add("crow", "owl")
+	if ring1.Signature() == ring2.Signature() {
+		t.Errorf("Signatures must be different - different placement")
+	}
+	ring2 = NewRendezvous(20, nil)
+	ring2.Add("crow", "owl")
+	if ring1.Signature() != ring2.Signature() {
+		t.Errorf("Signatures must be identical")
+	}
+}
@@ -0,0 +1,174 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Scheduled delivery of messages. A client publishes {pub deliver_at=...};
+ *  the topic keeps the message in the store instead of saving it into the
+ *  history. When the message is due, a background job injects it into the
+ *  topic as if it were published by the sender at that time. The SeqId is
+ *  assigned at delivery. Pending messages survive restarts; in a cluster each
+ *  message is delivered by the node which owns the topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default interval between checks for due messages
+	SCHEDULED_DEFAULT_INTERVAL = 10 * time.Second
+	// Default maximum delay of delivery: 30 days
+	SCHEDULED_DEFAULT_MAX_DELAY = 30 * 24 * time.Hour
+	// Maximum number of scheduled messages delivered at once
+	SCHEDULED_BATCH_SIZE = 256
+)
+
+type scheduledConfig struct {
+	// Enable scheduled delivery
+	Enabled bool `json:"enabled"`
+	// How often to check for due messages, seconds
+	CheckInterval int `json:"check_interval"`
+	// How far in the future a message can be scheduled, seconds
+	MaxDelay int `json:"max_delay"`
+}
+
+var scheduled struct {
+	enabled  bool
+	maxDelay time.Duration
+	// Exported counters of scheduled and delivered messages
+	queued    *expvar.Int
+	delivered *expvar.Int
+}
+
+// scheduledInit parses config and starts the background job. Scheduled delivery is off by default.
+func scheduledInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config scheduledConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logScheduled.Fatal("Failed to parse scheduled_delivery config:", err)
+	}
+
+	if !config.Enabled {
+		return
+	}
+
+	interval := time.Duration(config.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = SCHEDULED_DEFAULT_INTERVAL
+	}
+	scheduled.maxDelay = time.Duration(config.MaxDelay) * time.Second
+	if scheduled.maxDelay <= 0 {
+		scheduled.maxDelay = SCHEDULED_DEFAULT_MAX_DELAY
+	}
+
+	scheduled.queued, scheduled.delivered = new(expvar.Int), new(expvar.Int)
+	vars := new(expvar.Map).Init()
+	vars.Set("queued", scheduled.queued)
+	vars.Set("delivered", scheduled.delivered)
+	expvar.Publish("ScheduledMessages", vars)
+
+	scheduled.enabled = true
+
+	go scheduledRun(interval)
+	logScheduled.Infof("Scheduled delivery of messages, checking every %s", interval)
+}
+
+// scheduledValid checks the requested delivery time.
+func scheduledValid(at, now time.Time) bool {
+	return scheduled.enabled && at.After(now) && at.Sub(now) <= scheduled.maxDelay
+}
+
+// scheduleMessage stores the message for delivery at msg.deliverAt and responds to the sender
+// with the ID of the pending message.
+func (t *Topic) scheduleMessage(msg *ServerComMessage, from types.Uid) {
+	pending := &types.ScheduledMessage{
+		Topic:   t.name,
+		From:    from.String(),
+		Thread:  msg.Data.Thread,
+		Head:    msg.Data.Head,
+		Content: msg.Data.Content,
+		At:      msg.deliverAt}
+	if err := store.Scheduled.Save(pending); err != nil {
+		logTopic.Errorf("topic[%s]: failed to schedule message: %v", t.name, err)
+		msg.sessFrom.queueOut(ErrUnknown(msg.id, t.original(from), msg.timestamp))
+		return
+	}
+	scheduled.queued.Add(1)
+
+	if msg.id != "" {
+		reply := NoErrAccepted(msg.id, t.original(from), msg.timestamp)
+		reply.Ctrl.Params = map[string]interface{}{"scheduled": pending.Id, "deliver_at": pending.At}
+		msg.sessFrom.queueOut(reply)
+	}
+}
+
+func scheduledRun(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		scheduledDeliver()
+	}
+}
+
+func scheduledDeliver() {
+	if isStandby() {
+		// Scheduled messages are delivered by the primary region
+		return
+	}
+
+	now := types.TimeNow()
+
+	// The message is delivered by the cluster node which owns the topic. Messages of other nodes are
+	// skipped by the query: they must not fill the batch.
+	msgs, err := store.Scheduled.GetDue(now, SCHEDULED_BATCH_SIZE, func(msg *types.ScheduledMessage) bool {
+		return !globals.cluster.isRemoteTopic(msg.Topic)
+	})
+	if err != nil {
+		logScheduled.Warn("scheduled: failed to load due messages", err)
+		return
+	}
+
+	for i := range msgs {
+		pending := &msgs[i]
+
+		// The sender may have lost the permission to post since the message was scheduled.
+		from := types.ParseUid(pending.From)
+		sub, err := store.Subs.Get(pending.Topic, from)
+		if err != nil {
+			logScheduled.Warnf("scheduled: topic '%s' failed to check sender %v", pending.Topic, err)
+			continue
+		}
+		if sub != nil && (sub.ModeWant & sub.ModeGiven).IsWriter() {
+			globals.hub.route <- &ServerComMessage{
+				Data: &MsgServerData{
+					Topic:     pending.Topic,
+					From:      from.UserId(),
+					Timestamp: now,
+					Head:      pending.Head,
+					Thread:    pending.Thread,
+					Content:   pending.Content},
+				rcptto:    pending.Topic,
+				timestamp: now}
+			scheduled.delivered.Add(1)
+		} else {
+			logScheduled.Infof("scheduled: message '%s' dropped, sender '%s' cannot post to '%s'",
+				pending.Id, pending.From, pending.Topic)
+		}
+
+		if err := store.Scheduled.Delete(pending.Id); err != nil {
+			logScheduled.Error("scheduled: failed to delete delivered message", err)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Automation scripts attached to group topics. The owner or an admin of the
+ *  topic uploads a script through /v0/admin/scripts. Every upload is a new
+ *  version stored with the topic; earlier versions may be restored. The
+ *  script may define
+ *    on_message(msg) - called for every message published by a user, in the
+ *                      "scripts" stage of the publishing pipeline;
+ *    on_timer()      - called every `every` seconds, `every` is a global
+ *                      variable of the script.
+ *  Hooks return None or a dict with
+ *    "tags": {"x-...": "..."} - headers added to the message (on_message);
+ *    "post": "text"           - message posted into the topic by the script.
+ *  Scripts run with a limited number of execution steps and time and have no
+ *  access to anything but the arguments. The engine is compiled in with the
+ *  "starlark" build tag.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path of the admin endpoint
+	ADMIN_SCRIPTS_PATH = "/v0/admin/scripts"
+
+	// Default number of execution steps of one call
+	SCRIPT_DEFAULT_MAX_STEPS = 100000
+	// Default time limit of one call
+	SCRIPT_DEFAULT_TIMEOUT = 50 * time.Millisecond
+	// Default interval between checks for due timers
+	SCRIPT_DEFAULT_TIMER_CHECK = time.Minute
+	// Default minimum interval between on_timer calls
+	SCRIPT_DEFAULT_MIN_EVERY = 5 * time.Minute
+	// Default number of versions kept per topic
+	SCRIPT_DEFAULT_MAX_VERSIONS = 20
+
+	// Maximum size of the script source
+	SCRIPT_MAX_SOURCE = 16 * 1024
+	// Maximum length of a message posted by a script
+	SCRIPT_MAX_POST = 4096
+	// Scripts may only add headers with this prefix
+	SCRIPT_TAG_PREFIX = "x-"
+	// Maximum number of headers added by one call
+	SCRIPT_MAX_TAGS = 8
+	// Maximum length of header name and value in bytes
+	SCRIPT_MAX_TAG_KEY   = 32
+	SCRIPT_MAX_TAG_VALUE = 1024
+)
+
+type scriptsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Execution steps allowed per call
+	MaxSteps int `json:"max_steps"`
+	// Time allowed per call in milliseconds
+	Timeout int `json:"timeout"`
+	// How often to check for due timers, seconds
+	TimerCheck int `json:"timer_check"`
+	// Minimum interval between on_timer calls, seconds
+	MinEvery int `json:"min_every"`
+	// Number of versions to keep
+	MaxVersions int `json:"max_versions"`
+}
+
+// scriptEngine compiles scripts. Implemented by the engine compiled in with the build tag.
+type scriptEngine interface {
+	compile(name, source string) (scriptProgram, error)
+}
+
+// scriptProgram is a compiled script.
+type scriptProgram interface {
+	// call runs the hook if the script defines it, otherwise returns nil.
+	call(hook string, arg map[string]interface{}) (*scriptResult, error)
+	// every is the interval between on_timer calls, zero if the script has no timer.
+	every() time.Duration
+}
+
+// scriptResult is the value returned by a hook.
+type scriptResult struct {
+	Tags map[string]string
+	Post string
+}
+
+// Active version of the script of a topic
+type topicScript struct {
+	version int
+	program scriptProgram
+	// Time of the last on_timer call
+	lastRun time.Time
+}
+
+// Request to reload the script of a topic from the database
+type ClusterScriptsReq struct {
+	Topic string
+}
+
+var scriptRuntime scriptEngine
+
+var scripts struct {
+	sync.Mutex
+
+	enabled     bool
+	maxSteps    uint64
+	timeout     time.Duration
+	minEvery    time.Duration
+	maxVersions int
+
+	// Compiled scripts by topic name
+	active map[string]*topicScript
+
+	// Exported as Scripts in expvar
+	stats *expvar.Map
+}
+
+// registerScriptEngine makes the scripting engine available. Called from init() of the engine.
+func registerScriptEngine(engine scriptEngine) {
+	if scriptRuntime != nil {
+		panic("registerScriptEngine: called twice")
+	}
+	scriptRuntime = engine
+}
+
+// scriptsInit parses config and starts the timer. Scripts are off by default.
+func scriptsInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config scriptsConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse scripts config:", err)
+	}
+	if !config.Enabled {
+		return
+	}
+	if scriptRuntime == nil {
+		logMain.Fatal("scripts: the server was built without scripting support, use -tags starlark")
+	}
+
+	scripts.maxSteps = SCRIPT_DEFAULT_MAX_STEPS
+	if config.MaxSteps > 0 {
+		scripts.maxSteps = uint64(config.MaxSteps)
+	}
+	scripts.timeout = SCRIPT_DEFAULT_TIMEOUT
+	if config.Timeout > 0 {
+		scripts.timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	scripts.minEvery = SCRIPT_DEFAULT_MIN_EVERY
+	if config.MinEvery > 0 {
+		scripts.minEvery = time.Duration(config.MinEvery) * time.Second
+	}
+	scripts.maxVersions = SCRIPT_DEFAULT_MAX_VERSIONS
+	if config.MaxVersions > 0 {
+		scripts.maxVersions = config.MaxVersions
+	}
+	timerCheck := SCRIPT_DEFAULT_TIMER_CHECK
+	if config.TimerCheck > 0 {
+		timerCheck = time.Duration(config.TimerCheck) * time.Second
+	}
+
+	scripts.active = make(map[string]*topicScript)
+	scripts.stats = new(expvar.Map).Init()
+	expvar.Publish("Scripts", scripts.stats)
+	scripts.enabled = true
+
+	http.HandleFunc(ADMIN_SCRIPTS_PATH, serveScripts)
+
+	go scriptsTimer(timerCheck)
+	logMain.Infof("Topic scripts enabled, %d steps and %s per call", scripts.maxSteps, scripts.timeout)
+}
+
+// scriptsLoad compiles the latest version of the topic's script unless it's compiled already.
+// Disabled and broken scripts are unloaded.
+func scriptsLoad(topic string, versions []types.TopicScript) {
+	if !scripts.enabled {
+		return
+	}
+
+	scripts.Lock()
+	defer scripts.Unlock()
+
+	if len(versions) == 0 || versions[len(versions)-1].Disabled {
+		delete(scripts.active, topic)
+		return
+	}
+	latest := &versions[len(versions)-1]
+	if current := scripts.active[topic]; current != nil && current.version == latest.Version {
+		return
+	}
+
+	program, err := scriptRuntime.compile(topic, latest.Source)
+	if err != nil {
+		logScripts.Warnf("scripts: topic '%s' version %d failed to compile: %v", topic, latest.Version, err)
+		delete(scripts.active, topic)
+		return
+	}
+	// The first timer fires one period after loading
+	scripts.active[topic] = &topicScript{version: latest.Version, program: program, lastRun: time.Now()}
+}
+
+// scriptsGet returns the active script of the topic or nil.
+func scriptsGet(topic string) *topicScript {
+	if !scripts.enabled {
+		return nil
+	}
+
+	scripts.Lock()
+	defer scripts.Unlock()
+	return scripts.active[topic]
+}
+
+// scriptCall runs the hook and checks the result.
+func scriptCall(topic string, script *topicScript, hook string, arg map[string]interface{}) *scriptResult {
+	res, err := script.program.call(hook, arg)
+	if err == nil && res != nil {
+		err = res.validate()
+	}
+	if err != nil {
+		scripts.stats.Add(hook+".failed", 1)
+		logScripts.Warnf("scripts: topic '%s' version %d %s: %v", topic, script.version, hook, err)
+		return nil
+	}
+	scripts.stats.Add(hook+".calls", 1)
+	return res
+}
+
+func (res *scriptResult) validate() error {
+	if len(res.Tags) > SCRIPT_MAX_TAGS {
+		return errors.New("too many tags")
+	}
+	for key, val := range res.Tags {
+		if !strings.HasPrefix(key, SCRIPT_TAG_PREFIX) || len(key) <= len(SCRIPT_TAG_PREFIX) ||
+			len(key) > SCRIPT_MAX_TAG_KEY || len(val) > SCRIPT_MAX_TAG_VALUE {
+			return errors.New("invalid tag '" + key + "'")
+		}
+	}
+	if len(res.Post) > SCRIPT_MAX_POST {
+		return errors.New("post too long")
+	}
+	return nil
+}
+
+// scriptPost publishes the text into the topic on behalf of the script.
+func scriptPost(topic string, version int, text string) {
+	now := types.TimeNow()
+	msg := &ServerComMessage{
+		Data: &MsgServerData{
+			Topic:     topic,
+			Timestamp: now,
+			Head:      map[string]string{"script": strconv.Itoa(version)},
+			Content:   text},
+		rcptto:    topic,
+		timestamp: now}
+	// May be called from the topic goroutine: don't block it
+	go func() {
+		globals.hub.route <- msg
+	}()
+	scripts.stats.Add("posts", 1)
+}
+
+func init() {
+	registerPubStage("scripts", true, pubScripts)
+}
+
+// pubScripts calls on_message of the topic's script. Failed scripts don't affect the message.
+func pubScripts(pc *pubContext) (*ServerComMessage, bool) {
+	t, msg := pc.t, pc.msg
+	if pc.edit || msg.Data.From == "" {
+		// Edits and messages posted by the server, including scripts, are not passed to scripts
+		return nil, true
+	}
+	script := scriptsGet(t.name)
+	if script == nil {
+		return nil, true
+	}
+
+	head := make(map[string]interface{}, len(msg.Data.Head))
+	for key, val := range msg.Data.Head {
+		head[key] = val
+	}
+	res := scriptCall(t.name, script, "on_message", map[string]interface{}{
+		"topic": t.name,
+		"from":  msg.Data.From,
+		"head":  head,
+		"text":  webViewText(msg.Data.Content)})
+	if res == nil {
+		return nil, true
+	}
+
+	if len(res.Tags) > 0 {
+		head := make(map[string]string, len(msg.Data.Head)+len(res.Tags))
+		for key, val := range msg.Data.Head {
+			head[key] = val
+		}
+		for key, val := range res.Tags {
+			head[key] = val
+		}
+		msg.Data.Head = head
+	}
+	if res.Post != "" {
+		scriptPost(t.name, script.version, res.Post)
+	}
+	return nil, true
+}
+
+// scriptsTimer calls on_timer of the scripts which are due.
+func scriptsTimer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if isStandby() {
+			// Scripts are run by the primary region
+			continue
+		}
+
+		topics, err := store.Topics.GetScripted()
+		if err != nil {
+			logScripts.Warn("scripts: failed to load topics", err)
+			continue
+		}
+
+		now := time.Now()
+		for i := range topics {
+			topic := &topics[i]
+			// Only the cluster node which owns the topic runs the timer
+			if globals.cluster.isRemoteTopic(topic.Id) {
+				continue
+			}
+			scriptsLoad(topic.Id, topic.Scripts)
+			script := scriptsGet(topic.Id)
+			if script == nil {
+				continue
+			}
+			every := script.program.every()
+			if every <= 0 {
+				continue
+			}
+			if every < scripts.minEvery {
+				every = scripts.minEvery
+			}
+
+			scripts.Lock()
+			due := now.Sub(script.lastRun) >= every
+			if due {
+				script.lastRun = now
+			}
+			scripts.Unlock()
+			if !due {
+				continue
+			}
+
+			if res := scriptCall(topic.Id, script, "on_timer", nil); res != nil && res.Post != "" {
+				scriptPost(topic.Id, script.version, res.Post)
+			}
+		}
+	}
+}
+
+// ScriptsReload reloads the script of the topic. Called by the node which received the admin request.
+func (c *Cluster) ScriptsReload(req *ClusterScriptsReq, unused *bool) error {
+	return scriptsReload(req.Topic)
+}
+
+func scriptsReload(name string) error {
+	topic, err := store.Topics.Get(name)
+	if err != nil {
+		return err
+	}
+	var versions []types.TopicScript
+	if topic != nil {
+		versions = topic.Scripts
+	}
+	scriptsLoad(name, versions)
+	return nil
+}
+
+// scriptsReloadAll reloads the script of the topic on this and all other nodes of the cluster.
+func (c *Cluster) scriptsReloadAll(topic string) error {
+	var failed error
+	if c != nil {
+		for _, n := range c.nodes {
+			unused := false
+			if err := n.call("Cluster.ScriptsReload", &ClusterScriptsReq{Topic: topic}, &unused); err != nil {
+				logCluster.Warnf("cluster: failed to reload script on node '%s': %v", n.name, err)
+				failed = err
+			}
+		}
+	}
+	if err := scriptsReload(topic); err != nil {
+		failed = err
+	}
+	return failed
+}
+
+// Version of the script as reported by the admin endpoint
+type scriptVersion struct {
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Author   string    `json:"author"`
+	Disabled bool      `json:"disabled,omitempty"`
+	Source   string    `json:"source"`
+}
+
+// serveScripts lists the versions of the topic's script or changes the script:
+// GET /v0/admin/scripts?topic=grpXXX
+// POST /v0/admin/scripts?topic=grpXXX with the source in the body - new version
+// POST /v0/admin/scripts?topic=grpXXX&action=restore&version=N - the source of version N as a new version
+// POST /v0/admin/scripts?topic=grpXXX&action=disable - stop running the script
+// Only root users and the owner and admins of the topic may use it.
+func serveScripts(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	writeErr := func(msg *ServerComMessage) {
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+	}
+
+	if req.Method != http.MethodGet && redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		writeErr(ErrAuthRequired("", "", now))
+		return
+	}
+
+	uid, authLvl, err := authHttpRequestLevel(req)
+	if err != nil {
+		writeErr(ErrAuthFailed("", "", now))
+		return
+	}
+
+	name := req.FormValue("topic")
+	if types.GetTopicCat(name) != types.TopicCat_Grp {
+		writeErr(ErrMalformed("", name, now))
+		return
+	}
+	topic, err := store.Topics.Get(name)
+	if err != nil {
+		writeErr(ErrUnknown("", name, now))
+		return
+	}
+	if topic == nil {
+		writeErr(ErrTopicNotFound("", name, now))
+		return
+	}
+
+	if authLvl != auth.LevelRoot {
+		sub, err := store.Subs.Get(name, uid)
+		if err != nil {
+			writeErr(ErrUnknown("", name, now))
+			return
+		}
+		if sub == nil || sub.DeletedAt != nil {
+			writeErr(ErrPermissionDenied("", name, now))
+			return
+		}
+		if mode := sub.ModeGiven & sub.ModeWant; !mode.IsAdmin() && !mode.IsOwner() {
+			writeErr(ErrPermissionDenied("", name, now))
+			return
+		}
+	}
+
+	versions := topic.Scripts
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var next types.TopicScript
+		switch req.FormValue("action") {
+		case "":
+			source, err := ioutil.ReadAll(io.LimitReader(req.Body, SCRIPT_MAX_SOURCE+1))
+			if err != nil || len(source) == 0 || len(source) > SCRIPT_MAX_SOURCE {
+				writeErr(ErrMalformed("", name, now))
+				return
+			}
+			next.Source = string(source)
+		case "restore":
+			version, _ := strconv.Atoi(req.FormValue("version"))
+			for i := range versions {
+				if versions[i].Version == version {
+					next.Source = versions[i].Source
+				}
+			}
+			if next.Source == "" {
+				writeErr(ErrNotFound("", name, now))
+				return
+			}
+		case "disable":
+			if len(versions) == 0 || versions[len(versions)-1].Disabled {
+				writeErr(InfoNoAction("", name, now))
+				return
+			}
+			next.Source = versions[len(versions)-1].Source
+			next.Disabled = true
+		default:
+			writeErr(ErrMalformed("", name, now))
+			return
+		}
+
+		if !next.Disabled {
+			if _, err := scriptRuntime.compile(name, next.Source); err != nil {
+				msg := ErrMalformed("", name, now)
+				msg.Ctrl.Params = map[string]string{"error": err.Error()}
+				writeErr(msg)
+				return
+			}
+		}
+
+		next.CreatedAt = now
+		next.Author = uid.UserId()
+		if len(versions) > 0 {
+			next.Version = versions[len(versions)-1].Version + 1
+		} else {
+			next.Version = 1
+		}
+		versions = append(versions, next)
+		if len(versions) > scripts.maxVersions {
+			versions = versions[len(versions)-scripts.maxVersions:]
+		}
+		if err = store.Topics.Update(name, map[string]interface{}{"Scripts": versions}); err != nil {
+			writeErr(ErrUnknown("", name, now))
+			return
+		}
+		if err = globals.cluster.scriptsReloadAll(name); err != nil {
+			// Saved, but some nodes may run the old version until the next timer check
+			logScripts.Warnf("scripts: topic '%s' reload failed: %v", name, err)
+		}
+		logScripts.Infof("scripts: topic '%s' version %d saved by %s", name, next.Version, next.Author)
+	default:
+		writeErr(ErrOperationNotAllowed("", name, now))
+		return
+	}
+
+	list := make([]scriptVersion, len(versions))
+	for i := range versions {
+		v := &versions[i]
+		list[i] = scriptVersion{Version: v.Version, Created: v.CreatedAt, Author: v.Author,
+			Disabled: v.Disabled, Source: v.Source}
+	}
+	enc.Encode(map[string]interface{}{"topic": name, "versions": list})
+}
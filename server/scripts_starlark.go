@@ -0,0 +1,168 @@
+// +build starlark
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// Starlark engine of topic scripts. Starlark has no access to files, network or clock, load() is not
+// available. Calls are limited by the number of execution steps and by time.
+
+type starlarkEngine struct{}
+
+type starlarkProgram struct {
+	name     string
+	globals  starlark.StringDict
+	interval time.Duration
+}
+
+func init() {
+	registerScriptEngine(starlarkEngine{})
+}
+
+// starlarkThread creates a thread limited by the configured steps and time. The returned
+// function must be called when the thread is done.
+func starlarkThread(name string) (*starlark.Thread, func()) {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			logScripts.Infof("scripts: topic '%s': %s", name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(scripts.maxSteps)
+	timer := time.AfterFunc(scripts.timeout, func() {
+		thread.Cancel("timeout")
+	})
+	return thread, func() { timer.Stop() }
+}
+
+func (starlarkEngine) compile(name, source string) (scriptProgram, error) {
+	thread, done := starlarkThread(name)
+	defer done()
+
+	globals, err := starlark.ExecFile(thread, name+".star", source, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Calls must not change the state of the script
+	globals.Freeze()
+
+	prog := &starlarkProgram{name: name, globals: globals}
+	if val, ok := globals["every"]; ok {
+		every, ok := val.(starlark.Int)
+		if !ok {
+			return nil, errors.New("'every' must be an integer")
+		}
+		secs, ok := every.Int64()
+		if !ok || secs < 0 {
+			return nil, errors.New("'every' is out of range")
+		}
+		prog.interval = time.Duration(secs) * time.Second
+	}
+	return prog, nil
+}
+
+func (p *starlarkProgram) every() time.Duration {
+	if _, ok := p.globals["on_timer"].(starlark.Callable); !ok {
+		return 0
+	}
+	return p.interval
+}
+
+func (p *starlarkProgram) call(hook string, arg map[string]interface{}) (*scriptResult, error) {
+	fn, ok := p.globals[hook].(starlark.Callable)
+	if !ok {
+		return nil, nil
+	}
+
+	var args starlark.Tuple
+	if arg != nil {
+		val, err := starlarkValue(arg)
+		if err != nil {
+			return nil, err
+		}
+		args = starlark.Tuple{val}
+	}
+
+	thread, done := starlarkThread(p.name)
+	defer done()
+
+	ret, err := starlark.Call(thread, fn, args, nil)
+	if err != nil {
+		return nil, err
+	}
+	return starlarkResult(ret)
+}
+
+// starlarkValue converts the argument of a hook to Starlark.
+func starlarkValue(val interface{}) (starlark.Value, error) {
+	switch val := val.(type) {
+	case nil:
+		return starlark.None, nil
+	case string:
+		return starlark.String(val), nil
+	case int:
+		return starlark.MakeInt(val), nil
+	case bool:
+		return starlark.Bool(val), nil
+	case map[string]interface{}:
+		dict := starlark.NewDict(len(val))
+		for key, item := range val {
+			v, err := starlarkValue(item)
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(key), v)
+		}
+		return dict, nil
+	}
+	return nil, errors.New("unsupported argument type")
+}
+
+// starlarkResult converts the value returned by a hook.
+func starlarkResult(ret starlark.Value) (*scriptResult, error) {
+	if ret == starlark.None {
+		return nil, nil
+	}
+	dict, ok := ret.(*starlark.Dict)
+	if !ok {
+		return nil, errors.New("hook must return None or a dict")
+	}
+
+	res := &scriptResult{}
+	for _, item := range dict.Items() {
+		key, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, errors.New("result keys must be strings")
+		}
+		switch key {
+		case "tags":
+			tags, ok := item[1].(*starlark.Dict)
+			if !ok {
+				return nil, errors.New("'tags' must be a dict")
+			}
+			res.Tags = make(map[string]string, tags.Len())
+			for _, tag := range tags.Items() {
+				name, ok1 := starlark.AsString(tag[0])
+				value, ok2 := starlark.AsString(tag[1])
+				if !ok1 || !ok2 {
+					return nil, errors.New("tags must be strings")
+				}
+				res.Tags[name] = value
+			}
+		case "post":
+			post, ok := starlark.AsString(item[1])
+			if !ok {
+				return nil, errors.New("'post' must be a string")
+			}
+			res.Post = post
+		default:
+			return nil, errors.New("unknown result key '" + key + "'")
+		}
+	}
+	return res, nil
+}
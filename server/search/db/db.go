@@ -0,0 +1,32 @@
+// Package db implements search interface by querying messages directly in the database
+// using the capabilities of the store adapter.
+package db
+
+import (
+	"github.com/tinode/chat/server/search"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const handlerName = "db"
+
+type dbhandler struct{}
+
+// Init initializes the search handler. There is nothing to configure.
+func (dbhandler) Init(jsconf string) error {
+	return nil
+}
+
+// Index does nothing: the messages are already in the database.
+func (dbhandler) Index(msg *types.Message) error {
+	return nil
+}
+
+// Search passes the query to the store adapter.
+func (dbhandler) Search(topic string, forUser types.Uid, query string, opts *types.BrowseOpt) ([]types.Message, error) {
+	return store.Messages.Search(topic, forUser, query, opts)
+}
+
+func init() {
+	search.Register(handlerName, dbhandler{})
+}
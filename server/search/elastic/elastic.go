@@ -0,0 +1,253 @@
+// Package elastic implements search interface by indexing messages in ElasticSearch.
+// The messages themselves are loaded from the database: the index contains only the
+// searchable text and the references to the messages.
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/search"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	handlerName = "elastic"
+
+	// Default name of the index
+	defaultIndex = "tinode"
+	// Default request timeout
+	defaultTimeout = 5 * time.Second
+	// Maximum number of search hits
+	maxHits = 1024
+)
+
+type configType struct {
+	// ElasticSearch endpoint, e.g. http://localhost:9200
+	Url string `json:"url"`
+	// Name of the index
+	Index string `json:"index"`
+	// Optional basic authentication
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Request timeout in milliseconds
+	Timeout int `json:"timeout"`
+}
+
+type eshandler struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+}
+
+// Document stored in the index
+type document struct {
+	Topic string    `json:"topic"`
+	SeqId int       `json:"seq"`
+	From  string    `json:"from,omitempty"`
+	Ts    time.Time `json:"ts"`
+	Text  string    `json:"text"`
+}
+
+// Mapping of the index. Topic and sender must not be analyzed to be usable in filters.
+const indexMapping = `{
+	"mappings": {
+		"properties": {
+			"topic": {"type": "keyword"},
+			"seq": {"type": "integer"},
+			"from": {"type": "keyword"},
+			"ts": {"type": "date"},
+			"text": {"type": "text"}
+		}
+	}
+}`
+
+// Init initializes the search handler and creates the index if it does not exist.
+func (eh *eshandler) Init(jsconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.Url == "" {
+		return errors.New("missing url")
+	}
+	if config.Index == "" {
+		config.Index = defaultIndex
+	}
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	eh.url = strings.TrimSuffix(config.Url, "/") + "/" + config.Index
+	eh.username = config.Username
+	eh.password = config.Password
+	eh.client = &http.Client{Timeout: timeout}
+
+	resp, err := eh.do(http.MethodHead, "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		resp, err = eh.do(http.MethodPut, "", strings.NewReader(indexMapping))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return eh.error(resp)
+		}
+	} else if resp.StatusCode != http.StatusOK {
+		return errors.New("elastic: unexpected response status " + resp.Status)
+	}
+	return nil
+}
+
+// Index adds the message to the index. Non-string content is indexed in its JSON representation.
+func (eh *eshandler) Index(msg *types.Message) error {
+	text, ok := msg.Content.(string)
+	if !ok {
+		raw, err := json.Marshal(msg.Content)
+		if err != nil {
+			return err
+		}
+		text = string(raw)
+	}
+
+	body, err := json.Marshal(&document{
+		Topic: msg.Topic,
+		SeqId: msg.SeqId,
+		From:  msg.From,
+		Ts:    msg.CreatedAt,
+		Text:  text})
+	if err != nil {
+		return err
+	}
+
+	resp, err := eh.do(http.MethodPut, "/_doc/"+msg.Topic+"-"+strconv.Itoa(msg.SeqId), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return eh.error(resp)
+	}
+	return nil
+}
+
+// Search queries the index and loads the matching messages from the database. Messages which
+// were deleted after being indexed are skipped.
+func (eh *eshandler) Search(topic string, forUser types.Uid, query string, opts *types.BrowseOpt) ([]types.Message, error) {
+	limit := maxHits
+	seqRange := map[string]int{}
+	if opts != nil {
+		if opts.Since > 0 {
+			seqRange["gte"] = opts.Since
+		}
+		if opts.Before > 0 {
+			seqRange["lt"] = opts.Before
+		}
+		if opts.Limit > 0 && int(opts.Limit) < limit {
+			limit = int(opts.Limit)
+		}
+	}
+
+	filter := []interface{}{
+		map[string]interface{}{"term": map[string]interface{}{"topic": topic}},
+	}
+	if len(seqRange) > 0 {
+		filter = append(filter, map[string]interface{}{"range": map[string]interface{}{"seq": seqRange}})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"size":    limit,
+		"_source": []string{"seq"},
+		"sort":    []interface{}{map[string]string{"seq": "desc"}},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"match": map[string]interface{}{
+						"text": map[string]string{"query": query, "operator": "and"}}},
+				"filter": filter}}})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := eh.do(http.MethodPost, "/_search", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, eh.error(resp)
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source document `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	if len(result.Hits.Hits) == 0 {
+		return nil, nil
+	}
+
+	list := make([]int, len(result.Hits.Hits))
+	for i, hit := range result.Hits.Hits {
+		list[i] = hit.Source.SeqId
+	}
+	found, err := store.Messages.GetList(topic, forUser, list)
+	if err != nil {
+		return nil, err
+	}
+
+	// The database returns the messages in any order
+	bySeq := make(map[int]*types.Message, len(found))
+	for i := range found {
+		bySeq[found[i].SeqId] = &found[i]
+	}
+	var msgs []types.Message
+	for _, seq := range list {
+		if mm := bySeq[seq]; mm != nil && mm.DeletedAt == nil {
+			msgs = append(msgs, *mm)
+		}
+	}
+	return msgs, nil
+}
+
+func (eh *eshandler) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, eh.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if eh.username != "" {
+		req.SetBasicAuth(eh.username, eh.password)
+	}
+	return eh.client.Do(req)
+}
+
+func (eh *eshandler) error(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return errors.New("elastic: " + resp.Status + " " + string(msg))
+}
+
+func init() {
+	search.Register(handlerName, &eshandler{})
+}
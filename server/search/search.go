@@ -0,0 +1,43 @@
+package search
+
+// Interfaces for full-text search of messages
+
+import (
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Handler is an interface which must be implemented by search backends.
+type Handler interface {
+	// Init initializes the search handler.
+	Init(jsconf string) error
+
+	// Index adds a newly saved message to the search index. Handlers which query the database
+	// directly should do nothing.
+	Index(msg *types.Message) error
+
+	// Search finds messages in the topic which match the query, newest first. Messages deleted
+	// for the requester must not be returned.
+	Search(topic string, forUser types.Uid, query string, opts *types.BrowseOpt) ([]types.Message, error)
+}
+
+var handlers map[string]Handler
+
+// Register a search handler
+func Register(name string, hnd Handler) {
+	if handlers == nil {
+		handlers = make(map[string]Handler)
+	}
+
+	if hnd == nil {
+		panic("Register: search handler is nil")
+	}
+	if _, dup := handlers[name]; dup {
+		panic("Register: called twice for handler " + name)
+	}
+	handlers[name] = hnd
+}
+
+// GetHandler returns a registered handler by name or nil if the handler is not found.
+func GetHandler(name string) Handler {
+	return handlers[name]
+}
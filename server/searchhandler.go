@@ -0,0 +1,91 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Full-text search of messages. Clients search with
+ *  {get what="data" data={query: "..."}}. The search is performed by the
+ *  configured search handler: "db" uses the store adapter, "elastic" an
+ *  external ElasticSearch cluster.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/tinode/chat/server/search"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of search results
+	SEARCH_DEFAULT_LIMIT = 32
+	// Maximum number of search results
+	SEARCH_MAX_LIMIT = 128
+	// Minimum length of the search query
+	SEARCH_MIN_QUERY_LENGTH = 2
+)
+
+type searchConfig struct {
+	// Name of the handler to use for message search, e.g. "db" or "elastic"
+	UseHandler string `json:"use_handler"`
+	// Individual handler configs
+	Handlers map[string]json.RawMessage `json:"handlers"`
+}
+
+// searchInit parses config and initializes the search handler. Search is disabled if no handler is configured.
+func searchInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config searchConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logSearch.Fatal("Failed to parse search config:", err)
+	}
+
+	if config.UseHandler == "" {
+		return
+	}
+
+	globals.searchHandler = search.GetHandler(config.UseHandler)
+	if globals.searchHandler == nil {
+		logSearch.Fatal("Unknown search handler '" + config.UseHandler + "'")
+	}
+	if err := globals.searchHandler.Init(string(config.Handlers[config.UseHandler])); err != nil {
+		logSearch.Fatal("Failed to initialize search handler:", err)
+	}
+	logSearch.Infof("Using search handler '%s'", config.UseHandler)
+}
+
+// searchReply runs the search and sends the found messages to the session as {data}, newest last.
+// It's called outside of the topic goroutine: topic is the routable name, original is the name as
+// seen by the user.
+func searchReply(sess *Session, id, topic, original, query string, opts *types.BrowseOpt, now time.Time) {
+	messages, err := globals.searchHandler.Search(topic, sess.uid, query, opts)
+	if err != nil {
+		logSearch.Warnf("search: topic '%s' failed: %v", topic, err)
+		sess.queueOut(ErrUnknown(id, original, now))
+		return
+	}
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		sess.queueOut(storedMessage(original, sess.uid, &messages[i]))
+	}
+	sess.queueOut(NoErr(id, original, now))
+}
+
+// searchIndex passes a newly saved message to the search handler. Indexing is done in the background.
+func searchIndex(msg *types.Message) {
+	if globals.searchHandler == nil {
+		return
+	}
+
+	go func() {
+		if err := globals.searchHandler.Index(msg); err != nil {
+			logSearch.Errorf("search: failed to index message %s:%d: %v", msg.Topic, msg.SeqId, err)
+		}
+	}()
+}
@@ -0,0 +1,247 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Priority classes of packets sent to sessions. Each session has three
+ *  outbound queues:
+ *    send   - {ctrl}, {data}, {meta} and {info} other than typing, in order;
+ *    pres   - {pres} notifications;
+ *    typing - {info what="kp"}.
+ *  Writers always send the packets queued in a higher class first. When a
+ *  queue is full the packet is handled according to its class:
+ *    ctrl   - waits for a short time; the last slots of the send queue are
+ *             reserved for {ctrl}, so responses get through a flood of data;
+ *    data   - a published message which would take the reserve of {ctrl} is
+ *             dropped and not counted as delivered for push notifications;
+ *             the session stays attached. A session whose queue is full,
+ *             reserve included, is stuck and is detached from the topic;
+ *    pres   - the oldest queued notification is dropped to make room;
+ *    typing - the new notification is dropped.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"time"
+)
+
+// Priority classes of outbound packets, highest first
+const (
+	SEND_CLASS_CTRL = iota
+	SEND_CLASS_DATA
+	SEND_CLASS_PRES
+	SEND_CLASS_TYPING
+)
+
+const (
+	// Default size of the send queue
+	SEND_DEFAULT_QUEUE = 256
+	// Default number of slots of the send queue reserved for {ctrl}
+	SEND_DEFAULT_CTRL_RESERVE = 16
+	// Default size of the presence queue
+	SEND_DEFAULT_PRES_QUEUE = 128
+	// Default size of the typing notifications queue
+	SEND_DEFAULT_TYPING_QUEUE = 16
+	// Time to wait for a place in the queue
+	SEND_QUEUE_TIMEOUT = 10 * time.Millisecond
+)
+
+type sendQueueConfig struct {
+	// Size of the queue of {ctrl} and {data}
+	Size int `json:"size"`
+	// Slots of the queue which {data} cannot take
+	CtrlReserve int `json:"ctrl_reserve"`
+	// Size of the queue of {pres}
+	Presence int `json:"presence"`
+	// Size of the queue of typing notifications
+	Typing int `json:"typing"`
+}
+
+var sendQueue = struct {
+	size        int
+	ctrlReserve int
+	presence    int
+	typing      int
+
+	// Exported as SendQueues in expvar
+	dropped [SEND_CLASS_TYPING + 1]*expvar.Int
+}{
+	size:        SEND_DEFAULT_QUEUE,
+	ctrlReserve: SEND_DEFAULT_CTRL_RESERVE,
+	presence:    SEND_DEFAULT_PRES_QUEUE,
+	typing:      SEND_DEFAULT_TYPING_QUEUE,
+}
+
+var sendClassNames = [...]string{"ctrl", "data", "pres", "typing"}
+
+// sendQueueInit parses config and publishes the metrics.
+func sendQueueInit(jsconfig json.RawMessage) {
+	var config sendQueueConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			logMain.Fatal("Failed to parse send_queues config:", err)
+		}
+	}
+
+	if config.Size > 0 {
+		sendQueue.size = config.Size
+	}
+	if config.CtrlReserve > 0 {
+		sendQueue.ctrlReserve = config.CtrlReserve
+	}
+	if sendQueue.ctrlReserve >= sendQueue.size {
+		sendQueue.ctrlReserve = sendQueue.size / 2
+	}
+	if config.Presence > 0 {
+		sendQueue.presence = config.Presence
+	}
+	if config.Typing > 0 {
+		sendQueue.typing = config.Typing
+	}
+
+	vars := new(expvar.Map).Init()
+	for i := range sendQueue.dropped {
+		sendQueue.dropped[i] = new(expvar.Int)
+		vars.Set("dropped_"+sendClassNames[i], sendQueue.dropped[i])
+	}
+	expvar.Publish("SendQueues", vars)
+}
+
+// sendQueueDropped counts a dropped packet.
+func sendQueueDropped(class int) {
+	if sendQueue.dropped[class] != nil {
+		sendQueue.dropped[class].Add(1)
+	}
+}
+
+// sendClass returns the priority class of the message.
+func sendClass(msg *ServerComMessage) int {
+	switch {
+	case msg.Ctrl != nil:
+		return SEND_CLASS_CTRL
+	case msg.Pres != nil:
+		return SEND_CLASS_PRES
+	case msg.Info != nil && msg.Info.What == "kp":
+		return SEND_CLASS_TYPING
+	}
+	return SEND_CLASS_DATA
+}
+
+// makeSendQueues creates the outbound queues of the session.
+func (s *Session) makeSendQueues() {
+	s.send = make(chan []byte, sendQueue.size)
+	s.sendPres = make(chan []byte, sendQueue.presence)
+	s.sendTyping = make(chan []byte, sendQueue.typing)
+}
+
+// enqueue adds the packet to the queue of its class without waiting. Returns false if the packet of
+// the ctrl or data class does not fit.
+func (s *Session) enqueue(packet []byte, class int) bool {
+	switch class {
+	case SEND_CLASS_PRES:
+		if s.sendPres == nil {
+			break
+		}
+		for {
+			select {
+			case s.sendPres <- packet:
+				return true
+			default:
+			}
+			// Drop the oldest notification
+			select {
+			case <-s.sendPres:
+				sendQueueDropped(SEND_CLASS_PRES)
+			default:
+			}
+		}
+	case SEND_CLASS_TYPING:
+		if s.sendTyping == nil {
+			break
+		}
+		select {
+		case s.sendTyping <- packet:
+		default:
+			sendQueueDropped(SEND_CLASS_TYPING)
+		}
+		return true
+	case SEND_CLASS_DATA:
+		if cap(s.send)-len(s.send) <= sendQueue.ctrlReserve && cap(s.send) > sendQueue.ctrlReserve {
+			// The rest of the queue is kept for {ctrl}
+			sendQueueDropped(SEND_CLASS_DATA)
+			return false
+		}
+	}
+
+	select {
+	case s.send <- packet:
+		return true
+	default:
+		sendQueueDropped(class)
+		return false
+	}
+}
+
+// sendStuck checks if the send queue is full including the reserve of {ctrl}: the writer does not
+// keep up at all.
+func (s *Session) sendStuck() bool {
+	return len(s.send) >= cap(s.send)
+}
+
+// enqueueWait adds the packet to the queue of its class, waits for a short time if the queue is full.
+func (s *Session) enqueueWait(packet []byte, class int) bool {
+	if class == SEND_CLASS_PRES || class == SEND_CLASS_TYPING {
+		return s.enqueue(packet, class)
+	}
+
+	// Responses to the session's own requests may take the reserve
+	select {
+	case s.send <- packet:
+		return true
+	case <-time.After(SEND_QUEUE_TIMEOUT):
+		sendQueueDropped(class)
+		return false
+	}
+}
+
+// nextUrgent returns a packet queued with a priority higher than the class and its class, without waiting.
+func (s *Session) nextUrgent(class int) ([]byte, int, bool) {
+	if class > SEND_CLASS_DATA {
+		select {
+		case msg := <-s.send:
+			return msg, SEND_CLASS_DATA, true
+		default:
+		}
+	}
+	if class > SEND_CLASS_PRES {
+		select {
+		case msg := <-s.sendPres:
+			return msg, SEND_CLASS_PRES, true
+		default:
+		}
+	}
+	return nil, 0, false
+}
+
+// writeQueued writes the packet of the given class taken from the queue, after the packets
+// queued with a higher priority.
+func (s *Session) writeQueued(msg []byte, class int, write func([]byte, int) error) error {
+	for {
+		urgent, urgentClass, ok := s.nextUrgent(class)
+		if !ok {
+			break
+		}
+		if err := write(urgent, urgentClass); err != nil {
+			return err
+		}
+	}
+	return write(msg, class)
+}
+
+// queuedCount returns the number of packets in all queues of the session.
+func (s *Session) queuedCount() int {
+	return len(s.send) + len(s.sendPres) + len(s.sendTyping)
+}
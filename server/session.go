@@ -11,18 +11,19 @@ package main
 
 import (
 	"container/list"
-	"encoding/json"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Wire transport
@@ -31,6 +32,8 @@ const (
 	WEBSOCK
 	LPOLL
 	RPC
+	SSE
+	MQTT
 )
 
 var MIN_SUPPORTED_VERSION_VAL = parseVersion(MIN_SUPPORTED_VERSION)
@@ -38,7 +41,11 @@ var MIN_SUPPORTED_VERSION_VAL = parseVersion(MIN_SUPPORTED_VERSION)
 // A single WS connection or a long polling session. A user may have multiple
 // sessions.
 type Session struct {
-	// protocol - NONE (unset), WEBSOCK, LPOLL, RPC
+	// Time in Unix nanoseconds when the session received any packet from client. Accessed atomically,
+	// kept first for 64-bit alignment.
+	lastAction int64
+
+	// protocol - NONE (unset), WEBSOCK, LPOLL, RPC, SSE, MQTT
 	proto int
 
 	// -- Set only for websockets
@@ -51,6 +58,16 @@ type Session struct {
 	lpTracker *list.Element
 	// --
 
+	// -- Set only for SSE sessions
+	// Event stream
+	sse *sseConn
+	// --
+
+	// -- Set only for MQTT sessions
+	// Connection of the MQTT client
+	mqtt *mqttConn
+	// --
+
 	// -- Set only for RPC sessions
 	// reference to the cluster node where the session has originated
 	rpcnode *ClusterNode
@@ -65,10 +82,15 @@ type Session struct {
 	// Protocol version of the client: ((major & 0xff) << 8) | (minor & 0xff)
 	ver int
 
+	// Binary encoding negotiated by the client, nil for JSON
+	enc frameEncoding
+
 	// Device ID of the client
 	deviceId string
 	// Human language of the client
 	lang string
+	// Platform of the device, used to choose the push notification provider
+	platform string
 
 	// ID of the current user or 0
 	uid types.Uid
@@ -76,14 +98,23 @@ type Session struct {
 	// Authentication level - NONE (unset), ANON, AUTH, ROOT
 	authLvl int
 
+	// Login with a password waiting for the second factor
+	pendingLogin *pendingLogin
+
+	// Root admin who opened this read-only session on behalf of the user, or 0
+	impersonator types.Uid
+	// Time when the impersonated session expires
+	impersonationExpires time.Time
+
 	// Time when the long polling session was last refreshed
 	lastTouched time.Time
 
-	// Time when the session received any packer from client
-	lastAction time.Time
-
 	// outbound mesages, buffered
 	send chan []byte
+	// outbound presence notifications, buffered, sent after 'send'
+	sendPres chan []byte
+	// outbound typing notifications, buffered, sent last
+	sendTyping chan []byte
 
 	// channel for shutting down the session, buffer 1
 	stop chan []byte
@@ -94,9 +125,29 @@ type Session struct {
 	// Map of topic subscriptions, indexed by topic name
 	subs map[string]*Subscription
 
+	// channel for detaching the idle session from its topics, buffer 1
+	hibernate chan bool
+	// Topics the session was detached from while idle, indexed by topic name
+	hibernated map[string]*hibernatedTopic
+	// Lock for hibernated
+	hlock sync.Mutex
+
 	// Nodes to inform when the session is disconnected
 	nodes map[string]bool
 
+	// Topics of other nodes the session is attached to, indexed by topic name
+	remoteSubs map[string]*remoteSub
+	// Lock for remoteSubs and nodes
+	rlock sync.Mutex
+
+	// Recent requests waiting for responses
+	reqs recentReqs
+
+	// Long polling with shared state: ID of the last message queued in each topic
+	lpSeq map[string]int
+	// Lock for lpSeq
+	lpLock sync.Mutex
+
 	// Session ID
 	sid string
 
@@ -128,11 +179,11 @@ func (s *Session) queueOut(msg *ServerComMessage) {
 		return
 	}
 
-	data, _ := json.Marshal(msg)
-	select {
-	case s.send <- data:
-	case <-time.After(time.Millisecond * 10):
-		log.Println("session.queueOut: timeout")
+	s.reqStamp(msg)
+	data := encodePacket(msg)
+	memMessageQueued(len(data))
+	if !s.enqueueWait(data, sendClass(msg)) {
+		logSession.Warn("session.queueOut: timeout")
 	}
 }
 
@@ -140,11 +191,19 @@ func (s *Session) queueOut(msg *ServerComMessage) {
 func (s *Session) dispatchRaw(raw []byte) {
 	var msg ClientComMessage
 
-	log.Printf("Session.dispatch got '%s' from '%s'", raw, s.remoteAddr)
+	// Messages in a binary encoding are converted to JSON
+	raw, err := frameToJSON(s.enc, raw)
+	if err != nil {
+		logSession.Debug("Session.dispatch: " + err.Error())
+		s.queueOut(ErrMalformed("", "", time.Now().UTC().Round(time.Millisecond)))
+		return
+	}
 
-	if err := json.Unmarshal(raw, &msg); err != nil {
+	logSession.Debugf("Session.dispatch got '%s' from '%s'", raw, s.remoteAddr)
+
+	if err = wire.Unmarshal(raw, &msg); err != nil {
 		// Malformed message
-		log.Println("Session.dispatch: " + err.Error())
+		logSession.Debug("Session.dispatch: " + err.Error())
 		s.queueOut(ErrMalformed("", "", time.Now().UTC().Round(time.Millisecond)))
 		return
 	}
@@ -152,15 +211,36 @@ func (s *Session) dispatchRaw(raw []byte) {
 	s.dispatch(&msg)
 }
 
+// lastActionAt returns the time when the session received any packet from client, zero if none.
+func (s *Session) lastActionAt() time.Time {
+	if ns := atomic.LoadInt64(&s.lastAction); ns != 0 {
+		return time.Unix(0, ns).UTC()
+	}
+	return time.Time{}
+}
+
 func (s *Session) dispatch(msg *ClientComMessage) {
-	s.lastAction = time.Now().UTC().Round(time.Millisecond)
+	now := time.Now().UTC().Round(time.Millisecond)
+	atomic.StoreInt64(&s.lastAction, now.UnixNano())
+
+	if s.hibernate != nil {
+		// Attach to the topics released while the session was idle
+		s.wake()
+	}
 
 	msg.from = s.uid.UserId()
-	msg.timestamp = s.lastAction
+	msg.timestamp = now
+	s.reqStart(msg)
+
+	if !s.impersonator.IsZero() && !s.impersonationAllowed(msg) {
+		// Impersonated sessions are read-only
+		return
+	}
 
-	// Locking-unlocking is needed for long polling: the client may issue multiple requests in parallel.
+	// Locking-unlocking is needed for long polling and SSE: the client may issue multiple requests in parallel.
+	// MQTT sessions dispatch requests from the read loop and from the responses to earlier requests.
 	// Should not affect performance
-	if s.proto == LPOLL {
+	if s.proto == LPOLL || s.proto == SSE || s.proto == MQTT {
 		s.rw.Lock()
 		defer s.rw.Unlock()
 	}
@@ -168,48 +248,48 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 	switch {
 	case msg.Pub != nil:
 		s.publish(msg)
-		log.Println("dispatch: Pub done")
+		logSession.Debug("dispatch: Pub done, req=", msg.reqId)
 
 	case msg.Sub != nil:
 		s.subscribe(msg)
-		log.Println("dispatch: Sub done")
+		logSession.Debug("dispatch: Sub done, req=", msg.reqId)
 
 	case msg.Leave != nil:
 		s.leave(msg)
-		log.Println("dispatch: Leave done")
+		logSession.Debug("dispatch: Leave done, req=", msg.reqId)
 
 	case msg.Hi != nil:
 		s.hello(msg)
-		log.Println("dispatch: Hi done")
+		logSession.Debug("dispatch: Hi done, req=", msg.reqId)
 
 	case msg.Login != nil:
 		s.login(msg)
-		log.Println("dispatch: Login done")
+		logSession.Debug("dispatch: Login done, req=", msg.reqId)
 
 	case msg.Get != nil:
 		s.get(msg)
-		log.Println("dispatch: Get." + msg.Get.What + " done")
+		logSession.Debug("dispatch: Get."+msg.Get.What+" done, req=", msg.reqId)
 
 	case msg.Set != nil:
 		s.set(msg)
-		log.Println("dispatch: Set done")
+		logSession.Debug("dispatch: Set done, req=", msg.reqId)
 
 	case msg.Del != nil:
 		s.del(msg)
-		log.Println("dispatch: Del." + msg.Del.What + " done")
+		logSession.Debug("dispatch: Del."+msg.Del.What+" done, req=", msg.reqId)
 
 	case msg.Acc != nil:
 		s.acc(msg)
-		log.Println("dispatch: Acc done")
+		logSession.Debug("dispatch: Acc done, req=", msg.reqId)
 
 	case msg.Note != nil:
 		s.note(msg)
-		log.Println("dispatch: Note." + msg.Note.What + " done")
+		logSession.Debug("dispatch: Note."+msg.Note.What+" done, req=", msg.reqId)
 
 	default:
 		// Unknown message
 		s.queueOut(ErrMalformed("", "", msg.timestamp))
-		log.Println("Session.dispatch: unknown message")
+		logSession.Debug("Session.dispatch: unknown message, req=", msg.reqId)
 	}
 
 	// Notify 'me' topic that this session is currently active
@@ -223,7 +303,7 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 
 // Request to subscribe to a topic
 func (s *Session) subscribe(msg *ClientComMessage) {
-	log.Printf("Sub to '%s' from '%s'", msg.Sub.Topic, msg.from)
+	logSession.Debugf("Sub to '%s' from '%s'", msg.Sub.Topic, msg.from)
 
 	var topic, expanded string
 
@@ -236,6 +316,10 @@ func (s *Session) subscribe(msg *ClientComMessage) {
 		// Request to create a new named topic
 		expanded = genTopicName()
 		topic = expanded
+	} else if strings.HasPrefix(msg.Sub.Topic, "nch") {
+		// Request to create a new channel
+		expanded = genChannelName()
+		topic = expanded
 	} else {
 		var err *ServerComMessage
 		expanded, err = s.validateTopicName(msg.Sub.Id, msg.Sub.Topic, msg.timestamp)
@@ -246,12 +330,16 @@ func (s *Session) subscribe(msg *ClientComMessage) {
 	}
 
 	if _, ok := s.subs[expanded]; ok {
-		log.Printf("sess.subscribe: already subscribed to '%s'", expanded)
+		logSession.Debugf("sess.subscribe: already subscribed to '%s'", expanded)
 		s.queueOut(InfoAlreadySubscribed(msg.Sub.Id, topic, msg.timestamp))
 	} else if globals.cluster.isRemoteTopic(expanded) {
 		// The topic is handled by a remote node. Forward message to it.
 		if err := globals.cluster.routeToTopic(msg, expanded, s); err != nil {
 			s.queueOut(ErrClusterNodeUnreachable(msg.Sub.Id, topic, msg.timestamp))
+		} else if topic != "" {
+			s.remoteSubAdd(expanded, topic)
+		} else {
+			s.remoteSubAdd(expanded, msg.Sub.Topic)
 		}
 	} else {
 		//log.Printf("Sub to'%s' (%s) from '%s' as '%s' -- OK!", expanded, msg.Sub.Topic, msg.from, topic)
@@ -268,6 +356,11 @@ func (s *Session) leave(msg *ClientComMessage) {
 		return
 	}
 
+	if msg.Leave.All != "" {
+		s.replyLeaveAll(msg)
+		return
+	}
+
 	expanded, err := s.validateTopicName(msg.Leave.Id, msg.Leave.Topic, msg.timestamp)
 	if err != nil {
 		s.queueOut(err)
@@ -289,6 +382,8 @@ func (s *Session) leave(msg *ClientComMessage) {
 		// The topic is handled by a remote node. Forward message to it.
 		if err := globals.cluster.routeToTopic(msg, expanded, s); err != nil {
 			s.queueOut(ErrClusterNodeUnreachable(msg.Leave.Id, msg.Leave.Topic, msg.timestamp))
+		} else {
+			s.remoteSubDel(expanded)
 		}
 	} else if !msg.Leave.Unsub {
 		// Session is not attached to the topic, wants to leave - fine, no change
@@ -310,26 +405,66 @@ func (s *Session) publish(msg *ClientComMessage) {
 
 	// TODO(gene): Check for repeated messages with the same ID
 
+	var span trace.Span
+	msg.ctx, span = traceStart(msg.ctx, "session.pub",
+		attribute.String("topic", msg.Pub.Topic), attribute.String("sid", s.sid),
+		attribute.String("reqid", msg.reqId))
+	defer span.End()
+
+	if msg.Pub.Replace < 0 || msg.Pub.Thread < 0 {
+		s.queueOut(ErrMalformed(msg.Pub.Id, msg.Pub.Topic, msg.timestamp))
+		return
+	}
+
+	var deliverAt time.Time
+	if msg.Pub.DeliverAt != nil {
+		// Edits are applied immediately, only new messages can be scheduled
+		if msg.Pub.Replace > 0 || !scheduledValid(*msg.Pub.DeliverAt, msg.timestamp) {
+			s.queueOut(ErrMalformed(msg.Pub.Id, msg.Pub.Topic, msg.timestamp))
+			return
+		}
+		deliverAt = msg.Pub.DeliverAt.UTC().Round(time.Millisecond)
+	}
+
 	expanded, err := s.validateTopicName(msg.Pub.Id, msg.Pub.Topic, msg.timestamp)
 	if err != nil {
 		s.queueOut(err)
 		return
 	}
 
+	head := msg.Pub.Head
+	if len(msg.Pub.Mentions) > 0 {
+		// Structured mentions take precedence over head.mentions
+		head = make(map[string]string, len(msg.Pub.Head)+1)
+		for key, val := range msg.Pub.Head {
+			head[key] = val
+		}
+		head["mentions"] = strings.Join(msg.Pub.Mentions, ",")
+	}
+
 	data := &ServerComMessage{Data: &MsgServerData{
 		Topic:     msg.Pub.Topic,
 		From:      msg.from,
 		Timestamp: msg.timestamp,
-		Head:      msg.Pub.Head,
+		Head:      head,
+		Thread:    msg.Pub.Thread,
 		Content:   msg.Pub.Content},
-		rcptto: expanded, sessFrom: s, id: msg.Pub.Id, timestamp: msg.timestamp}
+		rcptto: expanded, sessFrom: s, id: msg.Pub.Id, replace: msg.Pub.Replace, deliverAt: deliverAt,
+		timestamp: msg.timestamp, received: time.Now(), ctx: msg.ctx, reqId: msg.reqId}
 	if msg.Pub.NoEcho {
 		data.skipSid = s.sid
 	}
 
 	if sub, ok := s.subs[expanded]; ok {
+		// Stages of the publishing pipeline which don't need the topic, e.g. plugins
+		if !pubSessionStages(data) {
+			return
+		}
 		// This is a post to a subscribed topic. The message is sent to the topic only
 		sub.broadcast <- data
+	} else if globals.cluster != nil && handoffBuffer(expanded, data) {
+		// The topic is moving to another cluster node, the message is sent there when the move completes.
+		// Sessions still attached to the topic send messages through it to keep them in order.
 	} else if globals.cluster.isRemoteTopic(expanded) {
 		// The topic is handled by a remote node. Forward message to it.
 		if err := globals.cluster.routeToTopic(msg, expanded, s); err != nil {
@@ -385,12 +520,13 @@ func (s *Session) hello(msg *ClientComMessage) {
 	s.userAgent = msg.Hi.UserAgent
 	s.deviceId = msg.Hi.DeviceID
 	s.lang = msg.Hi.Lang
+	s.platform = parsePlatform(msg.Hi.Platform)
 
-	params := map[string]interface{}{"ver": VERSION, "build": buildstamp}
+	params := map[string]interface{}{"ver": VERSION, "build": buildstamp, "types": msgTypes.names}
 	var httpStatus int
 	var httpStatusText string
-	if s.proto == LPOLL {
-		// In case of long polling StatusCreated was reported earlier.
+	if s.proto == LPOLL || s.proto == SSE {
+		// In case of long polling and SSE StatusCreated was reported earlier.
 		httpStatus = http.StatusOK
 		httpStatusText = "ok"
 
@@ -419,15 +555,39 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
+	if msg.Login.Scheme == "totp" {
+		// Second step of the login with a password
+		s.loginSecondFactor(msg)
+		return
+	}
+
+	if msg.Login.Scheme == "impersonate" {
+		// Read-only login of support staff as the user
+		s.loginImpersonate(msg)
+		return
+	}
+
 	handler := store.GetAuthHandler(msg.Login.Scheme)
 	if handler == nil {
 		s.queueOut(ErrAuthUnknownScheme(msg.Login.Id, "", msg.timestamp))
 		return
 	}
 
+	if msg.Login.Scheme == "anonymous" && shedAnonymous() {
+		// The server is overloaded, existing users go first
+		s.queueOut(ErrServiceUnavailable(msg.Login.Id, "", msg.timestamp))
+		return
+	}
+
+	limitKeys := loginLimitKeys(msg.Login.Scheme, msg.Login.Secret, s.remoteAddr)
+	if retry := loginLockedOut(limitKeys); retry > 0 {
+		s.queueOut(ErrTooManyRequests(msg.Login.Id, "", msg.timestamp, retry))
+		return
+	}
+
 	uid, authLvl, expires, authErr := handler.Authenticate(msg.Login.Secret)
 	if authErr.IsError() {
-		log.Println(authErr.Err)
+		logSession.Info("login failed, req=", msg.reqId, ": ", authErr.Err)
 	}
 
 	if authErr.Code == auth.ErrMalformed {
@@ -437,30 +597,54 @@ func (s *Session) login(msg *ClientComMessage) {
 
 	// DB error
 	if authErr.Code == auth.ErrInternal {
-		s.queueOut(ErrUnknown(msg.Login.Id, "", msg.timestamp))
+		s.queueOut(ErrStoreUnavailable(msg.Login.Id, "", msg.timestamp))
 		return
 	}
 
 	// All other errors are reported as invalid login or password
 	if uid.IsZero() {
-		s.queueOut(ErrAuthFailed(msg.Login.Id, "", msg.timestamp))
+		loginFailed(limitKeys)
+		if authErr.Code == auth.ErrExpired {
+			s.queueOut(ErrAuthExpired(msg.Login.Id, "", msg.timestamp))
+		} else {
+			s.queueOut(ErrAuthFailed(msg.Login.Id, "", msg.timestamp))
+		}
 		return
 	}
 
-	s.uid = uid
-	s.authLvl = authLvl
+	if msg.Login.Scheme == "basic" {
+		var pending bool
+		if authLvl, pending = s.requireSecondFactor(msg, uid, authLvl, expires, limitKeys); pending {
+			return
+		}
+	}
 
-	if msg.Login.Scheme != "token" {
-		handler = store.GetAuthHandler("token")
+	loginSucceeded(limitKeys)
+	s.loginComplete(msg, uid, authLvl, expires)
+}
+
+// loginComplete authenticates the session and issues a token.
+func (s *Session) loginComplete(msg *ClientComMessage, uid types.Uid, authLvl int, expires time.Time) {
+	if user, err := store.Users.Get(uid); err != nil {
+		s.queueOut(ErrStoreUnavailable(msg.Login.Id, "", msg.timestamp))
+		return
+	} else if !userStateLoaded(user) {
+		logSession.Info("login rejected, account ", userStateName(user.State), ", req=", msg.reqId, ": ",
+			uid.UserId())
+		s.queueOut(ErrAccountState(msg.Login.Id, "", msg.timestamp, user.State, user.StateReason))
+		return
 	}
 
+	s.uid = uid
+	s.authLvl = authLvl
+
 	var tokenLifetime time.Duration
 	if !expires.IsZero() {
 		tokenLifetime = time.Until(expires)
 	}
-	secret, expires, authErr := handler.GenSecret(uid, authLvl, tokenLifetime)
+	secret, expires, authErr := store.GetAuthHandler("token").GenSecret(uid, authLvl, tokenLifetime)
 	if authErr.IsError() {
-		log.Println(authErr.Err)
+		logSession.Info(authErr.Err)
 		s.queueOut(ErrAuthFailed(msg.Login.Id, "", msg.timestamp))
 		return
 	}
@@ -469,7 +653,7 @@ func (s *Session) login(msg *ClientComMessage) {
 	if s.deviceId != "" {
 		store.Devices.Update(uid, &types.DeviceDef{
 			DeviceId: s.deviceId,
-			Platform: "",
+			Platform: s.platform,
 			LastSeen: msg.timestamp,
 			Lang:     s.lang,
 		})
@@ -491,6 +675,12 @@ func (s *Session) acc(msg *ClientComMessage) {
 		return
 	}
 
+	if msg.Acc.Scheme == "totp" {
+		// Enrollment in two-factor authentication
+		s.accSecondFactor(msg)
+		return
+	}
+
 	// FIXME(gene): it should be possible to change Tags without stating the auth scheme
 	authhdl := store.GetAuthHandler(msg.Acc.Scheme)
 	if authhdl == nil {
@@ -505,9 +695,15 @@ func (s *Session) acc(msg *ClientComMessage) {
 			return
 		}
 
+		if msg.Acc.Scheme == "anonymous" && shedAnonymous() {
+			// The server is overloaded, existing users go first
+			s.queueOut(ErrServiceUnavailable(msg.Acc.Id, "", msg.timestamp))
+			return
+		}
+
 		// Request to create a new account
 		if ok, authErr := authhdl.IsUnique(msg.Acc.Secret); !ok {
-			log.Println("Not unique: ", authErr.Err)
+			logSession.Warn("Not unique:", authErr.Err)
 			if authErr.Code == auth.ErrDuplicate {
 				s.queueOut(ErrDuplicateCredential(msg.Acc.Id, "", msg.timestamp))
 			} else {
@@ -556,6 +752,11 @@ func (s *Session) acc(msg *ClientComMessage) {
 			}
 		}
 
+		if reject := pluginAccount(&user, msg.Acc.Id, msg.timestamp); reject != nil {
+			s.queueOut(reject)
+			return
+		}
+
 		if _, err := store.Users.Create(&user, private); err != nil {
 			s.queueOut(ErrUnknown(msg.Acc.Id, "", msg.timestamp))
 			return
@@ -563,7 +764,7 @@ func (s *Session) acc(msg *ClientComMessage) {
 
 		var authLvl int
 		if al, authErr := authhdl.AddRecord(user.Uid(), msg.Acc.Secret, 0); authErr.IsError() {
-			log.Println(authErr.Err)
+			logSession.Info(authErr.Err)
 			// Attempt to delete incomplete user record
 			store.Users.Delete(user.Uid(), false)
 			s.queueOut(decodeAuthError(authErr.Code, msg.Acc.Id, msg.timestamp))
@@ -599,7 +800,7 @@ func (s *Session) acc(msg *ClientComMessage) {
 			if s.deviceId != "" {
 				store.Devices.Update(s.uid, &types.DeviceDef{
 					DeviceId: s.deviceId,
-					Platform: "",
+					Platform: s.platform,
 					LastSeen: msg.timestamp,
 					Lang:     s.lang,
 				})
@@ -614,7 +815,7 @@ func (s *Session) acc(msg *ClientComMessage) {
 		// TODO(gene): support adding new auth schemes
 		// TODO(gene): support the case when msg.Acc.User is not equal to the current user
 		if authErr := authhdl.UpdateRecord(s.uid, msg.Acc.Secret, 0); authErr.IsError() {
-			log.Println("failed to update credentials", authErr.Err)
+			logSession.Error("failed to update credentials", authErr.Err)
 			s.queueOut(decodeAuthError(authErr.Code, msg.Acc.Id, msg.timestamp))
 			return
 		}
@@ -630,7 +831,7 @@ func (s *Session) acc(msg *ClientComMessage) {
 }
 
 func (s *Session) get(msg *ClientComMessage) {
-	log.Println("s.get: processing 'get." + msg.Get.What + "'")
+	logSession.Debug("s.get: processing 'get." + msg.Get.What + "'")
 
 	if s.ver == 0 {
 		s.queueOut(ErrCommandOutOfSequence(msg.Get.Id, msg.Get.Topic, msg.timestamp))
@@ -644,6 +845,12 @@ func (s *Session) get(msg *ClientComMessage) {
 		return
 	}
 
+	if msg.Get.What == "inline" {
+		// Inline bot queries are answered by the bot, not by the topic
+		s.inlineQuery(msg, expanded)
+		return
+	}
+
 	sub, ok := s.subs[expanded]
 	meta := &metaReq{
 		topic: expanded,
@@ -653,7 +860,7 @@ func (s *Session) get(msg *ClientComMessage) {
 
 	if meta.what == 0 {
 		s.queueOut(ErrMalformed(msg.Get.Id, msg.Get.Topic, msg.timestamp))
-		log.Println("s.get: invalid Get message action: '" + msg.Get.What + "'")
+		logSession.Warn("s.get: invalid Get message action: '" + msg.Get.What + "'")
 	} else if ok {
 		sub.meta <- meta
 	} else if globals.cluster.isRemoteTopic(expanded) {
@@ -662,8 +869,10 @@ func (s *Session) get(msg *ClientComMessage) {
 			s.queueOut(ErrClusterNodeUnreachable(msg.Get.Id, msg.Get.Topic, msg.timestamp))
 		}
 	} else {
-		if (meta.what&constMsgMetaData != 0) || (meta.what&constMsgMetaSub != 0) {
-			log.Println("s.get: invalid Get message action for hub routing: '" + msg.Get.What + "'")
+		if (meta.what&constMsgMetaData != 0) || (meta.what&constMsgMetaSub != 0) ||
+			(meta.what&constMsgMetaProfiles != 0) || (meta.what&constMsgMetaSessions != 0) ||
+			(meta.what&constMsgMetaContacts != 0) {
+			logSession.Warn("s.get: invalid Get message action for hub routing: '" + msg.Get.What + "'")
 			s.queueOut(ErrPermissionDenied(msg.Get.Id, msg.Get.Topic, msg.timestamp))
 		} else {
 			// Description of a topic not currently subscribed to. Request desc from the hub
@@ -673,7 +882,7 @@ func (s *Session) get(msg *ClientComMessage) {
 }
 
 func (s *Session) set(msg *ClientComMessage) {
-	log.Println("s.set: processing 'set'")
+	logSession.Debug("s.set: processing 'set'")
 
 	if s.ver == 0 {
 		s.queueOut(ErrCommandOutOfSequence(msg.Set.Id, msg.Set.Topic, msg.timestamp))
@@ -699,12 +908,39 @@ func (s *Session) set(msg *ClientComMessage) {
 		if msg.Set.Sub != nil {
 			meta.what |= constMsgMetaSub
 		}
+		if msg.Set.Remind != nil {
+			meta.what |= constMsgMetaRemind
+		}
+		if msg.Set.Action != nil {
+			meta.what |= constMsgMetaAction
+		}
+		if msg.Set.Notify != nil {
+			meta.what |= constMsgMetaNotify
+		}
+		if msg.Set.Invite != nil {
+			meta.what |= constMsgMetaInvite
+		}
+		if msg.Set.Transfer != nil {
+			meta.what |= constMsgMetaTransfer
+		}
+		if msg.Set.Impersonate != nil {
+			meta.what |= constMsgMetaImpersonate
+		}
+		if msg.Set.Block != nil {
+			meta.what |= constMsgMetaBlock
+		}
+		if msg.Set.Contact != nil {
+			meta.what |= constMsgMetaContact
+		}
+		if msg.Set.Privacy != nil {
+			meta.what |= constMsgMetaPrivacy
+		}
 		if meta.what == 0 {
 			s.queueOut(ErrMalformed(msg.Set.Id, msg.Set.Topic, msg.timestamp))
-			log.Println("s.set: nil Set action")
+			logSession.Info("s.set: nil Set action")
 		}
 
-		log.Println("s.set: sending to topic")
+		logSession.Debug("s.set: sending to topic")
 		sub.meta <- meta
 	} else if globals.cluster.isRemoteTopic(expanded) {
 		// The topic is handled by a remote node. Forward message to it.
@@ -712,13 +948,13 @@ func (s *Session) set(msg *ClientComMessage) {
 			s.queueOut(ErrClusterNodeUnreachable(msg.Set.Id, msg.Set.Topic, msg.timestamp))
 		}
 	} else {
-		log.Println("s.set: can Set for subscribed topics only")
+		logSession.Warn("s.set: can Set for subscribed topics only")
 		s.queueOut(ErrPermissionDenied(msg.Set.Id, msg.Set.Topic, msg.timestamp))
 	}
 }
 
 func (s *Session) del(msg *ClientComMessage) {
-	log.Println("s.del: processing 'del." + msg.Del.What + "'")
+	logSession.Debug("s.del: processing 'del." + msg.Del.What + "'")
 
 	if s.ver == 0 {
 		s.queueOut(ErrCommandOutOfSequence(msg.Del.Id, msg.Del.Topic, msg.timestamp))
@@ -735,13 +971,13 @@ func (s *Session) del(msg *ClientComMessage) {
 	what := parseMsgClientDel(msg.Del.What)
 	if what == 0 {
 		s.queueOut(ErrMalformed(msg.Del.Id, msg.Del.Topic, msg.timestamp))
-		log.Println("s.del: invalid Del action '" + msg.Del.What + "'")
+		logSession.Warn("s.del: invalid Del action '" + msg.Del.What + "'")
 	}
 
 	sub, ok := s.subs[expanded]
 	if ok && what != constMsgDelTopic {
 		// Session is attached, deleting subscription or messages. Send to topic.
-		log.Println("s.del: sending to topic")
+		logSession.Debug("s.del: sending to topic")
 		sub.meta <- &metaReq{
 			topic: expanded,
 			pkt:   msg,
@@ -764,7 +1000,7 @@ func (s *Session) del(msg *ClientComMessage) {
 	} else {
 		// Must join the topic to delete messages or subscriptions.
 		s.queueOut(ErrAttachFirst(msg.Del.Id, msg.Del.Topic, msg.timestamp))
-		log.Println("s.del: invalid Del action while unsubbed '" + msg.Del.What + "'")
+		logSession.Warn("s.del: invalid Del action while unsubbed '" + msg.Del.What + "'")
 	}
 }
 
@@ -790,17 +1026,58 @@ func (s *Session) note(msg *ClientComMessage) {
 		if msg.Note.SeqId <= 0 {
 			return
 		}
+	case "check":
+		if msg.Note.SeqId <= 0 || msg.Note.Item == nil || *msg.Note.Item < 0 || msg.Note.Done == nil {
+			return
+		}
+	case "rsvp":
+		if msg.Note.SeqId <= 0 || !isValidRsvp(msg.Note.Rsvp) {
+			return
+		}
+	case "card":
+		if msg.Note.SeqId <= 0 || msg.Note.Card == nil || msg.Note.Card.Elem == "" {
+			return
+		}
+	case "edit":
+		if msg.Note.SeqId <= 0 || msg.Note.Content == nil {
+			return
+		}
+	case "react", "unreact":
+		if msg.Note.SeqId <= 0 || !isValidReaction(msg.Note.React) {
+			return
+		}
+	case "pin", "unpin":
+		if msg.Note.SeqId <= 0 {
+			return
+		}
+	case "answer":
+		// Bot's answer to an inline query goes directly to the querying session
+		if err := s.inlineAnswer(msg.Note.Answer); err != nil {
+			logSession.Warn("s.note: " + err.Error())
+		}
+		return
 	default:
 		return
 	}
 
+	if shedNote(msg.Note.What) {
+		// The server is overloaded
+		return
+	}
+
 	if sub, ok := s.subs[expanded]; ok {
 		// Pings can be sent to subscribed topics only
 		sub.broadcast <- &ServerComMessage{Info: &MsgServerInfo{
-			Topic: msg.Note.Topic,
-			From:  s.uid.UserId(),
-			What:  msg.Note.What,
-			SeqId: msg.Note.SeqId,
+			Topic:   msg.Note.Topic,
+			From:    s.uid.UserId(),
+			What:    msg.Note.What,
+			SeqId:   msg.Note.SeqId,
+			Item:    msg.Note.Item,
+			Done:    msg.Note.Done,
+			Rsvp:    msg.Note.Rsvp,
+			Card:    msg.Note.Card,
+			Content: msg.Note.Content,
+			React:   msg.Note.React,
 		}, rcptto: expanded, timestamp: msg.timestamp, skipSid: s.sid}
 	} else if globals.cluster.isRemoteTopic(expanded) {
 		// The topic is handled by a remote node. Forward message to it.
@@ -810,9 +1087,10 @@ func (s *Session) note(msg *ClientComMessage) {
 
 // validateTopicName expands session specific topic name to global name
 // Returns
-//   topic: session-specific topic name the message recepient should see
-//   routeTo: routable global topic name
-//   err: *ServerComMessage with an error to return to the sender
+//
+//	topic: session-specific topic name the message recepient should see
+//	routeTo: routable global topic name
+//	err: *ServerComMessage with an error to return to the sender
 func (s *Session) validateTopicName(msgId, topic string, timestamp time.Time) (string, *ServerComMessage) {
 
 	if topic == "" {
@@ -847,8 +1125,18 @@ func (s *Session) validateTopicName(msgId, topic string, timestamp time.Time) (s
 	return routeTo, nil
 }
 
+// parsePlatform normalizes the device platform reported by the client, unknown platforms are ignored.
+func parsePlatform(platform string) string {
+	switch platform = strings.ToLower(platform); platform {
+	case "ios", "android", "web":
+		return platform
+	}
+	return ""
+}
+
 func filterTags(dst *[]string, src []string) int {
-	if globals.indexableTags == nil || len(globals.indexableTags) == 0 {
+	tags := indexableTags()
+	if len(tags) == 0 {
 		return 0
 	}
 
@@ -861,7 +1149,7 @@ func filterTags(dst *[]string, src []string) int {
 			continue
 		}
 		parts[0] = strings.ToLower(parts[0])
-		for _, tag := range globals.indexableTags {
+		for _, tag := range tags {
 			if parts[0] == tag {
 				*dst = append(*dst, s)
 			}
@@ -888,7 +1176,7 @@ func decodeAuthError(code int, id string, timestamp time.Time) *ServerComMessage
 	case auth.ErrUnsupported:
 		errmsg = ErrNotImplemented(id, "", timestamp)
 	case auth.ErrExpired:
-		errmsg = ErrAuthFailed(id, "", timestamp)
+		errmsg = ErrAuthExpired(id, "", timestamp)
 	case auth.ErrPolicy:
 		errmsg = ErrPolicy(id, "", timestamp)
 	default:
@@ -10,8 +10,6 @@ package main
 
 import (
 	"container/list"
-	"encoding/json"
-	"log"
 	"net/http"
 	"sync"
 	"time"
@@ -47,15 +45,24 @@ func (ss *SessionStore) Create(conn interface{}, sid string) *Session {
 	case *ClusterNode:
 		s.proto = RPC
 		s.rpcnode = c
+	case *sseConn:
+		s.proto = SSE
+		s.sse = c
+	case *mqttConn:
+		s.proto = MQTT
+		s.mqtt = c
 	default:
 		s.proto = NONE
 	}
 
 	if s.proto != NONE {
 		s.subs = make(map[string]*Subscription)
-		s.send = make(chan []byte, 256)  // buffered
+		s.makeSendQueues()
 		s.stop = make(chan []byte, 1)    // Buffered by 1 just to make it non-blocking
 		s.detach = make(chan string, 64) // buffered
+		if (s.proto == WEBSOCK || s.proto == SSE) && hibernation.idle > 0 {
+			s.hibernate = make(chan bool, 1)
+		}
 	}
 
 	s.lastTouched = time.Now()
@@ -105,6 +112,14 @@ func (ss *SessionStore) Get(sid string) *Session {
 	return nil
 }
 
+// has checks if the session is still in the store.
+func (ss *SessionStore) has(s *Session) bool {
+	ss.rw.RLock()
+	defer ss.rw.RUnlock()
+
+	return ss.sessCache[s.sid] == s
+}
+
 func (ss *SessionStore) Delete(s *Session) {
 	ss.rw.Lock()
 	defer ss.rw.Unlock()
@@ -113,23 +128,146 @@ func (ss *SessionStore) Delete(s *Session) {
 
 	if s.proto == LPOLL {
 		ss.lru.Remove(s.lpTracker)
+		lpStateDrop(s.sid)
+	}
+
+	if !s.impersonator.IsZero() && s.proto != RPC {
+		logAudit.Infof("impersonation: sess[%s] of %s by %s closed", s.sid, s.uid.UserId(),
+			s.impersonator.UserId())
 	}
 }
 
-// Shutting down sessionStore. No need to clean up.
+// Shutting down sessionStore. Sessions are sent the shutdown notice after the messages already
+// queued for them. Waits until the websocket sessions disconnect or the deadline passes.
 // Don't send to clustered sessions, their servers are not being shut down.
-func (ss *SessionStore) Shutdown() {
-	ss.rw.Lock()
-	defer ss.rw.Unlock()
+func (ss *SessionStore) Shutdown(deadline time.Time) {
+	count := ss.stopAll(NoErrShutdown(time.Now().UTC().Round(time.Millisecond)))
+
+	for time.Now().Before(deadline) && ss.countWS() > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	logSession.Infof("SessionStore shut down, sessions terminated: %d, still connected: %d", count, ss.countWS())
+}
+
+// Redirect disconnects the sessions telling them to reconnect to the given URL.
+func (ss *SessionStore) Redirect(url string) {
+	count := ss.stopAll(InfoRedirect(url, time.Now().UTC().Round(time.Millisecond)))
+	logSession.Infof("SessionStore redirected %d sessions to %s", count, url)
+}
+
+// stopAll sends the message to the sessions and stops them. Returns the number of sessions.
+func (ss *SessionStore) stopAll(msg *ServerComMessage) int {
+	data := encodePacket(msg)
+
+	ss.rw.RLock()
+	defer ss.rw.RUnlock()
+
+	for _, s := range ss.sessCache {
+		if s.stop != nil && s.proto != RPC {
+			select {
+			case s.stop <- data:
+			default:
+				// The session is already stopping
+			}
+		}
+	}
+	return len(ss.sessCache)
+}
+
+// StopIdle stops the client sessions which have not sent anything for the given time.
+// Returns the number of stopped sessions.
+func (ss *SessionStore) StopIdle(idle time.Duration, msg *ServerComMessage) int {
+	data := encodePacket(msg)
+	expire := time.Now().Add(-idle)
+
+	ss.rw.RLock()
+	defer ss.rw.RUnlock()
+
+	count := 0
+	for _, s := range ss.sessCache {
+		if s.stop == nil || s.proto == RPC {
+			continue
+		}
+		last := s.lastActionAt()
+		if last.IsZero() {
+			last = s.lastTouched
+		}
+		if last.Before(expire) {
+			select {
+			case s.stop <- data:
+				count++
+			default:
+			}
+		}
+	}
+	return count
+}
+
+// Hibernate asks the websocket sessions which have not sent anything for the given time to detach
+// from their topics. Returns the number of sessions asked.
+func (ss *SessionStore) Hibernate(idle time.Duration) int {
+	expire := time.Now().Add(-idle)
 
-	shutdown, _ := json.Marshal(NoErrShutdown(time.Now().UTC().Round(time.Millisecond)))
+	ss.rw.RLock()
+	defer ss.rw.RUnlock()
+
+	count := 0
 	for _, s := range ss.sessCache {
-		if s.send != nil && s.proto != RPC {
-			s.send <- shutdown
+		if s.hibernate == nil || s.uid.IsZero() {
+			continue
+		}
+		last := s.lastActionAt()
+		if last.IsZero() {
+			last = s.lastTouched
+		}
+		if last.Before(expire) {
+			select {
+			case s.hibernate <- true:
+				count++
+			default:
+			}
 		}
 	}
+	return count
+}
+
+// all returns all sessions.
+func (ss *SessionStore) all() []*Session {
+	ss.rw.RLock()
+	defer ss.rw.RUnlock()
+
+	list := make([]*Session, 0, len(ss.sessCache))
+	for _, s := range ss.sessCache {
+		list = append(list, s)
+	}
+	return list
+}
 
-	log.Printf("SessionStore shut down, sessions terminated: %d", len(ss.sessCache))
+// queuedMessages returns the number of messages waiting to be sent to the sessions.
+func (ss *SessionStore) queuedMessages() int {
+	ss.rw.RLock()
+	defer ss.rw.RUnlock()
+
+	count := 0
+	for _, s := range ss.sessCache {
+		count += s.queuedCount()
+	}
+	return count
+}
+
+// countWS returns the number of websocket and SSE sessions.
+func (ss *SessionStore) countWS() int {
+	ss.rw.RLock()
+	defer ss.rw.RUnlock()
+
+	count := 0
+	for _, s := range ss.sessCache {
+		if s.proto == WEBSOCK || s.proto == SSE || s.proto == MQTT {
+			count++
+		}
+	}
+	return count
 }
 
 func NewSessionStore(lifetime time.Duration) *SessionStore {
@@ -0,0 +1,114 @@
+package main
+
+// Concurrency tests of the session store. Run with go test -race.
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Long polling sessions are created, looked up, expired and deleted at once while the cluster
+// forwards responses to them and idle sessions are being stopped.
+func TestSessionStoreConcurrent(t *testing.T) {
+	const workers = 8
+	const perWorker = 200
+
+	// Short lifetime: creating a session expires the older ones while others still use them
+	ss := NewSessionStore(5 * time.Millisecond)
+	globals.sessionStore = ss
+	globals.cluster = nil
+
+	shutdown := NoErrShutdown(time.Now())
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var created []*Session
+			for i := 0; i < perWorker; i++ {
+				sid := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				created = append(created, ss.Create(httptest.NewRecorder(), sid))
+
+				// Sessions of this and other workers, possibly expired already
+				ss.Get(sid)
+				ss.Get(strconv.Itoa((w+1)%workers) + "-" + strconv.Itoa(i))
+
+				// Response from the topic's master node
+				var unused bool
+				Cluster{}.Proxy(&ClusterResp{Msg: []byte("{}"), FromSID: sid}, &unused)
+
+				if i%10 == 0 {
+					ss.StopIdle(time.Millisecond, shutdown)
+					ss.queuedMessages()
+				}
+				if i%3 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			for _, sess := range created {
+				ss.Delete(sess)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(ss.sessCache) != 0 {
+		t.Errorf("sessions left in cache: %d", len(ss.sessCache))
+	}
+	if ss.lru.Len() != 0 {
+		t.Errorf("sessions left in LRU list: %d", ss.lru.Len())
+	}
+}
+
+// Sessions are redirected by the store while they are being deleted. Stopping must not block
+// on sessions which already have a stop notice pending.
+func TestSessionStoreStopDelete(t *testing.T) {
+	ss := NewSessionStore(time.Minute)
+	globals.sessionStore = ss
+
+	sessions := make([]*Session, 100)
+	for i := range sessions {
+		sessions[i] = ss.Create(httptest.NewRecorder(), strconv.Itoa(i))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			ss.Redirect("https://example.com")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for _, sess := range sessions {
+			ss.Delete(sess)
+		}
+	}()
+	wg.Wait()
+
+	if len(ss.sessCache) != 0 {
+		t.Errorf("sessions left in cache: %d", len(ss.sessCache))
+	}
+}
+
+func BenchmarkSessionStoreGet(b *testing.B) {
+	ss := NewSessionStore(time.Hour)
+	const count = 1000
+	for i := 0; i < count; i++ {
+		ss.Create(httptest.NewRecorder(), strconv.Itoa(i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ss.Get(strconv.Itoa(i % count))
+			i++
+		}
+	})
+}
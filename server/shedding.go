@@ -0,0 +1,224 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Load shedding. When the node is overloaded, i.e. the CPU usage of the
+ *  process or the number of messages queued to sessions and topics is above
+ *  the configured threshold, the node sheds load in steps, one step per
+ *  check for as long as the overload lasts:
+ *    1. new anonymous sessions are refused with 503;
+ *    2. non-essential notes, {note what="kp"} and {note what="recv"}, are dropped;
+ *    3. new topics are not loaded, subscribers are told to retry with 429.
+ *  Steps are undone one at a time when the load drops below 80% of the
+ *  thresholds. Topics already loaded and sessions already attached keep
+ *  working, so existing conversations are not interrupted.
+ *
+ *  Independently of the node, a topic with a long queue drops its own
+ *  non-essential notes.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Steps of load shedding
+const (
+	SHED_NONE = iota
+	SHED_ANONYMOUS
+	SHED_NOTES
+	SHED_TOPICS
+)
+
+const (
+	// Interval between checks of the load
+	SHED_CHECK_INTERVAL = time.Second
+	// Clients are asked to retry loading topics after this time
+	SHED_RETRY_AFTER = 5 * time.Second
+	// Default CPU usage in percent above which the node sheds load
+	SHED_DEFAULT_CPU_HIGH = 90
+	// Default length of the topic's queue above which the topic drops notes
+	SHED_DEFAULT_TOPIC_QUEUE = 192
+)
+
+type sheddingConfig struct {
+	// Enable load shedding
+	Enabled bool `json:"enabled"`
+	// CPU usage of the process in percent of all available cores. 0 means the default, -1 ignores CPU.
+	CpuHigh int `json:"cpu_high"`
+	// Number of messages queued to sessions and topics, 0 ignores queues.
+	QueueHigh int `json:"queue_high"`
+	// Number of messages queued to one topic above which the topic drops non-essential notes.
+	// 0 means the default, -1 disables.
+	TopicQueueHigh int `json:"topic_queue_high"`
+}
+
+var shedding struct {
+	enabled    bool
+	cpuHigh    int
+	queueHigh  int
+	topicQueue int
+
+	// Current step, one of SHED_*
+	level int32
+
+	// CPU time and wall time at the previous check
+	lastCpu  time.Duration
+	lastWall time.Time
+
+	// Exported as LoadShedding in expvar
+	cpu       *expvar.Int
+	queued    *expvar.Int
+	anonymous *expvar.Int
+	notes     *expvar.Int
+	topics    *expvar.Int
+}
+
+// sheddingInit parses config and starts the checks of the load. Load shedding is off by default.
+func sheddingInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config sheddingConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse load_shedding config:", err)
+	}
+
+	if !config.Enabled {
+		return
+	}
+
+	shedding.cpuHigh = config.CpuHigh
+	if shedding.cpuHigh == 0 {
+		shedding.cpuHigh = SHED_DEFAULT_CPU_HIGH
+	}
+	if shedding.cpuHigh > 0 {
+		if _, ok := processCpuTime(); !ok {
+			logMain.Warn("CPU usage is not available on this platform, load shedding uses queues only")
+			shedding.cpuHigh = -1
+		}
+	}
+	shedding.queueHigh = config.QueueHigh
+	shedding.topicQueue = config.TopicQueueHigh
+	if shedding.topicQueue == 0 {
+		shedding.topicQueue = SHED_DEFAULT_TOPIC_QUEUE
+	}
+
+	shedding.cpu = new(expvar.Int)
+	shedding.queued = new(expvar.Int)
+	shedding.anonymous = new(expvar.Int)
+	shedding.notes = new(expvar.Int)
+	shedding.topics = new(expvar.Int)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("level", expvar.Func(func() interface{} { return atomic.LoadInt32(&shedding.level) }))
+	vars.Set("cpu", shedding.cpu)
+	vars.Set("queued", shedding.queued)
+	vars.Set("anonymous_refused", shedding.anonymous)
+	vars.Set("notes_dropped", shedding.notes)
+	vars.Set("topics_refused", shedding.topics)
+	expvar.Publish("LoadShedding", vars)
+
+	shedding.enabled = true
+	shedding.lastCpu, _ = processCpuTime()
+	shedding.lastWall = time.Now()
+
+	go func() {
+		for range time.Tick(SHED_CHECK_INTERVAL) {
+			shedCheck()
+		}
+	}()
+
+	logMain.Infof("Load shedding: CPU %d%%, queued messages %d", shedding.cpuHigh, shedding.queueHigh)
+}
+
+// shedCheck measures the load and moves one step up or down.
+func shedCheck() {
+	cpu := -1
+	if shedding.cpuHigh > 0 {
+		now := time.Now()
+		used, _ := processCpuTime()
+		if wall := now.Sub(shedding.lastWall); wall > 0 {
+			cpu = int(100 * (used - shedding.lastCpu) / (wall * time.Duration(runtime.GOMAXPROCS(0))))
+		}
+		shedding.lastCpu, shedding.lastWall = used, now
+		shedding.cpu.Set(int64(cpu))
+	}
+
+	queued := globals.sessionStore.queuedMessages() + topicWatchQueued()
+	shedding.queued.Set(int64(queued))
+
+	over := (shedding.cpuHigh > 0 && cpu >= shedding.cpuHigh) ||
+		(shedding.queueHigh > 0 && queued >= shedding.queueHigh)
+	under := (shedding.cpuHigh <= 0 || cpu < shedding.cpuHigh*8/10) &&
+		(shedding.queueHigh <= 0 || queued < shedding.queueHigh*8/10)
+
+	level := atomic.LoadInt32(&shedding.level)
+	if over && level < SHED_TOPICS {
+		level++
+		logMain.Warnf("Node is overloaded (CPU %d%%, queued %d), shedding load, level %d", cpu, queued, level)
+	} else if under && level > SHED_NONE {
+		level--
+		logMain.Infof("Node load is down (CPU %d%%, queued %d), shedding level %d", cpu, queued, level)
+	} else {
+		return
+	}
+	atomic.StoreInt32(&shedding.level, level)
+}
+
+// shedLevel returns true if the node sheds load at the given step or higher.
+func shedLevel(level int32) bool {
+	return shedding.enabled && atomic.LoadInt32(&shedding.level) >= level
+}
+
+// shedAnonymous checks if a new anonymous session may be started.
+func shedAnonymous() bool {
+	if !shedLevel(SHED_ANONYMOUS) {
+		return false
+	}
+	shedding.anonymous.Add(1)
+	return true
+}
+
+// isEssentialNote checks if the note must be delivered even when the server is overloaded.
+func isEssentialNote(what string) bool {
+	return what != "kp" && what != "recv"
+}
+
+// shedNote checks if the note should be dropped because the node is overloaded.
+func shedNote(what string) bool {
+	if isEssentialNote(what) || !shedLevel(SHED_NOTES) {
+		return false
+	}
+	shedding.notes.Add(1)
+	return true
+}
+
+// shedNote checks if the note should be dropped because the topic is overloaded.
+func (t *Topic) shedNote(what string) bool {
+	if !shedding.enabled || shedding.topicQueue < 0 || isEssentialNote(what) ||
+		len(t.broadcast) < shedding.topicQueue {
+		return false
+	}
+	shedding.notes.Add(1)
+	return true
+}
+
+// shedRefuseTopic checks if the topic may be loaded. If not, the session is told to retry later.
+func shedRefuseTopic(sreg *sessionJoin) bool {
+	if !shedLevel(SHED_TOPICS) {
+		return false
+	}
+	shedding.topics.Add(1)
+	sreg.sess.queueOut(ErrTooManyRequests(sreg.pkt.Id, sreg.pkt.Topic, types.TimeNow(), SHED_RETRY_AFTER))
+	return true
+}
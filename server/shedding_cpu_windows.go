@@ -0,0 +1,8 @@
+package main
+
+import "time"
+
+// processCpuTime is not implemented on Windows.
+func processCpuTime() (time.Duration, bool) {
+	return 0, false
+}
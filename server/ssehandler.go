@@ -0,0 +1,225 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Handler of Server-Sent Events clients (see also wshandler for web sockets
+ *  and lphandler for long polling). The client opens an EventSource to
+ *    GET /v0/channels/sse
+ *  and receives every server message as one event. The first event is a
+ *  {ctrl} with the session ID in params.sid. Messages from the client are
+ *  posted to
+ *    POST /v0/channels/sse?sid=<session ID>
+ *  one or more messages per request; the responses arrive over the stream.
+ *  The session ends when the stream is closed. The POST may reach any node
+ *  of the cluster: it's forwarded to the node which holds the session.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Stream of events of a SSE session
+type sseConn struct {
+	wrt     http.ResponseWriter
+	flusher http.Flusher
+}
+
+// write sends the packet as one event. Lines of the packet are sent as separate data fields.
+func (c *sseConn) write(packet []byte) error {
+	var buf bytes.Buffer
+	for _, line := range bytes.Split(packet, []byte{'\n'}) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	if _, err := c.wrt.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// ping sends a comment to keep proxies from closing the idle stream.
+func (c *sseConn) ping() error {
+	if _, err := c.wrt.Write([]byte(": ping\n\n")); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// sseLoop writes the queued messages to the stream until the client disconnects or the session is stopped.
+func (sess *Session) sseLoop(closed <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+
+	defer func() {
+		ticker.Stop()
+		logSession.Debug("serveSSE - stop")
+		globals.sessionStore.Delete(sess)
+		globals.cluster.sessionGone(sess)
+		for _, sub := range sess.subs {
+			// sub.done is the same as topic.unreg
+			sub.done <- &sessionLeave{sess: sess, unsub: false}
+		}
+	}()
+
+	write := func(msg []byte, class int) error {
+		return sess.sse.write(msg)
+	}
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				return
+			}
+			if err := sess.sse.write(msg); err != nil {
+				logSession.Warn("sess.sseLoop: " + err.Error())
+				return
+			}
+		case msg := <-sess.sendPres:
+			if err := sess.writeQueued(msg, SEND_CLASS_PRES, write); err != nil {
+				logSession.Warn("sess.sseLoop: " + err.Error())
+				return
+			}
+		case msg := <-sess.sendTyping:
+			if err := sess.writeQueued(msg, SEND_CLASS_TYPING, write); err != nil {
+				logSession.Warn("sess.sseLoop: " + err.Error())
+				return
+			}
+		case msg := <-sess.stop:
+			// Write the messages and notifications already queued, then the notice
+			for {
+				queued, _, ok := sess.nextUrgent(SEND_CLASS_TYPING)
+				if !ok {
+					break
+				}
+				if err := sess.sse.write(queued); err != nil {
+					return
+				}
+			}
+			if msg != nil {
+				sess.sse.write(msg)
+			}
+			return
+
+		case topic := <-sess.detach:
+			delete(sess.subs, topic)
+
+		case <-sess.hibernate:
+			sess.hibernateTopics()
+
+		case <-closed:
+			return
+
+		case <-ticker.C:
+			if err := sess.sse.ping(); err != nil {
+				logSession.Warn("sess.sseLoop: ping/" + err.Error())
+				return
+			}
+		}
+	}
+}
+
+// serveSSE opens the event stream of a new session or accepts messages of an existing one.
+func serveSSE(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	enc := json.NewEncoder(wrt)
+
+	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
+		http.Error(wrt, "Missing, invalid or expired API key", http.StatusForbidden)
+		logSession.Warn("sse: Missing, invalid or expired API key")
+		return
+	}
+
+	// Any domain is allowed to connect, same as long polling
+	wrt.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch req.Method {
+	case http.MethodGet:
+		serveSSEStream(wrt, req, now)
+
+	case http.MethodPost:
+		sid := req.FormValue("sid")
+		if sid == "" || req.ContentLength == 0 {
+			wrt.WriteHeader(http.StatusBadRequest)
+			enc.Encode(ErrMalformed(req.FormValue("id"), "", now))
+			return
+		}
+		if node := globals.cluster.nodeForSession(sid); node != nil {
+			// Session of another node
+			globals.cluster.proxyLongPoll(node, sid, wrt, req)
+			return
+		}
+
+		sess := globals.sessionStore.Get(sid)
+		if sess == nil || sess.proto != SSE {
+			wrt.WriteHeader(http.StatusForbidden)
+			enc.Encode(&ServerComMessage{Ctrl: &MsgServerCtrl{
+				Timestamp: now,
+				Code:      http.StatusForbidden,
+				Text:      "invalid or expired session id"}})
+			return
+		}
+		if err, code := sess.readOnce(wrt, req); err != nil {
+			logSession.Warn("sse: " + err.Error())
+			if code == 0 {
+				code = http.StatusBadRequest
+			}
+			wrt.WriteHeader(code)
+			enc.Encode(ErrMalformed(req.FormValue("id"), "", now))
+			return
+		}
+		// Responses are sent over the stream
+		wrt.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(wrt, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveSSEStream creates a session and streams its messages.
+func serveSSEStream(wrt http.ResponseWriter, req *http.Request, now time.Time) {
+	flusher, ok := wrt.(http.Flusher)
+	if !ok {
+		http.Error(wrt, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if globals.cluster.isCordoned() {
+		// The node is being restarted, the client should connect to another node
+		http.Error(wrt, "Node is restarting", http.StatusServiceUnavailable)
+		return
+	}
+
+	wrt.Header().Set("Content-Type", "text/event-stream")
+	wrt.Header().Set("Cache-Control", "no-cache")
+	// Disable response buffering by nginx
+	wrt.Header().Set("X-Accel-Buffering", "no")
+	wrt.WriteHeader(http.StatusOK)
+
+	conn := &sseConn{wrt: wrt, flusher: flusher}
+	sess := globals.sessionStore.Create(conn, globals.cluster.lpSessionId())
+	sess.remoteAddr = req.RemoteAddr
+	logSession.Debug("sse: new session created, sid=", sess.sid)
+
+	pkt := NoErrCreated(req.FormValue("id"), "", now)
+	pkt.Ctrl.Params = map[string]string{"sid": sess.sid}
+	if err := conn.write(encodePacket(pkt)); err != nil {
+		globals.sessionStore.Delete(sess)
+		return
+	}
+
+	sess.sseLoop(req.Context().Done())
+}
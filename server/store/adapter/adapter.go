@@ -41,6 +41,14 @@ type Adapter interface {
 	TopicCreateP2P(initiator, invited *t.Subscription) error
 	// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
 	TopicGet(topic string) (*t.Topic, error)
+	// TopicsWebIndex loads group topics which are published on the web and may be indexed, up to limit.
+	TopicsWebIndex(limit int) ([]t.Topic, error)
+	// TopicsDigest loads group topics which have periodic digests enabled.
+	TopicsDigest() ([]t.Topic, error)
+	// TopicsScripted loads topics which have automation scripts.
+	TopicsScripted() ([]t.Topic, error)
+	// TopicsExpiring loads topics which have a message TTL set.
+	TopicsExpiring() ([]t.Topic, error)
 	// TopicsForUser loads subscriptions for a given user. Reads public value.
 	TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription, error)
 	// UsersForTopic loads users' subscriptions for a given topic
@@ -51,6 +59,17 @@ type Adapter interface {
 	TopicUpdateOnMessage(topic string, msg *t.Message) error
 	TopicUpdate(topic string, update map[string]interface{}) error
 
+	// External IDs: references to users and topics in external systems. An empty ID clears it.
+
+	// UserSetExternalId sets or clears the external ID of the user
+	UserSetExternalId(uid t.Uid, extId string) error
+	// UserGetByExternalId loads the user with the external ID, returns (nil, nil) if not found
+	UserGetByExternalId(extId string) (*t.User, error)
+	// TopicSetExternalId sets or clears the external ID of the topic
+	TopicSetExternalId(topic string, extId string) error
+	// TopicGetByExternalId loads the topic with the external ID, returns (nil, nil) if not found
+	TopicGetByExternalId(extId string) (*t.Topic, error)
+
 	// SubscriptionGet rads a subscription of a user to a topic
 	SubscriptionGet(topic string, user t.Uid) (*t.Subscription, error)
 	// SubsForUser gets a list of topics of interest for a given user. Does NOT read public value.
@@ -59,21 +78,132 @@ type Adapter interface {
 	SubsForTopic(topic string, keepDeleted bool) ([]t.Subscription, error)
 	// SubsUpdate updates pasrt of a subscription object. Pass nil for fields which don't need to be updated
 	SubsUpdate(topic string, user t.Uid, update map[string]interface{}) error
+	// SubsOwnerChange saves access modes of the old and the new owner of the topic together,
+	// in one transaction if the database supports it. User, ModeWant and ModeGiven are used.
+	SubsOwnerChange(topic string, oldOwner, newOwner *t.Subscription) error
 	// SubsDelete deletes a single subscription
 	SubsDelete(topic string, user t.Uid) error
 	// SubsDelForTopic deletes all subscriptions to the given topic
 	SubsDelForTopic(topic string) error
-	// Search for new contacts given a list of tags
-	FindSubs(user t.Uid, query []interface{}) ([]t.Subscription, error)
+	// Search for new contacts matching any of the tags exactly or starting with any of the prefixes.
+	// Subscription.Private of each result is the list of the user's tags which matched. At most limit users
+	// are returned, the caller is not included.
+	FindSubs(user t.Uid, tags, prefixes []string, limit int) ([]t.Subscription, error)
 
 	// Messages
 	MessageSave(msg *t.Message) error
 	MessageGetAll(topic string, forUser t.Uid, opts *t.BrowseOpt) ([]t.Message, error)
+	// MessageGetList loads the messages of the topic with the listed seq IDs, missing ones are skipped
+	MessageGetList(topic string, forUser t.Uid, list []int) ([]t.Message, error)
 	MessageDeleteAll(topic string, before int) error
 	MessageDeleteList(topic string, forUser t.Uid, hard bool, list []int) error
+	// MessageSearch finds messages in the topic which contain the query string, newest first
+	MessageSearch(topic string, forUser t.Uid, query string, opts *t.BrowseOpt) ([]t.Message, error)
+	// MessageUpdate updates part of a message identified by topic and seq ID
+	MessageUpdate(topic string, seqId int, update map[string]interface{}) error
+	// MessageFirstAfter returns SeqId of the first message starting with since which was created
+	// after the given time, 0 if there is no such message
+	MessageFirstAfter(topic string, since int, after time.Time) (int, error)
+
+	// File upload records. The files themselves are stored by the media handler.
+
+	// FileStartUpload initializes a file upload
+	FileStartUpload(fd *t.FileDef) error
+	// FileFinishUpload saves status, location and size of a completed or failed upload
+	FileFinishUpload(fd *t.FileDef) error
+	// FileGet fetches a record of a specific file upload. Returns (nil, nil) if the record is not found
+	FileGet(fid string) (*t.FileDef, error)
+	// FileUsage returns total size of files successfully uploaded by the user
+	FileUsage(uid t.Uid) (int64, error)
+
+	// Reminders
+
+	// ReminderUpsert creates a reminder or replaces an existing one with the same Id
+	ReminderUpsert(r *t.Reminder) error
+	// ReminderDelete deletes a reminder. Deleting a missing reminder is not an error.
+	ReminderDelete(id string) error
+	// RemindersDue loads reminders which are due at or before the given time, up to limit. Reminders
+	// rejected by keep are skipped and not counted against the limit; nil keep accepts all.
+	RemindersDue(until time.Time, limit int, keep func(*t.Reminder) bool) ([]t.Reminder, error)
+
+	// Scheduled messages
+
+	// ScheduledSave stores a message for delivery at a later time
+	ScheduledSave(msg *t.ScheduledMessage) error
+	// ScheduledDelete deletes a scheduled message. Deleting a missing message is not an error.
+	ScheduledDelete(id string) error
+	// ScheduledDue loads scheduled messages which are due at or before the given time, up to limit.
+	// Messages rejected by keep are skipped and not counted against the limit; nil keep accepts all.
+	ScheduledDue(until time.Time, limit int, keep func(*t.ScheduledMessage) bool) ([]t.ScheduledMessage, error)
+
+	// Credentials
+
+	// CredUpsert creates a credential or replaces an existing one with the same Id
+	CredUpsert(cred *t.Credential) error
+	// CredGet loads a credential by Id, returns nil if not found
+	CredGet(id string) (*t.Credential, error)
+	// CredDelete deletes a credential. Deleting a missing credential is not an error.
+	CredDelete(id string) error
+
+	// Client logs
+
+	// ClientLogUpsert creates a client log record or replaces an existing one with the same Id
+	ClientLogUpsert(cl *t.ClientLog) error
+	// ClientLogGet loads a client log record by Id, returns nil if not found
+	ClientLogGet(id string) (*t.ClientLog, error)
+	// ClientLogFind loads records of logs linked to the ticket and/or uploaded by the user, newest first.
+	// Empty ticket or zero user match any.
+	ClientLogFind(ticket string, user t.Uid, limit int) ([]t.ClientLog, error)
+
+	// Contacts
+
+	// ContactUpsert creates contact records or replaces existing ones with the same User and Contact
+	ContactUpsert(contacts ...*t.ContactRecord) error
+	// ContactGetAll loads contact records of the user
+	ContactGetAll(user t.Uid) ([]t.ContactRecord, error)
+	// ContactDelete deletes the record of the contact of the user and the reverse record.
+	// Deleting missing records is not an error.
+	ContactDelete(user, contact t.Uid) error
+
+	// Journal of multi-step operations
+
+	// OperationUpsert saves a journal record of an operation
+	OperationUpsert(op *t.Operation) error
+	// OperationGetAll loads all journal records
+	OperationGetAll() ([]t.Operation, error)
+	// OperationDelete deletes a journal record. Deleting a missing record is not an error.
+	OperationDelete(id string) error
+	// TagsDeleteForUser deletes all unique tag records of the user
+	TagsDeleteForUser(uid t.Uid) error
+
+	// Consistency checks. Scans call fn for every record of the table, including deleted records, and stop
+	// at the first error returned by fn.
+
+	// FsckUsers scans user records. Only Id, DeletedAt and Tags are loaded.
+	FsckUsers(fn func(*t.User) error) error
+	// FsckTopics scans topic records. Only Id, SeqId, ClearId and DeletedAt are loaded.
+	FsckTopics(fn func(*t.Topic) error) error
+	// FsckSubs scans subscriptions. Private and other values are not loaded.
+	FsckSubs(fn func(*t.Subscription) error) error
+	// FsckAuth scans authentication records, calls fn with the unique key and the user of each.
+	FsckAuth(fn func(unique string, uid t.Uid) error) error
+	// FsckTags scans unique tags, calls fn with the tag and the ID of the user it belongs to.
+	FsckTags(fn func(tag, source string) error) error
+	// TagDelete deletes a unique tag record
+	TagDelete(tag string) error
 
 	// Devices (for push notifications)
 	DeviceUpsert(uid t.Uid, dev *t.DeviceDef) error
 	DeviceGetAll(uid ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error)
+	// DeviceGetPage loads devices of a page of users, sorted by user ID then by device ID. Only devices
+	// of the platform are returned unless the platform is empty. The caller limits the number of users.
+	DeviceGetPage(uids []t.Uid, platform string) ([]t.UserDevice, error)
 	DeviceDelete(uid t.Uid, deviceId string) error
 }
+
+// Expirer is implemented by the adapters which delete messages when their retention period passes,
+// see t.Message.GetRetention. The server's retention policy is rejected with other adapters.
+type Expirer interface {
+	// ExpiresMessages returns true if the adapter honors the retention period of messages.
+	ExpiresMessages() bool
+}
@@ -0,0 +1,347 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/store/adapter"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default time to live of cached objects
+	CACHE_DEFAULT_TTL = 5 * time.Minute
+)
+
+// Cache is a key-value store for serialized objects. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Init initializes the cache with provider-specific config.
+	Init(jsonconf string) error
+	// Get returns the value, if it's present.
+	Get(key string) ([]byte, bool)
+	// Set adds or replaces the value. Zero ttl means the value does not expire.
+	Set(key string, val []byte, ttl time.Duration)
+	// Delete removes values.
+	Delete(keys ...string)
+	// Close releases resources.
+	Close() error
+}
+
+type cacheConfig struct {
+	// Name of the cache provider, "lru" or "redis"
+	Provider string `json:"provider"`
+	// Time to live of cached objects in seconds
+	TTL    int             `json:"ttl"`
+	Config json.RawMessage `json:"config"`
+}
+
+var cacheProviders map[string]Cache
+
+// RegisterCache makes a cache provider available by the provided name.
+func RegisterCache(name string, cache Cache) {
+	if cacheProviders == nil {
+		cacheProviders = make(map[string]Cache)
+	}
+
+	if cache == nil {
+		panic("RegisterCache: cache is nil")
+	}
+	if _, dup := cacheProviders[name]; dup {
+		panic("RegisterCache: called twice for provider " + name)
+	}
+	cacheProviders[name] = cache
+}
+
+// GetCache returns the configured cache or nil if the cache is not configured.
+func GetCache() Cache {
+	for a := adaptr; a != nil; a = wrappedAdapter(a) {
+		if ca, ok := a.(*cachingAdapter); ok {
+			return ca.cache
+		}
+	}
+	return nil
+}
+
+// CacheMemSize estimates the memory held by the cache in bytes. Caches which keep the objects outside
+// of the process, like Redis, hold none.
+func CacheMemSize() int64 {
+	if sizer, ok := GetCache().(interface{ MemSize() int64 }); ok {
+		return sizer.MemSize()
+	}
+	return 0
+}
+
+// initCache wraps the adapter with a caching layer if cache is configured.
+func initCache(config *cacheConfig) error {
+	if ca, ok := adaptr.(*cachingAdapter); ok {
+		// Store is being reopened
+		adaptr = ca.Adapter
+	}
+
+	if config == nil || config.Provider == "" {
+		return nil
+	}
+
+	cache := cacheProviders[config.Provider]
+	if cache == nil {
+		return errors.New("store: unknown cache provider '" + config.Provider + "'")
+	}
+	if err := cache.Init(string(config.Config)); err != nil {
+		return err
+	}
+
+	ttl := time.Duration(config.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = CACHE_DEFAULT_TTL
+	}
+
+	adaptr = &cachingAdapter{Adapter: adaptr, cache: cache, ttl: ttl}
+	return nil
+}
+
+// cachingAdapter serves hot reads from cache and invalidates cached objects on writes. All other
+// calls go straight to the wrapped adapter.
+//
+// Subscriptions and messages are cached under a per-topic version. Changing the version invalidates
+// all cached objects of the topic at once.
+type cachingAdapter struct {
+	adapter.Adapter
+	cache Cache
+	ttl   time.Duration
+}
+
+func (ca *cachingAdapter) get(key string, obj interface{}) bool {
+	if data, ok := ca.cache.Get(key); ok {
+		return json.Unmarshal(data, obj) == nil
+	}
+	return false
+}
+
+func (ca *cachingAdapter) set(key string, obj interface{}) {
+	if data, err := json.Marshal(obj); err == nil {
+		ca.cache.Set(key, data, ca.ttl)
+	}
+}
+
+// version returns current version of the cached objects of the given kind for the topic.
+func (ca *cachingAdapter) version(kind, topic string) string {
+	key := "ver:" + kind + ":" + topic
+	if data, ok := ca.cache.Get(key); ok {
+		return string(data)
+	}
+	// Never reuse a version: objects cached under an expired version must not come back to life.
+	return ca.bump(kind, topic)
+}
+
+// bump invalidates all cached objects of the given kind for the topic.
+func (ca *cachingAdapter) bump(kind, topic string) string {
+	ver := strconv.FormatInt(time.Now().UnixNano(), 36)
+	ca.cache.Set("ver:"+kind+":"+topic, []byte(ver), 2*ca.ttl)
+	return ver
+}
+
+func userCacheKey(uid types.Uid) string {
+	return "usr:" + uid.String()
+}
+
+func topicCacheKey(topic string) string {
+	return "topic:" + topic
+}
+
+func (ca *cachingAdapter) Close() error {
+	ca.cache.Close()
+	return ca.Adapter.Close()
+}
+
+func (ca *cachingAdapter) UserGet(uid types.Uid) (*types.User, error) {
+	var user types.User
+	if ca.get(userCacheKey(uid), &user) {
+		return &user, nil
+	}
+
+	usr, err := ca.Adapter.UserGet(uid)
+	if err == nil && usr != nil {
+		ca.set(userCacheKey(uid), usr)
+	}
+	return usr, err
+}
+
+func (ca *cachingAdapter) UserDelete(uid types.Uid, soft bool) error {
+	defer ca.cache.Delete(userCacheKey(uid))
+	return ca.Adapter.UserDelete(uid, soft)
+}
+
+func (ca *cachingAdapter) UserUpdateLastSeen(uid types.Uid, userAgent string, when time.Time) error {
+	defer ca.cache.Delete(userCacheKey(uid))
+	return ca.Adapter.UserUpdateLastSeen(uid, userAgent, when)
+}
+
+func (ca *cachingAdapter) ChangePassword(uid types.Uid, password string) error {
+	defer ca.cache.Delete(userCacheKey(uid))
+	return ca.Adapter.ChangePassword(uid, password)
+}
+
+func (ca *cachingAdapter) UserUpdate(uid types.Uid, update map[string]interface{}) error {
+	defer ca.cache.Delete(userCacheKey(uid))
+	return ca.Adapter.UserUpdate(uid, update)
+}
+
+func (ca *cachingAdapter) TopicCreate(topic *types.Topic) error {
+	defer ca.cache.Delete(topicCacheKey(topic.Id))
+	return ca.Adapter.TopicCreate(topic)
+}
+
+func (ca *cachingAdapter) TopicCreateP2P(initiator, invited *types.Subscription) error {
+	defer ca.bump("sub", initiator.Topic)
+	defer ca.cache.Delete(topicCacheKey(initiator.Topic))
+	return ca.Adapter.TopicCreateP2P(initiator, invited)
+}
+
+func (ca *cachingAdapter) TopicGet(name string) (*types.Topic, error) {
+	var topic types.Topic
+	if ca.get(topicCacheKey(name), &topic) {
+		return &topic, nil
+	}
+
+	tpc, err := ca.Adapter.TopicGet(name)
+	if err == nil && tpc != nil {
+		ca.set(topicCacheKey(name), tpc)
+	}
+	return tpc, err
+}
+
+func (ca *cachingAdapter) TopicShare(subs []*types.Subscription) (int, error) {
+	for _, sub := range subs {
+		defer ca.bump("sub", sub.Topic)
+	}
+	return ca.Adapter.TopicShare(subs)
+}
+
+func (ca *cachingAdapter) TopicDelete(topic string) error {
+	defer ca.cache.Delete(topicCacheKey(topic))
+	return ca.Adapter.TopicDelete(topic)
+}
+
+func (ca *cachingAdapter) TopicUpdateOnMessage(topic string, msg *types.Message) error {
+	if types.GetTopicCat(topic) == types.TopicCat_Me {
+		defer ca.cache.Delete(userCacheKey(types.ParseUserId(topic)))
+	} else {
+		defer ca.cache.Delete(topicCacheKey(topic))
+	}
+	return ca.Adapter.TopicUpdateOnMessage(topic, msg)
+}
+
+func (ca *cachingAdapter) TopicUpdate(topic string, update map[string]interface{}) error {
+	defer ca.cache.Delete(topicCacheKey(topic))
+	return ca.Adapter.TopicUpdate(topic, update)
+}
+
+func (ca *cachingAdapter) UserSetExternalId(uid types.Uid, extId string) error {
+	defer ca.cache.Delete(userCacheKey(uid))
+	return ca.Adapter.UserSetExternalId(uid, extId)
+}
+
+func (ca *cachingAdapter) TopicSetExternalId(topic string, extId string) error {
+	defer ca.cache.Delete(topicCacheKey(topic))
+	return ca.Adapter.TopicSetExternalId(topic, extId)
+}
+
+func (ca *cachingAdapter) SubscriptionGet(topic string, user types.Uid) (*types.Subscription, error) {
+	key := "sub:" + ca.version("sub", topic) + ":" + topic + ":" + user.String()
+
+	var sub types.Subscription
+	if ca.get(key, &sub) {
+		return &sub, nil
+	}
+
+	s, err := ca.Adapter.SubscriptionGet(topic, user)
+	if err == nil && s != nil {
+		ca.set(key, s)
+	}
+	return s, err
+}
+
+func (ca *cachingAdapter) SubsUpdate(topic string, user types.Uid, update map[string]interface{}) error {
+	defer ca.bump("sub", topic)
+	return ca.Adapter.SubsUpdate(topic, user, update)
+}
+
+func (ca *cachingAdapter) SubsOwnerChange(topic string, oldOwner, newOwner *types.Subscription) error {
+	defer ca.bump("sub", topic)
+	return ca.Adapter.SubsOwnerChange(topic, oldOwner, newOwner)
+}
+
+func (ca *cachingAdapter) SubsDelete(topic string, user types.Uid) error {
+	defer ca.bump("sub", topic)
+	return ca.Adapter.SubsDelete(topic, user)
+}
+
+func (ca *cachingAdapter) SubsDelForTopic(topic string) error {
+	defer ca.bump("sub", topic)
+	return ca.Adapter.SubsDelForTopic(topic)
+}
+
+func (ca *cachingAdapter) MessageSave(msg *types.Message) error {
+	defer ca.bump("msg", msg.Topic)
+	return ca.Adapter.MessageSave(msg)
+}
+
+// MessageGetAll caches only the most recent page, i.e. requests without an upper bound. The key includes
+// every other field of opts.
+func (ca *cachingAdapter) MessageGetAll(topic string, forUser types.Uid, opts *types.BrowseOpt) ([]types.Message, error) {
+	if opts != nil && (opts.ByTime || opts.Before > 0 || opts.After != nil || opts.Until != nil) {
+		return ca.Adapter.MessageGetAll(topic, forUser, opts)
+	}
+
+	key := "msg:" + ca.version("msg", topic) + ":" + topic + ":" + forUser.String()
+	if opts != nil {
+		key += ":" + strconv.Itoa(opts.Since) + ":" + strconv.FormatUint(uint64(opts.Limit), 10) +
+			":" + strconv.Itoa(opts.Thread) + ":" + opts.Mentions.String()
+	}
+
+	var msgs []types.Message
+	if ca.get(key, &msgs) {
+		return msgs, nil
+	}
+
+	msgs, err := ca.Adapter.MessageGetAll(topic, forUser, opts)
+	if err == nil {
+		ca.set(key, msgs)
+	}
+	return msgs, err
+}
+
+func (ca *cachingAdapter) MessageDeleteAll(topic string, before int) error {
+	// Depending on the adapter, ClearId may be stored in the topic, user or subscription.
+	defer func() {
+		ca.bump("msg", topic)
+		ca.bump("sub", topic)
+		ca.cache.Delete(topicCacheKey(topic))
+		if types.GetTopicCat(topic) == types.TopicCat_Me {
+			ca.cache.Delete(userCacheKey(types.ParseUserId(topic)))
+		}
+	}()
+	return ca.Adapter.MessageDeleteAll(topic, before)
+}
+
+func (ca *cachingAdapter) MessageDeleteList(topic string, forUser types.Uid, hard bool, list []int) error {
+	defer ca.bump("msg", topic)
+	return ca.Adapter.MessageDeleteList(topic, forUser, hard, list)
+}
+
+func (ca *cachingAdapter) MessageUpdate(topic string, seqId int, update map[string]interface{}) error {
+	defer ca.bump("msg", topic)
+	return ca.Adapter.MessageUpdate(topic, seqId, update)
+}
+
+func (ca *cachingAdapter) DeviceUpsert(uid types.Uid, dev *types.DeviceDef) error {
+	defer ca.cache.Delete(userCacheKey(uid))
+	return ca.Adapter.DeviceUpsert(uid, dev)
+}
+
+func (ca *cachingAdapter) DeviceDelete(uid types.Uid, deviceId string) error {
+	defer ca.cache.Delete(userCacheKey(uid))
+	return ca.Adapter.DeviceDelete(uid, deviceId)
+}
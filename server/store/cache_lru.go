@@ -0,0 +1,127 @@
+package store
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// Default maximum number of objects in the in-process cache
+	LRU_DEFAULT_SIZE = 8192
+	// Estimated memory held by a cached object in addition to its key and value
+	LRU_ENTRY_OVERHEAD = 128
+)
+
+// lruCache is an in-process Cache. Each server keeps its own copy, so it should not be used
+// when more than one cluster node writes to the same database.
+type lruCache struct {
+	sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	val     []byte
+	expires time.Time
+}
+
+func (c *lruCache) Init(jsonconf string) error {
+	var config struct {
+		// Maximum number of cached objects
+		Size int `json:"size"`
+	}
+	if jsonconf != "" {
+		if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+			return err
+		}
+	}
+
+	c.size = config.Size
+	if c.size <= 0 {
+		c.size = LRU_DEFAULT_SIZE
+	}
+	c.ll = list.New()
+	c.items = make(map[string]*list.Element, c.size)
+	return nil
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		if entry.expires.IsZero() || entry.expires.After(time.Now()) {
+			c.ll.MoveToFront(elem)
+			return entry.val, true
+		}
+		c.ll.Remove(elem)
+		delete(c.items, key)
+	}
+	return nil, false
+}
+
+func (c *lruCache) Set(key string, val []byte, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.val = val
+		entry.expires = expires
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, val: val, expires: expires})
+	for c.ll.Len() > c.size {
+		elem := c.ll.Back()
+		c.ll.Remove(elem)
+		delete(c.items, elem.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Delete(keys ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range keys {
+		if elem, ok := c.items[key]; ok {
+			c.ll.Remove(elem)
+			delete(c.items, key)
+		}
+	}
+}
+
+// MemSize estimates the memory held by the cached objects.
+func (c *lruCache) MemSize() int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	var size int64
+	for key, elem := range c.items {
+		size += int64(len(key) + len(elem.Value.(*lruEntry).val) + LRU_ENTRY_OVERHEAD)
+	}
+	return size
+}
+
+func (c *lruCache) Close() error {
+	c.Lock()
+	c.ll = list.New()
+	c.items = make(map[string]*list.Element)
+	c.Unlock()
+	return nil
+}
+
+func init() {
+	RegisterCache("lru", &lruCache{})
+}
@@ -0,0 +1,112 @@
+// +build redis
+
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tinode/chat/server/logs"
+)
+
+var cacheLog = logs.New("cache")
+
+// redisCache is a Cache shared by all cluster nodes.
+type redisCache struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+func (c *redisCache) Init(jsonconf string) error {
+	var config struct {
+		// Address of the redis server, host:port
+		Addr     string `json:"addr"`
+		Password string `json:"password"`
+		DB       int    `json:"db"`
+		// Prefix added to all keys
+		Prefix string `json:"prefix"`
+		// Maximum number of idle connections in the pool
+		MaxIdle int `json:"max_idle"`
+	}
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return err
+	}
+	if config.Addr == "" {
+		config.Addr = "localhost:6379"
+	}
+	if config.MaxIdle <= 0 {
+		config.MaxIdle = 16
+	}
+
+	c.prefix = config.Prefix
+	c.pool = &redis.Pool{
+		MaxIdle:     config.MaxIdle,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.Addr,
+				redis.DialPassword(config.Password),
+				redis.DialDatabase(config.DB))
+		},
+	}
+
+	// Check connectivity
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	val, err := redis.Bytes(conn.Do("GET", c.prefix+key))
+	if err != nil {
+		if err != redis.ErrNil {
+			cacheLog.Warn("redis cache:", err)
+		}
+		return nil, false
+	}
+	return val, true
+}
+
+func (c *redisCache) Set(key string, val []byte, ttl time.Duration) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	var err error
+	if ttl > 0 {
+		_, err = conn.Do("SET", c.prefix+key, val, "PX", int64(ttl/time.Millisecond))
+	} else {
+		_, err = conn.Do("SET", c.prefix+key, val)
+	}
+	if err != nil {
+		cacheLog.Warn("redis cache:", err)
+	}
+}
+
+func (c *redisCache) Delete(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = c.prefix + key
+	}
+	if _, err := conn.Do("DEL", args...); err != nil {
+		cacheLog.Warn("redis cache:", err)
+	}
+}
+
+func (c *redisCache) Close() error {
+	return c.pool.Close()
+}
+
+func init() {
+	RegisterCache("redis", &redisCache{})
+}
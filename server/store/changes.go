@@ -0,0 +1,701 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/adapter"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of the most recent changes kept in memory
+	CHANGES_DEFAULT_BUFFER = 65536
+)
+
+type changesConfig struct {
+	// Record the changes
+	Enabled bool `json:"enabled"`
+	// Number of the most recent changes kept in memory
+	Buffer int `json:"buffer"`
+}
+
+// Change is a successful write to the store, recorded to be repeated by a standby region.
+type Change struct {
+	// Sequential number of the change in the stream, starting with 1
+	Seq int64
+	// Name of the adapter method
+	Op string
+	// Arguments of the method, gob-encoded
+	Args []byte
+}
+
+var changesLog = logs.New("changes")
+
+// Stream of changes of this process. It outlives reopening of the store.
+var changes struct {
+	sync.Mutex
+	// Identifies the stream: a restarted process starts a new stream
+	epoch string
+	// Ring buffer of the most recent changes, the oldest at start
+	buf   []Change
+	start int
+	count int
+	// Seq of the last recorded change
+	last int64
+
+	once        sync.Once
+	recorded    *expvar.Int
+	unencodable *expvar.Int
+}
+
+func init() {
+	// Types which are passed to the adapter inside interface{}: in update maps and in Public, Private and
+	// Content fields.
+	gob.Register(types.Uid(0))
+	gob.Register(types.AccessMode(0))
+	// Pointers are sent as the values they point to: *time.Time arrives as time.Time.
+	gob.Register(time.Time{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(map[string]string{})
+	gob.Register(map[string][]string{})
+	gob.Register(types.DefaultAccess{})
+	gob.Register(types.PresencePrivacy{})
+	gob.Register(&types.NotifyPrefs{})
+	gob.Register(&types.TopicWebhook{})
+	gob.Register([]types.TopicScript{})
+	gob.Register([]types.MessageEdit{})
+	gob.Register([]types.SoftDelete{})
+	gob.Register(map[string]*types.DeviceDef{})
+	// Arguments of the adapter methods
+	gob.Register(types.User{})
+	gob.Register(types.Topic{})
+	gob.Register(types.Subscription{})
+	gob.Register([]types.Subscription{})
+	gob.Register(types.Message{})
+	gob.Register(time.Duration(0))
+	gob.Register(types.FileDef{})
+	gob.Register(types.Reminder{})
+	gob.Register(types.ScheduledMessage{})
+	gob.Register(types.Credential{})
+	gob.Register(types.ClientLog{})
+	gob.Register([]types.ContactRecord{})
+	gob.Register(types.Operation{})
+	gob.Register(types.DeviceDef{})
+}
+
+// initChanges wraps the adapter with a layer which records successful writes.
+func initChanges(config *changesConfig) error {
+	if config == nil || !config.Enabled {
+		return nil
+	}
+
+	size := config.Buffer
+	if size <= 0 {
+		size = CHANGES_DEFAULT_BUFFER
+	}
+
+	changes.once.Do(func() {
+		changes.epoch = strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatInt(rand.Int63(), 36)
+		changes.buf = make([]Change, size)
+		changes.recorded, changes.unencodable = new(expvar.Int), new(expvar.Int)
+		vars := new(expvar.Map).Init()
+		vars.Set("recorded", changes.recorded)
+		vars.Set("unencodable", changes.unencodable)
+		expvar.Publish("StoreChanges", vars)
+	})
+
+	adaptr = &changesAdapter{Adapter: adaptr}
+
+	changesLog.Infof("changes: recording writes, last %d kept", len(changes.buf))
+	return nil
+}
+
+// ChangesEnabled checks if writes are recorded.
+func ChangesEnabled() bool {
+	return changes.buf != nil
+}
+
+// ChangesHead returns the epoch of the stream and the seq of the last change.
+func ChangesHead() (string, int64) {
+	changes.Lock()
+	defer changes.Unlock()
+	return changes.epoch, changes.last
+}
+
+// ChangesSince returns up to limit changes recorded after seq in the stream with the given epoch, the
+// current epoch and the position of the reader after the returned changes. If the epoch is not current,
+// e.g. the process was restarted, the changes are returned starting with the oldest one kept. lost is
+// true if some changes after seq may be no longer kept.
+func ChangesSince(epoch string, seq int64, limit int) (result []Change, current string, pos int64, lost bool) {
+	changes.Lock()
+	defer changes.Unlock()
+
+	oldest := changes.last - int64(changes.count) + 1
+	if epoch != changes.epoch {
+		lost = true
+		seq = oldest - 1
+	} else if seq+1 < oldest {
+		lost = true
+		seq = oldest - 1
+	}
+
+	for s := seq + 1; s <= changes.last && len(result) < limit; s++ {
+		result = append(result, changes.buf[(changes.start+int(s-oldest))%len(changes.buf)])
+	}
+	return result, changes.epoch, seq + int64(len(result)), lost
+}
+
+// changeRecord adds the write to the stream. The arguments are encoded right away: the caller may change
+// them after the call returns.
+func changeRecord(op string, args ...interface{}) {
+	data, err := changeEncode(args)
+	if err != nil {
+		changes.unencodable.Add(1)
+		changesLog.Warnf("changes: %s not recorded: %v", op, err)
+		return
+	}
+
+	changes.Lock()
+	changes.last++
+	ch := Change{Seq: changes.last, Op: op, Args: data}
+	if changes.count < len(changes.buf) {
+		changes.buf[(changes.start+changes.count)%len(changes.buf)] = ch
+		changes.count++
+	} else {
+		changes.buf[changes.start] = ch
+		changes.start = (changes.start + 1) % len(changes.buf)
+	}
+	changes.Unlock()
+
+	changes.recorded.Add(1)
+}
+
+// changeEncode gob-encodes the arguments of the write.
+func changeEncode(args []interface{}) ([]byte, error) {
+	for i, arg := range args {
+		args[i] = changeArg(arg)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// changeArg prepares a value inside interface{} for gob: nil pointers cannot be encoded and are
+// replaced with nil; Uid marshals itself by pointer and is passed as one, it's decoded as Uid.
+func changeArg(val interface{}) interface{} {
+	if uid, ok := val.(types.Uid); ok {
+		return &uid
+	}
+	if v := reflect.ValueOf(val); v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil
+	}
+	return val
+}
+
+// changeCopyMap makes a shallow copy of the update with values prepared for gob by changeArg.
+func changeCopyMap(src map[string]interface{}) map[string]interface{} {
+	dst := make(map[string]interface{}, len(src))
+	for key, val := range src {
+		dst[key] = changeArg(val)
+	}
+	return dst
+}
+
+// ApplyChange repeats the change recorded by another process.
+func ApplyChange(ch *Change) (err error) {
+	var args []interface{}
+	if err = gob.NewDecoder(bytes.NewReader(ch.Args)).Decode(&args); err != nil {
+		return err
+	}
+
+	defer func() {
+		// Arguments of unexpected types
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed change %s: %v", ch.Op, r)
+		}
+	}()
+
+	switch ch.Op {
+	case "UserCreate":
+		usr := args[0].(types.User)
+		err, _ = adaptr.UserCreate(&usr)
+	case "UserDelete":
+		err = adaptr.UserDelete(args[0].(types.Uid), args[1].(bool))
+	case "UserUpdateLastSeen":
+		err = adaptr.UserUpdateLastSeen(args[0].(types.Uid), args[1].(string), args[2].(time.Time))
+	case "UserUpdate":
+		err = adaptr.UserUpdate(args[0].(types.Uid), args[1].(map[string]interface{}))
+	case "AddAuthRecord":
+		err, _ = adaptr.AddAuthRecord(args[0].(types.Uid), args[1].(int), args[2].(string), args[3].([]byte),
+			args[4].(time.Time))
+	case "DelAuthRecord":
+		_, err = adaptr.DelAuthRecord(args[0].(string))
+	case "DelAllAuthRecords":
+		_, err = adaptr.DelAllAuthRecords(args[0].(types.Uid))
+	case "UpdAuthRecord":
+		_, err = adaptr.UpdAuthRecord(args[0].(string), args[1].(int), args[2].([]byte), args[3].(time.Time))
+	case "TopicCreate":
+		topic := args[0].(types.Topic)
+		err = adaptr.TopicCreate(&topic)
+	case "TopicCreateP2P":
+		initiator, invited := args[0].(types.Subscription), args[1].(types.Subscription)
+		err = adaptr.TopicCreateP2P(&initiator, &invited)
+	case "TopicShare":
+		list := args[0].([]types.Subscription)
+		subs := make([]*types.Subscription, len(list))
+		for i := range list {
+			subs[i] = &list[i]
+		}
+		_, err = adaptr.TopicShare(subs)
+	case "TopicDelete":
+		err = adaptr.TopicDelete(args[0].(string))
+	case "TopicUpdateOnMessage":
+		msg := args[1].(types.Message)
+		err = adaptr.TopicUpdateOnMessage(args[0].(string), &msg)
+	case "TopicUpdate":
+		err = adaptr.TopicUpdate(args[0].(string), args[1].(map[string]interface{}))
+	case "UserSetExternalId":
+		err = adaptr.UserSetExternalId(args[0].(types.Uid), args[1].(string))
+	case "TopicSetExternalId":
+		err = adaptr.TopicSetExternalId(args[0].(string), args[1].(string))
+	case "SubsUpdate":
+		err = adaptr.SubsUpdate(args[0].(string), args[1].(types.Uid), args[2].(map[string]interface{}))
+	case "SubsOwnerChange":
+		oldOwner, newOwner := args[1].(types.Subscription), args[2].(types.Subscription)
+		err = adaptr.SubsOwnerChange(args[0].(string), &oldOwner, &newOwner)
+	case "SubsDelete":
+		err = adaptr.SubsDelete(args[0].(string), args[1].(types.Uid))
+	case "SubsDelForTopic":
+		err = adaptr.SubsDelForTopic(args[0].(string))
+	case "MessageSave":
+		msg := args[0].(types.Message)
+		msg.SetRetention(args[1].(time.Duration))
+		err = adaptr.MessageSave(&msg)
+	case "MessageDeleteAll":
+		err = adaptr.MessageDeleteAll(args[0].(string), args[1].(int))
+	case "MessageDeleteList":
+		var list []int
+		if args[3] != nil {
+			list = args[3].([]int)
+		}
+		err = adaptr.MessageDeleteList(args[0].(string), args[1].(types.Uid), args[2].(bool), list)
+	case "MessageUpdate":
+		err = adaptr.MessageUpdate(args[0].(string), args[1].(int), args[2].(map[string]interface{}))
+	case "FileStartUpload":
+		fd := args[0].(types.FileDef)
+		err = adaptr.FileStartUpload(&fd)
+	case "FileFinishUpload":
+		fd := args[0].(types.FileDef)
+		err = adaptr.FileFinishUpload(&fd)
+	case "ReminderUpsert":
+		r := args[0].(types.Reminder)
+		err = adaptr.ReminderUpsert(&r)
+	case "ReminderDelete":
+		err = adaptr.ReminderDelete(args[0].(string))
+	case "ScheduledSave":
+		msg := args[0].(types.ScheduledMessage)
+		err = adaptr.ScheduledSave(&msg)
+	case "ScheduledDelete":
+		err = adaptr.ScheduledDelete(args[0].(string))
+	case "CredUpsert":
+		cred := args[0].(types.Credential)
+		err = adaptr.CredUpsert(&cred)
+	case "CredDelete":
+		err = adaptr.CredDelete(args[0].(string))
+	case "ClientLogUpsert":
+		cl := args[0].(types.ClientLog)
+		err = adaptr.ClientLogUpsert(&cl)
+	case "ContactUpsert":
+		list := args[0].([]types.ContactRecord)
+		contacts := make([]*types.ContactRecord, len(list))
+		for i := range list {
+			contacts[i] = &list[i]
+		}
+		err = adaptr.ContactUpsert(contacts...)
+	case "ContactDelete":
+		err = adaptr.ContactDelete(args[0].(types.Uid), args[1].(types.Uid))
+	case "OperationUpsert":
+		op := args[0].(types.Operation)
+		err = adaptr.OperationUpsert(&op)
+	case "OperationDelete":
+		err = adaptr.OperationDelete(args[0].(string))
+	case "TagsDeleteForUser":
+		err = adaptr.TagsDeleteForUser(args[0].(types.Uid))
+	case "TagDelete":
+		err = adaptr.TagDelete(args[0].(string))
+	case "DeviceUpsert":
+		dev := args[1].(types.DeviceDef)
+		err = adaptr.DeviceUpsert(args[0].(types.Uid), &dev)
+	case "DeviceDelete":
+		err = adaptr.DeviceDelete(args[0].(types.Uid), args[1].(string))
+	default:
+		err = errors.New("unknown change " + ch.Op)
+	}
+	return err
+}
+
+// changesAdapter records successful writes to the stream of changes. Reads and failed writes are not
+// recorded. Writes of one topic are recorded in the order they are made by the topic; concurrent writes
+// of different goroutines may be recorded in a different order than they are applied by the database.
+type changesAdapter struct {
+	adapter.Adapter
+}
+
+func (ca *changesAdapter) UserCreate(usr *types.User) (error, bool) {
+	err, dup := ca.Adapter.UserCreate(usr)
+	if err == nil {
+		changeRecord("UserCreate", *usr)
+	}
+	return err, dup
+}
+
+func (ca *changesAdapter) UserDelete(uid types.Uid, soft bool) error {
+	err := ca.Adapter.UserDelete(uid, soft)
+	if err == nil {
+		changeRecord("UserDelete", uid, soft)
+	}
+	return err
+}
+
+func (ca *changesAdapter) UserUpdateLastSeen(uid types.Uid, userAgent string, when time.Time) error {
+	err := ca.Adapter.UserUpdateLastSeen(uid, userAgent, when)
+	if err == nil {
+		changeRecord("UserUpdateLastSeen", uid, userAgent, when)
+	}
+	return err
+}
+
+// ChangePassword is not recorded: secrets never go into the stream. Auth handlers change passwords
+// with UpdAuthRecord, which replicates the resulting hashed record.
+func (ca *changesAdapter) ChangePassword(uid types.Uid, password string) error {
+	return ca.Adapter.ChangePassword(uid, password)
+}
+
+func (ca *changesAdapter) UserUpdate(uid types.Uid, update map[string]interface{}) error {
+	err := ca.Adapter.UserUpdate(uid, update)
+	if err == nil {
+		changeRecord("UserUpdate", uid, changeCopyMap(update))
+	}
+	return err
+}
+
+func (ca *changesAdapter) AddAuthRecord(user types.Uid, authLvl int, unique string, secret []byte, expires time.Time) (error, bool) {
+	err, dup := ca.Adapter.AddAuthRecord(user, authLvl, unique, secret, expires)
+	if err == nil {
+		changeRecord("AddAuthRecord", user, authLvl, unique, secret, expires)
+	}
+	return err, dup
+}
+
+func (ca *changesAdapter) DelAuthRecord(unique string) (int, error) {
+	count, err := ca.Adapter.DelAuthRecord(unique)
+	if err == nil {
+		changeRecord("DelAuthRecord", unique)
+	}
+	return count, err
+}
+
+func (ca *changesAdapter) DelAllAuthRecords(uid types.Uid) (int, error) {
+	count, err := ca.Adapter.DelAllAuthRecords(uid)
+	if err == nil {
+		changeRecord("DelAllAuthRecords", uid)
+	}
+	return count, err
+}
+
+func (ca *changesAdapter) UpdAuthRecord(unique string, authLvl int, secret []byte, expires time.Time) (int, error) {
+	count, err := ca.Adapter.UpdAuthRecord(unique, authLvl, secret, expires)
+	if err == nil {
+		changeRecord("UpdAuthRecord", unique, authLvl, secret, expires)
+	}
+	return count, err
+}
+
+func (ca *changesAdapter) TopicCreate(topic *types.Topic) error {
+	err := ca.Adapter.TopicCreate(topic)
+	if err == nil {
+		changeRecord("TopicCreate", *topic)
+	}
+	return err
+}
+
+func (ca *changesAdapter) TopicCreateP2P(initiator, invited *types.Subscription) error {
+	err := ca.Adapter.TopicCreateP2P(initiator, invited)
+	if err == nil {
+		changeRecord("TopicCreateP2P", *initiator, *invited)
+	}
+	return err
+}
+
+func (ca *changesAdapter) TopicShare(subs []*types.Subscription) (int, error) {
+	count, err := ca.Adapter.TopicShare(subs)
+	if err == nil {
+		list := make([]types.Subscription, len(subs))
+		for i, sub := range subs {
+			list[i] = *sub
+		}
+		changeRecord("TopicShare", list)
+	}
+	return count, err
+}
+
+func (ca *changesAdapter) TopicDelete(topic string) error {
+	err := ca.Adapter.TopicDelete(topic)
+	if err == nil {
+		changeRecord("TopicDelete", topic)
+	}
+	return err
+}
+
+func (ca *changesAdapter) TopicUpdateOnMessage(topic string, msg *types.Message) error {
+	err := ca.Adapter.TopicUpdateOnMessage(topic, msg)
+	if err == nil {
+		changeRecord("TopicUpdateOnMessage", topic, *msg)
+	}
+	return err
+}
+
+func (ca *changesAdapter) TopicUpdate(topic string, update map[string]interface{}) error {
+	err := ca.Adapter.TopicUpdate(topic, update)
+	if err == nil {
+		changeRecord("TopicUpdate", topic, changeCopyMap(update))
+	}
+	return err
+}
+
+func (ca *changesAdapter) UserSetExternalId(uid types.Uid, extId string) error {
+	err := ca.Adapter.UserSetExternalId(uid, extId)
+	if err == nil {
+		changeRecord("UserSetExternalId", uid, extId)
+	}
+	return err
+}
+
+func (ca *changesAdapter) TopicSetExternalId(topic string, extId string) error {
+	err := ca.Adapter.TopicSetExternalId(topic, extId)
+	if err == nil {
+		changeRecord("TopicSetExternalId", topic, extId)
+	}
+	return err
+}
+
+func (ca *changesAdapter) SubsUpdate(topic string, user types.Uid, update map[string]interface{}) error {
+	err := ca.Adapter.SubsUpdate(topic, user, update)
+	if err == nil {
+		changeRecord("SubsUpdate", topic, user, changeCopyMap(update))
+	}
+	return err
+}
+
+func (ca *changesAdapter) SubsOwnerChange(topic string, oldOwner, newOwner *types.Subscription) error {
+	err := ca.Adapter.SubsOwnerChange(topic, oldOwner, newOwner)
+	if err == nil {
+		changeRecord("SubsOwnerChange", topic, *oldOwner, *newOwner)
+	}
+	return err
+}
+
+func (ca *changesAdapter) SubsDelete(topic string, user types.Uid) error {
+	err := ca.Adapter.SubsDelete(topic, user)
+	if err == nil {
+		changeRecord("SubsDelete", topic, user)
+	}
+	return err
+}
+
+func (ca *changesAdapter) SubsDelForTopic(topic string) error {
+	err := ca.Adapter.SubsDelForTopic(topic)
+	if err == nil {
+		changeRecord("SubsDelForTopic", topic)
+	}
+	return err
+}
+
+func (ca *changesAdapter) MessageSave(msg *types.Message) error {
+	err := ca.Adapter.MessageSave(msg)
+	if err == nil {
+		changeRecord("MessageSave", *msg, msg.GetRetention())
+	}
+	return err
+}
+
+func (ca *changesAdapter) MessageDeleteAll(topic string, before int) error {
+	err := ca.Adapter.MessageDeleteAll(topic, before)
+	if err == nil {
+		changeRecord("MessageDeleteAll", topic, before)
+	}
+	return err
+}
+
+func (ca *changesAdapter) MessageDeleteList(topic string, forUser types.Uid, hard bool, list []int) error {
+	err := ca.Adapter.MessageDeleteList(topic, forUser, hard, list)
+	if err == nil {
+		var cp interface{}
+		if list != nil {
+			cp = list
+		}
+		changeRecord("MessageDeleteList", topic, forUser, hard, cp)
+	}
+	return err
+}
+
+func (ca *changesAdapter) MessageUpdate(topic string, seqId int, update map[string]interface{}) error {
+	err := ca.Adapter.MessageUpdate(topic, seqId, update)
+	if err == nil {
+		changeRecord("MessageUpdate", topic, seqId, changeCopyMap(update))
+	}
+	return err
+}
+
+func (ca *changesAdapter) FileStartUpload(fd *types.FileDef) error {
+	err := ca.Adapter.FileStartUpload(fd)
+	if err == nil {
+		changeRecord("FileStartUpload", *fd)
+	}
+	return err
+}
+
+func (ca *changesAdapter) FileFinishUpload(fd *types.FileDef) error {
+	err := ca.Adapter.FileFinishUpload(fd)
+	if err == nil {
+		changeRecord("FileFinishUpload", *fd)
+	}
+	return err
+}
+
+func (ca *changesAdapter) ReminderUpsert(r *types.Reminder) error {
+	err := ca.Adapter.ReminderUpsert(r)
+	if err == nil {
+		changeRecord("ReminderUpsert", *r)
+	}
+	return err
+}
+
+func (ca *changesAdapter) ReminderDelete(id string) error {
+	err := ca.Adapter.ReminderDelete(id)
+	if err == nil {
+		changeRecord("ReminderDelete", id)
+	}
+	return err
+}
+
+func (ca *changesAdapter) ScheduledSave(msg *types.ScheduledMessage) error {
+	err := ca.Adapter.ScheduledSave(msg)
+	if err == nil {
+		changeRecord("ScheduledSave", *msg)
+	}
+	return err
+}
+
+func (ca *changesAdapter) ScheduledDelete(id string) error {
+	err := ca.Adapter.ScheduledDelete(id)
+	if err == nil {
+		changeRecord("ScheduledDelete", id)
+	}
+	return err
+}
+
+func (ca *changesAdapter) CredUpsert(cred *types.Credential) error {
+	err := ca.Adapter.CredUpsert(cred)
+	if err == nil {
+		changeRecord("CredUpsert", *cred)
+	}
+	return err
+}
+
+func (ca *changesAdapter) CredDelete(id string) error {
+	err := ca.Adapter.CredDelete(id)
+	if err == nil {
+		changeRecord("CredDelete", id)
+	}
+	return err
+}
+
+func (ca *changesAdapter) ClientLogUpsert(cl *types.ClientLog) error {
+	err := ca.Adapter.ClientLogUpsert(cl)
+	if err == nil {
+		changeRecord("ClientLogUpsert", *cl)
+	}
+	return err
+}
+
+func (ca *changesAdapter) ContactUpsert(contacts ...*types.ContactRecord) error {
+	err := ca.Adapter.ContactUpsert(contacts...)
+	if err == nil {
+		list := make([]types.ContactRecord, len(contacts))
+		for i, c := range contacts {
+			list[i] = *c
+		}
+		changeRecord("ContactUpsert", list)
+	}
+	return err
+}
+
+func (ca *changesAdapter) ContactDelete(user, contact types.Uid) error {
+	err := ca.Adapter.ContactDelete(user, contact)
+	if err == nil {
+		changeRecord("ContactDelete", user, contact)
+	}
+	return err
+}
+
+func (ca *changesAdapter) OperationUpsert(op *types.Operation) error {
+	err := ca.Adapter.OperationUpsert(op)
+	if err == nil {
+		changeRecord("OperationUpsert", *op)
+	}
+	return err
+}
+
+func (ca *changesAdapter) OperationDelete(id string) error {
+	err := ca.Adapter.OperationDelete(id)
+	if err == nil {
+		changeRecord("OperationDelete", id)
+	}
+	return err
+}
+
+func (ca *changesAdapter) TagsDeleteForUser(uid types.Uid) error {
+	err := ca.Adapter.TagsDeleteForUser(uid)
+	if err == nil {
+		changeRecord("TagsDeleteForUser", uid)
+	}
+	return err
+}
+
+func (ca *changesAdapter) TagDelete(tag string) error {
+	err := ca.Adapter.TagDelete(tag)
+	if err == nil {
+		changeRecord("TagDelete", tag)
+	}
+	return err
+}
+
+func (ca *changesAdapter) DeviceUpsert(uid types.Uid, dev *types.DeviceDef) error {
+	err := ca.Adapter.DeviceUpsert(uid, dev)
+	if err == nil {
+		changeRecord("DeviceUpsert", uid, *dev)
+	}
+	return err
+}
+
+func (ca *changesAdapter) DeviceDelete(uid types.Uid, deviceId string) error {
+	err := ca.Adapter.DeviceDelete(uid, deviceId)
+	if err == nil {
+		changeRecord("DeviceDelete", uid, deviceId)
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// The package must initialize without panics and its writes must survive the trip through the stream.
+func TestChangeArgsRoundTrip(t *testing.T) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	update := changeCopyMap(map[string]interface{}{
+		"UpdatedAt": now,
+		"DeletedAt": &now,
+		"State":     (*time.Time)(nil),
+		"Owner":     types.Uid(7),
+		"Access":    types.DefaultAccess{Auth: types.ModeCPublic, Anon: types.ModeNone},
+	})
+
+	data, err := changeEncode([]interface{}{types.Uid(42), update})
+	if err != nil {
+		t.Fatal("failed to encode change:", err)
+	}
+
+	var args []interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&args); err != nil {
+		t.Fatal("failed to decode change:", err)
+	}
+	if uid, ok := args[0].(types.Uid); !ok || uid != 42 {
+		t.Errorf("uid mismatch: %#v", args[0])
+	}
+	decoded := args[1].(map[string]interface{})
+	if uid, ok := decoded["Owner"].(types.Uid); !ok || uid != 7 {
+		t.Errorf("Owner mismatch: %#v", decoded["Owner"])
+	}
+	if when, ok := decoded["UpdatedAt"].(time.Time); !ok || !when.Equal(now) {
+		t.Errorf("UpdatedAt mismatch: %#v", decoded["UpdatedAt"])
+	}
+	if when, ok := decoded["DeletedAt"].(time.Time); !ok || !when.Equal(now) {
+		t.Errorf("DeletedAt mismatch: %#v", decoded["DeletedAt"])
+	}
+	if decoded["State"] != nil {
+		t.Errorf("nil pointer expected to arrive as nil: %#v", decoded["State"])
+	}
+}
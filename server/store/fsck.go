@@ -0,0 +1,166 @@
+package store
+
+import (
+	"strings"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Fsck checks the store for:
+//   - subscriptions of users or to topics which do not exist or are deleted;
+//   - group topics and channels without an owner;
+//   - messages kept in topics after they were cleared;
+//   - unique tags not used by any user;
+//   - authentication records of users which do not exist or are deleted.
+//
+// Each problem found is reported to found. With repair the problems are fixed: orphaned subscriptions
+// are deleted, the ownership of a topic is given to an administrator or the oldest subscriber,
+// cleared messages, tags and authentication records are deleted. A topic with no subscribers left
+// is reported but not deleted.
+//
+// IDs of all users and topics are kept in memory while the check runs.
+func Fsck(repair bool, found func(*types.FsckIssue)) error {
+	report := func(kind, object, detail string, fix func() error) error {
+		issue := &types.FsckIssue{Kind: kind, Object: object, Detail: detail}
+		if repair && fix != nil {
+			if err := fix(); err != nil {
+				return err
+			}
+			issue.Repaired = true
+		}
+		found(issue)
+		return nil
+	}
+
+	// Tags of users which are not deleted
+	users := make(map[string][]string)
+	err := adaptr.FsckUsers(func(user *types.User) error {
+		if !user.IsDeleted() {
+			users[user.Id] = user.Tags
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// ClearId of topics which are not deleted
+	topics := make(map[string]int)
+	err = adaptr.FsckTopics(func(topic *types.Topic) error {
+		if !topic.IsDeleted() {
+			topics[topic.Id] = topic.ClearId
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	owned := make(map[string]bool)
+	// Candidates for the owner of group topics left without one
+	heirs := make(map[string]types.Subscription)
+	err = adaptr.FsckSubs(func(sub *types.Subscription) error {
+		if sub.IsDeleted() || len(sub.Topic) < 3 {
+			return nil
+		}
+
+		var exists bool
+		switch sub.Topic[:3] {
+		case "usr", "fnd":
+			_, exists = users[sub.Topic[3:]]
+		default:
+			_, exists = topics[sub.Topic]
+		}
+		if _, ok := users[sub.User]; !ok || !exists {
+			topic, uid := sub.Topic, types.ParseUid(sub.User)
+			return report(types.FsckOrphanSub, sub.Topic+":"+sub.User, "user or topic does not exist",
+				func() error { return adaptr.SubsDelete(topic, uid) })
+		}
+
+		if !strings.HasPrefix(sub.Topic, "grp") && !strings.HasPrefix(sub.Topic, "chn") {
+			return nil
+		}
+		mode := sub.ModeGiven & sub.ModeWant
+		if mode.IsOwner() {
+			owned[sub.Topic] = true
+			return nil
+		}
+		// Prefer the oldest administrator, then the oldest subscriber
+		heir, ok := heirs[sub.Topic]
+		approver := (heir.ModeGiven & heir.ModeWant).IsApprover()
+		if !ok || (mode.IsApprover() && !approver) ||
+			(mode.IsApprover() == approver && sub.CreatedAt.Before(heir.CreatedAt)) {
+			heirs[sub.Topic] = *sub
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, clearId := range topics {
+		if strings.HasPrefix(name, "grp") || strings.HasPrefix(name, "chn") {
+			if !owned[name] {
+				heir, ok := heirs[name]
+				if !ok {
+					if err = report(types.FsckNoOwner, name, "no subscribers left", nil); err != nil {
+						return err
+					}
+				} else {
+					topic, uid := name, types.ParseUid(heir.User)
+					err = report(types.FsckNoOwner, name, "ownership given to usr"+heir.User, func() error {
+						return adaptr.SubsUpdate(topic, uid, map[string]interface{}{
+							"ModeWant":  heir.ModeWant | types.ModeOwner,
+							"ModeGiven": heir.ModeGiven | types.ModeOwner,
+						})
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if clearId <= 0 {
+			continue
+		}
+		msgs, err := adaptr.MessageGetAll(name, types.ZeroUid, &types.BrowseOpt{Before: clearId + 1, Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(msgs) > 0 {
+			topic, before := name, clearId
+			err = report(types.FsckClearedMessages, name, "messages kept at or before the cleared ID",
+				func() error { return adaptr.MessageDeleteAll(topic, before) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = adaptr.FsckTags(func(tag, source string) error {
+		if tags, ok := users[source]; ok {
+			for _, t := range tags {
+				if t == tag {
+					return nil
+				}
+			}
+		}
+		return report(types.FsckDanglingTag, tag, "not used by usr"+source,
+			func() error { return adaptr.TagDelete(tag) })
+	})
+	if err != nil {
+		return err
+	}
+
+	return adaptr.FsckAuth(func(unique string, uid types.Uid) error {
+		if _, ok := users[uid.String()]; ok {
+			return nil
+		}
+		return report(types.FsckDanglingAuth, unique, "user does not exist",
+			func() error {
+				_, err := adaptr.DelAuthRecord(unique)
+				return err
+			})
+	})
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Cluster node which runs the operations, empty for a standalone server
+var journalNode string
+
+// journalRun saves the journal record of the operation, runs the steps and deletes the record.
+// If the steps fail, undo is called if given. The record is kept if the operation is not completed
+// or undone: it's recovered at the next startup.
+func journalRun(op *types.Operation, steps func() error, undo func() error) error {
+	op.SetUid(GetUid())
+	op.InitTimes()
+	op.Node = journalNode
+	if err := adaptr.OperationUpsert(op); err != nil {
+		return err
+	}
+
+	err := steps()
+	if err != nil {
+		if undo == nil || undo() != nil {
+			return err
+		}
+	}
+	if derr := adaptr.OperationDelete(op.Id); derr != nil && err == nil {
+		err = derr
+	}
+	return err
+}
+
+// RecoverOperations completes operations interrupted by a crash: deletions are resumed, creation of users
+// is rolled back. It must be called at startup before the server accepts requests. In a cluster, only
+// operations started by the given node are recovered; a standalone server passes an empty node and
+// recovers all. New operations are journaled under the given node.
+//
+// Each operation found is reported to done with the result of the recovery. Failed operations are kept and
+// tried again at the next startup.
+func RecoverOperations(node string, done func(op *types.Operation, err error)) error {
+	journalNode = node
+
+	ops, err := adaptr.OperationGetAll()
+	if err != nil {
+		return err
+	}
+	for i := range ops {
+		op := &ops[i]
+		if node != "" && op.Node != node {
+			continue
+		}
+
+		switch op.Kind {
+		case types.OpTopicDelete:
+			err = topicDelete(op.Object)
+		case types.OpUserCreate, types.OpUserDelete:
+			err = userDelete(types.ParseUid(op.Object))
+		case types.OpUnsubscribe:
+			err = unsubscribe(types.ParseUid(op.Object), op.Topics, nil)
+		default:
+			// Unknown operation, keep it
+			done(op, errors.New("store: unknown operation '"+op.Kind+"'"))
+			continue
+		}
+		if err == nil {
+			err = adaptr.OperationDelete(op.Id)
+		}
+		done(op, err)
+	}
+	return nil
+}
+
+// topicDelete deletes subscriptions, messages and the topic. Steps can be repeated.
+func topicDelete(topic string) error {
+	if err := adaptr.SubsDelForTopic(topic); err != nil {
+		return err
+	}
+	if err := adaptr.MessageDeleteAll(topic, -1); err != nil {
+		return err
+	}
+	return adaptr.TopicDelete(topic)
+}
+
+// userDelete deletes subscriptions, contacts, authentication records, tags and the record of the user.
+// The user record is deleted last. Steps can be repeated.
+func userDelete(uid types.Uid) error {
+	for {
+		subs, err := adaptr.SubsForUser(uid, false)
+		if err != nil {
+			return err
+		}
+		if len(subs) == 0 {
+			break
+		}
+		for i := range subs {
+			if err = adaptr.SubsDelete(subs[i].Topic, uid); err != nil {
+				return err
+			}
+		}
+	}
+
+	contacts, err := adaptr.ContactGetAll(uid)
+	if err != nil {
+		return err
+	}
+	for i := range contacts {
+		if err = adaptr.ContactDelete(uid, types.ParseUid(contacts[i].Contact)); err != nil {
+			return err
+		}
+	}
+
+	if _, err = adaptr.DelAllAuthRecords(uid); err != nil {
+		return err
+	}
+	if err = adaptr.TagsDeleteForUser(uid); err != nil {
+		return err
+	}
+	return adaptr.UserDelete(uid, false)
+}
+
+// unsubscribe deletes subscriptions of the user to the topics and calls done, if given, after each one.
+// Steps can be repeated.
+func unsubscribe(uid types.Uid, topics []string, done func(topic string)) error {
+	for _, topic := range topics {
+		if err := adaptr.SubsDelete(topic, uid); err != nil {
+			return err
+		}
+		if done != nil {
+			done(topic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package store
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/adapter"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of most recent messages cached per topic
+	RECENT_DEFAULT_SIZE = 64
+	// Maximum number of messages cached per topic
+	RECENT_MAX_SIZE = 1024
+	// Default time a cached page is served before it's reloaded
+	RECENT_DEFAULT_MAX_AGE = time.Minute
+	// Estimated memory held by a cached message
+	RECENT_MESSAGE_MEM_SIZE = 1024
+)
+
+type recentConfig struct {
+	// Number of topics with a cached page, 0 disables the cache
+	Topics int `json:"topics"`
+	// Number of the most recent messages cached per topic
+	Size int `json:"size"`
+	// Time in seconds a cached page is served before it's reloaded from the database
+	MaxAge int `json:"max_age"`
+}
+
+// Counters are published once per process: the store may be reopened.
+var recentStats struct {
+	once sync.Once
+
+	hits          *expvar.Int
+	misses        *expvar.Int
+	fills         *expvar.Int
+	invalidations *expvar.Int
+}
+
+// initRecent wraps the adapter with an in-process cache of the most recent messages of hot topics.
+func initRecent(config *recentConfig) error {
+	if ra, ok := adaptr.(*recentAdapter); ok {
+		// Store is being reopened
+		adaptr = ra.Adapter
+	}
+
+	if config == nil || config.Topics <= 0 {
+		return nil
+	}
+
+	size := config.Size
+	if size <= 0 {
+		size = RECENT_DEFAULT_SIZE
+	} else if size > RECENT_MAX_SIZE {
+		size = RECENT_MAX_SIZE
+	}
+	maxAge := time.Duration(config.MaxAge) * time.Second
+	if maxAge <= 0 {
+		maxAge = RECENT_DEFAULT_MAX_AGE
+	}
+
+	ra := &recentAdapter{
+		Adapter: adaptr,
+		topics:  config.Topics,
+		size:    size,
+		maxAge:  maxAge,
+		ll:      list.New(),
+		pages:   make(map[string]*list.Element, config.Topics)}
+
+	recentStats.once.Do(func() {
+		recentStats.hits = new(expvar.Int)
+		recentStats.misses = new(expvar.Int)
+		recentStats.fills = new(expvar.Int)
+		recentStats.invalidations = new(expvar.Int)
+
+		vars := new(expvar.Map).Init()
+		vars.Set("hits", recentStats.hits)
+		vars.Set("misses", recentStats.misses)
+		vars.Set("fills", recentStats.fills)
+		vars.Set("invalidations", recentStats.invalidations)
+		vars.Set("hit_rate", expvar.Func(func() interface{} {
+			hits, misses := recentStats.hits.Value(), recentStats.misses.Value()
+			if hits+misses == 0 {
+				return 0.0
+			}
+			return float64(hits) / float64(hits+misses)
+		}))
+		expvar.Publish("RecentPages", vars)
+	})
+
+	adaptr = ra
+	return nil
+}
+
+// recentAdapter keeps the most recent messages of the recently read topics in memory and serves the
+// requests for the latest page of messages from them. New messages are added to the cached page, any
+// other change of the messages of the topic drops the page.
+//
+// Each server keeps its own pages: messages changed by another cluster node directly in the database
+// are seen after max_age at the latest.
+type recentAdapter struct {
+	adapter.Adapter
+
+	topics int
+	size   int
+	maxAge time.Duration
+
+	lock  sync.Mutex
+	ll    *list.List
+	pages map[string]*list.Element
+}
+
+// Most recent messages of one topic
+type recentPage struct {
+	topic string
+	// Messages ordered by SeqId descending, as returned by the adapter
+	msgs []types.Message
+	// There are no messages older than the cached ones
+	complete bool
+	loaded   time.Time
+	// The page is being loaded; a change of messages while loading makes the page dirty
+	loading bool
+	dirty   bool
+}
+
+// cacheable checks if the request is for the most recent messages.
+func (ra *recentAdapter) cacheable(opts *types.BrowseOpt) bool {
+	return opts == nil || (!opts.ByTime && opts.Before == 0 && opts.Thread == 0 && opts.Mentions.IsZero() &&
+		int(opts.Limit) <= ra.size)
+}
+
+// serve returns messages from the page if the page has all the requested messages.
+func (pg *recentPage) serve(forUser types.Uid, opts *types.BrowseOpt) ([]types.Message, bool) {
+	var since, limit int
+	if opts != nil {
+		since, limit = opts.Since, int(opts.Limit)
+	}
+
+	n := 0
+	for n < len(pg.msgs) && pg.msgs[n].SeqId >= since && (limit == 0 || n < limit) {
+		n++
+	}
+	// All messages from the newest down to 'since' are cached if the page extends to or below 'since'.
+	covered := pg.complete || (len(pg.msgs) > 0 && pg.msgs[len(pg.msgs)-1].SeqId <= since)
+	if !covered && (limit == 0 || n < limit) {
+		return nil, false
+	}
+	if n == 0 {
+		return nil, true
+	}
+
+	requester := forUser.String()
+	msgs := make([]types.Message, n)
+	copy(msgs, pg.msgs[:n])
+	for i := range msgs {
+		// Soft-deletion is reported to the user who deleted the message
+		for j := range msgs[i].DeletedFor {
+			if msgs[i].DeletedFor[j].User == requester {
+				ts := msgs[i].DeletedFor[j].Timestamp
+				msgs[i].DeletedAt = &ts
+			}
+		}
+	}
+	return msgs, true
+}
+
+// RecentMemSize estimates the memory held by the cached pages in bytes.
+func RecentMemSize() int64 {
+	for a := adaptr; a != nil; a = wrappedAdapter(a) {
+		if ra, ok := a.(*recentAdapter); ok {
+			ra.lock.Lock()
+			defer ra.lock.Unlock()
+
+			count := 0
+			for _, elem := range ra.pages {
+				count += len(elem.Value.(*recentPage).msgs)
+			}
+			return int64(count) * RECENT_MESSAGE_MEM_SIZE
+		}
+	}
+	return 0
+}
+
+// invalidate drops the cached page of the topic.
+func (ra *recentAdapter) invalidate(topic string) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	if elem, ok := ra.pages[topic]; ok {
+		pg := elem.Value.(*recentPage)
+		if pg.loading {
+			pg.dirty = true
+		} else {
+			ra.ll.Remove(elem)
+			delete(ra.pages, topic)
+		}
+		recentStats.invalidations.Add(1)
+	}
+}
+
+func (ra *recentAdapter) MessageGetAll(topic string, forUser types.Uid, opts *types.BrowseOpt) ([]types.Message, error) {
+	if !ra.cacheable(opts) {
+		return ra.Adapter.MessageGetAll(topic, forUser, opts)
+	}
+
+	ra.lock.Lock()
+	elem, ok := ra.pages[topic]
+	if ok {
+		pg := elem.Value.(*recentPage)
+		if !pg.loading && time.Since(pg.loaded) < ra.maxAge {
+			if msgs, ok := pg.serve(forUser, opts); ok {
+				ra.ll.MoveToFront(elem)
+				ra.lock.Unlock()
+				recentStats.hits.Add(1)
+				return msgs, nil
+			}
+		}
+		if pg.loading {
+			// Another request is loading the page
+			ra.lock.Unlock()
+			recentStats.misses.Add(1)
+			return ra.Adapter.MessageGetAll(topic, forUser, opts)
+		}
+		ra.ll.Remove(elem)
+		delete(ra.pages, topic)
+	}
+	// Reserve the page, evict the least recently used one
+	pg := &recentPage{topic: topic, loading: true}
+	elem = ra.ll.PushFront(pg)
+	ra.pages[topic] = elem
+	for ra.ll.Len() > ra.topics {
+		back := ra.ll.Back()
+		ra.ll.Remove(back)
+		delete(ra.pages, back.Value.(*recentPage).topic)
+	}
+	ra.lock.Unlock()
+	recentStats.misses.Add(1)
+
+	msgs, err := ra.Adapter.MessageGetAll(topic, types.ZeroUid, &types.BrowseOpt{Limit: uint(ra.size)})
+
+	ra.lock.Lock()
+	current, ok := ra.pages[topic]
+	if err != nil || pg.dirty || !ok || current != elem {
+		if ok && current == elem {
+			ra.ll.Remove(elem)
+			delete(ra.pages, topic)
+		}
+		ra.lock.Unlock()
+		return ra.Adapter.MessageGetAll(topic, forUser, opts)
+	}
+	pg.msgs = msgs
+	pg.complete = len(msgs) < ra.size
+	pg.loaded = time.Now()
+	pg.loading = false
+	result, served := pg.serve(forUser, opts)
+	ra.lock.Unlock()
+	recentStats.fills.Add(1)
+
+	if !served {
+		return ra.Adapter.MessageGetAll(topic, forUser, opts)
+	}
+	return result, nil
+}
+
+// MessageSave adds the new message to the cached page.
+func (ra *recentAdapter) MessageSave(msg *types.Message) error {
+	if err := ra.Adapter.MessageSave(msg); err != nil {
+		ra.invalidate(msg.Topic)
+		return err
+	}
+
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	elem, ok := ra.pages[msg.Topic]
+	if !ok {
+		return nil
+	}
+	pg := elem.Value.(*recentPage)
+	if pg.loading {
+		pg.dirty = true
+		return nil
+	}
+	if len(pg.msgs) > 0 && msg.SeqId != pg.msgs[0].SeqId+1 {
+		// The page may be missing messages
+		ra.ll.Remove(elem)
+		delete(ra.pages, msg.Topic)
+		recentStats.invalidations.Add(1)
+		return nil
+	}
+
+	msgs := make([]types.Message, 0, ra.size)
+	msgs = append(msgs, *msg)
+	msgs = append(msgs, pg.msgs...)
+	if len(msgs) > ra.size {
+		msgs = msgs[:ra.size]
+		pg.complete = false
+	}
+	pg.msgs = msgs
+	return nil
+}
+
+func (ra *recentAdapter) MessageDeleteAll(topic string, before int) error {
+	defer ra.invalidate(topic)
+	return ra.Adapter.MessageDeleteAll(topic, before)
+}
+
+func (ra *recentAdapter) MessageDeleteList(topic string, forUser types.Uid, hard bool, list []int) error {
+	defer ra.invalidate(topic)
+	return ra.Adapter.MessageDeleteList(topic, forUser, hard, list)
+}
+
+func (ra *recentAdapter) MessageUpdate(topic string, seqId int, update map[string]interface{}) error {
+	defer ra.invalidate(topic)
+	return ra.Adapter.MessageUpdate(topic, seqId, update)
+}
+
+func (ra *recentAdapter) TopicDelete(topic string) error {
+	defer ra.invalidate(topic)
+	return ra.Adapter.TopicDelete(topic)
+}
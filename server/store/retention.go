@@ -0,0 +1,123 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/adapter"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// RetainDefault tells the adapter to apply its own default message retention.
+	RetainDefault time.Duration = 0
+	// RetainForever means the messages should never expire.
+	RetainForever time.Duration = -1
+)
+
+// retentionConfig is the "retention" section of the store config. Values are in seconds:
+// 0 or missing - use adapter default, -1 - keep forever.
+type retentionConfig struct {
+	Me     int            `json:"me"`
+	P2P    int            `json:"p2p"`
+	Grp    int            `json:"grp"`
+	Topics map[string]int `json:"topics"`
+}
+
+// RetentionOverrides decides how long messages in a given topic are kept before they expire:
+// per-category defaults with per-topic overrides.
+type RetentionOverrides struct {
+	rw         sync.RWMutex
+	categories map[types.TopicCat]time.Duration
+	topics     map[string]time.Duration
+}
+
+// NewRetentionOverrides creates an empty policy which defers to the adapter for all topics.
+func NewRetentionOverrides() *RetentionOverrides {
+	return &RetentionOverrides{
+		categories: make(map[types.TopicCat]time.Duration),
+		topics:     make(map[string]time.Duration)}
+}
+
+// SetCategory sets retention for all topics of the given category.
+func (ro *RetentionOverrides) SetCategory(cat types.TopicCat, period time.Duration) {
+	ro.rw.Lock()
+	if period == RetainDefault {
+		delete(ro.categories, cat)
+	} else {
+		ro.categories[cat] = period
+	}
+	ro.rw.Unlock()
+}
+
+// SetTopic overrides retention for a single topic. Passing RetainDefault removes the override.
+func (ro *RetentionOverrides) SetTopic(topic string, period time.Duration) {
+	ro.rw.Lock()
+	if period == RetainDefault {
+		delete(ro.topics, topic)
+	} else {
+		ro.topics[topic] = period
+	}
+	ro.rw.Unlock()
+}
+
+// Category returns retention set for all topics of the category, RetainDefault if none.
+func (ro *RetentionOverrides) Category(cat types.TopicCat) time.Duration {
+	ro.rw.RLock()
+	defer ro.rw.RUnlock()
+
+	return ro.categories[cat]
+}
+
+// Topics returns a copy of the per-topic overrides.
+func (ro *RetentionOverrides) Topics() map[string]time.Duration {
+	ro.rw.RLock()
+	defer ro.rw.RUnlock()
+
+	topics := make(map[string]time.Duration, len(ro.topics))
+	for topic, period := range ro.topics {
+		topics[topic] = period
+	}
+	return topics
+}
+
+// Retention returns retention period for messages in the topic: RetainDefault, RetainForever or
+// a positive duration.
+func (ro *RetentionOverrides) Retention(topic string) time.Duration {
+	ro.rw.RLock()
+	defer ro.rw.RUnlock()
+
+	if period, ok := ro.topics[topic]; ok {
+		return period
+	}
+	return ro.categories[types.GetTopicCat(topic)]
+}
+
+func (ro *RetentionOverrides) init(config *retentionConfig) {
+	if config == nil {
+		return
+	}
+	seconds := func(val int) time.Duration {
+		if val < 0 {
+			return RetainForever
+		}
+		return time.Duration(val) * time.Second
+	}
+	ro.SetCategory(types.TopicCat_Me, seconds(config.Me))
+	ro.SetCategory(types.TopicCat_P2P, seconds(config.P2P))
+	ro.SetCategory(types.TopicCat_Grp, seconds(config.Grp))
+	// Channels are kept as long as group topics
+	ro.SetCategory(types.TopicCat_Chn, seconds(config.Grp))
+	for topic, val := range config.Topics {
+		ro.SetTopic(topic, seconds(val))
+	}
+}
+
+// Retention is the retention policy initialized from the config and changed by the admin console.
+var Retention = NewRetentionOverrides()
+
+// RetentionSupported returns true if the adapter in use deletes messages by their retention period.
+func RetentionSupported() bool {
+	expirer, ok := adapters[adapterName].(adapter.Expirer)
+	return ok && expirer.ExpiresMessages()
+}
@@ -0,0 +1,618 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/adapter"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of operations waiting to be applied to the shadow adapter
+	SHADOW_DEFAULT_QUEUE = 4096
+	// Time allowed to apply the queued operations on close
+	SHADOW_DRAIN_TIMEOUT = 10 * time.Second
+	// Longest value written to the log on divergence
+	SHADOW_LOG_LENGTH = 512
+)
+
+type shadowConfig struct {
+	// Name of the secondary adapter
+	AdapterName   string          `json:"adapter"`
+	AdapterConfig json.RawMessage `json:"adapter_config"`
+	// Fraction of reads to repeat on the secondary adapter and compare, from 0 to 1
+	CompareReads float64 `json:"compare_reads"`
+	// Number of operations waiting to be applied to the secondary adapter
+	QueueSize int `json:"queue_size"`
+}
+
+var shadowLog = logs.New("shadow")
+
+// Counters are published once per process: the store may be reopened.
+var shadowStats struct {
+	once sync.Once
+	vars *expvar.Map
+}
+
+// initShadow wraps the adapter with a layer which mirrors writes to the secondary adapter.
+func initShadow(config *shadowConfig) error {
+	if config == nil || config.AdapterName == "" {
+		return nil
+	}
+
+	shadow := adapters[config.AdapterName]
+	if shadow == nil {
+		return errors.New("unknown adapter '" + config.AdapterName + "'")
+	}
+	if shadow == adaptr {
+		return errors.New("the shadow adapter must differ from the primary")
+	}
+	if !shadow.IsOpen() {
+		if err := shadow.Open(string(config.AdapterConfig)); err != nil {
+			return err
+		}
+	}
+
+	size := config.QueueSize
+	if size <= 0 {
+		size = SHADOW_DEFAULT_QUEUE
+	}
+
+	shadowStats.once.Do(func() {
+		shadowStats.vars = new(expvar.Map).Init()
+		expvar.Publish("StoreShadow", shadowStats.vars)
+	})
+
+	sa := &shadowAdapter{
+		Adapter: adaptr,
+		shadow:  shadow,
+		compare: config.CompareReads,
+		queue:   make(chan func(), size),
+		done:    make(chan bool),
+		stats:   shadowStats.vars}
+	go sa.run()
+	adaptr = sa
+
+	shadowLog.Infof("shadow: mirroring writes to '%s', comparing %.0f%% of reads", config.AdapterName,
+		config.CompareReads*100)
+	return nil
+}
+
+// shadowAdapter is used to validate a new backend against production traffic. All calls are served by the
+// primary adapter. Successful writes are then applied to the shadow adapter in the same order, and a sample
+// of reads is repeated on the shadow and compared to the results of the primary. Failures and differences
+// are logged and counted, they never affect the caller.
+//
+// Operations are applied in the background. If the shadow falls behind and the queue is full, operations
+// are dropped and the shadow can no longer be compared reliably.
+type shadowAdapter struct {
+	adapter.Adapter
+	shadow  adapter.Adapter
+	compare float64
+
+	// Guards queue from being written to after close
+	lock   sync.RWMutex
+	closed bool
+	queue  chan func()
+	done   chan bool
+
+	stats *expvar.Map
+}
+
+// run applies queued operations to the shadow adapter.
+func (sa *shadowAdapter) run() {
+	for op := range sa.queue {
+		op()
+	}
+	close(sa.done)
+}
+
+// enqueue adds the operation to the queue without blocking.
+func (sa *shadowAdapter) enqueue(op func()) bool {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+
+	if sa.closed {
+		return false
+	}
+	select {
+	case sa.queue <- op:
+		return true
+	default:
+		sa.stats.Add("dropped", 1)
+		return false
+	}
+}
+
+// mirror applies the write to the shadow adapter.
+func (sa *shadowAdapter) mirror(name string, write func(a adapter.Adapter) error) {
+	sa.enqueue(func() {
+		sa.stats.Add("writes", 1)
+		if err := write(sa.shadow); err != nil {
+			sa.stats.Add("errors", 1)
+			shadowLog.Warnf("shadow: %s failed: %v", name, err)
+		}
+	})
+}
+
+// compareRead repeats a sample of reads on the shadow adapter and logs differences from the primary result.
+// The primary result is serialized right away: the caller may change it.
+func (sa *shadowAdapter) compareRead(name, key string, result interface{}, read func(a adapter.Adapter) (interface{}, error)) {
+	if sa.compare <= 0 || rand.Float64() >= sa.compare {
+		return
+	}
+	expected, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+
+	sa.enqueue(func() {
+		res, err := read(sa.shadow)
+		if err != nil {
+			sa.stats.Add("errors", 1)
+			shadowLog.Warnf("shadow: %s(%s) failed: %v", name, key, err)
+			return
+		}
+		actual, err := json.Marshal(res)
+		if err != nil {
+			return
+		}
+
+		sa.stats.Add("compared", 1)
+		if !shadowEqual(expected, actual) {
+			sa.stats.Add("diverged", 1)
+			shadowLog.Warnf("shadow: %s(%s) diverged, primary: %s, shadow: %s", name, key,
+				shadowTruncate(expected), shadowTruncate(actual))
+		}
+	})
+}
+
+// shadowEqual compares serialized results. Missing and empty results are the same.
+func shadowEqual(a, b []byte) bool {
+	empty := func(v []byte) bool {
+		return bytes.Equal(v, []byte("null")) || bytes.Equal(v, []byte("[]")) || bytes.Equal(v, []byte("{}"))
+	}
+	return bytes.Equal(a, b) || (empty(a) && empty(b))
+}
+
+func shadowTruncate(v []byte) string {
+	if len(v) > SHADOW_LOG_LENGTH {
+		return string(v[:SHADOW_LOG_LENGTH]) + "..."
+	}
+	return string(v)
+}
+
+// Close applies the queued operations, then closes both adapters.
+func (sa *shadowAdapter) Close() error {
+	sa.lock.Lock()
+	if !sa.closed {
+		sa.closed = true
+		close(sa.queue)
+	}
+	sa.lock.Unlock()
+
+	select {
+	case <-sa.done:
+	case <-time.After(SHADOW_DRAIN_TIMEOUT):
+		shadowLog.Warn("shadow: timed out applying queued operations")
+	}
+
+	if err := sa.shadow.Close(); err != nil {
+		shadowLog.Warn("shadow: failed to close:", err)
+	}
+	return sa.Adapter.Close()
+}
+
+// Writes. Objects are copied: the caller may change them after the call returns.
+
+func (sa *shadowAdapter) UserCreate(usr *types.User) (error, bool) {
+	err, dup := sa.Adapter.UserCreate(usr)
+	if err == nil {
+		cp := *usr
+		sa.mirror("UserCreate", func(a adapter.Adapter) error {
+			err, _ := a.UserCreate(&cp)
+			return err
+		})
+	}
+	return err, dup
+}
+
+func (sa *shadowAdapter) UserDelete(uid types.Uid, soft bool) error {
+	err := sa.Adapter.UserDelete(uid, soft)
+	if err == nil {
+		sa.mirror("UserDelete", func(a adapter.Adapter) error { return a.UserDelete(uid, soft) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) UserUpdateLastSeen(uid types.Uid, userAgent string, when time.Time) error {
+	err := sa.Adapter.UserUpdateLastSeen(uid, userAgent, when)
+	if err == nil {
+		sa.mirror("UserUpdateLastSeen", func(a adapter.Adapter) error { return a.UserUpdateLastSeen(uid, userAgent, when) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) ChangePassword(uid types.Uid, password string) error {
+	err := sa.Adapter.ChangePassword(uid, password)
+	if err == nil {
+		sa.mirror("ChangePassword", func(a adapter.Adapter) error { return a.ChangePassword(uid, password) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) UserUpdate(uid types.Uid, update map[string]interface{}) error {
+	err := sa.Adapter.UserUpdate(uid, update)
+	if err == nil {
+		cp := shadowCopyMap(update)
+		sa.mirror("UserUpdate", func(a adapter.Adapter) error { return a.UserUpdate(uid, cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) AddAuthRecord(user types.Uid, authLvl int, unique string, secret []byte, expires time.Time) (error, bool) {
+	err, dup := sa.Adapter.AddAuthRecord(user, authLvl, unique, secret, expires)
+	if err == nil {
+		sa.mirror("AddAuthRecord", func(a adapter.Adapter) error {
+			err, _ := a.AddAuthRecord(user, authLvl, unique, secret, expires)
+			return err
+		})
+	}
+	return err, dup
+}
+
+func (sa *shadowAdapter) DelAuthRecord(unique string) (int, error) {
+	count, err := sa.Adapter.DelAuthRecord(unique)
+	if err == nil {
+		sa.mirror("DelAuthRecord", func(a adapter.Adapter) error {
+			_, err := a.DelAuthRecord(unique)
+			return err
+		})
+	}
+	return count, err
+}
+
+func (sa *shadowAdapter) DelAllAuthRecords(uid types.Uid) (int, error) {
+	count, err := sa.Adapter.DelAllAuthRecords(uid)
+	if err == nil {
+		sa.mirror("DelAllAuthRecords", func(a adapter.Adapter) error {
+			_, err := a.DelAllAuthRecords(uid)
+			return err
+		})
+	}
+	return count, err
+}
+
+func (sa *shadowAdapter) UpdAuthRecord(unique string, authLvl int, secret []byte, expires time.Time) (int, error) {
+	count, err := sa.Adapter.UpdAuthRecord(unique, authLvl, secret, expires)
+	if err == nil {
+		sa.mirror("UpdAuthRecord", func(a adapter.Adapter) error {
+			_, err := a.UpdAuthRecord(unique, authLvl, secret, expires)
+			return err
+		})
+	}
+	return count, err
+}
+
+func (sa *shadowAdapter) TopicCreate(topic *types.Topic) error {
+	err := sa.Adapter.TopicCreate(topic)
+	if err == nil {
+		cp := *topic
+		sa.mirror("TopicCreate", func(a adapter.Adapter) error { return a.TopicCreate(&cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) TopicCreateP2P(initiator, invited *types.Subscription) error {
+	err := sa.Adapter.TopicCreateP2P(initiator, invited)
+	if err == nil {
+		cp1, cp2 := *initiator, *invited
+		sa.mirror("TopicCreateP2P", func(a adapter.Adapter) error { return a.TopicCreateP2P(&cp1, &cp2) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) TopicShare(subs []*types.Subscription) (int, error) {
+	count, err := sa.Adapter.TopicShare(subs)
+	if err == nil {
+		cp := make([]*types.Subscription, len(subs))
+		for i, sub := range subs {
+			s := *sub
+			cp[i] = &s
+		}
+		sa.mirror("TopicShare", func(a adapter.Adapter) error {
+			_, err := a.TopicShare(cp)
+			return err
+		})
+	}
+	return count, err
+}
+
+func (sa *shadowAdapter) TopicDelete(topic string) error {
+	err := sa.Adapter.TopicDelete(topic)
+	if err == nil {
+		sa.mirror("TopicDelete", func(a adapter.Adapter) error { return a.TopicDelete(topic) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) TopicUpdateOnMessage(topic string, msg *types.Message) error {
+	err := sa.Adapter.TopicUpdateOnMessage(topic, msg)
+	if err == nil {
+		cp := *msg
+		sa.mirror("TopicUpdateOnMessage", func(a adapter.Adapter) error { return a.TopicUpdateOnMessage(topic, &cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) TopicUpdate(topic string, update map[string]interface{}) error {
+	err := sa.Adapter.TopicUpdate(topic, update)
+	if err == nil {
+		cp := shadowCopyMap(update)
+		sa.mirror("TopicUpdate", func(a adapter.Adapter) error { return a.TopicUpdate(topic, cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) UserSetExternalId(uid types.Uid, extId string) error {
+	err := sa.Adapter.UserSetExternalId(uid, extId)
+	if err == nil {
+		sa.mirror("UserSetExternalId", func(a adapter.Adapter) error { return a.UserSetExternalId(uid, extId) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) TopicSetExternalId(topic string, extId string) error {
+	err := sa.Adapter.TopicSetExternalId(topic, extId)
+	if err == nil {
+		sa.mirror("TopicSetExternalId", func(a adapter.Adapter) error { return a.TopicSetExternalId(topic, extId) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) SubsUpdate(topic string, user types.Uid, update map[string]interface{}) error {
+	err := sa.Adapter.SubsUpdate(topic, user, update)
+	if err == nil {
+		cp := shadowCopyMap(update)
+		sa.mirror("SubsUpdate", func(a adapter.Adapter) error { return a.SubsUpdate(topic, user, cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) SubsOwnerChange(topic string, oldOwner, newOwner *types.Subscription) error {
+	err := sa.Adapter.SubsOwnerChange(topic, oldOwner, newOwner)
+	if err == nil {
+		o, n := *oldOwner, *newOwner
+		sa.mirror("SubsOwnerChange", func(a adapter.Adapter) error { return a.SubsOwnerChange(topic, &o, &n) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) SubsDelete(topic string, user types.Uid) error {
+	err := sa.Adapter.SubsDelete(topic, user)
+	if err == nil {
+		sa.mirror("SubsDelete", func(a adapter.Adapter) error { return a.SubsDelete(topic, user) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) SubsDelForTopic(topic string) error {
+	err := sa.Adapter.SubsDelForTopic(topic)
+	if err == nil {
+		sa.mirror("SubsDelForTopic", func(a adapter.Adapter) error { return a.SubsDelForTopic(topic) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) MessageSave(msg *types.Message) error {
+	err := sa.Adapter.MessageSave(msg)
+	if err == nil {
+		cp := *msg
+		sa.mirror("MessageSave", func(a adapter.Adapter) error { return a.MessageSave(&cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) MessageDeleteAll(topic string, before int) error {
+	err := sa.Adapter.MessageDeleteAll(topic, before)
+	if err == nil {
+		sa.mirror("MessageDeleteAll", func(a adapter.Adapter) error { return a.MessageDeleteAll(topic, before) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) MessageDeleteList(topic string, forUser types.Uid, hard bool, list []int) error {
+	err := sa.Adapter.MessageDeleteList(topic, forUser, hard, list)
+	if err == nil {
+		cp := append([]int(nil), list...)
+		sa.mirror("MessageDeleteList", func(a adapter.Adapter) error { return a.MessageDeleteList(topic, forUser, hard, cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) MessageUpdate(topic string, seqId int, update map[string]interface{}) error {
+	err := sa.Adapter.MessageUpdate(topic, seqId, update)
+	if err == nil {
+		cp := shadowCopyMap(update)
+		sa.mirror("MessageUpdate", func(a adapter.Adapter) error { return a.MessageUpdate(topic, seqId, cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) FileStartUpload(fd *types.FileDef) error {
+	err := sa.Adapter.FileStartUpload(fd)
+	if err == nil {
+		cp := *fd
+		sa.mirror("FileStartUpload", func(a adapter.Adapter) error { return a.FileStartUpload(&cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) FileFinishUpload(fd *types.FileDef) error {
+	err := sa.Adapter.FileFinishUpload(fd)
+	if err == nil {
+		cp := *fd
+		sa.mirror("FileFinishUpload", func(a adapter.Adapter) error { return a.FileFinishUpload(&cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) ReminderUpsert(r *types.Reminder) error {
+	err := sa.Adapter.ReminderUpsert(r)
+	if err == nil {
+		cp := *r
+		sa.mirror("ReminderUpsert", func(a adapter.Adapter) error { return a.ReminderUpsert(&cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) ReminderDelete(id string) error {
+	err := sa.Adapter.ReminderDelete(id)
+	if err == nil {
+		sa.mirror("ReminderDelete", func(a adapter.Adapter) error { return a.ReminderDelete(id) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) ScheduledSave(msg *types.ScheduledMessage) error {
+	err := sa.Adapter.ScheduledSave(msg)
+	if err == nil {
+		cp := *msg
+		sa.mirror("ScheduledSave", func(a adapter.Adapter) error { return a.ScheduledSave(&cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) ScheduledDelete(id string) error {
+	err := sa.Adapter.ScheduledDelete(id)
+	if err == nil {
+		sa.mirror("ScheduledDelete", func(a adapter.Adapter) error { return a.ScheduledDelete(id) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) CredUpsert(cred *types.Credential) error {
+	err := sa.Adapter.CredUpsert(cred)
+	if err == nil {
+		cp := *cred
+		sa.mirror("CredUpsert", func(a adapter.Adapter) error { return a.CredUpsert(&cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) CredDelete(id string) error {
+	err := sa.Adapter.CredDelete(id)
+	if err == nil {
+		sa.mirror("CredDelete", func(a adapter.Adapter) error { return a.CredDelete(id) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) ClientLogUpsert(cl *types.ClientLog) error {
+	err := sa.Adapter.ClientLogUpsert(cl)
+	if err == nil {
+		cp := *cl
+		sa.mirror("ClientLogUpsert", func(a adapter.Adapter) error { return a.ClientLogUpsert(&cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) DeviceUpsert(uid types.Uid, dev *types.DeviceDef) error {
+	err := sa.Adapter.DeviceUpsert(uid, dev)
+	if err == nil {
+		cp := *dev
+		sa.mirror("DeviceUpsert", func(a adapter.Adapter) error { return a.DeviceUpsert(uid, &cp) })
+	}
+	return err
+}
+
+func (sa *shadowAdapter) DeviceDelete(uid types.Uid, deviceId string) error {
+	err := sa.Adapter.DeviceDelete(uid, deviceId)
+	if err == nil {
+		sa.mirror("DeviceDelete", func(a adapter.Adapter) error { return a.DeviceDelete(uid, deviceId) })
+	}
+	return err
+}
+
+// Reads which are compared. Results of lists without a defined order are not compared.
+
+func (sa *shadowAdapter) UserGet(uid types.Uid) (*types.User, error) {
+	usr, err := sa.Adapter.UserGet(uid)
+	if err == nil {
+		sa.compareRead("UserGet", uid.String(), usr, func(a adapter.Adapter) (interface{}, error) {
+			return a.UserGet(uid)
+		})
+	}
+	return usr, err
+}
+
+func (sa *shadowAdapter) TopicGet(topic string) (*types.Topic, error) {
+	tpc, err := sa.Adapter.TopicGet(topic)
+	if err == nil {
+		sa.compareRead("TopicGet", topic, tpc, func(a adapter.Adapter) (interface{}, error) {
+			return a.TopicGet(topic)
+		})
+	}
+	return tpc, err
+}
+
+func (sa *shadowAdapter) SubscriptionGet(topic string, user types.Uid) (*types.Subscription, error) {
+	sub, err := sa.Adapter.SubscriptionGet(topic, user)
+	if err == nil {
+		sa.compareRead("SubscriptionGet", topic+":"+user.String(), sub, func(a adapter.Adapter) (interface{}, error) {
+			return a.SubscriptionGet(topic, user)
+		})
+	}
+	return sub, err
+}
+
+func (sa *shadowAdapter) MessageGetAll(topic string, forUser types.Uid, opts *types.BrowseOpt) ([]types.Message, error) {
+	msgs, err := sa.Adapter.MessageGetAll(topic, forUser, opts)
+	if err == nil {
+		var cp *types.BrowseOpt
+		if opts != nil {
+			o := *opts
+			cp = &o
+		}
+		sa.compareRead("MessageGetAll", topic, msgs, func(a adapter.Adapter) (interface{}, error) {
+			return a.MessageGetAll(topic, forUser, cp)
+		})
+	}
+	return msgs, err
+}
+
+func (sa *shadowAdapter) FileGet(fid string) (*types.FileDef, error) {
+	fd, err := sa.Adapter.FileGet(fid)
+	if err == nil {
+		sa.compareRead("FileGet", fid, fd, func(a adapter.Adapter) (interface{}, error) {
+			return a.FileGet(fid)
+		})
+	}
+	return fd, err
+}
+
+func (sa *shadowAdapter) CredGet(id string) (*types.Credential, error) {
+	cred, err := sa.Adapter.CredGet(id)
+	if err == nil {
+		sa.compareRead("CredGet", id, cred, func(a adapter.Adapter) (interface{}, error) {
+			return a.CredGet(id)
+		})
+	}
+	return cred, err
+}
+
+// shadowCopyMap makes a shallow copy of the update.
+func shadowCopyMap(src map[string]interface{}) map[string]interface{} {
+	dst := make(map[string]interface{}, len(src))
+	for key, val := range src {
+		dst[key] = val
+	}
+	return dst
+}
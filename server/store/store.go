@@ -3,6 +3,7 @@ package store
 import (
 	"encoding/json"
 	"errors"
+	"sort"
 	"time"
 
 	"github.com/tinode/chat/server/auth"
@@ -12,16 +13,41 @@ import (
 
 const (
 	MAX_USERS_FOR_TOPIC = 32
+	// Number of users whose devices are loaded at once by paged device queries
+	DEVICE_PAGE_SIZE = 100
 )
 
 var adaptr adapter.Adapter
 
+// wrappedAdapter returns the adapter wrapped by one of the layers set up by Open, nil for a database adapter.
+func wrappedAdapter(a adapter.Adapter) adapter.Adapter {
+	switch w := a.(type) {
+	case *recentAdapter:
+		return w.Adapter
+	case *cachingAdapter:
+		return w.Adapter
+	case *changesAdapter:
+		return w.Adapter
+	case *shadowAdapter:
+		return w.Adapter
+	}
+	return nil
+}
+
+// ErrExternalIdTaken is returned when the external ID is already given to another user or topic
+var ErrExternalIdTaken = errors.New("store: external ID is already used")
+
+// All registered adapters by name
+var adapters = make(map[string]adapter.Adapter)
+
 // Unique ID generator
 var uGen types.UidGenerator
 
+// Name of the adapter in use
+var adapterName string
+
 type configType struct {
-	// Name of the adapter to use.
-	// Currently unused
+	// Name of the adapter to use. Required if more than one adapter is compiled in.
 	AdapterName string `json:"adapter"`
 	// The following two values ate used to initialize types.UidGenerator
 	// Snowflake workerId, beteween 0 and 1023
@@ -29,6 +55,16 @@ type configType struct {
 	// 16-byte key for XTEA
 	UidKey        []byte          `json:"uid_key"`
 	AdapterConfig json.RawMessage `json:"adapter_config"`
+	// Message retention policy
+	Retention *retentionConfig `json:"retention"`
+	// Optional cache in front of the adapter
+	Cache *cacheConfig `json:"cache"`
+	// Optional in-process cache of the most recent messages of hot topics
+	Recent *recentConfig `json:"recent_cache"`
+	// Optional secondary adapter which receives a copy of all writes
+	Shadow *shadowConfig `json:"shadow"`
+	// Optional stream of writes to be repeated by a standby region
+	Changes *changesConfig `json:"change_stream"`
 }
 
 // Open initializes the persistence system. Adapter holds a connection pool for a single database.
@@ -51,6 +87,42 @@ func Open(jsonconf string) error {
 		return errors.New("store: failed to init snowflake: " + err.Error())
 	}
 
+	// Start with the bare adapter: the store may be reopened with a different cache or shadow.
+	name := config.AdapterName
+	if name == "" {
+		if len(adapters) > 1 {
+			return errors.New("store: more than one adapter is available, 'adapter' must be specified")
+		}
+		for name = range adapters {
+		}
+	}
+	if adapters[name] == nil {
+		return errors.New("store: unknown adapter '" + name + "'")
+	}
+	adaptr = adapters[name]
+	adapterName = name
+
+	if config.Retention != nil && !RetentionSupported() {
+		return errors.New("store: adapter '" + name + "' does not expire messages, 'retention' is not supported")
+	}
+	Retention.init(config.Retention)
+
+	if err := initShadow(config.Shadow); err != nil {
+		return errors.New("store: failed to init shadow adapter: " + err.Error())
+	}
+
+	if err := initChanges(config.Changes); err != nil {
+		return errors.New("store: failed to init change stream: " + err.Error())
+	}
+
+	if err := initCache(config.Cache); err != nil {
+		return errors.New("store: failed to init cache: " + err.Error())
+	}
+
+	if err := initRecent(config.Recent); err != nil {
+		return errors.New("store: failed to init recent messages cache: " + err.Error())
+	}
+
 	return adaptr.Open(string(config.AdapterConfig))
 }
 
@@ -62,6 +134,11 @@ func Close() error {
 	}
 }
 
+// AdapterName returns the name of the adapter in use, empty if the store is not open.
+func AdapterName() string {
+	return adapterName
+}
+
 func IsOpen() bool {
 	if adaptr != nil {
 		return adaptr.IsOpen()
@@ -76,16 +153,18 @@ func InitDb(reset bool) error {
 
 // Register makes a persistence adapter available by the provided name.
 // If Register is called twice with the same name or if the adapter is nil,
-// it panics.
-// Name is currently unused, i.e. only a single adapter can be registered
+// it panics. The first registered adapter is used unless the config names another.
 func Register(name string, adapter adapter.Adapter) {
 	if adapter == nil {
 		panic("store: Register adapter is nil")
 	}
-	if adaptr != nil {
-		panic("store: Adapter already registered")
+	if _, dup := adapters[name]; dup {
+		panic("store: Adapter already registered " + name)
+	}
+	adapters[name] = adapter
+	if adaptr == nil {
+		adaptr = adapter
 	}
-	adaptr = adapter
 }
 
 // Generate unique ID
@@ -110,34 +189,34 @@ func (u UsersObjMapper) Create(user *types.User, private interface{}) (*types.Us
 	user.SetUid(GetUid())
 	user.InitTimes()
 
-	err, _ := adaptr.UserCreate(user)
-	if err != nil {
-		return nil, err
-	}
+	// The user is deleted if it's not created completely
+	op := &types.Operation{Kind: types.OpUserCreate, Object: user.Id}
+	err := journalRun(op, func() error {
+		if err, _ := adaptr.UserCreate(user); err != nil {
+			return err
+		}
 
-	// Create user's subscription to 'me' && 'find'. Theese topics are ephemeral, the topic object need not to be
-	// inserted.
-	err = Subs.Create(
-		&types.Subscription{
-			ObjHeader: types.ObjHeader{CreatedAt: user.CreatedAt},
-			User:      user.Id,
-			Topic:     user.Uid().UserId(),
-			ModeWant:  types.ModeCSelf,
-			ModeGiven: types.ModeCSelf,
-			Private:   private,
-		},
-		&types.Subscription{
-			ObjHeader: types.ObjHeader{CreatedAt: user.CreatedAt},
-			User:      user.Id,
-			Topic:     user.Uid().FndName(),
-			ModeWant:  types.ModeCSelf,
-			ModeGiven: types.ModeCSelf,
-			Private:   nil,
-		})
+		// Create user's subscription to 'me' && 'find'. Theese topics are ephemeral, the topic object need not to be
+		// inserted.
+		return Subs.Create(
+			&types.Subscription{
+				ObjHeader: types.ObjHeader{CreatedAt: user.CreatedAt},
+				User:      user.Id,
+				Topic:     user.Uid().UserId(),
+				ModeWant:  types.ModeCSelf,
+				ModeGiven: types.ModeCSelf,
+				Private:   private,
+			},
+			&types.Subscription{
+				ObjHeader: types.ObjHeader{CreatedAt: user.CreatedAt},
+				User:      user.Id,
+				Topic:     user.Uid().FndName(),
+				ModeWant:  types.ModeCSelf,
+				ModeGiven: types.ModeCSelf,
+				Private:   nil,
+			})
+	}, func() error { return userDelete(user.Uid()) })
 	if err != nil {
-		// Best effort to delete incomplete user record. Orphaned user records are not a problem.
-		// They just take up space.
-		adaptr.UserDelete(user.Uid(), true)
 		return nil, err
 	}
 
@@ -163,6 +242,11 @@ func (UsersObjMapper) UpdateAuthRecord(uid types.Uid, authLvl int, scheme, uniqu
 	return adaptr.UpdAuthRecord(scheme+":"+unique, authLvl, secret, expires)
 }
 
+// Delete authentication record
+func (UsersObjMapper) DelAuthRecord(scheme, unique string) (int, error) {
+	return adaptr.DelAuthRecord(scheme + ":" + unique)
+}
+
 // Get returns a user object for the given user id
 func (UsersObjMapper) Get(uid types.Uid) (*types.User, error) {
 	return adaptr.UserGet(uid)
@@ -173,14 +257,32 @@ func (UsersObjMapper) GetAll(uid ...types.Uid) ([]types.User, error) {
 	return adaptr.UserGetAll(uid...)
 }
 
-// TODO(gene): implement
+// Delete marks the user as deleted or, if soft is false, deletes the user's subscriptions, contacts,
+// authentication records, tags and the user object. Topics owned by the user are not deleted.
 func (UsersObjMapper) Delete(id types.Uid, soft bool) error {
-	// Maybe delete topics where the user is the owner and all subscriptions to those topics, and messages
-	// Delete user's subscriptions
-	// Delete user's authentication records
-	// Delete user's tags
-	// Delete user object
-	return errors.New("store: not implemented")
+	if soft {
+		return adaptr.UserDelete(id, true)
+	}
+	op := &types.Operation{Kind: types.OpUserDelete, Object: id.String()}
+	return journalRun(op, func() error { return userDelete(id) }, nil)
+}
+
+// SetExternalId gives the user an ID in an external system or clears it if the ID is empty. An ID given to
+// another user is rejected with ErrExternalIdTaken.
+func (UsersObjMapper) SetExternalId(uid types.Uid, extId string) error {
+	if extId != "" {
+		if other, err := adaptr.UserGetByExternalId(extId); err != nil {
+			return err
+		} else if other != nil && other.Id != uid.String() {
+			return ErrExternalIdTaken
+		}
+	}
+	return adaptr.UserSetExternalId(uid, extId)
+}
+
+// GetByExternalId returns the user with the given external ID, nil if there is none
+func (UsersObjMapper) GetByExternalId(extId string) (*types.User, error) {
+	return adaptr.UserGetByExternalId(extId)
 }
 
 func (UsersObjMapper) UpdateStatus(id types.Uid, status interface{}) error {
@@ -201,9 +303,41 @@ func (u UsersObjMapper) GetSubs(id types.Uid) ([]types.Subscription, error) {
 	return adaptr.SubsForUser(id, false)
 }
 
-// GetSubs loads a list of subscriptions for the given user
-func (u UsersObjMapper) FindSubs(id types.Uid, query []interface{}) ([]types.Subscription, error) {
-	return adaptr.FindSubs(id, query)
+// FindSubs finds users by tags for 'fnd'. A tag ending with "*" matches all tags starting with it.
+// Prefixes too short to be used are ignored. At most limit users are found. Users who matched more tags
+// are listed first, then ordered by ID.
+func (u UsersObjMapper) FindSubs(id types.Uid, query []interface{}, limit int) ([]types.Subscription, error) {
+	var tags, prefixes []string
+	for _, q := range query {
+		str, _ := q.(string)
+		if tag, prefix, ok := types.ParseTagQuery(str); !ok {
+			continue
+		} else if prefix {
+			prefixes = append(prefixes, tag)
+		} else {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 && len(prefixes) == 0 {
+		return nil, nil
+	}
+
+	subs, err := adaptr.FindSubs(id, tags, prefixes, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := func(sub *types.Subscription) int {
+		tags, _ := sub.Private.([]string)
+		return len(tags)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if mi, mj := matched(&subs[i]), matched(&subs[j]); mi != mj {
+			return mi > mj
+		}
+		return subs[i].User < subs[j].User
+	})
+	return subs, nil
 }
 
 // GetTopics load a list of user's subscriptions with Public field copied to subscription
@@ -258,6 +392,26 @@ func (TopicsObjMapper) Get(topic string) (*types.Topic, error) {
 	return adaptr.TopicGet(topic)
 }
 
+// GetWebIndex loads topics published on the web which may be indexed by search engines, up to limit
+func (TopicsObjMapper) GetWebIndex(limit int) ([]types.Topic, error) {
+	return adaptr.TopicsWebIndex(limit)
+}
+
+// GetDigest loads topics with periodic digests enabled
+func (TopicsObjMapper) GetDigest() ([]types.Topic, error) {
+	return adaptr.TopicsDigest()
+}
+
+// GetScripted loads topics with automation scripts
+func (TopicsObjMapper) GetScripted() ([]types.Topic, error) {
+	return adaptr.TopicsScripted()
+}
+
+// GetExpiring loads topics with a message TTL
+func (TopicsObjMapper) GetExpiring() ([]types.Topic, error) {
+	return adaptr.TopicsExpiring()
+}
+
 // GetUsers loads subscriptions for topic plus loads user.Public
 func (TopicsObjMapper) GetUsers(topic string) ([]types.Subscription, error) {
 	return adaptr.UsersForTopic(topic, false)
@@ -274,26 +428,39 @@ func (TopicsObjMapper) GetSubs(topic string) ([]types.Subscription, error) {
 	return adaptr.SubsForTopic(topic, false)
 }
 
-// GetSubs loads a list of subscriptions to the given topic, including deleted subscriptions.
+// GetSubsAny loads a list of subscriptions to the given topic, including deleted subscriptions.
 // user.Public is not loaded
-// func (TopicsObjMapper) GetSubsAny(topic string) ([]types.Subscription, error) {
-//	return adaptr.SubsForTopic(topic, true)
-// }
+func (TopicsObjMapper) GetSubsAny(topic string) ([]types.Subscription, error) {
+	return adaptr.SubsForTopic(topic, true)
+}
 
 func (TopicsObjMapper) Update(topic string, update map[string]interface{}) error {
 	update["UpdatedAt"] = types.TimeNow()
 	return adaptr.TopicUpdate(topic, update)
 }
 
-func (TopicsObjMapper) Delete(topic string) error {
-	if err := adaptr.SubsDelForTopic(topic); err != nil {
-		return err
-	}
-	if err := adaptr.MessageDeleteAll(topic, -1); err != nil {
-		return err
+// SetExternalId gives the topic an ID in an external system or clears it if the ID is empty. An ID given to
+// another topic is rejected with ErrExternalIdTaken.
+func (TopicsObjMapper) SetExternalId(topic string, extId string) error {
+	if extId != "" {
+		if other, err := adaptr.TopicGetByExternalId(extId); err != nil {
+			return err
+		} else if other != nil && other.Id != topic {
+			return ErrExternalIdTaken
+		}
 	}
+	return adaptr.TopicSetExternalId(topic, extId)
+}
 
-	return adaptr.TopicDelete(topic)
+// GetByExternalId returns the topic with the given external ID, nil if there is none
+func (TopicsObjMapper) GetByExternalId(extId string) (*types.Topic, error) {
+	return adaptr.TopicGetByExternalId(extId)
+}
+
+// Delete deletes the topic with all its subscriptions and messages
+func (TopicsObjMapper) Delete(topic string) error {
+	op := &types.Operation{Kind: types.OpTopicDelete, Object: topic}
+	return journalRun(op, func() error { return topicDelete(topic) }, nil)
 }
 
 // Topics struct to hold methods for persistence mapping for the topic object.
@@ -321,11 +488,23 @@ func (SubsObjMapper) Update(topic string, user types.Uid, update map[string]inte
 	return adaptr.SubsUpdate(topic, user, update)
 }
 
+// OwnerChange saves access modes of the old and the new owner of the topic together.
+func (SubsObjMapper) OwnerChange(topic string, oldOwner, newOwner *types.Subscription) error {
+	return adaptr.SubsOwnerChange(topic, oldOwner, newOwner)
+}
+
 // Delete deletes a subscription
 func (SubsObjMapper) Delete(topic string, user types.Uid) error {
 	return adaptr.SubsDelete(topic, user)
 }
 
+// DeleteAll deletes subscriptions of the user to the given topics one by one and calls done, if given,
+// after each one. If interrupted, the rest is deleted at the next startup.
+func (SubsObjMapper) DeleteAll(user types.Uid, topics []string, done func(topic string)) error {
+	op := &types.Operation{Kind: types.OpUnsubscribe, Object: user.String(), Topics: topics}
+	return journalRun(op, func() error { return unsubscribe(user, topics, done) }, nil)
+}
+
 // Messages struct to hold methods for persistence mapping for the Message object.
 type MessagesObjMapper struct{}
 
@@ -351,6 +530,8 @@ func (MessagesObjMapper) Save(msg *types.Message) error {
 		return err
 	}
 
+	msg.SetRetention(Retention.Retention(msg.Topic))
+
 	return adaptr.MessageSave(msg)
 }
 
@@ -358,7 +539,7 @@ func (MessagesObjMapper) Save(msg *types.Message) error {
 func (MessagesObjMapper) Delete(topic string, forUser types.Uid, hard bool, cleared int) (err error) {
 	if hard {
 		err = adaptr.MessageDeleteAll(topic, cleared)
-		if err != nil {
+		if err == nil {
 			update := map[string]interface{}{"ClearId": cleared}
 			if topic == forUser.UserId() {
 				err = adaptr.UserUpdate(forUser, update)
@@ -384,6 +565,194 @@ func (MessagesObjMapper) GetAll(topic string, forUser types.Uid, opt *types.Brow
 	return adaptr.MessageGetAll(topic, forUser, opt)
 }
 
+// GetList loads the messages with the given seq IDs in one request
+func (MessagesObjMapper) GetList(topic string, forUser types.Uid, list []int) ([]types.Message, error) {
+	return adaptr.MessageGetList(topic, forUser, list)
+}
+
+// Search finds messages in the topic which contain the query string
+func (MessagesObjMapper) Search(topic string, forUser types.Uid, query string, opt *types.BrowseOpt) ([]types.Message, error) {
+	return adaptr.MessageSearch(topic, forUser, query, opt)
+}
+
+// FirstAfter returns SeqId of the first message starting with since which was created after the given time
+func (MessagesObjMapper) FirstAfter(topic string, since int, after time.Time) (int, error) {
+	return adaptr.MessageFirstAfter(topic, since, after)
+}
+
+// Update updates part of a stored message
+func (MessagesObjMapper) Update(topic string, seqId int, update map[string]interface{}) error {
+	update["UpdatedAt"] = types.TimeNow()
+	return adaptr.MessageUpdate(topic, seqId, update)
+}
+
+// Files struct to hold methods for persistence mapping for the FileDef object.
+type FilesObjMapper struct{}
+
+var Files FilesObjMapper
+
+// StartUpload records that the given user initiated a file upload
+func (FilesObjMapper) StartUpload(fd *types.FileDef) error {
+	fd.Status = types.UploadStarted
+	fd.InitTimes()
+	return adaptr.FileStartUpload(fd)
+}
+
+// FinishUpload marks started upload as successfully finished or failed
+func (FilesObjMapper) FinishUpload(fd *types.FileDef, success bool) error {
+	if success {
+		fd.Status = types.UploadCompleted
+	} else {
+		fd.Status = types.UploadFailed
+	}
+	fd.UpdatedAt = types.TimeNow()
+	return adaptr.FileFinishUpload(fd)
+}
+
+// Get fetches a file record for a unique file id.
+func (FilesObjMapper) Get(fid string) (*types.FileDef, error) {
+	return adaptr.FileGet(fid)
+}
+
+// Usage returns the number of bytes the user has uploaded
+func (FilesObjMapper) Usage(uid types.Uid) (int64, error) {
+	return adaptr.FileUsage(uid)
+}
+
+// RemindersObjMapper is a struct to hold methods for persistence mapping for the Reminder object.
+type RemindersObjMapper struct{}
+
+var Reminders RemindersObjMapper
+
+// Upsert creates a reminder or replaces an existing one with the same ID
+func (RemindersObjMapper) Upsert(r *types.Reminder) error {
+	r.InitTimes()
+	return adaptr.ReminderUpsert(r)
+}
+
+// Delete deletes a reminder by ID
+func (RemindersObjMapper) Delete(id string) error {
+	return adaptr.ReminderDelete(id)
+}
+
+// GetDue loads reminders which are due at or before the given time and accepted by keep
+func (RemindersObjMapper) GetDue(until time.Time, limit int, keep func(*types.Reminder) bool) ([]types.Reminder, error) {
+	return adaptr.RemindersDue(until, limit, keep)
+}
+
+// ScheduledObjMapper is a struct to hold methods for persistence mapping for the ScheduledMessage object.
+type ScheduledObjMapper struct{}
+
+var Scheduled ScheduledObjMapper
+
+// Save stores a message for delivery at a later time and assigns it an ID
+func (ScheduledObjMapper) Save(msg *types.ScheduledMessage) error {
+	msg.SetUid(GetUid())
+	msg.InitTimes()
+	return adaptr.ScheduledSave(msg)
+}
+
+// Delete deletes a scheduled message by ID
+func (ScheduledObjMapper) Delete(id string) error {
+	return adaptr.ScheduledDelete(id)
+}
+
+// GetDue loads scheduled messages which are due at or before the given time and accepted by keep,
+// oldest first
+func (ScheduledObjMapper) GetDue(until time.Time, limit int,
+	keep func(*types.ScheduledMessage) bool) ([]types.ScheduledMessage, error) {
+	return adaptr.ScheduledDue(until, limit, keep)
+}
+
+// CredentialsObjMapper is a struct to hold methods for persistence mapping for the Credential object.
+type CredentialsObjMapper struct{}
+
+var Credentials CredentialsObjMapper
+
+// Upsert creates a credential or replaces an existing one with the same method and value
+func (CredentialsObjMapper) Upsert(cred *types.Credential) error {
+	cred.Id = cred.Method + ":" + cred.Value
+	if cred.CreatedAt.IsZero() {
+		cred.InitTimes()
+	} else {
+		cred.UpdatedAt = types.TimeNow()
+	}
+	return adaptr.CredUpsert(cred)
+}
+
+// Get loads a credential by method and value, returns nil if not found
+func (CredentialsObjMapper) Get(method, value string) (*types.Credential, error) {
+	return adaptr.CredGet(method + ":" + value)
+}
+
+// Delete deletes a credential by method and value
+func (CredentialsObjMapper) Delete(method, value string) error {
+	return adaptr.CredDelete(method + ":" + value)
+}
+
+// ClientLogsObjMapper is a struct to hold methods for persistence mapping for the ClientLog object.
+type ClientLogsObjMapper struct{}
+
+var ClientLogs ClientLogsObjMapper
+
+// Create stores a record of a new client log and assigns it an ID
+func (ClientLogsObjMapper) Create(cl *types.ClientLog) error {
+	cl.SetUid(GetUid())
+	cl.InitTimes()
+	return adaptr.ClientLogUpsert(cl)
+}
+
+// Update saves changes to an existing record, i.e. the ticket it's linked to
+func (ClientLogsObjMapper) Update(cl *types.ClientLog) error {
+	cl.UpdatedAt = types.TimeNow()
+	return adaptr.ClientLogUpsert(cl)
+}
+
+// Get loads a client log record by ID, returns nil if not found
+func (ClientLogsObjMapper) Get(id string) (*types.ClientLog, error) {
+	return adaptr.ClientLogGet(id)
+}
+
+// Find loads records of logs linked to the ticket and/or uploaded by the user, newest first
+func (ClientLogsObjMapper) Find(ticket string, user types.Uid, limit int) ([]types.ClientLog, error) {
+	return adaptr.ClientLogFind(ticket, user, limit)
+}
+
+// ContactsObjMapper is a struct to hold methods for persistence mapping for the ContactRecord object.
+type ContactsObjMapper struct{}
+
+var Contacts ContactsObjMapper
+
+// Set stores the status of the contact for both users: the user gets the given status, the contact
+// gets the reverse one. Existing records are replaced.
+func (ContactsObjMapper) Set(user, contact types.Uid, status int) error {
+	reverse := status
+	switch status {
+	case types.ContactSent:
+		reverse = types.ContactReceived
+	case types.ContactReceived:
+		reverse = types.ContactSent
+	}
+
+	mine := &types.ContactRecord{User: user.String(), Contact: contact.String(), Status: status}
+	theirs := &types.ContactRecord{User: contact.String(), Contact: user.String(), Status: reverse}
+	for _, c := range []*types.ContactRecord{mine, theirs} {
+		c.Id = c.User + ":" + c.Contact
+		c.InitTimes()
+	}
+	return adaptr.ContactUpsert(mine, theirs)
+}
+
+// GetAll loads the contact list of the user
+func (ContactsObjMapper) GetAll(user types.Uid) ([]types.ContactRecord, error) {
+	return adaptr.ContactGetAll(user)
+}
+
+// Delete removes the contact from the lists of both users
+func (ContactsObjMapper) Delete(user, contact types.Uid) error {
+	return adaptr.ContactDelete(user, contact)
+}
+
 var authHandlers map[string]auth.AuthHandler
 
 // Register an authentication scheme handler
@@ -421,3 +790,63 @@ func (DeviceMapper) GetAll(uid ...types.Uid) (map[types.Uid][]types.DeviceDef, i
 func (DeviceMapper) Delete(uid types.Uid, deviceId string) error {
 	return adaptr.DeviceDelete(uid, deviceId)
 }
+
+// GetPage returns devices of the platform (all platforms if empty) of up to limit users which
+// follow the cursor 'after' in the sorted list of uids. The returned cursor is passed to the next
+// call, it's zero after the last page. Use zero cursor to start from the beginning.
+func (DeviceMapper) GetPage(uids []types.Uid, platform string, after types.Uid,
+	limit int) ([]types.UserDevice, types.Uid, error) {
+
+	if limit <= 0 || limit > DEVICE_PAGE_SIZE {
+		limit = DEVICE_PAGE_SIZE
+	}
+
+	start := 0
+	if !after.IsZero() {
+		start = sort.Search(len(uids), func(i int) bool { return uids[i] > after })
+	}
+	if start >= len(uids) {
+		return nil, types.ZeroUid, nil
+	}
+	end := start + limit
+	if end > len(uids) {
+		end = len(uids)
+	}
+
+	devices, err := adaptr.DeviceGetPage(uids[start:end], platform)
+	if err != nil {
+		return nil, types.ZeroUid, err
+	}
+
+	next := types.ZeroUid
+	if end < len(uids) {
+		next = uids[end-1]
+	}
+	return devices, next, nil
+}
+
+// ForEach calls fn with devices of the users page by page, so devices of a large audience are not
+// loaded into memory at once. Only devices of the platform are passed unless the platform is empty.
+// Iteration stops at the first error.
+func (d DeviceMapper) ForEach(uids []types.Uid, platform string, fn func(devices []types.UserDevice) error) error {
+	sorted := make([]types.Uid, len(uids))
+	copy(sorted, uids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	after := types.ZeroUid
+	for {
+		devices, next, err := d.GetPage(sorted, platform, after, DEVICE_PAGE_SIZE)
+		if err != nil {
+			return err
+		}
+		if len(devices) > 0 {
+			if err = fn(devices); err != nil {
+				return err
+			}
+		}
+		if next.IsZero() {
+			return nil
+		}
+		after = next
+	}
+}
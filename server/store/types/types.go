@@ -236,11 +236,27 @@ func (h *ObjHeader) IsDeleted() bool {
 	return h.DeletedAt != nil
 }
 
+// States of a user account. Users in any state but active cannot log in or act in topics.
+const (
+	// The user may log in
+	UserStateActive = 0
+	// Temporarily disabled by the operator
+	UserStateSuspended = 1
+	// Deleted by the operator but kept for recovery
+	UserStateDeleted = 2
+	// Permanently disabled by the operator
+	UserStateBanned = 3
+)
+
 // Stored user
 type User struct {
 	ObjHeader
-	// Currently unused: Unconfirmed, Active, etc.
+	// State of the account, UserStateXXX
 	State int
+	// Reason of the last change of the state given by the operator
+	StateReason string
+	// When the state was last changed
+	StateAt time.Time
 
 	// Default access to user for P2P topics (used as default modeGiven)
 	Access DefaultAccess
@@ -261,8 +277,33 @@ type User struct {
 	// 'users' as well as indexed in 'tagunique'
 	Tags []string
 
+	// Indexed ID of the user in an external system. Not stored if empty: the index is sparse.
+	ExternalId string `json:",omitempty" dynamodbav:",omitempty"`
+
 	// Info on known devices, used for push notifications
 	Devices map[string]*DeviceDef
+
+	// The user allows support staff to impersonate the account until this time
+	ImpersonationConsent time.Time
+
+	// Users blocked by this user
+	Blocked []string
+
+	// Who sees the user's presence
+	Privacy PresencePrivacy
+
+	// Quota of uploaded files in bytes set by the operator: 0 for the server default, negative for unlimited
+	FileQuota int64
+}
+
+// PresencePrivacy is the user's choice of who sees the user online and when the user was last seen.
+type PresencePrivacy struct {
+	// The user appears offline to everyone
+	Invisible bool
+	// Time when the user was last seen is not shown
+	HideLastSeen bool
+	// Only accepted contacts see the user online
+	ContactsOnly bool
 }
 
 type AccessMode uint
@@ -280,6 +321,15 @@ const (
 	ModeUnset                          // Non-zero value to indicate unknown or undefined mode (:0x100),
 	// to make it different from ModeNone
 
+	// Scopes for bots which should not have full access. They are meaningful without ModeRead
+	// and ModeDelete respectively.
+	ModeCommand   // user receives only {data} with head.cmd addressed to it (C:0x200)
+	ModeDeleteOwn // user can hard-delete own messages (E:0x400)
+
+	// Moderator: user can hard-delete messages of others, evict and ban members who are not
+	// admins or moderators, and change topic's public description (M:0x800)
+	ModeModerate
+
 	ModeNone AccessMode = 0 // No access, requests to gain access are processed normally (N)
 
 	// Normal user's access to a topic
@@ -320,6 +370,15 @@ func (m AccessMode) MarshalText() ([]byte, error) {
 			res = append(res, chr)
 		}
 	}
+	if m&ModeCommand != 0 {
+		res = append(res, 'C')
+	}
+	if m&ModeDeleteOwn != 0 {
+		res = append(res, 'E')
+	}
+	if m&ModeModerate != 0 {
+		res = append(res, 'M')
+	}
 	return res, nil
 }
 
@@ -345,6 +404,12 @@ func (m *AccessMode) UnmarshalText(b []byte) error {
 			m0 |= ModePres
 		case 'O', 'o':
 			m0 |= ModeOwner
+		case 'C', 'c':
+			m0 |= ModeCommand
+		case 'E', 'e':
+			m0 |= ModeDeleteOwn
+		case 'M', 'm':
+			m0 |= ModeModerate
 		case 'N', 'n':
 			m0 = 0 // N means explicitly no access, all bits cleared
 			break
@@ -461,6 +526,21 @@ func (a AccessMode) IsDeleter() bool {
 	return a&ModeDelete != 0
 }
 
+// Check if user receives commands addressed to it
+func (a AccessMode) IsCommander() bool {
+	return a&ModeCommand != 0
+}
+
+// Check if user can hard-delete own messages
+func (a AccessMode) IsOwnDeleter() bool {
+	return a&ModeDeleteOwn != 0
+}
+
+// Check if user is a moderator
+func (a AccessMode) IsModerator() bool {
+	return a&ModeModerate != 0
+}
+
 // Check if not set
 func (a AccessMode) IsZero() bool {
 	return a == 0
@@ -511,6 +591,8 @@ type Subscription struct {
 	ModeGiven AccessMode
 	// User's private data associated with the subscription to topic
 	Private interface{}
+	// User's preferences of push notifications for the topic
+	Notify *NotifyPrefs
 
 	// Deserialized ephemeral values
 
@@ -595,6 +677,36 @@ type Contact struct {
 	Public   interface{}
 }
 
+const (
+	// Suffix of a tag in a 'fnd' query which matches all tags starting with the rest of it, e.g. "email:alice*"
+	TagPrefixSuffix = "*"
+	// Minimum length of the value of a prefix query, e.g. "al" in "email:al*"
+	TagPrefixMinLength = 2
+)
+
+// ParseTagQuery parses a tag of a 'fnd' query. It returns the tag or the prefix to match and whether
+// it's a prefix. A prefix must have a kind like "email:" and at least TagPrefixMinLength characters
+// after it, otherwise ok is false.
+func ParseTagQuery(query string) (tag string, prefix, ok bool) {
+	if !strings.HasSuffix(query, TagPrefixSuffix) {
+		return query, false, query != ""
+	}
+	tag = strings.TrimSuffix(query, TagPrefixSuffix)
+	parts := strings.SplitN(tag, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || len(parts[1]) < TagPrefixMinLength {
+		return "", true, false
+	}
+	return tag, true, true
+}
+
+// TagKind returns the kind of the tag, e.g. "email" for "email:alice@example.com", or an empty string.
+func TagKind(tag string) string {
+	if i := strings.Index(tag, ":"); i > 0 {
+		return tag[:i]
+	}
+	return ""
+}
+
 type perUserData struct {
 	private interface{}
 	want    AccessMode
@@ -619,6 +731,51 @@ type Topic struct {
 	// If messages were deleted, id of the last deleted message
 	ClearId int
 
+	// Topic history is published read-only on the web, no auth required
+	WebView bool
+	// Search engines may index the published history, it's listed in the sitemap
+	WebIndex bool
+
+	// Periodic digest posted into the topic: "daily", "weekly" or empty for none
+	Digest string
+	// When the last digest was generated
+	DigestAt time.Time
+	// SeqId of the last message covered by the digest
+	DigestSeq int
+
+	// SeqIds of pinned messages
+	Pinned []int
+
+	// IDs of users banned from the topic
+	Banned []string
+
+	// Generation of invite links; incremented to revoke the issued links
+	InviteGen int
+
+	// User the ownership of the topic is offered to
+	TransferTo string
+
+	// Messages are deleted this many seconds after they were sent, 0 to keep them
+	MessageTtl int
+
+	// Maximum number of members set by root, 0 for the server default
+	MaxMembers int
+
+	// Versions of the automation script, the latest last
+	Scripts []TopicScript
+
+	// Tags given to the topic by its template
+	Tags []string
+
+	// Reference to the entity of an external system the topic was provisioned for
+	ExternalRef string
+
+	// Indexed ID of the topic in an external system. Not stored if empty: the index is sparse.
+	ExternalId string `json:",omitempty" dynamodbav:",omitempty"`
+
+	// Webhook registered by the owner, nil if none
+	Webhook *TopicWebhook
+
 	Public interface{}
 
 	// Deserialized ephemeral params
@@ -694,6 +851,34 @@ type SoftDelete struct {
 	Timestamp time.Time
 }
 
+// Version of the automation script attached to a topic
+type TopicScript struct {
+	Version   int
+	CreatedAt time.Time
+	// User who saved this version
+	Author string
+	Source string
+	// The script is kept but not run
+	Disabled bool
+}
+
+// Webhook which receives the events of a topic
+type TopicWebhook struct {
+	Url string
+	// Secret for signing the requests
+	Secret string
+	// Names of the events, all events if empty
+	Events []string
+}
+
+// Earlier version of an edited message
+type MessageEdit struct {
+	// When this version was published or edited
+	Timestamp time.Time
+	Head      map[string]string
+	Content   interface{}
+}
+
 // Stored {data} message
 type Message struct {
 	ObjHeader
@@ -705,6 +890,28 @@ type Message struct {
 	From    string
 	Head    map[string]string
 	Content interface{}
+	// SeqId of the first message of the thread if this message is a reply in a thread
+	Thread int
+	// Time of the last edit by the sender, nil if never edited
+	EditedAt *time.Time
+	// Earlier versions of an edited message, oldest first
+	Edits []MessageEdit
+	// Reactions to the message: IDs of the users by reaction
+	Reactions map[string][]string
+
+	// Retention period requested by the server, not stored
+	retention time.Duration
+}
+
+// SetRetention sets how long the message should be kept: 0 - adapter default,
+// negative - forever.
+func (m *Message) SetRetention(period time.Duration) {
+	m.retention = period
+}
+
+// GetRetention returns message retention period as set by the server.
+func (m *Message) GetRetention() time.Duration {
+	return m.retention
 }
 
 // Announcements/Invites
@@ -744,6 +951,10 @@ type BrowseOpt struct {
 	Until  *time.Time
 	ByTime bool
 	Limit  uint
+	// Load only replies in the thread started by the message with this SeqId
+	Thread int
+	// Load only messages which mention this user in Head["mentions"]
+	Mentions Uid
 }
 
 type TopicCat int
@@ -753,6 +964,8 @@ const (
 	TopicCat_Fnd
 	TopicCat_P2P
 	TopicCat_Grp
+	// Channel: a group topic where only publishers post and readers don't see each other
+	TopicCat_Chn
 )
 
 func GetTopicCat(name string) TopicCat {
@@ -763,6 +976,8 @@ func GetTopicCat(name string) TopicCat {
 		return TopicCat_P2P
 	case "grp":
 		return TopicCat_Grp
+	case "chn":
+		return TopicCat_Chn
 	case "fnd":
 		return TopicCat_Fnd
 	default:
@@ -782,3 +997,190 @@ type DeviceDef struct {
 	// Device language, ISO code
 	Lang string
 }
+
+// UserDevice is a device together with the ID of its user, an item of paged device queries.
+type UserDevice struct {
+	User Uid
+	DeviceDef
+}
+
+// Status of a file upload
+const (
+	UploadStarted = iota
+	UploadCompleted
+	UploadFailed
+)
+
+// FileDef is a record of a file upload. The file itself is stored by the media handler.
+type FileDef struct {
+	ObjHeader
+	// Status of the upload
+	Status int
+	// User who uploaded the file
+	User string
+	// Topic where the file was shared
+	Topic string
+	// MIME type of the file
+	MimeType string
+	// Size of the file in bytes
+	Size int64
+	// Internal file location, i.e. path on disk or an S3 key
+	Location string
+}
+
+// NotifyPrefs are user's preferences of push notifications for a topic.
+type NotifyPrefs struct {
+	// No notifications at all
+	Muted bool
+	// Notifications only for messages which mention the user
+	MentionsOnly bool
+	// Quiet hours: no notifications from QuietStart till QuietEnd, minutes since midnight in TimeZone.
+	// Quiet hours are off if QuietStart == QuietEnd.
+	QuietStart int
+	QuietEnd   int
+	// IANA time zone name, e.g. "Europe/Berlin"
+	TimeZone string
+}
+
+// Credential is user's email address or phone number and the state of its validation.
+type Credential struct {
+	// Id is "<method>:<value>", e.g. "email:jdoe@example.com"
+	ObjHeader
+	// User who claims the credential
+	User string
+	// Validation method, e.g. "email" or "tel"
+	Method string
+	// Normalized value, e.g. email address
+	Value string
+	// The user has confirmed the ownership of the credential
+	Done bool
+	// Hash of the pending confirmation code, empty if there is none
+	Code string
+	// What the pending code is for, "confirm" or "reset"
+	Purpose string
+	// Time when the pending code expires
+	CodeExpires time.Time
+	// Number of failed attempts to enter the code
+	Retries int
+}
+
+// ClientLog is a diagnostic log uploaded by a client application.
+type ClientLog struct {
+	ObjHeader
+	// User who uploaded the log
+	User string
+	// ID of the file record which holds the content
+	File string
+	// Support ticket the log is linked to, could be empty
+	Ticket string
+	// User agent of the client which uploaded the log
+	UserAgent string
+	// Size of the content after redaction, bytes
+	Size int64
+}
+
+// Status of a contact
+const (
+	// The user asked the other user to be added to contacts
+	ContactSent = iota + 1
+	// The other user asked the user to be added to contacts
+	ContactReceived
+	// Both users agreed to be contacts
+	ContactAccepted
+)
+
+// ContactRecord is an entry of the user's contact list. Each pair of contacts is stored as two records,
+// one for each user. Id is User:Contact.
+type ContactRecord struct {
+	ObjHeader
+	// ID of the user who owns the record
+	User string
+	// ID of the other user
+	Contact string
+	// One of the Contact* statuses
+	Status int
+}
+
+// Kinds of journaled operations
+const (
+	// Deletion of a topic with its subscriptions and messages
+	OpTopicDelete = "topic-delete"
+	// Creation of a user with its tags and subscriptions to 'me' and 'fnd'
+	OpUserCreate = "user-create"
+	// Hard deletion of a user with its subscriptions, contacts, authentication records and tags
+	OpUserDelete = "user-delete"
+	// Deletion of subscriptions of a user to several topics
+	OpUnsubscribe = "unsubscribe"
+)
+
+// Operation is a journal record of a multi-step operation. It's saved before the first step and deleted
+// after the last one: a record found at startup belongs to an interrupted operation.
+type Operation struct {
+	ObjHeader
+	// One of the Op* kinds
+	Kind string
+	// Name of the topic or ID of the user the operation is applied to
+	Object string
+	// Names of topics of OpUnsubscribe
+	Topics []string `json:",omitempty"`
+	// Cluster node which runs the operation, empty for a standalone server
+	Node string `json:",omitempty"`
+}
+
+// Reminder is a request to remind the user about a message at a given time.
+type Reminder struct {
+	ObjHeader
+	// User who requested the reminder
+	User string
+	// Name of the topic as seen by the user
+	Topic string
+	// ID of the message to remind about
+	SeqId int
+	// Beginning of the message content
+	Snippet string
+	// Time when the reminder is due
+	At time.Time
+}
+
+// ScheduledMessage is a message published for delivery at a later time. It's kept in the store until
+// due and gets its SeqId when delivered to the topic.
+type ScheduledMessage struct {
+	ObjHeader
+	// Name of the topic to deliver the message to
+	Topic string
+	// UID of the sender as string
+	From string
+	// SeqId of the first message of the thread to reply in
+	Thread int
+	Head   map[string]string
+	// Content of the message
+	Content interface{}
+	// Time when the message is due
+	At time.Time
+}
+
+// Kinds of inconsistencies found by the store checker
+const (
+	// Subscription of a user or to a topic which does not exist or is deleted
+	FsckOrphanSub = "orphan-sub"
+	// Group topic or channel without an owner
+	FsckNoOwner = "no-owner"
+	// Messages which should have been deleted by clearing the topic
+	FsckClearedMessages = "cleared-messages"
+	// Unique tag record of a user which does not exist, is deleted or no longer has the tag
+	FsckDanglingTag = "dangling-tag"
+	// Authentication record of a user which does not exist or is deleted
+	FsckDanglingAuth = "dangling-auth"
+)
+
+// FsckIssue is an inconsistency found in the store by the checker.
+type FsckIssue struct {
+	// One of the Fsck* kinds
+	Kind string
+	// ID of the inconsistent record
+	Object string
+	// Human-readable description of the problem
+	Detail string
+	// The problem was fixed
+	Repaired bool
+}
@@ -0,0 +1,235 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Templates of group topics and channels defined by the server admin in
+ *  the config. A topic is created from a template in one call:
+ *    {sub topic="new" template="course" set={desc={public: {...}}}}
+ *  The template gives the topic:
+ *    - default access, unless the request sets it;
+ *    - public, unless the request sets it;
+ *    - tags, stored with the topic and reported in {meta desc};
+ *    - bots subscribed to the topic with the given access;
+ *    - a welcome message posted by the creator or one of the bots and
+ *      pinned.
+ *  The bots are told about the subscription as if they were invited. If
+ *  adding the bots or the welcome message fails, the topic is created
+ *  without them.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of tags of a topic template
+	TEMPLATE_MAX_TAGS = 16
+	// Access given to bots of a topic template by default
+	TEMPLATE_DEFAULT_BOT_MODE = "JRWP"
+)
+
+type templateBotConfig struct {
+	// ID of the bot user
+	User string `json:"user"`
+	// Access mode given to the bot, TEMPLATE_DEFAULT_BOT_MODE if empty
+	Mode string `json:"mode"`
+}
+
+type templateWelcomeConfig struct {
+	// Sender of the message, the creator of the topic if empty, otherwise one of the template's bots
+	From    string            `json:"from"`
+	Head    map[string]string `json:"head"`
+	Content interface{}       `json:"content"`
+}
+
+type topicTemplateConfig struct {
+	DefaultAcs *MsgDefaultAcsMode     `json:"default_acs"`
+	Public     interface{}            `json:"public"`
+	Tags       []string               `json:"tags"`
+	Bots       []templateBotConfig    `json:"bots"`
+	Welcome    *templateWelcomeConfig `json:"welcome"`
+}
+
+// Parsed template
+type topicTemplate struct {
+	// Default access, valid only if hasAccess is true
+	hasAccess  bool
+	accessAuth types.AccessMode
+	accessAnon types.AccessMode
+
+	public interface{}
+	tags   []string
+	// Access of bots by the user ID
+	bots map[types.Uid]types.AccessMode
+
+	welcome *templateWelcomeConfig
+	// Sender of the welcome message, zero for the creator
+	welcomeFrom types.Uid
+}
+
+// Templates by name
+var topicTemplates map[string]*topicTemplate
+
+// topicTemplatesInit parses config. There are no templates by default.
+func topicTemplatesInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config map[string]topicTemplateConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse topic_templates config:", err)
+	}
+
+	topicTemplates = make(map[string]*topicTemplate, len(config))
+	for name, conf := range config {
+		tmpl := &topicTemplate{public: conf.Public, welcome: conf.Welcome}
+
+		if conf.DefaultAcs != nil {
+			auth, anon, err := parseTopicAccess(conf.DefaultAcs, getDefaultAccess(types.TopicCat_Grp, true),
+				getDefaultAccess(types.TopicCat_Grp, false))
+			if err != nil || auth.IsOwner() || anon.IsOwner() {
+				logMain.Fatal("topic_templates: invalid default access of '" + name + "'")
+			}
+			tmpl.hasAccess, tmpl.accessAuth, tmpl.accessAnon = true, auth, anon
+		}
+
+		if len(conf.Tags) > TEMPLATE_MAX_TAGS {
+			logMain.Fatalf("topic_templates: '%s' has more than %d tags", name, TEMPLATE_MAX_TAGS)
+		}
+		tmpl.tags = conf.Tags
+
+		tmpl.bots = make(map[types.Uid]types.AccessMode, len(conf.Bots))
+		for _, bot := range conf.Bots {
+			uid := types.ParseUserId(bot.User)
+			if uid.IsZero() {
+				logMain.Fatal("topic_templates: invalid bot '" + bot.User + "' of '" + name + "'")
+			}
+			if bot.Mode == "" {
+				bot.Mode = TEMPLATE_DEFAULT_BOT_MODE
+			}
+			var mode types.AccessMode
+			if err := mode.UnmarshalText([]byte(bot.Mode)); err != nil || mode.IsOwner() || !mode.IsJoiner() {
+				logMain.Fatal("topic_templates: invalid access of bot '" + bot.User + "' of '" + name + "'")
+			}
+			tmpl.bots[uid] = mode
+		}
+
+		if conf.Welcome != nil && conf.Welcome.From != "" {
+			tmpl.welcomeFrom = types.ParseUserId(conf.Welcome.From)
+			if _, ok := tmpl.bots[tmpl.welcomeFrom]; !ok {
+				logMain.Fatal("topic_templates: sender of the welcome message of '" + name + "' is not its bot")
+			}
+		}
+
+		topicTemplates[name] = tmpl
+	}
+
+	logMain.Infof("Topic templates: %d", len(topicTemplates))
+}
+
+// topicTemplateGet returns the template by name. Returns nil and true if no template is requested, false
+// if the template is not found.
+func topicTemplateGet(name string) (*topicTemplate, bool) {
+	if name == "" {
+		return nil, true
+	}
+	tmpl, ok := topicTemplates[name]
+	return tmpl, ok
+}
+
+// applyDefaults sets parameters of the new topic from the template. They may be overridden by the request.
+func (tmpl *topicTemplate) applyDefaults(t *Topic) {
+	if tmpl.hasAccess {
+		t.accessAuth, t.accessAnon = tmpl.accessAuth, tmpl.accessAnon
+	}
+	if tmpl.public != nil {
+		t.public = tmpl.public
+	}
+	t.tags = tmpl.tags
+}
+
+// install subscribes the template's bots to the topic just saved and posts the welcome message.
+func (tmpl *topicTemplate) install(t *Topic) {
+	var subs []*types.Subscription
+	for uid, mode := range tmpl.bots {
+		if uid == t.owner {
+			continue
+		}
+		subs = append(subs, &types.Subscription{
+			User:      uid.String(),
+			Topic:     t.name,
+			ModeWant:  mode,
+			ModeGiven: mode})
+	}
+	if len(subs) > 0 {
+		if err := store.Subs.Create(subs...); err != nil {
+			logHub.Warnf("hub: failed to add bots to topic '%s': %v", t.name, err)
+		} else {
+			for _, sub := range subs {
+				t.perUser[types.ParseUid(sub.User)] = perUserData{modeGiven: sub.ModeGiven, modeWant: sub.ModeWant}
+			}
+		}
+	}
+
+	if tmpl.welcome == nil {
+		return
+	}
+	from := t.owner
+	if !tmpl.welcomeFrom.IsZero() {
+		if _, ok := t.perUser[tmpl.welcomeFrom]; !ok {
+			// The bot was not added
+			return
+		}
+		from = tmpl.welcomeFrom
+	}
+	msg := &types.Message{
+		SeqId:   t.lastId + 1,
+		Topic:   t.name,
+		From:    from.String(),
+		Head:    tmpl.welcome.Head,
+		Content: tmpl.welcome.Content}
+	var chainHead string
+	if historyChain.enabled {
+		var err error
+		if chainHead, err = t.chainLink(msg); err != nil {
+			logHub.Warnf("hub: failed to chain welcome message in topic '%s': %v", t.name, err)
+			return
+		}
+	}
+	if err := store.Messages.Save(msg); err != nil {
+		logHub.Warnf("hub: failed to post welcome message to topic '%s': %v", t.name, err)
+		return
+	}
+	t.lastId = msg.SeqId
+	if historyChain.enabled {
+		t.chainHead = chainHead
+	}
+	searchIndex(msg)
+
+	pinned := []int{msg.SeqId}
+	if err := store.Topics.Update(t.name, map[string]interface{}{"Pinned": pinned}); err != nil {
+		logHub.Warnf("hub: failed to pin welcome message in topic '%s': %v", t.name, err)
+		return
+	}
+	t.pinned = pinned
+}
+
+// templateMembersAdded tells members other than the creator that they were subscribed to the new topic.
+func (t *Topic) templateMembersAdded(creator types.Uid) {
+	for uid, pud := range t.perUser {
+		if uid == creator {
+			continue
+		}
+		t.presSingleUserOffline(uid, "acs", &PresParams{
+			dWant:  types.ModeNone.Delta(pud.modeWant),
+			dGiven: types.ModeNone.Delta(pud.modeGiven),
+			actor:  creator.UserId()}, "", false)
+	}
+}
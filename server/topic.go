@@ -9,7 +9,6 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"log"
 	"strings"
@@ -70,6 +69,44 @@ type Topic struct {
 	// Topic's public data
 	public interface{}
 
+	// Topic history is published read-only on the web (group topics only)
+	webView bool
+	// Published history may be indexed by search engines
+	webIndex bool
+	// Period of digests posted into the topic (group topics only)
+	digest string
+	// Webhook registered by the owner (group topics only)
+	webhook *types.TopicWebhook
+	// IDs of pinned messages
+	pinned []int
+	// Hash of the last message when the history is chained, valid if chainLoaded is true
+	chainHead   string
+	chainLoaded bool
+	// Tags given by the template (grp and chn topics only)
+	tags []string
+	// Reference to the entity of an external system (grp topics only)
+	externalRef string
+	// Users banned from the topic (grp and chn topics only)
+	banned map[types.Uid]bool
+	// 'me': users blocked by the user; p2p: participants blocked by the other participant
+	blocked map[types.Uid]bool
+	// 'me': who sees the user's presence
+	privacy types.PresencePrivacy
+	// 'me': accepted contacts of the user
+	contacts map[types.Uid]bool
+	// Generation of invite links, links of earlier generations are revoked (grp and chn topics only)
+	inviteGen int
+	// Member the ownership is offered to, zero if none (grp and chn topics only)
+	transferTo types.Uid
+	// Messages are deleted this many seconds after they were sent, 0 to keep them (grp and p2p topics)
+	ttl int
+	// Maximum number of members set by root, 0 for the default (grp topics only)
+	maxMembers int
+	// Throttling of typing notifications and receipts, nil if not throttled
+	notes *topicNotes
+	// The oldest message returned by history queries limited by age
+	historyFloor historyFloor
+
 	// Topic's per-subscriber data
 	perUser map[types.Uid]perUserData
 	// User's contact list (not nil for 'me' topic only).
@@ -117,6 +154,8 @@ type perUserData struct {
 	clearId int
 
 	private interface{}
+	// Preferences of push notifications
+	notify *types.NotifyPrefs
 
 	modeWant  types.AccessMode
 	modeGiven types.AccessMode
@@ -141,6 +180,8 @@ type sessionLeave struct {
 	topic string
 	// ID of originating request, if any
 	reqId string
+	// Idle session is detached quietly
+	hibernate *hibernatedTopic
 }
 
 const (
@@ -167,7 +208,9 @@ var nilPresParams = &PresParams{}
 
 func (t *Topic) run(hub *Hub) {
 
-	log.Printf("Topic started: '%s'", t.name)
+	logTopic.Debugf("Topic started: '%s'", t.name)
+	topicStarted(t)
+	defer topicExited(t)
 
 	keepAlive := TOPICTIMEOUT // TODO(gene): read keepalive value from the command line
 	killTimer := time.NewTimer(time.Hour)
@@ -179,6 +222,10 @@ func (t *Topic) run(hub *Hub) {
 	uaTimer = time.NewTimer(time.Minute)
 	uaTimer.Stop()
 
+	// Group topics only
+	t.notes = newTopicNotes(t.cat)
+	defer t.notes.stop()
+
 	for {
 		select {
 		case sreg := <-t.reg:
@@ -190,7 +237,13 @@ func (t *Topic) run(hub *Hub) {
 				// The topic is alive, so stop the kill timer, if it's ticking. We don't want the topic to die
 				// while processing the call
 				killTimer.Stop()
-				if err := t.handleSubscription(hub, sreg); err == nil {
+				var err error
+				if sreg.resume != nil {
+					err = t.resumeSession(sreg)
+				} else {
+					err = t.handleSubscription(hub, sreg)
+				}
+				if err == nil {
 					// give a broadcast channel to the connection (.read)
 					// give channel to use when shutting down (.done)
 					sreg.sess.subs[t.name] = &Subscription{
@@ -206,22 +259,36 @@ func (t *Topic) run(hub *Hub) {
 					killTimer.Reset(keepAlive)
 				}
 			}
+			if sreg.resumed != nil {
+				sreg.resumed <- true
+			}
+			topicResized(t)
 
 		case leave := <-t.unreg:
 			// Remove connection from topic; session may continue to function
 			now := types.TimeNow()
 
-			if t.isSuspended() {
+			if leave.hibernate != nil {
+				t.hibernateSession(leave.sess, leave.hibernate)
+
+			} else if t.isSuspended() {
 				leave.sess.queueOut(ErrLocked(leave.reqId, t.original(leave.sess.uid), now))
 				continue
 
 			} else if leave.unsub {
 				// User wants to leave and unsubscribe.
 				if err := t.replyLeaveUnsub(hub, leave.sess, leave.reqId); err != nil {
-					log.Println("failed to unsub", err)
+					logTopic.Warn("failed to unsub", err)
 					continue
 				}
 
+			} else if !t.sessions[leave.sess] {
+				// The session was detached already: it was stuck and left at the same time or
+				// it was stuck and the detaching was requested more than once
+				if leave.reqId != "" {
+					leave.sess.queueOut(NoErr(leave.reqId, t.original(leave.sess.uid), now))
+				}
+
 			} else {
 				// Just leaving the topic without unsubscribing
 				delete(t.sessions, leave.sess)
@@ -241,8 +308,8 @@ func (t *Topic) run(hub *Hub) {
 						}
 					}
 					// Update user's last online timestamp & user agent
-					if err := store.Users.UpdateLastSeen(mrs.uid, mrs.userAgent, now); err != nil {
-						log.Println(err)
+					if err := lastSeenUpdate(mrs.uid, mrs.userAgent, now); err != nil {
+						logTopic.Warn(err)
 					}
 				} else if t.cat == types.TopicCat_Grp && pud.online == 0 {
 					// User is going offline: notify online subscribers on 'me'
@@ -261,71 +328,75 @@ func (t *Topic) run(hub *Hub) {
 			if len(t.sessions) == 0 {
 				killTimer.Reset(keepAlive)
 			}
+			topicResized(t)
 
 		case msg := <-t.broadcast:
 			// Content message intended for broadcasting to recepients
 
-			var pushRcpt *pushReceipt
-
 			if msg.Data != nil {
+				// Validation, persistence and delivery of {data} are done by the publishing pipeline
+				t.publish(msg)
+				continue
+			}
+
+			if msg.Pres != nil {
+
+				t.presProcReq(msg.Pres.Src, msg.Pres.What, msg.Pres.wantReply)
+				if msg.Pres.What == "contact" {
+					t.contactsChanged()
+				}
+				if t.x_original != msg.Pres.Topic || strings.HasPrefix(msg.Pres.What, "?") {
+					// This is just a request for status, don't forward it to sessions
+					continue
+				}
+				if msg.Pres.What == "contact" && t.blocked[types.ParseUserId(msg.Pres.Src)] {
+					// Contact requests from blocked users are not shown
+					continue
+				}
+			} else if msg.Info != nil {
 				if t.isSuspended() {
-					if msg.sessFrom != nil {
-						msg.sessFrom.queueOut(ErrLocked(msg.id, t.original(msg.sessFrom.uid), msg.timestamp))
-					}
+					// Ignore info messages - topic is being deleted
 					continue
 				}
 
-				from := types.ParseUserId(msg.Data.From)
-				userData := t.perUser[from]
-
-				// msg.sessFrom is not nil when the message originated at the client.
-				// for internally generated messages the akn is nil
-				if msg.sessFrom != nil {
-					if !(userData.modeWant & userData.modeGiven).IsWriter() {
-						msg.sessFrom.queueOut(ErrPermissionDenied(msg.id, t.original(msg.sessFrom.uid),
-							msg.timestamp))
-						continue
-					}
+				if msg.Info.What == "expire" {
+					// Internal request to delete expired messages, not broadcast
+					t.expireMessages(msg.Info.SeqId)
+					continue
 				}
 
-				if err := store.Messages.Save(&types.Message{
-					ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
-					SeqId:     t.lastId + 1,
-					Topic:     t.name,
-					From:      from.String(),
-					Head:      msg.Data.Head,
-					Content:   msg.Data.Content}); err != nil {
-
-					log.Printf("topic[%s]: failed to save message: %v", t.name, err)
-					msg.sessFrom.queueOut(ErrUnknown(msg.id, t.original(msg.sessFrom.uid), msg.timestamp))
-
+				if msg.Info.What == "block" || msg.Info.What == "unblock" {
+					// Internal notice of a change of a participant's block list, not broadcast
+					t.p2pBlockChange(types.ParseUserId(msg.Info.From), msg.Info.What == "block")
 					continue
 				}
 
-				t.lastId++
-				msg.Data.SeqId = t.lastId
-
-				if msg.id != "" {
-					reply := NoErrAccepted(msg.id, t.original(msg.sessFrom.uid), msg.timestamp)
-					reply.Ctrl.Params = map[string]int{"seq": t.lastId}
-					msg.sessFrom.queueOut(reply)
+				if msg.Info.What == "unsub" {
+					// Internal notice that the user left the topic by a bulk request, not broadcast
+					if uid := types.ParseUserId(msg.Info.From); t.owner != uid {
+						if _, ok := t.perUser[uid]; ok {
+							t.evictUser(uid, true, "")
+						}
+					}
+					continue
 				}
 
-				pushRcpt = t.makePushReceipt(msg.Data)
-
-				// Message sent: notify offline 'R' subscrbers on 'me'
-				t.presSubsOffline("msg", &PresParams{seqId: t.lastId}, types.ModeRead, "", true)
-
-			} else if msg.Pres != nil {
+				if msg.Info.What == "provision" {
+					// Internal notice that the topic was changed by provisioning, not broadcast
+					t.provisionReload()
+					continue
+				}
 
-				t.presProcReq(msg.Pres.Src, msg.Pres.What, msg.Pres.wantReply)
-				if t.x_original != msg.Pres.Topic || strings.HasPrefix(msg.Pres.What, "?") {
-					// This is just a request for status, don't forward it to sessions
+				if msg.Info.What == "uncontact" {
+					// Internal notice that the other user removed the contact, not broadcast
+					if t.cat == types.TopicCat_Me {
+						t.contactRemoved(types.ParseUserId(msg.Info.From))
+					}
 					continue
 				}
-			} else if msg.Info != nil {
-				if t.isSuspended() {
-					// Ignore info messages - topic is being deleted
+
+				if t.shedNote(msg.Info.What) {
+					// The topic is overloaded
 					continue
 				}
 
@@ -341,6 +412,14 @@ func (t *Topic) run(hub *Hub) {
 				if msg.Info.What == "kp" && !(pud.modeGiven & pud.modeWant).IsWriter() {
 					continue
 				}
+				if msg.Info.What == "kp" && !t.notes.typingAllowed(uid, msg.timestamp) {
+					// The user's typing was reported recently
+					continue
+				}
+				if msg.Info.What == "kp" && t.blocksPeer(uid) {
+					// The blocked user does not see the blocker's activity
+					continue
+				}
 
 				if msg.Info.What == "read" || msg.Info.What == "recv" {
 					// Filter out "read/recv" from users with no 'R' permission
@@ -371,12 +450,9 @@ func (t *Topic) run(hub *Hub) {
 						recv = pud.recvId
 					}
 
-					if err := store.Subs.Update(t.name, uid,
-						map[string]interface{}{
-							"RecvSeqId": pud.recvId,
-							"ReadSeqId": pud.readId}); err != nil {
+					if err := markersUpdate(t.name, uid, pud.recvId, pud.readId); err != nil {
 
-						log.Printf("topic[%s]: failed to update SeqRead/Recv counter: %v", t.name, err)
+						logTopic.Errorf("topic[%s]: failed to update SeqRead/Recv counter: %v", t.name, err)
 						continue
 					}
 
@@ -384,76 +460,55 @@ func (t *Topic) run(hub *Hub) {
 					t.presPubMessageCount(uid, nil, 0, recv, read, msg.skipSid)
 
 					t.perUser[uid] = pud
-				}
-			}
-
-			// Broadcast the message. Only {data}, {pres}, {info} are broadcastable.
-			// {meta} and {ctrl} are sent to the session only
-			if msg.Data != nil || msg.Pres != nil || msg.Info != nil {
-
-				var packet []byte
-				if t.cat != types.TopicCat_P2P {
-					packet, _ = json.Marshal(msg)
-				}
 
-				for sess := range t.sessions {
-					if sess.sid == msg.skipSid {
+					if t.blocksPeer(uid) {
+						// Receipts would tell the blocked user that the blocker is online
 						continue
 					}
-
-					if msg.Pres != nil {
-						// Skip notifying - already notified on topic.
-						if msg.Pres.skipTopic != "" && sess.subs[msg.Pres.skipTopic] != nil {
-							continue
-						}
-
-						// Check presence filters
-						pud, _ := t.perUser[sess.uid]
-						if !(pud.modeGiven & pud.modeWant).IsPresencer() ||
-							(msg.Pres.filter != 0 && int(pud.modeGiven&pud.modeWant)&msg.Pres.filter == 0) {
-							continue
-						}
-					} else {
-						// Check if the user has Read permission
-						pud, _ := t.perUser[sess.uid]
-						if !(pud.modeGiven & pud.modeWant).IsReader() {
-							continue
-						}
+					if t.cat == types.TopicCat_Chn {
+						// Readers of a channel don't see each other's receipts
+						continue
 					}
-
-					if t.cat == types.TopicCat_P2P {
-						// For p2p topics topic name is dependent on receiver
-						if msg.Data != nil {
-							msg.Data.Topic = t.original(sess.uid)
-						} else if msg.Pres != nil {
-							msg.Pres.Topic = t.original(sess.uid)
-						} else if msg.Info != nil {
-							msg.Info.Topic = t.original(sess.uid)
-						}
-						packet, _ = json.Marshal(msg)
+					if t.notes.deferReceipt(uid, msg) {
+						// Broadcast with receipts of other users later
+						continue
 					}
-
-					select {
-					case sess.send <- packet:
-						// Update device map with the device ID which should recive the notification
-						if pushRcpt != nil {
-							if i, ok := pushRcpt.uidMap[sess.uid]; ok {
-								pushRcpt.rcpt.To[i].Delieved++
-								if sess.deviceId != "" {
-									pushRcpt.rcpt.To[i].Devices = append(pushRcpt.rcpt.To[i].Devices, sess.deviceId)
-								}
-							}
-						}
-					default:
-						log.Printf("topic[%s]: connection stuck, detaching", t.name)
-						t.unreg <- &sessionLeave{sess: sess, unsub: false}
+				} else if msg.Info.What == "check" {
+					// Persist the new state of the item; skip broadcasting if nothing has changed
+					if !t.checklistToggle(uid, msg.Info) {
+						continue
+					}
+				} else if msg.Info.What == "rsvp" {
+					// Persist the response and update the counts
+					if !t.eventRsvp(uid, msg.Info) {
+						continue
+					}
+				} else if msg.Info.What == "card" {
+					// Interactions are sent to the author of the card only
+					t.cardInteract(uid, msg.Info)
+					continue
+				} else if msg.Info.What == "edit" {
+					// Persist the new content of the card; skip broadcasting if the edit is rejected
+					if !t.cardEdit(uid, msg.Info) {
+						continue
+					}
+				} else if msg.Info.What == "react" || msg.Info.What == "unreact" {
+					// Persist the reaction and update the counts
+					if !t.messageReact(uid, msg.Info) {
+						continue
+					}
+				} else if msg.Info.What == "pin" || msg.Info.What == "unpin" {
+					// Persist the list of pinned messages
+					if !t.messagePin(uid, msg.Info, msg.skipSid) {
+						continue
 					}
 				}
+			}
 
-				if pushRcpt != nil {
-					push.Push(pushRcpt.rcpt)
-				}
-
+			// Broadcast the message. Only {data}, {pres}, {info} are broadcastable.
+			// {meta} and {ctrl} are sent to the session only
+			if msg.Pres != nil || msg.Info != nil {
+				t.fanOut(msg, nil)
 			} else {
 				// TODO(gene): remove this
 				log.Panic("topic[%s]: wrong message type for broadcasting", t.name)
@@ -474,6 +529,15 @@ func (t *Topic) run(hub *Hub) {
 				if meta.what&constMsgMetaData != 0 {
 					t.replyGetData(meta.sess, meta.pkt.Get.Id, meta.pkt.Get.Data)
 				}
+				if meta.what&constMsgMetaProfiles != 0 {
+					t.replyGetProfiles(meta.sess, meta.pkt.Get.Id, meta.pkt.Get.Profiles)
+				}
+				if meta.what&constMsgMetaSessions != 0 {
+					t.replyGetSessions(meta.sess, meta.pkt.Get.Id)
+				}
+				if meta.what&constMsgMetaContacts != 0 {
+					t.replyGetContacts(meta.sess, meta.pkt.Get.Id)
+				}
 			} else if meta.pkt.Set != nil {
 				// Set request
 				if meta.what&constMsgMetaDesc != 0 {
@@ -482,6 +546,33 @@ func (t *Topic) run(hub *Hub) {
 				if meta.what&constMsgMetaSub != 0 {
 					t.replySetSub(hub, meta.sess, meta.pkt.Set)
 				}
+				if meta.what&constMsgMetaRemind != 0 {
+					t.replySetRemind(meta.sess, meta.pkt.Set)
+				}
+				if meta.what&constMsgMetaAction != 0 {
+					t.replySetAction(meta.sess, meta.pkt.Set)
+				}
+				if meta.what&constMsgMetaNotify != 0 {
+					t.replySetNotify(meta.sess, meta.pkt.Set)
+				}
+				if meta.what&constMsgMetaInvite != 0 {
+					t.replySetInvite(meta.sess, meta.pkt.Set)
+				}
+				if meta.what&constMsgMetaTransfer != 0 {
+					t.replySetTransfer(meta.sess, meta.pkt.Set)
+				}
+				if meta.what&constMsgMetaImpersonate != 0 {
+					t.replySetImpersonate(meta.sess, meta.pkt.Set)
+				}
+				if meta.what&constMsgMetaBlock != 0 {
+					t.replySetBlock(meta.sess, meta.pkt.Set)
+				}
+				if meta.what&constMsgMetaContact != 0 {
+					t.replySetContact(meta.sess, meta.pkt.Set)
+				}
+				if meta.what&constMsgMetaPrivacy != 0 {
+					t.replySetPrivacy(meta.sess, meta.pkt.Set)
+				}
 
 			} else if meta.pkt.Del != nil {
 				// Del request
@@ -494,6 +585,7 @@ func (t *Topic) run(hub *Hub) {
 					t.replyDelTopic(hub, meta.sess, meta.pkt.Del)
 				}
 			}
+			topicResized(t)
 		case ua := <-t.uaChange:
 			// process an update to user agent from one of the sessions
 			currentUA = ua
@@ -507,6 +599,10 @@ func (t *Topic) run(hub *Hub) {
 			t.userAgent = currentUA
 			t.presUsersOfInterest("ua", t.userAgent)
 
+		case <-t.notes.flushC():
+			// Broadcast receipts collected since the last flush
+			t.notesFlush()
+
 		case <-killTimer.C:
 			// Topic timeout
 			hub.unreg <- &topicUnreg{topic: t.name}
@@ -519,6 +615,14 @@ func (t *Topic) run(hub *Hub) {
 			return
 
 		case sd := <-t.exit:
+			if (sd.reason == StopShutdown || sd.reason == StopRehashing) && len(t.broadcast) > 0 {
+				// Save and deliver pending messages first
+				go func() {
+					t.exit <- sd
+				}()
+				continue
+			}
+
 			// Handle four cases:
 			// 1. Topic is shutting down by timer due to inactivity (reason == StopNone)
 			// 2. Topic is being deleted (reason == StopDeleted)
@@ -526,17 +630,27 @@ func (t *Topic) run(hub *Hub) {
 			// 4. Cluster rehashing (reason == StopRehashing)
 			// FIXME(gene): save lastMessage value;
 
-			if t.cat == types.TopicCat_Grp && sd.reason == StopDeleted {
+			if (t.cat == types.TopicCat_Grp || t.cat == types.TopicCat_Chn) && sd.reason == StopDeleted {
 				t.presSubsOffline("gone", nilPresParams, 0, "", false)
 				// Not publishing online/offline to deleted P2P topics
 			} else if sd.reason == StopRehashing {
 				// Must send individual messages to sessions because normal sending through the topic's
 				// broadcast channel won't work - it will be shut down too soon.
-				t.presSubsOnlineDirect("term")
+				// Sessions of other nodes are attached again by their nodes if this node is believed dead.
+				t.presSubsOnlineDirect("term", globals.cluster.failedOver())
 			}
 
 			// In case of a system shutdown don't bother with notifications. They won't be delivered anyway.
 
+			// Save read/recv markers before the topic is loaded again, possibly by another node
+			markersFlushTopic(t.name)
+
+			if sd.reason == StopRehashing {
+				// Messages received while the topic was stopping can go to the new master now
+				t.handoffDrain()
+				handoffStopped(t.name)
+			}
+
 			// Report completion back to sender, if 'done' is not nil.
 			if sd.done != nil {
 				sd.done <- true
@@ -562,11 +676,11 @@ func (t *Topic) handleSubscription(h *Hub, sreg *sessionJoin) error {
 		// Notify user's contact that the given user is online now.
 		if t.cat == types.TopicCat_Me {
 			if err := t.loadContacts(sreg.sess.uid); err != nil {
-				log.Println("topic: failed to load contacts", t.name, err.Error())
+				logTopic.Warn("topic: failed to load contacts", t.name, err.Error())
 			}
 			// User online: notify users of interest
 			t.presUsersOfInterest("on", sreg.sess.userAgent)
-		} else if t.cat == types.TopicCat_Grp || t.cat == types.TopicCat_P2P {
+		} else if t.cat == types.TopicCat_Grp || t.cat == types.TopicCat_Chn || t.cat == types.TopicCat_P2P {
 			if sreg.created {
 				// Notify creator's other sessions that the topic was created.
 				t.presSingleUserOffline(sreg.sess.uid, "acs",
@@ -576,6 +690,11 @@ func (t *Topic) handleSubscription(h *Hub, sreg *sessionJoin) error {
 						actor:  "me"},
 					sreg.sess.sid, false)
 
+				if t.cat != types.TopicCat_P2P {
+					// Tell the bots added by the topic template
+					t.templateMembersAdded(sreg.sess.uid)
+				}
+
 				// Special handling of a P2P topic - notifying the other
 				// participant.
 				if t.cat == types.TopicCat_P2P {
@@ -630,13 +749,18 @@ func (t *Topic) subCommonReply(h *Hub, sreg *sessionJoin, sendDesc bool) error {
 
 	// The topic is already initialized by the Hub
 
+	if state, reason := userStateOf(sreg.sess.uid); state != types.UserStateActive {
+		sreg.sess.queueOut(ErrAccountState(sreg.pkt.Id, t.original(sreg.sess.uid), now, state, reason))
+		return errors.New("account is not active")
+	}
+
 	var private interface{}
 	var mode string
 
 	if sreg.pkt.Set != nil {
 		if sreg.pkt.Set.Sub != nil {
 			if sreg.pkt.Set.Sub.User != "" {
-				log.Println("subCommonReply: UID in request, msg.Sub.Sub.User=", sreg.pkt.Set.Sub.User)
+				logTopic.Debug("subCommonReply: UID in request, msg.Sub.Sub.User=", sreg.pkt.Set.Sub.User)
 				sreg.sess.queueOut(ErrMalformed(sreg.pkt.Id, t.original(sreg.sess.uid), now))
 				return errors.New("user id must not be specified")
 			}
@@ -649,9 +773,19 @@ func (t *Topic) subCommonReply(h *Hub, sreg *sessionJoin, sendDesc bool) error {
 		}
 	}
 
+	// Access mode given by the invite link
+	invited := types.ModeUnset
+	if sreg.pkt.Invite != "" {
+		var err error
+		if invited, err = t.inviteMode(sreg.pkt.Invite, now); err != nil {
+			sreg.sess.queueOut(ErrPermissionDenied(sreg.pkt.Id, t.original(sreg.sess.uid), now))
+			return err
+		}
+	}
+
 	// Create new subscription or modify an existing one.
-	if err := t.requestSub(h, sreg.sess, sreg.pkt.Id, mode, private); err != nil {
-		log.Println("requestSub failed: ", err.Error())
+	if err := t.requestSub(h, sreg.sess, sreg.pkt.Id, mode, invited, private); err != nil {
+		logTopic.Warn("requestSub failed:", err.Error())
 		return err
 	}
 
@@ -685,6 +819,7 @@ func (t *Topic) subCommonReply(h *Hub, sreg *sessionJoin, sendDesc bool) error {
 //	sess 	- originating session
 //  pktId 	- originating packet Id
 //	want	- requested access mode
+//	invited	- access mode given by an invite link or ModeUnset
 //	info 	- explanation info given by the requester
 //	private	- private value to assign to the subscription
 // Handle these cases:
@@ -693,7 +828,7 @@ func (t *Topic) subCommonReply(h *Hub, sreg *sessionJoin, sendDesc bool) error {
 // C. User is responsing to an earlier invite (modeWant was "N" in subscription)
 // D. User is already subscribed, changing modeWant
 // E. User is accepting ownership transfer (requesting ownership transfer is not permitted)
-func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
+func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string, invited types.AccessMode,
 	private interface{}) error {
 
 	now := types.TimeNow()
@@ -702,18 +837,28 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
 	oldWant := types.ModeNone
 	oldGiven := types.ModeNone
 
-	log.Println("requestSub", t.name, "'", want, "'")
+	logTopic.Debug("requestSub", t.name, "'", want, "'")
 
 	// Parse access mode requested by the user
 	modeWant := types.ModeUnset
 	if want != "" {
 		if err := modeWant.UnmarshalText([]byte(want)); err != nil {
-			log.Println(err.Error())
+			logTopic.Warn(err.Error())
 			sess.queueOut(ErrMalformed(pktId, t.original(sess.uid), now))
 			return err
 		}
 	}
 
+	if !sess.impersonator.IsZero() && t.cat != types.TopicCat_Me && t.cat != types.TopicCat_Fnd {
+		// Impersonated sessions may only join topics the user is subscribed to, without changes
+		if _, ok := t.perUser[sess.uid]; !ok || want != "" || invited != types.ModeUnset || private != nil {
+			logAudit.Infof("impersonation: sess[%s] of %s by %s denied subscription to '%s'", sess.sid,
+				sess.uid.UserId(), sess.impersonator.UserId(), t.name)
+			sess.queueOut(ErrPermissionDenied(pktId, t.original(sess.uid), now))
+			return errors.New("impersonated session cannot change subscriptions")
+		}
+	}
+
 	// Check if it's an attempt at a new subscription to the topic.
 	// It could be an actual subscription (IsJoiner() == true) or a ban (IsJoiner() == false)
 	userData, existingSub := t.perUser[sess.uid]
@@ -727,7 +872,7 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
 			// t.perUser contains just one element - the other user
 			for uid2, user2Data := range t.perUser {
 				if user2, err := store.Users.Get(uid2); err != nil {
-					log.Println(err.Error())
+					logTopic.Warn(err.Error())
 					sess.queueOut(ErrUnknown(pktId, t.original(sess.uid), now))
 					return err
 				} else if user2 == nil {
@@ -750,13 +895,30 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
 
 			// Make sure the user is not asking for unreasonable permissions
 			userData.modeWant = (userData.modeWant & types.ModeCP2P) | types.ModeApprove
+
+			if t.blocked[sess.uid] {
+				sess.queueOut(ErrPermissionDenied(pktId, t.original(sess.uid), now))
+				return errors.New("user is blocked by the other participant")
+			}
 		} else {
-			// For non-p2p2 topics access is given as default access
+			if t.isBanned(sess.uid) {
+				sess.queueOut(ErrPermissionDenied(pktId, t.original(sess.uid), now))
+				return errors.New("user is banned from the topic")
+			}
+			if limit, full := t.isFull(); full {
+				sess.queueOut(ErrTopicFull(pktId, t.original(sess.uid), now, limit))
+				return errors.New("topic is full")
+			}
+
+			// For non-p2p2 topics access is given as default access or by the invite link
 			userData.modeGiven = t.accessFor(sess.authLvl)
+			if invited != types.ModeUnset {
+				userData.modeGiven = invited
+			}
 
 			if modeWant == types.ModeUnset {
-				// User wants default access mode.
-				userData.modeWant = t.accessFor(sess.authLvl)
+				// User wants the access mode given.
+				userData.modeWant = userData.modeGiven
 			} else {
 				userData.modeWant = modeWant
 			}
@@ -772,7 +934,7 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
 		}
 
 		if err := store.Subs.Create(sub); err != nil {
-			log.Println(err.Error())
+			logTopic.Warn(err.Error())
 			sess.queueOut(ErrUnknown(pktId, t.original(sess.uid), now))
 			return err
 		}
@@ -798,7 +960,7 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
 
 				// Make sure the current owner cannot unset the owner flag or ban himself
 				if t.owner == sess.uid && !modeWant.IsOwner() {
-					log.Println("requestSub: owner attempts to unset the owner flag")
+					logTopic.Debug("requestSub: owner attempts to unset the owner flag")
 					sess.queueOut(ErrPermissionDenied(pktId, t.original(sess.uid), now))
 					return errors.New("cannot unset ownership")
 				}
@@ -874,6 +1036,12 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
 
 	t.perUser[sess.uid] = userData
 
+	if !existingSub {
+		t.webhookMember(sess.uid, "join", userData)
+	} else if userData.modeWant != oldWant || userData.modeGiven != oldGiven {
+		t.webhookMember(sess.uid, "acs", userData)
+	}
+
 	// If the user is self-banning himself from the topic, no action is needed.
 	// Re-subscription will unban.
 	if !userData.modeWant.IsJoiner() {
@@ -882,7 +1050,7 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
 		return nil
 	} else if !userData.modeGiven.IsJoiner() {
 		// User was banned
-		log.Println("User is banned", t.name, sess.uid.UserId(), userData.modeGiven.String(), oldGiven.String())
+		logTopic.Warn("User is banned", t.name, sess.uid.UserId(), userData.modeGiven.String(), oldGiven.String())
 
 		sess.queueOut(ErrPermissionDenied(pktId, t.original(sess.uid), now))
 		return errors.New("topic access denied")
@@ -929,7 +1097,7 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktId string, want string,
 // B. Sharer or Approver is re-inviting another user (adjusting modeGiven, modeWant is still Unset)
 // C. Approver is changing modeGiven for another user, modeWant != Unset
 func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClientSet) error {
-	log.Printf("approveSub, session uid=%s, target uid=%s", sess.uid.String(), target.String())
+	logTopic.Debugf("approveSub, session uid=%s, target uid=%s", sess.uid.String(), target.String())
 
 	now := types.TimeNow()
 
@@ -940,8 +1108,9 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 	// Access mode of the person who is executing this approval process
 	var hostMode types.AccessMode
 
-	// Check if approver actually has permission to manage sharing
-	if userData, ok := t.perUser[sess.uid]; !ok || !(userData.modeGiven & userData.modeWant).IsSharer() {
+	// Check if approver actually has permission to manage sharing or is a moderator
+	if userData, ok := t.perUser[sess.uid]; !ok || !(userData.modeGiven & userData.modeWant).IsSharer() &&
+		!(userData.modeGiven & userData.modeWant).IsModerator() {
 		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
 		return errors.New("topic access denied")
 	} else {
@@ -965,23 +1134,63 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 		}
 	}
 
-	// Make sure only the owner & approvers can set non-default access mode
-	if modeGiven != types.ModeUnset && !hostMode.IsAdmin() {
+	// Make sure only the owner & approvers can set non-default access mode. Moderators can only ban.
+	if modeGiven != types.ModeUnset && !hostMode.IsAdmin() &&
+		!(hostMode.IsModerator() && modeGiven == types.ModeNone) {
 		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
 		return errors.New("sharer cannot set explicit modeGiven")
 	}
 
+	// Moderators who are not sharers cannot invite
+	if modeGiven != types.ModeNone && !hostMode.IsSharer() {
+		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
+		return errors.New("moderator cannot invite")
+	}
+
 	// Make sure no one but the owner can do an ownership transfer
 	if modeGiven.IsOwner() && t.owner != sess.uid {
 		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
 		return errors.New("attempt to transfer ownership by non-owner")
 	}
 
+	// Only the owner appoints and dismisses moderators
+	if modeGiven != types.ModeUnset && t.owner != sess.uid &&
+		modeGiven.IsModerator() != t.perUser[target].modeGiven.IsModerator() {
+		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
+		return errors.New("attempt to change moderator permission by non-owner")
+	}
+
+	// Moderators cannot ban admins and other moderators
+	if targetData, ok := t.perUser[target]; ok && !hostMode.IsAdmin() &&
+		((targetData.modeGiven&targetData.modeWant).IsAdmin() || targetData.modeGiven.IsModerator()) {
+		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
+		return errors.New("moderator cannot change access of admins or moderators")
+	}
+
+	// Only admins can lift a ban, by inviting the user with any mode but N
+	if t.isBanned(target) {
+		if !hostMode.IsAdmin() {
+			sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
+			return errors.New("user is banned from the topic")
+		}
+		if modeGiven != types.ModeNone {
+			if err := t.bansSave(target, false); err != nil {
+				sess.queueOut(ErrUnknown(set.Id, t.original(sess.uid), now))
+				return err
+			}
+		}
+	}
+
 	// Check if it's a new invite. If so, save it to database as a subscription.
 	// Saved subscription does not mean the user is allowed to post/read
 	userData, existingSub := t.perUser[target]
 	if !existingSub {
 
+		if limit, full := t.isFull(); full && modeGiven != types.ModeNone {
+			sess.queueOut(ErrTopicFull(set.Id, t.original(sess.uid), now, limit))
+			return errors.New("topic is full")
+		}
+
 		if modeGiven == types.ModeUnset {
 			// Request to use default access mode for the new subscriptions.
 			// Assuming LevelAuth. Approver should use non-default access if that is not suitable.
@@ -996,6 +1205,9 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 		} else if user == nil {
 			sess.queueOut(ErrUserNotFound(set.Id, t.original(sess.uid), now))
 			return errors.New("user not found")
+		} else if !userStateLoaded(user) {
+			sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
+			return errors.New("invited user is not active")
 		} else {
 			modeWant = user.Access.Auth
 		}
@@ -1043,6 +1255,12 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 		}
 	}
 
+	if !existingSub {
+		t.webhookMember(target, "join", userData)
+	} else if userData.modeGiven != oldGiven {
+		t.webhookMember(target, "acs", userData)
+	}
+
 	// The user does not want to be bothered, no further action is needed
 	if !userData.modeWant.IsJoiner() {
 		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
@@ -1121,6 +1339,20 @@ func (t *Topic) replyGetDesc(sess *Session, id, tempName string, opts *MsgGetOpt
 			desc.Private = pud.private
 		}
 
+		if t.cat == types.TopicCat_Grp || t.cat == types.TopicCat_Chn {
+			desc.WebView = t.webView
+			desc.WebIndex = t.webIndex
+			desc.Digest = t.digest
+			desc.MaxMembers = t.memberLimit()
+			if t.owner == sess.uid {
+				desc.Webhook = webhookDesc(t.webhook)
+			}
+		}
+		if t.cat == types.TopicCat_Grp || t.cat == types.TopicCat_Chn || t.cat == types.TopicCat_P2P {
+			desc.Ttl = t.ttl
+		}
+		desc.Tags = t.tags
+
 		// Don't report message IDs to users without Read access.
 		if (pud.modeGiven & pud.modeWant).IsReader() {
 			desc.SeqId = t.lastId
@@ -1129,6 +1361,24 @@ func (t *Topic) replyGetDesc(sess *Session, id, tempName string, opts *MsgGetOpt
 			desc.ClearId = max(pud.clearId, t.clearId)
 			desc.ReadSeqId = max(pud.readId, desc.ClearId)
 			desc.RecvSeqId = max(pud.recvId, pud.readId)
+			desc.Pinned = t.pinned
+			if historyChain.enabled {
+				if err := t.chainLoad(); err != nil {
+					logTopic.Warnf("topic[%s]: failed to load head of history chain: %v", t.name, err)
+				}
+				desc.Chain = t.chainHead
+			}
+		}
+		if mode := pud.modeGiven & pud.modeWant; mode.IsAdmin() || mode.IsModerator() {
+			desc.Banned = t.bannedList()
+		}
+		if mode := pud.modeGiven & pud.modeWant; mode.IsAdmin() {
+			desc.Ref = t.externalRef
+		}
+		desc.Blocked = t.blockedList()
+		desc.Privacy = t.privacyDesc()
+		if !t.transferTo.IsZero() && (sess.uid == t.owner || sess.uid == t.transferTo) {
+			desc.Transfer = t.transferTo.UserId()
 		}
 
 		// When the topic is first created it may have been assigned a temporary name.
@@ -1158,6 +1408,8 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 			return err
 		} else if auth.IsOwner() || anon.IsOwner() {
 			return errors.New("default 'owner' access is not permitted")
+		} else if (auth != types.ModeInvalid && auth.IsModerator()) || (anon != types.ModeInvalid && anon.IsModerator()) {
+			return errors.New("default 'moderator' access is not permitted")
 		} else {
 			access := make(map[string]interface{})
 			if auth != types.ModeInvalid {
@@ -1219,6 +1471,24 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 		if public, ok := upd["Public"]; ok {
 			t.public = public
 		}
+		if webView, ok := upd["WebView"]; ok {
+			t.webView = webView.(bool)
+		}
+		if webIndex, ok := upd["WebIndex"]; ok {
+			t.webIndex = webIndex.(bool)
+		}
+		if digest, ok := upd["Digest"]; ok {
+			t.digest = digest.(string)
+		}
+		if ttl, ok := upd["MessageTtl"]; ok {
+			t.ttl = ttl.(int)
+		}
+		if maxMembers, ok := upd["MaxMembers"]; ok {
+			t.maxMembers = maxMembers.(int)
+		}
+		if webhook, ok := upd["Webhook"]; ok {
+			t.webhook = webhook.(*types.TopicWebhook)
+		}
 	}
 
 	var err error
@@ -1249,25 +1519,86 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 				}
 			}
 		} else if t.cat == types.TopicCat_P2P {
-			// Reject direct changes to P2P topics.
-			sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
-			return errors.New("attempt to change metadata of a p2p topic")
+			if set.Desc.Ttl == nil || set.Desc.DefaultAcs != nil || set.Desc.Public != nil {
+				// Reject direct changes to P2P topics.
+				sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
+				return errors.New("attempt to change metadata of a p2p topic")
+			}
+			// Either participant may change the message TTL
+			if *set.Desc.Ttl != t.ttl {
+				if !isValidTtl(*set.Desc.Ttl) {
+					err = errors.New("invalid message ttl")
+				} else {
+					topic["MessageTtl"] = *set.Desc.Ttl
+					sendPres = true
+				}
+			}
 		} else {
-			// Update group topic
-			if set.Desc.DefaultAcs != nil || set.Desc.Public != nil {
-				if t.owner == sess.uid {
+			// Update group topic. Moderators may change the public description only.
+			pud := t.perUser[sess.uid]
+			moderator := (pud.modeGiven&pud.modeWant).IsModerator() && set.Desc.DefaultAcs == nil &&
+				set.Desc.WebView == nil && set.Desc.WebIndex == nil && set.Desc.Digest == nil && set.Desc.Ttl == nil
+			if set.Desc.DefaultAcs != nil || set.Desc.Public != nil || set.Desc.WebView != nil ||
+				set.Desc.WebIndex != nil || set.Desc.Digest != nil || set.Desc.Ttl != nil {
+				if t.owner == sess.uid || moderator {
 					if set.Desc.DefaultAcs != nil {
 						err = assignAccess(topic, set.Desc.DefaultAcs)
 					}
 					if set.Desc.Public != nil {
 						sendPres = assignGenericValues(topic, "Public", set.Desc.Public)
 					}
+					if set.Desc.WebView != nil && *set.Desc.WebView != t.webView {
+						topic["WebView"] = *set.Desc.WebView
+					}
+					if set.Desc.WebIndex != nil && *set.Desc.WebIndex != t.webIndex {
+						topic["WebIndex"] = *set.Desc.WebIndex
+					}
+					if set.Desc.Digest != nil && *set.Desc.Digest != t.digest {
+						if !isValidDigest(*set.Desc.Digest) {
+							err = errors.New("invalid digest period")
+						} else {
+							topic["Digest"] = *set.Desc.Digest
+							// The first digest covers messages since the moment it was enabled
+							topic["DigestAt"] = now
+							topic["DigestSeq"] = t.lastId
+						}
+					}
+					if set.Desc.Ttl != nil && *set.Desc.Ttl != t.ttl {
+						if !isValidTtl(*set.Desc.Ttl) {
+							err = errors.New("invalid message ttl")
+						} else {
+							topic["MessageTtl"] = *set.Desc.Ttl
+							sendPres = true
+						}
+					}
 				} else {
 					// This is a request from non-owner
 					sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
 					return errors.New("attempt to change public or permissions by non-owner")
 				}
 			}
+			if set.Desc.MaxMembers != nil {
+				if t.cat != types.TopicCat_Grp || sess.authLvl != auth.LevelRoot {
+					sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
+					return errors.New("attempt to change member limit by non-root")
+				}
+				if *set.Desc.MaxMembers < 0 {
+					err = errors.New("invalid member limit")
+				} else if *set.Desc.MaxMembers != t.maxMembers {
+					topic["MaxMembers"] = *set.Desc.MaxMembers
+				}
+			}
+			if set.Desc.Webhook != nil {
+				if t.cat != types.TopicCat_Grp || t.owner != sess.uid || !webhooks.topicHooks {
+					sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
+					return errors.New("attempt to set webhook by non-owner or topic webhooks disabled")
+				}
+				if webhook, werr := webhookParse(set.Desc.Webhook); werr != nil {
+					err = werr
+				} else if webhook != nil || t.webhook != nil {
+					topic["Webhook"] = webhook
+				}
+			}
 		}
 
 		if err != nil {
@@ -1283,6 +1614,9 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 	var change int
 	if len(user) > 0 {
 		err = store.Users.Update(sess.uid, user)
+		if _, ok := user["Public"]; ok {
+			profileInvalidate(sess.uid)
+		}
 		change++
 	}
 	if err == nil && len(topic) > 0 {
@@ -1310,7 +1644,7 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 	}
 	if t.cat == types.TopicCat_Me {
 		updateCached(user)
-	} else if t.cat == types.TopicCat_Grp {
+	} else if t.cat == types.TopicCat_Grp || t.cat == types.TopicCat_Chn || t.cat == types.TopicCat_P2P {
 		updateCached(topic)
 	}
 
@@ -1338,6 +1672,9 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 	var subs []types.Subscription
 	var err error
 	var isSharer bool
+	// Members of large topics are returned in pages without Public
+	var paged bool
+	var next string
 
 	if t.cat == types.TopicCat_Me {
 		// Fetch user's subscriptions, with Topic.Public denormalized into subscription.
@@ -1345,17 +1682,40 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 		subs, err = store.Users.GetTopicsAny(sess.uid)
 		isSharer = true
 	} else if t.cat == types.TopicCat_Fnd {
-		// Given a query provided in .private, fetch user's contacts
+		// Given a query provided in .private, fetch a page of user's contacts
 		if query, ok := t.perUser[sess.uid].private.([]interface{}); ok {
 			if query != nil && len(query) > 0 {
-				subs, err = store.Users.FindSubs(sess.uid, query)
+				subs, next, err = fndPage(sess.uid, query, opts)
 			}
 		}
+	} else if userData := t.perUser[sess.uid]; t.cat == types.TopicCat_Chn &&
+		!(userData.modeGiven & userData.modeWant).IsSharer() {
+		// Readers of a channel see only their own subscription
+		var sub *types.Subscription
+		if sub, err = store.Subs.Get(t.name, sess.uid); sub != nil {
+			subs = []types.Subscription{*sub}
+		}
 	} else {
-		// TODO(gene): don't load subs from DB, use perUserData - it already contains subscriptions.
-		subs, err = store.Topics.GetUsersAny(t.name)
-		userData := t.perUser[sess.uid]
-		isSharer = (userData.modeGiven & userData.modeWant).IsSharer()
+		if paged = t.membersPaged(); paged {
+			subs, next, err = t.membersPage(opts)
+		} else {
+			// TODO(gene): don't load subs from DB, use perUserData - it already contains subscriptions.
+			subs, err = store.Topics.GetUsersAny(t.name)
+		}
+		// Moderators need to see the members they may evict
+		isSharer = (userData.modeGiven&userData.modeWant).IsSharer() ||
+			(userData.modeGiven&userData.modeWant).IsModerator()
+	}
+
+	// Users who blocked the requester are not found in 'fnd'. In 'me' users who blocked the requester or
+	// hide presence by privacy settings appear offline, their last seen time may be hidden too.
+	var blockers, unseen map[string]bool
+	if err == nil && t.cat == types.TopicCat_Me {
+		blockers, unseen, err = presenceHiddenBy(sess.uid, t.contacts, subs)
+	} else if err == nil && t.cat == types.TopicCat_Fnd {
+		blockers, err = blockersOf(sess.uid, subs, func(sub *types.Subscription) string {
+			return types.ParseUid(sub.User).UserId()
+		})
 	}
 
 	if err != nil {
@@ -1372,11 +1732,11 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 		limit = opts.Limit
 	}
 
-	if limit <= 0 {
+	if limit <= 0 || paged {
 		limit = 1024
 	}
 
-	meta := &MsgServerMeta{Id: id, Topic: t.original(sess.uid), Timestamp: &now}
+	meta := &MsgServerMeta{Id: id, Topic: t.original(sess.uid), Timestamp: &now, Next: next}
 	if subs != nil && len(subs) > 0 {
 		meta.Sub = make([]MsgTopicSub, 0, len(subs))
 		idx := 0
@@ -1412,6 +1772,9 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 			}
 
 			uid := types.ParseUid(sub.User)
+			if t.cat == types.TopicCat_Fnd && blockers[uid.UserId()] {
+				continue
+			}
 			isReader := sub.ModeGiven.IsReader() && sub.ModeWant.IsReader()
 			var clearId int
 			if t.cat == types.TopicCat_Me {
@@ -1440,6 +1803,12 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 					}
 
 					lastSeen := sub.GetLastSeen()
+					if blockers[with] {
+						mts.Online = false
+					}
+					if unseen[with] {
+						lastSeen = time.Time{}
+					}
 					if !lastSeen.IsZero() {
 						mts.LastSeen = &MsgLastSeenInfo{
 							When:      &lastSeen,
@@ -1448,7 +1817,7 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 				}
 			} else {
 				// Mark subscriptions that the user does not care about as deleted
-				if t.cat == types.TopicCat_Grp && !isSharer &&
+				if (t.cat == types.TopicCat_Grp || t.cat == types.TopicCat_Chn) && !isSharer &&
 					(!sub.ModeWant.IsJoiner() || !sub.ModeGiven.IsJoiner()) {
 					deleted = true
 				}
@@ -1474,8 +1843,13 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 
 				if isReader {
 					// Ensure sanity or ReadId and RecvId:
-					mts.ReadSeqId = max(clearId, sub.ReadSeqId)
-					mts.RecvSeqId = max(clearId, sub.RecvSeqId)
+					recvId, readId := sub.RecvSeqId, sub.ReadSeqId
+					if recv, read, ok := markersPending(sub.Topic, uid); ok {
+						// Markers not written to the database yet
+						recvId, readId = recv, read
+					}
+					mts.ReadSeqId = max(clearId, readId)
+					mts.RecvSeqId = max(clearId, recvId)
 				}
 
 				if t.cat != types.TopicCat_Fnd {
@@ -1488,12 +1862,17 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 
 				// Returning public and private only if they have changed since ifModified
 				if sendPubPriv {
-					mts.Public = sub.GetPublic()
+					if !paged {
+						mts.Public = sub.GetPublic()
+					}
 					// Reporting private only if it's user's own supscription or
 					// a synthetic 'private' in 'find' topic where it's a list of tags matched on.
 					if uid == sess.uid || t.cat == types.TopicCat_Fnd {
 						mts.Private = sub.Private
 					}
+					if uid == sess.uid {
+						mts.Notify = notifyPrefsToMsg(sub.Notify)
+					}
 				}
 			} else if mts.DeletedAt == nil {
 				mts.DeletedAt = &sub.UpdatedAt
@@ -1529,7 +1908,7 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, set *MsgClientSet) error {
 	var err error
 	if uid == sess.uid {
 		// Request new subscription or modify own subscription
-		err = t.requestSub(h, sess, set.Id, set.Sub.Mode, nil)
+		err = t.requestSub(h, sess, set.Id, set.Sub.Mode, types.ModeUnset, nil)
 	} else {
 		// Request to approve/change someone's subscription
 		err = t.approveSub(h, sess, uid, set)
@@ -1554,6 +1933,67 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, set *MsgClientSet) error {
 	return nil
 }
 
+// replySetRemind creates or cancels a reminder about a message in response to set.remind.
+// The reminder is delivered to the user's 'me' topic by the reminder job.
+func (t *Topic) replySetRemind(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+	remind := set.Remind
+
+	pud := t.perUser[sess.uid]
+	if !(pud.modeGiven & pud.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
+		return errors.New("attempt to set reminder without read access")
+	}
+
+	if remind.SeqId <= pud.clearId || remind.SeqId > t.lastId {
+		sess.queueOut(ErrMalformed(set.Id, t.original(sess.uid), now))
+		return errors.New("invalid seq id of the reminder")
+	}
+
+	id := reminderId(sess.uid, t.name, remind.SeqId)
+
+	if remind.At == nil {
+		// Cancel the reminder
+		if err := store.Reminders.Delete(id); err != nil {
+			sess.queueOut(ErrUnknown(set.Id, t.original(sess.uid), now))
+			return err
+		}
+		sess.queueOut(NoErr(set.Id, t.original(sess.uid), now))
+		return nil
+	}
+
+	if !remind.At.After(now) {
+		sess.queueOut(ErrMalformed(set.Id, t.original(sess.uid), now))
+		return errors.New("reminder time is in the past")
+	}
+
+	messages, err := store.Messages.GetAll(t.name, sess.uid,
+		&types.BrowseOpt{Since: remind.SeqId, Before: remind.SeqId + 1, Limit: 1})
+	if err != nil {
+		sess.queueOut(ErrUnknown(set.Id, t.original(sess.uid), now))
+		return err
+	}
+	if len(messages) == 0 || messages[0].DeletedAt != nil {
+		sess.queueOut(ErrNotFound(set.Id, t.original(sess.uid), now))
+		return errors.New("message not found")
+	}
+
+	reminder := &types.Reminder{
+		ObjHeader: types.ObjHeader{Id: id},
+		User:      sess.uid.String(),
+		Topic:     t.original(sess.uid),
+		SeqId:     remind.SeqId,
+		Snippet:   webViewSnippet(webFeedSanitize(webViewText(messages[0].Content)), REMINDER_SNIPPET_LENGTH),
+		At:        remind.At.UTC()}
+	if err = store.Reminders.Upsert(reminder); err != nil {
+		sess.queueOut(ErrUnknown(set.Id, t.original(sess.uid), now))
+		return err
+	}
+
+	sess.queueOut(NoErr(set.Id, t.original(sess.uid), now))
+	return nil
+}
+
 // replyGetData is a response to a get.data request - load a list of stored messages, send them to session as {data}
 // response goes to a single session rather than all sessions in a topic
 func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error {
@@ -1565,11 +2005,41 @@ func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error
 		return nil
 	}
 
+	if retry, throttled := historyThrottle(sess.uid, now); throttled {
+		sess.queueOut(ErrTooManyRequests(id, t.original(sess.uid), now, retry))
+		return errors.New("too many history requests")
+	}
+
 	opts := msgOpts2storeOpts(req, t.perUser[sess.uid].clearId)
+	if req != nil && req.Mentions {
+		// Only messages which mention the requester
+		opts.Mentions = sess.uid
+	}
+
+	if req != nil && req.Query != "" {
+		// Full-text search
+		if globals.searchHandler == nil {
+			sess.queueOut(ErrOperationNotAllowed(id, t.original(sess.uid), now))
+			return errors.New("message search is disabled")
+		}
+		if len([]rune(req.Query)) < SEARCH_MIN_QUERY_LENGTH {
+			sess.queueOut(ErrMalformed(id, t.original(sess.uid), now))
+			return errors.New("search query is too short")
+		}
+		if opts.Limit == 0 {
+			opts.Limit = SEARCH_DEFAULT_LIMIT
+		} else if opts.Limit > SEARCH_MAX_LIMIT {
+			opts.Limit = SEARCH_MAX_LIMIT
+		}
+		// The search handler may be slow: reply without blocking the topic
+		go searchReply(sess, id, t.name, t.original(sess.uid), req.Query, opts, now)
+		return nil
+	}
 
+	opts = t.historyAdjust(opts, now)
 	messages, err := store.Messages.GetAll(t.name, sess.uid, opts)
 	if err != nil {
-		log.Println("topic: error loading topics ", err)
+		logTopic.Warn("topic: error loading topics", err)
 		sess.queueOut(ErrUnknown(id, t.original(sess.uid), now))
 		return err
 	}
@@ -1579,26 +2049,7 @@ func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error
 	// clients to process.
 	if messages != nil {
 		for i := len(messages) - 1; i >= 0; i-- {
-			mm := messages[i]
-
-			from := types.ParseUid(mm.From)
-			msg := &ServerComMessage{Data: &MsgServerData{
-				Topic:     t.original(sess.uid),
-				Head:      mm.Head,
-				SeqId:     mm.SeqId,
-				From:      from.UserId(),
-				Timestamp: mm.CreatedAt,
-				Content:   mm.Content}}
-
-			// Clear content if the message was soft-deleted for the current user
-			if mm.DeletedAt != nil {
-				msg.Data.Head = nil
-				msg.Data.Content = nil
-				msg.Data.DeletedAt = mm.DeletedAt
-			}
-
-			sess.queueOut(msg)
-
+			sess.queueOut(storedMessage(t.original(sess.uid), sess.uid, &messages[i]))
 		}
 	}
 	// Inform the requester that all the data has been served.
@@ -1607,6 +2058,47 @@ func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error
 	return nil
 }
 
+// storedMessage converts a message loaded from the store to {data} for the user. The topic is the name
+// of the topic as seen by the user.
+func storedMessage(topic string, uid types.Uid, mm *types.Message) *ServerComMessage {
+	from := types.ParseUid(mm.From)
+	msg := &ServerComMessage{Data: &MsgServerData{
+		Topic:     topic,
+		Head:      mm.Head,
+		SeqId:     mm.SeqId,
+		From:      from.UserId(),
+		Timestamp: mm.CreatedAt,
+		EditedAt:  mm.EditedAt,
+		Thread:    mm.Thread,
+		Content:   mm.Content,
+		Reactions: reactionCounts(mm.Reactions),
+		Reacted:   reactionsOf(mm.Reactions, uid)}}
+
+	// Clear content if the message was soft-deleted for the current user
+	if mm.DeletedAt != nil {
+		msg.Data.Head = nil
+		msg.Data.Content = nil
+		msg.Data.Reactions = nil
+		msg.Data.Reacted = nil
+		msg.Data.DeletedAt = mm.DeletedAt
+	}
+	return msg
+}
+
+// isAuthorOf checks if all the listed messages were published by the user.
+func (t *Topic) isAuthorOf(uid types.Uid, list []int) (bool, error) {
+	for _, seq := range list {
+		messages, err := store.Messages.GetAll(t.name, uid, &types.BrowseOpt{Since: seq, Before: seq + 1, Limit: 1})
+		if err != nil {
+			return false, err
+		}
+		if len(messages) == 0 || messages[0].From != uid.String() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 // replyDelMsg deletes (soft or hard) messages in response to del.msg packet.
 func (t *Topic) replyDelMsg(sess *Session, del *MsgClientDel) error {
 	now := time.Now().UTC().Round(time.Millisecond)
@@ -1646,10 +2138,22 @@ func (t *Topic) replyDelMsg(sess *Session, del *MsgClientDel) error {
 	}
 
 	pud := t.perUser[sess.uid]
-	if !(pud.modeGiven & pud.modeWant).IsDeleter() {
+	if mode := pud.modeGiven & pud.modeWant; !mode.IsDeleter() && mode.IsModerator() && mode.IsReader() &&
+		del.Hard && del.Before == 0 {
+		// Moderators may hard-delete any listed messages but cannot clear the history
+	} else if !mode.IsDeleter() && mode.IsOwnDeleter() && del.Hard && del.Before == 0 {
+		// User may hard-delete only the messages he has published
+		if own, err := t.isAuthorOf(sess.uid, filteredList); err != nil {
+			sess.queueOut(ErrUnknown(del.Id, t.original(sess.uid), now))
+			return err
+		} else if !own {
+			sess.queueOut(ErrPermissionDenied(del.Id, t.original(sess.uid), now))
+			return errors.New("del.msg: not the author")
+		}
+	} else if !mode.IsDeleter() {
 		// User must have an R permission: if the user cannot read messages, he has
 		// no business of deleting them.
-		if !(pud.modeGiven & pud.modeWant).IsReader() {
+		if !mode.IsReader() {
 			sess.queueOut(ErrPermissionDenied(del.Id, t.original(sess.uid), now))
 			return errors.New("del.msg: permission denied")
 		}
@@ -1698,6 +2202,8 @@ func (t *Topic) replyDelMsg(sess *Session, del *MsgClientDel) error {
 	}
 
 	if del.Hard {
+		t.unpinDeleted(del.Before, filteredList)
+
 		// Broadcast the change to all, online and offline, exclude the session making the change.
 		t.presSubsOnline("del", "", params, types.ModeRead, sess.sid)
 		t.presSubsOffline("del", params, types.ModeRead, sess.sid, true)
@@ -1723,7 +2229,8 @@ func (t *Topic) replyDelMsg(sess *Session, del *MsgClientDel) error {
 // 2.1.2 If the other subscription does not exist, delete topic
 // 2.2 If this is not a p2p topic, treat it as {leave unreg=true}
 func (t *Topic) replyDelTopic(h *Hub, sess *Session, del *MsgClientDel) error {
-	if t.owner != sess.uid {
+	// The session is nil if the topic is deleted by the operator
+	if sess != nil && t.owner != sess.uid {
 		// Cases 2.1.1 and 2.2
 		if t.cat != types.TopicCat_P2P || len(t.perUser) > 1 {
 			return t.replyLeaveUnsub(h, sess, del.Id)
@@ -1749,7 +2256,8 @@ func (t *Topic) replyDelSub(h *Hub, sess *Session, del *MsgClientDel) error {
 	uid := types.ParseUserId(del.User)
 
 	pud := t.perUser[sess.uid]
-	if !(pud.modeGiven & pud.modeWant).IsAdmin() {
+	hostMode := pud.modeGiven & pud.modeWant
+	if !hostMode.IsAdmin() && !hostMode.IsModerator() {
 		err = errors.New("del.sub: permission denied")
 	} else if uid.IsZero() || uid == sess.uid {
 		// Cannot delete self-subscription. User [leave unsub] or [delete topic]
@@ -1766,6 +2274,15 @@ func (t *Topic) replyDelSub(h *Hub, sess *Session, del *MsgClientDel) error {
 
 	pud, ok := t.perUser[uid]
 	if !ok {
+		if del.Ban && !t.isBanned(uid) {
+			// Users may be banned before they subscribe
+			if err := t.bansSave(uid, true); err != nil {
+				sess.queueOut(ErrUnknown(del.Id, t.original(sess.uid), now))
+				return err
+			}
+			sess.queueOut(NoErr(del.Id, t.original(sess.uid), now))
+			return nil
+		}
 		sess.queueOut(InfoNoAction(del.Id, t.original(sess.uid), now))
 		return errors.New("del.sub: user not found")
 	}
@@ -1773,6 +2290,8 @@ func (t *Topic) replyDelSub(h *Hub, sess *Session, del *MsgClientDel) error {
 	// Check if the user being ejected is the owner.
 	if (pud.modeGiven & pud.modeWant).IsOwner() {
 		err = errors.New("del.sub: cannot evict topic owner")
+	} else if !hostMode.IsAdmin() && ((pud.modeGiven&pud.modeWant).IsAdmin() || pud.modeGiven.IsModerator()) {
+		err = errors.New("del.sub: moderator cannot evict admins or moderators")
 	} else if !pud.modeWant.IsJoiner() {
 		// If the user has banned the topic, subscription should not be deleted. Otherwise user may be re-invited
 		// which defeats the purpose of banning.
@@ -1784,6 +2303,13 @@ func (t *Topic) replyDelSub(h *Hub, sess *Session, del *MsgClientDel) error {
 		return err
 	}
 
+	if del.Ban {
+		if err := t.bansSave(uid, true); err != nil {
+			sess.queueOut(ErrUnknown(del.Id, t.original(sess.uid), now))
+			return err
+		}
+	}
+
 	// Delete user's subscription from the database
 	if err := store.Subs.Delete(t.name, uid); err != nil {
 		sess.queueOut(ErrUnknown(del.Id, t.original(sess.uid), now))
@@ -1833,8 +2359,23 @@ func (t *Topic) evictUser(uid types.Uid, unsub bool, skip string) {
 
 	pud := t.perUser[uid]
 
+	if unsub {
+		t.webhookMember(uid, "leave", pud)
+	}
+
 	// First notify topic subscribers that the user has left the topic
-	if t.cat == types.TopicCat_Grp {
+	if t.cat == types.TopicCat_Chn && unsub {
+		// Let admins know
+		t.presSubsOnline("acs", uid.UserId(),
+			&PresParams{
+				actor:  skip,
+				target: uid.UserId(),
+				dWant:  pud.modeWant.Delta(types.ModeNone),
+				dGiven: pud.modeGiven.Delta(types.ModeNone)},
+			types.ModeCAdmin, skip)
+		// Let affected user know
+		t.presSingleUserOffline(uid, "gone", nilPresParams, "", false)
+	} else if t.cat == types.TopicCat_Grp {
 		if unsub {
 			// Let admins know
 			t.presSubsOnline("acs", uid.UserId(),
@@ -1882,9 +2423,15 @@ func (t *Topic) evictUser(uid types.Uid, unsub bool, skip string) {
 	}
 }
 
+// canReceive checks if the user with the given access mode may receive the message: readers receive
+// all messages, users with the 'C' scope only commands addressed to them in head.cmd.
+func canReceive(mode types.AccessMode, uid types.Uid, data *MsgServerData) bool {
+	return mode.IsReader() || (mode.IsCommander() && data.Head["cmd"] == uid.UserId())
+}
+
 // Prepares a payload to be delivered to a mobile device as a push notification.
 func (t *Topic) makePushReceipt(data *MsgServerData) *pushReceipt {
-	idx := make(map[types.Uid]int, len(t.perUser))
+	idx := newPushIndex()
 	receipt := push.Receipt{
 		To: make([]push.PushTo, len(t.perUser)),
 		Payload: push.Payload{
@@ -1894,11 +2441,14 @@ func (t *Topic) makePushReceipt(data *MsgServerData) *pushReceipt {
 			SeqId:     data.SeqId,
 			Content:   data.Content}}
 
+	mentioned := mentionedUsers(data)
 	i := 0
 	for uid, pud := range t.perUser {
-		if (pud.modeWant & pud.modeGiven).IsPresencer() {
-			// Only send to those users who have notifications enabled
+		if mode := pud.modeWant & pud.modeGiven; mode.IsPresencer() && canReceive(mode, uid, data) &&
+			notifyAllowed(pud.notify, mentioned[uid], data) {
+			// Only send to those users who have notifications enabled and may see the message
 			receipt.To[i].User = uid
+			receipt.To[i].Mentioned = mentioned[uid]
 			idx[uid] = i
 			i++
 		}
@@ -1911,9 +2461,9 @@ func (t *Topic) mostRecentSession() *Session {
 	var sess *Session
 	var latest time.Time
 	for s, _ := range t.sessions {
-		if s.lastAction.After(latest) {
+		if last := s.lastActionAt(); last.After(latest) {
 			sess = s
-			latest = s.lastAction
+			latest = last
 		}
 	}
 	return sess
@@ -1990,6 +2540,9 @@ func getDefaultAccess(cat types.TopicCat, auth bool) types.AccessMode {
 		return types.ModeNone
 	case types.TopicCat_Grp:
 		return types.ModeCPublic
+	case types.TopicCat_Chn:
+		// Subscribers of a channel are readers, publishers are appointed by admins
+		return types.ModeCReadOnly
 	case types.TopicCat_Me:
 		return types.ModeCSelf
 	default:
@@ -2004,6 +2557,7 @@ func msgOpts2storeOpts(req *MsgBrowseOpts, clearId int) *types.BrowseOpt {
 		opts = &types.BrowseOpt{}
 		if req != nil {
 			opts.Limit = req.Limit
+			opts.Thread = req.Thread
 			if req.SinceId != 0 || req.BeforeId != 0 {
 				opts.Since = req.SinceId
 				opts.Before = req.BeforeId
@@ -2039,3 +2593,8 @@ func topicCat(name string) types.TopicCat {
 func genTopicName() string {
 	return "grp" + store.GetUidString()
 }
+
+// Generate random string as a name of the channel
+func genChannelName() string {
+	return "chn" + store.GetUidString()
+}
@@ -0,0 +1,310 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Lifecycle metrics of topic goroutines and detection of leaked topics.
+ *  Every topic runs in its own goroutine. The hub asks a topic to stop by
+ *  sending to topic.exit; a topic which is blocked, e.g. on a database call,
+ *  never reads it and its goroutine leaks. The watchdog reports topics which
+ *  have not stopped within TOPICTIMEOUT, logs the stack of the topic's
+ *  goroutine and, optionally, writes a dump of all goroutines.
+ *
+ *  With force_teardown enabled, the watchdog also drains the channels of the
+ *  stuck topic: sessions are told the topic is gone and detached from it,
+ *  so they don't block on a topic which no longer reads its input.
+ *
+ *  Metrics are exported as TopicGoroutines in /debug/vars.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+type topicWatchConfig struct {
+	// Don't look for stuck topics, metrics are still collected
+	Disabled bool `json:"disabled"`
+	// Detach sessions from the stuck topic
+	ForceTeardown bool `json:"force_teardown"`
+	// Write dumps of all goroutines to this directory
+	DumpDir string `json:"dump_dir"`
+}
+
+// Lifecycle of one topic goroutine
+type topicLife struct {
+	name string
+	// ID of the goroutine running the topic
+	goid string
+	// Estimated memory held by the topic
+	size int64
+	// When the hub asked the topic to stop, zero if it was not asked yet
+	stopping time.Time
+	reason   int
+	// The topic was reported as stuck
+	stuck bool
+	// Closed when the goroutine exits
+	done chan bool
+}
+
+var topicWatch = struct {
+	sync.Mutex
+	live   map[*Topic]*topicLife
+	config topicWatchConfig
+
+	started *expvar.Int
+	exited  *expvar.Int
+	running *expvar.Int
+	// Topics currently stuck
+	stuck *expvar.Int
+	// Topics ever detected as stuck
+	leaked *expvar.Int
+	forced *expvar.Int
+}{
+	live:    make(map[*Topic]*topicLife),
+	started: new(expvar.Int),
+	exited:  new(expvar.Int),
+	running: new(expvar.Int),
+	stuck:   new(expvar.Int),
+	leaked:  new(expvar.Int),
+	forced:  new(expvar.Int),
+}
+
+// topicWatchInit publishes the metrics and starts the watchdog.
+func topicWatchInit(jsconfig json.RawMessage) {
+	vars := new(expvar.Map).Init()
+	vars.Set("started", topicWatch.started)
+	vars.Set("exited", topicWatch.exited)
+	vars.Set("running", topicWatch.running)
+	vars.Set("stuck", topicWatch.stuck)
+	vars.Set("leaked", topicWatch.leaked)
+	vars.Set("forced_teardown", topicWatch.forced)
+	expvar.Publish("TopicGoroutines", vars)
+
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &topicWatch.config); err != nil {
+			logMain.Fatal("Failed to parse topic_watchdog config:", err)
+		}
+	}
+	if topicWatch.config.Disabled {
+		return
+	}
+
+	go func() {
+		for range time.Tick(TOPICTIMEOUT) {
+			topicWatchCheck()
+		}
+	}()
+}
+
+// goroutineId returns the ID of the calling goroutine as it appears in stack dumps.
+func goroutineId() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// "goroutine 123 [running]:..."
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// topicStarted is called by the topic goroutine when it starts.
+func topicStarted(t *Topic) {
+	topicWatch.Lock()
+	topicWatch.live[t] = &topicLife{name: t.name, goid: goroutineId(), size: memTopicSize(t), done: make(chan bool)}
+	topicWatch.Unlock()
+
+	topicWatch.started.Add(1)
+	topicWatch.running.Add(1)
+}
+
+// topicResized is called by the topic goroutine when it may have gained or lost subscribers or contacts.
+func topicResized(t *Topic) {
+	size := memTopicSize(t)
+	topicWatch.Lock()
+	if life := topicWatch.live[t]; life != nil {
+		life.size = size
+	}
+	topicWatch.Unlock()
+}
+
+// topicExited is called by the topic goroutine when it exits.
+func topicExited(t *Topic) {
+	topicWatch.Lock()
+	life := topicWatch.live[t]
+	delete(topicWatch.live, t)
+	topicWatch.Unlock()
+
+	topicWatch.exited.Add(1)
+	topicWatch.running.Add(-1)
+	if life == nil {
+		return
+	}
+	close(life.done)
+	if life.stuck {
+		topicWatch.stuck.Add(-1)
+		logTopic.Warnf("topic[%s]: stopped after %v", life.name, time.Since(life.stopping))
+	}
+}
+
+// topicStopping is called by the hub when it asks the topic to stop.
+func topicStopping(t *Topic, reason int) {
+	topicWatch.Lock()
+	if life := topicWatch.live[t]; life != nil && life.stopping.IsZero() {
+		life.stopping = time.Now()
+		life.reason = reason
+	}
+	topicWatch.Unlock()
+}
+
+// topicWatchMemory returns the estimated memory held by running topics.
+func topicWatchMemory() int64 {
+	topicWatch.Lock()
+	defer topicWatch.Unlock()
+
+	var total int64
+	for _, life := range topicWatch.live {
+		total += life.size
+	}
+	return total
+}
+
+// topicWatchQueued returns the number of messages waiting to be processed by running topics.
+func topicWatchQueued() int {
+	topicWatch.Lock()
+	defer topicWatch.Unlock()
+
+	count := 0
+	for t := range topicWatch.live {
+		count += len(t.broadcast)
+	}
+	return count
+}
+
+// topicWatchCheck reports topics which have not stopped in time.
+func topicWatchCheck() {
+	deadline := time.Now().Add(-TOPICTIMEOUT)
+
+	var stuck []*Topic
+	topicWatch.Lock()
+	for t, life := range topicWatch.live {
+		if !life.stuck && !life.stopping.IsZero() && life.stopping.Before(deadline) {
+			life.stuck = true
+			stuck = append(stuck, t)
+		}
+	}
+	topicWatch.Unlock()
+
+	if len(stuck) == 0 {
+		return
+	}
+
+	stacks := goroutineStacks()
+	for _, t := range stuck {
+		topicWatch.Lock()
+		life := topicWatch.live[t]
+		topicWatch.Unlock()
+		if life == nil {
+			// Stopped just now
+			continue
+		}
+
+		topicWatch.stuck.Add(1)
+		topicWatch.leaked.Add(1)
+		logTopic.Errorf("topic[%s]: did not stop in %v (reason %d); queued: broadcast=%d, meta=%d, reg=%d, unreg=%d\n%s",
+			life.name, time.Since(life.stopping), life.reason,
+			len(t.broadcast), len(t.meta), len(t.reg), len(t.unreg), stacks[life.goid])
+
+		if topicWatch.config.ForceTeardown {
+			topicWatch.forced.Add(1)
+			go topicTeardown(t, life.done)
+		}
+	}
+
+	if topicWatch.config.DumpDir != "" {
+		writeGoroutineDump(topicWatch.config.DumpDir)
+	}
+}
+
+// goroutineStacks returns stacks of all goroutines indexed by goroutine ID.
+func goroutineStacks() map[string]string {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 2)
+
+	stacks := make(map[string]string)
+	for _, stack := range strings.Split(buf.String(), "\n\n") {
+		if fields := strings.Fields(stack); len(fields) > 1 && fields[0] == "goroutine" {
+			stacks[fields[1]] = stack
+		}
+	}
+	return stacks
+}
+
+// writeGoroutineDump writes stacks of all goroutines to a file in the directory.
+func writeGoroutineDump(dir string) {
+	name := filepath.Join(dir, "goroutines-"+strconv.FormatInt(time.Now().Unix(), 10)+".txt")
+	file, err := os.Create(name)
+	if err != nil {
+		logTopic.Warn("topic watchdog: failed to write goroutine dump:", err)
+		return
+	}
+	defer file.Close()
+
+	pprof.Lookup("goroutine").WriteTo(file, 2)
+	logTopic.Infof("topic watchdog: goroutine dump written to %s", name)
+}
+
+// topicTeardown answers requests sent to the stuck topic until its goroutine exits. Sessions are
+// detached from the topic. The topic's own goroutine can't be stopped.
+func topicTeardown(t *Topic, done chan bool) {
+	// Topic names are taken from requests: the state of the topic belongs to its goroutine
+	gone := func(sess *Session, id, topic string) {
+		if sess == nil {
+			return
+		}
+		sess.queueOut(ErrGone(id, topic, types.TimeNow()))
+		select {
+		case sess.detach <- t.name:
+		default:
+		}
+	}
+
+	for {
+		select {
+		case sreg := <-t.reg:
+			gone(sreg.sess, sreg.pkt.Id, sreg.pkt.Topic)
+		case leave := <-t.unreg:
+			gone(leave.sess, leave.reqId, leave.topic)
+		case meta := <-t.meta:
+			switch {
+			case meta.pkt.Get != nil:
+				gone(meta.sess, meta.pkt.Get.Id, meta.pkt.Get.Topic)
+			case meta.pkt.Set != nil:
+				gone(meta.sess, meta.pkt.Set.Id, meta.pkt.Set.Topic)
+			case meta.pkt.Del != nil:
+				gone(meta.sess, meta.pkt.Del.Id, meta.pkt.Del.Topic)
+			}
+		case msg := <-t.broadcast:
+			if msg.Data != nil {
+				gone(msg.sessFrom, msg.id, msg.Data.Topic)
+			}
+		case <-t.uaChange:
+		case <-done:
+			return
+		}
+	}
+}
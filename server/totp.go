@@ -0,0 +1,141 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Two-factor authentication with time-based one-time passwords.
+ *
+ *  Enrollment, by an authenticated user:
+ *    {acc scheme="totp"} - returns the otpauth:// URI and backup codes;
+ *    {acc scheme="totp" secret="123456"} - confirms enrollment with a code;
+ *    {acc scheme="totp" secret="␡123456"} - disables the second factor.
+ *
+ *  Login: {login scheme="basic"} of an enrolled user is answered with 300
+ *  and must be followed by {login scheme="totp" secret="123456"} with a code
+ *  from the app or a backup code.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/auth_totp"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Time allowed to enter the code after the password
+	TOTP_LOGIN_TIMEOUT = 2 * time.Minute
+	// Wrong codes allowed before the login must start over
+	TOTP_MAX_ATTEMPTS = 3
+	// Prefix of the secret which disables the second factor, same as deleting other schemes
+	TOTP_DISABLE = "\u2421"
+)
+
+// Login which passed the password check
+type pendingLogin struct {
+	uid      types.Uid
+	authLvl  int
+	expires  time.Time
+	deadline time.Time
+	attempts int
+	// Counters of failed logins
+	limitKeys []string
+}
+
+// requireSecondFactor checks if the login with a password must be completed with a code. Returns the
+// auth level to use and true if the login is pending or failed and the session was already answered.
+func (s *Session) requireSecondFactor(msg *ClientComMessage, uid types.Uid, authLvl int,
+	expires time.Time, limitKeys []string) (int, bool) {
+
+	enabled, err := auth_totp.Enabled(uid)
+	if err != nil {
+		logSession.Warn("totp: failed to check enrollment:", err)
+		s.queueOut(ErrUnknown(msg.Login.Id, "", msg.timestamp))
+		return authLvl, true
+	}
+
+	if !enabled {
+		if auth_totp.Required(authLvl) {
+			// Let the user in with lower privileges to enroll
+			logSession.Warnf("totp: user %s has no second factor, auth level lowered", uid.UserId())
+			authLvl = auth.LevelAuth
+		}
+		return authLvl, false
+	}
+
+	s.pendingLogin = &pendingLogin{
+		uid:       uid,
+		authLvl:   authLvl,
+		expires:   expires,
+		deadline:  time.Now().Add(TOTP_LOGIN_TIMEOUT),
+		limitKeys: limitKeys}
+	s.queueOut(InfoSecondFactor(msg.Login.Id, msg.timestamp))
+	return authLvl, true
+}
+
+// loginSecondFactor completes the pending login with the code from {login scheme="totp"}.
+func (s *Session) loginSecondFactor(msg *ClientComMessage) {
+	pending := s.pendingLogin
+	if pending == nil || time.Now().After(pending.deadline) {
+		s.pendingLogin = nil
+		s.queueOut(ErrCommandOutOfSequence(msg.Login.Id, "", msg.timestamp))
+		return
+	}
+
+	authErr := auth_totp.Verify(pending.uid, string(msg.Login.Secret))
+	if authErr.IsError() {
+		logSession.Info(authErr.Err)
+		if authErr.Code == auth.ErrInternal {
+			s.queueOut(ErrUnknown(msg.Login.Id, "", msg.timestamp))
+			return
+		}
+
+		loginFailed(pending.limitKeys)
+		pending.attempts++
+		if pending.attempts >= TOTP_MAX_ATTEMPTS {
+			// Start over with the password
+			s.pendingLogin = nil
+		}
+		s.queueOut(ErrAuthFailed(msg.Login.Id, "", msg.timestamp))
+		return
+	}
+
+	s.pendingLogin = nil
+	loginSucceeded(pending.limitKeys)
+	s.loginComplete(msg, pending.uid, pending.authLvl, pending.expires)
+}
+
+// accSecondFactor enrolls the user in two-factor authentication, confirms or disables it.
+func (s *Session) accSecondFactor(msg *ClientComMessage) {
+	if s.uid.IsZero() || (msg.Acc.User != "" && msg.Acc.User != s.uid.UserId()) {
+		s.queueOut(ErrPermissionDenied(msg.Acc.Id, "", msg.timestamp))
+		return
+	}
+
+	secret := string(msg.Acc.Secret)
+	var authErr auth.AuthErr
+	switch {
+	case secret == "":
+		var uri string
+		var backup []string
+		if uri, backup, authErr = auth_totp.Enroll(s.uid, s.uid.UserId()); !authErr.IsError() {
+			reply := NoErrAccepted(msg.Acc.Id, "", msg.timestamp)
+			reply.Ctrl.Params = map[string]interface{}{"uri": uri, "backup": backup}
+			s.queueOut(reply)
+			return
+		}
+	case strings.HasPrefix(secret, TOTP_DISABLE):
+		authErr = auth_totp.Disable(s.uid, strings.TrimPrefix(secret, TOTP_DISABLE))
+	default:
+		authErr = auth_totp.Confirm(s.uid, secret)
+	}
+
+	if authErr.Err != nil {
+		logSession.Info(authErr.Err)
+	}
+	s.queueOut(decodeAuthError(authErr.Code, msg.Acc.Id, msg.timestamp))
+}
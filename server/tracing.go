@@ -0,0 +1,179 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  OpenTelemetry tracing of the message path: session -> hub -> topic ->
+ *  store -> push. The trace context travels with the message and across
+ *  cluster nodes. Tracing is off by default; spans are then no-ops.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Name of the instrumentation library
+	TRACER_NAME = "github.com/tinode/chat/server"
+	// Default name of the service in traces
+	TRACING_DEFAULT_SERVICE = "tinode"
+)
+
+type tracingConfig struct {
+	// Enable tracing
+	Enabled bool `json:"enabled"`
+	// Name of the service as reported in traces
+	ServiceName string `json:"service_name"`
+	// Exporter: "otlp_grpc", "otlp_http" or "stdout"
+	Exporter string `json:"exporter"`
+	// Address of the OTLP collector, e.g. "localhost:4317"
+	Endpoint string `json:"endpoint"`
+	// Don't use TLS when talking to the collector
+	Insecure bool `json:"insecure"`
+	// Fraction of traces to sample, 0 < ratio <= 1; default 1
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// Tracer used by all instrumented code. It's a no-op until tracing is initialized.
+var tracer = otel.Tracer(TRACER_NAME)
+
+// Propagator of the trace context across cluster nodes
+var tracePropagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// tracingInit parses config and sets up the exporter. Returns a function which flushes
+// the pending spans and shuts tracing down.
+func tracingInit(jsconfig json.RawMessage) func() {
+	noop := func() {}
+	if len(jsconfig) == 0 {
+		return noop
+	}
+
+	var config tracingConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse tracing config:", err)
+	}
+	if !config.Enabled {
+		return noop
+	}
+
+	exporter, err := tracingExporter(&config)
+	if err != nil {
+		logMain.Fatal("Failed to initialize tracing exporter:", err)
+	}
+
+	if config.ServiceName == "" {
+		config.ServiceName = TRACING_DEFAULT_SERVICE
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", config.ServiceName),
+		attribute.String("service.version", VERSION)}
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, attribute.String("host.name", host))
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if config.SampleRatio > 0 && config.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(config.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(tracePropagator)
+	tracer = provider.Tracer(TRACER_NAME)
+
+	logMain.Infof("Tracing enabled, exporting to '%s'", config.Exporter)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logMain.Warn("tracing: failed to shut down", err)
+		}
+	}
+}
+
+func tracingExporter(config *tracingConfig) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+	switch config.Exporter {
+	case "otlp_grpc":
+		opts := []otlptracegrpc.Option{}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "otlp_http":
+		opts := []otlptracehttp.Option{}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	}
+	return nil, errors.New("unknown exporter '" + config.Exporter + "'")
+}
+
+// traceStart starts a span which is a child of the span in ctx, if any.
+func traceStart(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// traceEnd records the error, if any, and ends the span.
+func traceEnd(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceInject serializes the trace context for sending to another cluster node.
+func traceInject(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// traceExtract restores the trace context received from another cluster node.
+func traceExtract(carrier map[string]string) context.Context {
+	ctx := context.Background()
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return tracePropagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
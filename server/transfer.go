@@ -0,0 +1,166 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Ownership transfer of group topics and channels. The owner offers the
+ *  topic to a member with
+ *    {set transfer={what: "offer", user: "usr..."}}
+ *  The member receives {pres what="transfer"} on 'me' and accepts the
+ *  offer with {set transfer={what: "accept"}} or declines it with
+ *  {set transfer={what: "decline"}}. The owner withdraws the offer with
+ *  {set transfer={what: "cancel"}}. There is at most one offer per topic;
+ *  a new offer replaces the previous one. When the offer is accepted the
+ *  'O' permission is moved from the old owner to the new one in one update
+ *  of the store and the change of access is announced to all subscribers.
+ *  The old owner stays a member with all other permissions.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// replySetTransfer handles the steps of the ownership transfer in response to set.transfer.
+func (t *Topic) replySetTransfer(sess *Session, set *MsgClientSet) error {
+	now := types.TimeNow()
+	req := set.Transfer
+	original := t.original(sess.uid)
+
+	if t.cat != types.TopicCat_Grp && t.cat != types.TopicCat_Chn {
+		sess.queueOut(ErrPermissionDenied(set.Id, original, now))
+		return errors.New("ownership transfer of a non-group topic")
+	}
+
+	switch req.What {
+	case "offer":
+		if t.owner != sess.uid {
+			sess.queueOut(ErrPermissionDenied(set.Id, original, now))
+			return errors.New("ownership transfer offered by non-owner")
+		}
+		target := types.ParseUserId(req.User)
+		if target.IsZero() || target == sess.uid {
+			sess.queueOut(ErrMalformed(set.Id, original, now))
+			return errors.New("invalid target of ownership transfer")
+		}
+		if pud, ok := t.perUser[target]; !ok || !(pud.modeGiven & pud.modeWant).IsJoiner() || t.isBanned(target) {
+			sess.queueOut(ErrUserNotFound(set.Id, original, now))
+			return errors.New("ownership transfer offered to non-member")
+		}
+		if err := t.transferSave(target); err != nil {
+			sess.queueOut(ErrUnknown(set.Id, original, now))
+			return err
+		}
+		t.presSingleUserOffline(target, "transfer", &PresParams{actor: sess.uid.UserId()}, "", false)
+
+	case "cancel":
+		if t.owner != sess.uid {
+			sess.queueOut(ErrPermissionDenied(set.Id, original, now))
+			return errors.New("ownership transfer cancelled by non-owner")
+		}
+		if t.transferTo.IsZero() {
+			sess.queueOut(InfoNoAction(set.Id, original, now))
+			return nil
+		}
+		if err := t.transferSave(types.ZeroUid); err != nil {
+			sess.queueOut(ErrUnknown(set.Id, original, now))
+			return err
+		}
+
+	case "decline":
+		if t.transferTo != sess.uid {
+			sess.queueOut(ErrPermissionDenied(set.Id, original, now))
+			return errors.New("no ownership transfer offered to the user")
+		}
+		if err := t.transferSave(types.ZeroUid); err != nil {
+			sess.queueOut(ErrUnknown(set.Id, original, now))
+			return err
+		}
+		t.presSingleUserOffline(t.owner, "transfer", &PresParams{actor: sess.uid.UserId()}, "", false)
+
+	case "accept":
+		if t.transferTo != sess.uid || t.owner == sess.uid {
+			sess.queueOut(ErrPermissionDenied(set.Id, original, now))
+			return errors.New("no ownership transfer offered to the user")
+		}
+		if err := t.transferAccept(sess); err != nil {
+			sess.queueOut(ErrUnknown(set.Id, original, now))
+			return err
+		}
+
+	default:
+		sess.queueOut(ErrMalformed(set.Id, original, now))
+		return errors.New("unknown ownership transfer step")
+	}
+
+	sess.queueOut(NoErr(set.Id, original, now))
+	return nil
+}
+
+// transferSave stores the pending offer, zero uid clears it.
+func (t *Topic) transferSave(target types.Uid) error {
+	var value string
+	if !target.IsZero() {
+		value = target.String()
+	}
+	if err := store.Topics.Update(t.name, map[string]interface{}{"TransferTo": value}); err != nil {
+		return err
+	}
+	t.transferTo = target
+	return nil
+}
+
+// transferAccept moves the owner permission to the user and announces the change.
+func (t *Topic) transferAccept(sess *Session) error {
+	oldOwner := t.owner
+	oldData, ok := t.perUser[oldOwner]
+	newData, ok2 := t.perUser[sess.uid]
+	if !ok || !ok2 {
+		return errors.New("owner or new owner is not subscribed")
+	}
+
+	oldGiven, oldWant := oldData.modeGiven, oldData.modeWant
+	newGiven, newWant := newData.modeGiven, newData.modeWant
+
+	newData.modeGiven |= oldData.modeGiven
+	newData.modeWant |= oldData.modeWant
+	oldData.modeGiven &= ^types.ModeOwner
+	oldData.modeWant &= ^types.ModeOwner
+
+	if err := store.Subs.OwnerChange(t.name,
+		&types.Subscription{User: oldOwner.String(), ModeWant: oldData.modeWant, ModeGiven: oldData.modeGiven},
+		&types.Subscription{User: sess.uid.String(), ModeWant: newData.modeWant, ModeGiven: newData.modeGiven}); err != nil {
+		return err
+	}
+
+	t.perUser[oldOwner] = oldData
+	t.perUser[sess.uid] = newData
+	t.owner = sess.uid
+	if err := t.transferSave(types.ZeroUid); err != nil {
+		// The transfer is complete, the stored offer to the new owner cannot be accepted again.
+		logTopic.Warnf("topic[%s]: failed to clear ownership transfer: %v", t.name, err)
+		t.transferTo = types.ZeroUid
+	}
+
+	// Announce the change of both subscriptions to everyone attached to the topic and to the admins on 'me'
+	for _, change := range []struct {
+		uid                            types.Uid
+		oldGiven, oldWant, given, want types.AccessMode
+	}{
+		{oldOwner, oldGiven, oldWant, oldData.modeGiven, oldData.modeWant},
+		{sess.uid, newGiven, newWant, newData.modeGiven, newData.modeWant},
+	} {
+		params := &PresParams{
+			actor:  oldOwner.UserId(),
+			target: change.uid.UserId(),
+			dWant:  change.oldWant.Delta(change.want),
+			dGiven: change.oldGiven.Delta(change.given)}
+		t.presSubsOnline("acs", change.uid.UserId(), params, types.ModeNone, "")
+		t.presSubsOffline("acs", params, types.ModeCSharer, "", true)
+	}
+	return nil
+}
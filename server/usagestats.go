@@ -0,0 +1,232 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Anonymous usage statistics, opt-in. With "usage_stats" enabled the node
+ *  periodically posts a report to the configured endpoint:
+ *    {"version": "0.13", "go": "go1.16", "os": "linux", "arch": "amd64",
+ *     "adapter": "rethinkdb", "features": ["cluster", "mqtt", ...],
+ *     "sessions": 120, "topics": 48, "nodes": 3, "messages": 1500}
+ *  Features are the names of the config sections which are present and not
+ *  disabled; their values are never sent. The counts are the numbers of
+ *  live sessions, loaded topics, cluster nodes and messages saved since
+ *  the last report. Each count is perturbed with Laplace noise scaled by
+ *  1/epsilon, so a report does not reveal whether any single session or
+ *  message was there. No message content, user, topic or host identifiers
+ *  are collected, and the report is written to the log before it is sent.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	// Default interval between reports
+	USAGE_DEFAULT_INTERVAL = 24 * time.Hour
+	// Shortest allowed interval between reports
+	USAGE_MIN_INTERVAL = time.Hour
+	// Default privacy budget of one report
+	USAGE_DEFAULT_EPSILON = 1.0
+	// Timeout of the report request
+	USAGE_TIMEOUT = 30 * time.Second
+)
+
+type usageStatsConfig struct {
+	// Enable the reports
+	Enabled bool `json:"enabled"`
+	// URL which receives the reports
+	Endpoint string `json:"endpoint"`
+	// Interval between reports, hours
+	Interval int `json:"interval"`
+	// Privacy parameter: smaller values add more noise to the counts
+	Epsilon float64 `json:"epsilon"`
+}
+
+// Report sent to the endpoint
+type usageReport struct {
+	Version  string   `json:"version"`
+	Go       string   `json:"go"`
+	Os       string   `json:"os"`
+	Arch     string   `json:"arch"`
+	Adapter  string   `json:"adapter"`
+	Features []string `json:"features"`
+	Sessions int64    `json:"sessions"`
+	Topics   int64    `json:"topics"`
+	Nodes    int64    `json:"nodes"`
+	Messages int64    `json:"messages"`
+}
+
+var usageStats struct {
+	endpoint string
+	epsilon  float64
+	features []string
+	client   *http.Client
+	// Number of saved messages at the time of the previous report
+	lastMessages int64
+}
+
+// usageStatsInit starts sending the reports. Nothing is sent unless enabled in the config.
+func usageStatsInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config usageStatsConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse usage_stats config:", err)
+	}
+	if !config.Enabled {
+		return
+	}
+	if !strings.HasPrefix(config.Endpoint, "https://") && !strings.HasPrefix(config.Endpoint, "http://") {
+		logMain.Fatal("usage_stats: invalid or missing 'endpoint'")
+	}
+
+	interval := time.Duration(config.Interval) * time.Hour
+	if interval <= 0 {
+		interval = USAGE_DEFAULT_INTERVAL
+	} else if interval < USAGE_MIN_INTERVAL {
+		interval = USAGE_MIN_INTERVAL
+	}
+	usageStats.epsilon = config.Epsilon
+	if usageStats.epsilon <= 0 {
+		usageStats.epsilon = USAGE_DEFAULT_EPSILON
+	}
+	usageStats.endpoint = config.Endpoint
+	usageStats.client = &http.Client{Timeout: USAGE_TIMEOUT}
+
+	var err error
+	if usageStats.features, err = usageFeatures(globals.configFile); err != nil {
+		logMain.Warn("usage_stats: failed to read features from config:", err)
+	}
+
+	go usageStatsRun(interval)
+
+	logMain.Infof("Anonymous usage statistics are sent to '%s' every %s, no content or identifiers",
+		usageStats.endpoint, interval)
+}
+
+// usageFeatures returns the names of the sections of the config file which are present and not disabled.
+// Only names defined by configType are reported.
+func usageFeatures(configFile string) ([]string, error) {
+	raw, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var sections map[string]json.RawMessage
+	if err = json.Unmarshal(raw, &sections); err != nil {
+		return nil, err
+	}
+
+	var features []string
+	ctype := reflect.TypeOf(configType{})
+	for i := 0; i < ctype.NumField(); i++ {
+		name := strings.Split(ctype.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		// Plain values such as "listen" are settings, not features
+		section := bytes.TrimSpace(sections[name])
+		if len(section) == 0 || section[0] != '{' || bytes.Equal(section, []byte("{}")) {
+			continue
+		}
+		var toggle struct {
+			Enabled  *bool `json:"enabled"`
+			Disabled bool  `json:"disabled"`
+		}
+		if json.Unmarshal(section, &toggle) == nil && (toggle.Disabled || toggle.Enabled != nil && !*toggle.Enabled) {
+			continue
+		}
+		features = append(features, name)
+	}
+	sort.Strings(features)
+	return features, nil
+}
+
+func usageStatsRun(interval time.Duration) {
+	// The first report is sent at a random time so reports of nodes started together are not correlated
+	time.Sleep(time.Duration(rand.Int63n(int64(interval))))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := usageSend(usageCollect()); err != nil {
+			logMain.Warn("usage_stats: failed to send report:", err)
+		}
+		<-ticker.C
+	}
+}
+
+// usageCollect builds the report with noisy counts.
+func usageCollect() *usageReport {
+	var messages int64
+	if stage := pubStages["save"]; stage != nil && stage.calls != nil {
+		total := stage.calls.Value()
+		messages = total - usageStats.lastMessages
+		usageStats.lastMessages = total
+	}
+	var nodes int64 = 1
+	if globals.cluster != nil {
+		nodes = int64(len(globals.cluster.nodes) + 1)
+	}
+
+	return &usageReport{
+		Version:  VERSION,
+		Go:       runtime.Version(),
+		Os:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Adapter:  store.AdapterName(),
+		Features: usageStats.features,
+		Sessions: usageNoisy(int64(len(globals.sessionStore.all()))),
+		Topics:   usageNoisy(globals.hub.topicsLive.Value()),
+		Nodes:    usageNoisy(nodes),
+		Messages: usageNoisy(messages)}
+}
+
+// usageNoisy adds Laplace noise with the scale of 1/epsilon to the count. The result is never negative.
+func usageNoisy(count int64) int64 {
+	// Inverse CDF of the Laplace distribution
+	u := rand.Float64() - 0.5
+	noise := -math.Copysign(1, u) * math.Log(1-2*math.Abs(u)) / usageStats.epsilon
+	noisy := math.Round(float64(count) + noise)
+	if noisy < 0 {
+		return 0
+	}
+	return int64(noisy)
+}
+
+// usageSend logs the report and posts it to the endpoint.
+func usageSend(report *usageReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	logMain.Infof("usage_stats: sending report to '%s': %s", usageStats.endpoint, body)
+
+	resp, err := usageStats.client.Post(usageStats.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected response status " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  States of user accounts. The operator moves an account between the
+ *  states with the console API:
+ *    active    -> suspended, deleted, banned
+ *    suspended -> active, deleted, banned
+ *    banned    -> active, deleted
+ *    deleted   -> active
+ *  The state is stored with the user. A user in any state but active
+ *  cannot log in, use a token over HTTP, attach to topics, publish, or be
+ *  invited; the request is rejected with 403 and the code of the state,
+ *  e.g. "permission.suspended", with the state and the operator's reason
+ *  in params. When the state changes, every node of the cluster remembers
+ *  it and terminates the sessions of the user, telling them the reason.
+ *  A deleted account keeps its data and subscriptions, unlike a user
+ *  deleted by {del what="user"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Names of the states in the API
+var userStateNames = map[int]string{
+	types.UserStateActive:    "active",
+	types.UserStateSuspended: "suspended",
+	types.UserStateDeleted:   "deleted",
+	types.UserStateBanned:    "banned",
+}
+
+// States an account may move to from each state
+var userStateTransitions = map[int][]int{
+	types.UserStateActive:    {types.UserStateSuspended, types.UserStateDeleted, types.UserStateBanned},
+	types.UserStateSuspended: {types.UserStateActive, types.UserStateDeleted, types.UserStateBanned},
+	types.UserStateBanned:    {types.UserStateActive, types.UserStateDeleted},
+	types.UserStateDeleted:   {types.UserStateActive},
+}
+
+var errUserStateTransition = errors.New("account state transition not allowed")
+
+// Users of this node which are not active, with the reasons
+var userStates struct {
+	sync.RWMutex
+	inactive map[types.Uid]userStateEntry
+}
+
+type userStateEntry struct {
+	state  int
+	reason string
+}
+
+// Request to apply the new state of the user on another node
+type ClusterUserStateReq struct {
+	User   types.Uid
+	State  int
+	Reason string
+}
+
+// userStateName returns the name of the state.
+func userStateName(state int) string {
+	if name, ok := userStateNames[state]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// parseUserState returns the state by name.
+func parseUserState(name string) (int, bool) {
+	for state, known := range userStateNames {
+		if known == name {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+// userStateErrCode returns the error code reported to the user in the state.
+func userStateErrCode(state int) string {
+	switch state {
+	case types.UserStateDeleted:
+		return ERR_ACCOUNT_DELETED
+	case types.UserStateBanned:
+		return ERR_ACCOUNT_BANNED
+	}
+	return ERR_ACCOUNT_SUSPENDED
+}
+
+// userStateTransitionAllowed checks if the account may move from one state to the other.
+func userStateTransitionAllowed(from, to int) bool {
+	for _, state := range userStateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// userStateOf returns the state of the user known to this node: users are remembered when their state
+// changes or when they fail to log in.
+func userStateOf(uid types.Uid) (int, string) {
+	userStates.RLock()
+	defer userStates.RUnlock()
+
+	if entry, ok := userStates.inactive[uid]; ok {
+		return entry.state, entry.reason
+	}
+	return types.UserStateActive, ""
+}
+
+// userStateRemember records the state of the user on this node.
+func userStateRemember(uid types.Uid, state int, reason string) {
+	userStates.Lock()
+	defer userStates.Unlock()
+
+	if state == types.UserStateActive {
+		delete(userStates.inactive, uid)
+		return
+	}
+	if userStates.inactive == nil {
+		userStates.inactive = make(map[types.Uid]userStateEntry)
+	}
+	userStates.inactive[uid] = userStateEntry{state: state, reason: reason}
+}
+
+// userStateLoaded remembers the state of the user loaded from the store. Returns false if the user
+// is not active.
+func userStateLoaded(user *types.User) bool {
+	if user == nil {
+		return true
+	}
+	uid := types.ParseUid(user.Id)
+	if user.State != types.UserStateActive {
+		userStateRemember(uid, user.State, user.StateReason)
+		return false
+	}
+	if state, _ := userStateOf(uid); state != types.UserStateActive {
+		// Reinstated while this node was not told
+		userStateRemember(uid, types.UserStateActive, "")
+	}
+	return true
+}
+
+// userStateApply remembers the new state of the user and terminates the user's sessions on this node
+// unless the user is active. Returns the number of sessions terminated.
+func userStateApply(uid types.Uid, state int, reason string) int {
+	userStateRemember(uid, state, reason)
+	if state == types.UserStateActive {
+		return 0
+	}
+
+	data := encodePacket(ErrAccountState("", "", types.TimeNow(), state, reason))
+	count := 0
+	for _, s := range globals.sessionStore.all() {
+		if s.proto == RPC || s.stop == nil || s.uid != uid {
+			continue
+		}
+		select {
+		case s.stop <- data:
+			count++
+		default:
+			// The session is already stopping
+		}
+	}
+	return count
+}
+
+// UserState applies the new state of the user on this node. Called by the node which changed the state.
+func (Cluster) UserState(req *ClusterUserStateReq, count *int) error {
+	*count = userStateApply(req.User, req.State, req.Reason)
+	return nil
+}
+
+// userStateChange moves the account to the new state and applies it on all nodes. Returns the number of
+// sessions terminated.
+func userStateChange(user *types.User, state int, reason, actor string) (int, error) {
+	if state == user.State && reason == user.StateReason {
+		return 0, nil
+	}
+	if state != user.State && !userStateTransitionAllowed(user.State, state) {
+		return 0, errUserStateTransition
+	}
+
+	uid := types.ParseUid(user.Id)
+	now := types.TimeNow()
+	if err := store.Users.Update(uid, map[string]interface{}{
+		"State":       state,
+		"StateReason": reason,
+		"StateAt":     now}); err != nil {
+		return 0, err
+	}
+	logAudit.Infof("user state: '%s' changed '%s' from %s to %s, reason %q", actor, uid.UserId(),
+		userStateName(user.State), userStateName(state), reason)
+	user.State, user.StateReason, user.StateAt = state, reason, now
+
+	count := userStateApply(uid, state, reason)
+	if globals.cluster != nil {
+		req := &ClusterUserStateReq{User: uid, State: state, Reason: reason}
+		for _, n := range globals.cluster.nodes {
+			var remote int
+			if err := n.call("Cluster.UserState", req, &remote); err != nil {
+				logMain.Warnf("user state: node '%s' was not told of the state of '%s': %v", n.name,
+					uid.UserId(), err)
+				continue
+			}
+			count += remote
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,74 @@
+package validate
+
+// Interfaces for validators of user credentials such as email addresses and phone numbers.
+// A validator delivers confirmation codes to the credential; the server checks the codes.
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Validator is an interface which must be implemented by validators.
+type Validator interface {
+	// Init initializes the validator. A disabled validator returns no error and is not ready.
+	Init(jsonconf string) error
+
+	// IsReady checks if the validator is initialized.
+	IsReady() bool
+
+	// PreCheck normalizes the credential and checks that it's well-formed, e.g. a valid email address.
+	PreCheck(cred string) (string, error)
+
+	// Send delivers the code to the credential. Purpose is "confirm" for the code confirming
+	// the credential or "reset" for the code resetting the password.
+	Send(to, code, purpose string) error
+}
+
+type configType struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+var validators map[string]Validator
+
+// Register a validator by the name of the credential method, e.g. "email"
+func Register(method string, v Validator) {
+	if validators == nil {
+		validators = make(map[string]Validator)
+	}
+
+	if v == nil {
+		panic("Register: validator is nil")
+	}
+	if _, dup := validators[method]; dup {
+		panic("Register: called twice for validator " + method)
+	}
+	validators[method] = v
+}
+
+// Init initializes registered validators
+func Init(jsconfig string) error {
+	var config []configType
+
+	if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	for _, cc := range config {
+		if v := validators[cc.Name]; v != nil {
+			if err := v.Init(string(cc.Config)); err != nil {
+				return errors.New(cc.Name + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Get returns the initialized validator of the credential method or nil.
+func Get(method string) Validator {
+	if v := validators[method]; v != nil && v.IsReady() {
+		return v
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package validate_email
+
+// Validator of email addresses: the confirmation code is sent by email over SMTP.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+
+	"github.com/tinode/chat/server/validate"
+)
+
+const (
+	DEFAULT_PORT = 25
+
+	DEFAULT_CONFIRM_SUBJECT = "Confirm your email"
+	DEFAULT_CONFIRM_BODY    = "Your confirmation code is $CODE"
+	DEFAULT_RESET_SUBJECT   = "Reset your password"
+	DEFAULT_RESET_BODY      = "Your password reset code is $CODE"
+)
+
+type validator struct {
+	config *configType
+	auth   smtp.Auth
+}
+
+type configType struct {
+	Disabled bool `json:"disabled"`
+	// SMTP server
+	Host string `json:"smtp_host"`
+	Port int    `json:"smtp_port"`
+	// Address of the sender, e.g. "Tinode <noreply@example.com>"
+	From string `json:"from"`
+	// Optional credentials of the SMTP server
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// Templates of the emails, $CODE is replaced with the code
+	ConfirmSubject string `json:"confirm_subject"`
+	ConfirmBody    string `json:"confirm_body"`
+	ResetSubject   string `json:"reset_subject"`
+	ResetBody      string `json:"reset_body"`
+}
+
+// Init initializes the validator
+func (v *validator) Init(jsonconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if config.Disabled {
+		return nil
+	}
+
+	if config.Host == "" {
+		return errors.New("smtp_host is required")
+	}
+	if _, err := mail.ParseAddress(config.From); err != nil {
+		return errors.New("invalid from address")
+	}
+	if config.Port <= 0 {
+		config.Port = DEFAULT_PORT
+	}
+	if config.ConfirmSubject == "" {
+		config.ConfirmSubject = DEFAULT_CONFIRM_SUBJECT
+	}
+	if config.ConfirmBody == "" {
+		config.ConfirmBody = DEFAULT_CONFIRM_BODY
+	}
+	if config.ResetSubject == "" {
+		config.ResetSubject = DEFAULT_RESET_SUBJECT
+	}
+	if config.ResetBody == "" {
+		config.ResetBody = DEFAULT_RESET_BODY
+	}
+
+	if config.Login != "" {
+		v.auth = smtp.PlainAuth("", config.Login, config.Password, config.Host)
+	}
+	v.config = &config
+
+	return nil
+}
+
+// IsReady checks if the validator is initialized
+func (v *validator) IsReady() bool {
+	return v.config != nil
+}
+
+// PreCheck checks the format of the address and converts it to lower case
+func (v *validator) PreCheck(cred string) (string, error) {
+	addr, err := mail.ParseAddress(cred)
+	if err != nil || addr.Address != cred || !strings.Contains(addr.Address, ".") {
+		return "", errors.New("invalid email address")
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// Send emails the code to the address
+func (v *validator) Send(to, code, purpose string) error {
+	subject, body := v.config.ConfirmSubject, v.config.ConfirmBody
+	if purpose == "reset" {
+		subject, body = v.config.ResetSubject, v.config.ResetBody
+	}
+
+	from, _ := mail.ParseAddress(v.config.From)
+	msg := "From: " + v.config.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "$CODE", code, -1) + "\r\n"
+
+	return smtp.SendMail(v.config.Host+":"+strconv.Itoa(v.config.Port), v.auth, from.Address, []string{to}, []byte(msg))
+}
+
+func init() {
+	validate.Register("email", &validator{})
+}
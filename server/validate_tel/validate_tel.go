@@ -0,0 +1,139 @@
+package validate_tel
+
+// Validator of phone numbers: the confirmation code is sent by SMS through an HTTP gateway.
+// The gateway receives POST requests with JSON body {"to": "+15551234567", "text": "..."}.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/validate"
+)
+
+const (
+	// Default timeout of the request to the gateway in milliseconds
+	DEFAULT_TIMEOUT = 10000
+
+	DEFAULT_CONFIRM_TEXT = "Your confirmation code is $CODE"
+	DEFAULT_RESET_TEXT   = "Your password reset code is $CODE"
+)
+
+type validator struct {
+	config *configType
+	client *http.Client
+}
+
+type configType struct {
+	Disabled bool `json:"disabled"`
+	// URL of the SMS gateway
+	Url string `json:"url"`
+	// Additional request headers, e.g. to authenticate with the gateway
+	Headers map[string]string `json:"headers"`
+	// Request timeout in milliseconds
+	Timeout int `json:"timeout"`
+	// Templates of the messages, $CODE is replaced with the code
+	ConfirmText string `json:"confirm_text"`
+	ResetText   string `json:"reset_text"`
+}
+
+type smsRequest struct {
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// Init initializes the validator
+func (v *validator) Init(jsonconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if config.Disabled {
+		return nil
+	}
+
+	if u, err := url.Parse(config.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be a valid http(s) URL")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DEFAULT_TIMEOUT
+	}
+	if config.ConfirmText == "" {
+		config.ConfirmText = DEFAULT_CONFIRM_TEXT
+	}
+	if config.ResetText == "" {
+		config.ResetText = DEFAULT_RESET_TEXT
+	}
+
+	v.client = &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond}
+	v.config = &config
+
+	return nil
+}
+
+// IsReady checks if the validator is initialized
+func (v *validator) IsReady() bool {
+	return v.config != nil
+}
+
+// PreCheck converts the number to E.164 form: '+' followed by 8 to 15 digits. Spaces, dashes,
+// dots and parentheses are removed.
+func (v *validator) PreCheck(cred string) (string, error) {
+	var digits []rune
+	for i, r := range strings.TrimSpace(cred) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, r)
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", errors.New("invalid phone number")
+		}
+	}
+	if !strings.HasPrefix(strings.TrimSpace(cred), "+") || len(digits) < 8 || len(digits) > 15 {
+		return "", errors.New("phone number must be in international format")
+	}
+	return "+" + string(digits), nil
+}
+
+// Send texts the code to the number
+func (v *validator) Send(to, code, purpose string) error {
+	text := v.config.ConfirmText
+	if purpose == "reset" {
+		text = v.config.ResetText
+	}
+
+	body, err := json.Marshal(&smsRequest{To: to, Text: strings.Replace(text, "$CODE", code, -1)})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, v.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, val := range v.config.Headers {
+		req.Header.Set(name, val)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("SMS gateway responded " + resp.Status)
+	}
+	return nil
+}
+
+func init() {
+	validate.Register("tel", &validator{})
+}
@@ -0,0 +1,271 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  User-defined message filters compiled to WebAssembly. The filters run in
+ *  the "wasm" stage of the publishing pipeline, each call in a fresh
+ *  instance with limited memory and time. A filter can only see the
+ *  message, annotate it and return a verdict: accept, reject or drop.
+ *
+ *  Host API, imported from module "tinode":
+ *    message_size() i32           - size of the message JSON in bytes;
+ *    message_read(ptr i32) i32    - copy the message JSON to memory at ptr;
+ *    annotate(kptr, klen, vptr, vlen i32) i32
+ *                                 - set head key "x-..." to value, 0 if
+ *                                   accepted, -1 otherwise.
+ *  The module exports
+ *    filter() i32                 - 0 accept, 1 reject, 2 drop.
+ *
+ *  The WebAssembly runtime is compiled in with the "wasm" build tag.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	// Module name of the host API
+	WASM_HOST_MODULE = "tinode"
+	// Function exported by the filter
+	WASM_FILTER_EXPORT = "filter"
+
+	// Default timeout of a filter call
+	WASM_DEFAULT_TIMEOUT = 20 * time.Millisecond
+	// Default limit of filter's memory in 64KB pages
+	WASM_DEFAULT_MEMORY_PAGES = 16
+
+	// Filters may only add head keys with this prefix
+	WASM_ANNOTATION_PREFIX = "x-"
+	// Maximum number of annotations added by one filter
+	WASM_MAX_ANNOTATIONS = 8
+	// Maximum length of annotation key and value in bytes
+	WASM_MAX_ANNOTATION_KEY   = 32
+	WASM_MAX_ANNOTATION_VALUE = 1024
+)
+
+// Filter verdicts
+const (
+	wasmVerdictAccept = 0
+	wasmVerdictReject = 1
+	wasmVerdictDrop   = 2
+)
+
+type wasmFilterConfig struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`
+	// Path to the compiled module
+	Path string `json:"path"`
+	// Timeout of a call in milliseconds
+	Timeout int `json:"timeout"`
+	// Accept the message if the filter fails, reject otherwise
+	FailOpen bool `json:"fail_open"`
+}
+
+type wasmFiltersConfig struct {
+	// Memory limit of every filter instance in 64KB pages
+	MemoryPages int                `json:"memory_pages"`
+	Filters     []wasmFilterConfig `json:"filters"`
+}
+
+// wasmEngine compiles WebAssembly modules. Implemented by the runtime compiled in with the build tag.
+type wasmEngine interface {
+	compile(name string, code []byte, memoryPages uint32) (wasmModule, error)
+}
+
+// wasmModule is a compiled filter.
+type wasmModule interface {
+	// run calls the filter in a new instance of the module and returns the verdict.
+	run(ctx context.Context, call *wasmCall) (int, error)
+}
+
+// wasmCall is the state of one call available to the filter through the host API.
+type wasmCall struct {
+	// The message as JSON
+	message []byte
+	// Head keys added by the filter
+	annotations map[string]string
+}
+
+// annotate records an annotation. Returns false if the annotation is not allowed.
+func (c *wasmCall) annotate(key, value string) bool {
+	if !strings.HasPrefix(key, WASM_ANNOTATION_PREFIX) || len(key) <= len(WASM_ANNOTATION_PREFIX) ||
+		len(key) > WASM_MAX_ANNOTATION_KEY || len(value) > WASM_MAX_ANNOTATION_VALUE {
+		return false
+	}
+	if c.annotations == nil {
+		c.annotations = make(map[string]string)
+	}
+	if _, ok := c.annotations[key]; !ok && len(c.annotations) >= WASM_MAX_ANNOTATIONS {
+		return false
+	}
+	c.annotations[key] = value
+	return true
+}
+
+// wasmMessage is the view of the message passed to the filter.
+type wasmMessage struct {
+	Topic   string            `json:"topic"`
+	From    string            `json:"from"`
+	Thread  int               `json:"thread,omitempty"`
+	Replace int               `json:"replace,omitempty"`
+	Head    map[string]string `json:"head,omitempty"`
+	Content interface{}       `json:"content,omitempty"`
+}
+
+type wasmFilter struct {
+	name     string
+	module   wasmModule
+	timeout  time.Duration
+	failOpen bool
+}
+
+var wasmRuntime wasmEngine
+
+var wasmFilters []*wasmFilter
+
+// Counters of verdicts and failures by filter
+var wasmStats *expvar.Map
+
+// registerWasmEngine makes the WebAssembly runtime available. Called from init() of the runtime.
+func registerWasmEngine(engine wasmEngine) {
+	if wasmRuntime != nil {
+		panic("registerWasmEngine: called twice")
+	}
+	wasmRuntime = engine
+}
+
+func wasmFiltersInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config wasmFiltersConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse wasm_filters config:", err)
+	}
+
+	memoryPages := uint32(WASM_DEFAULT_MEMORY_PAGES)
+	if config.MemoryPages > 0 {
+		memoryPages = uint32(config.MemoryPages)
+	}
+
+	names := make(map[string]bool)
+	for _, conf := range config.Filters {
+		if !conf.Enabled {
+			continue
+		}
+		if wasmRuntime == nil {
+			logMain.Fatal("wasm_filters: the server was built without WebAssembly support, use -tags wasm")
+		}
+		if conf.Name == "" || names[conf.Name] {
+			logMain.Fatalf("wasm_filters: missing or duplicate filter name '%s'", conf.Name)
+		}
+		names[conf.Name] = true
+
+		code, err := ioutil.ReadFile(conf.Path)
+		if err != nil {
+			logMain.Fatalf("wasm_filters: failed to read filter '%s': %v", conf.Name, err)
+		}
+		module, err := wasmRuntime.compile(conf.Name, code, memoryPages)
+		if err != nil {
+			logMain.Fatalf("wasm_filters: failed to compile filter '%s': %v", conf.Name, err)
+		}
+
+		filter := &wasmFilter{name: conf.Name, module: module, timeout: WASM_DEFAULT_TIMEOUT, failOpen: conf.FailOpen}
+		if conf.Timeout > 0 {
+			filter.timeout = time.Duration(conf.Timeout) * time.Millisecond
+		}
+		wasmFilters = append(wasmFilters, filter)
+	}
+
+	if len(wasmFilters) > 0 {
+		wasmStats = new(expvar.Map).Init()
+		expvar.Publish("WasmFilters", wasmStats)
+		logMain.Infof("WebAssembly filters: %d loaded", len(wasmFilters))
+	}
+}
+
+func init() {
+	registerPubStage("wasm", false, pubWasmFilters)
+}
+
+// pubWasmFilters runs the message through the filters in the order they are listed in the config.
+// Each filter sees the annotations added by the previous ones.
+func pubWasmFilters(pc *pubContext) (*ServerComMessage, bool) {
+	if len(wasmFilters) == 0 {
+		return nil, true
+	}
+
+	msg := pc.msg
+	_, span := traceStart(msg.ctx, "wasm.filters")
+	defer span.End()
+
+	for _, filter := range wasmFilters {
+		message, err := json.Marshal(&wasmMessage{
+			Topic:   msg.rcptto,
+			From:    msg.Data.From,
+			Thread:  msg.Data.Thread,
+			Replace: msg.replace,
+			Head:    msg.Data.Head,
+			Content: msg.Data.Content})
+		if err != nil {
+			logSession.Warnf("wasm: failed to serialize message: %v", err)
+			return ErrUnknown(msg.id, msg.Data.Topic, msg.timestamp), false
+		}
+
+		call := &wasmCall{message: message}
+		ctx, cancel := context.WithTimeout(context.Background(), filter.timeout)
+		verdict, err := filter.module.run(ctx, call)
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		cancel()
+
+		if err == nil && verdict != wasmVerdictAccept && verdict != wasmVerdictReject && verdict != wasmVerdictDrop {
+			err = errors.New("invalid verdict")
+		}
+		if err != nil {
+			wasmStats.Add(filter.name+".failed", 1)
+			logSession.Warnf("wasm: filter '%s' failed: %v", filter.name, err)
+			if filter.failOpen {
+				continue
+			}
+			return ErrServiceUnavailable(msg.id, msg.Data.Topic, msg.timestamp), false
+		}
+
+		switch verdict {
+		case wasmVerdictReject:
+			wasmStats.Add(filter.name+".rejected", 1)
+			return ErrPolicy(msg.id, msg.Data.Topic, msg.timestamp), false
+		case wasmVerdictDrop:
+			// The sender is not told the message was dropped
+			wasmStats.Add(filter.name+".dropped", 1)
+			if msg.id != "" {
+				return NoErrAccepted(msg.id, msg.Data.Topic, msg.timestamp), false
+			}
+			return nil, false
+		}
+
+		wasmStats.Add(filter.name+".accepted", 1)
+		if len(call.annotations) > 0 {
+			head := make(map[string]string, len(msg.Data.Head)+len(call.annotations))
+			for key, val := range msg.Data.Head {
+				head[key] = val
+			}
+			for key, val := range call.annotations {
+				head[key] = val
+			}
+			msg.Data.Head = head
+		}
+	}
+	return nil, true
+}
@@ -0,0 +1,112 @@
+// +build wasm
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// WebAssembly runtime for the message filters. No WASI: the filters have no access to files,
+// network or clock, only to the host API.
+
+type wazeroEngine struct{}
+
+type wazeroModule struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// Key of the *wasmCall in the context of the host functions
+type wasmCallKey struct{}
+
+func init() {
+	registerWasmEngine(wazeroEngine{})
+}
+
+func (wazeroEngine) compile(name string, code []byte, memoryPages uint32) (wasmModule, error) {
+	ctx := context.Background()
+	// Each filter gets its own runtime so the memory limit applies to it alone.
+	// Calls are interrupted when the context expires.
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(memoryPages).
+		WithCloseOnContextDone(true))
+
+	_, err := runtime.NewHostModuleBuilder(WASM_HOST_MODULE).
+		NewFunctionBuilder().WithFunc(wasmHostMessageSize).Export("message_size").
+		NewFunctionBuilder().WithFunc(wasmHostMessageRead).Export("message_read").
+		NewFunctionBuilder().WithFunc(wasmHostAnnotate).Export("annotate").
+		Instantiate(ctx)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	for _, fn := range compiled.ImportedFunctions() {
+		if module, _, _ := fn.Import(); module != WASM_HOST_MODULE {
+			runtime.Close(ctx)
+			return nil, errors.New("module imports from '" + module + "', only '" + WASM_HOST_MODULE + "' is allowed")
+		}
+	}
+	if _, ok := compiled.ExportedFunctions()[WASM_FILTER_EXPORT]; !ok {
+		runtime.Close(ctx)
+		return nil, errors.New("module does not export '" + WASM_FILTER_EXPORT + "'")
+	}
+
+	return &wazeroModule{runtime: runtime, compiled: compiled}, nil
+}
+
+func (m *wazeroModule) run(ctx context.Context, call *wasmCall) (int, error) {
+	ctx = context.WithValue(ctx, wasmCallKey{}, call)
+
+	// Anonymous instance: calls from different sessions run concurrently
+	instance, err := m.runtime.InstantiateModule(ctx, m.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return 0, err
+	}
+	defer instance.Close(ctx)
+
+	results, err := instance.ExportedFunction(WASM_FILTER_EXPORT).Call(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(results) != 1 {
+		return 0, errors.New("filter returned no verdict")
+	}
+	return int(int32(results[0])), nil
+}
+
+func wasmHostMessageSize(ctx context.Context) uint32 {
+	return uint32(len(ctx.Value(wasmCallKey{}).(*wasmCall).message))
+}
+
+func wasmHostMessageRead(ctx context.Context, m api.Module, ptr uint32) uint32 {
+	message := ctx.Value(wasmCallKey{}).(*wasmCall).message
+	if !m.Memory().Write(ptr, message) {
+		return 0
+	}
+	return uint32(len(message))
+}
+
+func wasmHostAnnotate(ctx context.Context, m api.Module, kptr, klen, vptr, vlen uint32) int32 {
+	key, ok := m.Memory().Read(kptr, klen)
+	if !ok {
+		return -1
+	}
+	value, ok := m.Memory().Read(vptr, vlen)
+	if !ok {
+		return -1
+	}
+	if !ctx.Value(wasmCallKey{}).(*wasmCall).annotate(string(key), string(value)) {
+		return -1
+	}
+	return 0
+}
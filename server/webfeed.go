@@ -0,0 +1,297 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  RSS and Atom feeds of topics published on the web. Served by the web view
+ *  at <mount>/<topic>/rss and <mount>/<topic>/atom.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Number of messages in a feed
+	WEBFEED_ITEMS = 32
+	// Maximum number of feeds kept in cache
+	WEBFEED_CACHE_SIZE = 256
+	// Maximum length of the item title when it's generated from content
+	WEBFEED_TITLE_LENGTH = 80
+)
+
+// Cached rendering of a feed. The entry is valid while the topic is unchanged.
+type webFeedEntry struct {
+	seqId   int
+	clearId int
+	updated time.Time
+	modTime time.Time
+	body    []byte
+}
+
+var webFeedCache = struct {
+	sync.Mutex
+	feeds map[string]*webFeedEntry
+}{feeds: make(map[string]*webFeedEntry)}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	PubDate     string    `xml:"pubDate,omitempty"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Guid        string        `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Description string        `xml:"description"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssEnclosure struct {
+	Url    string `xml:"url,attr"`
+	Length string `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length string `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Id      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Author  *atomName  `xml:"author,omitempty"`
+	Link    []atomLink `xml:"link"`
+	Content string     `xml:"content"`
+}
+
+type atomName struct {
+	Name string `xml:"name"`
+}
+
+// serveWebFeed generates RSS or Atom feed of the published topic. The format is either "rss" or "atom".
+func serveWebFeed(wrt http.ResponseWriter, req *http.Request, topic *types.Topic, format string) {
+	name := topic.Id
+	key := name + "/" + format
+
+	webFeedCache.Lock()
+	entry := webFeedCache.feeds[key]
+	webFeedCache.Unlock()
+
+	if entry == nil || entry.seqId != topic.SeqId || entry.clearId != topic.ClearId || !entry.updated.Equal(topic.UpdatedAt) {
+		msgs, err := store.Messages.GetAll(name, types.ZeroUid,
+			&types.BrowseOpt{Limit: WEBFEED_ITEMS, Since: topic.ClearId + 1})
+		if err != nil {
+			logHttp.Warn("webfeed: failed to load messages '" + name + "' (" + err.Error() + ")")
+			wrt.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		entry = &webFeedEntry{
+			seqId:   topic.SeqId,
+			clearId: topic.ClearId,
+			updated: topic.UpdatedAt,
+			modTime: topic.UpdatedAt}
+		for i := range msgs {
+			if msgs[i].CreatedAt.After(entry.modTime) {
+				entry.modTime = msgs[i].CreatedAt
+			}
+		}
+
+		base := webView.baseUrl + webView.mount + name
+		if format == "atom" {
+			entry.body, err = webFeedAtom(topic, msgs, base, entry.modTime)
+		} else {
+			entry.body, err = webFeedRss(topic, msgs, base, entry.modTime)
+		}
+		if err != nil {
+			logHttp.Warn("webfeed: failed to render '" + name + "' (" + err.Error() + ")")
+			wrt.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		webFeedCache.Lock()
+		if len(webFeedCache.feeds) >= WEBFEED_CACHE_SIZE {
+			// Cache is full. Drop some random entry.
+			for k := range webFeedCache.feeds {
+				delete(webFeedCache.feeds, k)
+				break
+			}
+		}
+		webFeedCache.feeds[key] = entry
+		webFeedCache.Unlock()
+	}
+
+	if format == "atom" {
+		wrt.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	} else {
+		wrt.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	}
+	wrt.Header().Set("ETag", "\""+name+"."+strconv.Itoa(entry.seqId)+"."+
+		strconv.FormatInt(entry.updated.Unix(), 36)+"."+format+"\"")
+	if webView.maxAge > 0 {
+		wrt.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(webView.maxAge))
+	}
+
+	// ServeContent takes care of If-None-Match and If-Modified-Since
+	http.ServeContent(wrt, req, "", entry.modTime, bytes.NewReader(entry.body))
+}
+
+func webFeedRss(topic *types.Topic, msgs []types.Message, base string, modTime time.Time) ([]byte, error) {
+	title := webViewTitle(topic)
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        base,
+			Description: title,
+			PubDate:     modTime.Format(time.RFC1123Z)}}
+
+	for i := range msgs {
+		mm := &msgs[i]
+		if mm.DeletedAt != nil {
+			continue
+		}
+		link := base + "?before=" + strconv.Itoa(mm.SeqId+1) + "#seq" + strconv.Itoa(mm.SeqId)
+		item := rssItem{
+			Title:       webFeedItemTitle(mm),
+			Link:        link,
+			Guid:        link,
+			PubDate:     mm.CreatedAt.Format(time.RFC1123Z),
+			Description: webFeedSanitize(webViewText(mm.Content))}
+		if url, mime, size := webFeedEnclosure(mm); url != "" {
+			item.Enclosure = &rssEnclosure{Url: url, Type: mime, Length: size}
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+
+	return webFeedMarshal(&feed)
+}
+
+func webFeedAtom(topic *types.Topic, msgs []types.Message, base string, modTime time.Time) ([]byte, error) {
+	feed := atomFeed{
+		Id:      base,
+		Title:   webViewTitle(topic),
+		Updated: modTime.Format(time.RFC3339),
+		Link: []atomLink{
+			{Href: base, Rel: "alternate", Type: "text/html"},
+			{Href: base + "/atom", Rel: "self", Type: "application/atom+xml"}}}
+
+	for i := range msgs {
+		mm := &msgs[i]
+		if mm.DeletedAt != nil {
+			continue
+		}
+		link := base + "?before=" + strconv.Itoa(mm.SeqId+1) + "#seq" + strconv.Itoa(mm.SeqId)
+		entry := atomEntry{
+			Id:      link,
+			Title:   webFeedItemTitle(mm),
+			Updated: mm.CreatedAt.Format(time.RFC3339),
+			Link:    []atomLink{{Href: link, Rel: "alternate", Type: "text/html"}},
+			Content: webFeedSanitize(webViewText(mm.Content))}
+		if mm.From != "" {
+			entry.Author = &atomName{Name: types.ParseUid(mm.From).UserId()}
+		}
+		if url, mime, size := webFeedEnclosure(mm); url != "" {
+			entry.Link = append(entry.Link, atomLink{Href: url, Rel: "enclosure", Type: mime, Length: size})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	return webFeedMarshal(&feed)
+}
+
+func webFeedMarshal(feed interface{}) ([]byte, error) {
+	body, err := xml.MarshalIndent(feed, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// webFeedItemTitle uses head.title if available, otherwise the beginning of the content.
+func webFeedItemTitle(msg *types.Message) string {
+	if title := webFeedSanitize(msg.Head["title"]); title != "" {
+		return title
+	}
+
+	title := webFeedSanitize(webViewText(msg.Content))
+	if idx := strings.IndexAny(title, "\r\n"); idx >= 0 {
+		title = title[:idx]
+	}
+	return webViewSnippet(title, WEBFEED_TITLE_LENGTH)
+}
+
+// webFeedEnclosure returns media attachment of the message as described by head.enclosure,
+// head.mime and head.size.
+func webFeedEnclosure(msg *types.Message) (url, mime, size string) {
+	url = msg.Head["enclosure"]
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", "", ""
+	}
+	mime = msg.Head["mime"]
+	if mime == "" {
+		mime = "application/octet-stream"
+	}
+	size = msg.Head["size"]
+	if _, err := strconv.ParseInt(size, 10, 64); err != nil {
+		size = "0"
+	}
+	return
+}
+
+// webFeedSanitize strips markup and characters which are not permitted in XML.
+func webFeedSanitize(text string) string {
+	var buf bytes.Buffer
+	inTag := false
+	for _, r := range text {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+		case inTag:
+		case r == '\t' || r == '\n' || r == '\r':
+			buf.WriteRune(r)
+		case r < 0x20 || r == utf8.RuneError || (r >= 0xFFFE && r <= 0xFFFF):
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,438 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Outgoing webhooks. Events of topics are posted as JSON to the webhooks
+ *  configured by the operator in "webhooks" and to the webhook registered
+ *  by the owner of a group topic with {set desc={webhook: {...}}}:
+ *    {"event": "message", "topic": "grp...", "ts": "...",
+ *     "message": {"seq": 12, "from": "usr...", "head": {...}, "content": ...}}
+ *    {"event": "member", "topic": "grp...", "ts": "...",
+ *     "member": {"user": "usr...", "action": "join", "want": "JRWPS", "given": "JRWPS"}}
+ *    {"event": "delete", "topic": "grp...", "ts": "..."}
+ *  Member actions are "join", "acs" for a change of the access mode and
+ *  "leave". Requests are signed with HMAC-SHA256 of the body in the
+ *  X-Tinode-Signature header if the webhook has a secret.
+ *
+ *  Each webhook has its own queue, delivered in order by a goroutine which
+ *  exits when the queue stays empty. A failed request is retried with
+ *  backoff and the event is dropped after the maximum number of attempts;
+ *  events are also dropped when the queue is full. The queues are not
+ *  persisted. In a cluster the events of a topic are sent by the node
+ *  which hosts the topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Names of the events
+	WEBHOOK_EVENT_MESSAGE = "message"
+	WEBHOOK_EVENT_MEMBER  = "member"
+	WEBHOOK_EVENT_DELETE  = "delete"
+
+	// Default number of events waiting for delivery to one webhook
+	WEBHOOK_DEFAULT_QUEUE_SIZE = 1000
+	// Default timeout of a request
+	WEBHOOK_DEFAULT_TIMEOUT = 10 * time.Second
+	// Default number of attempts to deliver an event
+	WEBHOOK_DEFAULT_ATTEMPTS = 5
+	// Maximum delay between attempts
+	WEBHOOK_MAX_BACKOFF = time.Minute
+	// Delivery goroutine exits after the queue was empty for this long
+	WEBHOOK_IDLE_TIMEOUT = 5 * time.Minute
+)
+
+type webhookHookConfig struct {
+	// URL which receives the events
+	Url string `json:"url"`
+	// Secret for signing the requests, optional
+	Secret string `json:"secret"`
+	// Names of the topics, all topics if empty
+	Topics []string `json:"topics"`
+	// Names of the events, all events if empty
+	Events []string `json:"events"`
+}
+
+type webhooksConfig struct {
+	// Enable webhooks
+	Enabled bool `json:"enabled"`
+	// Webhooks configured by the operator
+	Hooks []webhookHookConfig `json:"hooks"`
+	// Allow owners of group topics to register webhooks
+	TopicHooks bool `json:"topic_hooks"`
+	// Maximum number of events waiting for delivery to one webhook
+	QueueSize int `json:"queue_size"`
+	// Timeout of a request, milliseconds
+	Timeout int `json:"timeout"`
+	// Number of attempts to deliver an event
+	Attempts int `json:"attempts"`
+}
+
+// Webhook configured by the operator
+type webhookHook struct {
+	url    string
+	secret string
+	topics map[string]bool
+	events map[string]bool
+}
+
+// Event posted to the webhooks
+type webhookEvent struct {
+	Event     string          `json:"event"`
+	Topic     string          `json:"topic"`
+	Timestamp time.Time       `json:"ts"`
+	Message   *webhookMessage `json:"message,omitempty"`
+	Member    *webhookMember  `json:"member,omitempty"`
+}
+
+type webhookMessage struct {
+	SeqId   int               `json:"seq"`
+	From    string            `json:"from,omitempty"`
+	Thread  int               `json:"thread,omitempty"`
+	Head    map[string]string `json:"head,omitempty"`
+	Content interface{}       `json:"content"`
+}
+
+type webhookMember struct {
+	User   string `json:"user"`
+	Action string `json:"action"`
+	Want   string `json:"want,omitempty"`
+	Given  string `json:"given,omitempty"`
+}
+
+// Queue of one webhook
+type webhookTarget struct {
+	url    string
+	secret []byte
+	queue  chan []byte
+}
+
+var webhooks struct {
+	enabled    bool
+	hooks      []*webhookHook
+	topicHooks bool
+	queueSize  int
+	attempts   int
+	client     *http.Client
+
+	// Queues of the webhooks with pending events, by URL and secret
+	lock    sync.Mutex
+	targets map[string]*webhookTarget
+
+	// Exported counters of events
+	sent    *expvar.Int
+	failed  *expvar.Int
+	dropped *expvar.Int
+}
+
+// webhooksInit parses config. Webhooks are disabled by default.
+func webhooksInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config webhooksConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logWebhooks.Fatal("Failed to parse webhooks config:", err)
+	}
+	if !config.Enabled {
+		return
+	}
+
+	for _, hc := range config.Hooks {
+		if !isValidWebhookUrl(hc.Url, false) {
+			logWebhooks.Fatalf("webhooks: invalid url '%s'", hc.Url)
+		}
+		hook := &webhookHook{url: hc.Url, secret: hc.Secret}
+		if len(hc.Topics) > 0 {
+			hook.topics = make(map[string]bool, len(hc.Topics))
+			for _, name := range hc.Topics {
+				hook.topics[name] = true
+			}
+		}
+		if len(hc.Events) > 0 {
+			if !isValidWebhookEvents(hc.Events) {
+				logWebhooks.Fatalf("webhooks: invalid events %v of '%s'", hc.Events, hc.Url)
+			}
+			hook.events = make(map[string]bool, len(hc.Events))
+			for _, name := range hc.Events {
+				hook.events[name] = true
+			}
+		}
+		webhooks.hooks = append(webhooks.hooks, hook)
+	}
+
+	webhooks.topicHooks = config.TopicHooks
+	webhooks.queueSize = config.QueueSize
+	if webhooks.queueSize <= 0 {
+		webhooks.queueSize = WEBHOOK_DEFAULT_QUEUE_SIZE
+	}
+	webhooks.attempts = config.Attempts
+	if webhooks.attempts <= 0 {
+		webhooks.attempts = WEBHOOK_DEFAULT_ATTEMPTS
+	}
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = WEBHOOK_DEFAULT_TIMEOUT
+	}
+	webhooks.client = &http.Client{Timeout: timeout}
+	webhooks.targets = make(map[string]*webhookTarget)
+
+	webhooks.sent, webhooks.failed, webhooks.dropped = new(expvar.Int), new(expvar.Int), new(expvar.Int)
+	vars := new(expvar.Map).Init()
+	vars.Set("sent", webhooks.sent)
+	vars.Set("failed", webhooks.failed)
+	vars.Set("dropped", webhooks.dropped)
+	expvar.Publish("Webhooks", vars)
+
+	webhooks.enabled = true
+
+	logWebhooks.Infof("Webhooks enabled: %d configured, topic webhooks %v", len(webhooks.hooks), webhooks.topicHooks)
+}
+
+// isValidWebhookUrl checks the URL of a webhook. Webhooks of topics must use HTTPS.
+func isValidWebhookUrl(url string, secure bool) bool {
+	return strings.HasPrefix(url, "https://") || (!secure && strings.HasPrefix(url, "http://"))
+}
+
+// isValidWebhookEvents checks if the names of the events are known.
+func isValidWebhookEvents(events []string) bool {
+	for _, name := range events {
+		if name != WEBHOOK_EVENT_MESSAGE && name != WEBHOOK_EVENT_MEMBER && name != WEBHOOK_EVENT_DELETE {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookParse converts the webhook sent by the topic owner. Returns nil if the webhook is removed.
+func webhookParse(msg *MsgWebhook) (*types.TopicWebhook, error) {
+	if msg.Url == "" {
+		return nil, nil
+	}
+	if !isValidWebhookUrl(msg.Url, true) {
+		return nil, errors.New("webhook url must be https")
+	}
+	if !isValidWebhookEvents(msg.Events) {
+		return nil, errors.New("unknown webhook event")
+	}
+	return &types.TopicWebhook{Url: msg.Url, Secret: msg.Secret, Events: msg.Events}, nil
+}
+
+// webhookDesc reports the webhook of the topic without the secret.
+func webhookDesc(hook *types.TopicWebhook) *MsgWebhook {
+	if hook == nil {
+		return nil
+	}
+	return &MsgWebhook{Url: hook.Url, Events: hook.Events}
+}
+
+// webhookOf loads the webhook of a topic which is not loaded.
+func webhookOf(topic string) *types.TopicWebhook {
+	if !webhooks.enabled || !webhooks.topicHooks || topicCat(topic) != types.TopicCat_Grp {
+		return nil
+	}
+	stopic, err := store.Topics.Get(topic)
+	if err != nil || stopic == nil {
+		return nil
+	}
+	return stopic.Webhook
+}
+
+// webhookNotify queues the event for the operator's webhooks and the webhook of the topic, if any.
+func webhookNotify(hook *types.TopicWebhook, event *webhookEvent) {
+	if !webhooks.enabled {
+		return
+	}
+
+	var body []byte
+	encode := func() bool {
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(event); err != nil {
+				logWebhooks.Warnf("webhooks: failed to encode event '%s' of '%s': %v", event.Event, event.Topic, err)
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, h := range webhooks.hooks {
+		if (h.topics == nil || h.topics[event.Topic]) && (h.events == nil || h.events[event.Event]) {
+			if !encode() {
+				return
+			}
+			webhookEnqueue(h.url, h.secret, body)
+		}
+	}
+
+	if hook != nil && webhooks.topicHooks {
+		wanted := len(hook.Events) == 0
+		for _, name := range hook.Events {
+			wanted = wanted || name == event.Event
+		}
+		if wanted && encode() {
+			webhookEnqueue(hook.Url, hook.Secret, body)
+		}
+	}
+}
+
+// webhookEnqueue adds the event to the queue of the webhook, starting its delivery goroutine if needed.
+func webhookEnqueue(url, secret string, body []byte) {
+	key := url + "\x00" + secret
+
+	webhooks.lock.Lock()
+	defer webhooks.lock.Unlock()
+
+	target := webhooks.targets[key]
+	if target == nil {
+		target = &webhookTarget{url: url, secret: []byte(secret), queue: make(chan []byte, webhooks.queueSize)}
+		webhooks.targets[key] = target
+		go target.run(key)
+	}
+
+	select {
+	case target.queue <- body:
+	default:
+		webhooks.dropped.Add(1)
+		logWebhooks.Warnf("webhooks: queue of '%s' is full, event dropped", url)
+	}
+}
+
+// run delivers the queued events in order until the queue stays empty.
+func (wt *webhookTarget) run(key string) {
+	idle := time.NewTimer(WEBHOOK_IDLE_TIMEOUT)
+	defer idle.Stop()
+
+	for {
+		select {
+		case body := <-wt.queue:
+			wt.deliver(body)
+		case <-idle.C:
+			// Events are queued under the same lock: none can be lost once the target is removed
+			webhooks.lock.Lock()
+			if len(wt.queue) == 0 {
+				delete(webhooks.targets, key)
+				webhooks.lock.Unlock()
+				return
+			}
+			webhooks.lock.Unlock()
+		}
+
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(WEBHOOK_IDLE_TIMEOUT)
+	}
+}
+
+// deliver posts the event, retrying with backoff.
+func (wt *webhookTarget) deliver(body []byte) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := wt.post(body)
+		if err == nil {
+			webhooks.sent.Add(1)
+			return
+		}
+		if attempt >= webhooks.attempts {
+			webhooks.failed.Add(1)
+			logWebhooks.Warnf("webhooks: event to '%s' dropped after %d attempts: %v", wt.url, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > WEBHOOK_MAX_BACKOFF {
+			backoff = WEBHOOK_MAX_BACKOFF
+		}
+	}
+}
+
+// post sends one event signed with HMAC-SHA256 of the body in the X-Tinode-Signature header.
+func (wt *webhookTarget) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wt.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wt.secret) > 0 {
+		mac := hmac.New(sha256.New, wt.secret)
+		mac.Write(body)
+		req.Header.Set("X-Tinode-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhooks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected response status " + resp.Status)
+	}
+	return nil
+}
+
+// webhookMessageSaved sends the event of a message saved into the topic.
+func webhookMessageSaved(hook *types.TopicWebhook, msg *types.Message) {
+	webhookNotify(hook, &webhookEvent{
+		Event:     WEBHOOK_EVENT_MESSAGE,
+		Topic:     msg.Topic,
+		Timestamp: msg.CreatedAt,
+		Message: &webhookMessage{
+			SeqId:   msg.SeqId,
+			From:    types.ParseUid(msg.From).UserId(),
+			Thread:  msg.Thread,
+			Head:    msg.Head,
+			Content: msg.Content}})
+}
+
+// webhookMemberChanged sends the event of a subscription created, changed or removed.
+func webhookMemberChanged(hook *types.TopicWebhook, topic string, uid types.Uid, action string,
+	want, given types.AccessMode) {
+	member := &webhookMember{User: uid.UserId(), Action: action}
+	if action != "leave" {
+		member.Want, member.Given = want.String(), given.String()
+	}
+	webhookNotify(hook, &webhookEvent{
+		Event:     WEBHOOK_EVENT_MEMBER,
+		Topic:     topic,
+		Timestamp: types.TimeNow(),
+		Member:    member})
+}
+
+// webhookTopicDeleted sends the event of a deleted topic.
+func webhookTopicDeleted(hook *types.TopicWebhook, topic string) {
+	webhookNotify(hook, &webhookEvent{
+		Event:     WEBHOOK_EVENT_DELETE,
+		Topic:     topic,
+		Timestamp: types.TimeNow()})
+}
+
+// webhookMember sends the event of a change of the user's subscription to the topic.
+func (t *Topic) webhookMember(uid types.Uid, action string, pud perUserData) {
+	if t.cat == types.TopicCat_Me || t.cat == types.TopicCat_Fnd {
+		return
+	}
+	webhookMemberChanged(t.webhook, t.name, uid, action, pud.modeWant, pud.modeGiven)
+}
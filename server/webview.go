@@ -0,0 +1,400 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Read-only web view of group topics and channels which were published by
+ *  the owner.
+ *  No authentication is required: the topic owner must explicitly opt in
+ *  by setting desc.web = true. Search engines are asked not to index the
+ *  pages and feeds and the topic is not listed in the sitemap unless the
+ *  owner also sets desc.webindex = true.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default URL path where the web view is mounted
+	WEBVIEW_DEFAULT_MOUNT = "/v0/pub/"
+	// Default number of messages per page
+	WEBVIEW_DEFAULT_PAGE_SIZE = 24
+	// Maximum number of messages per page
+	WEBVIEW_MAX_PAGE_SIZE = 128
+	// Maximum length of description in page metadata
+	WEBVIEW_DESCRIPTION_LENGTH = 200
+	// Maximum number of URLs in a sitemap
+	WEBVIEW_SITEMAP_SIZE = 50000
+	// How long the sitemap is cached
+	WEBVIEW_SITEMAP_TTL = 5 * time.Minute
+)
+
+type webViewConfig struct {
+	// Enable web view of published topics
+	Enabled bool `json:"enabled"`
+	// URL path to mount the web view at, WEBVIEW_DEFAULT_MOUNT if missing
+	Mount string `json:"mount"`
+	// Number of messages per page
+	PageSize int `json:"page_size"`
+	// Value of max-age in Cache-Control header, seconds
+	MaxAge int `json:"max_age"`
+	// Public base URL of the server, e.g. "https://chat.example.com", used in links of feeds, sitemap and
+	// page metadata. The Host header of the request is not trusted: the links are cached.
+	BaseUrl string `json:"base_url"`
+}
+
+// Page of topic history as served to the web client
+type webViewPage struct {
+	Topic    string           `json:"topic"`
+	Public   interface{}      `json:"public,omitempty"`
+	Messages []*MsgServerData `json:"messages"`
+	// URL of the page with older messages, if any
+	Next string `json:"next,omitempty"`
+}
+
+// OpenGraph and Twitter card metadata of the page
+type webViewMeta struct {
+	Title       string
+	Description string
+	Url         string
+	Image       string
+}
+
+type sitemapUrlset struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	Urls    []sitemapUrl `xml:"url"`
+}
+
+type sitemapUrl struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+var webView struct {
+	mount    string
+	pageSize int
+	maxAge   int
+	baseUrl  string
+	tmpl     *template.Template
+
+	// Cached sitemap
+	sitemapLock    sync.Mutex
+	sitemap        []byte
+	sitemapExpires time.Time
+}
+
+// webViewInit parses config and mounts the handler. The web view is off by default.
+func webViewInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config webViewConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logHttp.Fatal("Failed to parse web_view config:", err)
+	}
+
+	if !config.Enabled {
+		return
+	}
+
+	webView.mount = config.Mount
+	if webView.mount == "" {
+		webView.mount = WEBVIEW_DEFAULT_MOUNT
+	} else {
+		if !strings.HasPrefix(webView.mount, "/") {
+			webView.mount = "/" + webView.mount
+		}
+		if !strings.HasSuffix(webView.mount, "/") {
+			webView.mount = webView.mount + "/"
+		}
+	}
+
+	webView.pageSize = config.PageSize
+	if webView.pageSize <= 0 {
+		webView.pageSize = WEBVIEW_DEFAULT_PAGE_SIZE
+	} else if webView.pageSize > WEBVIEW_MAX_PAGE_SIZE {
+		webView.pageSize = WEBVIEW_MAX_PAGE_SIZE
+	}
+	webView.maxAge = config.MaxAge
+
+	if !webViewValidUrl(config.BaseUrl) {
+		logHttp.Fatal("web_view: base_url must be an absolute http(s) URL")
+	}
+	webView.baseUrl = strings.TrimSuffix(config.BaseUrl, "/")
+
+	webView.tmpl = template.Must(template.New("webview").Funcs(template.FuncMap{
+		"text": webViewText,
+	}).Parse(webViewTemplate))
+
+	http.HandleFunc(webView.mount, serveWebView)
+	logHttp.Infof("Serving web view of published topics at '%s'", webView.mount)
+}
+
+// serveWebView handles GET requests like /v0/pub/grpXXXXX?before=123&limit=20[&format=json],
+// /v0/pub/grpXXXXX/rss or /v0/pub/grpXXXXX/atom, and /v0/pub/sitemap.xml.
+// Channels are served the same way as /v0/pub/chnXXXXX.
+func serveWebView(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		wrt.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(wrt).Encode(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	name := strings.TrimPrefix(req.URL.Path, webView.mount)
+	if name == "sitemap.xml" {
+		serveWebSitemap(wrt, req)
+		return
+	}
+
+	// RSS or Atom feed is requested as <topic>/rss or <topic>/atom
+	feed := ""
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		name, feed = parts[0], parts[1]
+		if feed != "rss" && feed != "atom" {
+			serve404(wrt, req)
+			return
+		}
+	}
+	if !strings.HasPrefix(name, "grp") && !strings.HasPrefix(name, "chn") {
+		serve404(wrt, req)
+		return
+	}
+
+	topic, err := store.Topics.Get(name)
+	if err != nil {
+		logHttp.Warn("webview: failed to load topic '" + name + "' (" + err.Error() + ")")
+		wrt.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(wrt).Encode(ErrUnknown("", name, now))
+		return
+	}
+	// Unpublished topics are indistinguishable from missing ones.
+	if topic == nil || topic.DeletedAt != nil || !topic.WebView {
+		serve404(wrt, req)
+		return
+	}
+	if !topic.WebIndex {
+		wrt.Header().Set("X-Robots-Tag", "noindex")
+	}
+
+	if feed != "" {
+		serveWebFeed(wrt, req, topic, feed)
+		return
+	}
+
+	limit := webView.pageSize
+	if val, err := strconv.Atoi(req.FormValue("limit")); err == nil && val > 0 && val < limit {
+		limit = val
+	}
+	opts := &types.BrowseOpt{Limit: uint(limit), Since: topic.ClearId + 1}
+	if val, err := strconv.Atoi(req.FormValue("before")); err == nil && val > 0 {
+		opts.Before = val
+	}
+
+	msgs, err := store.Messages.GetAll(name, types.ZeroUid, opts)
+	if err != nil {
+		logHttp.Warn("webview: failed to load messages '" + name + "' (" + err.Error() + ")")
+		wrt.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(wrt).Encode(ErrUnknown("", name, now))
+		return
+	}
+
+	page := &webViewPage{Topic: name, Public: topic.Public, Messages: make([]*MsgServerData, 0, len(msgs))}
+	lowest := 0
+	for i := range msgs {
+		mm := &msgs[i]
+		if lowest == 0 || mm.SeqId < lowest {
+			lowest = mm.SeqId
+		}
+		if mm.DeletedAt != nil {
+			continue
+		}
+		page.Messages = append(page.Messages, &MsgServerData{
+			Topic:     name,
+			From:      types.ParseUid(mm.From).UserId(),
+			Timestamp: mm.CreatedAt,
+			SeqId:     mm.SeqId,
+			Head:      mm.Head,
+			Content:   mm.Content})
+	}
+	if len(msgs) == limit && lowest > topic.ClearId+1 {
+		page.Next = webView.mount + name + "?before=" + strconv.Itoa(lowest) + "&limit=" + strconv.Itoa(limit)
+	}
+
+	if webView.maxAge > 0 {
+		wrt.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(webView.maxAge))
+	}
+
+	if req.FormValue("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		if page.Next != "" {
+			page.Next += "&format=json"
+		}
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(wrt).Encode(page)
+		return
+	}
+
+	meta := &webViewMeta{
+		Title: webViewTitle(topic),
+		Url:   webView.baseUrl + webView.mount + name,
+		Image: webViewImage(topic.Public)}
+	// Describe the page with the latest message
+	for _, msg := range page.Messages {
+		if text := webFeedSanitize(webViewText(msg.Content)); text != "" {
+			meta.Description = webViewSnippet(strings.Join(strings.Fields(text), " "), WEBVIEW_DESCRIPTION_LENGTH)
+			break
+		}
+	}
+
+	wrt.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webView.tmpl.Execute(wrt, map[string]interface{}{
+		"Title":   meta.Title,
+		"Meta":    meta,
+		"Page":    page,
+		"NoIndex": !topic.WebIndex,
+	}); err != nil {
+		logHttp.Warn("webview: failed to render '" + name + "' (" + err.Error() + ")")
+	}
+}
+
+// webViewTitle returns topic's public.fn or topic name if fn is unavailable.
+func webViewTitle(topic *types.Topic) string {
+	if public, ok := topic.Public.(map[string]interface{}); ok {
+		if fn, ok := public["fn"].(string); ok && fn != "" {
+			return fn
+		}
+	}
+	return topic.Id
+}
+
+// serveWebSitemap lists the topics published on the web which may be indexed.
+func serveWebSitemap(wrt http.ResponseWriter, req *http.Request) {
+	webView.sitemapLock.Lock()
+	defer webView.sitemapLock.Unlock()
+
+	if webView.sitemap == nil || webView.sitemapExpires.Before(time.Now()) {
+		topics, err := store.Topics.GetWebIndex(WEBVIEW_SITEMAP_SIZE)
+		if err != nil {
+			logHttp.Warn("webview: failed to load published topics (" + err.Error() + ")")
+			wrt.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		base := webView.baseUrl + webView.mount
+		urlset := sitemapUrlset{Urls: make([]sitemapUrl, 0, len(topics))}
+		for i := range topics {
+			urlset.Urls = append(urlset.Urls, sitemapUrl{
+				Loc:     base + topics[i].Id,
+				LastMod: topics[i].UpdatedAt.Format(time.RFC3339)})
+		}
+
+		sitemap, err := webFeedMarshal(&urlset)
+		if err != nil {
+			logHttp.Warn("webview: failed to render sitemap (" + err.Error() + ")")
+			wrt.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		webView.sitemap = sitemap
+		webView.sitemapExpires = time.Now().Add(WEBVIEW_SITEMAP_TTL)
+	}
+
+	wrt.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	wrt.Write(webView.sitemap)
+}
+
+// webViewValidUrl checks if the string is an absolute http(s) URL which may serve as a base for links.
+func webViewValidUrl(str string) bool {
+	u, err := url.Parse(str)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		u.RawQuery == "" && u.Fragment == ""
+}
+
+// webViewImage returns URL of topic's avatar if public.photo is a link rather than inline data.
+func webViewImage(public interface{}) string {
+	pub, ok := public.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	var url string
+	switch photo := pub["photo"].(type) {
+	case string:
+		url = photo
+	case map[string]interface{}:
+		url, _ = photo["ref"].(string)
+	}
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return url
+	}
+	return ""
+}
+
+// webViewSnippet truncates text to at most length runes.
+func webViewSnippet(text string, length int) string {
+	if utf8.RuneCountInString(text) > length {
+		runes := []rune(text)
+		text = string(runes[:length-1]) + "…"
+	}
+	return text
+}
+
+// webViewText converts message content to plain text suitable for rendering.
+func webViewText(content interface{}) string {
+	if str, ok := content.(string); ok {
+		return str
+	}
+	if raw, err := json.Marshal(content); err == nil {
+		return string(raw)
+	}
+	return ""
+}
+
+const webViewTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+{{if .NoIndex}}<meta name="robots" content="noindex">
+{{end}}{{with .Meta}}<link rel="canonical" href="{{.Url}}">
+<meta name="description" content="{{.Description}}">
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:url" content="{{.Url}}">
+<meta property="og:description" content="{{.Description}}">
+{{if .Image}}<meta property="og:image" content="{{.Image}}">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:image" content="{{.Image}}">
+{{else}}<meta name="twitter:card" content="summary">
+{{end}}<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:description" content="{{.Description}}">
+{{end}}<link rel="alternate" type="application/json" href="?format=json">
+<link rel="alternate" type="application/rss+xml" title="RSS" href="{{.Page.Topic}}/rss">
+<link rel="alternate" type="application/atom+xml" title="Atom" href="{{.Page.Topic}}/atom">
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Page.Messages}}<div class="msg" id="seq{{.SeqId}}">
+<div class="head"><span class="from">{{.From}}</span> <time datetime="{{.Timestamp.Format "2006-01-02T15:04:05Z07:00"}}">{{.Timestamp.Format "Jan 2, 2006 15:04"}}</time></div>
+<div class="content">{{text .Content}}</div>
+</div>
+{{else}}<p>No messages.</p>
+{{end}}{{if .Page.Next}}<p><a href="{{.Page.Next}}" rel="next">Older messages</a></p>{{end}}
+</body>
+</html>
+`
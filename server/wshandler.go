@@ -9,7 +9,8 @@
 package main
 
 import (
-	"log"
+	"compress/flate"
+	"encoding/json"
 	"net/http"
 	"time"
 
@@ -25,8 +26,59 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Messages shorter than this are not compressed by default
+	WS_COMPRESSION_DEFAULT_THRESHOLD = 256
 )
 
+type wsCompressionConfig struct {
+	// Compress messages to clients which support permessage-deflate
+	Enabled bool `json:"enabled"`
+	// Compression level from -2 (Huffman only) to 9 (best compression), 1 (best speed) if 0
+	Level int `json:"level"`
+	// Messages shorter than this number of bytes are sent uncompressed
+	Threshold int `json:"threshold"`
+}
+
+var wsCompression struct {
+	enabled   bool
+	level     int
+	threshold int
+}
+
+// wsCompressionInit enables permessage-deflate if configured. Messages are not compressed by default.
+func wsCompressionInit(jsconfig json.RawMessage) {
+	if len(jsconfig) == 0 {
+		return
+	}
+
+	var config wsCompressionConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		logMain.Fatal("Failed to parse ws_compression config:", err)
+	}
+	if !config.Enabled {
+		return
+	}
+
+	if config.Level == 0 {
+		config.Level = flate.BestSpeed
+	}
+	if config.Level < flate.HuffmanOnly || config.Level > flate.BestCompression {
+		logMain.Fatal("ws_compression: invalid level", config.Level)
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = WS_COMPRESSION_DEFAULT_THRESHOLD
+	}
+
+	wsCompression.enabled = true
+	wsCompression.level = config.Level
+	wsCompression.threshold = config.Threshold
+	upgrader.EnableCompression = true
+
+	logMain.Infof("Websocket compression enabled, level %d, messages from %d bytes", config.Level,
+		config.Threshold)
+}
+
 func (s *Session) closeWS() {
 	if s.proto == WEBSOCK {
 		s.ws.Close()
@@ -35,7 +87,7 @@ func (s *Session) closeWS() {
 
 func (sess *Session) readLoop() {
 	defer func() {
-		log.Println("serveWebsocket - stop")
+		logSession.Debug("serveWebsocket - stop")
 		sess.closeWS()
 		globals.sessionStore.Delete(sess)
 		globals.cluster.sessionGone(sess)
@@ -45,7 +97,7 @@ func (sess *Session) readLoop() {
 		}
 	}()
 
-	sess.ws.SetReadLimit(globals.maxMessageSize)
+	sess.ws.SetReadLimit(maxMessageSize())
 	sess.ws.SetReadDeadline(time.Now().Add(pongWait))
 	sess.ws.SetPongHandler(func(string) error {
 		sess.ws.SetReadDeadline(time.Now().Add(pongWait))
@@ -56,7 +108,7 @@ func (sess *Session) readLoop() {
 	for {
 		// Read a ClientComMessage
 		if _, raw, err := sess.ws.ReadMessage(); err != nil {
-			log.Println("sess.readLoop: " + err.Error())
+			logSession.Warn("sess.readLoop: " + err.Error())
 			return
 		} else {
 			sess.dispatchRaw(raw)
@@ -72,6 +124,10 @@ func (sess *Session) writeLoop() {
 		sess.closeWS() // break readLoop
 	}()
 
+	write := func(msg []byte, class int) error {
+		return sess.wsWriteMessage(msg)
+	}
+
 	for {
 		select {
 		case msg, ok := <-sess.send:
@@ -79,31 +135,74 @@ func (sess *Session) writeLoop() {
 				// channel closed
 				return
 			}
-			if err := ws_write(sess.ws, websocket.TextMessage, msg); err != nil {
-				log.Println("sess.writeLoop: " + err.Error())
+			if err := sess.wsWriteMessage(msg); err != nil {
+				logSession.Warn("sess.writeLoop: " + err.Error())
+				return
+			}
+		case msg := <-sess.sendPres:
+			if err := sess.writeQueued(msg, SEND_CLASS_PRES, write); err != nil {
+				logSession.Warn("sess.writeLoop: " + err.Error())
+				return
+			}
+		case msg := <-sess.sendTyping:
+			if err := sess.writeQueued(msg, SEND_CLASS_TYPING, write); err != nil {
+				logSession.Warn("sess.writeLoop: " + err.Error())
 				return
 			}
 		case msg := <-sess.stop:
-			// Shutdown requested, don't care if the message is delivered
+			// Shutdown requested. Write the messages and notifications already queued, then the notice,
+			// don't care if they are delivered
+			for {
+				queued, _, ok := sess.nextUrgent(SEND_CLASS_TYPING)
+				if !ok {
+					break
+				}
+				if err := sess.wsWriteMessage(queued); err != nil {
+					return
+				}
+			}
 			if msg != nil {
-				ws_write(sess.ws, websocket.TextMessage, msg)
+				sess.wsWriteMessage(msg)
 			}
 			return
 
 		case topic := <-sess.detach:
 			delete(sess.subs, topic)
 
+		case <-sess.hibernate:
+			sess.hibernateTopics()
+
 		case <-ticker.C:
 			if err := ws_write(sess.ws, websocket.PingMessage, []byte{}); err != nil {
-				log.Println("sess.writeLoop: ping/" + err.Error())
+				logSession.Warn("sess.writeLoop: ping/" + err.Error())
 				return
 			}
 		}
 	}
 }
 
+// wsWriteMessage writes a message taken from the queues: JSON in a text frame or the negotiated
+// binary encoding in a binary frame.
+func (sess *Session) wsWriteMessage(msg []byte) error {
+	if sess.enc == nil {
+		return ws_write(sess.ws, websocket.TextMessage, msg)
+	}
+
+	frame, err := sess.encodeFrame(msg)
+	if err != nil {
+		// Don't drop the connection because of one message
+		logSession.Warn("sess.writeLoop: failed to encode message", err)
+		return nil
+	}
+	return ws_write(sess.ws, websocket.BinaryMessage, frame)
+}
+
 // Writes a message with the given message type (mt) and payload.
 func ws_write(ws *websocket.Conn, mt int, payload []byte) error {
+	if wsCompression.enabled {
+		// Short messages grow when compressed. No effect if the client did not negotiate compression.
+		ws.EnableWriteCompression(len(payload) >= wsCompression.threshold)
+	}
 	ws.SetWriteDeadline(time.Now().Add(writeWait))
 	return ws.WriteMessage(mt, payload)
 }
@@ -119,26 +218,51 @@ var upgrader = websocket.Upgrader{
 func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
 	if isValid, _ := checkApiKey(getApiKey(req)); !isValid {
 		http.Error(wrt, "Missing, invalid or expired API key", http.StatusForbidden)
-		log.Println("ws: Missing, invalid or expired API key")
+		logSession.Warn("ws: Missing, invalid or expired API key")
 		return
 	}
 
 	if req.Method != "GET" {
 		http.Error(wrt, "Method not allowed", http.StatusMethodNotAllowed)
-		log.Println("ws: Invalid HTTP method")
+		logSession.Warn("ws: Invalid HTTP method")
+		return
+	}
+
+	if redirectToPrimary(wrt, req) {
+		return
+	}
+
+	if globals.cluster.isCordoned() {
+		// The node is being restarted, the client should connect to another node
+		http.Error(wrt, "Node is restarting", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Encoding requested in the query, a subprotocol takes precedence
+	fenc, ok := frameEncodingByName(req.FormValue("enc"))
+	if !ok {
+		http.Error(wrt, "Unknown encoding", http.StatusBadRequest)
 		return
 	}
 
 	ws, err := upgrader.Upgrade(wrt, req, nil)
 	if _, ok := err.(websocket.HandshakeError); ok {
-		log.Println("ws: Not a websocket handshake")
+		logSession.Warn("ws: Not a websocket handshake")
 		return
 	} else if err != nil {
-		log.Println("ws: failed to Upgrade ", err.Error())
+		logSession.Warn("ws: failed to Upgrade", err.Error())
 		return
 	}
+	if protocol := ws.Subprotocol(); protocol != "" {
+		fenc, _ = frameEncodingByName(protocol)
+	}
+
+	if wsCompression.enabled {
+		ws.SetCompressionLevel(wsCompression.level)
+	}
 
 	sess := globals.sessionStore.Create(ws, "")
+	sess.enc = fenc
 
 	go sess.writeLoop()
 	sess.readLoop()
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// fsck checks the database for inconsistencies and optionally repairs them. The server should
+// not be running when problems are repaired.
+func fsck(repair bool, dbsource string) {
+	log.Println("Opening DB...")
+
+	if err := store.Open(dbsource); err != nil {
+		log.Fatal("Failed to connect to DB: ", err)
+	}
+	defer store.Close()
+
+	log.Println("Checking DB...")
+
+	var found, repaired int
+	err := store.Fsck(repair, func(issue *types.FsckIssue) {
+		found++
+		status := ""
+		if issue.Repaired {
+			repaired++
+			status = " [repaired]"
+		}
+		log.Printf("%s '%s': %s%s", issue.Kind, issue.Object, issue.Detail, status)
+	})
+	if err != nil {
+		log.Fatal("Check failed: ", err)
+	}
+
+	log.Printf("Found %d problems, repaired %d", found, repaired)
+}
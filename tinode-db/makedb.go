@@ -32,6 +32,8 @@ func main() {
 	var reset = flag.Bool("reset", false, "first delete the database if one exists")
 	var datafile = flag.String("data", "", "name of file with sample data")
 	var conffile = flag.String("config", "./tinode.conf", "config of the database connection")
+	var check = flag.Bool("fsck", false, "check the database for inconsistencies instead of creating it")
+	var repair = flag.Bool("repair", false, "with -fsck, repair the inconsistencies found")
 	flag.Parse()
 
 	var data Data
@@ -55,7 +57,11 @@ func main() {
 			log.Fatal(err)
 		}
 
-		gen_rethink(*reset, string(config.StoreConfig), &data)
+		if *check {
+			fsck(*repair, string(config.StoreConfig))
+		} else {
+			gen_rethink(*reset, string(config.StoreConfig), &data)
+		}
 	} else {
 		log.Println("No config provided. Exiting.")
 	}